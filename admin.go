@@ -0,0 +1,79 @@
+package goproxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// AdminHandler returns the handler of the administration API of the proxy, to be served on a
+// private listener:
+//
+//	GET /debug            the components being debugged, e.g. "dns,tls"
+//	PUT /debug            sets the components being debugged from the request body
+//	GET /handlers         the request, response and CONNECT handler chains, in JSON
+//	GET /bandwidth?top=N  the N destination domains with the most traffic, in JSON
+//	GET /validate         the diagnostics of the configuration of the proxy, in JSON
+//	GET /config           the effective configuration of the proxy, secrets redacted, in
+//	                      JSON, or in YAML with ?format=yaml
+//	GET /sessions         the requests and tunnels in progress, in JSON
+//	GET /errors           the recent warnings and errors, in JSON, filtered with
+//	                      ?level=error, ?session=N and the last ones with ?limit=N
+//	GET /selftest?url=U   the outcome of every step of the pipeline for a GET of U, in JSON,
+//	                      see SelfTest
+//	GET /traces           the diagnostic traces of the requests kept, in JSON
+//	GET /traces/ID        the trace ID, from the X-Proxy-Trace-Id header of a response
+//	GET /bundle           a support bundle, see WriteSupportBundle
+//	GET /capabilities     the socket options and features available, in JSON, see
+//	                      Capabilities
+//	GET /drain            the draining forward proxies and destinations, in JSON
+//	PUT /drain            marks the forward proxy ?upstream=H:P or the destination
+//	                      ?destination=H as draining, see DrainFlags
+//	DELETE /drain         clears the drain flag of ?upstream=H:P or ?destination=H
+//	GET /slo              the ratios and burn rates of the objectives of SLO, in JSON
+//
+// The profiling routes of AdminProfiling are served under /debug/ too.
+func (proxy *ProxyHttpServer) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug", proxy.serveDebugFlags)
+	mux.HandleFunc("/handlers", proxy.serveHandlers)
+	mux.HandleFunc("/bandwidth", proxy.serveBandwidth)
+	mux.HandleFunc("/validate", proxy.serveValidate)
+	mux.HandleFunc("/config", proxy.serveConfig)
+	mux.HandleFunc("/sessions", proxy.serveSessions)
+	mux.HandleFunc("/errors", proxy.serveErrorLog)
+	mux.HandleFunc("/selftest", proxy.serveSelfTest)
+	mux.HandleFunc("/traces", proxy.serveTraces)
+	mux.HandleFunc("/traces/", proxy.serveTraces)
+	mux.HandleFunc("/bundle", proxy.serveSupportBundle)
+	mux.HandleFunc("/capabilities", proxy.serveCapabilities)
+	mux.HandleFunc("/drain", proxy.serveDrain)
+	mux.HandleFunc("/slo", proxy.serveSLO)
+	proxy.handleProfiling(mux)
+	return mux
+}
+
+func (proxy *ProxyHttpServer) serveDebugFlags(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET", "HEAD":
+	case "PUT", "POST":
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1024))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		flags, err := ParseDebugFlags(strings.TrimSpace(string(body)))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		proxy.SetDebug(flags)
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprintln(w, proxy.Debug())
+}
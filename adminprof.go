@@ -0,0 +1,215 @@
+package goproxy
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AdminProfiling exposes the profiles and the runtime statistics of the process on the admin
+// API. As the profiles reveal the memory of the process, its routes are only served to the
+// requests carrying Token, as "Authorization: Bearer <token>":
+//
+//	GET  /debug/pprof/           the names of the profiles
+//	GET  /debug/pprof/NAME       the profile NAME, e.g. heap or goroutine, in text with
+//	                             ?debug=1, a CPU profile of ?seconds=S if NAME is profile, an
+//	                             execution trace if it is trace
+//	GET  /debug/runtime          the goroutines, heap and GC statistics, in JSON
+//	POST /debug/dump?kind=K      writes a dump of the heap or of the goroutines to DumpDir,
+//	                             and returns its path in JSON
+type AdminProfiling struct {
+	// Token is the bearer token of the requests to the profiling routes, which are not
+	// served if it is empty
+	Token string
+	// DumpDir is the directory of the dumps, os.TempDir() if empty
+	DumpDir string
+}
+
+// RuntimeStats are the runtime statistics of the process served on /debug/runtime
+type RuntimeStats struct {
+	Goroutines     int           `json:"goroutines"`
+	GOMAXPROCS     int           `json:"gomaxprocs"`
+	HeapAlloc      uint64        `json:"heap_alloc"`
+	HeapInuse      uint64        `json:"heap_inuse"`
+	HeapObjects    uint64        `json:"heap_objects"`
+	Sys            uint64        `json:"sys"`
+	NumGC          uint32        `json:"num_gc"`
+	PauseTotal     time.Duration `json:"pause_total"`
+	LastGC         time.Time     `json:"last_gc"`
+	NextGC         uint64        `json:"next_gc"`
+	TotalAlloc     uint64        `json:"total_alloc"`
+	ActiveRequests int64         `json:"active_requests"`
+	ActiveTunnels  int64         `json:"active_tunnels"`
+}
+
+// RuntimeStats returns the runtime statistics of the process and the sessions in progress
+func (proxy *ProxyHttpServer) RuntimeStats() RuntimeStats {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	s := RuntimeStats{
+		Goroutines:  runtime.NumGoroutine(),
+		GOMAXPROCS:  runtime.GOMAXPROCS(0),
+		HeapAlloc:   m.HeapAlloc,
+		HeapInuse:   m.HeapInuse,
+		HeapObjects: m.HeapObjects,
+		Sys:         m.Sys,
+		NumGC:       m.NumGC,
+		PauseTotal:  time.Duration(m.PauseTotalNs),
+		NextGC:      m.NextGC,
+		TotalAlloc:  m.TotalAlloc,
+	}
+	if m.LastGC > 0 {
+		s.LastGC = time.Unix(0, int64(m.LastGC))
+	}
+	s.ActiveRequests, s.ActiveTunnels = proxy.ActiveSessions()
+	return s
+}
+
+// authorizeProfiling serves the requests to h carrying the token of AdminProfiling, 404 if
+// it is not set up
+func (proxy *ProxyHttpServer) authorizeProfiling(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p := proxy.AdminProfiling
+		if p == nil || p.Token == "" {
+			http.Error(w, "profiling is not enabled", http.StatusNotFound)
+			return
+		}
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(p.Token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="goproxy admin"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// Dump writes a dump of the heap, or of the stacks of the goroutines if kind is
+// "goroutine", to DumpDir, and returns its path
+func (p *AdminProfiling) Dump(kind string) (string, error) {
+	profile := pprof.Lookup(kind)
+	if profile == nil || (kind != "heap" && kind != "goroutine") {
+		return "", fmt.Errorf("unknown dump %q, expecting heap or goroutine", kind)
+	}
+	dir := p.DumpDir
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	f, err := ioutil.TempFile(dir, fmt.Sprintf("goproxy-%s-%s-*.pprof", kind, time.Now().UTC().Format("20060102T150405Z")))
+	if err != nil {
+		return "", err
+	}
+	if kind == "heap" {
+		// the heap profile is as of the last GC
+		runtime.GC()
+	}
+	err = profile.WriteTo(f, 0)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// handleProfiling registers the profiling routes of AdminProfiling on mux
+func (proxy *ProxyHttpServer) handleProfiling(mux *http.ServeMux) {
+	mux.HandleFunc("/debug/pprof/", proxy.authorizeProfiling(servePprof))
+	mux.HandleFunc("/debug/runtime", proxy.authorizeProfiling(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", ContentTypeJSON)
+		json.NewEncoder(w).Encode(proxy.RuntimeStats())
+	}))
+	mux.HandleFunc("/debug/dump", proxy.authorizeProfiling(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		kind := r.URL.Query().Get("kind")
+		if kind == "" {
+			kind = "heap"
+		}
+		path, err := proxy.AdminProfiling.Dump(kind)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", ContentTypeJSON)
+		json.NewEncoder(w).Encode(map[string]string{"kind": kind, "path": path})
+	}))
+}
+
+// servePprof serves the profiles of the process like net/http/pprof, which is not imported
+// as it serves them on http.DefaultServeMux, without authentication
+func servePprof(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/debug/pprof/")
+	seconds, err := strconv.Atoi(r.URL.Query().Get("seconds"))
+	if err != nil || seconds <= 0 {
+		seconds = 30
+		if name == "trace" {
+			seconds = 1
+		}
+	}
+	switch name {
+	case "":
+		w.Header().Set("Content-Type", "text/plain")
+		for _, p := range pprof.Profiles() {
+			fmt.Fprintf(w, "%s %d\n", p.Name(), p.Count())
+		}
+		fmt.Fprintln(w, "profile")
+		fmt.Fprintln(w, "trace")
+	case "profile":
+		w.Header().Set("Content-Type", "application/octet-stream")
+		if err := pprof.StartCPUProfile(w); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		sleepRequest(r, time.Duration(seconds)*time.Second)
+		pprof.StopCPUProfile()
+	case "trace":
+		w.Header().Set("Content-Type", "application/octet-stream")
+		if err := trace.Start(w); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		sleepRequest(r, time.Duration(seconds)*time.Second)
+		trace.Stop()
+	default:
+		p := pprof.Lookup(name)
+		if p == nil {
+			http.Error(w, "unknown profile "+name, http.StatusNotFound)
+			return
+		}
+		debug, _ := strconv.Atoi(r.URL.Query().Get("debug"))
+		if debug > 0 {
+			w.Header().Set("Content-Type", "text/plain")
+		} else {
+			w.Header().Set("Content-Type", "application/octet-stream")
+		}
+		if name == "heap" && r.URL.Query().Get("gc") != "" {
+			runtime.GC()
+		}
+		p.WriteTo(w, debug)
+	}
+}
+
+// sleepRequest waits for d, or until the client of r is gone
+func sleepRequest(r *http.Request, d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-r.Context().Done():
+	}
+}
@@ -0,0 +1,58 @@
+package goproxy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestAdminProfiling(t *testing.T) {
+	proxy := NewProxyHttpServer()
+	admin := proxy.AdminHandler()
+	serve := func(method, path, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		admin.ServeHTTP(rec, req)
+		return rec
+	}
+	if rec := serve("GET", "/debug/runtime", "s3cret"); rec.Code != http.StatusNotFound {
+		t.Errorf("profiling served without AdminProfiling: %d", rec.Code)
+	}
+
+	dir, err := ioutil.TempDir("", "goproxy-dumps")
+	orFatal("TempDir", err, t)
+	defer os.RemoveAll(dir)
+	proxy.AdminProfiling = &AdminProfiling{Token: "s3cret", DumpDir: dir}
+	if rec := serve("GET", "/debug/runtime", "wrong"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("profiling served with a wrong token: %d", rec.Code)
+	}
+	rec := serve("GET", "/debug/runtime", "s3cret")
+	var stats RuntimeStats
+	orFatal("Unmarshal", json.Unmarshal(rec.Body.Bytes(), &stats), t)
+	if stats.Goroutines == 0 || stats.HeapAlloc == 0 {
+		t.Errorf("unexpected stats %s", rec.Body)
+	}
+	if rec := serve("GET", "/debug/pprof/", "s3cret"); !strings.Contains(rec.Body.String(), "goroutine ") {
+		t.Errorf("unexpected index %q", rec.Body)
+	}
+	if rec := serve("GET", "/debug/pprof/goroutine?debug=1", "s3cret"); !strings.Contains(rec.Body.String(), "TestAdminProfiling") {
+		t.Errorf("unexpected goroutine profile %q", rec.Body)
+	}
+
+	rec = serve("POST", "/debug/dump?kind=goroutine", "s3cret")
+	var dump map[string]string
+	orFatal("Unmarshal", json.Unmarshal(rec.Body.Bytes(), &dump), t)
+	if fi, err := os.Stat(dump["path"]); err != nil || fi.Size() == 0 || !strings.HasPrefix(dump["path"], dir) {
+		t.Errorf("unexpected dump %s: %v", rec.Body, err)
+	}
+	if rec := serve("POST", "/debug/dump?kind=cpu", "s3cret"); rec.Code != http.StatusBadRequest {
+		t.Errorf("unexpected dump of an unknown kind: %d", rec.Code)
+	}
+}
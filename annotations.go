@@ -0,0 +1,76 @@
+package goproxy
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Headers of the responses annotated by ResponseAnnotations
+const (
+	UpstreamHeader  = "X-Proxy-Upstream"
+	CacheHeader     = "X-Proxy-Cache"
+	DurationHeader  = "X-Proxy-Duration-Ms"
+	RequestIDHeader = "X-Proxy-Request-Id"
+)
+
+// ResponseAnnotations adds headers describing how the proxy handled the requests to their
+// responses, so that the teams running the clients can diagnose them without access to the
+// logs of the proxy. It can be set for the whole proxy, for a Tenant, and overridden per
+// request by setting ProxyCtx.ResponseAnnotations in a request handler, e.g. for a route.
+type ResponseAnnotations struct {
+	// Upstream sets X-Proxy-Upstream to the forward proxy of the request, or "direct"
+	Upstream bool
+	// Cache sets X-Proxy-Cache to the CacheStatus of the request, if any
+	Cache bool
+	// Duration sets X-Proxy-Duration-Ms to the milliseconds since the request was received
+	Duration bool
+	// RequestID sets X-Proxy-Request-Id to the LogRequestID of the request, or its session
+	RequestID bool
+}
+
+// AllResponseAnnotations adds all the annotations
+var AllResponseAnnotations = &ResponseAnnotations{Upstream: true, Cache: true, Duration: true, RequestID: true}
+
+// responseAnnotations returns the annotations of the request, falling back to the ones of its
+// tenant and of the proxy
+func (ctx *ProxyCtx) responseAnnotations() *ResponseAnnotations {
+	if ctx.ResponseAnnotations != nil {
+		return ctx.ResponseAnnotations
+	}
+	if t := ctx.Tenant(); t != nil && t.ResponseAnnotations != nil {
+		return t.ResponseAnnotations
+	}
+	if ctx.Proxy != nil {
+		return ctx.Proxy.ResponseAnnotations
+	}
+	return nil
+}
+
+// annotateResponse sets the annotations of the request of ctx in h, the header of its response
+func (ctx *ProxyCtx) annotateResponse(h http.Header) {
+	a := ctx.responseAnnotations()
+	if a == nil {
+		return
+	}
+	if a.Upstream {
+		if ctx.ForwardProxy != "" {
+			h.Set(UpstreamHeader, ctx.ForwardProxy)
+		} else {
+			h.Set(UpstreamHeader, "direct")
+		}
+	}
+	if a.Cache && ctx.CacheStatus != "" {
+		h.Set(CacheHeader, ctx.CacheStatus)
+	}
+	if a.Duration && !ctx.received.IsZero() {
+		h.Set(DurationHeader, strconv.FormatInt(int64(time.Since(ctx.received)/time.Millisecond), 10))
+	}
+	if a.RequestID {
+		if ctx.LogRequestID != "" {
+			h.Set(RequestIDHeader, ctx.LogRequestID)
+		} else {
+			h.Set(RequestIDHeader, strconv.FormatInt(ctx.Session, 10))
+		}
+	}
+}
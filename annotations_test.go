@@ -0,0 +1,42 @@
+package goproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestResponseAnnotations(t *testing.T) {
+	target := httptest.NewServer(ConstantHanlder("bobo"))
+	defer target.Close()
+
+	proxy := NewProxyHttpServer()
+	proxy.ResponseAnnotations = &ResponseAnnotations{Upstream: true, RequestID: true}
+	proxy.OnRequest().DoFunc(func(r *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response) {
+		if r.URL.Path == "/route" {
+			ctx.LogRequestID = "req-1"
+			ctx.ResponseAnnotations = AllResponseAnnotations
+		}
+		return r, nil
+	})
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	proxyURL, _ := url.Parse(s.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	resp, err := client.Get(target.URL)
+	orFatal("Get", err, t)
+	resp.Body.Close()
+	if resp.Header.Get(UpstreamHeader) != "direct" || resp.Header.Get(RequestIDHeader) == "" ||
+		resp.Header.Get(DurationHeader) != "" {
+		t.Errorf("expected the annotations of the proxy, got %v", resp.Header)
+	}
+
+	resp, err = client.Get(target.URL + "/route")
+	orFatal("Get", err, t)
+	resp.Body.Close()
+	if resp.Header.Get(RequestIDHeader) != "req-1" || resp.Header.Get(DurationHeader) == "" {
+		t.Errorf("expected the annotations of the route, got %v", resp.Header)
+	}
+}
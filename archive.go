@@ -0,0 +1,307 @@
+package goproxy
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+)
+
+// ArchiveEntry is a file of an inspected archive
+type ArchiveEntry struct {
+	// Name is the path of the file in the archive, prefixed with the paths of the archives
+	// containing it, e.g. "lib/deps.zip/README"
+	Name string
+	Mode os.FileMode
+	// Size is the extracted size of regular files
+	Size int64
+	// Depth is the number of archives the archive of the file is nested in
+	Depth int
+}
+
+// ArchiveInspector is a RespHandler listing the files of the zip, tar and tar.gz archives
+// downloaded, with bounded extraction, before relaying them to the client. Archives extracting
+// to more than MaxExtractedSize bytes or MaxRatio times their size, with more than MaxEntries
+// files or with archives nested deeper than MaxDepth are blocked with 403 Forbidden, as are the
+// archives Policy rejects. Register it for the routes to inspect, e.g.
+//
+//	proxy.OnResponse(goproxy.ReqHostIs("downloads.example.com:443")).Do(&goproxy.ArchiveInspector{
+//		Policy: func(entries []goproxy.ArchiveEntry, resp *http.Response, ctx *goproxy.ProxyCtx) error {
+//			for _, e := range entries {
+//				if strings.HasSuffix(e.Name, ".exe") {
+//					return errors.New("executables are not allowed")
+//				}
+//			}
+//			return nil
+//		}})
+type ArchiveInspector struct {
+	// MaxSize is the size of the largest archive inspected, and of the largest nested archive
+	// extracted, 32MB if zero
+	MaxSize int64
+	// AllowOversized relays the archives larger than MaxSize without inspecting them, they are
+	// blocked otherwise
+	AllowOversized bool
+	// MaxExtractedSize bounds the bytes extracted from an archive, 1GB if zero
+	MaxExtractedSize int64
+	// MaxRatio bounds the ratio of the bytes extracted from an archive to its size, once more
+	// than a MB was extracted, 200 if zero
+	MaxRatio int64
+	// MaxEntries bounds the files of an archive, including the files of nested archives,
+	// 10000 if zero
+	MaxEntries int
+	// MaxDepth bounds the nesting of archives, 3 if zero
+	MaxDepth int
+	// Policy, if set, returns nil if an archive made of entries may be relayed, and the
+	// reason it is blocked otherwise
+	Policy func(entries []ArchiveEntry, resp *http.Response, ctx *ProxyCtx) error
+}
+
+var errArchiveBomb = errors.New("archive extracts to too many bytes")
+
+func (a *ArchiveInspector) maxSize() int64 {
+	if a.MaxSize > 0 {
+		return a.MaxSize
+	}
+	return 32 << 20
+}
+
+// isArchive reports whether head, the first bytes of a file, are the ones of an archive
+func isArchive(head []byte) bool {
+	return bytes.HasPrefix(head, []byte("PK\x03\x04")) || bytes.HasPrefix(head, []byte("PK\x05\x06")) ||
+		bytes.HasPrefix(head, []byte{0x1f, 0x8b}) || isTar(head)
+}
+
+func isTar(head []byte) bool {
+	return len(head) >= 262 && string(head[257:262]) == "ustar"
+}
+
+// archiveInspection is the state of the inspection of an archive of size bytes
+type archiveInspection struct {
+	a         *ArchiveInspector
+	size      int64
+	entries   []ArchiveEntry
+	extracted int64
+}
+
+// countingReader counts the bytes extracted by an inspection
+type countingReader struct {
+	r  io.Reader
+	in *archiveInspection
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.in.extracted += int64(n)
+	max, ratio := c.in.a.MaxExtractedSize, c.in.a.MaxRatio
+	if max <= 0 {
+		max = 1 << 30
+	}
+	if ratio <= 0 {
+		ratio = 200
+	}
+	if c.in.extracted > max || c.in.extracted > 1<<20 && c.in.extracted > ratio*c.in.size {
+		return n, errArchiveBomb
+	}
+	return n, err
+}
+
+func (in *archiveInspection) add(e ArchiveEntry) error {
+	max := in.a.MaxEntries
+	if max <= 0 {
+		max = 10000
+	}
+	if len(in.entries) >= max {
+		return fmt.Errorf("archive has more than %d files", max)
+	}
+	in.entries = append(in.entries, e)
+	return nil
+}
+
+// archive inspects the archive data, whose files are named with prefix
+func (in *archiveInspection) archive(prefix string, data []byte, depth int) error {
+	switch {
+	case bytes.HasPrefix(data, []byte("PK")):
+		zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return err
+		}
+		for _, f := range zr.File {
+			if !f.Mode().IsRegular() {
+				if err := in.add(ArchiveEntry{Name: prefix + f.Name, Mode: f.Mode(), Depth: depth}); err != nil {
+					return err
+				}
+				continue
+			}
+			rc, err := f.Open()
+			if err != nil {
+				return err
+			}
+			err = in.file(ArchiveEntry{Name: prefix + f.Name, Mode: f.Mode(), Depth: depth}, rc)
+			rc.Close()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case data[0] == 0x1f:
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		br := bufio.NewReaderSize(zr, 512)
+		if head, _ := br.Peek(512); isTar(head) {
+			return in.tar(prefix, br, depth)
+		}
+		// a single compressed file
+		name := zr.Name
+		if name == "" {
+			name = "-"
+		}
+		return in.file(ArchiveEntry{Name: prefix + name, Mode: 0644, Depth: depth}, br)
+	default:
+		return in.tar(prefix, bytes.NewReader(data), depth)
+	}
+}
+
+func (in *archiveInspection) tar(prefix string, r io.Reader, depth int) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		e := ArchiveEntry{Name: prefix + hdr.Name, Mode: hdr.FileInfo().Mode(), Depth: depth}
+		if !e.Mode.IsRegular() {
+			err = in.add(e)
+		} else {
+			err = in.file(e, tr)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// file inspects the regular file e of an archive, extracting it from r. Nested archives are
+// inspected in turn.
+func (in *archiveInspection) file(e ArchiveEntry, r io.Reader) error {
+	r = &countingReader{r, in}
+	head := make([]byte, 512)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	head = head[:n]
+	if !isArchive(head) {
+		m, err := io.Copy(ioutil.Discard, r)
+		e.Size = int64(n) + m
+		if err != nil {
+			return err
+		}
+		return in.add(e)
+	}
+	max := in.a.MaxDepth
+	if max <= 0 {
+		max = 3
+	}
+	if e.Depth >= max {
+		return fmt.Errorf("%s: archives nested deeper than %d", e.Name, max)
+	}
+	rest, err := ioutil.ReadAll(io.LimitReader(r, in.a.maxSize()-int64(n)+1))
+	if err != nil {
+		return err
+	}
+	data := append(head, rest...)
+	if int64(len(data)) > in.a.maxSize() {
+		return fmt.Errorf("%s: nested archive larger than %d bytes", e.Name, in.a.maxSize())
+	}
+	e.Size = int64(len(data))
+	if err := in.add(e); err != nil {
+		return err
+	}
+	return in.archive(e.Name+"/", data, e.Depth+1)
+}
+
+// Handle implements RespHandler
+func (a *ArchiveInspector) Handle(resp *http.Response, ctx *ProxyCtx) *http.Response {
+	if resp == nil || resp.Body == nil || resp.StatusCode != http.StatusOK || resp.Request != nil && resp.Request.Method == "HEAD" {
+		return resp
+	}
+	// other downloads are relayed without being buffered
+	br := bufio.NewReaderSize(resp.Body, 512)
+	head, _ := br.Peek(512)
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{br, resp.Body}
+	if len(contentEncodings(resp.Header)) == 0 && !isArchive(head) {
+		return resp
+	}
+	max := a.maxSize()
+	if resp.ContentLength > max || ctx.Streaming() {
+		return a.oversized(resp, ctx)
+	}
+	body, err := ctx.readAll(io.LimitReader(resp.Body, max+1))
+	if err != nil {
+		resp.Body.Close()
+		return a.blocked(ctx, http.StatusBadGateway, err)
+	}
+	if int64(len(body)) > max {
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		return a.oversized(resp, ctx)
+	}
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+
+	// the archive is inspected decoded, and relayed as it was received
+	data := body
+	if len(contentEncodings(resp.Header)) > 0 {
+		decoded := &http.Response{Header: cloneHeader(resp.Header), Body: ioutil.NopCloser(bytes.NewReader(body))}
+		if err := DecodeContent(decoded); err != nil {
+			return a.blocked(ctx, http.StatusBadGateway, err)
+		}
+		if data, err = ctx.readAll(io.LimitReader(decoded.Body, max+1)); err != nil || int64(len(data)) > max {
+			return a.oversized(resp, ctx)
+		}
+	}
+	if !isArchive(data) {
+		return resp
+	}
+	in := &archiveInspection{a: a, size: int64(len(data))}
+	err = in.archive("", data, 0)
+	if err == nil && a.Policy != nil {
+		err = a.Policy(in.entries, resp, ctx)
+	}
+	if err != nil {
+		return a.blocked(ctx, http.StatusForbidden, err)
+	}
+	ctx.Logf("inspected archive %s: %d files, %d bytes extracted", ctx.Req.URL, len(in.entries), in.extracted)
+	return resp
+}
+
+func (a *ArchiveInspector) oversized(resp *http.Response, ctx *ProxyCtx) *http.Response {
+	if a.AllowOversized {
+		return resp
+	}
+	resp.Body.Close()
+	return a.blocked(ctx, http.StatusForbidden, fmt.Errorf("archive larger than %d bytes", a.maxSize()))
+}
+
+func (a *ArchiveInspector) blocked(ctx *ProxyCtx, status int, err error) *http.Response {
+	ctx.Warnf("archive %s blocked: %v", ctx.Req.URL, err)
+	return ctx.BlockedResponse(status, PolicyDecision{Policy: "archive", Reason: err.Error()})
+}
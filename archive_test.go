@@ -0,0 +1,85 @@
+package goproxy
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func zipArchive(t *testing.T, files map[string][]byte) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, content := range files {
+		w, err := zw.Create(name)
+		orFatal("Create", err, t)
+		w.Write(content)
+	}
+	orFatal("Close", zw.Close(), t)
+	return buf.Bytes()
+}
+
+func tarGzArchive(t *testing.T, files map[string][]byte) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(zw)
+	for name, content := range files {
+		orFatal("WriteHeader", tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}), t)
+		tw.Write(content)
+	}
+	orFatal("Close", tw.Close(), t)
+	orFatal("Close", zw.Close(), t)
+	return buf.Bytes()
+}
+
+func TestArchiveInspector(t *testing.T) {
+	var listed []string
+	inspector := &ArchiveInspector{Policy: func(entries []ArchiveEntry, resp *http.Response, ctx *ProxyCtx) error {
+		listed = nil
+		for _, e := range entries {
+			listed = append(listed, e.Name)
+			if strings.HasSuffix(e.Name, ".exe") {
+				return errors.New("executables are not allowed")
+			}
+		}
+		return nil
+	}}
+	nested := zipArchive(t, map[string][]byte{"deps.tar.gz": tarGzArchive(t, map[string][]byte{"lib/a.go": []byte("package a")})})
+	deep := []byte("data")
+	for i := 0; i < 5; i++ {
+		deep = zipArchive(t, map[string][]byte{"inner.zip": deep})
+	}
+	for _, c := range []struct {
+		name   string
+		body   []byte
+		status int
+	}{
+		{"not an archive", []byte("plain file"), http.StatusOK},
+		{"tar.gz", tarGzArchive(t, map[string][]byte{"README": []byte("read me")}), http.StatusOK},
+		{"nested", nested, http.StatusOK},
+		{"policy", zipArchive(t, map[string][]byte{"setup.exe": []byte("MZ")}), http.StatusForbidden},
+		{"bomb", zipArchive(t, map[string][]byte{"zeros": make([]byte, 4<<20)}), http.StatusForbidden},
+		{"deep", deep, http.StatusForbidden},
+	} {
+		resp := integrityResponse("http://example.com/file", c.body, http.Header{})
+		resp = inspector.Handle(resp, &ProxyCtx{Req: resp.Request, Proxy: NewProxyHttpServer()})
+		if resp.StatusCode != c.status {
+			t.Errorf("%s: expected status %d, got %d", c.name, c.status, resp.StatusCode)
+			continue
+		}
+		if got, _ := ioutil.ReadAll(resp.Body); c.status == http.StatusOK && !bytes.Equal(got, c.body) {
+			t.Errorf("%s: unexpected body", c.name)
+		}
+	}
+	// listed by the last accepted archive
+	resp := integrityResponse("http://example.com/file", nested, http.Header{})
+	inspector.Handle(resp, &ProxyCtx{Req: resp.Request, Proxy: NewProxyHttpServer()})
+	if strings.Join(listed, ",") != "deps.tar.gz,deps.tar.gz/lib/a.go" {
+		t.Errorf("unexpected entries %v", listed)
+	}
+}
@@ -0,0 +1,178 @@
+package goproxy
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// BandwidthUsage is the traffic of the proxy with a registrable domain
+type BandwidthUsage struct {
+	Domain        string `json:"domain"`
+	Requests      int64  `json:"requests"`
+	BytesSent     int64  `json:"bytes_sent"`
+	BytesReceived int64  `json:"bytes_received"`
+}
+
+// Total returns the bytes sent and received
+func (u BandwidthUsage) Total() int64 {
+	return u.BytesSent + u.BytesReceived
+}
+
+// BandwidthReport aggregates the bytes sent and received by the requests and tunnels of the
+// proxy per registrable domain (eTLD+1, e.g. "example.co.uk" for "cdn.example.co.uk"). Set it
+// as ProxyHttpServer.BandwidthReport, the top talkers are served by the admin API on
+// /bandwidth, and reported to OnReport every Period by Run.
+type BandwidthReport struct {
+	// Period is the period of the reports, an hour if zero
+	Period time.Duration
+	// Top is the number of domains reported, 10 if zero
+	Top int
+	// MaxDomains bounds the domains tracked during a period, the traffic with the other ones is
+	// aggregated as "other". 10000 if zero.
+	MaxDomains int
+	// OnReport, if set, is called with the top talkers of the period that ended
+	OnReport func(top []BandwidthUsage, since time.Time)
+
+	mu    sync.Mutex
+	usage map[string]*BandwidthUsage
+	since time.Time
+}
+
+// registrableDomain returns the eTLD+1 of the host of hostport, or the host itself if it is
+// an IP address or a public suffix
+func registrableDomain(hostport string) string {
+	host := hostport
+	if h, _, err := net.SplitHostPort(hostport); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(strings.Trim(host, "[]"), "."))
+	if net.ParseIP(host) != nil {
+		return host
+	}
+	if domain, err := publicsuffix.EffectiveTLDPlusOne(host); err == nil {
+		return domain
+	}
+	return host
+}
+
+// Add charges the bytes sent to and received from hostport
+func (b *BandwidthReport) Add(hostport string, sent, received int64) {
+	domain := registrableDomain(hostport)
+	max := b.MaxDomains
+	if max <= 0 {
+		max = 10000
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.usage == nil {
+		b.usage = make(map[string]*BandwidthUsage)
+		b.since = time.Now()
+	}
+	u, ok := b.usage[domain]
+	if !ok {
+		if len(b.usage) >= max {
+			domain = "other"
+			u = b.usage[domain]
+		}
+		if u == nil {
+			u = &BandwidthUsage{Domain: domain}
+			b.usage[domain] = u
+		}
+	}
+	u.Requests++
+	u.BytesSent += sent
+	u.BytesReceived += received
+}
+
+// TopTalkers returns the n domains with the most traffic in the current period, by
+// decreasing traffic
+func (b *BandwidthReport) TopTalkers(n int) []BandwidthUsage {
+	b.mu.Lock()
+	top := make([]BandwidthUsage, 0, len(b.usage))
+	for _, u := range b.usage {
+		top = append(top, *u)
+	}
+	b.mu.Unlock()
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Total() != top[j].Total() {
+			return top[i].Total() > top[j].Total()
+		}
+		return top[i].Domain < top[j].Domain
+	})
+	if n > 0 && len(top) > n {
+		top = top[:n]
+	}
+	return top
+}
+
+func (b *BandwidthReport) top() int {
+	if b.Top > 0 {
+		return b.Top
+	}
+	return 10
+}
+
+// Reset starts a new period, and returns the top talkers of the one that ended and its start
+func (b *BandwidthReport) Reset() ([]BandwidthUsage, time.Time) {
+	top := b.TopTalkers(b.top())
+	b.mu.Lock()
+	since := b.since
+	b.usage = nil
+	b.mu.Unlock()
+	return top, since
+}
+
+// Run reports the top talkers to OnReport and starts a new period every Period, until stop is
+// closed
+func (b *BandwidthReport) Run(stop <-chan struct{}) {
+	period := b.Period
+	if period <= 0 {
+		period = time.Hour
+	}
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		top, since := b.Reset()
+		if b.OnReport != nil {
+			b.OnReport(top, since)
+		}
+	}
+}
+
+// accountBandwidth charges the bytes of the request or tunnel of ctx to its destination
+func (proxy *ProxyHttpServer) accountBandwidth(ctx *ProxyCtx) {
+	if proxy.BandwidthReport == nil || ctx.Req == nil {
+		return
+	}
+	host := ctx.Req.URL.Host
+	if host == "" {
+		host = ctx.Req.Host
+	}
+	proxy.BandwidthReport.Add(host, ctx.BytesSent, ctx.BytesReceived)
+}
+
+func (proxy *ProxyHttpServer) serveBandwidth(w http.ResponseWriter, r *http.Request) {
+	if proxy.BandwidthReport == nil {
+		http.Error(w, "bandwidth reports are not enabled", http.StatusNotFound)
+		return
+	}
+	n := proxy.BandwidthReport.top()
+	if top, err := strconv.Atoi(r.URL.Query().Get("top")); err == nil && top > 0 {
+		n = top
+	}
+	w.Header().Set("Content-Type", ContentTypeJSON)
+	json.NewEncoder(w).Encode(proxy.BandwidthReport.TopTalkers(n))
+}
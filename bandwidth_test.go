@@ -0,0 +1,62 @@
+package goproxy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestRegistrableDomain(t *testing.T) {
+	for host, expected := range map[string]string{
+		"cdn.example.co.uk:443": "example.co.uk",
+		"www.Example.com.":      "example.com",
+		"127.0.0.1:8080":        "127.0.0.1",
+		"[::1]:443":             "::1",
+		"localhost":             "localhost",
+	} {
+		if domain := registrableDomain(host); domain != expected {
+			t.Errorf("%s: expected %s, got %s", host, expected, domain)
+		}
+	}
+}
+
+func TestBandwidthReport(t *testing.T) {
+	b := &BandwidthReport{MaxDomains: 2}
+	b.Add("a.example.com:443", 10, 100)
+	b.Add("b.example.com", 5, 50)
+	b.Add("example.org", 1, 1)
+	b.Add("example.net", 1000, 0)
+	top := b.TopTalkers(0)
+	if len(top) != 3 || top[0].Domain != "other" || top[1].Domain != "example.com" || top[1].Requests != 2 || top[1].Total() != 165 {
+		t.Errorf("unexpected top talkers %+v", top)
+	}
+	if top, _ := b.Reset(); len(top) != 3 || len(b.TopTalkers(0)) != 0 {
+		t.Errorf("unexpected report %+v", top)
+	}
+
+	upstream := httptest.NewServer(ConstantHanlder("hello"))
+	defer upstream.Close()
+	proxy := NewProxyHttpServer()
+	proxy.BandwidthReport = b
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+	proxyURL, _ := url.Parse(s.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(upstream.URL)
+		orFatal("GET", err, t)
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+
+	// only the bodies of the responses are counted as received, not their headers
+	rec := httptest.NewRecorder()
+	proxy.AdminHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/bandwidth?top=1", nil))
+	orFatal("Decode", json.NewDecoder(rec.Body).Decode(&top), t)
+	if len(top) != 1 || top[0].Domain != "127.0.0.1" || top[0].Requests != 2 || top[0].BytesReceived != 10 {
+		t.Errorf("unexpected top talkers %+v", top)
+	}
+}
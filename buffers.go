@@ -0,0 +1,120 @@
+package goproxy
+
+import (
+	"sync"
+)
+
+// AdaptiveBuffers sizes the buffers relaying each direction of the CONNECT tunnels from its
+// throughput, instead of CopyBufferSize: a buffer doubles when a read fills it, up to Max,
+// and halves after 4 reads filling less than a quarter of it, down to Min. Idle and chatty
+// tunnels thus hold small buffers while bulk transfers get large ones.
+type AdaptiveBuffers struct {
+	// Min is the size of the buffers of new and idle tunnels, 4KB if zero
+	Min int
+	// Max is the size of the buffers of bulk transfers, 256KB if zero
+	Max int
+}
+
+// the sizes of the pooled buffers are the powers of two from minBufferShift to maxBufferShift
+const (
+	minBufferShift = 10
+	maxBufferShift = 20
+)
+
+// sizedBuffers pools the buffers of each size
+var sizedBuffers [maxBufferShift - minBufferShift + 1]sync.Pool
+
+// adaptiveBuffers returns the AdaptiveBuffers of the tunnel of ctx, nil if its buffers are
+// of a fixed size
+func (ctx *ProxyCtx) adaptiveBuffers() *AdaptiveBuffers {
+	if ctx.AdaptiveBuffers != nil {
+		return ctx.AdaptiveBuffers
+	}
+	if ctx.Proxy != nil {
+		return ctx.Proxy.AdaptiveBuffers
+	}
+	return nil
+}
+
+// bufferShift returns the shift of the smallest pooled size holding size bytes
+func bufferShift(size int) uint {
+	shift := uint(minBufferShift)
+	for shift < maxBufferShift && 1<<shift < size {
+		shift++
+	}
+	return shift
+}
+
+func (policy *AdaptiveBuffers) shifts() (min, max uint) {
+	min, max = bufferShift(4*1024), bufferShift(256*1024)
+	if policy.Min > 0 {
+		min = bufferShift(policy.Min)
+	}
+	if policy.Max > 0 {
+		max = bufferShift(policy.Max)
+	}
+	if max < min {
+		max = min
+	}
+	return min, max
+}
+
+// adaptiveBuffer is a buffer sized by an AdaptiveBuffers
+type adaptiveBuffer struct {
+	min, max uint
+	shift    uint
+	buf      *[]byte
+	// the number of reads in a row filling less than a quarter of buf
+	small int
+}
+
+func newAdaptiveBuffer(policy *AdaptiveBuffers) *adaptiveBuffer {
+	b := &adaptiveBuffer{}
+	b.min, b.max = policy.shifts()
+	b.resize(b.min)
+	return b
+}
+
+func (b *adaptiveBuffer) resize(shift uint) {
+	if b.buf != nil {
+		sizedBuffers[b.shift-minBufferShift].Put(b.buf)
+	}
+	b.shift = shift
+	if buf, ok := sizedBuffers[shift-minBufferShift].Get().(*[]byte); ok {
+		b.buf = buf
+		return
+	}
+	buf := make([]byte, 1<<shift)
+	b.buf = &buf
+}
+
+// bytes returns the buffer to read into
+func (b *adaptiveBuffer) bytes() []byte {
+	return *b.buf
+}
+
+// adapt resizes the buffer after a read of n bytes into it, and returns the buffer for the
+// next read
+func (b *adaptiveBuffer) adapt(n int) []byte {
+	size := 1 << b.shift
+	switch {
+	case n == size && b.shift < b.max:
+		b.small = 0
+		b.resize(b.shift + 1)
+	case n < size/4 && b.shift > b.min:
+		b.small++
+		if b.small >= 4 {
+			b.small = 0
+			b.resize(b.shift - 1)
+		}
+	default:
+		b.small = 0
+	}
+	return *b.buf
+}
+
+// release gives the buffer back to its pool
+func (b *adaptiveBuffer) release() {
+	sizedBuffers[b.shift-minBufferShift].Put(b.buf)
+	b.buf = nil
+}
@@ -0,0 +1,42 @@
+package goproxy
+
+import (
+	"testing"
+)
+
+func TestAdaptiveBuffer(t *testing.T) {
+	b := newAdaptiveBuffer(&AdaptiveBuffers{Min: 3000, Max: 32 * 1024})
+	defer b.release()
+	if len(b.bytes()) != 4096 {
+		t.Fatalf("unexpected initial size %d", len(b.bytes()))
+	}
+	// bulk reads grow the buffer up to Max
+	for i := 0; i < 10; i++ {
+		buf := b.bytes()
+		b.adapt(len(buf))
+	}
+	if len(b.bytes()) != 32*1024 {
+		t.Errorf("buffer not grown: %d", len(b.bytes()))
+	}
+	// small reads shrink it back to Min, 4 of them at each size
+	for i := 0; i < 3; i++ {
+		b.adapt(10)
+	}
+	if len(b.bytes()) != 32*1024 {
+		t.Errorf("buffer shrunk too early: %d", len(b.bytes()))
+	}
+	for i := 0; i < 20; i++ {
+		b.adapt(10)
+	}
+	if len(b.bytes()) != 4096 {
+		t.Errorf("buffer not shrunk: %d", len(b.bytes()))
+	}
+	// reads of a medium size keep the buffer as it is
+	b.adapt(4096)
+	for i := 0; i < 10; i++ {
+		b.adapt(3000)
+	}
+	if len(b.bytes()) != 8192 {
+		t.Errorf("unexpected size %d", len(b.bytes()))
+	}
+}
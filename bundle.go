@@ -0,0 +1,200 @@
+package goproxy
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"runtime/pprof"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+)
+
+// SupportBundle sets what the support bundles gather besides the state of the proxy
+type SupportBundle struct {
+	// Gatherer provides the metrics, prometheus.DefaultGatherer if nil
+	Gatherer prometheus.Gatherer
+	// ResolveHosts are resolved through Resolver, the system resolver if nil, to check the DNS
+	ResolveHosts []string
+	Resolver     Resolver
+	// Upstreams are the host:port of the forward proxies and servers to check the
+	// connectivity to
+	Upstreams []string
+	// Timeout bounds every check, 5 seconds if zero
+	Timeout time.Duration
+}
+
+// HealthCheck is the result of a DNS or upstream check of a support bundle
+type HealthCheck struct {
+	Kind     string   `json:"kind"`
+	Target   string   `json:"target"`
+	OK       bool     `json:"ok"`
+	Addrs    []string `json:"addrs,omitempty"`
+	Error    string   `json:"error,omitempty"`
+	Duration string   `json:"duration"`
+}
+
+func (b *SupportBundle) timeout() time.Duration {
+	if b.Timeout > 0 {
+		return b.Timeout
+	}
+	return 5 * time.Second
+}
+
+// checkHealth resolves the hosts and dials the upstreams of b concurrently
+func (b *SupportBundle) checkHealth() []HealthCheck {
+	checks := make([]HealthCheck, len(b.ResolveHosts)+len(b.Upstreams))
+	var wg sync.WaitGroup
+	run := func(i int, kind, target string, check func(ctx context.Context) ([]string, error)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), b.timeout())
+			defer cancel()
+			start := time.Now()
+			addrs, err := check(ctx)
+			checks[i] = HealthCheck{Kind: kind, Target: target, OK: err == nil, Addrs: addrs, Duration: time.Since(start).String()}
+			if err != nil {
+				checks[i].Error = err.Error()
+			}
+		}()
+	}
+	resolver := b.Resolver
+	if resolver == nil {
+		resolver = SystemResolver{}
+	}
+	for i, host := range b.ResolveHosts {
+		host := host
+		run(i, "dns", host, func(ctx context.Context) ([]string, error) {
+			ips, err := resolver.LookupIP(ctx, host, LookupHints{Network: "ip", Timeout: b.timeout()})
+			var addrs []string
+			for _, ip := range ips {
+				addrs = append(addrs, ip.String())
+			}
+			return addrs, err
+		})
+	}
+	for i, upstream := range b.Upstreams {
+		upstream := upstream
+		run(len(b.ResolveHosts)+i, "upstream", upstream, func(ctx context.Context) ([]string, error) {
+			var d net.Dialer
+			conn, err := d.DialContext(ctx, "tcp", upstream)
+			if err != nil {
+				return nil, err
+			}
+			defer conn.Close()
+			return []string{conn.RemoteAddr().String()}, nil
+		})
+	}
+	wg.Wait()
+	return checks
+}
+
+// WriteSupportBundle writes to w a gzipped tarball of the state of the proxy, for debugging
+// deployments without a shell access to them:
+//
+//	config.json      the effective configuration, secrets redacted, see ConfigSnapshot
+//	validate.json    the diagnostics of the configuration, see Validate
+//	errors.json      the recent warnings and errors of the requests, see ErrorLog
+//	metrics.txt      the metrics, in the Prometheus text format
+//	goroutines.txt   the stacks of all the goroutines
+//	sessions.json    the requests and tunnels in progress, see Sessions
+//	health.json      the results of the DNS and upstream checks of b
+//
+// b may be nil, the metrics of prometheus.DefaultGatherer are gathered then, with no checks.
+func (proxy *ProxyHttpServer) WriteSupportBundle(w io.Writer, b *SupportBundle) error {
+	if b == nil {
+		b = &SupportBundle{}
+	}
+	zw := gzip.NewWriter(w)
+	tw := tar.NewWriter(zw)
+	now := time.Now()
+	add := func(name string, content []byte) error {
+		hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), ModTime: now}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err := tw.Write(content)
+		return err
+	}
+	addJSON := func(name string, v interface{}) error {
+		content, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		return add(name, append(content, '\n'))
+	}
+
+	config, err := proxy.ConfigSnapshot().JSON()
+	if err != nil {
+		return fmt.Errorf("config.json: %v", err)
+	}
+	if err := add("config.json", config); err != nil {
+		return err
+	}
+	if err := addJSON("validate.json", proxy.Validate()); err != nil {
+		return err
+	}
+	var entries []ErrorLogEntry
+	if proxy.ErrorLog != nil {
+		entries = proxy.ErrorLog.Entries()
+	}
+	if err := addJSON("errors.json", entries); err != nil {
+		return err
+	}
+	if err := add("metrics.txt", gatherMetrics(b.Gatherer)); err != nil {
+		return err
+	}
+	var goroutines bytes.Buffer
+	pprof.Lookup("goroutine").WriteTo(&goroutines, 2)
+	if err := add("goroutines.txt", goroutines.Bytes()); err != nil {
+		return err
+	}
+	if err := addJSON("sessions.json", proxy.Sessions()); err != nil {
+		return err
+	}
+	if err := addJSON("health.json", b.checkHealth()); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// gatherMetrics returns the metrics of g in the Prometheus text format. The errors of the
+// collectors are reported after the metrics gathered.
+func gatherMetrics(g prometheus.Gatherer) []byte {
+	if g == nil {
+		g = prometheus.DefaultGatherer
+	}
+	var buf bytes.Buffer
+	families, err := g.Gather()
+	for _, family := range families {
+		expfmt.MetricFamilyToText(&buf, family)
+	}
+	if err != nil {
+		fmt.Fprintf(&buf, "# error gathering the metrics: %v\n", err)
+	}
+	return buf.Bytes()
+}
+
+func (proxy *ProxyHttpServer) serveSupportBundle(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	if err := proxy.WriteSupportBundle(&buf, proxy.SupportBundle); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition",
+		fmt.Sprintf(`attachment; filename="goproxy-support-%s.tar.gz"`, time.Now().UTC().Format("20060102T150405Z")))
+	w.Write(buf.Bytes())
+}
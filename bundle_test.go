@@ -0,0 +1,95 @@
+package goproxy
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestSupportBundle(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	background := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		io.WriteString(w, "done")
+	}))
+	defer background.Close()
+
+	proxy := NewProxyHttpServer()
+	proxy.OnRequest().DoFunc(func(r *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response) {
+		ctx.Warnf("slow request to %s", r.URL.Host)
+		return r, nil
+	})
+	proxy.SupportBundle = &SupportBundle{
+		ResolveHosts: []string{"example.com", "missing.invalid"},
+		Resolver:     StaticResolver{"example.com": {net.ParseIP("192.0.2.1")}},
+		Upstreams:    []string{background.Listener.Addr().String()},
+	}
+	srv := httptest.NewServer(proxy)
+	defer srv.Close()
+	proxyURL, _ := url.Parse(srv.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if resp, err := client.Get(background.URL + "/slow"); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	<-started
+
+	rec := httptest.NewRecorder()
+	proxy.AdminHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/bundle", nil))
+	close(release)
+	<-done
+	if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Header().Get("Content-Disposition"), "attachment") {
+		t.Fatalf("unexpected response %d %v", rec.Code, rec.Header())
+	}
+
+	zr, err := gzip.NewReader(rec.Body)
+	orFatal("gzip.NewReader", err, t)
+	tr := tar.NewReader(zr)
+	files := make(map[string]string)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		orFatal("Next", err, t)
+		content, err := ioutil.ReadAll(tr)
+		orFatal("ReadAll", err, t)
+		files[hdr.Name] = string(content)
+	}
+	for _, name := range []string{"config.json", "validate.json", "errors.json", "metrics.txt", "goroutines.txt", "sessions.json", "health.json"} {
+		if _, ok := files[name]; !ok {
+			t.Errorf("%s missing from the bundle", name)
+		}
+	}
+	if !strings.Contains(files["goroutines.txt"], "goroutine ") {
+		t.Errorf("unexpected goroutine dump %q", files["goroutines.txt"])
+	}
+	if !strings.Contains(files["errors.json"], "slow request to "+background.Listener.Addr().String()) {
+		t.Errorf("warning missing from %s", files["errors.json"])
+	}
+
+	var sessions []SessionInfo
+	orFatal("Unmarshal", json.Unmarshal([]byte(files["sessions.json"]), &sessions), t)
+	if len(sessions) != 1 || sessions[0].Kind != SessionHTTP || sessions[0].Destination != background.Listener.Addr().String() {
+		t.Errorf("unexpected sessions %+v", sessions)
+	}
+
+	var checks []HealthCheck
+	orFatal("Unmarshal", json.Unmarshal([]byte(files["health.json"]), &checks), t)
+	if len(checks) != 3 || !checks[0].OK || checks[0].Addrs[0] != "192.0.2.1" || checks[1].OK || !checks[2].OK {
+		t.Errorf("unexpected health checks %+v", checks)
+	}
+}
@@ -0,0 +1,345 @@
+package goproxy
+
+import (
+	"container/list"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SharedCache is a cache backend shared by the instances of a fleet (Redis, memcached...),
+// so that the work done by one instance (DNS lookups, certificate signing) is reused by the
+// others. Get returns ok false, and no error, for missing keys.
+type SharedCache interface {
+	Get(key string) (value []byte, ok bool, err error)
+	Set(key string, value []byte, ttl time.Duration) error
+}
+
+// lruCache is a size bounded cache with per entry expiration, used in front of SharedCache
+type lruCache struct {
+	size int
+
+	mu      sync.Mutex
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type lruEntry struct {
+	key     string
+	value   interface{}
+	expires time.Time
+}
+
+func newLRUCache(size int) *lruCache {
+	if size <= 0 {
+		size = 1024
+	}
+	return &lruCache{size: size, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+func (c *lruCache) get(key string) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := e.Value.(*lruEntry)
+	if !entry.expires.IsZero() && time.Now().After(entry.expires) {
+		c.order.Remove(e)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	return entry.value, true
+}
+
+func (c *lruCache) set(key string, value interface{}, ttl time.Duration) {
+	var expires time.Time
+	if ttl > 0 {
+		expires = time.Now().Add(ttl)
+	}
+	c.setUntil(key, value, expires)
+}
+
+// setUntil sets the value of key until expires, forever if it is zero
+func (c *lruCache) setUntil(key string, value interface{}, expires time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		e.Value = &lruEntry{key: key, value: value, expires: expires}
+		c.order.MoveToFront(e)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&lruEntry{key: key, value: value, expires: expires})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lruEntry).key)
+	}
+}
+
+func (c *lruCache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		c.order.Remove(e)
+		delete(c.entries, key)
+	}
+}
+
+// removeMatching removes the entries whose key matches, and returns their keys
+func (c *lruCache) removeMatching(match func(key string) bool) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var keys []string
+	for key, e := range c.entries {
+		if match(key) {
+			c.order.Remove(e)
+			delete(c.entries, key)
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// CachingResolver caches the answers of Resolver in a local LRU, and in Shared if set, so that
+// a fleet of proxies resolves each host once per TTL
+type CachingResolver struct {
+	Resolver Resolver
+	Shared   SharedCache
+	// Prefix is prepended to the keys in Shared
+	Prefix string
+	// Size is the number of entries of the local cache, 1024 if zero
+	Size int
+	// TTL is how long answers are cached, a minute if zero
+	TTL time.Duration
+
+	once  sync.Once
+	local *lruCache
+}
+
+func (r *CachingResolver) ttl() time.Duration {
+	if r.TTL > 0 {
+		return r.TTL
+	}
+	return time.Minute
+}
+
+// LookupIP implements Resolver. Failed lookups are not cached.
+func (r *CachingResolver) LookupIP(ctx context.Context, host string, hints LookupHints) ([]net.IP, error) {
+	r.once.Do(func() { r.local = newLRUCache(r.Size) })
+
+	// the answers depend on the family and the client subnet sent to the server
+	key := strings.Join([]string{hints.Network, hints.EDNSClientSubnetV4, hints.EDNSClientSubnetV6, strings.ToLower(host)}, "|")
+	if ips, ok := r.local.get(key); ok {
+		return ips.([]net.IP), nil
+	}
+	if r.Shared != nil {
+		if value, ok, err := r.Shared.Get(r.Prefix + key); err == nil && ok {
+			var ips []net.IP
+			for _, s := range strings.Split(string(value), ",") {
+				if ip := net.ParseIP(s); ip != nil {
+					ips = append(ips, ip)
+				}
+			}
+			if len(ips) > 0 {
+				r.local.set(key, ips, r.ttl())
+				return ips, nil
+			}
+		}
+	}
+
+	ips, err := r.Resolver.LookupIP(ctx, host, hints)
+	if err != nil {
+		return nil, err
+	}
+	r.local.set(key, ips, r.ttl())
+	if r.Shared != nil {
+		r.Shared.Set(r.Prefix+key, []byte(strings.Join(ipStrings(ips), ",")), r.ttl())
+	}
+	return ips, nil
+}
+
+// Forget removes the cached answers for host, so that its next lookup queries Resolver again.
+// Its answers in Shared are overwritten with empty ones, which the lookups ignore.
+func (r *CachingResolver) Forget(host string) {
+	r.once.Do(func() { r.local = newLRUCache(r.Size) })
+	suffix := "|" + strings.ToLower(host)
+	keys := r.local.removeMatching(func(key string) bool { return strings.HasSuffix(key, suffix) })
+	if r.Shared != nil {
+		for _, key := range keys {
+			r.Shared.Set(r.Prefix+key, []byte{}, r.ttl())
+		}
+	}
+}
+
+// SharedCertStorage is a CertStorage keeping the certificates in a local LRU, and in Shared
+// so that a fleet of proxies signs each host once. All the instances sharing the same Prefix
+// must sign with the same CA. The certificates are stored in Shared with their private keys,
+// sealed with Key.
+type SharedCertStorage struct {
+	Shared SharedCache
+	// Key is the AES key, of 16, 24 or 32 bytes, sealing the certificates with AES-GCM before
+	// they are stored in Shared, which is only used when Key is set. All the instances
+	// sharing the same Prefix must use the same Key.
+	Key []byte
+	// Prefix is prepended to the keys in Shared
+	Prefix string
+	// Size is the number of certificates of the local cache, 1024 if zero
+	Size int
+	// TTL is how long certificates are kept, forever if zero
+	TTL time.Duration
+
+	once    sync.Once
+	local   *lruCache
+	aead    cipher.AEAD
+	aeadErr error
+}
+
+func (s *SharedCertStorage) init() {
+	s.local = newLRUCache(s.Size)
+	if s.Key == nil {
+		return
+	}
+	block, err := aes.NewCipher(s.Key)
+	if err == nil {
+		s.aead, err = cipher.NewGCM(block)
+	}
+	s.aeadErr = err
+}
+
+// Fetch implements CertStorage. It fails when Key isn't a valid AES key.
+func (s *SharedCertStorage) Fetch(hostname string, gen func() (*tls.Certificate, error)) (*tls.Certificate, error) {
+	s.once.Do(s.init)
+	if s.aeadErr != nil {
+		return nil, s.aeadErr
+	}
+
+	if cert, ok := s.local.get(hostname); ok {
+		return cert.(*tls.Certificate), nil
+	}
+	shared := s.Shared != nil && s.aead != nil
+	if shared {
+		if value, ok, err := s.Shared.Get(s.Prefix + hostname); err == nil && ok {
+			if encoded, err := s.open(hostname, value); err == nil {
+				if cert, err := tls.X509KeyPair(encoded, encoded); err == nil {
+					s.local.set(hostname, &cert, s.TTL)
+					return &cert, nil
+				}
+			}
+		}
+	}
+
+	cert, err := gen()
+	if err != nil {
+		return nil, err
+	}
+	s.local.set(hostname, cert, s.TTL)
+	if shared {
+		if encoded, err := encodeCertificate(cert); err == nil {
+			if sealed, err := s.seal(hostname, encoded); err == nil {
+				s.Shared.Set(s.Prefix+hostname, sealed, s.TTL)
+			}
+		}
+	}
+	return cert, nil
+}
+
+// seal encrypts the encoded certificate of hostname, prefixed with its nonce. The key in
+// Shared is authenticated with it, so that an entry can't be served for another host.
+func (s *SharedCertStorage) seal(hostname string, encoded []byte) ([]byte, error) {
+	nonce := make([]byte, s.aead.NonceSize(), s.aead.NonceSize()+len(encoded)+s.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return s.aead.Seal(nonce, nonce, encoded, []byte(s.Prefix+hostname)), nil
+}
+
+// open decrypts the sealed certificate of hostname
+func (s *SharedCertStorage) open(hostname string, sealed []byte) ([]byte, error) {
+	if len(sealed) < s.aead.NonceSize() {
+		return nil, errors.New("sealed certificate too short")
+	}
+	nonce, ciphertext := sealed[:s.aead.NonceSize()], sealed[s.aead.NonceSize():]
+	return s.aead.Open(nil, nonce, ciphertext, []byte(s.Prefix+hostname))
+}
+
+// encodeCertificate encodes the chain and the key of cert as PEM blocks
+func encodeCertificate(cert *tls.Certificate) ([]byte, error) {
+	var b []byte
+	for _, der := range cert.Certificate {
+		b = append(b, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	return append(b, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key})...), nil
+}
+
+// getScript returns {value} for existing keys and {} otherwise, as nil replies are
+// reported as errors by some clients
+const getScript = `
+local v = redis.call("GET", KEYS[1])
+if v then
+	return {v}
+end
+return {}
+`
+
+const setScript = `
+if tonumber(ARGV[2]) > 0 then
+	return redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[2])
+end
+return redis.call("SET", KEYS[1], ARGV[1])
+`
+
+// RedisCache is a SharedCache stored in Redis
+type RedisCache struct {
+	Client RedisClient
+	// Prefix is prepended to the keys
+	Prefix string
+}
+
+// Get implements SharedCache
+func (c *RedisCache) Get(key string) ([]byte, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	res, err := c.Client.Eval(ctx, getScript, []string{c.Prefix + key})
+	if err != nil {
+		return nil, false, err
+	}
+	values, ok := res.([]interface{})
+	if !ok {
+		return nil, false, fmt.Errorf("unexpected redis reply %v", res)
+	}
+	if len(values) == 0 {
+		return nil, false, nil
+	}
+	switch v := values[0].(type) {
+	case string:
+		return []byte(v), true, nil
+	case []byte:
+		return v, true, nil
+	}
+	return nil, false, errors.New("unexpected redis value type")
+}
+
+// Set implements SharedCache
+func (c *RedisCache) Set(key string, value []byte, ttl time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	_, err := c.Client.Eval(ctx, setScript, []string{c.Prefix + key}, string(value), int64(ttl/time.Millisecond))
+	return err
+}
@@ -0,0 +1,107 @@
+package goproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+type mapCache struct {
+	mu     sync.Mutex
+	values map[string][]byte
+}
+
+func (c *mapCache) Get(key string) ([]byte, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	v, ok := c.values[key]
+	return v, ok, nil
+}
+
+func (c *mapCache) Set(key string, value []byte, ttl time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[key] = value
+	return nil
+}
+
+func TestCachingResolverShared(t *testing.T) {
+	lookups := 0
+	upstream := ResolverFunc(func(ctx context.Context, host string, hints LookupHints) ([]net.IP, error) {
+		lookups++
+		return []net.IP{net.ParseIP("10.0.0.1")}, nil
+	})
+	shared := &mapCache{values: map[string][]byte{}}
+	a := &CachingResolver{Resolver: upstream, Shared: shared}
+	b := &CachingResolver{Resolver: upstream, Shared: shared}
+
+	for _, r := range []*CachingResolver{a, a, b} {
+		ips, err := r.LookupIP(context.Background(), "example.com", LookupHints{Network: "ip"})
+		if err != nil || len(ips) != 1 || !ips[0].Equal(net.ParseIP("10.0.0.1")) {
+			t.Fatalf("unexpected answer %v %v", ips, err)
+		}
+	}
+	if lookups != 1 {
+		t.Errorf("expected a single upstream lookup, got %d", lookups)
+	}
+}
+
+func TestSharedCertStorage(t *testing.T) {
+	shared := &mapCache{values: map[string][]byte{}}
+	signs := 0
+	gen := func() (*tls.Certificate, error) {
+		signs++
+		return signHost(GoproxyCa, []string{"example.com"})
+	}
+	key := []byte("0123456789abcdef0123456789abcdef")
+	a := &SharedCertStorage{Shared: shared, Key: key}
+	b := &SharedCertStorage{Shared: shared, Key: key}
+	certA, err := a.Fetch("example.com", gen)
+	orFatal("fetch", err, t)
+	certB, err := b.Fetch("example.com", gen)
+	orFatal("fetch", err, t)
+	if signs != 1 {
+		t.Errorf("expected a single signature, got %d", signs)
+	}
+	if string(certA.Certificate[0]) != string(certB.Certificate[0]) {
+		t.Error("instances got different certificates")
+	}
+
+	// the private keys are sealed in the shared cache
+	if bytes.Contains(shared.values["example.com"], []byte("PRIVATE KEY")) {
+		t.Error("expected the private key to be encrypted in the shared cache")
+	}
+
+	// an instance with another key, or none, signs the host itself
+	c := &SharedCertStorage{Shared: shared, Key: []byte("fedcba9876543210")}
+	_, err = c.Fetch("example.com", gen)
+	orFatal("fetch", err, t)
+	d := &SharedCertStorage{Shared: shared}
+	_, err = d.Fetch("example.com", gen)
+	orFatal("fetch", err, t)
+	if signs != 3 {
+		t.Errorf("expected the instances without the key to sign, got %d signatures", signs)
+	}
+
+	if _, err := (&SharedCertStorage{Shared: shared, Key: []byte("short")}).Fetch("example.com", gen); err == nil {
+		t.Error("expected an invalid key to fail the fetch")
+	}
+}
+
+func TestLRUCacheEviction(t *testing.T) {
+	c := newLRUCache(2)
+	c.set("a", 1, 0)
+	c.set("b", 2, 0)
+	c.get("a")
+	c.set("c", 3, 0)
+	if _, ok := c.get("b"); ok {
+		t.Error("expected the least recently used entry to be evicted")
+	}
+	if _, ok := c.get("a"); !ok {
+		t.Error("expected a to be kept")
+	}
+}
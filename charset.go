@@ -0,0 +1,51 @@
+package goproxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/html/charset"
+	"golang.org/x/text/transform"
+)
+
+// TranscodeToUTF8 converts the body of resp, the response of ctx, from the charset reported
+// by ctx.Charset() to UTF-8 as it is read, and updates the charset of its Content-Type header,
+// so that the handlers inspecting the body can assume it is UTF-8. Responses without a
+// charset, or already in UTF-8, are left as is. The body must have been decoded first, see
+// DecodeContent.
+func (ctx *ProxyCtx) TranscodeToUTF8(resp *http.Response) error {
+	if resp == nil || resp.Body == nil {
+		return nil
+	}
+	name := charsetOf(resp.Header)
+	if name == "" {
+		return nil
+	}
+	enc, canonical := charset.Lookup(name)
+	if enc == nil {
+		return fmt.Errorf("unsupported charset %s", name)
+	}
+	if canonical == "utf-8" {
+		return nil
+	}
+	ctx.Logf("Transcoding response body from %s to utf-8", canonical)
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{transform.NewReader(resp.Body, enc.NewDecoder()), resp.Body}
+	resp.Header.Set("Content-Type", charsetFinder.ReplaceAllString(resp.Header.Get("Content-Type"), "charset=utf-8"))
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	return nil
+}
+
+// charsetOf returns the charset of the Content-Type header of h, without quotes
+func charsetOf(h http.Header) string {
+	charsets := charsetFinder.FindStringSubmatch(h.Get("Content-Type"))
+	if charsets == nil {
+		return ""
+	}
+	return strings.Trim(charsets[1], `"`)
+}
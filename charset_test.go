@@ -0,0 +1,31 @@
+package goproxy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+func TestTranscodeToUTF8(t *testing.T) {
+	// "café crème" in ISO-8859-1
+	latin1 := []byte{'c', 'a', 'f', 0xe9, ' ', 'c', 'r', 0xe8, 'm', 'e'}
+	resp := &http.Response{StatusCode: 200, Header: http.Header{}, ContentLength: int64(len(latin1)),
+		Body: ioutil.NopCloser(bytes.NewReader(latin1))}
+	resp.Header.Set("Content-Type", "text/html; charset=ISO-8859-1")
+	ctx := &ProxyCtx{Resp: resp, Proxy: NewProxyHttpServer()}
+	orFatal("TranscodeToUTF8", ctx.TranscodeToUTF8(resp), t)
+	body, err := ioutil.ReadAll(resp.Body)
+	orFatal("ReadAll", err, t)
+	if string(body) != "café crème" {
+		t.Errorf("unexpected transcoded body %q", body)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "text/html; charset=utf-8" || ctx.Charset() != "utf-8" {
+		t.Errorf("unexpected Content-Type %q", ct)
+	}
+
+	resp.Header.Set("Content-Type", "text/html; charset=x-bobo")
+	if err := ctx.TranscodeToUTF8(resp); err == nil {
+		t.Error("expected an error for an unknown charset")
+	}
+}
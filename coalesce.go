@@ -0,0 +1,117 @@
+package goproxy
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// coalescer merges identical requests in flight into a single upstream request
+type coalescer struct {
+	// hits must be aligned in i386
+	hits int64
+
+	mu    sync.Mutex
+	calls map[string]*coalescedCall
+}
+
+type coalescedCall struct {
+	wg sync.WaitGroup
+	// resp holds the response of the upstream request, with its whole body
+	resp *CachedResponse
+	err  error
+	// unshared is set when the response can't be shared, because its body is too large or
+	// it can't be stored in a shared cache, the waiting requests are then sent upstream on
+	// their own
+	unshared bool
+}
+
+// CoalesceHits returns the number of requests that were answered with the response of an
+// identical request in flight
+func (proxy *ProxyHttpServer) CoalesceHits() int64 {
+	proxy.coalesceOnce.Do(proxy.initCoalescer)
+	return atomic.LoadInt64(&proxy.coalescer.hits)
+}
+
+func (proxy *ProxyHttpServer) initCoalescer() {
+	proxy.coalescer = &coalescer{calls: make(map[string]*coalescedCall)}
+}
+
+// coalescedFetch sends r through roundTrip, unless an identical request is in flight, in which
+// case it waits for it and answers with a copy of its response
+func (proxy *ProxyHttpServer) coalescedFetch(ctx *ProxyCtx, key string, r *http.Request, roundTrip func(*http.Request) (*http.Response, error)) (*http.Response, error) {
+	proxy.coalesceOnce.Do(proxy.initCoalescer)
+	c := proxy.coalescer
+
+	c.mu.Lock()
+	if call, ok := c.calls[key]; ok {
+		c.mu.Unlock()
+		call.wg.Wait()
+		if call.err != nil {
+			return nil, call.err
+		}
+		if call.unshared {
+			return roundTrip(r)
+		}
+		atomic.AddInt64(&c.hits, 1)
+		if proxy.CoalesceHitsMetric != nil {
+			metric := *proxy.CoalesceHitsMetric
+			metric.Inc()
+		}
+		ctx.CacheStatus = CacheCoalesced
+		ctx.Logf("coalesced request %s", key)
+		return call.resp.Response(r), nil
+	}
+	call := &coalescedCall{}
+	call.wg.Add(1)
+	c.calls[key] = call
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.calls, key)
+		c.mu.Unlock()
+		call.wg.Done()
+	}()
+
+	resp, err := roundTrip(r)
+	if err != nil {
+		call.err = err
+		return nil, err
+	}
+
+	// the responses private to the client, e.g. personalised ones, are never shared
+	if _, ok := freshness(resp); !ok || proxy.Streaming.streams(resp) {
+		call.unshared = true
+		return resp, nil
+	}
+	max := proxy.maxCacheObjectSize()
+	body, err := ctx.readAll(io.LimitReader(resp.Body, max+1))
+	if err != nil {
+		resp.Body.Close()
+		call.err = err
+		return nil, err
+	}
+	if int64(len(body)) > max {
+		call.unshared = true
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		return resp, nil
+	}
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+
+	call.resp = &CachedResponse{StatusCode: resp.StatusCode, Header: cloneHeader(resp.Header), Body: body}
+	if proxy.Cache != nil && r.Header.Get("Range") == "" {
+		if cached := newCachedResponse(resp, body); cached != nil {
+			proxy.Cache.Set(key, cached)
+		}
+	}
+	return resp, nil
+}
@@ -0,0 +1,103 @@
+package goproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ClientConfig is the configuration pushed to the agents running on the clients
+type ClientConfig struct {
+	// Version increases with every change of the configurations, see ConfigPush.Notify
+	Version uint64 `json:"version"`
+	// Bypass are the destinations the client reaches directly, as in LocalDestinations.Hosts
+	// and LocalDestinations.CIDRs
+	Bypass []string `json:"bypass,omitempty"`
+	// Exit is the exit the client should select, e.g. a region or a forward proxy name
+	Exit string `json:"exit,omitempty"`
+}
+
+// ConfigPush distributes their configuration to the authenticated clients long polling the
+// /config internal endpoint, making the proxy the distribution point of the policies of the
+// tenants. A client polls with the version it has, e.g. /config?version=12, and gets the
+// current configuration as soon as it has another version, or 304 Not Modified after MaxWait.
+// A client ahead of the proxy, e.g. after the proxy restarted, gets it at once.
+type ConfigPush struct {
+	// Generate returns the configuration of the client of ctx, typically from the policy of its
+	// tenant. The configuration bypasses the LocalDestinations of the proxy if nil.
+	Generate func(ctx *ProxyCtx) *ClientConfig
+	// MaxWait bounds the time a poll waits for a change, 30s if zero
+	MaxWait time.Duration
+
+	mu      sync.Mutex
+	version uint64
+	changed chan struct{}
+}
+
+// Notify signals that the configurations changed, e.g. after the policy of a tenant was
+// updated, and wakes the clients waiting for it
+func (p *ConfigPush) Notify() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.version++
+	if p.changed != nil {
+		close(p.changed)
+		p.changed = nil
+	}
+}
+
+// current returns the current version, and a channel closed when it changes
+func (p *ConfigPush) current() (uint64, chan struct{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.changed == nil {
+		p.changed = make(chan struct{})
+	}
+	return p.version, p.changed
+}
+
+func (p *ConfigPush) config(ctx *ProxyCtx, version uint64) *ClientConfig {
+	var config *ClientConfig
+	if p.Generate != nil {
+		config = p.Generate(ctx)
+	}
+	if config == nil {
+		config = &ClientConfig{}
+		if local := ctx.Proxy.LocalDestinations; local != nil {
+			config.Bypass = append(append(config.Bypass, local.Hosts...), local.CIDRs...)
+		}
+	}
+	config.Version = version
+	return config
+}
+
+// response answers the poll r of the client of ctx
+func (p *ConfigPush) response(ctx *ProxyCtx, r *http.Request) *http.Response {
+	if ctx.ProxyUser == "" && ctx.Tenant() == nil {
+		return NewResponse(r, ContentTypeText, http.StatusForbidden, "the configuration is only pushed to authenticated clients\n")
+	}
+	known, err := strconv.ParseUint(r.URL.Query().Get("version"), 10, 64)
+	version, changed := p.current()
+	if err == nil && known == version {
+		maxWait := p.MaxWait
+		if maxWait <= 0 {
+			maxWait = 30 * time.Second
+		}
+		timer := time.NewTimer(maxWait)
+		defer timer.Stop()
+		select {
+		case <-changed:
+			version, _ = p.current()
+		case <-timer.C:
+			return NewResponse(r, ContentTypeText, http.StatusNotModified, "")
+		case <-r.Context().Done():
+			return NewResponse(r, ContentTypeText, http.StatusNotModified, "")
+		}
+	}
+	body, _ := json.Marshal(p.config(ctx, version))
+	resp := NewResponse(r, ContentTypeJSON, http.StatusOK, string(body))
+	resp.Header.Set("Cache-Control", "no-store")
+	return resp
+}
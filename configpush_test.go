@@ -0,0 +1,75 @@
+package goproxy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestConfigPush(t *testing.T) {
+	push := &ConfigPush{MaxWait: 50 * time.Millisecond}
+	proxy := NewProxyHttpServer()
+	proxy.OnRequest().DoFunc(func(r *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response) {
+		ctx.ProxyUser = r.Header.Get("X-User")
+		return r, nil
+	})
+	proxy.LocalDestinations = &LocalDestinations{Hosts: []string{"*.corp.example.com"}}
+	proxy.InternalEndpoints = &InternalEndpoints{ConfigPush: push}
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+	proxyURL, _ := url.Parse(s.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	poll := func(user, query string) (*http.Response, *ClientConfig) {
+		req, _ := http.NewRequest("GET", "http://proxy.internal/config"+query, nil)
+		req.Header.Set("X-User", user)
+		resp, err := client.Do(req)
+		orFatal("GET /config", err, t)
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		var config ClientConfig
+		if resp.StatusCode == http.StatusOK {
+			orFatal("Unmarshal", json.Unmarshal(body, &config), t)
+		}
+		return resp, &config
+	}
+
+	if resp, _ := poll("", ""); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected unauthenticated clients to be rejected, got %s", resp.Status)
+	}
+	resp, config := poll("bobo", "")
+	if resp.StatusCode != http.StatusOK || config.Version != 0 || len(config.Bypass) != 1 || config.Bypass[0] != "*.corp.example.com" {
+		t.Errorf("unexpected configuration %s %+v", resp.Status, config)
+	}
+	if resp, _ := poll("bobo", "?version=0"); resp.StatusCode != http.StatusNotModified {
+		t.Errorf("expected an unchanged configuration to time out, got %s", resp.Status)
+	}
+
+	push.MaxWait = 5 * time.Second
+	done := make(chan *ClientConfig)
+	go func() {
+		_, config := poll("bobo", "?version=0")
+		done <- config
+	}()
+	time.Sleep(20 * time.Millisecond)
+	push.Notify()
+	select {
+	case config := <-done:
+		if config.Version != 1 {
+			t.Errorf("expected the new configuration to be pushed, got %+v", config)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("expected the waiting poll to be woken by Notify")
+	}
+
+	// a client ahead of the proxy, e.g. after a restart, is answered at once
+	start := time.Now()
+	resp, config = poll("bobo", "?version=7")
+	if resp.StatusCode != http.StatusOK || config.Version != 1 || time.Since(start) > time.Second {
+		t.Errorf("expected the current configuration at once, got %s %+v after %v", resp.Status, config, time.Since(start))
+	}
+}
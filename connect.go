@@ -0,0 +1,179 @@
+package goproxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+)
+
+// ConnectResponse is the response to an accepted CONNECT request, written to the client before
+// the tunnel starts. Its status code is always 200.
+type ConnectResponse struct {
+	// Proto is the protocol of the status line, "HTTP/1.1" by default
+	Proto string
+	// Reason is the reason phrase of the status line, "Connection Established" by default
+	Reason string
+	Header http.Header
+}
+
+// forwardProxyTLSConfig returns the TLS configuration of the connections to the https forward
+// proxy hostport of ctx
+func (ctx *ProxyCtx) forwardProxyTLSConfig(hostport string) *tls.Config {
+	config := ctx.ForwardProxyTLSConfig
+	if config == nil {
+		return ctx.Proxy.Tr.TLSClientConfig
+	}
+	if config.ServerName == "" {
+		config = config.Clone()
+		config.ServerName = hostOnly(hostport)
+	}
+	return config
+}
+
+// writeConnectEstablished answers 200 to the CONNECT request of ctx on client, once the
+// connection to the destination is set up. The response set on ctx by the CONNECT handlers is
+// applied first, then ProxyHttpServer.ConnectResponse may rewrite it.
+//
+// A CONNECT handler can make the tunnel exit directly from a local address rather than through
+// a forward proxy, by setting ProxyCtx.ForwardProxyDirect and ProxyCtx.ForwardProxySourceIP.
+// ProxyCtx.ForwardProxyDirectSendOK then has the client answered here once the destination is
+// connected; it must be left false for the transparently proxied connections, whose clients
+// never sent a CONNECT and expect the TLS stream of the destination straight away. Bytes the
+// client sends right after its CONNECT, without waiting for the response, are relayed once the
+// tunnel is up.
+func (proxy *ProxyHttpServer) writeConnectEstablished(ctx *ProxyCtx, client net.Conn) error {
+	resp := &ConnectResponse{Proto: "HTTP/1.1", Reason: "Connection Established", Header: make(http.Header)}
+	if override := ctx.ConnectResponse; override != nil {
+		if override.Proto != "" {
+			resp.Proto = override.Proto
+		}
+		if override.Reason != "" {
+			resp.Reason = override.Reason
+		}
+		for k, vs := range override.Header {
+			resp.Header[k] = append([]string(nil), vs...)
+		}
+	}
+	if proxy.ConnectResponse != nil {
+		proxy.ConnectResponse(ctx, resp)
+	}
+	var b bytes.Buffer
+	b.WriteString(resp.Proto + " 200 " + resp.Reason + "\r\n")
+	resp.Header.Write(&b)
+	b.WriteString("\r\n")
+	_, err := client.Write(b.Bytes())
+	return err
+}
+
+// SetConnectHeader sets a header of the 200 response to the CONNECT request of ctx, for the
+// clients expecting e.g. keep-alive hints or a Via marker
+func (ctx *ProxyCtx) SetConnectHeader(name, value string) {
+	if ctx.ConnectResponse == nil {
+		ctx.ConnectResponse = &ConnectResponse{}
+	}
+	if ctx.ConnectResponse.Header == nil {
+		ctx.ConnectResponse.Header = make(http.Header)
+	}
+	ctx.ConnectResponse.Header.Set(name, value)
+}
+
+// bufferedConn is a connection whose first bytes were already read into a buffer, e.g. the
+// TLS client hello the clients send right after their CONNECT request without waiting for the
+// response
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	if c.r.Buffered() > 0 {
+		return c.r.Read(b)
+	}
+	return c.Conn.Read(b)
+}
+
+// hijackedConn returns the connection of a hijacked request, with the bytes the client sent
+// after the request and the server already buffered
+func hijackedConn(conn net.Conn, brw *bufio.ReadWriter) net.Conn {
+	if brw == nil || brw.Reader.Buffered() == 0 {
+		return conn
+	}
+	return &bufferedConn{Conn: conn, r: brw.Reader}
+}
+
+// UpstreamConnectError is the error of the forward proxy dialers when the forward proxy refuses
+// a CONNECT request, e.g. with a 407, 403 or 502
+type UpstreamConnectError struct {
+	StatusCode int
+	Status     string
+	Header     http.Header
+	// Body is the beginning of the body of the response of the forward proxy
+	Body []byte
+}
+
+func (e *UpstreamConnectError) Error() string {
+	return "proxy refused connection" + string(e.Body)
+}
+
+// maxUpstreamConnectErrorBody bounds the body kept from the error responses of forward proxies
+const maxUpstreamConnectErrorBody = 500
+
+func newUpstreamConnectError(resp *http.Response) (*UpstreamConnectError, error) {
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxUpstreamConnectErrorBody))
+	if err != nil {
+		return nil, err
+	}
+	return &UpstreamConnectError{StatusCode: resp.StatusCode, Status: resp.Status, Header: resp.Header, Body: body}, nil
+}
+
+// Response returns the response relaying e to the client. The challenges of the forward proxy
+// are not relayed, they are for the credentials of the proxy rather than the ones of the client.
+func (e *UpstreamConnectError) Response() *http.Response {
+	header := make(http.Header)
+	if contentType := e.Header.Get("Content-Type"); contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+	return &http.Response{
+		Status:        e.Status,
+		StatusCode:    e.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(e.Body)),
+		ContentLength: int64(len(e.Body)),
+	}
+}
+
+// connectError answers the client of a CONNECT request whose tunnel could not be set up because
+// of err, and closes it. The refusals of the forward proxies are relayed as they are, or as
+// ProxyHttpServer.UpstreamConnectErrorResponse maps them; other errors are answered with 502.
+func (proxy *ProxyHttpServer) connectError(ctx *ProxyCtx, client net.Conn, err error) {
+	refused, ok := err.(*UpstreamConnectError)
+	if !ok {
+		httpError(client, ctx, err)
+		return
+	}
+	var resp *http.Response
+	if proxy.UpstreamConnectErrorResponse != nil {
+		resp = proxy.UpstreamConnectErrorResponse(ctx, refused)
+	} else {
+		resp = refused.Response()
+	}
+	if resp == nil {
+		httpError(client, ctx, err)
+		return
+	}
+	ctx.Logf("relaying the refusal of the forward proxy: %s", resp.Status)
+	resp.Close = true
+	if err := resp.Write(client); err != nil {
+		ctx.Warnf("Error responding to client: %s", err)
+	}
+	if err := client.Close(); err != nil {
+		ctx.Warnf("Error closing client connection: %s", err)
+	}
+}
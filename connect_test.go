@@ -0,0 +1,192 @@
+package goproxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestConnectDirectPipelined(t *testing.T) {
+	upstream := httptest.NewServer(ConstantHanlder("bobo"))
+	defer upstream.Close()
+	host := upstream.Listener.Addr().String()
+
+	proxy := NewProxyHttpServer()
+	proxy.OnRequest().HandleConnectFunc(func(host string, ctx *ProxyCtx) (*ConnectAction, string) {
+		ctx.ForwardProxyDirect = true
+		ctx.ForwardProxySourceIP = "127.0.0.1"
+		ctx.ForwardProxyDirectSendOK = true
+		return OkConnect, host
+	})
+	proxy.ConnectResponse = func(ctx *ProxyCtx, resp *ConnectResponse) {
+		resp.Header.Set("Proxy-Agent", "goproxy")
+	}
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", s.Listener.Addr().String())
+	orFatal("Dial", err, t)
+	defer conn.Close()
+	// the request to tunnel is sent along with the CONNECT, without waiting for the response
+	_, err = conn.Write([]byte("CONNECT " + host + " HTTP/1.1\r\nHost: " + host + "\r\n\r\n" +
+		"GET / HTTP/1.1\r\nHost: " + host + "\r\nConnection: close\r\n\r\n"))
+	orFatal("Write", err, t)
+
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, &http.Request{Method: "CONNECT"})
+	orFatal("ReadResponse(CONNECT)", err, t)
+	if resp.Status != "200 Connection Established" || resp.Proto != "HTTP/1.1" || resp.Header.Get("Proxy-Agent") != "goproxy" {
+		t.Fatalf("unexpected CONNECT response %s %s %v", resp.Proto, resp.Status, resp.Header)
+	}
+	resp, err = http.ReadResponse(r, nil)
+	orFatal("ReadResponse(GET)", err, t)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), "bobo") {
+		t.Errorf("expected the pipelined request to be tunneled, got %q", body)
+	}
+}
+
+func TestConnectResponseOverride(t *testing.T) {
+	proxy := NewProxyHttpServer()
+	proxy.ConnectResponse = func(ctx *ProxyCtx, resp *ConnectResponse) {
+		resp.Header.Add("Via", "1.1 goproxy")
+	}
+	ctx := &ProxyCtx{Proxy: proxy}
+	ctx.SetConnectHeader("Proxy-Connection", "keep-alive")
+	ctx.ConnectResponse.Reason = "OK"
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		proxy.writeConnectEstablished(ctx, server)
+		server.Close()
+	}()
+	resp, err := http.ReadResponse(bufio.NewReader(client), &http.Request{Method: "CONNECT"})
+	orFatal("ReadResponse", err, t)
+	if resp.Status != "200 OK" || resp.Header.Get("Proxy-Connection") != "keep-alive" || resp.Header.Get("Via") != "1.1 goproxy" {
+		t.Errorf("unexpected CONNECT response %s %v", resp.Status, resp.Header)
+	}
+}
+
+func TestUpstreamConnectError(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Proxy-Authenticate", `Basic realm="upstream"`)
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusProxyAuthRequired)
+		w.Write([]byte("bad credentials"))
+	}))
+	defer upstream.Close()
+
+	proxy := NewProxyHttpServer()
+	proxy.OnRequest().HandleConnectFunc(func(host string, ctx *ProxyCtx) (*ConnectAction, string) {
+		ctx.ForwardProxy = upstream.Listener.Addr().String()
+		ctx.ForwardProxyDialTimeout = 5
+		return OkConnect, host
+	})
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	connect := func() (*http.Response, string) {
+		conn, err := net.Dial("tcp", s.Listener.Addr().String())
+		orFatal("Dial", err, t)
+		defer conn.Close()
+		_, err = conn.Write([]byte("CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n"))
+		orFatal("Write", err, t)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "GET"})
+		orFatal("ReadResponse", err, t)
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+
+	resp, body := connect()
+	if resp.StatusCode != http.StatusProxyAuthRequired || body != "bad credentials" {
+		t.Errorf("expected the refusal of the forward proxy to be relayed, got %s %q", resp.Status, body)
+	}
+	if resp.Header.Get("Proxy-Authenticate") != "" {
+		t.Error("the challenge of the forward proxy should not be relayed")
+	}
+
+	proxy.UpstreamConnectErrorResponse = func(ctx *ProxyCtx, err *UpstreamConnectError) *http.Response {
+		if err.StatusCode == http.StatusProxyAuthRequired {
+			return &http.Response{StatusCode: http.StatusBadGateway, ProtoMajor: 1, ProtoMinor: 1,
+				Header: make(http.Header), Body: ioutil.NopCloser(strings.NewReader("upstream auth"))}
+		}
+		return nil
+	}
+	if resp, _ := connect(); resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("expected the refusal to be mapped to 502, got %s", resp.Status)
+	}
+}
+
+func TestForwardProxyTLSConfig(t *testing.T) {
+	target := httptest.NewServer(ConstantHanlder("bobo"))
+	defer target.Close()
+	host := target.Listener.Addr().String()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(GoproxyCa.Leaf)
+	serverCert, err := signHost(GoproxyCa, []string{"127.0.0.1"})
+	orFatal("signHost", err, t)
+	clientCert, err := signHost(GoproxyCa, []string{"client.example.com"})
+	orFatal("signHost", err, t)
+	next := httptest.NewUnstartedServer(NewProxyHttpServer())
+	next.TLS = &tls.Config{Certificates: []tls.Certificate{*serverCert}, ClientAuth: tls.RequireAnyClientCert,
+		VerifyPeerCertificate: func(raw [][]byte, _ [][]*x509.Certificate) error {
+			// the certificates of signHost are server certificates
+			cert, err := x509.ParseCertificate(raw[0])
+			if err == nil {
+				_, err = cert.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}})
+			}
+			return err
+		}}
+	next.StartTLS()
+	defer next.Close()
+
+	var config *tls.Config
+	proxy := NewProxyHttpServer()
+	proxy.Tr.TLSClientConfig = &tls.Config{}
+	proxy.OnRequest().HandleConnectFunc(func(host string, ctx *ProxyCtx) (*ConnectAction, string) {
+		ctx.ForwardProxy = next.Listener.Addr().String()
+		ctx.ForwardProxyProto = "https"
+		ctx.ForwardProxyDialTimeout = 5
+		ctx.ForwardProxyDirectSendOK = true
+		ctx.ForwardProxyTLSConfig = config
+		return OkConnect, host
+	})
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	connect := func() string {
+		conn, err := net.Dial("tcp", s.Listener.Addr().String())
+		orFatal("Dial", err, t)
+		defer conn.Close()
+		conn.Write([]byte("CONNECT " + host + " HTTP/1.1\r\nHost: " + host + "\r\n\r\n"))
+		r := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(r, &http.Request{Method: "CONNECT"})
+		if err != nil || resp.StatusCode != http.StatusOK {
+			return "CONNECT failed"
+		}
+		conn.Write([]byte("GET / HTTP/1.1\r\nHost: " + host + "\r\n\r\n"))
+		resp, err = http.ReadResponse(r, nil)
+		if err != nil {
+			return err.Error()
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		return string(body)
+	}
+
+	if body := connect(); body == "bobo" {
+		t.Error("expected the forward proxy to be untrusted without ForwardProxyTLSConfig")
+	}
+	config = &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{*clientCert}}
+	if body := connect(); body != "bobo" {
+		t.Errorf("expected the tunnel through the TLS forward proxy, got %q", body)
+	}
+}
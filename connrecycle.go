@@ -0,0 +1,92 @@
+package goproxy
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ConnRecycling bounds the lifetime of the pooled connections to the destinations, those of
+// the transport of the fast path and of the UpstreamHTTP2 transports. A connection kept alive
+// by a steady flow of requests is otherwise never closed, and the proxy misses the DNS
+// changes, the rebalancing of the load balancers and the certificate rotations of the origins.
+//
+// The request sent on a connection older than MaxLifetime asks to close it once it is done:
+// HTTP/1.1 connections are closed after its response, HTTP/2 connections take no new streams
+// and are closed once their streams are done. The requests in flight are never interrupted.
+type ConnRecycling struct {
+	// MaxLifetime is how long a connection is reused after its first request
+	MaxLifetime time.Duration
+	// Metric, if set, counts the connections recycled
+	Metric *prometheus.Counter
+
+	recycled int64
+
+	mu    sync.Mutex
+	born  map[net.Conn]time.Time
+	swept time.Time
+}
+
+// Recycled returns the number of connections recycled
+func (c *ConnRecycling) Recycled() int64 {
+	return atomic.LoadInt64(&c.recycled)
+}
+
+// expired records conn and reports whether it is older than MaxLifetime, forgetting it then
+func (c *ConnRecycling) expired(conn net.Conn) bool {
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	born, ok := c.born[conn]
+	if !ok {
+		if c.born == nil {
+			c.born = make(map[net.Conn]time.Time)
+		}
+		c.born[conn] = now
+		// forget the connections closed without being recycled, the ones still open are
+		// recorded again on their next request
+		if now.Sub(c.swept) > c.MaxLifetime {
+			for k, t := range c.born {
+				if now.Sub(t) > 2*c.MaxLifetime {
+					delete(c.born, k)
+				}
+			}
+			c.swept = now
+		}
+		return false
+	}
+	if now.Sub(born) < c.MaxLifetime {
+		return false
+	}
+	delete(c.born, conn)
+	return true
+}
+
+// request returns req asking to close its connection if it is older than MaxLifetime
+func (c *ConnRecycling) request(req *http.Request) *http.Request {
+	if c == nil || c.MaxLifetime <= 0 {
+		return req
+	}
+	var out *http.Request
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Conn == nil || !c.expired(info.Conn) {
+				return
+			}
+			// the transports read Close once they got the connection
+			out.Close = true
+			atomic.AddInt64(&c.recycled, 1)
+			if c.Metric != nil {
+				metric := *c.Metric
+				metric.Inc()
+			}
+		},
+	}
+	out = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	return out
+}
@@ -0,0 +1,46 @@
+package goproxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestConnRecycling(t *testing.T) {
+	var conns []string
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conns = append(conns, r.RemoteAddr)
+	}))
+	defer target.Close()
+
+	proxy := NewProxyHttpServer()
+	proxy.FastPath = true
+	proxy.Tr = &http.Transport{}
+	proxy.ConnRecycling = &ConnRecycling{MaxLifetime: 100 * time.Millisecond}
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	proxyURL, _ := url.Parse(s.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	get := func() {
+		resp, err := client.Get(target.URL)
+		orFatal("Get", err, t)
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	get()
+	get()
+	time.Sleep(150 * time.Millisecond)
+	// sent on the expired connection, which is closed after it
+	get()
+	get()
+	if len(conns) != 4 || conns[0] != conns[1] || conns[1] != conns[2] || conns[2] == conns[3] {
+		t.Errorf("expected the connection to be replaced once expired, got %v", conns)
+	}
+	if proxy.ConnRecycling.Recycled() != 1 {
+		t.Errorf("expected 1 connection recycled, got %d", proxy.ConnRecycling.Recycled())
+	}
+}
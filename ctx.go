@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
 	"regexp"
 	"strings"
@@ -27,18 +28,23 @@ type ProxyLeveledLogger struct {
 type ProxyCtx struct {
 	// Will contain the client request from the proxy
 	Req *http.Request
+	// Target is the host:port of the destination of the request or tunnel, with the default
+	// port of its scheme when its URL has none, see ProxyHttpServer.DefaultPorts
+	Target string
 	// Will contain the remote server's response (if available. nil if the request wasn't send yet)
 	Resp         *http.Response
 	RoundTripper RoundTripper
 	// will contain the recent error that occurred while trying to send receive or parse traffic
 	Error error
 	// A handle for the user to keep data in the context, from the call of ReqHandler to the
-	// call of RespHandler
+	// call of RespHandler. Handler libraries should use SetValue instead, which doesn't
+	// collide with the data of other handlers.
 	UserData interface{}
 	// Will connect a request to a response
-	Session   int64
-	certStore CertStorage
-	Proxy     *ProxyHttpServer
+	Session int64
+	Proxy   *ProxyHttpServer
+	// cfg is the configuration snapshot of the proxy when the request was accepted
+	cfg *ctxConfig
 
 	// Cancel can be used to ensure contexts created during the request
 	// in callbacks provided to DoFunc and HandleConnectFunc are cancelled
@@ -91,15 +97,168 @@ type ProxyCtx struct {
 	ProxyWriteDeadline                   int
 	CopyBufferSize                       int
 	Accounting                           string
-	BytesSent                            int64
-	BytesReceived                        int64
-	Tail                                 func(*ProxyCtx) error
+	// BytesSent counts the bytes written to the destination. BytesReceived counts the bytes of
+	// the response bodies relayed to the client, without the headers of the responses, for plain
+	// HTTP requests as for mitm'd and HTTP/2 ones; tunnels count every byte relayed.
+	BytesSent     int64
+	BytesReceived int64
+	Tail          func(*ProxyCtx) error
+	// FirstByte is the time from the reception of the request to the headers of its response
+	// written to the client, ResponseDuration to the end of its body. They are set once the
+	// response of a plain or mitm'd HTTP request is relayed, before Tail is called.
+	FirstByte        time.Duration
+	ResponseDuration time.Duration
+	// DialTrace holds the timings of the connection setup to the destination or the forward proxy
+	DialTrace *DialTrace
+	// Resolver and BackupResolver resolve destination and forward proxy host names.
+	// When set, they take precedence over the DNSResolver and BackupDNSResolver addresses.
+	Resolver       Resolver
+	BackupResolver Resolver
+	// DNSForceTCP makes the lookups of this request use tcp instead of udp
+	DNSForceTCP bool
+	// PolicyDecision is set when the request was denied through BlockedResponse
+	PolicyDecision *PolicyDecision
+	// RedirectPolicy, if set, overrides the RedirectPolicy of the proxy for this request
+	RedirectPolicy *RedirectPolicy
+	// RedirectChain contains the URLs of the redirects followed by the proxy, in order
+	RedirectChain []*url.URL
+	// CacheStatus is CacheHit, CacheMiss or CacheCoalesced for the requests that went through
+	// the cache or the coalescing of the proxy, empty otherwise
+	CacheStatus string
+	// StalePolicy, if set, overrides the StalePolicy of the proxy for this request
+	StalePolicy *StalePolicy
+	// EncodingPolicy, if set, overrides the EncodingPolicy of the proxy for this request
+	EncodingPolicy *EncodingPolicy
+	// UserAgentPolicy, if set, overrides the UserAgentPolicy of the proxy for this request
+	UserAgentPolicy *UserAgentPolicy
+	// OriginalUserAgent is the User-Agent the client sent, before the handlers and the
+	// UserAgentPolicy changed it
+	OriginalUserAgent string
+	// FingerprintPolicy is set by ReduceFingerprint
+	FingerprintPolicy *FingerprintPolicy
+	// CachePartition, if set, separates the responses the proxy caches for this request from
+	// the ones cached for requests of other partitions
+	CachePartition string
+	// HeaderLimits, if set, overrides the HeaderLimits of the proxy for this request
+	HeaderLimits *HeaderLimits
+	// ConnectResponse, if set by a CONNECT handler, overrides the status text and sets headers of
+	// the 200 response to this CONNECT request. Its empty fields keep their default.
+	ConnectResponse *ConnectResponse
+	// FallbackChain are the forward proxies tried in order when the connection through
+	// ForwardProxy fails. It replaces ForwardProxyErrorFallback, which is still honored and
+	// tried first.
+	FallbackChain []FallbackUpstream
+	// DialBudget, if set, overrides the DialBudget of the proxy for this request
+	DialBudget *DialBudget
+	// TunnelEngine, if set, overrides the TunnelEngine of the proxy for this CONNECT request
+	TunnelEngine string
+	// WriteCoalescing, if set, overrides the WriteCoalescing of the proxy for this CONNECT
+	// request
+	WriteCoalescing *WriteCoalescing
+	// AdaptiveBuffers, if set, overrides the AdaptiveBuffers of the proxy for this CONNECT
+	// request
+	AdaptiveBuffers *AdaptiveBuffers
+	// UpstreamHTTP2 sends the https requests through a transport negotiating HTTP/2 with
+	// ALPN, whose connections are shared with the other requests, instead of writing an
+	// HTTP/1.1 request on a new connection. The requests through a ForwardProxy are not
+	// affected.
+	UpstreamHTTP2 bool
+	// UpstreamHTTP3 sends the https requests through the HTTP3 transport of the proxy, if
+	// set. The requests it fails are sent over TCP, and so are the requests to their origin
+	// for a while. The requests whose body can't be sent again are always sent over TCP.
+	UpstreamHTTP3 bool
+	// ResponseAnnotations, if set, overrides the ResponseAnnotations of the proxy and of the
+	// tenant for this request
+	ResponseAnnotations *ResponseAnnotations
+	// ProxyProtocolUpstream sends a PROXY protocol v2 header with the address of the client
+	// at the start of the connections to the destination or to the forward proxy of this
+	// request. The header carries the Accounting of the request in a TLV of type
+	// ProxyProtocolTLVAccounting, its tags in ProxyProtocolTLVTags, and ProxyProtocolTLVs.
+	// The connections of UpstreamHTTP2, shared with other requests, carry no header.
+	ProxyProtocolUpstream bool
+	ProxyProtocolTLVs     map[byte][]byte
+	// ForwardProxyTLSConfig, if set, is the TLS configuration of the connections to the
+	// ForwardProxy of the "https" ForwardProxyProto, e.g. with the RootCAs of a TLS
+	// terminating enterprise proxy and the client Certificates it requires. Its ServerName
+	// defaults to the host of the forward proxy. The TLSClientConfig of the transport of the
+	// proxy is used otherwise.
+	ForwardProxyTLSConfig *tls.Config
+
+	httpTrace *httptrace.ClientTrace
+	tenant    *Tenant
+
+	// when the request was received, see ResponseAnnotations
+	received time.Time
+
+	requestKey    string
+	requestKeyReq *http.Request
+
+	// the Accept-Encoding of the client, before removeProxyHeaders removed it
+	clientAcceptEncoding    string
+	clientAcceptEncodingSet bool
+
+	// the values of SetValue
+	values map[interface{}]interface{}
+
+	// the number of upstreams of FallbackChain tried
+	fallbackAttempts int
+
+	// whether the connections to private and local addresses are refused, once a redirect to
+	// another host is followed, see RedirectPolicy
+	refusePrivate bool
+
+	// the first request with an idempotency key, see DeduplicateRequests
+	idempotent *idempotentRequest
+
+	// whether the body of the response is streamed, see StreamingPolicy
+	streaming bool
+
+	// cost attribution tags, see SetTag
+	tags map[string]string
+
+	// the diagnostic trace of the request, see TracePolicy
+	trace *RequestTrace
+	// the profile of the request, see ProfilingPolicy
+	profile *RequestProfile
+
+	// whether ctx is given back to ctxPool once the request is done
+	pooled bool
+
+	// the bytes buffered by the request, see MemoryBudget
+	memory int64
+	// the SpillBuffers of the request, closed once it is done
+	spills []*SpillBuffer
+}
+
+type proxyCtxKey struct{}
+
+// withProxyCtx returns a copy of parent carrying ctx, so that dialers and resolvers shared
+// between requests can pick up the settings of the request they are dialing for
+func withProxyCtx(parent context.Context, ctx *ProxyCtx) context.Context {
+	return context.WithValue(parent, proxyCtxKey{}, ctx)
+}
+
+// proxyCtxFromContext returns the ProxyCtx stored in c by withProxyCtx, or nil
+func proxyCtxFromContext(c context.Context) *ProxyCtx {
+	if c == nil {
+		return nil
+	}
+	ctx, _ := c.Value(proxyCtxKey{}).(*ProxyCtx)
+	return ctx
 }
 
 type MetricsCounters struct {
 	Requests       *prometheus.CounterVec
 	ProxyBandwidth *prometheus.Counter
 	TLSTimes       *prometheus.Observer
+	// HTTP3 counts the requests sent with UpstreamHTTP3, labeled "ok", "session_resumed"
+	// when the HTTP3 transport resumed a TLS session, or "fallback" when they failed and were
+	// sent over TCP instead. Whether the resumed sessions sent 0-RTT data is not reported by
+	// the transports through net/http.
+	HTTP3 *prometheus.CounterVec
+	// HTTP3HandshakeTimes observes the durations in milliseconds of the QUIC handshakes the
+	// HTTP3 transport of the proxy reports through httptrace
+	HTTP3HandshakeTimes *prometheus.Observer
 }
 
 type ForwardProxyHeader struct {
@@ -150,9 +309,22 @@ func (ctx *ProxyCtx) SetSuccessMetric() {
 }
 
 func (ctx *ProxyCtx) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx.setUpstreamUserAgent(req)
+	if resp := ctx.enforceHeaderLimits(req); resp != nil {
+		return resp, nil
+	}
 	if ctx.RoundTripper != nil {
 		return ctx.RoundTripper.RoundTrip(req, ctx)
 	}
+	ctx.httpTrace = httptrace.ContextClientTrace(req.Context())
+	if ctx.http3Usable(req) {
+		if resp, ok := ctx.roundTripHTTP3(req); ok {
+			return resp, nil
+		}
+	}
+	if ctx.UpstreamHTTP2 && req.URL.Scheme == "https" && ctx.ForwardProxy == "" {
+		return ctx.roundTripHTTP2(req)
+	}
 	var tr *http.Transport
 
 	dialTimeout := ctx.ForwardProxyDialTimeout
@@ -173,11 +345,16 @@ func (ctx *ProxyCtx) RoundTrip(req *http.Request) (*http.Response, error) {
 		}
 	}
 
-	host := req.URL.Host
-	if !strings.Contains(req.URL.Host, ":") {
-		host = req.URL.Host + ":80"
+	// only reach IPv6 destinations directly when we have a v6 source address to bind
+	dialNetwork := "tcp4"
+	if ctx.ForwardProxySourceIPv6 != "" {
+		dialNetwork = "tcp"
 	}
 
+	host := ctx.Proxy.target(req)
+	ctx.Target = host
+	ctx.traceGetConn(host)
+
 	//check for idle override
 	var idleTimeout time.Duration
 	if ctx.IdleConnTimeout != 0 {
@@ -264,29 +441,21 @@ func (ctx *ProxyCtx) RoundTrip(req *http.Request) (*http.Response, error) {
 		dialEnd := time.Now().UnixNano()
 
 		if err != nil {
-			c4, c6, err := ctx.Proxy.resolveDomain(ctx, "udp", strings.Split(host, ":")[0], ctx.DNSResolver)
-			if err != nil && ctx.BackupDNSResolver != "" {
-				c4, c6, err = ctx.Proxy.resolveDomain(ctx, "udp", strings.Split(host, ":")[0], ctx.BackupDNSResolver)
+			dialErr := err
+			c4, c6, err := ctx.Proxy.resolveDomain(ctx, ctx.primaryResolver("udp"), hostOnly(host))
+			if backup := ctx.backupResolver("udp"); err != nil && backup != nil {
+				c4, c6, err = ctx.Proxy.resolveDomain(ctx, backup, hostOnly(host))
 			}
 			if len(c4) > 0 && len(c6) > 0 {
 				ctx.Logf("error-metric: http dial to %s failed: %v", host, err)
 				ctx.SetErrorMetric()
 			}
-			// if a fallback func was provided, retry
-			if ctx.ForwardProxyErrorFallback != nil {
-				newForwardProxy, extra := ctx.ForwardProxyErrorFallback()
-				ctx.ForwardProxyErrorFallback = nil
-				if newForwardProxy != "" {
-					ctx.ForwardProxy = newForwardProxy
-					if ctx.ForwardProxyErrorFallbackAuth {
-						ctx.ForwardProxyAuth = extra
-					} else {
-						ctx.Accounting = extra
-					}
-					return ctx.RoundTrip(req)
-				}
+			// retry through the next forward proxy, if any
+			ctx.fallbackFromLegacy()
+			if ctx.nextFallback(dialErr) {
+				return ctx.RoundTrip(req)
 			}
-			return nil, err
+			return nil, dialErr
 		}
 
 		if ctx.ForwardMetricsCounters.TLSTimes != nil {
@@ -295,6 +464,13 @@ func (ctx *ProxyCtx) RoundTrip(req *http.Request) (*http.Response, error) {
 			metric.Observe(float64(tlsTime))
 		}
 
+		// the SOCKS5 tunnels reach the destination, which the MITM'd requests reach over TLS
+		if ctx.forwardProxySOCKS() && req.URL.Scheme == "https" {
+			if rawConn, err = ctx.socks5TLS(rawConn, req.URL.Hostname()); err != nil {
+				return nil, err
+			}
+		}
+
 	} else {
 
 		setTargetKA = true
@@ -305,8 +481,10 @@ func (ctx *ProxyCtx) RoundTrip(req *http.Request) (*http.Response, error) {
 		}
 		// Dial with regular transport
 		tr = &http.Transport{
-			Proxy:                 http.ProxyFromEnvironment,
-			Dial:                  d.Dial,
+			Proxy: http.ProxyFromEnvironment,
+			Dial: func(network, addr string) (net.Conn, error) {
+				return ctx.tracedDial(&d, network, addr)
+			},
 			MaxIdleConns:          maxConns,
 			MaxIdleConnsPerHost:   maxPerHostConns,
 			IdleConnTimeout:       idleTimeout,
@@ -315,12 +493,16 @@ func (ctx *ProxyCtx) RoundTrip(req *http.Request) (*http.Response, error) {
 			ExpectContinueTimeout: 1 * time.Second,
 		}
 
-		rawConn, err = tr.Dial("tcp4", host)
+		rawConn, err = tr.Dial(dialNetwork, host)
 		if err != nil {
+			ctx.connFailed(host, nil)
 			return nil, err
 		}
 	}
 
+	ctx.Logf("dial trace: %v", ctx.DialTrace)
+	ctx.traceGotConn(rawConn)
+
 	req.RequestURI = req.URL.String()
 
 	conn := newProxyTCPConn(rawConn)
@@ -358,31 +540,48 @@ func (ctx *ProxyCtx) RoundTrip(req *http.Request) (*http.Response, error) {
 		bufferSize = ctx.CopyBufferSize
 	}
 
-	reader := bufio.NewReaderSize(conn, bufferSize*1024)
+	reader := bufio.NewReaderSize(ctx.traceFirstByte(conn), bufferSize*1024)
 	writer := bufio.NewWriterSize(conn, bufferSize*1024)
 	readDone := make(chan responseAndError, 1)
 	writeDone := make(chan error, 1)
 
+	// the body of a request expecting 100-continue is only sent once the server agreed to it
+	wreq := req
+	var proceed chan bool
+	if expectsContinue(req) {
+		proceed = make(chan bool, 1)
+		r := *req
+		r.Body = &continueBody{ReadCloser: req.Body, flush: writer.Flush, proceed: proceed}
+		wreq = &r
+	}
+	continued := func(ok bool) {
+		if proceed != nil {
+			select {
+			case proceed <- ok:
+			default:
+			}
+		}
+	}
+
 	// Write the request.
 	go func(pconn *ProxyTCPConn) {
 		var err error
-
-		if req.Header.Get("User-Agent") == "" {
-			req.Header.Set("User-Agent", "")
-		}
+		sendTrailers(wreq)
 
 		// Use writeproxy so as to not strip RequestURI if we
 		// are forwarding to another proxy
-		if ctx.ForwardProxy != "" && ctx.ForwardProxyRegWrite == false {
-			err = req.WriteProxy(writer)
+		if ctx.ForwardProxy != "" && ctx.ForwardProxyRegWrite == false && !ctx.forwardProxySOCKS() {
+			err = wreq.WriteProxy(writer)
 		} else {
-			err = req.Write(writer)
+			err = wreq.Write(writer)
 		}
 
 		if err == nil {
-			writer.Flush()
+			ctx.traceWroteRequest(writer.Flush())
 		} else {
-			ctx.Logf("req.Write failed: %v - conn read %v, conn written %v", err, pconn.BytesRead, pconn.BytesWrote)
+			ctx.traceWroteRequest(err)
+			wrote, read := pconn.Counters()
+			ctx.Logf("req.Write failed: %v - conn read %v, conn written %v", err, read, wrote)
 		}
 
 		writeDone <- err
@@ -390,27 +589,33 @@ func (ctx *ProxyCtx) RoundTrip(req *http.Request) (*http.Response, error) {
 
 	// And read the response.
 	go func() {
-		resp, err := http.ReadResponse(reader, req)
+		resp, err := readFinalResponse(reader, req, continued)
 		if err != nil {
 			readDone <- responseAndError{nil, err}
 			return
 		}
 
+		// resp.Trailer is filled once the body is read to its end, through connCloser
 		resp.Body = &connCloser{resp.Body, conn.Conn}
 
 		readDone <- responseAndError{resp, nil}
 	}()
 
-	if err := <-writeDone; err != nil {
-		ctx.Logf("error-metric: writeDone failed: %v - conn read %v, conn written %v", err, conn.BytesRead, conn.BytesWrote)
+	// the server answered before the body of the request was sent, with its final response
+	if err := <-writeDone; err != nil && !refused(wreq.Body) {
+		wrote, read := conn.Counters()
+		ctx.Logf("error-metric: writeDone failed: %v - conn read %v, conn written %v", err, read, wrote)
 		if !strings.Contains(err.Error(), "timeout") {
 			ctx.SetErrorMetric()
 		}
+		// the request was cut short, e.g. by a DLP rule blocking the rest of its body, the
+		// server must not wait for the rest of it
+		conn.Close()
 		return nil, err
 	}
 
-	ctx.BytesSent = conn.BytesWrote
-	ctx.BytesReceived = conn.BytesRead
+	// the bytes received are counted as the body of the response is relayed
+	ctx.BytesSent, _ = conn.Counters()
 
 	r := <-readDone
 	if r.err != nil {
@@ -424,7 +629,8 @@ func (ctx *ProxyCtx) RoundTrip(req *http.Request) (*http.Response, error) {
 	ctx.SetSuccessMetric()
 	if ctx.ForwardMetricsCounters.ProxyBandwidth != nil {
 		metric := *ctx.ForwardMetricsCounters.ProxyBandwidth
-		metric.Add(float64(conn.BytesWrote + conn.BytesRead))
+		wrote, read := conn.Counters()
+		metric.Add(float64(wrote + read))
 	}
 	return r.resp, nil
 }
@@ -483,6 +689,22 @@ func (ctx *ProxyCtx) Infof(msg string, argv ...interface{}) {
 //		return r, nil
 //	})
 func (ctx *ProxyCtx) Warnf(msg string, argv ...interface{}) {
+	ctx.logEntry(LevelWarning, fmt.Sprintf(msg, argv...))
+	if ctx.ProxyLogger != nil {
+		if ctx.LogRequestID != "" {
+			ctx.ProxyLogger.Warningf("[%s] "+msg, append([]interface{}{ctx.LogRequestID}, argv...)...)
+		} else {
+			ctx.ProxyLogger.Warningf("[%03d] "+msg, append([]interface{}{ctx.Session & 0xFF}, argv...)...)
+		}
+		return
+	}
+	ctx.printf(msg, argv...)
+}
+
+// Errorf prints a message to the proxy's log like Warnf, and records it as an error in the
+// ErrorLog of the proxy. It reports the failures of the requests.
+func (ctx *ProxyCtx) Errorf(msg string, argv ...interface{}) {
+	ctx.logEntry(LevelError, fmt.Sprintf(msg, argv...))
 	if ctx.ProxyLogger != nil {
 		if ctx.LogRequestID != "" {
 			ctx.ProxyLogger.Warningf("[%s] "+msg, append([]interface{}{ctx.LogRequestID}, argv...)...)
@@ -500,9 +722,5 @@ var charsetFinder = regexp.MustCompile("charset=([^ ;]*)")
 // Returns the empty string if we don't know which character set it used.
 // Currently it will look for charset=<charset> in the Content-Type header of the request.
 func (ctx *ProxyCtx) Charset() string {
-	charsets := charsetFinder.FindStringSubmatch(ctx.Resp.Header.Get("Content-Type"))
-	if charsets == nil {
-		return ""
-	}
-	return charsets[1]
+	return charsetOf(ctx.Resp.Header)
 }
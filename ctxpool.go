@@ -0,0 +1,102 @@
+package goproxy
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ctxConfig is the configuration of the proxy that the contexts of the requests refer to
+// instead of copying it. It is an immutable snapshot, replaced as a whole by Reconfigure.
+type ctxConfig struct {
+	certStore    CertStorage
+	defaultPorts map[string]string
+	pooled       bool
+}
+
+// config returns the current snapshot of the configuration, taking it on first use
+func (proxy *ProxyHttpServer) config() *ctxConfig {
+	if c, ok := proxy.cfg.Load().(*ctxConfig); ok {
+		return c
+	}
+	proxy.cfgMu.Lock()
+	defer proxy.cfgMu.Unlock()
+	if c, ok := proxy.cfg.Load().(*ctxConfig); ok {
+		return c
+	}
+	return proxy.publishConfig()
+}
+
+// Reconfigure publishes the current CertStore, DefaultPorts and PoolContexts of the proxy to
+// the requests accepted from now on. The proxy takes them when it serves its first request,
+// Reconfigure must be called after changing them while it serves.
+func (proxy *ProxyHttpServer) Reconfigure() {
+	proxy.cfgMu.Lock()
+	defer proxy.cfgMu.Unlock()
+	proxy.publishConfig()
+}
+
+// publishConfig publishes a snapshot of the configuration, with proxy.cfgMu held
+func (proxy *ProxyHttpServer) publishConfig() *ctxConfig {
+	c := &ctxConfig{certStore: proxy.CertStore, pooled: proxy.PoolContexts}
+	if len(proxy.DefaultPorts) > 0 {
+		c.defaultPorts = make(map[string]string, len(proxy.DefaultPorts))
+		for scheme, port := range proxy.DefaultPorts {
+			c.defaultPorts[strings.ToLower(scheme)] = port
+		}
+	}
+	proxy.cfg.Store(c)
+	return c
+}
+
+// config returns the configuration snapshot of ctx, the current one of its proxy for the
+// contexts not acquired from it
+func (ctx *ProxyCtx) config() *ctxConfig {
+	if ctx.cfg != nil {
+		return ctx.cfg
+	}
+	if ctx.Proxy != nil {
+		return ctx.Proxy.config()
+	}
+	return &ctxConfig{}
+}
+
+// ctxPool pools the contexts of the requests, see PoolContexts
+var ctxPool = sync.Pool{
+	New: func() interface{} { return new(ProxyCtx) },
+}
+
+// acquireCtx returns a new context for the request r, referring to the current configuration
+// snapshot of the proxy. It is taken from ctxPool if pooled is set, and given back to the
+// pool by release once the request is done.
+func (proxy *ProxyHttpServer) acquireCtx(r *http.Request, pooled bool) *ProxyCtx {
+	cfg := proxy.config()
+	if !pooled {
+		return &ProxyCtx{Req: r, Session: atomic.AddInt64(&proxy.sess, 1), Proxy: proxy, cfg: cfg, received: time.Now()}
+	}
+	ctx := ctxPool.Get().(*ProxyCtx)
+	ctx.Req = r
+	ctx.Session = atomic.AddInt64(&proxy.sess, 1)
+	ctx.Proxy = proxy
+	ctx.cfg = cfg
+	ctx.received = time.Now()
+	ctx.pooled = true
+	return ctx
+}
+
+// keep prevents ctx from being given back to the pool, when it outlives its request
+func (ctx *ProxyCtx) keep() {
+	ctx.pooled = false
+}
+
+// release resets ctx and gives it back to the pool if it was taken from it. Nothing may use
+// ctx afterwards.
+func (ctx *ProxyCtx) release() {
+	if !ctx.pooled {
+		return
+	}
+	*ctx = ProxyCtx{}
+	ctxPool.Put(ctx)
+}
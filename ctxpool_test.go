@@ -0,0 +1,66 @@
+package goproxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPoolContexts(t *testing.T) {
+	background := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer background.Close()
+	proxy := NewProxyHttpServer()
+	proxy.PoolContexts = true
+	type key struct{}
+	var seen []*ProxyCtx
+	proxy.OnRequest().DoFunc(func(r *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response) {
+		if ctx.Value(key{}) != nil || ctx.UserData != nil {
+			t.Errorf("context not reset: %v %v", ctx.Value(key{}), ctx.UserData)
+		}
+		ctx.SetValue(key{}, "set")
+		ctx.UserData = "set"
+		seen = append(seen, ctx)
+		return r, nil
+	})
+
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, httptest.NewRequest("GET", background.URL, nil))
+		if w.Code != 200 || w.Body.String() != "ok" {
+			t.Fatalf("unexpected response %d %q", w.Code, w.Body)
+		}
+		if ctx := seen[len(seen)-1]; ctx.Req != nil || ctx.Proxy != nil || ctx.Value(key{}) != nil {
+			t.Errorf("context not released: %+v", ctx)
+		}
+	}
+
+	// the contexts of the MITM'd CONNECT requests outlive HandleHttps
+	ctx := proxy.acquireCtx(nil, true)
+	ctx.keep()
+	ctx.release()
+	if ctx.Proxy != proxy {
+		t.Errorf("kept context released")
+	}
+}
+
+func TestCtxConfigSnapshot(t *testing.T) {
+	proxy := NewProxyHttpServer()
+	proxy.DefaultPorts = map[string]string{"gopher": "70"}
+	before := proxy.acquireCtx(nil, false)
+
+	proxy.DefaultPorts = map[string]string{"gopher": "7070"}
+	if port := proxy.defaultPort("gopher"); port != "70" {
+		t.Errorf("expected the published snapshot until Reconfigure, got %s", port)
+	}
+	proxy.Reconfigure()
+	after := proxy.acquireCtx(nil, false)
+	if port := proxy.defaultPort("gopher"); port != "7070" {
+		t.Errorf("expected the new snapshot after Reconfigure, got %s", port)
+	}
+	if before.cfg == after.cfg || before.cfg.defaultPorts["gopher"] != "70" {
+		t.Errorf("expected the contexts to keep the snapshot they were acquired with")
+	}
+}
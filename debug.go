@@ -0,0 +1,104 @@
+package goproxy
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// DebugFlags selects the components of the proxy whose debug messages are logged even when
+// the proxy is not Verbose
+type DebugFlags uint32
+
+const (
+	// DebugDNS logs every DNS query, regardless of DNSQueryLogSampleRate
+	DebugDNS DebugFlags = 1 << iota
+	// DebugDial logs the connections to the destinations and the forward proxies
+	DebugDial
+	// DebugTLS logs the certificates signed and the TLS handshakes
+	DebugTLS
+	// DebugMitm logs the requests and responses of the intercepted connections
+	DebugMitm
+	// DebugTunnel logs the CONNECT tunnels
+	DebugTunnel
+	// DebugHandlers logs the request and response handlers run
+	DebugHandlers
+
+	DebugAll = DebugDNS | DebugDial | DebugTLS | DebugMitm | DebugTunnel | DebugHandlers
+)
+
+var debugFlagNames = map[string]DebugFlags{
+	"dns":      DebugDNS,
+	"dial":     DebugDial,
+	"tls":      DebugTLS,
+	"mitm":     DebugMitm,
+	"tunnel":   DebugTunnel,
+	"handlers": DebugHandlers,
+	"all":      DebugAll,
+}
+
+// ParseDebugFlags parses a comma separated list of components, e.g. "dns,tls"
+func ParseDebugFlags(s string) (DebugFlags, error) {
+	var flags DebugFlags
+	for _, name := range strings.Split(s, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" || name == "none" {
+			continue
+		}
+		flag, ok := debugFlagNames[name]
+		if !ok {
+			return 0, fmt.Errorf("unknown debug component %s", name)
+		}
+		flags |= flag
+	}
+	return flags, nil
+}
+
+func (f DebugFlags) String() string {
+	var names []string
+	for name, flag := range debugFlagNames {
+		if flag != DebugAll && f&flag != 0 {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+// Debug returns the components of the proxy being debugged
+func (proxy *ProxyHttpServer) Debug() DebugFlags {
+	return DebugFlags(atomic.LoadUint32(&proxy.debugFlags))
+}
+
+// SetDebug sets the components of the proxy being debugged. It can be called at any time.
+func (proxy *ProxyHttpServer) SetDebug(flags DebugFlags) {
+	atomic.StoreUint32(&proxy.debugFlags, uint32(flags))
+}
+
+// Debugging reports whether the component of the proxy is being debugged
+func (proxy *ProxyHttpServer) Debugging(component DebugFlags) bool {
+	return proxy != nil && proxy.Debug()&component != 0
+}
+
+// Debugf logs a debug message of component. It is logged as with Infof when the component is
+// being debugged, and as with Logf otherwise.
+func (ctx *ProxyCtx) Debugf(component DebugFlags, msg string, argv ...interface{}) {
+	if !ctx.Proxy.Debugging(component) {
+		ctx.Logf(msg, argv...)
+		return
+	}
+	msg = "[" + component.String() + "] " + msg
+	if ctx.ProxyLogger != nil {
+		ctx.Infof(msg, argv...)
+		return
+	}
+	if ctx.LogRequestID != "" {
+		ctx.Proxy.Logger.Printf("[%s] "+msg+"\n", append([]interface{}{ctx.LogRequestID}, argv...)...)
+	} else {
+		ctx.Proxy.Logger.Printf("[%03d] "+msg+"\n", append([]interface{}{ctx.Session & 0xFF}, argv...)...)
+	}
+}
@@ -0,0 +1,44 @@
+package goproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseDebugFlags(t *testing.T) {
+	flags, err := ParseDebugFlags("dns, TLS")
+	orFatal("ParseDebugFlags", err, t)
+	if flags != DebugDNS|DebugTLS || flags.String() != "dns,tls" {
+		t.Errorf("unexpected flags %v", flags)
+	}
+	if flags, _ := ParseDebugFlags("all"); flags != DebugAll {
+		t.Errorf("unexpected flags %v", flags)
+	}
+	if _, err := ParseDebugFlags("bobo"); err == nil {
+		t.Error("expected an error for an unknown component")
+	}
+}
+
+func TestAdminDebugFlags(t *testing.T) {
+	proxy := NewProxyHttpServer()
+	admin := httptest.NewServer(proxy.AdminHandler())
+	defer admin.Close()
+
+	req, _ := http.NewRequest("PUT", admin.URL+"/debug", strings.NewReader("dial,tunnel"))
+	resp, err := http.DefaultClient.Do(req)
+	orFatal("PUT /debug", err, t)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !proxy.Debugging(DebugDial) || proxy.Debugging(DebugDNS) {
+		t.Errorf("unexpected debug flags %v after %s", proxy.Debug(), resp.Status)
+	}
+
+	req, _ = http.NewRequest("PUT", admin.URL+"/debug", strings.NewReader("bobo"))
+	resp, err = http.DefaultClient.Do(req)
+	orFatal("PUT /debug", err, t)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest || proxy.Debug() != DebugDial|DebugTunnel {
+		t.Errorf("expected invalid flags to be rejected, got %s", resp.Status)
+	}
+}
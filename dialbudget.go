@@ -0,0 +1,73 @@
+package goproxy
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// DialBudget bounds the connect attempts to the addresses a destination resolves to. The
+// addresses are tried in turn until one connects, so that a single unreachable address doesn't
+// fail the request. It can be set for the whole proxy, and overridden per request by setting
+// ProxyCtx.DialBudget in a handler.
+type DialBudget struct {
+	// Attempts is the number of addresses tried, 3 if zero
+	Attempts int
+	// Total bounds the time spent on all the attempts, the dial timeout of the request if zero.
+	// Each attempt gets an equal share of the time left, so that an address failing quickly
+	// leaves more time to the next ones.
+	Total time.Duration
+}
+
+var defaultDialBudget = &DialBudget{}
+
+var errDialBudgetSpent = errors.New("dial budget spent")
+
+// dialBudget returns the budget of the request, falling back to the one of the proxy
+func (ctx *ProxyCtx) dialBudget() *DialBudget {
+	if ctx.DialBudget != nil {
+		return ctx.DialBudget
+	}
+	if ctx.Proxy != nil && ctx.Proxy.DialBudget != nil {
+		return ctx.Proxy.DialBudget
+	}
+	return defaultDialBudget
+}
+
+// dialAddrs dials the addresses of addrs in turn, until one connects or the dial budget of ctx
+// is spent. timeout is the total time allowed when the budget doesn't set it, zero for no
+// bound; dial is called with the time allowed to each attempt.
+func (ctx *ProxyCtx) dialAddrs(network string, addrs []string, timeout time.Duration, dial func(network, addr string, timeout time.Duration) (net.Conn, error)) (net.Conn, error) {
+	budget := ctx.dialBudget()
+	attempts := budget.Attempts
+	if attempts <= 0 {
+		attempts = 3
+	}
+	if attempts > len(addrs) {
+		attempts = len(addrs)
+	}
+	total := budget.Total
+	if total <= 0 {
+		total = timeout
+	}
+	deadline := time.Now().Add(total)
+
+	err := errDialBudgetSpent
+	for i := 0; i < attempts; i++ {
+		var attemptTimeout time.Duration
+		if total > 0 {
+			left := time.Until(deadline)
+			if left <= 0 {
+				break
+			}
+			attemptTimeout = left / time.Duration(attempts-i)
+		}
+		var conn net.Conn
+		conn, err = dial(network, addrs[i], attemptTimeout)
+		if err == nil {
+			return conn, nil
+		}
+		ctx.Debugf(DebugDial, "dial attempt %d/%d to %s failed: %v", i+1, attempts, addrs[i], err)
+	}
+	return nil, err
+}
@@ -0,0 +1,42 @@
+package goproxy
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDialAddrs(t *testing.T) {
+	ctx := &ProxyCtx{Proxy: NewProxyHttpServer()}
+	var tried []string
+	var timeouts []time.Duration
+	dial := func(network, addr string, timeout time.Duration) (net.Conn, error) {
+		tried = append(tried, addr)
+		timeouts = append(timeouts, timeout)
+		if addr != "10.0.0.3:443" {
+			return nil, errors.New("connection refused")
+		}
+		c, _ := net.Pipe()
+		return c, nil
+	}
+
+	conn, err := ctx.dialAddrs("tcp", []string{"10.0.0.1:443", "10.0.0.2:443", "10.0.0.3:443", "10.0.0.4:443"}, 3*time.Second, dial)
+	orFatal("dialAddrs", err, t)
+	conn.Close()
+	if len(tried) != 3 {
+		t.Fatalf("expected the third address to be reached, tried %v", tried)
+	}
+	if timeouts[0] > time.Second || timeouts[1] <= timeouts[0] {
+		t.Errorf("expected the time left to be shared between the attempts left, got %v", timeouts)
+	}
+
+	tried = nil
+	ctx.DialBudget = &DialBudget{Attempts: 2}
+	if _, err := ctx.dialAddrs("tcp", []string{"10.0.0.1:443", "10.0.0.2:443", "10.0.0.3:443"}, 0, dial); err == nil || len(tried) != 2 {
+		t.Errorf("expected 2 failed attempts, tried %v: %v", tried, err)
+	}
+	if timeouts[len(timeouts)-1] != 0 {
+		t.Error("expected no timeout without a budget")
+	}
+}
@@ -0,0 +1,381 @@
+package goproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// DialTrace holds the timings of the connection setup made on behalf of a request,
+// similar to what net/http/httptrace reports for the standard transport.
+// It is available on ProxyCtx once the proxy dialed the destination (or the forward proxy),
+// so that Tail and accounting callbacks can break down the latency of a request.
+type DialTrace struct {
+	mu sync.Mutex
+
+	// DNSStart and DNSDone are set around the resolution of the destination host.
+	// They are zero when the destination was an IP literal.
+	DNSStart time.Time
+	DNSDone  time.Time
+	// Addrs contains the addresses returned by the resolver
+	Addrs []string
+	// Attempts contains one entry per connect attempt, in the order they were made
+	Attempts []DialAttempt
+	// TLSStart and TLSDone are set around the TLS handshake with an https forward proxy
+	TLSStart time.Time
+	TLSDone  time.Time
+	// Reused is true when the connection was taken from the pool of a transport, e.g. the
+	// transports of UpstreamHTTP2, instead of being dialed for the request
+	Reused bool
+}
+
+// DialAttempt is a single connect attempt to one address
+type DialAttempt struct {
+	Network      string
+	Addr         string
+	ConnectStart time.Time
+	ConnectDone  time.Time
+	Err          error
+}
+
+// DNSDuration returns the time spent resolving the destination
+func (t *DialTrace) DNSDuration() time.Duration {
+	if t == nil || t.DNSDone.IsZero() {
+		return 0
+	}
+	return t.DNSDone.Sub(t.DNSStart)
+}
+
+// ConnectDuration returns the time spent from the first connect attempt until the last one finished
+func (t *DialTrace) ConnectDuration() time.Duration {
+	if t == nil || len(t.Attempts) == 0 {
+		return 0
+	}
+	last := t.Attempts[len(t.Attempts)-1]
+	if last.ConnectDone.IsZero() {
+		return 0
+	}
+	return last.ConnectDone.Sub(t.Attempts[0].ConnectStart)
+}
+
+// TLSDuration returns the time spent in the TLS handshake
+func (t *DialTrace) TLSDuration() time.Duration {
+	if t == nil || t.TLSDone.IsZero() {
+		return 0
+	}
+	return t.TLSDone.Sub(t.TLSStart)
+}
+
+func (t *DialTrace) String() string {
+	if t == nil {
+		return "<nil>"
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return fmt.Sprintf("dns=%v connect=%v tls=%v attempts=%d reused=%v",
+		t.DNSDuration(), t.ConnectDuration(), t.TLSDuration(), len(t.Attempts), t.Reused)
+}
+
+// clientTrace returns the httptrace.ClientTrace attached to the request being proxied, if any.
+// Callers that already instrument their requests with httptrace get the same callbacks
+// for proxied requests, whichever path is used to reach the destination.
+func (ctx *ProxyCtx) clientTrace() *httptrace.ClientTrace {
+	if ctx.httpTrace != nil {
+		return ctx.httpTrace
+	}
+	if ctx.Req == nil {
+		return nil
+	}
+	return httptrace.ContextClientTrace(ctx.Req.Context())
+}
+
+// dialTrace returns the DialTrace of the context, creating it if needed
+func (ctx *ProxyCtx) dialTrace() *DialTrace {
+	if ctx.DialTrace == nil {
+		ctx.DialTrace = &DialTrace{}
+	}
+	return ctx.DialTrace
+}
+
+func (ctx *ProxyCtx) traceDNSStart(host string) {
+	t := ctx.dialTrace()
+	t.mu.Lock()
+	t.DNSStart = time.Now()
+	t.DNSDone = time.Time{}
+	t.Addrs = nil
+	t.mu.Unlock()
+	if trace := ctx.clientTrace(); trace != nil && trace.DNSStart != nil {
+		trace.DNSStart(httptrace.DNSStartInfo{Host: host})
+	}
+}
+
+func (ctx *ProxyCtx) traceDNSDone(addrs []string, err error) {
+	t := ctx.dialTrace()
+	t.mu.Lock()
+	t.DNSDone = time.Now()
+	t.Addrs = append(t.Addrs, addrs...)
+	t.mu.Unlock()
+	if trace := ctx.clientTrace(); trace != nil && trace.DNSDone != nil {
+		info := httptrace.DNSDoneInfo{Err: err}
+		for _, addr := range addrs {
+			if ip := net.ParseIP(addr); ip != nil {
+				info.Addrs = append(info.Addrs, net.IPAddr{IP: ip})
+			}
+		}
+		trace.DNSDone(info)
+	}
+}
+
+// traceConnectStart records a new connect attempt and returns its index in Attempts
+func (ctx *ProxyCtx) traceConnectStart(network, addr string) int {
+	t := ctx.dialTrace()
+	t.mu.Lock()
+	t.Attempts = append(t.Attempts, DialAttempt{Network: network, Addr: addr, ConnectStart: time.Now()})
+	i := len(t.Attempts) - 1
+	t.mu.Unlock()
+	if trace := ctx.clientTrace(); trace != nil && trace.ConnectStart != nil {
+		trace.ConnectStart(network, addr)
+	}
+	return i
+}
+
+func (ctx *ProxyCtx) traceConnectDone(i int, err error) {
+	t := ctx.dialTrace()
+	t.mu.Lock()
+	if i < 0 || i >= len(t.Attempts) {
+		t.mu.Unlock()
+		return
+	}
+	t.Attempts[i].ConnectDone = time.Now()
+	t.Attempts[i].Err = err
+	attempt := t.Attempts[i]
+	t.mu.Unlock()
+	if trace := ctx.clientTrace(); trace != nil && trace.ConnectDone != nil {
+		trace.ConnectDone(attempt.Network, attempt.Addr, err)
+	}
+}
+
+func (ctx *ProxyCtx) traceTLSStart() {
+	t := ctx.dialTrace()
+	t.mu.Lock()
+	t.TLSStart = time.Now()
+	t.TLSDone = time.Time{}
+	t.mu.Unlock()
+	if trace := ctx.clientTrace(); trace != nil && trace.TLSHandshakeStart != nil {
+		trace.TLSHandshakeStart()
+	}
+}
+
+func (ctx *ProxyCtx) traceTLSDone(state tls.ConnectionState, err error) {
+	t := ctx.dialTrace()
+	t.mu.Lock()
+	t.TLSDone = time.Now()
+	t.mu.Unlock()
+	if trace := ctx.clientTrace(); trace != nil && trace.TLSHandshakeDone != nil {
+		trace.TLSHandshakeDone(state, err)
+	}
+}
+
+func (ctx *ProxyCtx) traceGetConn(hostPort string) {
+	if trace := ctx.clientTrace(); trace != nil && trace.GetConn != nil {
+		trace.GetConn(hostPort)
+	}
+}
+
+func (ctx *ProxyCtx) traceGotConn(conn net.Conn) {
+	reused := false
+	if t := ctx.DialTrace; t != nil {
+		t.mu.Lock()
+		reused = t.Reused
+		t.mu.Unlock()
+	}
+	if trace := ctx.clientTrace(); trace != nil && trace.GotConn != nil {
+		trace.GotConn(httptrace.GotConnInfo{Conn: conn, Reused: reused})
+	}
+}
+
+// withPoolTrace returns c with a trace recording in ctx.DialTrace whether the pooled
+// transport the request is sent through reused a connection. The hooks of the trace of the
+// client in c, if any, are called by the transport itself.
+func (ctx *ProxyCtx) withPoolTrace(c context.Context) context.Context {
+	t := ctx.dialTrace()
+	t.mu.Lock()
+	t.Reused = false
+	t.mu.Unlock()
+	return httptrace.WithClientTrace(c, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.mu.Lock()
+			t.Reused = info.Reused
+			t.mu.Unlock()
+		},
+	})
+}
+
+func (ctx *ProxyCtx) traceWroteRequest(err error) {
+	trace := ctx.clientTrace()
+	if trace == nil {
+		return
+	}
+	if err == nil && trace.WroteHeaders != nil {
+		trace.WroteHeaders()
+	}
+	if trace.WroteRequest != nil {
+		trace.WroteRequest(httptrace.WroteRequestInfo{Err: err})
+	}
+}
+
+// firstByteReader calls the GotFirstResponseByte hook of the trace on the first successful read
+type firstByteReader struct {
+	io.Reader
+	trace *httptrace.ClientTrace
+	once  sync.Once
+}
+
+func (r *firstByteReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	if n > 0 && r.trace.GotFirstResponseByte != nil {
+		r.once.Do(r.trace.GotFirstResponseByte)
+	}
+	return n, err
+}
+
+// traceFirstByte wraps r so that the trace of ctx is notified of the first response byte
+func (ctx *ProxyCtx) traceFirstByte(r io.Reader) io.Reader {
+	trace := ctx.clientTrace()
+	if trace == nil || trace.GotFirstResponseByte == nil {
+		return r
+	}
+	return &firstByteReader{Reader: r, trace: trace}
+}
+
+// tracedDial dials addr with d, recording the resolution and every connect attempt
+// the dialer makes in ctx.DialTrace, and sends the PROXY protocol header of the request
+// on the connection if ProxyProtocolUpstream is set.
+func (ctx *ProxyCtx) tracedDial(d *net.Dialer, network, addr string) (net.Conn, error) {
+	conn, err := ctx.tracedDialShared(d, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return ctx.writeUpstreamProxyProtocol(conn)
+}
+
+// tracedDialShared is tracedDial for the connections shared with other requests, which
+// carry no PROXY protocol header
+func (ctx *ProxyCtx) tracedDialShared(d *net.Dialer, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	ip := net.ParseIP(host)
+	lookup := err == nil && ip == nil
+	if lookup && (ctx.Resolver != nil || ctx.ForwardProxySourceIPv6 != "") {
+		return ctx.resolveAndDial(d, network, host, port)
+	}
+	if lookup {
+		ctx.traceDNSStart(host)
+	}
+	if ip != nil {
+		if src := ctx.sourceAddr(ip); src != nil {
+			withSource := *d
+			withSource.LocalAddr = src
+			d = &withSource
+		}
+	}
+
+	var mu sync.Mutex
+	attempt := -1
+	control := d.Control
+	traced := *d
+	traced.Control = func(network, address string, c syscall.RawConn) error {
+		mu.Lock()
+		if lookup && attempt == -1 {
+			ctx.traceDNSDone(nil, nil)
+		}
+		if attempt >= 0 {
+			ctx.traceConnectDone(attempt, errDialAttemptAbandoned)
+		}
+		attempt = ctx.traceConnectStart(network, address)
+		mu.Unlock()
+		if control != nil {
+			return control(network, address, c)
+		}
+		return nil
+	}
+
+	conn, err := ctx.dialBound(withProxyCtx(context.Background(), ctx), &traced, network, addr)
+
+	mu.Lock()
+	if attempt >= 0 {
+		ctx.traceConnectDone(attempt, err)
+	} else if lookup {
+		// the resolution itself failed
+		ctx.traceDNSDone(nil, err)
+	}
+	mu.Unlock()
+	return conn, err
+}
+
+// tracedDialFunc records a single connect attempt around dial, for dial functions
+// that do not expose their net.Dialer.
+func (ctx *ProxyCtx) tracedDialFunc(dial func(network, addr string) (net.Conn, error), network, addr string) (net.Conn, error) {
+	i := ctx.traceConnectStart(network, addr)
+	conn, err := dial(network, addr)
+	ctx.traceConnectDone(i, err)
+	if err != nil {
+		return nil, err
+	}
+	return ctx.writeUpstreamProxyProtocol(conn)
+}
+
+var errDialAttemptAbandoned = errors.New("dial attempt abandoned for next address")
+
+// resolveAndDial resolves host itself, either because ctx.Resolver cannot be used by a
+// net.Dialer or because the source address depends on the family of the destination,
+// and dials the resolved addresses in order until one succeeds, within the DialBudget
+func (ctx *ProxyCtx) resolveAndDial(d *net.Dialer, network, host, port string) (net.Conn, error) {
+	family := "ip"
+	if strings.HasSuffix(network, "4") {
+		family = "ip4"
+	} else if strings.HasSuffix(network, "6") {
+		family = "ip6"
+	}
+
+	ctx.traceDNSStart(host)
+	ips, err := ctx.primaryResolver("udp").LookupIP(withProxyCtx(context.Background(), ctx), host, ctx.lookupHints(family))
+	if backup := ctx.backupResolver("udp"); err != nil && backup != nil {
+		ips, err = backup.LookupIP(withProxyCtx(context.Background(), ctx), host, ctx.lookupHints(family))
+	}
+	ctx.traceDNSDone(ipStrings(ips), err)
+	if err != nil {
+		return nil, err
+	}
+
+	var addrs []string
+	for _, ip := range ips {
+		if ctx.hasSourceAddr() && ctx.sourceAddr(ip) == nil {
+			// no source address to reach this family from
+			continue
+		}
+		addrs = append(addrs, net.JoinHostPort(ip.String(), port))
+	}
+	if len(addrs) == 0 {
+		return nil, &net.DNSError{Err: "no suitable address found", Name: host}
+	}
+	return ctx.dialAddrs(network, addrs, d.Timeout, func(network, addr string, timeout time.Duration) (net.Conn, error) {
+		dialer := *d
+		dialer.Timeout = timeout
+		if ctx.hasSourceAddr() {
+			ip, _, _ := net.SplitHostPort(addr)
+			dialer.LocalAddr = ctx.sourceAddr(net.ParseIP(ip))
+		}
+		i := ctx.traceConnectStart(network, addr)
+		conn, err := ctx.dialBound(withProxyCtx(context.Background(), ctx), &dialer, network, addr)
+		ctx.traceConnectDone(i, err)
+		return conn, err
+	})
+}
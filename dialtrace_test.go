@@ -0,0 +1,48 @@
+package goproxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"testing"
+)
+
+func TestRoundTripClientTrace(t *testing.T) {
+	s := httptest.NewServer(ConstantHanlder("bobo"))
+	defer s.Close()
+
+	var gotConn, wroteRequest, firstByte bool
+	var connectStarted int
+	trace := &httptrace.ClientTrace{
+		ConnectStart:         func(network, addr string) { connectStarted++ },
+		GotConn:              func(httptrace.GotConnInfo) { gotConn = true },
+		WroteRequest:         func(httptrace.WroteRequestInfo) { wroteRequest = true },
+		GotFirstResponseByte: func() { firstByte = true },
+	}
+
+	req, err := http.NewRequest("GET", s.URL+"/", nil)
+	orFatal("NewRequest", err, t)
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+
+	ctx := &ProxyCtx{Req: req, Proxy: NewProxyHttpServer()}
+	resp, err := ctx.RoundTrip(req)
+	orFatal("RoundTrip", err, t)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	orFatal("ReadAll", err, t)
+	if string(body) != "bobo" {
+		t.Errorf("unexpected body %q", body)
+	}
+
+	if connectStarted != 1 || !gotConn || !wroteRequest || !firstByte {
+		t.Errorf("missing trace callbacks: connect=%d gotConn=%v wrote=%v firstByte=%v",
+			connectStarted, gotConn, wroteRequest, firstByte)
+	}
+	if ctx.DialTrace == nil || len(ctx.DialTrace.Attempts) != 1 {
+		t.Fatalf("expected a single dial attempt, got %+v", ctx.DialTrace)
+	}
+	if ctx.DialTrace.Attempts[0].Err != nil || ctx.DialTrace.ConnectDuration() <= 0 {
+		t.Errorf("unexpected dial attempt %+v", ctx.DialTrace.Attempts[0])
+	}
+}
@@ -5,8 +5,11 @@ import (
 	"io/ioutil"
 	"net"
 	"net/http"
+	"path"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // ReqCondition.HandleReq will decide whether or not to use the ReqHandler on an HTTP request
@@ -128,7 +131,7 @@ func DstHostIs(host string) ReqConditionFunc {
 func SrcIpIs(ips ...string) ReqCondition {
 	return ReqConditionFunc(func(req *http.Request, ctx *ProxyCtx) bool {
 		for _, ip := range ips {
-			if strings.HasPrefix(req.RemoteAddr, ip+":") {
+			if hostOnly(req.RemoteAddr) == ip {
 				return true
 			}
 		}
@@ -136,6 +139,102 @@ func SrcIpIs(ips ...string) ReqCondition {
 	})
 }
 
+// SrcIpIn returns a ReqCondition testing whether the source IP of the request is in one of the
+// given networks, in CIDR notation ("10.0.0.0/8", "2001:db8::/32") or single addresses.
+// It panics if one of them can't be parsed.
+func SrcIpIn(cidrs ...string) ReqConditionFunc {
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic("goproxy: SrcIpIn: " + err.Error())
+		}
+		nets = append(nets, n)
+	}
+	return func(req *http.Request, ctx *ProxyCtx) bool {
+		host, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			host = req.RemoteAddr
+		}
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return false
+		}
+		for _, n := range nets {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// MethodIs returns a ReqCondition testing whether the method of the request is one of the given
+// methods
+func MethodIs(methods ...string) ReqConditionFunc {
+	methodSet := make(map[string]bool)
+	for _, m := range methods {
+		methodSet[strings.ToUpper(m)] = true
+	}
+	return func(req *http.Request, ctx *ProxyCtx) bool {
+		return methodSet[req.Method]
+	}
+}
+
+// ActiveFrom returns a ReqCondition true from t on, so that the rules it guards take effect at
+// the same time on all the instances, whenever they loaded them
+func ActiveFrom(t time.Time) ReqConditionFunc {
+	return func(req *http.Request, ctx *ProxyCtx) bool {
+		return !time.Now().Before(t)
+	}
+}
+
+// ActiveUntil returns a ReqCondition true until t, when the rules it guards are retired
+func ActiveUntil(t time.Time) ReqConditionFunc {
+	return func(req *http.Request, ctx *ProxyCtx) bool {
+		return time.Now().Before(t)
+	}
+}
+
+// HeaderMatches returns a ReqCondition testing whether one of the values of the header name of
+// the request matches re
+func HeaderMatches(name string, re *regexp.Regexp) ReqConditionFunc {
+	name = http.CanonicalHeaderKey(name)
+	return func(req *http.Request, ctx *ProxyCtx) bool {
+		for _, v := range req.Header[name] {
+			if re.MatchString(v) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// PortIs returns a ReqCondition testing whether the port of the destination of the request is
+// one of the given ports, the default port of its scheme if its URL has none, see
+// ProxyHttpServer.DefaultPorts
+func PortIs(ports ...int) ReqConditionFunc {
+	portSet := make(map[string]bool)
+	for _, p := range ports {
+		portSet[strconv.Itoa(p)] = true
+	}
+	return func(req *http.Request, ctx *ProxyCtx) bool {
+		target := ctx.Target
+		if target == "" {
+			target = ctx.Proxy.target(req)
+		}
+		_, port := splitHostPort(target, "")
+		return portSet[port]
+	}
+}
+
 // Not returns a ReqCondition negating the given ReqCondition
 func Not(r ReqCondition) ReqConditionFunc {
 	return func(req *http.Request, ctx *ProxyCtx) bool {
@@ -161,20 +260,85 @@ func ContentTypeIs(typ string, types ...string) RespCondition {
 	})
 }
 
+// StatusIn returns a RespCondition testing whether the status code of the response is between
+// min and max, inclusive
+func StatusIn(min, max int) RespCondition {
+	return RespConditionFunc(func(resp *http.Response, ctx *ProxyCtx) bool {
+		return resp != nil && resp.StatusCode >= min && resp.StatusCode <= max
+	})
+}
+
+// Is2xx, Is3xx, Is4xx and Is5xx test the class of the status code of the response
+var (
+	Is2xx = StatusIn(200, 299)
+	Is3xx = StatusIn(300, 399)
+	Is4xx = StatusIn(400, 499)
+	Is5xx = StatusIn(500, 599)
+)
+
+// ContentLengthAtLeast returns a RespCondition testing whether the response is known to be at
+// least n bytes long
+func ContentLengthAtLeast(n int64) RespCondition {
+	return RespConditionFunc(func(resp *http.Response, ctx *ProxyCtx) bool {
+		return resp != nil && resp.ContentLength >= n
+	})
+}
+
+// ContentLengthAtMost returns a RespCondition testing whether the response is known to be at
+// most n bytes long. Responses of unknown length don't match.
+//
+//	proxy.OnResponse(goproxy.ContentLengthAtMost(10<<20)).Do(scanner)
+func ContentLengthAtMost(n int64) RespCondition {
+	return RespConditionFunc(func(resp *http.Response, ctx *ProxyCtx) bool {
+		return resp != nil && resp.ContentLength >= 0 && resp.ContentLength <= n
+	})
+}
+
+// ContentTypeMatches returns a RespCondition testing whether the media type of the Content-Type
+// of the response matches one of the given patterns, as in path.Match ("text/*",
+// "application/*+json")
+func ContentTypeMatches(patterns ...string) RespCondition {
+	return RespConditionFunc(func(resp *http.Response, ctx *ProxyCtx) bool {
+		if resp == nil {
+			return false
+		}
+		contentType := strings.ToLower(strings.TrimSpace(strings.Split(resp.Header.Get("Content-Type"), ";")[0]))
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(strings.ToLower(pattern), contentType); ok {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// HasHeader returns a RespCondition testing whether the response has the header name
+func HasHeader(name string) RespCondition {
+	name = http.CanonicalHeaderKey(name)
+	return RespConditionFunc(func(resp *http.Response, ctx *ProxyCtx) bool {
+		if resp == nil {
+			return false
+		}
+		_, ok := resp.Header[name]
+		return ok
+	})
+}
+
 // ProxyHttpServer.OnRequest Will return a temporary ReqProxyConds struct, aggregating the given condtions.
 // You will use the ReqProxyConds struct to register a ReqHandler, that would filter
 // the request, only if all the given ReqCondition matched.
 // Typical usage:
 //	proxy.OnRequest(UrlIs("example.com/foo"),UrlMatches(regexp.MustParse(`.*\.exampl.\com\./.*`)).Do(...)
 func (proxy *ProxyHttpServer) OnRequest(conds ...ReqCondition) *ReqProxyConds {
-	return &ReqProxyConds{proxy, conds}
+	return &ReqProxyConds{proxy: proxy, reqConds: conds}
 }
 
 // ReqProxyConds aggregate ReqConditions for a ProxyHttpServer. Upon calling Do, it will register a ReqHandler that would
 // handle the request if all conditions on the HTTP request are met.
 type ReqProxyConds struct {
-	proxy    *ProxyHttpServer
-	reqConds []ReqCondition
+	proxy     *ProxyHttpServer
+	reqConds  []ReqCondition
+	placement handlerPlacement
 }
 
 // DoFunc is equivalent to proxy.OnRequest().Do(FuncReqHandler(f))
@@ -190,14 +354,20 @@ func (pcond *ReqProxyConds) DoFunc(f func(req *http.Request, ctx *ProxyCtx) (*ht
 //	// given request to the proxy, will test if cond1.HandleReq(req,ctx) && cond2.HandleReq(req,ctx) are true
 //	// if they are, will call handler.Handle(req,ctx)
 func (pcond *ReqProxyConds) Do(h ReqHandler) {
-	pcond.proxy.reqHandlers = append(pcond.proxy.reqHandlers,
+	if pcond.placement.shadow {
+		h = pcond.proxy.shadowReqHandler(pcond.placement.Name, h)
+	}
+	pcond.proxy.addReqHandler(pcond.placement,
 		FuncReqHandler(func(r *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response) {
 			for _, cond := range pcond.reqConds {
 				if !cond.HandleReq(r, ctx) {
 					return r, nil
 				}
 			}
-			return h.Handle(r, ctx)
+			start := time.Now()
+			req, resp := h.Handle(r, ctx)
+			pcond.proxy.HandlerMetrics.observe("request", pcond.placement.Name, start, resp != nil)
+			return req, resp
 		}))
 }
 
@@ -213,14 +383,20 @@ func (pcond *ReqProxyConds) Do(h ReqHandler) {
 // will use the default tls configuration.
 //	proxy.OnRequest().HandleConnect(goproxy.AlwaysReject) // rejects all CONNECT requests
 func (pcond *ReqProxyConds) HandleConnect(h HttpsHandler) {
-	pcond.proxy.httpsHandlers = append(pcond.proxy.httpsHandlers,
+	if pcond.placement.shadow {
+		h = pcond.proxy.shadowHttpsHandler(pcond.placement.Name, h)
+	}
+	pcond.proxy.addHttpsHandler(pcond.placement,
 		FuncHttpsHandler(func(host string, ctx *ProxyCtx) (*ConnectAction, string) {
 			for _, cond := range pcond.reqConds {
 				if !cond.HandleReq(ctx.Req, ctx) {
 					return nil, ""
 				}
 			}
-			return h.HandleConnect(host, ctx)
+			start := time.Now()
+			todo, newHost := h.HandleConnect(host, ctx)
+			pcond.proxy.HandlerMetrics.observe("connect", pcond.placement.Name, start, todo != nil)
+			return todo, newHost
 		}))
 }
 
@@ -241,13 +417,14 @@ func (pcond *ReqProxyConds) HandleConnectFunc(f func(host string, ctx *ProxyCtx)
 }
 
 func (pcond *ReqProxyConds) HijackConnect(f func(req *http.Request, client net.Conn, ctx *ProxyCtx)) {
-	pcond.proxy.httpsHandlers = append(pcond.proxy.httpsHandlers,
+	pcond.proxy.addHttpsHandler(pcond.placement,
 		FuncHttpsHandler(func(host string, ctx *ProxyCtx) (*ConnectAction, string) {
 			for _, cond := range pcond.reqConds {
 				if !cond.HandleReq(ctx.Req, ctx) {
 					return nil, ""
 				}
 			}
+			pcond.proxy.HandlerMetrics.observe("connect", pcond.placement.Name, time.Now(), true)
 			return &ConnectAction{Action: ConnectHijack, Hijack: f}, host
 		}))
 }
@@ -256,9 +433,10 @@ func (pcond *ReqProxyConds) HijackConnect(f func(req *http.Request, client net.C
 // Upon calling ProxyConds.Do, it will register a RespHandler that would
 // handle the HTTP response from remote server if all conditions on the HTTP response are met.
 type ProxyConds struct {
-	proxy    *ProxyHttpServer
-	reqConds []ReqCondition
-	respCond []RespCondition
+	proxy     *ProxyHttpServer
+	reqConds  []ReqCondition
+	respCond  []RespCondition
+	placement handlerPlacement
 }
 
 // ProxyConds.DoFunc is equivalent to proxy.OnResponse().Do(FuncRespHandler(f))
@@ -269,7 +447,7 @@ func (pcond *ProxyConds) DoFunc(f func(resp *http.Response, ctx *ProxyCtx) *http
 // ProxyConds.Do will register the RespHandler on the proxy, h.Handle(resp,ctx) will be called on every
 // request that matches the conditions aggregated in pcond.
 func (pcond *ProxyConds) Do(h RespHandler) {
-	pcond.proxy.respHandlers = append(pcond.proxy.respHandlers,
+	pcond.proxy.addRespHandler(pcond.placement,
 		FuncRespHandler(func(resp *http.Response, ctx *ProxyCtx) *http.Response {
 			for _, cond := range pcond.reqConds {
 				if !cond.HandleReq(ctx.Req, ctx) {
@@ -281,7 +459,10 @@ func (pcond *ProxyConds) Do(h RespHandler) {
 					return resp
 				}
 			}
-			return h.Handle(resp, ctx)
+			start := time.Now()
+			resp = h.Handle(resp, ctx)
+			pcond.proxy.HandlerMetrics.observe("response", pcond.placement.Name, start, false)
+			return resp
 		}))
 }
 
@@ -289,7 +470,7 @@ func (pcond *ProxyConds) Do(h RespHandler) {
 //	proxy.OnResponse(cond1,cond2).Do(handler) // handler.Handle(resp,ctx) will be used
 //				// if cond1.HandleResp(resp) && cond2.HandleResp(resp)
 func (proxy *ProxyHttpServer) OnResponse(conds ...RespCondition) *ProxyConds {
-	return &ProxyConds{proxy, make([]ReqCondition, 0), conds}
+	return &ProxyConds{proxy: proxy, reqConds: make([]ReqCondition, 0), respCond: conds}
 }
 
 // AlwaysMitm is a HttpsHandler that always eavesdrop https connections, for example to
@@ -312,6 +493,9 @@ var AlwaysReject FuncHttpsHandler = func(host string, ctx *ProxyCtx) (*ConnectAc
 // and will replace the body of the original response with the resulting byte array.
 func HandleBytes(f func(b []byte, ctx *ProxyCtx) []byte) RespHandler {
 	return FuncRespHandler(func(resp *http.Response, ctx *ProxyCtx) *http.Response {
+		if ctx.Streaming() {
+			return resp
+		}
 		b, err := ioutil.ReadAll(resp.Body)
 		if err != nil {
 			ctx.Warnf("Cannot read response %s", err)
@@ -0,0 +1,83 @@
+package goproxy
+
+import (
+	"net/http"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestReqConditionMatchers(t *testing.T) {
+	req, _ := http.NewRequest("POST", "https://example.com/upload", nil)
+	req.RemoteAddr = "10.1.2.3:51234"
+	req.Header.Set("User-Agent", "curl/7.68.0")
+	ctx := &ProxyCtx{Req: req}
+
+	for _, c := range []struct {
+		name     string
+		cond     ReqCondition
+		expected bool
+	}{
+		{"SrcIpIn cidr", SrcIpIn("192.168.0.0/16", "10.0.0.0/8"), true},
+		{"SrcIpIn address", SrcIpIn("10.1.2.4", "2001:db8::1"), false},
+		{"MethodIs", MethodIs("get", "post"), true},
+		{"MethodIs other", MethodIs("GET"), false},
+		{"HeaderMatches", HeaderMatches("user-agent", regexp.MustCompile(`^curl/`)), true},
+		{"HeaderMatches missing", HeaderMatches("X-Bobo", regexp.MustCompile(``)), false},
+		{"PortIs default", PortIs(443), true},
+		{"PortIs other", PortIs(80, 8080), false},
+	} {
+		if got := c.cond.HandleReq(req, ctx); got != c.expected {
+			t.Errorf("%s: got %v", c.name, got)
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected an invalid network to panic")
+		}
+	}()
+	SrcIpIn("10.0.0.0/33")
+}
+
+func TestRespConditionMatchers(t *testing.T) {
+	resp := &http.Response{StatusCode: 404, Header: http.Header{}, ContentLength: 2048}
+	resp.Header.Set("Content-Type", "application/problem+json; charset=utf-8")
+	resp.Header.Set("Retry-After", "10")
+	ctx := &ProxyCtx{Resp: resp}
+
+	for _, c := range []struct {
+		name     string
+		cond     RespCondition
+		expected bool
+	}{
+		{"Is4xx", Is4xx, true},
+		{"Is5xx", Is5xx, false},
+		{"StatusIn", StatusIn(400, 403), false},
+		{"ContentLengthAtLeast", ContentLengthAtLeast(1024), true},
+		{"ContentLengthAtMost", ContentLengthAtMost(1024), false},
+		{"ContentTypeMatches", ContentTypeMatches("text/*", "application/*+json"), true},
+		{"ContentTypeMatches other", ContentTypeMatches("image/*"), false},
+		{"HasHeader", HasHeader("retry-after"), true},
+		{"HasHeader missing", HasHeader("Location"), false},
+	} {
+		if got := c.cond.HandleResp(resp, ctx); got != c.expected {
+			t.Errorf("%s: got %v", c.name, got)
+		}
+	}
+	resp.ContentLength = -1
+	if ContentLengthAtMost(1024).HandleResp(resp, ctx) {
+		t.Error("expected a response of unknown length not to match")
+	}
+}
+
+func TestActiveFromUntil(t *testing.T) {
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	past, future := time.Now().Add(-time.Minute), time.Now().Add(time.Minute)
+	if !ActiveFrom(past).HandleReq(req, nil) || ActiveFrom(future).HandleReq(req, nil) {
+		t.Error("expected ActiveFrom to be true after its time only")
+	}
+	if ActiveUntil(past).HandleReq(req, nil) || !ActiveUntil(future).HandleReq(req, nil) {
+		t.Error("expected ActiveUntil to be true before its time only")
+	}
+}
@@ -0,0 +1,254 @@
+package goproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Artifact is a compiled blocklist or rule set, built by one instance of a fleet and
+// distributed to the others
+type Artifact struct {
+	Name    string
+	Version string
+	Data    []byte
+	// ActivateAt, if not zero, is when the instances load the artifact, so that they all flip
+	// to it at the same time
+	ActivateAt time.Time
+}
+
+// Coordinator elects the instance of a fleet that builds the artifacts, and distributes what
+// it builds to its peers, so that large blocklists are not downloaded and compiled by every
+// instance on reload
+type Coordinator interface {
+	// IsLeader reports whether this instance is the one building the artifacts
+	IsLeader() (bool, error)
+	// Publish makes an artifact available to the peers
+	Publish(a Artifact) error
+	// Fetch returns the last published artifact named name, ok is false if there is none yet
+	Fetch(name string) (a Artifact, ok bool, err error)
+}
+
+// ArtifactDistributor keeps an artifact up to date on an instance. The leader builds and
+// publishes it, followers load what the leader published.
+//
+//	d := &goproxy.ArtifactDistributor{Coordinator: coordinator, Name: "ads",
+//		Build: downloadAndCompileBlocklist, Load: blocklist.Load, Interval: 10 * time.Minute}
+//	go d.Run(stop, nil)
+type ArtifactDistributor struct {
+	Coordinator Coordinator
+	Name        string
+	// Build downloads and compiles the artifact, it is only called on the leader
+	Build func() ([]byte, error)
+	// Load installs a compiled artifact on this instance
+	Load func(data []byte) error
+	// Interval between two syncs of Run, a minute if zero
+	Interval time.Duration
+	// Notifier, if set, is sent the loads of new versions
+	Notifier Notifier
+	// ActivateAt, if set, returns the activation time of the artifacts built by the leader,
+	// e.g. the next midnight. The followers fetching them before that time load them then.
+	ActivateAt func() time.Time
+
+	mu      sync.Mutex
+	version string
+	pending string
+	timer   *time.Timer
+}
+
+// Version returns the version of the artifact loaded on this instance
+func (d *ArtifactDistributor) Version() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.version
+}
+
+// Pending returns the version of the artifact waiting for its activation time on this
+// instance, if any
+func (d *ArtifactDistributor) Pending() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.pending
+}
+
+// Sync builds and publishes the artifact if this instance is the leader, or loads the last
+// published one otherwise. It does nothing when the loaded version is already the last one.
+func (d *ArtifactDistributor) Sync() error {
+	leader, err := d.Coordinator.IsLeader()
+	if err != nil {
+		return err
+	}
+	var a Artifact
+	if leader {
+		data, err := d.Build()
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(data)
+		a = Artifact{Name: d.Name, Version: hex.EncodeToString(sum[:]), Data: data}
+		if d.ActivateAt != nil {
+			a.ActivateAt = d.ActivateAt()
+		}
+		if err := d.Coordinator.Publish(a); err != nil {
+			return err
+		}
+	} else {
+		var ok bool
+		a, ok, err = d.Coordinator.Fetch(d.Name)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			// the leader didn't publish it yet
+			return nil
+		}
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if a.Version == d.version || a.Version == d.pending {
+		return nil
+	}
+	if d.timer != nil {
+		// a newer version replaces the pending one
+		d.timer.Stop()
+		d.timer, d.pending = nil, ""
+	}
+	if wait := time.Until(a.ActivateAt); !a.ActivateAt.IsZero() && wait > 0 {
+		d.pending = a.Version
+		d.timer = time.AfterFunc(wait, func() {
+			d.mu.Lock()
+			defer d.mu.Unlock()
+			if d.pending != a.Version {
+				return
+			}
+			d.timer, d.pending = nil, ""
+			d.load(a)
+		})
+		d.notify(EventReloadScheduled, "scheduled version "+a.Version+" at "+a.ActivateAt.UTC().Format(time.RFC3339))
+		return nil
+	}
+	return d.load(a)
+}
+
+// load installs a, with d.mu held
+func (d *ArtifactDistributor) load(a Artifact) error {
+	if err := d.Load(a.Data); err != nil {
+		d.notify(EventReloadFailed, "cannot load version "+a.Version+": "+err.Error())
+		return err
+	}
+	d.version = a.Version
+	d.notify(EventReloadApplied, "loaded version "+a.Version)
+	return nil
+}
+
+func (d *ArtifactDistributor) notify(t EventType, message string) {
+	if d.Notifier != nil {
+		d.Notifier.Notify(NewEvent(t, d.Name, message))
+	}
+}
+
+// Run syncs the artifact every Interval until stop is closed. onError, if not nil, is called
+// with the errors of the syncs.
+func (d *ArtifactDistributor) Run(stop <-chan struct{}, onError func(error)) {
+	interval := d.Interval
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := d.Sync(); err != nil && onError != nil {
+			onError(err)
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// leaseScript takes or renews the lease in KEYS[1] for the instance ARGV[1], for ARGV[2]
+// milliseconds. It returns 1 when the instance holds the lease.
+const leaseScript = `
+if redis.call("SET", KEYS[1], ARGV[1], "NX", "PX", ARGV[2]) then
+	return 1
+end
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	redis.call("PEXPIRE", KEYS[1], ARGV[2])
+	return 1
+end
+return 0
+`
+
+// RedisCoordinator is a Coordinator electing the leader with a lease in Redis, and storing
+// the artifacts there
+type RedisCoordinator struct {
+	Client RedisClient
+	// Prefix is prepended to the keys
+	Prefix string
+	// ID identifies this instance, it must be unique in the fleet
+	ID string
+	// Lease is how long the leader stays elected without renewing its lease, it should be
+	// longer than the Interval of the distributors. A minute if zero.
+	Lease time.Duration
+}
+
+// IsLeader implements Coordinator, taking or renewing the lease
+func (c *RedisCoordinator) IsLeader() (bool, error) {
+	if c.ID == "" {
+		return false, errors.New("coordinator has no instance ID")
+	}
+	lease := c.Lease
+	if lease <= 0 {
+		lease = time.Minute
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	res, err := c.Client.Eval(ctx, leaseScript, []string{c.Prefix + "leader"}, c.ID, int64(lease/time.Millisecond))
+	if err != nil {
+		return false, err
+	}
+	held, err := redisInt(res)
+	return held == 1, err
+}
+
+func (c *RedisCoordinator) cache() *RedisCache {
+	return &RedisCache{Client: c.Client, Prefix: c.Prefix + "artifact:"}
+}
+
+// Publish implements Coordinator
+func (c *RedisCoordinator) Publish(a Artifact) error {
+	header := a.Version
+	if !a.ActivateAt.IsZero() {
+		header += " " + strconv.FormatInt(a.ActivateAt.UnixNano()/int64(time.Millisecond), 10)
+	}
+	return c.cache().Set(a.Name, append([]byte(header+"\n"), a.Data...), 0)
+}
+
+// Fetch implements Coordinator
+func (c *RedisCoordinator) Fetch(name string) (Artifact, bool, error) {
+	value, ok, err := c.cache().Get(name)
+	if err != nil || !ok {
+		return Artifact{}, false, err
+	}
+	i := bytes.IndexByte(value, '\n')
+	if i < 0 {
+		return Artifact{}, false, errors.New("malformed artifact " + name)
+	}
+	a := Artifact{Name: name, Version: string(value[:i]), Data: value[i+1:]}
+	if j := strings.IndexByte(a.Version, ' '); j >= 0 {
+		ms, err := strconv.ParseInt(a.Version[j+1:], 10, 64)
+		if err != nil {
+			return Artifact{}, false, errors.New("malformed artifact " + name)
+		}
+		a.Version, a.ActivateAt = a.Version[:j], time.Unix(0, ms*int64(time.Millisecond))
+	}
+	return a, true, nil
+}
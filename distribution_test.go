@@ -0,0 +1,124 @@
+package goproxy
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+type memCoordinator struct {
+	leader    bool
+	artifacts map[string]Artifact
+}
+
+func (c *memCoordinator) IsLeader() (bool, error) { return c.leader, nil }
+
+func (c *memCoordinator) Publish(a Artifact) error {
+	c.artifacts[a.Name] = a
+	return nil
+}
+
+func (c *memCoordinator) Fetch(name string) (Artifact, bool, error) {
+	a, ok := c.artifacts[name]
+	return a, ok, nil
+}
+
+func TestArtifactDistributor(t *testing.T) {
+	data := "v1"
+	c := &memCoordinator{leader: true, artifacts: map[string]Artifact{}}
+	var leaderLoads int
+	leader := &ArtifactDistributor{Coordinator: c, Name: "ads",
+		Build: func() ([]byte, error) { return []byte(data), nil },
+		Load:  func(b []byte) error { leaderLoads++; return nil }}
+	var mu sync.Mutex
+	var loaded []string
+	var events []EventType
+	failing := false
+	follower := &ArtifactDistributor{Coordinator: &memCoordinator{artifacts: c.artifacts}, Name: "ads",
+		Load: func(b []byte) error {
+			mu.Lock()
+			defer mu.Unlock()
+			if failing {
+				return errors.New("corrupt")
+			}
+			loaded = append(loaded, string(b))
+			return nil
+		},
+		Notifier: notifierFunc(func(e Event) {
+			mu.Lock()
+			defer mu.Unlock()
+			events = append(events, e.Type)
+		})}
+
+	orFatal("follower Sync", follower.Sync(), t)
+	if follower.Version() != "" {
+		t.Errorf("expected nothing to load before the leader published, got %q", follower.Version())
+	}
+	orFatal("leader Sync", leader.Sync(), t)
+	orFatal("leader Sync", leader.Sync(), t)
+	if leaderLoads != 1 {
+		t.Errorf("expected the leader to load its unchanged artifact once, got %d", leaderLoads)
+	}
+
+	// concurrent syncs load the artifact once
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			follower.Sync()
+			follower.Version()
+		}()
+	}
+	wg.Wait()
+	if len(loaded) != 1 || loaded[0] != "v1" || follower.Version() != leader.Version() {
+		t.Errorf("expected the follower to load the published artifact once, got %v", loaded)
+	}
+
+	// a version failing to load is tried again on the next sync
+	data = "v2"
+	orFatal("leader Sync", leader.Sync(), t)
+	failing = true
+	if err := follower.Sync(); err == nil || follower.Version() == leader.Version() {
+		t.Errorf("expected the load to fail, got %v", err)
+	}
+	failing = false
+	orFatal("follower Sync", follower.Sync(), t)
+	if len(loaded) != 2 || follower.Version() != leader.Version() {
+		t.Errorf("expected the follower to load the new version, got %v", loaded)
+	}
+	if len(events) != 3 || events[0] != EventReloadApplied || events[1] != EventReloadFailed || events[2] != EventReloadApplied {
+		t.Errorf("unexpected events %v", events)
+	}
+}
+
+func TestArtifactDistributorActivateAt(t *testing.T) {
+	var mu sync.Mutex
+	var loaded []string
+	load := func(data []byte) error {
+		mu.Lock()
+		defer mu.Unlock()
+		loaded = append(loaded, string(data))
+		return nil
+	}
+	at := time.Now().Add(100 * time.Millisecond)
+	c := &memCoordinator{leader: true, artifacts: map[string]Artifact{}}
+	leader := &ArtifactDistributor{Coordinator: c, Name: "ads", Load: load,
+		Build: func() ([]byte, error) { return []byte("v2"), nil }, ActivateAt: func() time.Time { return at }}
+	follower := &ArtifactDistributor{Coordinator: &memCoordinator{artifacts: c.artifacts}, Name: "ads", Load: load}
+	orFatal("leader Sync", leader.Sync(), t)
+	orFatal("follower Sync", follower.Sync(), t)
+	orFatal("follower Sync", follower.Sync(), t)
+
+	if follower.Pending() == "" || follower.Version() != "" {
+		t.Errorf("expected the artifact to wait for its activation time, got %q", follower.Version())
+	}
+	time.Sleep(time.Until(at) + 100*time.Millisecond)
+	pending, version := follower.Pending(), follower.Version()
+	mu.Lock()
+	defer mu.Unlock()
+	if len(loaded) != 2 || pending != "" || version != leader.Version() {
+		t.Errorf("expected both instances to load the artifact once at its activation time, got %v", loaded)
+	}
+}
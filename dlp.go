@@ -0,0 +1,265 @@
+package goproxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DLPAction is what is done with an upload matching a DLP rule
+type DLPAction int
+
+const (
+	// DLPAllow only reports the match in the debug logs
+	DLPAllow DLPAction = iota
+	// DLPLog logs a warning, and lets the upload through
+	DLPLog
+	// DLPBlock blocks the upload
+	DLPBlock
+)
+
+// DLPMatch is a DLP rule matched by the body of a request
+type DLPMatch struct {
+	Rule   string
+	Action DLPAction
+}
+
+// DLPScanner classifies the body of a request as it is streamed
+type DLPScanner interface {
+	// Scan classifies the next bytes of the body, and returns the rules they match
+	Scan(p []byte) []DLPMatch
+	// Close returns the rules the body matches once it was scanned entirely
+	Close() []DLPMatch
+}
+
+// DLPClassifier is a source of DLP rules, such as regular expressions or fingerprints of
+// documents
+type DLPClassifier interface {
+	// NewScanner returns the scanner of the body of r
+	NewScanner(r *http.Request, ctx *ProxyCtx) DLPScanner
+}
+
+// DLPRule is a regular expression the uploads must not match
+type DLPRule struct {
+	Name    string
+	Pattern *regexp.Regexp
+	Action  DLPAction
+}
+
+// RegexClassifier is a DLPClassifier matching the bodies against regular expressions. The
+// bodies are matched by windows, matches longer than Overlap (256 if zero) may be missed when
+// they span the chunks the body is read by.
+type RegexClassifier struct {
+	Rules   []DLPRule
+	Overlap int
+}
+
+// NewScanner implements DLPClassifier
+func (c *RegexClassifier) NewScanner(r *http.Request, ctx *ProxyCtx) DLPScanner {
+	overlap := c.Overlap
+	if overlap <= 0 {
+		overlap = 256
+	}
+	return &regexScanner{c: c, overlap: overlap, matched: make(map[string]bool)}
+}
+
+type regexScanner struct {
+	c       *RegexClassifier
+	overlap int
+	tail    []byte
+	matched map[string]bool
+}
+
+func (s *regexScanner) Scan(p []byte) []DLPMatch {
+	window := append(s.tail, p...)
+	var matches []DLPMatch
+	for _, rule := range s.c.Rules {
+		if !s.matched[rule.Name] && rule.Pattern.Match(window) {
+			s.matched[rule.Name] = true
+			matches = append(matches, DLPMatch{rule.Name, rule.Action})
+		}
+	}
+	if len(window) > s.overlap {
+		window = window[len(window)-s.overlap:]
+	}
+	s.tail = append(s.tail[:0:0], window...)
+	return matches
+}
+
+func (s *regexScanner) Close() []DLPMatch {
+	return nil
+}
+
+// FingerprintClassifier is a DLPClassifier matching the uploads of documents by the SHA-256
+// of their content
+type FingerprintClassifier struct {
+	Fingerprints map[[sha256.Size]byte]DLPMatch
+}
+
+// NewScanner implements DLPClassifier
+func (c *FingerprintClassifier) NewScanner(r *http.Request, ctx *ProxyCtx) DLPScanner {
+	return &fingerprintScanner{c, sha256.New()}
+}
+
+type fingerprintScanner struct {
+	c *FingerprintClassifier
+	h hash.Hash
+}
+
+func (s *fingerprintScanner) Scan(p []byte) []DLPMatch {
+	s.h.Write(p)
+	return nil
+}
+
+func (s *fingerprintScanner) Close() []DLPMatch {
+	var sum [sha256.Size]byte
+	copy(sum[:], s.h.Sum(nil))
+	if m, ok := s.c.Fingerprints[sum]; ok {
+		return []DLPMatch{m}
+	}
+	return nil
+}
+
+// DLPPolicy configures the inspection of uploads by InspectUploads
+type DLPPolicy struct {
+	Classifiers []DLPClassifier
+	// MaxBufferSize is the size of the largest body inspected before it is sent upstream, 1MB
+	// if zero
+	MaxBufferSize int64
+	// BlockedMetric, if set, counts the uploads blocked
+	BlockedMetric *prometheus.Counter
+	// SpillToDisk inspects the bodies larger than MaxBufferSize entirely before they are sent
+	// upstream too, buffering them in a SpillBuffer
+	SpillToDisk bool
+}
+
+// UploadBlockedError is the error of an upload blocked by a DLP rule
+type UploadBlockedError struct {
+	Match DLPMatch
+}
+
+func (e *UploadBlockedError) Error() string {
+	return "upload blocked by DLP rule " + e.Match.Rule
+}
+
+// dlpInspection is the inspection of the body of a request by the scanners of a DLPPolicy
+type dlpInspection struct {
+	policy   *DLPPolicy
+	ctx      *ProxyCtx
+	scanners []DLPScanner
+}
+
+func (in *dlpInspection) apply(matches []DLPMatch) error {
+	for _, m := range matches {
+		switch m.Action {
+		case DLPAllow:
+			in.ctx.Logf("upload to %s matched DLP rule %s", in.ctx.Req.URL, m.Rule)
+		case DLPLog:
+			in.ctx.Warnf("upload to %s matched DLP rule %s", in.ctx.Req.URL, m.Rule)
+		case DLPBlock:
+			in.ctx.Warnf("upload to %s blocked by DLP rule %s", in.ctx.Req.URL, m.Rule)
+			if in.policy.BlockedMetric != nil {
+				metric := *in.policy.BlockedMetric
+				metric.Inc()
+			}
+			in.ctx.PolicyDecision = &PolicyDecision{Policy: "dlp", RuleID: m.Rule}
+			return &UploadBlockedError{m}
+		}
+	}
+	return nil
+}
+
+func (in *dlpInspection) Write(p []byte) (int, error) {
+	for _, s := range in.scanners {
+		if err := in.apply(s.Scan(p)); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (in *dlpInspection) close() error {
+	for _, s := range in.scanners {
+		if err := in.apply(s.Close()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// InspectUploads returns a ReqHandler streaming the bodies of the requests through the
+// classifiers of policy. Bodies of up to MaxBufferSize bytes, chunked or not, are inspected
+// before they are sent upstream, and blocked uploads are answered with 403 Forbidden. Larger
+// bodies are inspected as they are relayed, and the upstream request is aborted before the end
+// of its body when they are blocked, unless SpillToDisk is set.
+//
+//	proxy.OnRequest().Do(goproxy.InspectUploads(&goproxy.DLPPolicy{Classifiers: []goproxy.DLPClassifier{
+//		&goproxy.RegexClassifier{Rules: []goproxy.DLPRule{
+//			{Name: "card", Pattern: regexp.MustCompile(`\b4[0-9]{12}(?:[0-9]{3})?\b`), Action: goproxy.DLPBlock}}}}}))
+func InspectUploads(policy *DLPPolicy) ReqHandler {
+	return FuncReqHandler(func(r *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response) {
+		if r.Body == nil || r.Body == http.NoBody || r.ContentLength == 0 || len(policy.Classifiers) == 0 {
+			return r, nil
+		}
+		in := &dlpInspection{policy: policy, ctx: ctx}
+		for _, c := range policy.Classifiers {
+			in.scanners = append(in.scanners, c.NewScanner(r, ctx))
+		}
+		max := policy.MaxBufferSize
+		if max <= 0 {
+			max = 1 << 20
+		}
+		// the client is sent 100 Continue when the body is first read, the upstream server is
+		// not asked again
+		r.Header.Del("Expect")
+		if policy.SpillToDisk && (r.ContentLength > max || r.ContentLength < 0) {
+			body := ctx.NewSpillBuffer()
+			if _, err := io.Copy(io.MultiWriter(in, body), r.Body); err != nil {
+				body.Close()
+				if _, blocked := err.(*UploadBlockedError); blocked {
+					return r, ctx.BlockedResponse(http.StatusForbidden, *ctx.PolicyDecision)
+				}
+				ctx.Warnf("Cannot buffer upload to inspect it: %v", err)
+				return r, NewResponse(r, ContentTypeText, http.StatusBadRequest, "Cannot read request body\n")
+			}
+			if err := in.close(); err != nil {
+				body.Close()
+				return r, ctx.BlockedResponse(http.StatusForbidden, *ctx.PolicyDecision)
+			}
+			r.Body = body.Reader()
+			r.ContentLength = body.Len()
+			r.TransferEncoding = nil
+			return r, nil
+		}
+		var read []byte
+		if r.ContentLength <= max {
+			body, err := ctx.readAll(io.LimitReader(r.Body, max+1))
+			if err != nil {
+				ctx.Warnf("Cannot read upload to inspect it: %v", err)
+				return r, NewResponse(r, ContentTypeText, http.StatusBadRequest, "Cannot read request body\n")
+			}
+			if _, err := in.Write(body); err != nil {
+				return r, ctx.BlockedResponse(http.StatusForbidden, *ctx.PolicyDecision)
+			}
+			if int64(len(body)) <= max {
+				if err := in.close(); err != nil {
+					return r, ctx.BlockedResponse(http.StatusForbidden, *ctx.PolicyDecision)
+				}
+				r.Body = ioutil.NopCloser(bytes.NewReader(body))
+				r.ContentLength = int64(len(body))
+				r.TransferEncoding = nil
+				return r, nil
+			}
+			// a larger chunked body, relay what was read and inspect the rest as it is relayed
+			read = body
+		}
+		r.Body = newVerifyingBody(r.Body, in, read, in.close)
+		return r, nil
+	})
+}
@@ -0,0 +1,102 @@
+package goproxy
+
+import (
+	"crypto/sha256"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInspectUploads(t *testing.T) {
+	received := make(chan string, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			received <- "error"
+			return
+		}
+		received <- string(body)
+		w.Write([]byte(strconv.Itoa(len(body))))
+	}))
+	defer upstream.Close()
+
+	secret := "top secret document"
+	proxy := NewProxyHttpServer()
+	proxy.OnRequest().Do(InspectUploads(&DLPPolicy{MaxBufferSize: 64, Classifiers: []DLPClassifier{
+		&RegexClassifier{Rules: []DLPRule{
+			{Name: "card", Pattern: regexp.MustCompile(`\b4[0-9]{15}\b`), Action: DLPBlock},
+			{Name: "internal", Pattern: regexp.MustCompile(`INTERNAL`), Action: DLPLog}}},
+		&FingerprintClassifier{Fingerprints: map[[sha256.Size]byte]DLPMatch{
+			sha256.Sum256([]byte(secret)): {Rule: "secret", Action: DLPBlock}}},
+	}}))
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+	proxyURL, _ := url.Parse(s.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	post := func(body io.Reader, chunked, expect bool) (int, string) {
+		req, _ := http.NewRequest("POST", upstream.URL, body)
+		if chunked {
+			req.ContentLength = -1
+		}
+		if expect {
+			req.Header.Set("Expect", "100-continue")
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return 0, ""
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+
+	large := strings.Repeat("INTERNAL notes ", 20)
+	for _, c := range []struct {
+		name            string
+		body            string
+		chunked, expect bool
+		status          int
+	}{
+		{"clean", "hello", false, false, http.StatusOK},
+		{"expect", "hello", false, true, http.StatusOK},
+		{"chunked", "hello", true, false, http.StatusOK},
+		{"large chunked", large, true, true, http.StatusOK},
+		{"card", "card=4111111111111111", false, false, http.StatusForbidden},
+		{"chunked card", "card=4111111111111111", true, false, http.StatusForbidden},
+		{"fingerprint", secret, false, true, http.StatusForbidden},
+	} {
+		status, body := post(strings.NewReader(c.body), c.chunked, c.expect)
+		if status != c.status {
+			t.Errorf("%s: expected status %d, got %d", c.name, c.status, status)
+			continue
+		}
+		if c.status == http.StatusOK && body != strconv.Itoa(len(c.body)) {
+			t.Errorf("%s: upstream received %s bytes instead of %d", c.name, body, len(c.body))
+		}
+		if c.status == http.StatusOK {
+			<-received
+		}
+	}
+
+	// blocked after the first bytes were relayed
+	status, _ := post(strings.NewReader(large+"card=4111111111111111"), true, false)
+	if status == http.StatusOK {
+		t.Error("expected the large upload to be aborted")
+	}
+	select {
+	case got := <-received:
+		if got != "error" {
+			t.Errorf("expected upstream to receive an incomplete body, got %d bytes", len(got))
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("expected the upstream request to be aborted")
+	}
+}
@@ -0,0 +1,59 @@
+package goproxy
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// DNSQuery describes a single DNS query made by the proxy, as reported to
+// ProxyHttpServer.DNSQueryLogger
+type DNSQuery struct {
+	// Name is the queried host name
+	Name string
+	// Type is the query type ("A", "AAAA"), or "IP" for resolvers that do not speak DNS
+	Type string
+	// Resolver describes the resolver that answered
+	Resolver string
+	Latency  time.Duration
+	// Rcode is the DNS response code, empty when no response was received
+	Rcode   string
+	Answers []string
+	// ClientSubnet is the EDNS client subnet sent with the query, if any
+	ClientSubnet string
+	Err          error
+}
+
+func (q DNSQuery) String() string {
+	return fmt.Sprintf("dns query name=%s type=%s resolver=%s latency=%v rcode=%s answers=[%s] ecs=%s err=%v",
+		q.Name, q.Type, q.Resolver, q.Latency, q.Rcode, strings.Join(q.Answers, ","), q.ClientSubnet, q.Err)
+}
+
+// LogDNSQuery is a DNSQueryLogger writing the queries to the log of ctx
+func LogDNSQuery(ctx *ProxyCtx, q DNSQuery) {
+	ctx.Infof("%s", q)
+}
+
+// queryLogger returns the function reporting the DNS queries of a lookup made on behalf of ctx,
+// or nil when DNS query logging is disabled or the lookup was not sampled. All the queries are
+// reported while DNS is being debugged.
+func (ctx *ProxyCtx) queryLogger() func(DNSQuery) {
+	debug := ctx.Proxy.Debugging(DebugDNS)
+	if ctx.Proxy == nil || ctx.Proxy.DNSQueryLogger == nil {
+		if debug {
+			return func(q DNSQuery) {
+				ctx.Debugf(DebugDNS, "%s", q)
+			}
+		}
+		return nil
+	}
+	rate := ctx.Proxy.DNSQueryLogSampleRate
+	if !debug && rate > 0 && rate < 1 && rand.Float64() >= rate {
+		return nil
+	}
+	logger := ctx.Proxy.DNSQueryLogger
+	return func(q DNSQuery) {
+		logger(ctx, q)
+	}
+}
@@ -0,0 +1,70 @@
+package goproxy
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestDNSQueryLogSampling(t *testing.T) {
+	for _, c := range []struct {
+		rate     float64
+		min, max int
+	}{
+		{0, 1000, 1000},
+		{1, 1000, 1000},
+		{0.25, 150, 350},
+	} {
+		proxy := NewProxyHttpServer()
+		proxy.DNSQueryLogger = func(ctx *ProxyCtx, q DNSQuery) {}
+		proxy.DNSQueryLogSampleRate = c.rate
+		sampled := 0
+		for i := 0; i < 1000; i++ {
+			if (&ProxyCtx{Proxy: proxy}).queryLogger() != nil {
+				sampled++
+			}
+		}
+		if sampled < c.min || sampled > c.max {
+			t.Errorf("rate %v: %d lookups of 1000 sampled", c.rate, sampled)
+		}
+	}
+
+	if (&ProxyCtx{Proxy: NewProxyHttpServer()}).queryLogger() != nil {
+		t.Error("expected no query logger without DNSQueryLogger")
+	}
+}
+
+func TestDNSQueryLogged(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	orFatal("ListenPacket", err, t)
+	server := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, m *dns.Msg) {
+		r := new(dns.Msg)
+		r.SetReply(m)
+		if m.Question[0].Qtype == dns.TypeA {
+			rr, _ := dns.NewRR(m.Question[0].Name + " 60 IN A 192.0.2.1")
+			r.Answer = append(r.Answer, rr)
+		}
+		w.WriteMsg(r)
+	})}
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+
+	var queries []DNSQuery
+	proxy := NewProxyHttpServer()
+	proxy.DNSQueryLogger = func(ctx *ProxyCtx, q DNSQuery) { queries = append(queries, q) }
+	ctx := &ProxyCtx{Proxy: proxy, EDNSClientSubnetV4: "198.51.100.0/24"}
+	r := &DNSServerResolver{Addr: pc.LocalAddr().String()}
+	_, err = r.LookupIP(context.Background(), "example.com", ctx.lookupHints("ip4"))
+	orFatal("LookupIP", err, t)
+
+	if len(queries) != 1 {
+		t.Fatalf("expected the A query to be logged, got %+v", queries)
+	}
+	q := queries[0]
+	if q.Name != "example.com" || q.Type != "A" || q.Resolver != r.String() || q.Rcode != "NOERROR" ||
+		len(q.Answers) != 1 || q.Answers[0] != "192.0.2.1" || q.ClientSubnet != "198.51.100.0/24" || q.Err != nil {
+		t.Errorf("unexpected query %+v", q)
+	}
+}
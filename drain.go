@@ -0,0 +1,159 @@
+package goproxy
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PolicyDrain is the policy of the requests denied by DrainFlags
+const PolicyDrain = "drain"
+
+// DrainFlags mark forward proxies and destinations as draining, for planned maintenance: the
+// new requests through a draining forward proxy fall back to the next upstream of their
+// FallbackChain, and are answered 503 with a Retry-After header if there is none, like the
+// new requests to a draining destination. The tunnels already established go on until they
+// are closed. The flags are set with the methods of DrainFlags or on the admin API.
+type DrainFlags struct {
+	// RetryAfter is the Retry-After of the 503 responses, 60s if zero
+	RetryAfter time.Duration
+
+	mu           sync.RWMutex
+	upstreams    map[string]bool
+	destinations map[string]bool
+}
+
+// DrainState is the set of the draining forward proxies and destinations
+type DrainState struct {
+	Upstreams    []string `json:"upstreams"`
+	Destinations []string `json:"destinations"`
+}
+
+// DrainUpstream marks the forward proxy hostport as draining, or not
+func (d *DrainFlags) DrainUpstream(hostport string, draining bool) {
+	d.set(&d.upstreams, strings.ToLower(hostport), draining)
+}
+
+// DrainDestination marks the destination host as draining, or not. host is a host name, which
+// matches all its ports, or a host:port.
+func (d *DrainFlags) DrainDestination(host string, draining bool) {
+	d.set(&d.destinations, strings.ToLower(host), draining)
+}
+
+func (d *DrainFlags) set(m *map[string]bool, key string, draining bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !draining {
+		delete(*m, key)
+		return
+	}
+	if *m == nil {
+		*m = make(map[string]bool)
+	}
+	(*m)[key] = true
+}
+
+// Draining returns the draining forward proxies and destinations, sorted
+func (d *DrainFlags) Draining() DrainState {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	s := DrainState{Upstreams: []string{}, Destinations: []string{}}
+	for k := range d.upstreams {
+		s.Upstreams = append(s.Upstreams, k)
+	}
+	for k := range d.destinations {
+		s.Destinations = append(s.Destinations, k)
+	}
+	sort.Strings(s.Upstreams)
+	sort.Strings(s.Destinations)
+	return s
+}
+
+func (d *DrainFlags) upstreamDraining(hostport string) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.upstreams[strings.ToLower(hostport)]
+}
+
+func (d *DrainFlags) destinationDraining(hostport string) bool {
+	hostport = strings.ToLower(hostport)
+	host := hostport
+	if h, _, err := net.SplitHostPort(hostport); err == nil {
+		host = h
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.destinations[hostport] || d.destinations[host]
+}
+
+func (d *DrainFlags) retryAfter() string {
+	if d.RetryAfter <= 0 {
+		return "60"
+	}
+	return strconv.Itoa(int((d.RetryAfter + time.Second - 1) / time.Second))
+}
+
+// drained moves the request of ctx to host off the draining forward proxies, and returns the
+// response denying it if it can't avoid them or if host is draining, nil otherwise
+func (proxy *ProxyHttpServer) drained(ctx *ProxyCtx, host string) *http.Response {
+	d := proxy.DrainFlags
+	if d == nil {
+		return nil
+	}
+	draining := ""
+	if d.destinationDraining(host) {
+		draining = host
+	} else if ctx.ForwardProxy != "" && d.upstreamDraining(ctx.ForwardProxy) {
+		ctx.fallbackFromLegacy()
+		for ctx.ForwardProxy != "" && d.upstreamDraining(ctx.ForwardProxy) && len(ctx.FallbackChain) > 0 {
+			ctx.Logf("forward proxy %s is draining, using %s", ctx.ForwardProxy, ctx.FallbackChain[0].ForwardProxy)
+			ctx.useUpstream(ctx.FallbackChain[0])
+			ctx.FallbackChain = ctx.FallbackChain[1:]
+		}
+		if ctx.ForwardProxy != "" && d.upstreamDraining(ctx.ForwardProxy) {
+			draining = ctx.ForwardProxy
+		}
+	}
+	if draining == "" {
+		return nil
+	}
+	ctx.Warnf("Denying %s, %s is draining", host, draining)
+	resp := ctx.BlockedResponse(http.StatusServiceUnavailable, PolicyDecision{Policy: PolicyDrain, RuleID: draining,
+		Reason: draining + " is under maintenance"})
+	resp.Header.Set("Retry-After", d.retryAfter())
+	return resp
+}
+
+// serveDrain serves the drain flags on the admin API
+func (proxy *ProxyHttpServer) serveDrain(w http.ResponseWriter, r *http.Request) {
+	if proxy.DrainFlags == nil {
+		http.Error(w, "drain flags are not enabled", http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case "GET", "HEAD":
+	case "PUT", "POST", "DELETE":
+		upstream, destination := r.URL.Query().Get("upstream"), r.URL.Query().Get("destination")
+		if upstream == "" && destination == "" {
+			http.Error(w, "upstream or destination required", http.StatusBadRequest)
+			return
+		}
+		if upstream != "" {
+			proxy.DrainFlags.DrainUpstream(upstream, r.Method != "DELETE")
+		}
+		if destination != "" {
+			proxy.DrainFlags.DrainDestination(destination, r.Method != "DELETE")
+		}
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", ContentTypeJSON)
+	json.NewEncoder(w).Encode(proxy.DrainFlags.Draining())
+}
@@ -0,0 +1,68 @@
+package goproxy
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDrainFlags(t *testing.T) {
+	target := httptest.NewServer(ConstantHanlder("bobo"))
+	defer target.Close()
+	next := httptest.NewServer(NewProxyHttpServer())
+	defer next.Close()
+	host := target.Listener.Addr().String()
+
+	proxy := NewProxyHttpServer()
+	proxy.DrainFlags = &DrainFlags{}
+	proxy.OnRequest().HandleConnectFunc(func(host string, ctx *ProxyCtx) (*ConnectAction, string) {
+		ctx.ForwardProxy = "192.0.2.1:3128"
+		ctx.ForwardProxyDialTimeout = 5
+		ctx.ForwardProxyDirectSendOK = true
+		ctx.FallbackChain = []FallbackUpstream{{ForwardProxy: next.Listener.Addr().String()}}
+		return OkConnect, host
+	})
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+	admin := httptest.NewServer(proxy.AdminHandler())
+	defer admin.Close()
+
+	connect := func() *http.Response {
+		conn, err := net.Dial("tcp", s.Listener.Addr().String())
+		orFatal("Dial", err, t)
+		defer conn.Close()
+		_, err = conn.Write([]byte("CONNECT " + host + " HTTP/1.1\r\nHost: " + host + "\r\n\r\n"))
+		orFatal("Write", err, t)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "CONNECT"})
+		orFatal("ReadResponse(CONNECT)", err, t)
+		return resp
+	}
+	adminDo := func(method, query string) {
+		req, _ := http.NewRequest(method, admin.URL+"/drain?"+query, nil)
+		resp, err := http.DefaultClient.Do(req)
+		orFatal("admin", err, t)
+		resp.Body.Close()
+	}
+
+	adminDo("PUT", "upstream=192.0.2.1:3128")
+	if resp := connect(); resp.StatusCode != http.StatusOK {
+		t.Errorf("expected the CONNECT to fall back to the next upstream, got %s", resp.Status)
+	}
+
+	adminDo("PUT", "upstream="+next.Listener.Addr().String())
+	if resp := connect(); resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") != "60" {
+		t.Errorf("expected 503 with Retry-After once all the upstreams drain, got %s %v", resp.Status, resp.Header)
+	}
+	adminDo("DELETE", "upstream="+next.Listener.Addr().String())
+
+	adminDo("PUT", "destination=127.0.0.1")
+	if resp := connect(); resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get(PolicyHeader) != PolicyDrain {
+		t.Errorf("expected 503 for a draining destination, got %s %v", resp.Status, resp.Header)
+	}
+	if s := proxy.DrainFlags.Draining(); strings.Join(s.Destinations, ",") != "127.0.0.1" || len(s.Upstreams) != 1 {
+		t.Errorf("unexpected drain state %+v", s)
+	}
+}
@@ -0,0 +1,154 @@
+package goproxy
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// PolicyStrictEgress is the policy of the requests denied by StrictEgress
+const PolicyStrictEgress = "strict-egress"
+
+// StrictEgress makes the proxy fail closed: while a policy subsystem the handlers rely on,
+// like the blocklist source, the auth backend or the categorizer, is unhealthy, the requests
+// and the CONNECT requests the handlers let through are denied instead of being allowed
+// unchecked. The subsystems report their health with SetHealth, or are polled with Check.
+//
+//	blocklist := &goproxy.EgressSubsystem{}
+//	proxy.StrictEgress = &goproxy.StrictEgress{Subsystems: map[string]*goproxy.EgressSubsystem{
+//		"blocklist":   blocklist,
+//		"categorizer": {Check: categorizer.Ping, FailOpen: true},
+//	}}
+//	...
+//	blocklist.SetHealth(refreshBlocklist())
+type StrictEgress struct {
+	// Subsystems are the policy subsystems, by name
+	Subsystems map[string]*EgressSubsystem
+	// Status is the status of the responses denying the requests, 503 if zero
+	Status int
+	// Metric, if set, counts the requests met while a subsystem is unhealthy, labeled with the
+	// subsystem and "denied" or "allowed" for the subsystems failing open
+	Metric *prometheus.CounterVec
+
+	once  sync.Once
+	names []string
+}
+
+// EgressSubsystem is a policy subsystem whose health StrictEgress checks
+type EgressSubsystem struct {
+	// Check, if set, returns why the subsystem is unhealthy, nil if it is healthy. It is
+	// polled at most once per CheckInterval, instead of the health reported with SetHealth.
+	Check func() error
+	// CheckInterval is the interval between the calls to Check, 1s if zero
+	CheckInterval time.Duration
+	// FailOpen allows the requests while the subsystem is unhealthy, they are only counted
+	FailOpen bool
+
+	mu      sync.Mutex
+	err     error
+	checked time.Time
+	failing bool
+}
+
+// SetHealth records the health of the subsystem, err is why it is unhealthy or nil if it is
+// healthy
+func (s *EgressSubsystem) SetHealth(err error) {
+	s.mu.Lock()
+	s.err = err
+	s.mu.Unlock()
+}
+
+// Err returns why the subsystem is unhealthy, nil if it is healthy
+func (s *EgressSubsystem) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.health()
+}
+
+func (s *EgressSubsystem) health() error {
+	if s.Check == nil {
+		return s.err
+	}
+	interval := s.CheckInterval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	if now := time.Now(); now.Sub(s.checked) >= interval {
+		s.err = s.Check()
+		s.checked = now
+	}
+	return s.err
+}
+
+// transition records whether the subsystem fails and reports whether it just started to
+func (s *EgressSubsystem) transition(failing bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	started := failing && !s.failing
+	s.failing = failing
+	return started
+}
+
+func (e *StrictEgress) init() {
+	for name := range e.Subsystems {
+		e.names = append(e.names, name)
+	}
+	sort.Strings(e.names)
+}
+
+// Unhealthy returns the errors of the unhealthy subsystems, by name
+func (e *StrictEgress) Unhealthy() map[string]error {
+	e.once.Do(e.init)
+	unhealthy := map[string]error{}
+	for _, name := range e.names {
+		if err := e.Subsystems[name].Err(); err != nil {
+			unhealthy[name] = err
+		}
+	}
+	return unhealthy
+}
+
+func (e *StrictEgress) status() int {
+	if e.Status == 0 {
+		return http.StatusServiceUnavailable
+	}
+	return e.Status
+}
+
+// failClosed returns the response denying the request of ctx while a subsystem of
+// StrictEgress not failing open is unhealthy, nil if it is allowed. The first such subsystem
+// by name denies it.
+func (proxy *ProxyHttpServer) failClosed(ctx *ProxyCtx) *http.Response {
+	e := proxy.StrictEgress
+	if e == nil {
+		return nil
+	}
+	e.once.Do(e.init)
+	var resp *http.Response
+	for _, name := range e.names {
+		s := e.Subsystems[name]
+		err := s.Err()
+		if s.transition(err != nil) {
+			proxy.notify(NewEvent(EventFailClosed, name, err.Error()))
+		}
+		switch {
+		case err == nil:
+		case s.FailOpen:
+			ctx.Warnf("Allowing %s while %s is unhealthy: %v", ctx.Req.URL.Host, name, err)
+			if e.Metric != nil {
+				e.Metric.WithLabelValues(name, "allowed").Inc()
+			}
+		case resp == nil:
+			ctx.Warnf("Denying %s while %s is unhealthy: %v", ctx.Req.URL.Host, name, err)
+			if e.Metric != nil {
+				e.Metric.WithLabelValues(name, "denied").Inc()
+			}
+			resp = ctx.BlockedResponse(e.status(), PolicyDecision{Policy: PolicyStrictEgress, RuleID: name,
+				Reason: name + " is unavailable"})
+		}
+	}
+	return resp
+}
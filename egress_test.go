@@ -0,0 +1,55 @@
+package goproxy
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestStrictEgressFailClosed(t *testing.T) {
+	target := httptest.NewServer(ConstantHanlder("bobo"))
+	defer target.Close()
+
+	blocklist := &EgressSubsystem{}
+	categorizer := &EgressSubsystem{Check: func() error { return errors.New("timeout") }, FailOpen: true}
+	proxy := NewProxyHttpServer()
+	proxy.StrictEgress = &StrictEgress{Subsystems: map[string]*EgressSubsystem{
+		"blocklist":   blocklist,
+		"categorizer": categorizer,
+	}}
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	proxyURL, _ := url.Parse(s.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	resp, err := client.Get(target.URL)
+	orFatal("Get", err, t)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "bobo" {
+		t.Errorf("expected the request to be allowed while only a fail open subsystem is unhealthy, got %s %q", resp.Status, body)
+	}
+
+	blocklist.SetHealth(errors.New("cannot download the blocklist"))
+	resp, err = client.Get(target.URL)
+	orFatal("Get", err, t)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get(PolicyHeader) != PolicyStrictEgress ||
+		resp.Header.Get(PolicyRuleIDHeader) != "blocklist" {
+		t.Errorf("expected the request to be denied while the blocklist is unhealthy, got %s %v", resp.Status, resp.Header)
+	}
+	if unhealthy := proxy.StrictEgress.Unhealthy(); len(unhealthy) != 2 {
+		t.Errorf("expected 2 unhealthy subsystems, got %v", unhealthy)
+	}
+
+	blocklist.SetHealth(nil)
+	resp, err = client.Get(target.URL)
+	orFatal("Get", err, t)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected the request to be allowed once the blocklist is healthy, got %s", resp.Status)
+	}
+}
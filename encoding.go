@@ -0,0 +1,312 @@
+package goproxy
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// EncodingPolicy controls the content encodings negotiated with the upstream servers and
+// the clients. It can be set for the whole proxy, and overridden per request by setting
+// ProxyCtx.EncodingPolicy in a request handler.
+type EncodingPolicy struct {
+	// AcceptEncoding, if not empty, is sent to the upstream servers instead of letting the
+	// transport ask for gzip and decompress the responses itself. Use "identity" to get
+	// uncompressed bodies for inspection, or e.g. "gzip, br" to save bandwidth upstream.
+	// Responses in an encoding the client doesn't accept are decoded for it.
+	AcceptEncoding string
+	// CompressResponses gzips the uncompressed responses for the clients that accept gzip
+	CompressResponses bool
+	// CompressMinSize is the size under which responses of known length are not compressed,
+	// 1024 if zero
+	CompressMinSize int64
+	// CompressTypes are the compressed content types, a trailing * matches every subtype.
+	// Textual types are compressed if empty.
+	CompressTypes []string
+	// CPUBudget is the fraction of a CPU the proxy may spend compressing responses, e.g. 0.5
+	// for half a core. Responses are relayed uncompressed while it is spent. There is no
+	// bound if it is zero.
+	CPUBudget float64
+
+	budget cpuBudget
+}
+
+var defaultCompressTypes = []string{"text/*", "application/json", "application/javascript",
+	"application/xml", "application/xhtml+xml", "image/svg+xml"}
+
+// encodingPolicy returns the policy of the request, falling back to the one of the proxy
+func (ctx *ProxyCtx) encodingPolicy() *EncodingPolicy {
+	if ctx.EncodingPolicy != nil {
+		return ctx.EncodingPolicy
+	}
+	if ctx.Proxy != nil {
+		return ctx.Proxy.EncodingPolicy
+	}
+	return nil
+}
+
+// setUpstreamAcceptEncoding sets the Accept-Encoding of the request sent upstream. It must be
+// called after removeProxyHeaders.
+func (ctx *ProxyCtx) setUpstreamAcceptEncoding(r *http.Request) {
+	if policy := ctx.encodingPolicy(); policy != nil && policy.AcceptEncoding != "" {
+		r.Header.Set("Accept-Encoding", policy.AcceptEncoding)
+	}
+}
+
+// acceptEncoding returns the Accept-Encoding header the client sent
+func (ctx *ProxyCtx) acceptEncoding() string {
+	if ctx.clientAcceptEncodingSet || ctx.Req == nil {
+		return ctx.clientAcceptEncoding
+	}
+	return ctx.Req.Header.Get("Accept-Encoding")
+}
+
+// acceptsEncoding reports whether the Accept-Encoding header acceptEncoding allows enc
+func acceptsEncoding(acceptEncoding, enc string) bool {
+	if enc == "" || strings.EqualFold(enc, "identity") {
+		return true
+	}
+	wildcard := false
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		fields := strings.Split(part, ";")
+		name := strings.TrimSpace(fields[0])
+		accepted := true
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil && q == 0 {
+					accepted = false
+				}
+			}
+		}
+		if strings.EqualFold(name, enc) {
+			return accepted
+		}
+		if name == "*" {
+			wildcard = accepted
+		}
+	}
+	return wildcard
+}
+
+// contentEncodings returns the encodings of the Content-Encoding header h, in the order they
+// were applied
+func contentEncodings(h http.Header) []string {
+	var encodings []string
+	for _, v := range h["Content-Encoding"] {
+		for _, enc := range strings.Split(v, ",") {
+			if enc = strings.ToLower(strings.TrimSpace(enc)); enc != "" && enc != "identity" {
+				encodings = append(encodings, enc)
+			}
+		}
+	}
+	return encodings
+}
+
+// DecodeContent replaces the body of resp with its decoded content, and removes the
+// Content-Encoding and Content-Length headers. It supports the gzip, deflate, br and zstd
+// encodings, and stacks of them such as "br, gzip", which are decoded in the reverse order
+// they were applied.
+func DecodeContent(resp *http.Response) error {
+	encodings := contentEncodings(resp.Header)
+	if len(encodings) == 0 {
+		return nil
+	}
+	body := &decodedBody{body: resp.Body}
+	var r io.Reader = resp.Body
+	for i := len(encodings) - 1; i >= 0; i-- {
+		switch encodings[i] {
+		case "gzip", "x-gzip":
+			zr, err := gzip.NewReader(r)
+			if err != nil {
+				body.closeDecoders()
+				return err
+			}
+			r = zr
+		case "deflate":
+			r = flate.NewReader(r)
+		case "br":
+			r = brotli.NewReader(r)
+		case "zstd":
+			zr, err := zstd.NewReader(r)
+			if err != nil {
+				body.closeDecoders()
+				return err
+			}
+			rc := zr.IOReadCloser()
+			body.decoders = append(body.decoders, rc)
+			r = rc
+		default:
+			body.closeDecoders()
+			return fmt.Errorf("unsupported content encoding %s", encodings[i])
+		}
+	}
+	body.Reader = r
+	resp.Body = body
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	return nil
+}
+
+// decodedBody reads the decoded content of body, and releases the decoders that hold
+// resources when it is closed
+type decodedBody struct {
+	io.Reader
+	body     io.Closer
+	decoders []io.Closer
+}
+
+func (b *decodedBody) closeDecoders() {
+	for _, d := range b.decoders {
+		d.Close()
+	}
+}
+
+func (b *decodedBody) Close() error {
+	b.closeDecoders()
+	return b.body.Close()
+}
+
+// cpuBudget is a token bucket of CPU time, refilled at the budget fraction of the elapsed time
+type cpuBudget struct {
+	mu        sync.Mutex
+	available time.Duration
+	last      time.Time
+}
+
+func (b *cpuBudget) allow(fraction float64) bool {
+	if fraction <= 0 {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	if !b.last.IsZero() {
+		b.available += time.Duration(float64(now.Sub(b.last)) * fraction)
+	}
+	// allow bursts of a second of budget
+	if max := time.Duration(fraction * float64(time.Second)); b.last.IsZero() || b.available > max {
+		b.available = max
+	}
+	b.last = now
+	return b.available > 0
+}
+
+func (b *cpuBudget) charge(d time.Duration) {
+	b.mu.Lock()
+	b.available -= d
+	b.mu.Unlock()
+}
+
+// gzipBody compresses the body it wraps as it is read
+type gzipBody struct {
+	src    io.ReadCloser
+	buf    bytes.Buffer
+	zw     *gzip.Writer
+	chunk  []byte
+	eof    bool
+	budget *cpuBudget
+}
+
+func (b *gzipBody) Read(p []byte) (int, error) {
+	for b.buf.Len() == 0 && !b.eof {
+		n, err := b.src.Read(b.chunk)
+		start := time.Now()
+		if n > 0 {
+			b.zw.Write(b.chunk[:n])
+		}
+		if err == io.EOF {
+			b.zw.Close()
+			b.eof = true
+		} else if err != nil {
+			return 0, err
+		} else {
+			b.zw.Flush()
+		}
+		b.budget.charge(time.Since(start))
+	}
+	if b.buf.Len() == 0 {
+		return 0, io.EOF
+	}
+	return b.buf.Read(p)
+}
+
+func (b *gzipBody) Close() error {
+	return b.src.Close()
+}
+
+func (policy *EncodingPolicy) compressible(resp *http.Response) bool {
+	minSize := policy.CompressMinSize
+	if minSize == 0 {
+		minSize = 1024
+	}
+	if resp.ContentLength >= 0 && resp.ContentLength < minSize {
+		return false
+	}
+	if resp.StatusCode == http.StatusPartialContent || resp.StatusCode == http.StatusNoContent ||
+		resp.Request != nil && resp.Request.Method == "HEAD" {
+		return false
+	}
+	types := policy.CompressTypes
+	if len(types) == 0 {
+		types = defaultCompressTypes
+	}
+	return mediaTypeIn(resp.Header.Get("Content-Type"), types)
+}
+
+// mediaTypeIn reports whether the media type of the Content-Type contentType is one of types,
+// in which a trailing * matches every subtype
+func mediaTypeIn(contentType string, types []string) bool {
+	contentType = strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	for _, t := range types {
+		if contentType == t || strings.HasSuffix(t, "*") && strings.HasPrefix(contentType, t[:len(t)-1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// encodeForClient makes the encoding of resp acceptable to the client of ctx: responses the
+// client can't decode are decoded, and uncompressed responses are compressed when the
+// policy asks for it
+func (ctx *ProxyCtx) encodeForClient(resp *http.Response) *http.Response {
+	policy := ctx.encodingPolicy()
+	if policy == nil || resp == nil || resp.Body == nil {
+		return resp
+	}
+	encodings := contentEncodings(resp.Header)
+	for _, enc := range encodings {
+		if !acceptsEncoding(ctx.acceptEncoding(), enc) {
+			if err := DecodeContent(resp); err != nil {
+				ctx.Warnf("Cannot decode %v response for the client: %v", encodings, err)
+				return resp
+			}
+			encodings = nil
+			break
+		}
+	}
+	if len(encodings) > 0 || !policy.CompressResponses || !acceptsEncoding(ctx.acceptEncoding(), "gzip") ||
+		!policy.compressible(resp) || ctx.streaming && mediaTypeIn(resp.Header.Get("Content-Type"), eventStreamTypes) ||
+		!policy.budget.allow(policy.CPUBudget) {
+		return resp
+	}
+	body := &gzipBody{src: resp.Body, chunk: make([]byte, 32*1024), budget: &policy.budget}
+	body.zw, _ = gzip.NewWriterLevel(&body.buf, gzip.DefaultCompression)
+	resp.Body = body
+	resp.Header.Set("Content-Encoding", "gzip")
+	resp.Header.Del("Content-Length")
+	resp.Header.Add("Vary", "Accept-Encoding")
+	resp.ContentLength = -1
+	return resp
+}
@@ -0,0 +1,98 @@
+package goproxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestAcceptsEncoding(t *testing.T) {
+	for _, c := range []struct {
+		header, enc string
+		expected    bool
+	}{
+		{"gzip, deflate", "gzip", true},
+		{"gzip;q=0, *", "gzip", false},
+		{"*", "br", true},
+		{"deflate", "gzip", false},
+		{"", "identity", true},
+	} {
+		if got := acceptsEncoding(c.header, c.enc); got != c.expected {
+			t.Errorf("acceptsEncoding(%q, %q) = %v", c.header, c.enc, got)
+		}
+	}
+}
+
+func TestEncodeForClient(t *testing.T) {
+	text := strings.Repeat("bobo ", 1000)
+	newResp := func(body []byte, encoding string) *http.Response {
+		resp := &http.Response{StatusCode: 200, Header: http.Header{}, ContentLength: int64(len(body)),
+			Body: ioutil.NopCloser(bytes.NewReader(body))}
+		resp.Header.Set("Content-Type", "text/plain")
+		if encoding != "" {
+			resp.Header.Set("Content-Encoding", encoding)
+		}
+		return resp
+	}
+	policy := &EncodingPolicy{CompressResponses: true}
+
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp := (&ProxyCtx{Req: req, EncodingPolicy: policy}).encodeForClient(newResp([]byte(text), ""))
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatal("expected the response to be compressed")
+	}
+	zr, err := gzip.NewReader(resp.Body)
+	orFatal("gzip.NewReader", err, t)
+	if body, _ := ioutil.ReadAll(zr); string(body) != text {
+		t.Error("unexpected decompressed body")
+	}
+
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	zw.Write([]byte(text))
+	zw.Close()
+	req.Header.Del("Accept-Encoding")
+	resp = (&ProxyCtx{Req: req, EncodingPolicy: policy}).encodeForClient(newResp(compressed.Bytes(), "gzip"))
+	if body, _ := ioutil.ReadAll(resp.Body); resp.Header.Get("Content-Encoding") != "" || string(body) != text {
+		t.Errorf("expected the response to be decoded for the client, got %q", resp.Header.Get("Content-Encoding"))
+	}
+}
+
+func TestDecodeContentStack(t *testing.T) {
+	text := strings.Repeat("bobo ", 1000)
+	var br, gz, zst bytes.Buffer
+	bw := brotli.NewWriter(&br)
+	bw.Write([]byte(text))
+	bw.Close()
+	zw := gzip.NewWriter(&gz)
+	zw.Write(br.Bytes())
+	zw.Close()
+	sw, err := zstd.NewWriter(&zst)
+	orFatal("zstd.NewWriter", err, t)
+	sw.Write(gz.Bytes())
+	sw.Close()
+
+	resp := &http.Response{StatusCode: 200, Header: http.Header{}, ContentLength: int64(zst.Len()),
+		Body: ioutil.NopCloser(&zst)}
+	resp.Header.Set("Content-Encoding", "br, gzip")
+	resp.Header.Add("Content-Encoding", "zstd")
+	orFatal("DecodeContent", DecodeContent(resp), t)
+	body, err := ioutil.ReadAll(resp.Body)
+	orFatal("ReadAll", err, t)
+	if string(body) != text || resp.Header.Get("Content-Encoding") != "" || resp.ContentLength != -1 {
+		t.Error("unexpected decoded response")
+	}
+	orFatal("Close", resp.Body.Close(), t)
+
+	resp.Header.Set("Content-Encoding", "compress")
+	if err := DecodeContent(resp); err == nil {
+		t.Error("expected an error for an unsupported encoding")
+	}
+}
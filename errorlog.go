@@ -0,0 +1,98 @@
+package goproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Levels of the entries of an ErrorLog
+const (
+	LevelWarning = "warning"
+	LevelError   = "error"
+)
+
+// ErrorLogEntry is a warning or an error logged for a request, see ProxyCtx.Warnf and
+// ProxyCtx.Errorf
+type ErrorLogEntry struct {
+	Time      time.Time `json:"time"`
+	Level     string    `json:"level"`
+	Session   int64     `json:"session"`
+	RequestID string    `json:"request_id,omitempty"`
+	Host      string    `json:"host,omitempty"`
+	Message   string    `json:"message"`
+}
+
+// ErrorLog keeps the last warnings and errors of the requests in memory, so that transient
+// issues can be inspected after the fact through the admin API or the support bundles
+type ErrorLog struct {
+	// Size is the number of entries kept, 256 if zero
+	Size int
+
+	mu   sync.Mutex
+	ring []ErrorLogEntry
+	next int
+}
+
+func (l *ErrorLog) size() int {
+	if l.Size > 0 {
+		return l.Size
+	}
+	return 256
+}
+
+// Add adds e to the log, replacing the oldest entry if it is full
+func (l *ErrorLog) Add(e ErrorLogEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.ring) < l.size() {
+		l.ring = append(l.ring, e)
+		return
+	}
+	l.ring[l.next] = e
+	l.next = (l.next + 1) % len(l.ring)
+}
+
+// Entries returns the entries of the log, oldest first
+func (l *ErrorLog) Entries() []ErrorLogEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entries := make([]ErrorLogEntry, 0, len(l.ring))
+	entries = append(entries, l.ring[l.next:]...)
+	return append(entries, l.ring[:l.next]...)
+}
+
+// logEntry adds the message msg of ctx to the ErrorLog of the proxy, if any
+func (ctx *ProxyCtx) logEntry(level, msg string) {
+	if ctx.Proxy == nil || ctx.Proxy.ErrorLog == nil {
+		return
+	}
+	e := ErrorLogEntry{Time: time.Now(), Level: level, Session: ctx.Session, RequestID: ctx.LogRequestID, Message: msg}
+	if ctx.Req != nil && ctx.Req.URL != nil {
+		e.Host = ctx.Req.URL.Host
+	}
+	ctx.Proxy.ErrorLog.Add(e)
+}
+
+func (proxy *ProxyHttpServer) serveErrorLog(w http.ResponseWriter, r *http.Request) {
+	if proxy.ErrorLog == nil {
+		http.Error(w, "the error log is not enabled", http.StatusNotFound)
+		return
+	}
+	q := r.URL.Query()
+	level := q.Get("level")
+	session, _ := strconv.ParseInt(q.Get("session"), 10, 64)
+	entries := []ErrorLogEntry{}
+	for _, e := range proxy.ErrorLog.Entries() {
+		if (level == "" || e.Level == level) && (session == 0 || e.Session == session) {
+			entries = append(entries, e)
+		}
+	}
+	if limit, err := strconv.Atoi(q.Get("limit")); err == nil && limit >= 0 && limit < len(entries) {
+		entries = entries[len(entries)-limit:]
+	}
+	w.Header().Set("Content-Type", ContentTypeJSON)
+	json.NewEncoder(w).Encode(entries)
+}
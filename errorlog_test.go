@@ -0,0 +1,52 @@
+package goproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestErrorLogRing(t *testing.T) {
+	l := &ErrorLog{Size: 3}
+	for i := 0; i < 5; i++ {
+		l.Add(ErrorLogEntry{Level: LevelWarning, Message: fmt.Sprint(i)})
+	}
+	entries := l.Entries()
+	if len(entries) != 3 || entries[0].Message != "2" || entries[2].Message != "4" {
+		t.Errorf("unexpected entries %+v", entries)
+	}
+}
+
+func TestErrorLogRecordsFailures(t *testing.T) {
+	proxy := NewProxyHttpServer()
+	proxy.OnRequest().DoFunc(func(r *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response) {
+		ctx.Warnf("about to fail")
+		return r, nil
+	})
+	srv := httptest.NewServer(proxy)
+	defer srv.Close()
+	proxyURL, _ := url.Parse(srv.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	resp, err := client.Get("http://127.0.0.1:1/")
+	orFatal("Get", err, t)
+	resp.Body.Close()
+
+	entries := proxy.ErrorLog.Entries()
+	if len(entries) != 2 || entries[0].Level != LevelWarning || entries[1].Level != LevelError ||
+		entries[0].Session != entries[1].Session || entries[1].Host != "127.0.0.1:1" ||
+		!strings.HasPrefix(entries[1].Message, "error read response 127.0.0.1:1") {
+		t.Fatalf("unexpected entries %+v", entries)
+	}
+
+	rec := httptest.NewRecorder()
+	proxy.AdminHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/errors?level=error", nil))
+	var served []ErrorLogEntry
+	orFatal("Unmarshal", json.Unmarshal(rec.Body.Bytes(), &served), t)
+	if len(served) != 1 || served[0].Message != entries[1].Message {
+		t.Errorf("unexpected errors served %s", rec.Body)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// goproxy-selftest serves a proxy, or with the selftest subcommand runs the pipeline of the
+// same proxy for a URL and reports every step, or with the validate subcommand reports the
+// problems of its configuration, e.g.
+//
+//	goproxy-selftest selftest -timeout 10s https://example.com/
+//	goproxy-selftest validate -json
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "selftest" {
+		selftest(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		validate(os.Args[2:])
+		return
+	}
+	verbose := flag.Bool("v", false, "should every proxy request be logged to stdout")
+	addr := flag.String("addr", ":8080", "proxy listen address")
+	flag.Parse()
+	proxy := newProxy()
+	proxy.Verbose = *verbose
+	log.Fatal(http.ListenAndServe(*addr, proxy))
+}
+
+// newProxy sets up the proxy, its handlers are the ones self-tested
+func newProxy() *goproxy.ProxyHttpServer {
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().DoFunc(func(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		ctx.Resolver = goproxy.SystemResolver{}
+		return r, nil
+	})
+	proxy.OnRequest().HandleConnectFunc(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		ctx.Resolver = goproxy.SystemResolver{}
+		return nil, host
+	})
+	return proxy
+}
+
+func selftest(args []string) {
+	flags := flag.NewFlagSet("selftest", flag.ExitOnError)
+	timeout := flags.Duration("timeout", 30*time.Second, "bound of the whole self-test")
+	asJSON := flags.Bool("json", false, "print the report in JSON")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: goproxy-selftest selftest [-timeout d] [-json] URL")
+		os.Exit(2)
+	}
+	c, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	report := newProxy().SelfTest(c, flags.Arg(0), nil)
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(report)
+	} else {
+		fmt.Print(report)
+	}
+	if !report.OK {
+		os.Exit(1)
+	}
+}
+
+// validate exits with 1 when the configuration of the proxy has errors, e.g. to check a
+// deployment before serving it
+func validate(args []string) {
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "print the diagnostics in JSON")
+	flags.Parse(args)
+	ds := newProxy().Validate()
+	if *asJSON {
+		if ds == nil {
+			ds = goproxy.Diagnostics{}
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(ds)
+	} else if len(ds) > 0 {
+		fmt.Println(ds)
+	}
+	if ds.HasErrors() {
+		os.Exit(1)
+	}
+}
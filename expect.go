@@ -0,0 +1,100 @@
+package goproxy
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// expectContinueTimeout is how long the body of a request expecting 100-continue waits for
+// the 100 Continue of the server before it is sent anyway, like the ExpectContinueTimeout of
+// the transports
+const expectContinueTimeout = time.Second
+
+// errContinueRefused is the error of the bodies of the requests expecting 100-continue that the
+// server answered with a final response, which are not sent
+var errContinueRefused = errors.New("server answered without 100 Continue, body not sent")
+
+// refused reports whether the body of the request written with body was not sent because the
+// server answered with a final response, once the request is written
+func refused(body io.Reader) bool {
+	b, ok := body.(*continueBody)
+	return ok && b.refused
+}
+
+// expectsContinue reports whether req waits for 100 Continue before sending its body
+func expectsContinue(req *http.Request) bool {
+	return req.Body != nil && req.Body != http.NoBody && req.ContentLength != 0 &&
+		strings.EqualFold(req.Header.Get("Expect"), "100-continue")
+}
+
+// continueBody is the body of a request expecting 100-continue, sent upstream: its first read
+// flushes the headers of the request and waits for the answer of the server on proceed, true
+// for 100 Continue and false for a final response, or for expectContinueTimeout
+type continueBody struct {
+	io.ReadCloser
+	flush   func() error
+	proceed <-chan bool
+	started bool
+	refused bool
+}
+
+func (b *continueBody) Read(p []byte) (int, error) {
+	if !b.started {
+		b.started = true
+		if err := b.flush(); err != nil {
+			return 0, err
+		}
+		t := time.NewTimer(expectContinueTimeout)
+		defer t.Stop()
+		select {
+		case ok := <-b.proceed:
+			if !ok {
+				b.refused = true
+				return 0, errContinueRefused
+			}
+		case <-t.C:
+		}
+	}
+	return b.ReadCloser.Read(p)
+}
+
+// continueSender is the body of a request expecting 100-continue, read from its client: its
+// first read answers 100 Continue to the client, so that it sends the body
+type continueSender struct {
+	io.ReadCloser
+	client  io.Writer
+	started bool
+}
+
+func (b *continueSender) Read(p []byte) (int, error) {
+	if !b.started {
+		b.started = true
+		if _, err := io.WriteString(b.client, "HTTP/1.1 100 Continue\r\n\r\n"); err != nil {
+			return 0, err
+		}
+	}
+	return b.ReadCloser.Read(p)
+}
+
+// readFinalResponse reads the response to req from r, skipping the interim responses but 101
+// Switching Protocols. continued, if set, is called with true on 100 Continue, and with false
+// once the final response is read or failed.
+func readFinalResponse(r *bufio.Reader, req *http.Request, continued func(bool)) (*http.Response, error) {
+	for {
+		resp, err := http.ReadResponse(r, req)
+		if err == nil && resp.StatusCode >= 100 && resp.StatusCode < 200 && resp.StatusCode != http.StatusSwitchingProtocols {
+			if resp.StatusCode == http.StatusContinue && continued != nil {
+				continued(true)
+			}
+			continue
+		}
+		if continued != nil {
+			continued(false)
+		}
+		return resp, err
+	}
+}
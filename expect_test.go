@@ -0,0 +1,65 @@
+package goproxy
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+type readFlag struct {
+	io.Reader
+	read bool
+}
+
+func (r *readFlag) Read(p []byte) (int, error) {
+	r.read = true
+	return r.Reader.Read(p)
+}
+
+func TestExpectContinue(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/forbidden" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		io.Copy(w, r.Body)
+	}))
+	defer backend.Close()
+
+	proxy := NewProxyHttpServer()
+	proxy.OnRequest().DoFunc(func(r *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response) { return r, nil })
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+	proxyURL, _ := url.Parse(s.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL), ExpectContinueTimeout: 5 * time.Second}}
+
+	for path, expected := range map[string]int{"/upload": http.StatusOK, "/forbidden": http.StatusForbidden} {
+		body := &readFlag{Reader: strings.NewReader("payload")}
+		req, err := http.NewRequest("POST", backend.URL+path, body)
+		orFatal("NewRequest", err, t)
+		req.ContentLength = int64(len("payload"))
+		req.Header.Set("Expect", "100-continue")
+		start := time.Now()
+		resp, err := client.Do(req)
+		orFatal("Do", err, t)
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != expected {
+			t.Errorf("%s: expected %d, got %d", path, expected, resp.StatusCode)
+		}
+		if time.Since(start) > 2*time.Second {
+			t.Errorf("%s: the request stalled for %v", path, time.Since(start))
+		}
+		if expected == http.StatusOK && string(b) != "payload" {
+			t.Errorf("%s: unexpected body %q", path, b)
+		}
+		if expected != http.StatusOK && body.read {
+			t.Errorf("%s: the body was sent although the server refused it", path)
+		}
+	}
+}
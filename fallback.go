@@ -0,0 +1,90 @@
+package goproxy
+
+import (
+	"crypto/tls"
+	"strconv"
+)
+
+// FallbackUpstream is a forward proxy tried when the connection through the previous ones
+// failed. Its zero fields keep the settings of the previous attempt.
+type FallbackUpstream struct {
+	// ForwardProxy is the host:port of the forward proxy
+	ForwardProxy string
+	// Proto is "http" or "https" for HTTP forward proxies, "socks5" or "socks5h" for SOCKS5
+	// proxies, the latter resolving the destinations themselves
+	Proto string
+	// Auth is the base64 encoded user:password sent to the forward proxy
+	Auth       string
+	Accounting string
+	// DialTimeout and TLSTimeout are in seconds, like ProxyCtx.ForwardProxyDialTimeout and
+	// ProxyCtx.ForwardProxyTLSTimeout
+	DialTimeout int
+	TLSTimeout  int
+	// TLSConfig is the ProxyCtx.ForwardProxyTLSConfig of the forward proxy
+	TLSConfig *tls.Config
+}
+
+// fallbackFromLegacy turns the ForwardProxyErrorFallback closure of ctx, if any, into a chain of
+// a single upstream. The second value the closure returns is the auth of the forward proxy if
+// ForwardProxyErrorFallbackAuth is set, its accounting otherwise.
+func (ctx *ProxyCtx) fallbackFromLegacy() {
+	if ctx.ForwardProxyErrorFallback == nil {
+		return
+	}
+	forwardProxy, extra := ctx.ForwardProxyErrorFallback()
+	ctx.ForwardProxyErrorFallback = nil
+	if forwardProxy == "" {
+		return
+	}
+	upstream := FallbackUpstream{ForwardProxy: forwardProxy}
+	if ctx.ForwardProxyErrorFallbackAuth {
+		upstream.Auth = extra
+	} else {
+		upstream.Accounting = extra
+	}
+	ctx.FallbackChain = append([]FallbackUpstream{upstream}, ctx.FallbackChain...)
+}
+
+// nextFallback switches ctx to the next upstream of its FallbackChain after the failure err of
+// the current one, and reports whether there was one
+func (ctx *ProxyCtx) nextFallback(err error) bool {
+	if len(ctx.FallbackChain) == 0 {
+		return false
+	}
+	upstream := ctx.FallbackChain[0]
+	ctx.FallbackChain = ctx.FallbackChain[1:]
+	ctx.fallbackAttempts++
+	ctx.Warnf("forward proxy %s failed: %v, falling back to %s (attempt %d)",
+		ctx.ForwardProxy, err, upstream.ForwardProxy, ctx.fallbackAttempts)
+	if ctx.Proxy != nil && ctx.Proxy.FallbackMetric != nil {
+		ctx.Proxy.FallbackMetric.WithLabelValues(strconv.Itoa(ctx.fallbackAttempts)).Inc()
+	}
+	e := NewEvent(EventUpstreamDown, ctx.ForwardProxy, err.Error())
+	e.Fields = map[string]string{"fallback": upstream.ForwardProxy}
+	ctx.Proxy.notify(e)
+	ctx.useUpstream(upstream)
+	return true
+}
+
+// useUpstream switches ctx to upstream
+func (ctx *ProxyCtx) useUpstream(upstream FallbackUpstream) {
+	ctx.ForwardProxy = upstream.ForwardProxy
+	if upstream.Proto != "" {
+		ctx.ForwardProxyProto = upstream.Proto
+	}
+	if upstream.Auth != "" {
+		ctx.ForwardProxyAuth = upstream.Auth
+	}
+	if upstream.Accounting != "" {
+		ctx.Accounting = upstream.Accounting
+	}
+	if upstream.DialTimeout > 0 {
+		ctx.ForwardProxyDialTimeout = upstream.DialTimeout
+	}
+	if upstream.TLSTimeout > 0 {
+		ctx.ForwardProxyTLSTimeout = upstream.TLSTimeout
+	}
+	if upstream.TLSConfig != nil {
+		ctx.ForwardProxyTLSConfig = upstream.TLSConfig
+	}
+}
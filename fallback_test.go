@@ -0,0 +1,66 @@
+package goproxy
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFallbackChainLegacy(t *testing.T) {
+	ctx := &ProxyCtx{Proxy: NewProxyHttpServer(), ForwardProxy: "a:80", ForwardProxyAuth: "auth-a",
+		ForwardProxyErrorFallback: func() (string, string) { return "b:80", "acct-b" },
+		FallbackChain:             []FallbackUpstream{{ForwardProxy: "c:443", Proto: "https", Auth: "auth-c", DialTimeout: 3}}}
+	ctx.fallbackFromLegacy()
+	if ctx.ForwardProxyErrorFallback != nil || len(ctx.FallbackChain) != 2 {
+		t.Fatalf("expected the fallback closure to be turned into an upstream, got %+v", ctx.FallbackChain)
+	}
+	if !ctx.nextFallback(errors.New("refused")) || ctx.ForwardProxy != "b:80" || ctx.Accounting != "acct-b" || ctx.ForwardProxyAuth != "auth-a" {
+		t.Errorf("unexpected first fallback %s %s %s", ctx.ForwardProxy, ctx.Accounting, ctx.ForwardProxyAuth)
+	}
+	if !ctx.nextFallback(errors.New("refused")) || ctx.ForwardProxy != "c:443" || ctx.ForwardProxyProto != "https" ||
+		ctx.ForwardProxyAuth != "auth-c" || ctx.ForwardProxyDialTimeout != 3 {
+		t.Errorf("unexpected second fallback %+v", ctx)
+	}
+	if ctx.nextFallback(errors.New("refused")) {
+		t.Error("expected the chain to be exhausted")
+	}
+}
+
+func TestFallbackChainConnect(t *testing.T) {
+	target := httptest.NewServer(ConstantHanlder("bobo"))
+	defer target.Close()
+	upstream := httptest.NewServer(NewProxyHttpServer())
+	defer upstream.Close()
+	// a port nothing listens on
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	orFatal("Listen", err, t)
+	dead := l.Addr().String()
+	l.Close()
+
+	proxy := NewProxyHttpServer()
+	proxy.OnRequest().HandleConnectFunc(func(host string, ctx *ProxyCtx) (*ConnectAction, string) {
+		ctx.ForwardProxy = dead
+		ctx.ForwardProxyDialTimeout = 5
+		ctx.ForwardProxyDirectSendOK = true
+		ctx.FallbackChain = []FallbackUpstream{{ForwardProxy: upstream.Listener.Addr().String()}}
+		return OkConnect, host
+	})
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", s.Listener.Addr().String())
+	orFatal("Dial", err, t)
+	defer conn.Close()
+	host := target.Listener.Addr().String()
+	_, err = conn.Write([]byte("CONNECT " + host + " HTTP/1.1\r\nHost: " + host + "\r\n\r\n"))
+	orFatal("Write", err, t)
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, &http.Request{Method: "CONNECT"})
+	orFatal("ReadResponse(CONNECT)", err, t)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the CONNECT to succeed through the fallback, got %s", resp.Status)
+	}
+}
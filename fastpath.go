@@ -0,0 +1,164 @@
+package goproxy
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// copyBufferSize is the size of the buffers relaying the bodies and the tunnels
+const copyBufferSize = 32 * 1024
+
+// copyBuffers pools the buffers of copyBufferSize bytes
+var copyBuffers = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, copyBufferSize)
+		return &buf
+	},
+}
+
+// fastPath reports whether the requests can be relayed without running the pipeline of the
+// proxy: FastPath is set, no handler is registered and no feature needs to see the requests
+func (proxy *ProxyHttpServer) fastPath() bool {
+	return proxy.FastPath && len(proxy.reqHandlers) == 0 && len(proxy.respHandlers) == 0 &&
+		len(proxy.httpsHandlers) == 0 && len(proxy.respHeadersHandlers) == 0 && len(proxy.webSocketHandlers) == 0 &&
+		proxy.Cache == nil && !proxy.CoalesceRequests && proxy.Prefetcher == nil &&
+		proxy.EncodingPolicy == nil && proxy.UserAgentPolicy == nil && proxy.HeaderLimits == nil &&
+		proxy.RedirectPolicy == nil && proxy.LocalDestinations == nil && proxy.InternalEndpoints == nil &&
+		proxy.Tracing == nil && proxy.Profiling == nil && proxy.StrictEgress == nil &&
+		proxy.ResponseAnnotations == nil && proxy.DrainFlags == nil && proxy.SLO == nil &&
+		(proxy.TunnelEngine == "" || proxy.TunnelEngine == TunnelEngineGoroutines) &&
+		proxy.WriteCoalescing == nil && proxy.AdaptiveBuffers == nil && proxy.DialBudget == nil
+}
+
+// accounts reports whether the traffic of the requests is accounted
+func (proxy *ProxyHttpServer) accounts() bool {
+	return proxy.BandwidthReport != nil || proxy.OnAccounting != nil || proxy.TagMetrics != nil
+}
+
+// removeHopHeaders removes the headers of r meant for the proxy, like removeProxyHeaders, but
+// keeps Accept-Encoding so that the bodies are relayed as they are
+func removeHopHeaders(r *http.Request) {
+	r.RequestURI = ""
+	delete(r.Header, "Proxy-Connection")
+	delete(r.Header, "Proxy-Authenticate")
+	delete(r.Header, "Proxy-Authorization")
+	delete(r.Header, "Connection")
+}
+
+// serveFastPath relays the plain HTTP request r through the transport of the proxy
+func (proxy *ProxyHttpServer) serveFastPath(w http.ResponseWriter, r *http.Request) {
+	var rt http.RoundTripper = http.DefaultTransport
+	if proxy.Tr != nil {
+		rt = proxy.Tr
+	}
+	proxy.relay(w, r, rt)
+}
+
+// relay relays r through rt, with no per-request allocation besides the ones of rt and of
+// the server of w
+func (proxy *ProxyHttpServer) relay(w http.ResponseWriter, r *http.Request, rt http.RoundTripper) {
+	ctx := proxy.acquireCtx(r, true)
+	defer ctx.release()
+	removeHopHeaders(r)
+	resp, err := rt.RoundTrip(proxy.ConnRecycling.request(r))
+	if err != nil {
+		ctx.Errorf("error read response %s : %v", r.URL.Host, err)
+		ctx.connFailed(r.URL.Host, rt)
+		if proxy.ErrorPages.Enabled() {
+			proxy.ErrorPages.WriteErrorPage(err, r.URL.Host, w)
+		} else {
+			http.Error(w, err.Error(), 500)
+		}
+		return
+	}
+	h := w.Header()
+	if !proxy.KeepDestinationHeaders {
+		for k := range h {
+			delete(h, k)
+		}
+	}
+	for k, vs := range resp.Header {
+		h[k] = vs
+	}
+	announceTrailers(h, resp)
+	ctx.markFirstByte()
+	w.WriteHeader(resp.StatusCode)
+	buf := copyBuffers.Get().(*[]byte)
+	n, _ := io.CopyBuffer(w, resp.Body, *buf)
+	copyBuffers.Put(buf)
+	copyTrailers(h, resp)
+	ctx.markResponseDone()
+	resp.Body.Close()
+	if proxy.accounts() {
+		if r.ContentLength > 0 {
+			ctx.BytesSent = r.ContentLength
+		}
+		ctx.BytesReceived = n
+		proxy.account(ctx)
+	}
+}
+
+// relayTunnel relays the CONNECT request r to its destination, without running the pipeline
+// of the proxy. client is the connection of the client if it was already hijacked.
+func (proxy *ProxyHttpServer) relayTunnel(w http.ResponseWriter, r *http.Request, client net.Conn) {
+	ctx := proxy.acquireCtx(r, true)
+	defer ctx.release()
+	if client == nil {
+		hij, ok := w.(http.Hijacker)
+		if !ok {
+			panic("httpserver does not support hijacking")
+		}
+		conn, brw, err := hij.Hijack()
+		if err != nil {
+			panic("Cannot hijack connection " + err.Error())
+		}
+		client = hijackedConn(conn, brw)
+	}
+	host := proxy.target(r)
+	defer proxy.trackSession(ctx, SessionTunnel, host)()
+	target, err := proxy.connectDial("tcp", host)
+	if err != nil {
+		ctx.Errorf("CONNECT to %s failed: %v", host, err)
+		ctx.connFailed(host, nil)
+		httpError(client, ctx, err)
+		return
+	}
+	if err := proxy.writeConnectEstablished(ctx, client); err != nil {
+		client.Close()
+		target.Close()
+		return
+	}
+	proxy.setSessionCloser(ctx, func() {
+		client.Close()
+		target.Close()
+	})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		ctx.BytesSent = relayHalf(target, client)
+		wg.Done()
+	}()
+	ctx.BytesReceived = relayHalf(client, target)
+	wg.Wait()
+	client.Close()
+	target.Close()
+	if proxy.accounts() {
+		proxy.account(ctx)
+	}
+}
+
+// relayHalf copies src to dst with a pooled buffer until src is done, then closes the write
+// side of dst, or dst entirely if it can't be half closed. It returns the bytes copied.
+func relayHalf(dst, src net.Conn) int64 {
+	buf := copyBuffers.Get().(*[]byte)
+	n, _ := io.CopyBuffer(dst, src, *buf)
+	copyBuffers.Put(buf)
+	if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	} else {
+		dst.Close()
+	}
+	return n
+}
@@ -0,0 +1,181 @@
+package goproxy
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// stubRoundTripper answers every request with the same response, without allocating
+type stubRoundTripper struct {
+	resp *http.Response
+	body stubBody
+	data []byte
+}
+
+type stubBody struct {
+	bytes.Reader
+}
+
+func (stubBody) Close() error { return nil }
+
+func (rt *stubRoundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	rt.body.Reset(rt.data)
+	return rt.resp, nil
+}
+
+// discardResponseWriter is a ResponseWriter discarding the responses, without allocating
+type discardResponseWriter struct {
+	header http.Header
+}
+
+func (w *discardResponseWriter) Header() http.Header         { return w.header }
+func (w *discardResponseWriter) Write(p []byte) (int, error) { return len(p), nil }
+func (w *discardResponseWriter) WriteHeader(int)             {}
+
+func newStubRoundTripper() *stubRoundTripper {
+	rt := &stubRoundTripper{data: bytes.Repeat([]byte("x"), 64*1024)}
+	rt.resp = &http.Response{StatusCode: 200, Header: http.Header{"Content-Type": {"text/plain"}}, Body: &rt.body}
+	return rt
+}
+
+func TestFastPathAllocations(t *testing.T) {
+	proxy := NewProxyHttpServer()
+	proxy.FastPath = true
+	rt := newStubRoundTripper()
+	w := &discardResponseWriter{header: make(http.Header)}
+	r, _ := http.NewRequest("GET", "http://example.com/", nil)
+	if allocs := testing.AllocsPerRun(100, func() { proxy.relay(w, r, rt) }); allocs > 0 {
+		t.Errorf("the fast path allocates %v times per request", allocs)
+	}
+	proxy.BandwidthReport = &BandwidthReport{}
+	proxy.BandwidthReport.Add("example.com", 0, 0)
+	// the lookup of the registrable domain of the destination allocates
+	if allocs := testing.AllocsPerRun(100, func() { proxy.relay(w, r, rt) }); allocs > 2 {
+		t.Errorf("the accounted fast path allocates %v times per request", allocs)
+	}
+}
+
+func BenchmarkFastPath(b *testing.B) {
+	proxy := NewProxyHttpServer()
+	proxy.FastPath = true
+	rt := newStubRoundTripper()
+	w := &discardResponseWriter{header: make(http.Header)}
+	r, _ := http.NewRequest("GET", "http://example.com/", nil)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(rt.data)))
+	for i := 0; i < b.N; i++ {
+		proxy.relay(w, r, rt)
+	}
+}
+
+func TestFastPath(t *testing.T) {
+	background := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Proxy-Connection") != "" {
+			t.Errorf("proxy header forwarded: %v", r.Header)
+		}
+		w.Header().Set("Content-Encoding", r.Header.Get("Accept-Encoding"))
+		io.WriteString(w, "relayed")
+	}))
+	defer background.Close()
+	proxy := NewProxyHttpServer()
+	proxy.FastPath = true
+	proxy.BandwidthReport = &BandwidthReport{}
+	srv := httptest.NewServer(proxy)
+	defer srv.Close()
+	proxyURL, _ := url.Parse(srv.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	req, _ := http.NewRequest("GET", background.URL, nil)
+	req.Header.Set("Accept-Encoding", "x-test")
+	resp, err := client.Do(req)
+	orFatal("Do", err, t)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "relayed" || resp.Header.Get("Content-Encoding") != "x-test" {
+		t.Errorf("unexpected response %v %q", resp.Header, body)
+	}
+	if top := proxy.BandwidthReport.TopTalkers(1); len(top) != 1 || top[0].BytesReceived != int64(len("relayed")) {
+		t.Errorf("unexpected bandwidth %+v", top)
+	}
+
+	// CONNECT tunnels are relayed as they are
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	orFatal("Dial", err, t)
+	defer conn.Close()
+	host := background.Listener.Addr().String()
+	io.WriteString(conn, "CONNECT "+host+" HTTP/1.1\r\nHost: "+host+"\r\n\r\n")
+	br := bufio.NewReader(conn)
+	resp, err = http.ReadResponse(br, nil)
+	orFatal("ReadResponse", err, t)
+	if resp.StatusCode != 200 {
+		t.Fatalf("unexpected CONNECT response %s", resp.Status)
+	}
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: "+host+"\r\nConnection: close\r\n\r\n")
+	resp, err = http.ReadResponse(br, nil)
+	orFatal("ReadResponse", err, t)
+	body, _ = ioutil.ReadAll(resp.Body)
+	if string(body) != "relayed" {
+		t.Errorf("unexpected response through the tunnel %q", body)
+	}
+
+	// registering a handler disables the fast path
+	proxy.OnRequest().DoFunc(func(r *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response) {
+		return r, NewResponse(r, ContentTypeText, http.StatusTeapot, "handled")
+	})
+	resp, err = client.Get(background.URL)
+	orFatal("Get", err, t)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTeapot {
+		t.Errorf("the handler did not run: %s", resp.Status)
+	}
+}
+
+func TestFastPathDisabledByTunnelFeatures(t *testing.T) {
+	for name, set := range map[string]func(proxy *ProxyHttpServer){
+		"TunnelEngine":    func(proxy *ProxyHttpServer) { proxy.TunnelEngine = TunnelEngineEpoll },
+		"WriteCoalescing": func(proxy *ProxyHttpServer) { proxy.WriteCoalescing = &WriteCoalescing{Nagle: true} },
+		"AdaptiveBuffers": func(proxy *ProxyHttpServer) { proxy.AdaptiveBuffers = &AdaptiveBuffers{} },
+		"DialBudget":      func(proxy *ProxyHttpServer) { proxy.DialBudget = &DialBudget{} },
+	} {
+		proxy := NewProxyHttpServer()
+		proxy.FastPath = true
+		set(proxy)
+		if proxy.fastPath() {
+			t.Errorf("%s: expected the fast path to be disabled", name)
+		}
+	}
+
+	// the tunnels are still relayed, by the regular path
+	background := httptest.NewServer(ConstantHanlder("relayed"))
+	defer background.Close()
+	proxy := NewProxyHttpServer()
+	proxy.FastPath = true
+	proxy.WriteCoalescing = &WriteCoalescing{Nagle: true}
+	srv := httptest.NewServer(proxy)
+	defer srv.Close()
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	orFatal("Dial", err, t)
+	defer conn.Close()
+	host := background.Listener.Addr().String()
+	io.WriteString(conn, "CONNECT "+host+" HTTP/1.1\r\nHost: "+host+"\r\n\r\n")
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	orFatal("ReadResponse", err, t)
+	if resp.StatusCode != 200 {
+		t.Fatalf("unexpected CONNECT response %s", resp.Status)
+	}
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: "+host+"\r\nConnection: close\r\n\r\n")
+	resp, err = http.ReadResponse(br, nil)
+	orFatal("ReadResponse", err, t)
+	body, _ := ioutil.ReadAll(resp.Body)
+	if string(body) != "relayed" {
+		t.Errorf("unexpected response through the tunnel %q", body)
+	}
+}
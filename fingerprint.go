@@ -0,0 +1,75 @@
+package goproxy
+
+import (
+	"net/http"
+	"strings"
+)
+
+// FingerprintPolicy reduces the information the requests give away to fingerprint and track
+// their users. It is applied to the requests handled by ReduceFingerprint, so that it can be
+// enabled for some user groups only:
+//
+//	proxy.OnRequest(goproxy.TenantIs("private")).Do(goproxy.ReduceFingerprint(&goproxy.FingerprintPolicy{
+//		StripClientHints: true, StripDNT: true, StripETags: true, CachePartition: "private"}))
+type FingerprintPolicy struct {
+	// StripClientHints removes the Sec-CH-* client hints from the requests, and the Accept-CH
+	// and Critical-CH headers asking for them from the responses
+	StripClientHints bool
+	// StripDNT removes the DNT and Sec-GPC headers, which set apart the users sending them
+	StripDNT bool
+	// AcceptLanguage, if set, replaces the Accept-Language of the requests
+	AcceptLanguage string
+	// StripETags removes the ETag validators from the responses and the requests, so that
+	// they can't be used as identifiers
+	StripETags bool
+	// CachePartition, if set, separates the responses cached by the proxy for these requests
+	// from the others, see ProxyCtx.CachePartition
+	CachePartition string
+}
+
+// ReduceFingerprint returns a ReqHandler applying policy to the requests it handles and to
+// their responses
+func ReduceFingerprint(policy *FingerprintPolicy) ReqHandler {
+	return FuncReqHandler(func(r *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response) {
+		ctx.FingerprintPolicy = policy
+		if policy.StripClientHints {
+			for h := range r.Header {
+				if strings.HasPrefix(h, "Sec-Ch-") {
+					r.Header.Del(h)
+				}
+			}
+		}
+		if policy.StripDNT {
+			r.Header.Del("Dnt")
+			r.Header.Del("Sec-Gpc")
+		}
+		if policy.AcceptLanguage != "" {
+			r.Header.Set("Accept-Language", policy.AcceptLanguage)
+		}
+		if policy.StripETags {
+			r.Header.Del("If-None-Match")
+			if strings.HasPrefix(r.Header.Get("If-Range"), `"`) {
+				r.Header.Del("If-Range")
+			}
+		}
+		if policy.CachePartition != "" {
+			ctx.CachePartition = policy.CachePartition
+		}
+		return r, nil
+	})
+}
+
+// reduceResponseFingerprint applies the FingerprintPolicy of ctx to resp
+func (ctx *ProxyCtx) reduceResponseFingerprint(resp *http.Response) {
+	policy := ctx.FingerprintPolicy
+	if policy == nil || resp == nil {
+		return
+	}
+	if policy.StripClientHints {
+		resp.Header.Del("Accept-Ch")
+		resp.Header.Del("Critical-Ch")
+	}
+	if policy.StripETags {
+		resp.Header.Del("Etag")
+	}
+}
@@ -0,0 +1,46 @@
+package goproxy
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestReduceFingerprint(t *testing.T) {
+	proxy := NewProxyHttpServer()
+	proxy.OnRequest(ReqHostIs("private.example.com")).Do(ReduceFingerprint(&FingerprintPolicy{
+		StripClientHints: true, StripDNT: true, AcceptLanguage: "en-US", StripETags: true, CachePartition: "private"}))
+
+	req, _ := http.NewRequest("GET", "http://private.example.com/", nil)
+	req.Header.Set("Sec-CH-UA-Platform", `"Linux"`)
+	req.Header.Set("DNT", "1")
+	req.Header.Set("Accept-Language", "fr-CH, fr;q=0.9")
+	req.Header.Set("If-None-Match", `"user-1234"`)
+	ctx := &ProxyCtx{Req: req, Proxy: proxy}
+	req, _ = proxy.filterRequest(req, ctx)
+	for _, h := range []string{"Sec-Ch-Ua-Platform", "Dnt", "If-None-Match"} {
+		if req.Header.Get(h) != "" {
+			t.Errorf("expected %s to be stripped", h)
+		}
+	}
+	if req.Header.Get("Accept-Language") != "en-US" {
+		t.Error("expected Accept-Language to be normalized")
+	}
+	if proxy.cacheKey(ctx, req) == proxy.cacheKey(&ProxyCtx{}, req) {
+		t.Error("expected the cache to be partitioned")
+	}
+
+	resp := &http.Response{StatusCode: 200, Header: http.Header{}, Request: req}
+	resp.Header.Set("Accept-CH", "Sec-CH-UA-Model")
+	resp.Header.Set("ETag", `"user-1234"`)
+	resp = proxy.filterResponse(resp, ctx)
+	if resp.Header.Get("Accept-CH") != "" || resp.Header.Get("ETag") != "" {
+		t.Error("expected the response to be stripped")
+	}
+
+	other, _ := http.NewRequest("GET", "http://example.com/", nil)
+	other.Header.Set("DNT", "1")
+	other, _ = proxy.filterRequest(other, &ProxyCtx{Req: other, Proxy: proxy})
+	if other.Header.Get("DNT") != "1" {
+		t.Error("expected the other requests to be left alone")
+	}
+}
@@ -0,0 +1,134 @@
+package goproxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/tls"
+	"errors"
+	"fmt"
+)
+
+// Built with the fips tag, the proxy restricts its TLS configurations, to the clients and to
+// the servers, to the FIPS-approved versions, cipher suites and curves, and generates the keys
+// of the MITM certificates with approved algorithms from the approved random source, rather
+// than deterministically from the CA key. The Go cryptographic module must be validated too,
+// which is checked when the package is initialized: build with Go+BoringCrypto
+// (GOEXPERIMENT=boringcrypto), or with Go 1.24 or later and run with GODEBUG=fips140=on.
+// VerifyFIPS checks the rest of the configuration of the proxy.
+
+// fipsCipherSuites are the TLS 1.2 cipher suites approved by FIPS 140, TLS 1.3 only has
+// approved ones in the FIPS Go cryptographic modules
+var fipsCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+}
+
+// fipsCurves are the key exchange curves approved by FIPS 140
+var fipsCurves = []tls.CurveID{tls.CurveP256, tls.CurveP384}
+
+func init() {
+	if FIPSMode {
+		if !fipsModule() {
+			panic("goproxy built for FIPS without a FIPS Go cryptographic module")
+		}
+		restrictTLSConfig(tlsClientSkipVerify)
+		restrictTLSConfig(defaultTLSConfig)
+	}
+}
+
+// restrictTLSConfig restricts config to the FIPS-approved versions, cipher suites and curves
+func restrictTLSConfig(config *tls.Config) {
+	if config.MinVersion < tls.VersionTLS12 {
+		config.MinVersion = tls.VersionTLS12
+	}
+	config.CipherSuites = fipsCipherSuites
+	config.CurvePreferences = fipsCurves
+}
+
+// checkFIPSTLSConfig returns an error if config allows TLS versions, cipher suites or curves
+// not approved by FIPS 140
+func checkFIPSTLSConfig(config *tls.Config) error {
+	if config == nil {
+		return errors.New("default TLS configuration")
+	}
+	if config.MinVersion < tls.VersionTLS12 {
+		return errors.New("TLS versions before 1.2 allowed")
+	}
+	if len(config.CipherSuites) == 0 {
+		return errors.New("default cipher suites")
+	}
+	for _, s := range config.CipherSuites {
+		if !containsUint16(fipsCipherSuites, s) {
+			return fmt.Errorf("cipher suite %s not approved", tls.CipherSuiteName(s))
+		}
+	}
+	if len(config.CurvePreferences) == 0 {
+		return errors.New("default curves")
+	}
+	for _, c := range config.CurvePreferences {
+		if c != tls.CurveP256 && c != tls.CurveP384 {
+			return fmt.Errorf("curve %v not approved", c)
+		}
+	}
+	return nil
+}
+
+func containsUint16(s []uint16, v uint16) bool {
+	for _, e := range s {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
+
+// checkFIPSKey returns an error if the CA key key may not sign certificates under FIPS 140
+func checkFIPSKey(key interface{}) error {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		if k.N.BitLen() < 2048 {
+			return fmt.Errorf("RSA key of %d bits, at least 2048 required", k.N.BitLen())
+		}
+	case *ecdsa.PrivateKey:
+		if k.Curve != elliptic.P256() && k.Curve != elliptic.P384() && k.Curve != elliptic.P521() {
+			return fmt.Errorf("ECDSA key on the unapproved curve %s", k.Curve.Params().Name)
+		}
+	default:
+		return fmt.Errorf("unapproved key type %T", key)
+	}
+	return nil
+}
+
+// VerifyFIPS returns an error if the proxy is not built for FIPS, see FIPSMode, or if its
+// configuration uses algorithms not approved by FIPS 140: the TLS configuration of Tr and the
+// keys of the default and tenant CAs are checked
+func (proxy *ProxyHttpServer) VerifyFIPS() error {
+	if !FIPSMode {
+		return errors.New("not built with the fips tag")
+	}
+	if !fipsModule() {
+		return errors.New("no FIPS Go cryptographic module")
+	}
+	if proxy.Tr != nil {
+		if err := checkFIPSTLSConfig(proxy.Tr.TLSClientConfig); err != nil {
+			return fmt.Errorf("Tr.TLSClientConfig: %v", err)
+		}
+	}
+	if err := checkFIPSKey(GoproxyCa.PrivateKey); err != nil {
+		return fmt.Errorf("GoproxyCa: %v", err)
+	}
+	proxy.tenantsMu.RLock()
+	defer proxy.tenantsMu.RUnlock()
+	for name, t := range proxy.tenants {
+		if t.CA == nil {
+			continue
+		}
+		if err := checkFIPSKey(t.CA.PrivateKey); err != nil {
+			return fmt.Errorf("CA of tenant %s: %v", name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,19 @@
+//go:build fips && boringcrypto
+// +build fips,boringcrypto
+
+package goproxy
+
+import (
+	"crypto/boring"
+	// restricts the TLS configurations of the whole program too
+	_ "crypto/tls/fipsonly"
+)
+
+// FIPSMode is whether the proxy is built with the fips tag, restricting it to the algorithms
+// approved by FIPS 140
+const FIPSMode = true
+
+// fipsModule reports whether the BoringCrypto module is in use
+func fipsModule() bool {
+	return boring.Enabled()
+}
@@ -0,0 +1,12 @@
+//go:build !fips
+// +build !fips
+
+package goproxy
+
+// FIPSMode is whether the proxy is built with the fips tag, restricting it to the algorithms
+// approved by FIPS 140
+const FIPSMode = false
+
+func fipsModule() bool {
+	return false
+}
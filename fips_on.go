@@ -0,0 +1,16 @@
+//go:build fips && !boringcrypto
+// +build fips,!boringcrypto
+
+package goproxy
+
+import "crypto/fips140"
+
+// FIPSMode is whether the proxy is built with the fips tag, restricting it to the algorithms
+// approved by FIPS 140
+const FIPSMode = true
+
+// fipsModule reports whether the Go cryptographic module runs in FIPS 140-3 mode, which
+// requires Go 1.24 or later
+func fipsModule() bool {
+	return fips140.Enabled()
+}
@@ -0,0 +1,40 @@
+package goproxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"testing"
+)
+
+func TestFIPSChecks(t *testing.T) {
+	config := &tls.Config{}
+	if checkFIPSTLSConfig(config) == nil {
+		t.Error("expected the default TLS configuration to be rejected")
+	}
+	restrictTLSConfig(config)
+	orFatal("checkFIPSTLSConfig", checkFIPSTLSConfig(config), t)
+	config.CipherSuites = append(config.CipherSuites, tls.TLS_RSA_WITH_AES_128_CBC_SHA)
+	if checkFIPSTLSConfig(config) == nil {
+		t.Error("expected TLS_RSA_WITH_AES_128_CBC_SHA to be rejected")
+	}
+
+	orFatal("checkFIPSKey", checkFIPSKey(GoproxyCa.PrivateKey), t)
+	small, err := rsa.GenerateKey(rand.Reader, 1024)
+	orFatal("GenerateKey", err, t)
+	if checkFIPSKey(small) == nil {
+		t.Error("expected a 1024 bits RSA key to be rejected")
+	}
+	p224, err := ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
+	orFatal("GenerateKey", err, t)
+	if checkFIPSKey(p224) == nil {
+		t.Error("expected a P-224 key to be rejected")
+	}
+
+	proxy := NewProxyHttpServer()
+	if err := proxy.VerifyFIPS(); FIPSMode != (err == nil) {
+		t.Errorf("unexpected verification %v", err)
+	}
+}
@@ -6,13 +6,18 @@ require (
 	github.com/LiamHaworth/go-tproxy v0.0.0-20190726054950-ef7efd7f24ed
 	github.com/Windscribe/go-tproxy v0.0.0-20210625021014-c992248a46c2
 	github.com/Windscribe/go-vhost v0.0.0-20221123165256-d464d364ffd1
+	github.com/andybalholm/brotli v1.0.4
 	github.com/elazarl/goproxy v0.0.0-20191011121108-aa519ddbe484
 	github.com/elazarl/goproxy/ext v0.0.0-20190911111923-ecfe977594f1
 	github.com/function61/gokit v0.0.0-20200923114939-f8d7e065a5c3
+	github.com/klauspost/compress v1.11.13
 	github.com/miekg/dns v1.1.41
 	github.com/oxtoacart/bpool v0.0.0-20190530202638-03653db5a59c
 	github.com/prometheus/client_golang v1.2.1
+	github.com/prometheus/common v0.9.1
 	github.com/valyala/bytebufferpool v1.0.0
 	golang.org/x/crypto v0.3.0 // indirect
+	golang.org/x/net v0.2.0
 	golang.org/x/sys v0.2.0
+	golang.org/x/text v0.4.0
 )
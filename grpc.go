@@ -0,0 +1,182 @@
+package goproxy
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"golang.org/x/net/http2"
+)
+
+// GRPCPassthrough relays the gRPC calls of the intercepted (ConnectMitm) connections end to
+// end over HTTP/2, instead of through the HTTP/1.1 pipeline of the intercepted requests which
+// loses their trailers and their streaming. The proxy then negotiates h2 with the clients of
+// the intercepted connections. The gRPC calls are streamed to the destination as they are,
+// without running the handlers, and their messages, metadata and trailers are preserved. The
+// other requests received over HTTP/2 are served as the plain requests of the proxy.
+//
+//	proxy.GRPC = &goproxy.GRPCPassthrough{OnCall: func(ctx *goproxy.ProxyCtx, call *goproxy.GRPCCall) {
+//		ctx.Logf("%s tenant=%s", call.FullMethod, call.Metadata.Get("x-tenant"))
+//	}}
+type GRPCPassthrough struct {
+	// OnCall, if set, is called with each call before it is sent to the destination, it can
+	// change its metadata
+	OnCall func(ctx *ProxyCtx, call *GRPCCall)
+	// OnStatus, if set, is called with each call once its response is done, with its status
+	OnStatus func(ctx *ProxyCtx, call *GRPCCall)
+}
+
+// GRPCCall is a gRPC call relayed by GRPCPassthrough
+type GRPCCall struct {
+	// FullMethod is the path of the call, e.g. "/helloworld.Greeter/SayHello"
+	FullMethod string
+	// Service and Method are the parts of FullMethod, e.g. "helloworld.Greeter" and "SayHello"
+	Service string
+	Method  string
+	// Metadata is the header of the request
+	Metadata http.Header
+	// Header and Trailer are the metadata of the response, set for OnStatus
+	Header  http.Header
+	Trailer http.Header
+	// Status and Message are the grpc-status and grpc-message of the response, set for
+	// OnStatus. Status is "14" (UNAVAILABLE) if the destination could not be reached.
+	Status  string
+	Message string
+}
+
+// grpcUnavailable is the status of the calls whose destination could not be reached
+const grpcUnavailable = "14"
+
+// isGRPCRequest reports whether r is a gRPC call
+func isGRPCRequest(r *http.Request) bool {
+	return r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+func newGRPCCall(r *http.Request) *GRPCCall {
+	call := &GRPCCall{FullMethod: r.URL.Path, Metadata: r.Header}
+	if i := strings.LastIndex(r.URL.Path, "/"); i > 0 {
+		call.Service, call.Method = r.URL.Path[1:i], r.URL.Path[i+1:]
+	}
+	return call
+}
+
+// serveMitmHTTP2 serves the HTTP/2 connection conn of a client of the intercepted CONNECT
+// request connect, of ctx
+func (proxy *ProxyHttpServer) serveMitmHTTP2(ctx *ProxyCtx, connect *http.Request, conn net.Conn) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.RemoteAddr = connect.RemoteAddr
+		req.URL.Scheme = "https"
+		req.URL.Host = connect.Host
+		if !isGRPCRequest(req) {
+			proxy.ServeHTTP(w, req)
+			return
+		}
+		ctx := &ProxyCtx{Req: req, Session: atomic.AddInt64(&proxy.sess, 1), Proxy: proxy, UserData: ctx.UserData,
+			values: ctx.cloneValues(), tags: ctx.Tags()}
+		defer proxy.trackSession(ctx, SessionHTTP, req.URL.Host)()
+		proxy.serveGRPC(ctx, w, req)
+	})
+	(&http2.Server{}).ServeConn(conn, &http2.ServeConnOpts{Handler: handler})
+}
+
+// serveGRPC relays the gRPC call r of ctx to its destination over HTTP/2, streaming the
+// messages of both directions and relaying the trailers
+func (proxy *ProxyHttpServer) serveGRPC(ctx *ProxyCtx, w http.ResponseWriter, r *http.Request) {
+	call := newGRPCCall(r)
+	if proxy.GRPC.OnCall != nil {
+		proxy.GRPC.OnCall(ctx, call)
+	}
+	ctx.Debugf(DebugMitm, "gRPC call %s to %s", call.FullMethod, r.URL.Host)
+	defer func() {
+		if proxy.GRPC.OnStatus != nil {
+			proxy.GRPC.OnStatus(ctx, call)
+		}
+		proxy.account(ctx)
+	}()
+
+	tr, err := proxy.http2Transport(ctx)
+	var resp *http.Response
+	if err == nil {
+		out := r.WithContext(withProxyCtx(r.Context(), ctx))
+		out.RequestURI = ""
+		body := &grpcBody{r: r.Body}
+		out.Body = body
+		resp, err = tr.RoundTrip(out)
+		defer func() { ctx.BytesSent += atomic.LoadInt64(&body.n) }()
+	}
+	if err != nil {
+		ctx.Warnf("Cannot relay gRPC call %s to %s: %v", call.FullMethod, r.URL.Host, err)
+		ctx.Error = err
+		call.Status, call.Message = grpcUnavailable, err.Error()
+		// a trailers-only response
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Grpc-Status", call.Status)
+		w.Header().Set("Grpc-Message", call.Message)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	defer resp.Body.Close()
+
+	call.Header = resp.Header
+	copyHeaders(w.Header(), resp.Header, false)
+	w.WriteHeader(resp.StatusCode)
+	n, err := copyFlushing(w, resp.Body)
+	ctx.BytesReceived += n
+	if err != nil {
+		ctx.Warnf("Cannot relay gRPC response of %s: %v", call.FullMethod, err)
+	}
+	// the trailers are only known once the body is read
+	for k, vs := range resp.Trailer {
+		w.Header()[http.TrailerPrefix+k] = vs
+	}
+	call.Trailer = resp.Trailer
+	call.Status, call.Message = resp.Trailer.Get("Grpc-Status"), resp.Trailer.Get("Grpc-Message")
+	if call.Status == "" {
+		call.Status, call.Message = resp.Header.Get("Grpc-Status"), resp.Header.Get("Grpc-Message")
+	}
+}
+
+// copyFlushing copies src to w, flushing every write so that the streamed messages are not
+// held back
+func copyFlushing(w http.ResponseWriter, src io.Reader) (int64, error) {
+	flusher, _ := w.(http.Flusher)
+	buf := make([]byte, 32*1024)
+	var written int64
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			m, werr := w.Write(buf[:n])
+			written += int64(m)
+			if werr != nil {
+				return written, werr
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+// grpcBody is the body of a gRPC call, counting the bytes read from r
+type grpcBody struct {
+	r io.ReadCloser
+	n int64
+}
+
+func (c *grpcBody) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	atomic.AddInt64(&c.n, int64(n))
+	return n, err
+}
+
+func (c *grpcBody) Close() error {
+	return c.r.Close()
+}
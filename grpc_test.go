@@ -0,0 +1,56 @@
+package goproxy
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestGRPCPassthrough(t *testing.T) {
+	target := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/grpc")
+		w.WriteHeader(http.StatusOK)
+		w.Write(body)
+		w.Header().Set(http.TrailerPrefix+"Grpc-Status", "0")
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", r.Proto+" "+r.Header.Get("X-Tenant"))
+	}))
+	target.EnableHTTP2 = true
+	target.StartTLS()
+	defer target.Close()
+
+	var calls []*GRPCCall
+	proxy := NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(AlwaysMitm)
+	proxy.GRPC = &GRPCPassthrough{OnCall: func(ctx *ProxyCtx, call *GRPCCall) {
+		call.Metadata.Set("X-Tenant", "acme")
+	}, OnStatus: func(ctx *ProxyCtx, call *GRPCCall) {
+		calls = append(calls, call)
+	}}
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	proxyURL, _ := url.Parse(s.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL),
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, ForceAttemptHTTP2: true}}
+	req, _ := http.NewRequest("POST", target.URL+"/helloworld.Greeter/SayHello", strings.NewReader("\x00\x00\x00\x00\x02hi"))
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Te", "trailers")
+	resp, err := client.Do(req)
+	orFatal("Do", err, t)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.ProtoMajor != 2 || string(body) != "\x00\x00\x00\x00\x02hi" {
+		t.Errorf("expected the call to be relayed over HTTP/2, got %s %q", resp.Proto, body)
+	}
+	if resp.Trailer.Get("Grpc-Status") != "0" || resp.Trailer.Get("Grpc-Message") != "HTTP/2.0 acme" {
+		t.Errorf("expected the trailers to be relayed, got %v", resp.Trailer)
+	}
+	if len(calls) != 1 || calls[0].Service != "helloworld.Greeter" || calls[0].Method != "SayHello" || calls[0].Status != "0" {
+		t.Errorf("expected the call to be reported, got %+v", calls)
+	}
+}
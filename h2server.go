@@ -0,0 +1,178 @@
+package goproxy
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// ConfigureHTTP2 makes srv accept HTTP/2 from the clients of the proxy, negotiated with ALPN
+// when it serves TLS, and as h2c, with prior knowledge or an Upgrade, otherwise. The handler
+// of srv is the proxy if it is nil. The clients can then multiplex their requests and their
+// CONNECT tunnels over a single connection, each tunnel being relayed over its own stream.
+//
+// HTTP/2 requests carry no absolute URL: the plain requests whose :authority is not the
+// address the client connected to are forwarded to it as http requests, the others are
+// served by the NonproxyHandler.
+func (proxy *ProxyHttpServer) ConfigureHTTP2(srv *http.Server) error {
+	h2 := &http2.Server{}
+	if err := http2.ConfigureServer(srv, h2); err != nil {
+		return err
+	}
+	handler := srv.Handler
+	if handler == nil {
+		handler = proxy
+	}
+	srv.Handler = h2c.NewHandler(handler, h2)
+	return nil
+}
+
+// absoluteHTTP2URL sets the scheme and the host of the URL of the HTTP/2 request r, unless
+// it is addressed to the proxy itself
+func absoluteHTTP2URL(r *http.Request) {
+	if r.URL.IsAbs() || r.Host == "" {
+		return
+	}
+	if self, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok && self.String() == r.Host {
+		return
+	}
+	r.URL.Scheme = "http"
+	r.URL.Host = r.Host
+}
+
+// serveHTTP2Connect serves the CONNECT request r received over HTTP/2, relaying the tunnel
+// over its stream until the tunnel is closed or the client resets the stream
+func (proxy *ProxyHttpServer) serveHTTP2Connect(w http.ResponseWriter, r *http.Request) {
+	stream := newStreamConn(w, r)
+	var conn net.Conn = stream
+	proxy.HandleHttps(w, r, &conn)
+	// the hijacked and the intercepted tunnels go on after HandleHttps, and the stream ends
+	// with the handler
+	select {
+	case <-stream.closed:
+	case <-r.Context().Done():
+		stream.Close()
+	}
+	// the response can't be written once the handler returned
+	stream.mu.Lock()
+	stream.mu.Unlock()
+}
+
+// errStreamClosed is the error of the writes to a closed streamConn
+var errStreamClosed = errors.New("goproxy: HTTP/2 stream closed")
+
+// streamConn is the connection of a CONNECT tunnel over an HTTP/2 stream: it reads the body
+// of the request and writes the body of the response. The head of the HTTP/1 response the
+// proxy writes to the clients of the tunnels is translated to the header of the response.
+type streamConn struct {
+	w      http.ResponseWriter
+	r      *http.Request
+	local  net.Addr
+	remote net.Addr
+
+	// mu serializes the writes, and the end of the handler after them
+	mu        sync.Mutex
+	head      []byte
+	started   bool
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newStreamConn(w http.ResponseWriter, r *http.Request) *streamConn {
+	c := &streamConn{w: w, r: r, closed: make(chan struct{}), remote: streamAddr(r.RemoteAddr)}
+	if self, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		c.local = self
+	} else {
+		c.local = streamAddr("")
+	}
+	return c
+}
+
+func (c *streamConn) Read(b []byte) (int, error) {
+	return c.r.Body.Read(b)
+}
+
+func (c *streamConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-c.closed:
+		return 0, errStreamClosed
+	default:
+	}
+	if !c.started {
+		c.head = append(c.head, b...)
+		end := bytes.Index(c.head, []byte("\r\n\r\n"))
+		if end < 0 {
+			return len(b), nil
+		}
+		if err := c.writeHeader(c.head[:end+4]); err != nil {
+			return 0, err
+		}
+		rest := c.head[end+4:]
+		c.head = nil
+		if len(rest) > 0 {
+			if _, err := c.w.Write(rest); err != nil {
+				return 0, err
+			}
+		}
+	} else if _, err := c.w.Write(b); err != nil {
+		return 0, err
+	}
+	c.flush()
+	return len(b), nil
+}
+
+// writeHeader writes the HTTP/1 response head as the header of the response of the stream
+func (c *streamConn) writeHeader(head []byte) error {
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(head)), nil)
+	if err != nil {
+		return err
+	}
+	h := c.w.Header()
+	for k, vs := range resp.Header {
+		h[k] = vs
+	}
+	// the connection specific headers are not allowed in HTTP/2
+	for _, k := range []string{"Connection", "Proxy-Connection", "Keep-Alive", "Transfer-Encoding", "Upgrade"} {
+		h.Del(k)
+	}
+	c.w.WriteHeader(resp.StatusCode)
+	c.started = true
+	return nil
+}
+
+func (c *streamConn) flush() {
+	if f, ok := c.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Close ends the stream, and with it the handler of its CONNECT request
+func (c *streamConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		err = c.r.Body.Close()
+	})
+	return err
+}
+
+func (c *streamConn) LocalAddr() net.Addr                { return c.local }
+func (c *streamConn) RemoteAddr() net.Addr               { return c.remote }
+func (c *streamConn) SetDeadline(t time.Time) error      { return nil }
+func (c *streamConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *streamConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// streamAddr is the address of a peer of a streamConn
+type streamAddr string
+
+func (a streamAddr) Network() string { return "tcp" }
+func (a streamAddr) String() string  { return string(a) }
@@ -0,0 +1,88 @@
+package goproxy
+
+import (
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/net/http2"
+)
+
+func TestServeHTTP2(t *testing.T) {
+	background := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.URL.Path)
+	}))
+	defer background.Close()
+	echo := echoServer(t, 5)
+	defer echo.Close()
+	proxy := NewProxyHttpServer()
+	var conns int32
+	srv := httptest.NewUnstartedServer(proxy)
+	srv.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	orFatal("ConfigureHTTP2", proxy.ConfigureHTTP2(srv.Config), t)
+	srv.Start()
+	defer srv.Close()
+	// h2c with prior knowledge
+	tr := &http2.Transport{AllowHTTP: true, DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+		return net.Dial(network, addr)
+	}}
+	defer tr.CloseIdleConnections()
+	proxyURL, _ := url.Parse(srv.URL)
+
+	req, _ := http.NewRequest("GET", srv.URL+"/plain", nil)
+	req.Host = background.Listener.Addr().String()
+	resp, err := tr.RoundTrip(req)
+	orFatal("RoundTrip", err, t)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.ProtoMajor != 2 || string(body) != "/plain" {
+		t.Errorf("unexpected response %s %q", resp.Proto, body)
+	}
+
+	for i := 0; i < 2; i++ {
+		pr, pw := io.Pipe()
+		req = &http.Request{Method: "CONNECT", URL: &url.URL{Scheme: "http", Host: proxyURL.Host},
+			Host: echo.Addr().String(), Header: make(http.Header), Body: pr}
+		resp, err = tr.RoundTrip(req)
+		orFatal("RoundTrip", err, t)
+		if resp.StatusCode != 200 {
+			t.Fatalf("unexpected CONNECT response %s", resp.Status)
+		}
+		go io.WriteString(pw, "hello")
+		buf := make([]byte, 5)
+		_, err = io.ReadFull(resp.Body, buf)
+		orFatal("ReadFull", err, t)
+		if string(buf) != "hello" {
+			t.Errorf("unexpected echo %q", buf)
+		}
+		pw.Close()
+		resp.Body.Close()
+	}
+	if n := atomic.LoadInt32(&conns); n != 1 {
+		t.Errorf("the requests were sent over %d connections", n)
+	}
+
+	// the destinations refusing the tunnels are reported in the status of the stream
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	l.Close()
+	req = &http.Request{Method: "CONNECT", URL: &url.URL{Scheme: "http", Host: proxyURL.Host},
+		Host: l.Addr().String(), Header: make(http.Header), Body: pr}
+	resp, err = tr.RoundTrip(req)
+	orFatal("RoundTrip", err, t)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("unexpected CONNECT response %s", resp.Status)
+	}
+}
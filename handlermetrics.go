@@ -0,0 +1,63 @@
+package goproxy
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// HandlerMetrics instruments the handlers registered on the proxy, labelled by chain
+// ("request", "response" or "connect") and by handler name ("unnamed" for the handlers
+// registered without Named). Handlers are only counted when their conditions match.
+type HandlerMetrics struct {
+	// Invocations counts the handler calls
+	Invocations *prometheus.CounterVec
+	// Duration observes the time spent in the handlers, in seconds
+	Duration *prometheus.HistogramVec
+	// ShortCircuits counts the request handlers that answered the request themselves, and
+	// the CONNECT handlers that decided the action of the CONNECT
+	ShortCircuits *prometheus.CounterVec
+}
+
+// NewHandlerMetrics returns HandlerMetrics with metrics named after namespace, which the
+// caller registers, e.g. with prometheus.MustRegister(m.Invocations, m.Duration, m.ShortCircuits)
+func NewHandlerMetrics(namespace string) *HandlerMetrics {
+	labels := []string{"chain", "handler"}
+	return &HandlerMetrics{
+		Invocations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "handler_invocations_total",
+			Help:      "Number of calls of the proxy handlers",
+		}, labels),
+		Duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "handler_duration_seconds",
+			Help:      "Time spent in the proxy handlers",
+			Buckets:   []float64{.0001, .0005, .001, .005, .01, .05, .1, .5, 1},
+		}, labels),
+		ShortCircuits: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "handler_short_circuits_total",
+			Help:      "Number of requests answered or CONNECTs decided by the proxy handlers",
+		}, labels),
+	}
+}
+
+// observe records a call of the handler name of chain started at start
+func (m *HandlerMetrics) observe(chain, name string, start time.Time, shortCircuit bool) {
+	if m == nil {
+		return
+	}
+	if name == "" {
+		name = "unnamed"
+	}
+	if m.Invocations != nil {
+		m.Invocations.WithLabelValues(chain, name).Inc()
+	}
+	if m.Duration != nil {
+		m.Duration.WithLabelValues(chain, name).Observe(time.Since(start).Seconds())
+	}
+	if shortCircuit && m.ShortCircuits != nil {
+		m.ShortCircuits.WithLabelValues(chain, name).Inc()
+	}
+}
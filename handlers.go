@@ -0,0 +1,158 @@
+package goproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// HandlerInfo describes a handler registered on the proxy
+type HandlerInfo struct {
+	// Name is the name given with Named, empty for anonymous handlers
+	Name     string `json:"name,omitempty"`
+	Priority int    `json:"priority"`
+}
+
+// HandlerChains are the handlers registered on the proxy, in the order they run
+type HandlerChains struct {
+	Request  []HandlerInfo `json:"request"`
+	Response []HandlerInfo `json:"response"`
+	Connect  []HandlerInfo `json:"connect"`
+}
+
+// handlerPlacement is where a handler is registered in its chain: the handlers run by
+// increasing priority, in the order they were registered for equal priorities, unless they
+// are placed before or after a named handler
+type handlerPlacement struct {
+	HandlerInfo
+	before, after string
+	// the handler is only evaluated, see ReqProxyConds.Shadow
+	shadow bool
+}
+
+// index returns the index of the handler placed by p in chain, and its info. It panics if the
+// name of the handler is already registered, or if the handler it is placed next to is not.
+func (p handlerPlacement) index(chain []HandlerInfo) (int, HandlerInfo) {
+	info := p.HandlerInfo
+	for _, h := range chain {
+		if info.Name != "" && h.Name == info.Name {
+			panic(fmt.Sprintf("goproxy: handler %q registered twice", info.Name))
+		}
+	}
+	if target := p.before + p.after; target != "" {
+		for i, h := range chain {
+			if h.Name != target {
+				continue
+			}
+			info.Priority = h.Priority
+			if p.after != "" {
+				return i + 1, info
+			}
+			return i, info
+		}
+		panic(fmt.Sprintf("goproxy: no handler named %q", target))
+	}
+	i := len(chain)
+	for i > 0 && chain[i-1].Priority > info.Priority {
+		i--
+	}
+	return i, info
+}
+
+func insertHandlerInfo(chain []HandlerInfo, i int, info HandlerInfo) []HandlerInfo {
+	chain = append(chain, HandlerInfo{})
+	copy(chain[i+1:], chain[i:])
+	chain[i] = info
+	return chain
+}
+
+func (proxy *ProxyHttpServer) addReqHandler(p handlerPlacement, h ReqHandler) {
+	i, info := p.index(proxy.reqHandlerInfos)
+	proxy.reqHandlerInfos = insertHandlerInfo(proxy.reqHandlerInfos, i, info)
+	proxy.reqHandlers = append(proxy.reqHandlers, nil)
+	copy(proxy.reqHandlers[i+1:], proxy.reqHandlers[i:])
+	proxy.reqHandlers[i] = h
+}
+
+func (proxy *ProxyHttpServer) addRespHandler(p handlerPlacement, h RespHandler) {
+	i, info := p.index(proxy.respHandlerInfos)
+	proxy.respHandlerInfos = insertHandlerInfo(proxy.respHandlerInfos, i, info)
+	proxy.respHandlers = append(proxy.respHandlers, nil)
+	copy(proxy.respHandlers[i+1:], proxy.respHandlers[i:])
+	proxy.respHandlers[i] = h
+}
+
+func (proxy *ProxyHttpServer) addHttpsHandler(p handlerPlacement, h HttpsHandler) {
+	i, info := p.index(proxy.httpsHandlerInfos)
+	proxy.httpsHandlerInfos = insertHandlerInfo(proxy.httpsHandlerInfos, i, info)
+	proxy.httpsHandlers = append(proxy.httpsHandlers, nil)
+	copy(proxy.httpsHandlers[i+1:], proxy.httpsHandlers[i:])
+	proxy.httpsHandlers[i] = h
+}
+
+// Handlers returns the handlers registered on the proxy, in the order they run
+func (proxy *ProxyHttpServer) Handlers() HandlerChains {
+	return HandlerChains{
+		Request:  append([]HandlerInfo{}, proxy.reqHandlerInfos...),
+		Response: append([]HandlerInfo{}, proxy.respHandlerInfos...),
+		Connect:  append([]HandlerInfo{}, proxy.httpsHandlerInfos...),
+	}
+}
+
+// Named names the handler registered by pcond, so that other handlers can be placed before
+// or after it, and it can be told apart in the admin API and the metrics
+func (pcond *ReqProxyConds) Named(name string) *ReqProxyConds {
+	pcond.placement.Name = name
+	return pcond
+}
+
+// Priority sets the priority of the handler registered by pcond. The handlers run by
+// increasing priority, 0 by default.
+func (pcond *ReqProxyConds) Priority(priority int) *ReqProxyConds {
+	pcond.placement.Priority = priority
+	return pcond
+}
+
+// Before places the handler registered by pcond right before the handler named name
+//
+//	proxy.OnRequest().Named("auth").DoFunc(authenticate)
+//	proxy.OnRequest().Named("ratelimit").Before("auth").Do(goproxy.LimitRate(limiter, key))
+func (pcond *ReqProxyConds) Before(name string) *ReqProxyConds {
+	pcond.placement.before, pcond.placement.after = name, ""
+	return pcond
+}
+
+// After places the handler registered by pcond right after the handler named name
+func (pcond *ReqProxyConds) After(name string) *ReqProxyConds {
+	pcond.placement.before, pcond.placement.after = "", name
+	return pcond
+}
+
+// Named names the handler registered by pcond, see ReqProxyConds.Named
+func (pcond *ProxyConds) Named(name string) *ProxyConds {
+	pcond.placement.Name = name
+	return pcond
+}
+
+// Priority sets the priority of the handler registered by pcond, see ReqProxyConds.Priority
+func (pcond *ProxyConds) Priority(priority int) *ProxyConds {
+	pcond.placement.Priority = priority
+	return pcond
+}
+
+// Before places the handler registered by pcond right before the handler named name
+func (pcond *ProxyConds) Before(name string) *ProxyConds {
+	pcond.placement.before, pcond.placement.after = name, ""
+	return pcond
+}
+
+// After places the handler registered by pcond right after the handler named name
+func (pcond *ProxyConds) After(name string) *ProxyConds {
+	pcond.placement.before, pcond.placement.after = "", name
+	return pcond
+}
+
+func (proxy *ProxyHttpServer) serveHandlers(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", ContentTypeJSON)
+	json.NewEncoder(w).Encode(proxy.Handlers())
+}
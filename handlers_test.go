@@ -0,0 +1,70 @@
+package goproxy
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestHandlerOrdering(t *testing.T) {
+	proxy := NewProxyHttpServer()
+	var order []string
+	record := func(name string) func(r *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response) {
+		return func(r *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response) {
+			order = append(order, name)
+			return r, nil
+		}
+	}
+	proxy.OnRequest().Named("auth").DoFunc(record("auth"))
+	proxy.OnRequest().Named("log").Priority(10).DoFunc(record("log"))
+	proxy.OnRequest().Named("acl").DoFunc(record("acl"))
+	proxy.OnRequest().Named("ratelimit").Before("auth").DoFunc(record("ratelimit"))
+	proxy.OnRequest().Named("audit").After("log").DoFunc(record("audit"))
+	proxy.OnRequest().Named("early").Priority(-1).DoFunc(record("early"))
+
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	proxy.filterRequest(req, &ProxyCtx{Req: req, Proxy: proxy})
+	expected := []string{"early", "ratelimit", "auth", "acl", "log", "audit"}
+	if !reflect.DeepEqual(order, expected) {
+		t.Errorf("unexpected handler order %v, expected %v", order, expected)
+	}
+	chains := proxy.Handlers()
+	if len(chains.Request) != len(expected) || chains.Request[5] != (HandlerInfo{Name: "audit", Priority: 10}) {
+		t.Errorf("unexpected request chain %+v", chains.Request)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected placing a handler next to an unknown one to panic")
+		}
+	}()
+	proxy.OnResponse().Before("bobo").DoFunc(func(resp *http.Response, ctx *ProxyCtx) *http.Response { return resp })
+}
+
+func TestHandlerMetrics(t *testing.T) {
+	proxy := NewProxyHttpServer()
+	proxy.HandlerMetrics = NewHandlerMetrics("test")
+	proxy.OnRequest(ReqHostIs("blocked.example.com")).Named("block").DoFunc(func(r *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response) {
+		return r, NewResponse(r, ContentTypeText, http.StatusForbidden, "blocked")
+	})
+	proxy.OnRequest().DoFunc(func(r *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response) {
+		return r, nil
+	})
+
+	for _, u := range []string{"http://example.com/", "http://blocked.example.com/"} {
+		req, _ := http.NewRequest("GET", u, nil)
+		proxy.filterRequest(req, &ProxyCtx{Req: req, Proxy: proxy})
+	}
+	m := proxy.HandlerMetrics
+	if n := testutil.ToFloat64(m.Invocations.WithLabelValues("request", "block")); n != 1 {
+		t.Errorf("expected 1 invocation of block, got %v", n)
+	}
+	if n := testutil.ToFloat64(m.Invocations.WithLabelValues("request", "unnamed")); n != 1 {
+		t.Errorf("expected 1 invocation of the unnamed handler, got %v", n)
+	}
+	if n := testutil.ToFloat64(m.ShortCircuits.WithLabelValues("request", "block")); n != 1 {
+		t.Errorf("expected 1 short circuit, got %v", n)
+	}
+}
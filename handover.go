@@ -0,0 +1,183 @@
+package goproxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// A process of the proxy can be replaced, e.g. by an upgraded binary, without dropping the
+// connections: the new process gets the listening sockets of the old one over a unix socket,
+// and the old one stops accepting and lets its tunnels end before it exits. The handover
+// protocol is made of lines on the unix socket:
+//
+//	new process: "listeners"
+//	old process: "<n> <address>..." with the n listening sockets, in a SCM_RIGHTS message
+//	new process: "ready", once it serves the sockets
+//	old process: "done", then it closes its listeners and drains its tunnels
+//
+// Alternatively, both processes can listen with ListenReusePort, the old one closing its
+// listener once the new one is up. Neither is available on Windows, see Capabilities.
+
+// maxHandoverListeners bounds the listeners handed over
+const maxHandoverListeners = 64
+
+// Handover hands the listeners of the proxy over to a new process, see ServeHandover
+type Handover struct {
+	// Socket is the path of the unix socket the new process connects to
+	Socket string
+	// DrainTimeout is how long the tunnels are given to end once the listeners are handed
+	// over, before they are closed, 30 seconds if zero
+	DrainTimeout time.Duration
+	// OnReady, if set, is called once the new process serves the listeners, and before the
+	// tunnels are drained, e.g. to shut the http.Server of the proxy down
+	OnReady func()
+}
+
+func (h *Handover) drainTimeout() time.Duration {
+	if h.DrainTimeout > 0 {
+		return h.DrainTimeout
+	}
+	return 30 * time.Second
+}
+
+// ServeHandover waits for a new process of the proxy to connect to the socket of h, hands it
+// listeners over, closes them once the new process serves them and drains the sessions in
+// progress. It returns once the process can exit, or if ctx is done before a new process
+// connects.
+func (proxy *ProxyHttpServer) ServeHandover(ctx context.Context, h *Handover, listeners ...net.Listener) error {
+	if len(listeners) == 0 || len(listeners) > maxHandoverListeners {
+		return fmt.Errorf("cannot hand %d listeners over", len(listeners))
+	}
+	files := make([]*os.File, len(listeners))
+	addrs := make([]string, len(listeners))
+	for i, l := range listeners {
+		fl, ok := l.(interface{ File() (*os.File, error) })
+		if !ok {
+			return fmt.Errorf("listener %s has no file descriptor", l.Addr())
+		}
+		f, err := fl.File()
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		files[i], addrs[i] = f, l.Addr().String()
+	}
+
+	os.Remove(h.Socket)
+	sock, err := net.ListenUnix("unix", &net.UnixAddr{Name: h.Socket, Net: "unix"})
+	if err != nil {
+		return err
+	}
+	defer sock.Close()
+	if err := os.Chmod(h.Socket, 0600); err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		sock.Close()
+	}()
+	var conn *net.UnixConn
+	for conn == nil {
+		c, err := sock.AcceptUnix()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		if err := proxy.handOver(c, files, addrs); err != nil {
+			proxy.Logger.Printf("WARN: handover failed: %v", err)
+			c.Close()
+			continue
+		}
+		conn = c
+	}
+	defer conn.Close()
+
+	for _, l := range listeners {
+		l.Close()
+	}
+	if h.OnReady != nil {
+		h.OnReady()
+	}
+	drain, cancel := context.WithTimeout(context.Background(), h.drainTimeout())
+	defer cancel()
+	if err := proxy.Drain(drain); err != nil {
+		proxy.Logger.Printf("WARN: closed %d tunnels still open after %v", proxy.CloseTunnels(), h.drainTimeout())
+	}
+	return nil
+}
+
+// Drain waits until the proxy has no request or tunnel in progress, or until ctx is done
+func (proxy *ProxyHttpServer) Drain(ctx context.Context) error {
+	t := time.NewTicker(100 * time.Millisecond)
+	defer t.Stop()
+	for {
+		if requests, tunnels := proxy.ActiveSessions(); requests == 0 && tunnels == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// InheritedListeners are the listeners handed over by the previous process of the proxy,
+// see InheritListeners
+type InheritedListeners struct {
+	Listeners []net.Listener
+	conn      *net.UnixConn
+	r         *bufio.Reader
+}
+
+// InheritListeners gets the listeners of the process of the proxy serving the handover
+// socket at path. The new process must serve them, then call Ready.
+func InheritListeners(path string) (*InheritedListeners, error) {
+	conn, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	il, err := inheritListeners(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return il, nil
+}
+
+// Ready tells the previous process that the listeners are served, so that it stops
+// accepting and drains its tunnels
+func (il *InheritedListeners) Ready() error {
+	defer il.conn.Close()
+	il.conn.SetDeadline(time.Now().Add(30 * time.Second))
+	if _, err := il.conn.Write([]byte("ready\n")); err != nil {
+		return err
+	}
+	if line, err := il.r.ReadString('\n'); err != nil || line != "done\n" {
+		return fmt.Errorf("unexpected handover answer %q: %v", line, err)
+	}
+	return nil
+}
+
+// Close closes the listeners, when the new process fails to serve them
+func (il *InheritedListeners) Close() error {
+	for _, l := range il.Listeners {
+		l.Close()
+	}
+	return il.conn.Close()
+}
+
+// ListenReusePort listens on addr with SO_REUSEPORT, so that the next process of the proxy
+// can listen on it too while the current one still serves it
+func ListenReusePort(network, addr string) (net.Listener, error) {
+	lc := net.ListenConfig{Control: setReusePort}
+	return lc.Listen(context.Background(), network, addr)
+}
@@ -0,0 +1,83 @@
+package goproxy
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHandover(t *testing.T) {
+	echo := echoServer(t, 1<<20)
+	defer echo.Close()
+	dir, err := ioutil.TempDir("", "goproxy-handover")
+	orFatal("TempDir", err, t)
+	defer os.RemoveAll(dir)
+
+	old := NewProxyHttpServer()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	orFatal("Listen", err, t)
+	go http.Serve(l, old)
+
+	// a tunnel through the old process
+	tunnel, err := net.Dial("tcp", l.Addr().String())
+	orFatal("Dial", err, t)
+	defer tunnel.Close()
+	io.WriteString(tunnel, "CONNECT "+echo.Addr().String()+" HTTP/1.1\r\nHost: "+echo.Addr().String()+"\r\n\r\n")
+	br := bufio.NewReader(tunnel)
+	resp, err := http.ReadResponse(br, nil)
+	orFatal("ReadResponse", err, t)
+	if resp.StatusCode != 200 {
+		t.Fatalf("unexpected CONNECT response %s", resp.Status)
+	}
+
+	h := &Handover{Socket: filepath.Join(dir, "handover.sock"), DrainTimeout: 200 * time.Millisecond}
+	ready := make(chan struct{})
+	h.OnReady = func() { close(ready) }
+	done := make(chan error, 1)
+	go func() { done <- old.ServeHandover(context.Background(), h, l) }()
+	var il *InheritedListeners
+	for i := 0; i < 100; i++ {
+		if il, err = InheritListeners(h.Socket); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	orFatal("InheritListeners", err, t)
+	if len(il.Listeners) != 1 || il.Listeners[0].Addr().String() != l.Addr().String() {
+		t.Fatalf("unexpected listeners %v", il.Listeners)
+	}
+	proxy := NewProxyHttpServer()
+	proxy.NonproxyHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "new")
+	})
+	go http.Serve(il.Listeners[0], proxy)
+	orFatal("Ready", il.Ready(), t)
+	<-ready
+
+	// the tunnel is still relayed until the drain timeout, then it is closed
+	io.WriteString(tunnel, "ping")
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(br, buf)
+	orFatal("ReadFull", err, t)
+	orFatal("ServeHandover", <-done, t)
+	tunnel.SetReadDeadline(time.Now().Add(time.Second))
+	if n, err := br.Read(buf); err == nil {
+		t.Errorf("the tunnel is still open after the drain: read %d bytes", n)
+	}
+
+	// the new process serves the listener
+	resp, err = http.Get("http://" + l.Addr().String() + "/")
+	orFatal("Get", err, t)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "new" {
+		t.Errorf("unexpected response %q", body)
+	}
+}
@@ -0,0 +1,89 @@
+//go:build !windows
+// +build !windows
+
+package goproxy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// handOver runs the handover protocol on c, for the listening sockets files at addrs
+func (proxy *ProxyHttpServer) handOver(c *net.UnixConn, files []*os.File, addrs []string) error {
+	c.SetDeadline(time.Now().Add(30 * time.Second))
+	defer c.SetDeadline(time.Time{})
+	r := bufio.NewReader(c)
+	if line, err := r.ReadString('\n'); err != nil || line != "listeners\n" {
+		return fmt.Errorf("unexpected request %q: %v", line, err)
+	}
+	fds := make([]int, len(files))
+	for i, f := range files {
+		fds[i] = int(f.Fd())
+	}
+	msg := strconv.Itoa(len(addrs)) + " " + strings.Join(addrs, " ") + "\n"
+	if _, _, err := c.WriteMsgUnix([]byte(msg), syscall.UnixRights(fds...), nil); err != nil {
+		return err
+	}
+	// the new process serves the sockets, or it failed and the old one goes on serving them
+	if line, err := r.ReadString('\n'); err != nil || line != "ready\n" {
+		return fmt.Errorf("new process not ready %q: %v", line, err)
+	}
+	_, err := c.Write([]byte("done\n"))
+	return err
+}
+
+func inheritListeners(conn *net.UnixConn) (*InheritedListeners, error) {
+	if _, err := conn.Write([]byte("listeners\n")); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 64*1024)
+	oob := make([]byte, syscall.CmsgSpace(4*maxHandoverListeners))
+	n, oobn, _, _, err := conn.ReadMsgUnix(buf, oob)
+	if err != nil {
+		return nil, err
+	}
+	var fds []int
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return nil, err
+	}
+	for i := range msgs {
+		rights, err := syscall.ParseUnixRights(&msgs[i])
+		if err != nil {
+			return nil, err
+		}
+		fds = append(fds, rights...)
+	}
+	closeFds := func(from int) {
+		for _, fd := range fds[from:] {
+			unix.Close(fd)
+		}
+	}
+	fields := strings.Fields(string(buf[:n]))
+	if len(fields) == 0 || fields[0] != strconv.Itoa(len(fds)) || len(fields) != len(fds)+1 {
+		closeFds(0)
+		return nil, errors.New("malformed handover of " + strconv.Itoa(len(fds)) + " listeners: " + string(buf[:n]))
+	}
+	il := &InheritedListeners{conn: conn, r: bufio.NewReader(conn)}
+	for i, fd := range fds {
+		f := os.NewFile(uintptr(fd), fields[i+1])
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			closeFds(i + 1)
+			il.Close()
+			return nil, err
+		}
+		il.Listeners = append(il.Listeners, l)
+	}
+	return il, nil
+}
@@ -0,0 +1,19 @@
+package goproxy
+
+import (
+	"errors"
+	"net"
+	"os"
+)
+
+// errNoHandover is returned by the handover, the sockets cannot be passed over unix sockets
+// on Windows
+var errNoHandover = errors.New("listener handover is not supported on windows")
+
+func (proxy *ProxyHttpServer) handOver(c *net.UnixConn, files []*os.File, addrs []string) error {
+	return errNoHandover
+}
+
+func inheritListeners(conn *net.UnixConn) (*InheritedListeners, error) {
+	return nil, errNoHandover
+}
@@ -0,0 +1,104 @@
+package goproxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// HashVerdictPolicy is a RespHandler computing the SHA-256 of the bodies of the responses of
+// the configured content types, and asking Verdict whether they may be released to the client,
+// e.g. from a malware hash lookup service:
+//
+//	proxy.OnResponse().Do(&goproxy.HashVerdictPolicy{
+//		ContentTypes: []string{"application/octet-stream", "application/zip", "application/x-*"},
+//		Verdict: func(sum [sha256.Size]byte, resp *http.Response, ctx *goproxy.ProxyCtx) error {
+//			return lookup(hex.EncodeToString(sum[:]))
+//		}})
+//
+// Bodies of up to MaxBufferSize bytes are stored and forwarded once allowed, blocked ones are
+// replaced with 403 Forbidden. Larger bodies are trickled to the client as they are read,
+// except for their last byte, and the connection is terminated if they are blocked. Memory
+// use is bounded by MaxBufferSize whatever the size of the body. Compressed bodies are
+// decoded, so that the hash is the one of the downloaded file.
+type HashVerdictPolicy struct {
+	// ContentTypes are the content types of the bodies checked, a trailing * matches every
+	// subtype. Every body is checked if it is empty.
+	ContentTypes []string
+	// Verdict returns nil if the body of resp whose hash is sum may be released, and the
+	// reason it is blocked otherwise
+	Verdict func(sum [sha256.Size]byte, resp *http.Response, ctx *ProxyCtx) error
+	// MaxBufferSize is the size of the largest body stored and forwarded, 1MB if zero
+	MaxBufferSize int64
+	// BlockedMetric, if set, counts the bodies blocked
+	BlockedMetric *prometheus.Counter
+}
+
+// Handle implements RespHandler
+func (p *HashVerdictPolicy) Handle(resp *http.Response, ctx *ProxyCtx) *http.Response {
+	if resp == nil || resp.Body == nil || resp.StatusCode != http.StatusOK || p.Verdict == nil ||
+		resp.Request != nil && resp.Request.Method == "HEAD" {
+		return resp
+	}
+	if len(p.ContentTypes) > 0 && !mediaTypeIn(resp.Header.Get("Content-Type"), p.ContentTypes) {
+		return resp
+	}
+	if err := DecodeContent(resp); err != nil {
+		ctx.Warnf("Cannot decode body to hash it: %v", err)
+		resp.Body.Close()
+		return p.blocked(ctx, err)
+	}
+	max := p.MaxBufferSize
+	if max <= 0 {
+		max = 1 << 20
+	}
+	h := sha256.New()
+	verdict := func() error {
+		var sum [sha256.Size]byte
+		copy(sum[:], h.Sum(nil))
+		return p.Verdict(sum, resp, ctx)
+	}
+	verify := func() error {
+		err := verdict()
+		if err != nil {
+			p.blocked(ctx, err)
+		}
+		return err
+	}
+	if resp.ContentLength > max || ctx.Streaming() {
+		resp.Body = newVerifyingBody(resp.Body, h, nil, verify)
+		return resp
+	}
+	body, err := ctx.readAll(io.LimitReader(resp.Body, max+1))
+	if err != nil {
+		resp.Body.Close()
+		return p.blocked(ctx, err)
+	}
+	h.Write(body)
+	if int64(len(body)) > max {
+		resp.Body = newVerifyingBody(resp.Body, h, body, verify)
+		return resp
+	}
+	resp.Body.Close()
+	if err := verdict(); err != nil {
+		return p.blocked(ctx, err)
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	return resp
+}
+
+// blocked records that the body of the response of ctx was blocked for err, and returns the
+// response replacing it
+func (p *HashVerdictPolicy) blocked(ctx *ProxyCtx, err error) *http.Response {
+	ctx.Warnf("body of %s blocked: %v", ctx.Req.URL, err)
+	if p.BlockedMetric != nil {
+		metric := *p.BlockedMetric
+		metric.Inc()
+	}
+	return ctx.BlockedResponse(http.StatusForbidden, PolicyDecision{Policy: "hash-verdict", Reason: err.Error()})
+}
@@ -0,0 +1,50 @@
+package goproxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+func TestHashVerdictPolicy(t *testing.T) {
+	malware := []byte("X5O!P%@AP[4\\PZX54(P^)7CC)7}$EICAR")
+	bad := sha256.Sum256(malware)
+	checked := 0
+	policy := &HashVerdictPolicy{ContentTypes: []string{"application/x-*"}, MaxBufferSize: 64,
+		Verdict: func(sum [sha256.Size]byte, resp *http.Response, ctx *ProxyCtx) error {
+			checked++
+			if sum == bad {
+				return errors.New("known malware")
+			}
+			return nil
+		}}
+	fetch := func(contentType string, body []byte) (*http.Response, []byte, error) {
+		resp := integrityResponse("http://example.com/file", body, http.Header{"Content-Type": {contentType}})
+		resp = policy.Handle(resp, &ProxyCtx{Req: resp.Request, Proxy: NewProxyHttpServer()})
+		got, err := ioutil.ReadAll(resp.Body)
+		return resp, got, err
+	}
+
+	if resp, _, _ := fetch("application/x-msdownload", malware); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected malware to be blocked, got %d", resp.StatusCode)
+	}
+	if resp, got, _ := fetch("application/x-msdownload", []byte("clean")); resp.StatusCode != http.StatusOK || string(got) != "clean" {
+		t.Errorf("expected clean file, got %d %q", resp.StatusCode, got)
+	}
+	if _, _, _ = fetch("text/html", malware); checked != 2 {
+		t.Errorf("expected other content types not to be checked, %d checks", checked)
+	}
+
+	// larger than MaxBufferSize, streamed
+	large := bytes.Repeat([]byte("clean file "), 100)
+	if _, got, err := fetch("application/x-tar", large); err != nil || !bytes.Equal(got, large) {
+		t.Errorf("expected the large clean file, got %d bytes, %v", len(got), err)
+	}
+	bad = sha256.Sum256(large)
+	if _, got, err := fetch("application/x-tar", large); err == nil || len(got) >= len(large) {
+		t.Errorf("expected the large malware to be terminated, got %d bytes, %v", len(got), err)
+	}
+}
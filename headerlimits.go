@@ -0,0 +1,127 @@
+package goproxy
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// HeaderLimitAction is what the proxy does with the requests whose header exceeds the
+// HeaderLimits
+type HeaderLimitAction int
+
+const (
+	// HeaderLimitReject answers 431 Request Header Fields Too Large
+	HeaderLimitReject HeaderLimitAction = iota
+	// HeaderLimitTruncate shortens the values of the HeaderLimits.Truncate headers to
+	// MaxValueSize. Cookie headers are cut between cookies.
+	HeaderLimitTruncate
+	// HeaderLimitStripCookies removes the Cookie header
+	HeaderLimitStripCookies
+)
+
+// HeaderLimits bounds the header of the requests sent upstream, for the origins that reject
+// requests with the huge Cookie headers the clients accumulate. The limits are enforced right
+// before the requests are written, and the requests still exceeding them after the Action
+// are rejected. It can be set for the whole proxy, and overridden per request by setting
+// ProxyCtx.HeaderLimits in a request handler.
+type HeaderLimits struct {
+	// MaxSize bounds the size of the header, counted as in HTTP/1.1, MaxCount its number of
+	// lines and MaxValueSize the size of each value. There is no bound if they are zero.
+	MaxSize      int
+	MaxCount     int
+	MaxValueSize int
+	Action       HeaderLimitAction
+	// Truncate are the headers shortened by HeaderLimitTruncate, Cookie if empty
+	Truncate []string
+}
+
+// headerLimits returns the limits of the request, falling back to the ones of the proxy
+func (ctx *ProxyCtx) headerLimits() *HeaderLimits {
+	if ctx.HeaderLimits != nil {
+		return ctx.HeaderLimits
+	}
+	if ctx.Proxy != nil {
+		return ctx.Proxy.HeaderLimits
+	}
+	return nil
+}
+
+// exceeded returns why h exceeds the limits, or "" if it doesn't
+func (l *HeaderLimits) exceeded(h http.Header) string {
+	size, count := 0, 0
+	for name, values := range h {
+		for _, v := range values {
+			if l.MaxValueSize > 0 && len(v) > l.MaxValueSize {
+				return fmt.Sprintf("%s header of %d bytes", name, len(v))
+			}
+			size += len(name) + len(v) + len(": \r\n")
+			count++
+		}
+	}
+	if l.MaxSize > 0 && size > l.MaxSize {
+		return fmt.Sprintf("header of %d bytes", size)
+	}
+	if l.MaxCount > 0 && count > l.MaxCount {
+		return fmt.Sprintf("%d header lines", count)
+	}
+	return ""
+}
+
+// truncate shortens the Truncate headers of h to MaxValueSize
+func (l *HeaderLimits) truncate(h http.Header) {
+	if l.MaxValueSize <= 0 {
+		return
+	}
+	names := l.Truncate
+	if len(names) == 0 {
+		names = []string{"Cookie"}
+	}
+	for _, name := range names {
+		name = http.CanonicalHeaderKey(name)
+		for i, v := range h[name] {
+			if len(v) <= l.MaxValueSize {
+				continue
+			}
+			v = v[:l.MaxValueSize]
+			if name == "Cookie" {
+				// don't forward half a cookie
+				if j := strings.LastIndex(v, ";"); j >= 0 {
+					v = v[:j]
+				} else {
+					v = ""
+				}
+			}
+			h[name][i] = v
+		}
+	}
+}
+
+// enforceHeaderLimits applies the HeaderLimits of ctx to req, and returns the response to
+// send instead of req if req exceeds them
+func (ctx *ProxyCtx) enforceHeaderLimits(req *http.Request) *http.Response {
+	l := ctx.headerLimits()
+	if l == nil {
+		return nil
+	}
+	reason := l.exceeded(req.Header)
+	if reason == "" {
+		return nil
+	}
+	switch l.Action {
+	case HeaderLimitTruncate:
+		l.truncate(req.Header)
+	case HeaderLimitStripCookies:
+		req.Header.Del("Cookie")
+	}
+	if l.Action != HeaderLimitReject {
+		ctx.Logf("Request header to %s exceeds the limits (%s), applied action %d", req.URL.Host, reason, l.Action)
+		if reason = l.exceeded(req.Header); reason == "" {
+			return nil
+		}
+	}
+	ctx.Warnf("Rejecting request to %s: %s", req.URL.Host, reason)
+	d := PolicyDecision{Policy: "headerlimits", Reason: reason}
+	ctx.PolicyDecision = &d
+	return NewBlockedResponse(req, http.StatusRequestHeaderFieldsTooLarge, d)
+}
@@ -0,0 +1,41 @@
+package goproxy
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestHeaderLimits(t *testing.T) {
+	cookie := strings.Repeat("a=bobo; ", 100) + "last=1"
+	newReq := func() *http.Request {
+		req, _ := http.NewRequest("GET", "http://example.com/", nil)
+		req.Header.Set("Cookie", cookie)
+		return req
+	}
+	proxy := NewProxyHttpServer()
+
+	proxy.HeaderLimits = &HeaderLimits{MaxSize: 512}
+	ctx := &ProxyCtx{Proxy: proxy}
+	if resp := ctx.enforceHeaderLimits(newReq()); resp == nil || resp.StatusCode != http.StatusRequestHeaderFieldsTooLarge {
+		t.Fatal("expected the request to be rejected")
+	}
+	if ctx.PolicyDecision == nil || ctx.PolicyDecision.Policy != "headerlimits" {
+		t.Error("expected the decision to be recorded")
+	}
+
+	req := newReq()
+	ctx = &ProxyCtx{Proxy: proxy, HeaderLimits: &HeaderLimits{MaxSize: 512, Action: HeaderLimitStripCookies}}
+	if resp := ctx.enforceHeaderLimits(req); resp != nil || req.Header.Get("Cookie") != "" {
+		t.Error("expected the cookies to be stripped")
+	}
+
+	req = newReq()
+	ctx = &ProxyCtx{Proxy: proxy, HeaderLimits: &HeaderLimits{MaxValueSize: 100, Action: HeaderLimitTruncate}}
+	if resp := ctx.enforceHeaderLimits(req); resp != nil {
+		t.Fatal("expected the request to be truncated")
+	}
+	if v := req.Header.Get("Cookie"); len(v) > 100 || !strings.HasSuffix(v, "a=bobo") {
+		t.Errorf("unexpected truncated cookie %q", v)
+	}
+}
@@ -0,0 +1,73 @@
+package goproxy
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// splitHostPort splits hostport in its host and port, the port being defaultPort if hostport
+// has none. It accepts IPv6 literals with or without brackets, and with zone IDs, e.g.
+// "[2001:db8::1]:8443", "[fe80::1%eth0]" or "2001:db8::1".
+func splitHostPort(hostport, defaultPort string) (host, port string) {
+	if h, p, err := net.SplitHostPort(hostport); err == nil {
+		return h, p
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(hostport, "["), "]"), defaultPort
+}
+
+// withPort returns hostport with the port defaultPort if it has none
+func withPort(hostport, defaultPort string) string {
+	return net.JoinHostPort(splitHostPort(hostport, defaultPort))
+}
+
+// hostOnly returns the host of hostport, without its port and the brackets of IPv6 literals
+func hostOnly(hostport string) string {
+	host, _ := splitHostPort(hostport, "")
+	return host
+}
+
+// ipLiteral returns the IP of host if it is an IP literal, possibly with a zone ID
+func ipLiteral(host string) net.IP {
+	if i := strings.IndexByte(host, '%'); i >= 0 {
+		host = host[:i]
+	}
+	return net.ParseIP(host)
+}
+
+// defaultPorts are the ports of the well-known schemes, for the destinations without one
+var defaultPorts = map[string]string{"http": "80", "https": "443", "ws": "80", "wss": "443", "ftp": "21"}
+
+// defaultPort returns the port of the destinations of scheme without one, looked up in
+// proxy.DefaultPorts, then in the well-known schemes. It is 80 for the unknown schemes.
+func (proxy *ProxyHttpServer) defaultPort(scheme string) string {
+	scheme = strings.ToLower(scheme)
+	if proxy != nil {
+		if port, ok := proxy.config().defaultPorts[scheme]; ok {
+			return port
+		}
+	}
+	if port, ok := defaultPorts[scheme]; ok {
+		return port
+	}
+	return "80"
+}
+
+// target returns the host:port the request r is sent to, the CONNECT requests being https
+// tunnels
+func (proxy *ProxyHttpServer) target(r *http.Request) string {
+	if r == nil || r.URL == nil {
+		return ""
+	}
+	host, scheme := r.URL.Host, r.URL.Scheme
+	if host == "" {
+		host = r.Host
+	}
+	if r.Method == "CONNECT" {
+		scheme = "https"
+	}
+	if host == "" {
+		return ""
+	}
+	return withPort(host, proxy.defaultPort(scheme))
+}
@@ -0,0 +1,148 @@
+package goproxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestSplitHostPort(t *testing.T) {
+	for _, test := range []struct {
+		in, host, port string
+	}{
+		{"example.com", "example.com", "80"},
+		{"example.com:8080", "example.com", "8080"},
+		{"192.0.2.1", "192.0.2.1", "80"},
+		{"[2001:db8::1]:8443", "2001:db8::1", "8443"},
+		{"[2001:db8::1]", "2001:db8::1", "80"},
+		{"2001:db8::1", "2001:db8::1", "80"},
+		{"[fe80::1%eth0]:443", "fe80::1%eth0", "443"},
+		{"fe80::1%eth0", "fe80::1%eth0", "80"},
+	} {
+		if host, port := splitHostPort(test.in, "80"); host != test.host || port != test.port {
+			t.Errorf("splitHostPort(%q): expected %s %s, got %s %s", test.in, test.host, test.port, host, port)
+		}
+	}
+	if hp := withPort("2001:db8::1", "443"); hp != "[2001:db8::1]:443" {
+		t.Errorf("expected the IPv6 literal to be bracketed, got %s", hp)
+	}
+}
+
+func TestResolveDomainIPLiteral(t *testing.T) {
+	proxy := NewProxyHttpServer()
+	failing := ResolverFunc(func(c context.Context, host string, hints LookupHints) ([]net.IP, error) {
+		return nil, errors.New("unexpected lookup of " + host)
+	})
+	ctx := &ProxyCtx{Proxy: proxy}
+	ips, ips6, err := proxy.resolveDomain(ctx, failing, "fe80::1%eth0")
+	if err != nil || len(ips) != 0 || len(ips6) != 1 || ips6[0] != "fe80::1%eth0" {
+		t.Errorf("expected the IPv6 literal not to be resolved, got %v %v %v", ips, ips6, err)
+	}
+	ips, _, err = proxy.resolveDomain(ctx, failing, hostOnly("192.0.2.1:443"))
+	if err != nil || len(ips) != 1 || ips[0] != "192.0.2.1" {
+		t.Errorf("expected the IPv4 literal not to be resolved, got %v %v", ips, err)
+	}
+}
+
+func TestIPv6Destinations(t *testing.T) {
+	l, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skip("IPv6 is not available:", err)
+	}
+	target := httptest.NewUnstartedServer(ConstantHanlder("v6"))
+	target.Listener = l
+	target.StartTLS()
+	defer target.Close()
+
+	l, err = net.Listen("tcp", "[::1]:0")
+	orFatal("Listen", err, t)
+	plain := httptest.NewUnstartedServer(ConstantHanlder("plain v6"))
+	plain.Listener = l
+	plain.Start()
+	defer plain.Close()
+
+	var hosts []string
+	proxy := NewProxyHttpServer()
+	proxy.OnRequest().DoFunc(func(r *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response) {
+		hosts = append(hosts, r.URL.Host)
+		ctx.ForwardProxySourceIPv6 = "::1"
+		return r, nil
+	})
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+	proxyURL, _ := url.Parse(s.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL),
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+
+	// CONNECT [::1]:port
+	resp, err := client.Get(target.URL)
+	orFatal("Get", err, t)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "v6" {
+		t.Errorf("expected the IPv6 destination through the tunnel, got %q", body)
+	}
+
+	resp, err = client.Get(plain.URL)
+	orFatal("Get", err, t)
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "plain v6" || len(hosts) != 1 || hosts[0] != plain.Listener.Addr().String() {
+		t.Errorf("expected the request to the IPv6 literal URL to be proxied, got %q %v", body, hosts)
+	}
+}
+
+func TestTarget(t *testing.T) {
+	proxy := NewProxyHttpServer()
+	proxy.DefaultPorts = map[string]string{"gopher": "70"}
+	for _, test := range []struct {
+		method, url, target string
+	}{
+		{"GET", "http://example.com/", "example.com:80"},
+		{"GET", "https://example.com/", "example.com:443"},
+		{"GET", "wss://example.com/", "example.com:443"},
+		{"GET", "gopher://example.com/", "example.com:70"},
+		{"GET", "https://[2001:db8::1]/", "[2001:db8::1]:443"},
+		{"GET", "http://example.com:8080/", "example.com:8080"},
+		{"CONNECT", "//example.com", "example.com:443"},
+	} {
+		req, _ := http.NewRequest(test.method, test.url, nil)
+		if target := proxy.target(req); target != test.target {
+			t.Errorf("%s %s: expected the target %s, got %s", test.method, test.url, test.target, target)
+		}
+	}
+
+	var target string
+	proxy.OnRequest().DoFunc(func(r *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response) {
+		target = ctx.Target
+		return nil, NewResponse(r, ContentTypeText, http.StatusNoContent, "")
+	})
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+	c, err := net.Dial("tcp", s.Listener.Addr().String())
+	orFatal("Dial", err, t)
+	defer c.Close()
+	c.Write([]byte("GET gopher://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	orFatal("ReadResponse", err, t)
+	resp.Body.Close()
+	if target != "example.com:70" {
+		t.Errorf("expected the target of the request on its ctx, got %q", target)
+	}
+
+	req, _ := http.NewRequest("GET", "https://example.com/", nil)
+	if !PortIs(443).HandleReq(req, &ProxyCtx{Proxy: proxy}) || PortIs(80).HandleReq(req, &ProxyCtx{Proxy: proxy}) {
+		t.Error("expected PortIs to match the default port of https")
+	}
+	req, _ = http.NewRequest("GET", "gopher://example.com/", nil)
+	if !PortIs(70).HandleReq(req, &ProxyCtx{Proxy: proxy}) {
+		t.Error("expected PortIs to match the DefaultPorts of the proxy")
+	}
+}
@@ -0,0 +1,152 @@
+package goproxy
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// HTMLRewriter is a RespHandler rewriting HTML pages as they are relayed to the client, without
+// buffering them. The page is tokenized, so markup in comments, scripts or attribute values
+// is never mistaken for tags. Register it for the hosts to rewrite, e.g.
+//
+//	proxy.OnResponse(ReqHostIs("example.com"), ContentTypeIs("text/html")).Do(&HTMLRewriter{
+//		InjectHead: `<script src="/_proxy/banner.js"></script>`})
+//
+// Compressed pages are decoded, and pages in legacy charsets are transcoded to UTF-8.
+type HTMLRewriter struct {
+	// InjectHead is inserted before </head>, or before <body> in pages without a head end tag
+	InjectHead string
+	// RewriteURL, if set, is called with the URLs of the assets of the page (scripts,
+	// stylesheets, images, media and frames), resolved against the URL of the page. It
+	// returns the URL to use instead, or "" to leave the URL unchanged.
+	RewriteURL func(u *url.URL, ctx *ProxyCtx) string
+}
+
+// assetAttrs are the attributes holding the URLs of the assets of a page, by element
+var assetAttrs = map[atom.Atom]string{
+	atom.Script: "src",
+	atom.Link:   "href",
+	atom.Img:    "src",
+	atom.Source: "src",
+	atom.Video:  "src",
+	atom.Audio:  "src",
+	atom.Iframe: "src",
+	atom.Embed:  "src",
+}
+
+// Handle implements RespHandler
+func (rw *HTMLRewriter) Handle(resp *http.Response, ctx *ProxyCtx) *http.Response {
+	if resp == nil || resp.Body == nil || resp.StatusCode != http.StatusOK {
+		return resp
+	}
+	if err := DecodeContent(resp); err != nil {
+		ctx.Warnf("Cannot decode HTML page to rewrite it: %v", err)
+		return resp
+	}
+	if err := ctx.TranscodeToUTF8(resp); err != nil {
+		ctx.Warnf("Cannot transcode HTML page to rewrite it: %v", err)
+		return resp
+	}
+	var base *url.URL
+	if resp.Request != nil {
+		base = resp.Request.URL
+	}
+	resp.Body = &htmlRewritingBody{rw: rw, ctx: ctx, base: base, z: html.NewTokenizer(resp.Body), src: resp.Body}
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	return resp
+}
+
+// htmlRewritingBody tokenizes the HTML page it wraps as it is read, and outputs the tokens
+// unchanged unless they are rewritten
+type htmlRewritingBody struct {
+	rw       *HTMLRewriter
+	ctx      *ProxyCtx
+	base     *url.URL
+	z        *html.Tokenizer
+	src      io.Closer
+	buf      bytes.Buffer
+	injected bool
+	err      error
+}
+
+func (b *htmlRewritingBody) Read(p []byte) (int, error) {
+	for b.buf.Len() == 0 && b.err == nil {
+		b.next()
+	}
+	if b.buf.Len() > 0 {
+		return b.buf.Read(p)
+	}
+	return 0, b.err
+}
+
+// next writes the next token of the page to buf
+func (b *htmlRewritingBody) next() {
+	tt := b.z.Next()
+	// TagName and Token lower case the tags in place, keep them as they were sent
+	raw := append([]byte(nil), b.z.Raw()...)
+	switch tt {
+	case html.ErrorToken:
+		// the tokenizer returns the raw bytes of an unterminated token with io.EOF
+		b.buf.Write(raw)
+		b.err = b.z.Err()
+		return
+	case html.EndTagToken:
+		if name, _ := b.z.TagName(); !b.injected && atom.Lookup(name) == atom.Head {
+			b.inject()
+		}
+	case html.StartTagToken, html.SelfClosingTagToken:
+		token := b.z.Token()
+		if !b.injected && token.DataAtom == atom.Body {
+			b.inject()
+		}
+		if b.rewrite(&token) {
+			b.buf.WriteString(token.String())
+		} else {
+			b.buf.Write(raw)
+		}
+		return
+	}
+	b.buf.Write(raw)
+}
+
+func (b *htmlRewritingBody) inject() {
+	b.injected = true
+	b.buf.WriteString(b.rw.InjectHead)
+}
+
+// rewrite rewrites the asset URL of token, and reports whether it was changed
+func (b *htmlRewritingBody) rewrite(token *html.Token) bool {
+	attr, ok := assetAttrs[token.DataAtom]
+	if !ok || b.rw.RewriteURL == nil {
+		return false
+	}
+	for i, a := range token.Attr {
+		if a.Namespace != "" || !strings.EqualFold(a.Key, attr) {
+			continue
+		}
+		u, err := url.Parse(strings.TrimSpace(a.Val))
+		if err != nil {
+			return false
+		}
+		if b.base != nil {
+			u = b.base.ResolveReference(u)
+		}
+		if rewritten := b.rw.RewriteURL(u, b.ctx); rewritten != "" && rewritten != a.Val {
+			token.Attr[i].Val = rewritten
+			return true
+		}
+		return false
+	}
+	return false
+}
+
+func (b *htmlRewritingBody) Close() error {
+	return b.src.Close()
+}
@@ -0,0 +1,42 @@
+package goproxy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"testing"
+	"testing/iotest"
+)
+
+func TestHTMLRewriter(t *testing.T) {
+	page := `<!DOCTYPE html><HTML><Head><title>bobo</title>` +
+		`<script>var s = "</head>";</script><!-- <img src="/x.png"> -->` +
+		`<link rel=stylesheet href="/style.css"></HEAD><body><img src="logo.png" alt="a&amp;b"></body></html>`
+	req, _ := http.NewRequest("GET", "http://example.com/dir/index.html", nil)
+	resp := &http.Response{StatusCode: 200, Header: http.Header{}, Request: req, ContentLength: int64(len(page)),
+		Body: ioutil.NopCloser(iotest.OneByteReader(bytes.NewReader([]byte(page))))}
+	resp.Header.Set("Content-Type", "text/html")
+	rw := &HTMLRewriter{
+		InjectHead: `<script src="/inject.js"></script>`,
+		RewriteURL: func(u *url.URL, ctx *ProxyCtx) string {
+			if u.Host == "example.com" {
+				return "https://cdn.example.com" + u.Path
+			}
+			return ""
+		},
+	}
+	resp = rw.Handle(resp, &ProxyCtx{Resp: resp, Proxy: NewProxyHttpServer()})
+	body, err := ioutil.ReadAll(resp.Body)
+	orFatal("ReadAll", err, t)
+	expected := `<!DOCTYPE html><HTML><Head><title>bobo</title>` +
+		`<script>var s = "</head>";</script><!-- <img src="/x.png"> -->` +
+		`<link rel="stylesheet" href="https://cdn.example.com/style.css"><script src="/inject.js"></script></HEAD>` +
+		`<body><img src="https://cdn.example.com/dir/logo.png" alt="a&amp;b"></body></html>`
+	if string(body) != expected {
+		t.Errorf("unexpected rewritten page\n%s\nexpected\n%s", body, expected)
+	}
+	if resp.ContentLength != -1 || resp.Header.Get("Content-Length") != "" {
+		t.Error("expected the rewritten page to have no length")
+	}
+}
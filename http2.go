@@ -0,0 +1,90 @@
+package goproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// http2Transport returns the transport of the requests of ctx sent with UpstreamHTTP2. The
+// transports are shared by the requests binding the same source addresses, so that their
+// connections are reused.
+func (proxy *ProxyHttpServer) http2Transport(ctx *ProxyCtx) (*http.Transport, error) {
+	key := ctx.ForwardProxySourceIP + "|" + ctx.ForwardProxySourceIPv6
+	proxy.http2Mu.Lock()
+	defer proxy.http2Mu.Unlock()
+	if tr, ok := proxy.http2Transports[key]; ok {
+		return tr, nil
+	}
+	tlsConfig := &tls.Config{}
+	if proxy.Tr != nil && proxy.Tr.TLSClientConfig != nil {
+		tlsConfig = proxy.Tr.TLSClientConfig.Clone()
+	}
+	tr := &http.Transport{
+		DialContext:           dialHTTP2,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   15 * time.Second,
+		IdleConnTimeout:       90 * time.Second,
+		MaxIdleConns:          100,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	// negotiates h2 with ALPN, and falls back to HTTP/1.1 with the servers not supporting it
+	if err := http2.ConfigureTransport(tr); err != nil {
+		return nil, err
+	}
+	if proxy.http2Transports == nil {
+		proxy.http2Transports = make(map[string]*http.Transport)
+	}
+	proxy.http2Transports[key] = tr
+	return tr, nil
+}
+
+// dialHTTP2 dials the connections of the transports of http2Transport with the settings of
+// the request they are dialed for
+func dialHTTP2(c context.Context, network, addr string) (net.Conn, error) {
+	ctx := proxyCtxFromContext(c)
+	if ctx == nil {
+		return (&net.Dialer{Timeout: 20 * time.Second}).DialContext(c, network, addr)
+	}
+	dialTimeout := ctx.ForwardProxyDialTimeout
+	if dialTimeout == 0 {
+		dialTimeout = 20
+	}
+	d := &net.Dialer{
+		Timeout:  time.Duration(dialTimeout) * time.Second,
+		Resolver: ctx.Proxy.getResolver(ctx, "udp", ""),
+	}
+	// only reach IPv6 destinations directly when we have a v6 source address to bind
+	if ctx.ForwardProxySourceIPv6 == "" {
+		network = "tcp4"
+	}
+	return ctx.tracedDialShared(d, network, addr)
+}
+
+// roundTripHTTP2 sends req through the transport of http2Transport
+func (ctx *ProxyCtx) roundTripHTTP2(req *http.Request) (*http.Response, error) {
+	tr, err := ctx.Proxy.http2Transport(ctx)
+	if err != nil {
+		return nil, err
+	}
+	out := ctx.Proxy.ConnRecycling.request(req.WithContext(ctx.withPoolTrace(withProxyCtx(req.Context(), ctx))))
+	out.RequestURI = ""
+	ctx.traceGetConn(req.URL.Host)
+	resp, err := tr.RoundTrip(out)
+	if err != nil {
+		ctx.Logf("error-metric: %s roundtrip failed: %v", req.URL.Host, err)
+		ctx.SetErrorMetric()
+		ctx.connFailed(req.URL.Host, tr)
+		return nil, err
+	}
+	ctx.Debugf(DebugDial, "%s answered with %s", req.URL.Host, resp.Proto)
+	if req.ContentLength > 0 {
+		ctx.BytesSent = req.ContentLength
+	}
+	ctx.SetSuccessMetric()
+	return resp, nil
+}
@@ -0,0 +1,45 @@
+package goproxy
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestUpstreamHTTP2(t *testing.T) {
+	var conns int32
+	background := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Proto)
+	}))
+	background.EnableHTTP2 = true
+	background.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	background.StartTLS()
+	defer background.Close()
+	proxy := NewProxyHttpServer()
+
+	for i := 0; i < 3; i++ {
+		req, _ := http.NewRequest("GET", background.URL+"/", nil)
+		ctx := &ProxyCtx{Req: req, Proxy: proxy, UpstreamHTTP2: true}
+		resp, err := ctx.RoundTrip(req)
+		orFatal("RoundTrip", err, t)
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.ProtoMajor != 2 || string(body) != "HTTP/2.0" {
+			t.Errorf("unexpected response %s %q", resp.Proto, body)
+		}
+		if ctx.DialTrace == nil || ctx.DialTrace.Reused != (i > 0) {
+			t.Errorf("request %d: unexpected dial trace %v", i, ctx.DialTrace)
+		}
+	}
+	if n := atomic.LoadInt32(&conns); n != 1 {
+		t.Errorf("the connection was not reused: %d connections", n)
+	}
+}
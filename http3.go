@@ -0,0 +1,84 @@
+package goproxy
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptrace"
+	"time"
+)
+
+// http3Retry is how long the origins whose HTTP/3 requests failed are reached over TCP only
+const http3Retry = 5 * time.Minute
+
+// http3Usable reports whether the request req of ctx can be sent with the HTTP3 transport
+// of the proxy: it is an https request sent directly, whose body, if any, can be sent again
+// over TCP, to an origin whose HTTP/3 requests did not fail lately
+func (ctx *ProxyCtx) http3Usable(req *http.Request) bool {
+	proxy := ctx.Proxy
+	if !ctx.UpstreamHTTP3 || proxy == nil || proxy.HTTP3 == nil || req.URL.Scheme != "https" || ctx.ForwardProxy != "" {
+		return false
+	}
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return false
+	}
+	proxy.http3Mu.Lock()
+	defer proxy.http3Mu.Unlock()
+	until, ok := proxy.http3Broken[req.URL.Host]
+	if ok && time.Now().After(until) {
+		delete(proxy.http3Broken, req.URL.Host)
+		return true
+	}
+	return !ok
+}
+
+// roundTripHTTP3 sends req with the HTTP3 transport of the proxy. It reports false if the
+// request failed, and must be sent over TCP instead.
+func (ctx *ProxyCtx) roundTripHTTP3(req *http.Request) (*http.Response, bool) {
+	proxy := ctx.Proxy
+	var handshake time.Time
+	trace := &httptrace.ClientTrace{
+		TLSHandshakeStart: func() { handshake = time.Now() },
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			if ctx.ForwardMetricsCounters.HTTP3HandshakeTimes != nil && !handshake.IsZero() {
+				metric := *ctx.ForwardMetricsCounters.HTTP3HandshakeTimes
+				metric.Observe(float64(time.Since(handshake) / time.Millisecond))
+			}
+		},
+	}
+	out := req.WithContext(httptrace.WithClientTrace(withProxyCtx(req.Context(), ctx), trace))
+	out.RequestURI = ""
+	resp, err := proxy.HTTP3.RoundTrip(out)
+	if err != nil {
+		ctx.Warnf("HTTP/3 request to %s failed, retrying over TCP: %v", req.URL.Host, err)
+		ctx.countHTTP3("fallback")
+		proxy.http3Mu.Lock()
+		if proxy.http3Broken == nil {
+			proxy.http3Broken = make(map[string]time.Time)
+		}
+		proxy.http3Broken[req.URL.Host] = time.Now().Add(http3Retry)
+		proxy.http3Mu.Unlock()
+		if req.GetBody != nil {
+			if req.Body, err = req.GetBody(); err != nil {
+				ctx.Warnf("cannot send the body of the request to %s again: %v", req.URL.Host, err)
+			}
+		}
+		return nil, false
+	}
+	if resp.TLS != nil && resp.TLS.DidResume {
+		ctx.countHTTP3("session_resumed")
+	} else {
+		ctx.countHTTP3("ok")
+	}
+	ctx.Debugf(DebugDial, "%s answered with %s", req.URL.Host, resp.Proto)
+	if req.ContentLength > 0 {
+		ctx.BytesSent = req.ContentLength
+	}
+	return resp, true
+}
+
+// countHTTP3 counts a request sent with the HTTP3 transport, see MetricsCounters.HTTP3
+func (ctx *ProxyCtx) countHTTP3(outcome string) {
+	if ctx.ForwardMetricsCounters.HTTP3 != nil {
+		ctx.ForwardMetricsCounters.HTTP3.WithLabelValues(outcome).Inc()
+	}
+}
@@ -0,0 +1,88 @@
+package goproxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fakeHTTP3 answers the requests to the hosts it knows, and fails the others like an
+// origin not speaking HTTP/3
+type fakeHTTP3 struct {
+	hosts    map[string]bool
+	requests int
+}
+
+func (tr *fakeHTTP3) RoundTrip(r *http.Request) (*http.Response, error) {
+	tr.requests++
+	if !tr.hosts[r.URL.Host] {
+		return nil, errors.New("no recent network activity")
+	}
+	if trace := httptrace.ContextClientTrace(r.Context()); trace != nil {
+		trace.TLSHandshakeStart()
+		time.Sleep(time.Millisecond)
+		trace.TLSHandshakeDone(tls.ConnectionState{}, nil)
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+	return &http.Response{StatusCode: 200, Proto: "HTTP/3.0", ProtoMajor: 3, Header: make(http.Header),
+		Body: ioutil.NopCloser(strings.NewReader("h3 " + string(body))), TLS: &tls.ConnectionState{DidResume: tr.requests > 1}}, nil
+}
+
+func TestUpstreamHTTP3(t *testing.T) {
+	background := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		io.WriteString(w, "tcp "+string(body))
+	}))
+	defer background.Close()
+	h3 := &fakeHTTP3{hosts: map[string]bool{"h3.example.com": true}}
+	proxy := NewProxyHttpServer()
+	proxy.HTTP3 = h3
+	proxy.Tr.TLSClientConfig = background.Client().Transport.(*http.Transport).TLSClientConfig
+	outcomes := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "http3"}, []string{"outcome"})
+	var handshakes int
+	var observer prometheus.Observer = prometheus.ObserverFunc(func(float64) { handshakes++ })
+
+	send := func(url, body string) string {
+		req, _ := http.NewRequest("POST", url, strings.NewReader(body))
+		ctx := &ProxyCtx{Req: req, Proxy: proxy, UpstreamHTTP3: true, UpstreamHTTP2: true,
+			ForwardMetricsCounters: MetricsCounters{HTTP3: outcomes, HTTP3HandshakeTimes: &observer}}
+		resp, err := ctx.RoundTrip(req)
+		orFatal("RoundTrip", err, t)
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return string(b)
+	}
+	for i := 0; i < 2; i++ {
+		if body := send("https://h3.example.com/", "x"); body != "h3 x" {
+			t.Errorf("unexpected response %q", body)
+		}
+	}
+	if ok, resumed := testutil.ToFloat64(outcomes.WithLabelValues("ok")), testutil.ToFloat64(outcomes.WithLabelValues("session_resumed")); ok != 1 || resumed != 1 {
+		t.Errorf("unexpected outcomes %v ok, %v resumed", ok, resumed)
+	}
+
+	// the failed requests are sent again over TCP, with their body, and their origin is
+	// then reached over TCP only
+	requests := h3.requests
+	for i := 0; i < 2; i++ {
+		if body := send(background.URL+"/", "y"); body != "tcp y" {
+			t.Errorf("unexpected response %q", body)
+		}
+	}
+	if h3.requests != requests+1 || testutil.ToFloat64(outcomes.WithLabelValues("fallback")) != 1 {
+		t.Errorf("the broken origin was retried over HTTP/3: %d requests", h3.requests-requests)
+	}
+	if handshakes != 2 {
+		t.Errorf("%d handshakes observed", handshakes)
+	}
+}
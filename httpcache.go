@@ -0,0 +1,337 @@
+package goproxy
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Values of ProxyCtx.CacheStatus
+const (
+	CacheHit       = "HIT"
+	CacheMiss      = "MISS"
+	CacheCoalesced = "COALESCED"
+	CacheStale     = "STALE"
+)
+
+// CachedResponse is a response stored in a ResponseCache
+type CachedResponse struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+	// Stored is when the response was received from the upstream server
+	Stored time.Time
+	// FreshFor is the freshness lifetime of the response, from its Cache-Control or
+	// Expires headers
+	FreshFor time.Duration
+	// StaleWhileRevalidate and StaleIfError are the windows after FreshFor during which the
+	// response may be served stale (RFC 5861)
+	StaleWhileRevalidate time.Duration
+	StaleIfError         time.Duration
+}
+
+// Age returns the time elapsed since the response was stored
+func (c *CachedResponse) Age(now time.Time) time.Duration {
+	return now.Sub(c.Stored)
+}
+
+// Fresh reports whether the response can still be served without revalidation
+func (c *CachedResponse) Fresh(now time.Time) bool {
+	return c.Age(now) < c.FreshFor
+}
+
+// Response returns a new http.Response to req with the content of c
+func (c *CachedResponse) Response(req *http.Request) *http.Response {
+	header := cloneHeader(c.Header)
+	return &http.Response{
+		Status:        strconv.Itoa(c.StatusCode) + " " + http.StatusText(c.StatusCode),
+		StatusCode:    c.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(c.Body)),
+		ContentLength: int64(len(c.Body)),
+		Request:       req,
+	}
+}
+
+// ResponseCache stores the responses of cacheable requests, keyed by ProxyCtx.RequestKey
+type ResponseCache interface {
+	Get(key string) (*CachedResponse, bool)
+	Set(key string, c *CachedResponse)
+}
+
+// MemoryResponseCache is an in memory LRU ResponseCache
+type MemoryResponseCache struct {
+	// Size is the number of responses kept, 1024 if zero
+	Size int
+
+	once  sync.Once
+	local *lruCache
+}
+
+func (c *MemoryResponseCache) lru() *lruCache {
+	c.once.Do(func() { c.local = newLRUCache(c.Size) })
+	return c.local
+}
+
+// Get implements ResponseCache
+func (c *MemoryResponseCache) Get(key string) (*CachedResponse, bool) {
+	v, ok := c.lru().get(key)
+	if !ok {
+		return nil, false
+	}
+	return v.(*CachedResponse), true
+}
+
+// Set implements ResponseCache
+func (c *MemoryResponseCache) Set(key string, resp *CachedResponse) {
+	c.lru().set(key, resp, 0)
+}
+
+func cloneHeader(h http.Header) http.Header {
+	c := make(http.Header, len(h))
+	for k, vs := range h {
+		c[k] = append([]string(nil), vs...)
+	}
+	return c
+}
+
+// cacheControl parses a Cache-Control header into its directives
+func cacheControl(h http.Header) map[string]string {
+	directives := make(map[string]string)
+	for _, v := range h["Cache-Control"] {
+		for _, d := range strings.Split(v, ",") {
+			d = strings.TrimSpace(d)
+			if d == "" {
+				continue
+			}
+			name, value := d, ""
+			if i := strings.IndexByte(d, '='); i >= 0 {
+				name, value = d[:i], strings.Trim(d[i+1:], `"`)
+			}
+			directives[strings.ToLower(name)] = value
+		}
+	}
+	return directives
+}
+
+// cacheableRequest reports whether the response to req may be taken from or stored in a
+// shared cache
+func cacheableRequest(req *http.Request) bool {
+	if req.Method != "GET" || req.Header.Get("Authorization") != "" || req.Header.Get("Cookie") != "" {
+		return false
+	}
+	if req.Body != nil && req.Body != http.NoBody && req.ContentLength != 0 {
+		return false
+	}
+	cc := cacheControl(req.Header)
+	if _, ok := cc["no-store"]; ok {
+		return false
+	}
+	if _, ok := cc["no-cache"]; ok {
+		return false
+	}
+	return req.Header.Get("Pragma") != "no-cache"
+}
+
+// freshness returns the freshness lifetime of resp, and false if it can't be stored in a
+// shared cache
+func freshness(resp *http.Response) (time.Duration, bool) {
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Set-Cookie") != "" {
+		return 0, false
+	}
+	if vary := resp.Header.Get("Vary"); vary != "" && !strings.EqualFold(vary, "Accept-Encoding") {
+		return 0, false
+	}
+	cc := cacheControl(resp.Header)
+	for _, d := range []string{"no-store", "no-cache", "private"} {
+		if _, ok := cc[d]; ok {
+			return 0, false
+		}
+	}
+	for _, d := range []string{"s-maxage", "max-age"} {
+		if v, ok := cc[d]; ok {
+			seconds, err := strconv.Atoi(v)
+			if err != nil || seconds <= 0 {
+				return 0, false
+			}
+			return time.Duration(seconds) * time.Second, true
+		}
+	}
+	if expires := resp.Header.Get("Expires"); expires != "" {
+		t, err := http.ParseTime(expires)
+		if err != nil {
+			return 0, false
+		}
+		date, err := http.ParseTime(resp.Header.Get("Date"))
+		if err != nil {
+			date = time.Now()
+		}
+		if lifetime := t.Sub(date); lifetime > 0 {
+			return lifetime, true
+		}
+	}
+	return 0, false
+}
+
+// newCachedResponse returns the cache entry for resp with the given body, or nil if resp
+// can't be stored
+func newCachedResponse(resp *http.Response, body []byte) *CachedResponse {
+	lifetime, ok := freshness(resp)
+	if !ok {
+		return nil
+	}
+	header := cloneHeader(resp.Header)
+	header.Del("Content-Length")
+	header.Del("Transfer-Encoding")
+	header.Del("Connection")
+	cached := &CachedResponse{StatusCode: resp.StatusCode, Header: header, Body: body, Stored: time.Now(), FreshFor: lifetime}
+	cc := cacheControl(resp.Header)
+	if seconds, err := strconv.Atoi(cc["stale-while-revalidate"]); err == nil && seconds > 0 {
+		cached.StaleWhileRevalidate = time.Duration(seconds) * time.Second
+	}
+	if seconds, err := strconv.Atoi(cc["stale-if-error"]); err == nil && seconds > 0 {
+		cached.StaleIfError = time.Duration(seconds) * time.Second
+	}
+	return cached
+}
+
+// cacheKey returns the key of the response to r in the cache of the proxy, in the cache
+// partition of ctx
+func (proxy *ProxyHttpServer) cacheKey(ctx *ProxyCtx, r *http.Request) string {
+	key := proxy.normalizer().Key(r)
+	if ctx.CachePartition != "" {
+		key += "\nPartition: " + ctx.CachePartition
+	}
+	return key
+}
+
+// defaultMaxCacheObjectSize bounds the responses stored when MaxCacheObjectSize is zero
+const defaultMaxCacheObjectSize = 1 << 20
+
+func (proxy *ProxyHttpServer) maxCacheObjectSize() int64 {
+	if proxy.MaxCacheObjectSize > 0 {
+		return proxy.MaxCacheObjectSize
+	}
+	return defaultMaxCacheObjectSize
+}
+
+// cachingBody copies the body it reads to a buffer, and stores the response in the cache once
+// the body was read entirely, if it was not larger than max and fit in the memory budget of
+// the request
+type cachingBody struct {
+	io.ReadCloser
+	ctx   *ProxyCtx
+	buf   bytes.Buffer
+	max   int64
+	store func(body []byte)
+	done  bool
+}
+
+func (b *cachingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if !b.done {
+		if int64(b.buf.Len()+n) > b.max || b.ctx.ReserveMemory(int64(n)) != nil {
+			b.done = true
+			b.buf = bytes.Buffer{}
+		} else {
+			b.buf.Write(p[:n])
+		}
+		if err == io.EOF && !b.done {
+			b.done = true
+			b.store(b.buf.Bytes())
+		}
+	}
+	return n, err
+}
+
+// serveCached returns the response to r from cached, setting the cache status of ctx
+func (proxy *ProxyHttpServer) serveCached(ctx *ProxyCtx, r *http.Request, cached *CachedResponse, status string) *http.Response {
+	ctx.CacheStatus = status
+	resp := cached.Response(r)
+	resp.Header.Set("Age", strconv.Itoa(int(cached.Age(time.Now())/time.Second)))
+	if r.Header.Get("Range") != "" {
+		resp = partialResponse(r, resp, cached.Body)
+	}
+	return resp
+}
+
+// fetch gets the response to r from the cache of the proxy if it has a fresh copy, or through
+// roundTrip otherwise, storing cacheable responses. Identical requests made concurrently are
+// coalesced into a single upstream request when CoalesceRequests is set. Single byte ranges
+// are served from the cached objects, and stale objects are served as allowed by the
+// StalePolicy of the request.
+func (proxy *ProxyHttpServer) fetch(ctx *ProxyCtx, r *http.Request, roundTrip func(*http.Request) (*http.Response, error)) (*http.Response, error) {
+	if (proxy.Cache == nil && !proxy.CoalesceRequests) || !cacheableRequest(r) {
+		return roundTrip(r)
+	}
+	rangeHeader := r.Header.Get("Range")
+	if _, ok := parseRange(rangeHeader); rangeHeader != "" && !ok {
+		// multiple ranges are left to the upstream server
+		return roundTrip(r)
+	}
+	key := proxy.cacheKey(ctx, r)
+	var stale *CachedResponse
+	policy := ctx.stalePolicy()
+	if proxy.Cache != nil {
+		if cached, ok := proxy.Cache.Get(key); ok {
+			now := time.Now()
+			if cached.Fresh(now) {
+				ctx.Logf("cache hit for %s", key)
+				return proxy.serveCached(ctx, r, cached, CacheHit), nil
+			}
+			if policy != nil && policy.WhileRevalidate && now.Before(cached.staleUntil(cached.StaleWhileRevalidate, policy)) {
+				ctx.Logf("serving stale %s while revalidating", key)
+				proxy.revalidate(ctx, key, r, cached)
+				return proxy.serveCached(ctx, r, cached, CacheStale), nil
+			}
+			stale = cached
+		}
+	}
+	ctx.CacheStatus = CacheMiss
+
+	resp, err := proxy.fetchUpstream(ctx, key, r, roundTrip)
+
+	if stale != nil && policy != nil && policy.IfError && (err != nil || resp.StatusCode >= 500) &&
+		time.Now().Before(stale.staleUntil(stale.StaleIfError, policy)) {
+		if err != nil {
+			ctx.Logf("serving stale %s on error: %v", key, err)
+		} else {
+			ctx.Logf("serving stale %s on error: %v", key, resp.Status)
+			resp.Body.Close()
+		}
+		return proxy.serveCached(ctx, r, stale, CacheStale), nil
+	}
+	return resp, err
+}
+
+// fetchUpstream gets the response to r from the upstream server, coalescing and caching it
+func (proxy *ProxyHttpServer) fetchUpstream(ctx *ProxyCtx, key string, r *http.Request, roundTrip func(*http.Request) (*http.Response, error)) (*http.Response, error) {
+	if r.Header.Get("Range") != "" {
+		return proxy.fetchRange(ctx, key, r, roundTrip)
+	}
+	if proxy.CoalesceRequests {
+		return proxy.coalescedFetch(ctx, key, r, roundTrip)
+	}
+
+	resp, err := roundTrip(r)
+	if err != nil || proxy.Cache == nil {
+		return resp, err
+	}
+	// the entry is created now, before the response handlers modify resp
+	if cached := newCachedResponse(resp, nil); cached != nil && resp.ContentLength <= proxy.maxCacheObjectSize() &&
+		!proxy.Streaming.streams(resp) {
+		resp.Body = &cachingBody{ReadCloser: resp.Body, ctx: ctx, max: proxy.maxCacheObjectSize(), store: func(body []byte) {
+			cached.Body = body
+			proxy.Cache.Set(key, cached)
+		}}
+	}
+	return resp, nil
+}
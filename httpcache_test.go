@@ -0,0 +1,106 @@
+package goproxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCoalescingAndCache(t *testing.T) {
+	var upstream int64
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&upstream, 1)
+		time.Sleep(100 * time.Millisecond)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("bobo"))
+	}))
+	defer s.Close()
+
+	proxy := NewProxyHttpServer()
+	proxy.Cache = &MemoryResponseCache{}
+	proxy.CoalesceRequests = true
+	p := httptest.NewServer(proxy)
+	defer p.Close()
+	proxyURL, _ := url.Parse(p.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	get := func() string {
+		resp, err := client.Get(s.URL + "/a?x=1")
+		if err != nil {
+			t.Error(err)
+			return ""
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return string(body)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if body := get(); body != "bobo" {
+				t.Errorf("unexpected body %q", body)
+			}
+		}()
+	}
+	wg.Wait()
+	if body := get(); body != "bobo" {
+		t.Errorf("unexpected cached body %q", body)
+	}
+	if n := atomic.LoadInt64(&upstream); n != 1 {
+		t.Errorf("expected a single upstream request, got %d", n)
+	}
+	if proxy.CoalesceHits() == 0 {
+		t.Error("expected coalesced requests")
+	}
+}
+
+func TestCoalescingKeepsPrivateResponses(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		cookie, _ := r.Cookie("session")
+		w.Header().Set("Cache-Control", "private, no-store")
+		w.Header().Set("Set-Cookie", "session="+cookie.Value)
+		w.Write([]byte(cookie.Value))
+	}))
+	defer s.Close()
+
+	proxy := NewProxyHttpServer()
+	proxy.Cache = &MemoryResponseCache{}
+	proxy.CoalesceRequests = true
+	p := httptest.NewServer(proxy)
+	defer p.Close()
+	proxyURL, _ := url.Parse(p.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		user := []string{"alice", "bob"}[i%2]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, _ := http.NewRequest("GET", s.URL+"/me", nil)
+			req.Header.Set("Cookie", "session="+user)
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer resp.Body.Close()
+			if body, _ := ioutil.ReadAll(resp.Body); string(body) != user {
+				t.Errorf("%s received the response of %q", user, body)
+			}
+		}()
+	}
+	wg.Wait()
+	if proxy.CoalesceHits() != 0 {
+		t.Errorf("expected no coalesced request, got %d", proxy.CoalesceHits())
+	}
+}
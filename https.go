@@ -7,7 +7,6 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
@@ -20,8 +19,6 @@ import (
 	"sync/atomic"
 	"syscall"
 	"time"
-
-	"github.com/miekg/dns"
 )
 
 type ConnectActionLiteral int
@@ -50,131 +47,67 @@ type ConnectAction struct {
 }
 
 func stripPort(s string) string {
-	ix := strings.IndexRune(s, ':')
-	if ix == -1 {
-		return s
-	}
-	return s[:ix]
+	return hostOnly(s)
 }
 
 func (proxy *ProxyHttpServer) dial(network, addr string) (c net.Conn, err error) {
+	return proxy.dialContext(context.Background(), network, addr)
+}
+
+// dialContext dials through proxy.Tr if it has a dialer, otherwise it resolves addr with
+// the DNS settings of the ProxyCtx carried by c, as they are at the time of the dial.
+func (proxy *ProxyHttpServer) dialContext(c context.Context, network, addr string) (net.Conn, error) {
+	if proxy.Tr.DialContext != nil {
+		return proxy.Tr.DialContext(c, network, addr)
+	}
 	if proxy.Tr.Dial != nil {
 		return proxy.Tr.Dial(network, addr)
 	}
-	return net.Dial(network, addr)
+	var d net.Dialer
+	if ctx := proxyCtxFromContext(c); ctx != nil && (ctx.DNSResolver != "" || ctx.DNSLocalAddr != "") {
+		d.Resolver = proxy.getResolver(ctx, "udp", "")
+	}
+	return d.DialContext(c, network, addr)
 }
 
 func (proxy *ProxyHttpServer) connectDial(network, addr string) (c net.Conn, err error) {
+	return proxy.connectDialContext(context.Background(), network, addr)
+}
+
+func (proxy *ProxyHttpServer) connectDialContext(c context.Context, network, addr string) (net.Conn, error) {
 	if proxy.ConnectDial == nil {
-		return proxy.dial(network, addr)
+		return proxy.dialContext(c, network, addr)
 	}
 	return proxy.ConnectDial(network, addr)
 }
 
-func (proxy *ProxyHttpServer) resolveDomain(proxyCtx *ProxyCtx, proto, domain, resolver string) (ips []string, ips6 []string, err error) {
-
-	if resolver == "" {
-		resolver = "127.0.0.1:53"
-	}
-
-	proxyCtx.Logf("resolving domain %s via %s", domain, resolver)
-
-	// resolve it manually and set the bootstrap ip
-	c := new(dns.Client)
-
-	c.Net = proto
-	c.DialTimeout = proxyCtx.DNSTimeout
-	c.ReadTimeout = proxyCtx.DNSTimeout
-	c.WriteTimeout = proxyCtx.DNSTimeout
-
-	localAddr := net.JoinHostPort(proxyCtx.DNSLocalAddr, "0")
-
-	if proxyCtx.DNSLocalAddr != "" {
-		c.Dialer = &net.Dialer{Timeout: c.DialTimeout}
-		if proto == "udp" {
-			udpAddr, err := net.ResolveUDPAddr("udp", localAddr)
-			if err != nil {
-				return ips, ips6, err
-			}
-			c.Dialer.LocalAddr = udpAddr
-		} else if proto == "tcp" {
-			tcpAddr, err := net.ResolveTCPAddr("tcp", localAddr)
-			if err != nil {
-				return ips, nil, err
-			}
-			c.Dialer.LocalAddr = tcpAddr
+// resolveDomain resolves domain through r and splits the addresses by family. IP literals are
+// returned as they are, with their zone ID if any, without querying r.
+func (proxy *ProxyHttpServer) resolveDomain(proxyCtx *ProxyCtx, r Resolver, domain string) (ips []string, ips6 []string, err error) {
+	if ip := ipLiteral(domain); ip != nil {
+		if ip.To4() != nil {
+			return []string{ip.String()}, nil, nil
 		}
+		return nil, []string{domain}, nil
 	}
-
-	// TODO: make these requests in parallel
-
-	m := new(dns.Msg)
-	m.SetQuestion(domain+".", dns.TypeA)
-
-	if ip, ipNet, err := net.ParseCIDR(proxyCtx.EDNSClientSubnetV4); err == nil {
-
-		eDNS0Subnet := new(dns.EDNS0_SUBNET)
-		eDNS0Subnet.Code = dns.EDNS0SUBNET
-		eDNS0Subnet.SourceScope = 0
-		eDNS0Subnet.Address = ip
-		eDNS0Subnet.Family = 1
-		ones, _ := ipNet.Mask.Size()
-		eDNS0Subnet.SourceNetmask = uint8(ones)
-		m.SetEdns0(dns.DefaultMsgSize, false)
-		opt := m.IsEdns0()
-		opt.Option = append(opt.Option, eDNS0Subnet)
-
-	}
-
-	r, _, err4 := c.Exchange(m, resolver)
-
-	if err4 == nil {
-		if r.Rcode == dns.RcodeSuccess {
-			for _, a := range r.Answer {
-				if ar, ok := a.(*dns.A); ok {
-					ips = append(ips, ar.A.String())
-				}
-			}
-		}
+	if r == nil {
+		return nil, nil, errNoResolver
 	}
 
-	m = new(dns.Msg)
-	m.SetQuestion(domain+".", dns.TypeAAAA)
-
-	if ip, ipNet, err := net.ParseCIDR(proxyCtx.EDNSClientSubnetV6); err == nil {
-
-		eDNS0Subnet := new(dns.EDNS0_SUBNET)
-		eDNS0Subnet.Code = dns.EDNS0SUBNET
-		eDNS0Subnet.SourceScope = 0
-		eDNS0Subnet.Address = ip
-		eDNS0Subnet.Family = 2
-		ones, _ := ipNet.Mask.Size()
-		eDNS0Subnet.SourceNetmask = uint8(ones)
-		m.SetEdns0(dns.DefaultMsgSize, false)
-		opt := m.IsEdns0()
-		opt.Option = append(opt.Option, eDNS0Subnet)
+	proxyCtx.Logf("resolving domain %s via %v", domain, r)
 
+	addrs, err := r.LookupIP(withProxyCtx(context.Background(), proxyCtx), domain, proxyCtx.lookupHints("ip"))
+	if err != nil {
+		return ips, ips6, err
 	}
-
-	r, _, err6 := c.Exchange(m, resolver)
-
-	if err6 == nil {
-		if r.Rcode == dns.RcodeSuccess {
-			for _, a := range r.Answer {
-				if ar, ok := a.(*dns.AAAA); ok {
-					ips6 = append(ips6, ar.AAAA.String())
-				}
-			}
+	for _, addr := range addrs {
+		if addr.To4() != nil {
+			ips = append(ips, addr.String())
+		} else {
+			ips6 = append(ips6, addr.String())
 		}
 	}
-
-	if len(ips) == 0 && len(ips6) == 0 {
-		err := fmt.Errorf("v4: %+v - v6: %+v", err4, err6)
-		return ips, ips6, err
-	}
-
 	return ips, ips6, nil
-
 }
 
 func (proxy *ProxyHttpServer) getTargetSiteConnection(ctx *ProxyCtx, proxyClient net.Conn, host string) (sendHTTPOK bool, setTargetKA bool, logHeaders http.Header, targetSiteCon net.Conn, err error) {
@@ -193,20 +126,15 @@ func (proxy *ProxyHttpServer) getTargetSiteConnection(ctx *ProxyCtx, proxyClient
 	var dialHost string
 
 	var targetDomain, targetPort string
-	if len(strings.Split(host, ":")) > 1 {
-		targetDomain, targetPort, err = net.SplitHostPort(host)
-		if err != nil {
-			return
-		}
-	} else {
-		targetPort = "443" // fallback on 443 if no port given
-		targetDomain = host
-	}
+	// fallback on 443 if no port given
+	targetDomain, targetPort = splitHostPort(host, "443")
 
-	ips, ips6, err := proxy.resolveDomain(ctx, "udp", targetDomain, ctx.DNSResolver)
-	if err != nil && ctx.BackupDNSResolver != "" {
-		ips, ips6, err = proxy.resolveDomain(ctx, "udp", targetDomain, ctx.BackupDNSResolver)
+	ctx.traceDNSStart(targetDomain)
+	ips, ips6, err := proxy.resolveDomain(ctx, ctx.primaryResolver("udp"), targetDomain)
+	if backup := ctx.backupResolver("udp"); err != nil && backup != nil {
+		ips, ips6, err = proxy.resolveDomain(ctx, backup, targetDomain)
 	}
+	ctx.traceDNSDone(append(append([]string{}, ips...), ips6...), err)
 
 	// if this is an ipv6 only endpoint, and we have a forward proxy, exit locally instead
 	// this is because the proxy does not support ipv6 yet
@@ -226,7 +154,7 @@ func (proxy *ProxyHttpServer) getTargetSiteConnection(ctx *ProxyCtx, proxyClient
 			setTargetKA = false
 		}
 
-		ctx.Logf("dial %v via forward proxy: %v %+v", host, ctx.ForwardProxyProto, ctx.ForwardProxy)
+		ctx.Debugf(DebugDial, "dial %v via forward proxy: %v %+v", host, ctx.ForwardProxyProto, ctx.ForwardProxy)
 
 		tlsTimeout := ctx.ForwardProxyTLSTimeout
 		if tlsTimeout == 0 {
@@ -281,7 +209,7 @@ func (proxy *ProxyHttpServer) getTargetSiteConnection(ctx *ProxyCtx, proxyClient
 
 		tlsTime := float64(dialEnd/1000000) - float64(dialStart/1000000)
 
-		ctx.Logf("dialing to proxy %s completed in %dms", ctx.ForwardProxy, int(tlsTime))
+		ctx.Debugf(DebugDial, "dialing to proxy %s completed in %dms", ctx.ForwardProxy, int(tlsTime))
 
 		if ctx.ForwardMetricsCounters.TLSTimes != nil {
 			metric := *ctx.ForwardMetricsCounters.TLSTimes
@@ -290,11 +218,6 @@ func (proxy *ProxyHttpServer) getTargetSiteConnection(ctx *ProxyCtx, proxyClient
 
 	} else if ctx.ForwardProxyDirect && ctx.ForwardProxySourceIP != "" {
 
-		tlsTimeout := ctx.ForwardProxyTLSTimeout
-		if tlsTimeout == 0 {
-			tlsTimeout = 15
-		}
-
 		//save v4 addresses for reference
 		ips4 := ips
 		v4SourceAddress := ctx.ForwardProxySourceIP
@@ -309,56 +232,49 @@ func (proxy *ProxyHttpServer) getTargetSiteConnection(ctx *ProxyCtx, proxyClient
 			ipProto = "tcp6"
 		}
 
-		if err != nil || len(ips) == 0 {
-			dialHost = host
-		} else {
-			dialHost = net.JoinHostPort(ips[0], targetPort)
+		dialHosts := []string{host}
+		if err == nil && len(ips) > 0 {
+			dialHosts = dialHosts[:0]
+			for _, ip := range ips {
+				dialHosts = append(dialHosts, net.JoinHostPort(ip, targetPort))
+			}
 		}
+		dialHost = dialHosts[0]
 
-		ctx.Logf("dial %v (%s) locally from: %+v", host, dialHost, ctx.ForwardProxySourceIP)
+		ctx.Debugf(DebugDial, "dial %v (%s) locally from: %+v", host, dialHost, ctx.ForwardProxySourceIP)
 
 		// dont use a proxy and use specific source IP
-		tr := &http.Transport{
-			Proxy: http.ProxyFromEnvironment,
-			Dial: func(network, address string) (net.Conn, error) {
-				localAddr, err := net.ResolveTCPAddr(network, net.JoinHostPort(ctx.ForwardProxySourceIP, "0"))
-				if err != nil {
-					ctx.Logf("Failed to resolve local address: %s - err: %v", ctx.ForwardProxySourceIP, err)
-					return nil, err
-				}
-				dialTimeout := ctx.ForwardProxyDialTimeout
-				if dialTimeout == 0 {
-					dialTimeout = 20
-				}
-				d := net.Dialer{
-					Timeout:   time.Duration(dialTimeout) * time.Second,
-					LocalAddr: localAddr,
-					Resolver:  proxy.getResolver(ctx, "udp", ""),
-				}
-				ctx.Logf("dial debug network: %v host: %v address: %s localAddr: %s", network, host, address, localAddr.String())
-				return d.Dial(network, address)
-			},
-			MaxIdleConns:          ctx.MaxIdleConns,
-			MaxIdleConnsPerHost:   ctx.MaxIdleConnsPerHost,
-			MaxConnsPerHost:       ctx.MaxConnsPerHost,
-			TLSHandshakeTimeout:   time.Duration(tlsTimeout) * time.Second,
-			ExpectContinueTimeout: 1 * time.Second,
-			IdleConnTimeout:       idleTimeout,
-			DisableKeepAlives:     ctx.ForwardDisableHTTPKeepAlives,
+		dialTimeout := ctx.ForwardProxyDialTimeout
+		if dialTimeout == 0 {
+			dialTimeout = 20
+		}
+		dial := func(network, address string, timeout time.Duration) (net.Conn, error) {
+			localAddr, err := net.ResolveTCPAddr(network, net.JoinHostPort(ctx.ForwardProxySourceIP, "0"))
+			if err != nil {
+				ctx.Logf("Failed to resolve local address: %s - err: %v", ctx.ForwardProxySourceIP, err)
+				return nil, err
+			}
+			d := net.Dialer{
+				Timeout:   timeout,
+				LocalAddr: localAddr,
+				Resolver:  proxy.getResolver(ctx, "udp", ""),
+			}
+			ctx.Debugf(DebugDial, "dial debug network: %v host: %v address: %s localAddr: %s", network, host, address, localAddr.String())
+			return ctx.tracedDial(&d, network, address)
 		}
 
 		dialStart := time.Now().UnixNano()
 
-		targetSiteCon, err = tr.Dial(ipProto, dialHost)
+		targetSiteCon, err = ctx.dialAddrs(ipProto, dialHosts, time.Duration(dialTimeout)*time.Second, dial)
 
 		dialEnd := time.Now().UnixNano()
 
 		tlsTime := float64(dialEnd/1000000) - float64(dialStart/1000000)
 
-		ctx.Logf("dialing to host %s completed in %dms", dialHost, int(tlsTime))
+		ctx.Debugf(DebugDial, "dialing to host %s completed in %dms", dialHost, int(tlsTime))
 
 		if ipv6Dial && err != nil && len(ips4) > 0 {
-			ctx.Logf("retrying via ipv4 %s", v4SourceAddress)
+			ctx.Debugf(DebugDial, "retrying via ipv4 %s", v4SourceAddress)
 			ctx.ForwardProxySourceIP = v4SourceAddress
 			ctx.ForwardProxySourceIPv6 = ""
 			return ctx.Proxy.getTargetSiteConnection(ctx, proxyClient, host)
@@ -366,7 +282,7 @@ func (proxy *ProxyHttpServer) getTargetSiteConnection(ctx *ProxyCtx, proxyClient
 
 	} else if ctx.ForwardProxyTProxy {
 
-		ctx.Logf("dialing %v via TPROXY from: %s -> %s", host, ctx.ForwardProxySourceIP, proxyClient.LocalAddr().String())
+		ctx.Debugf(DebugDial, "dialing %v via TPROXY from: %s -> %s", host, ctx.ForwardProxySourceIP, proxyClient.LocalAddr().String())
 
 		tcpLocal, errTCP := net.ResolveTCPAddr("tcp", fmt.Sprintf("%s:0", ctx.ForwardProxySourceIP))
 		if errTCP != nil {
@@ -390,7 +306,7 @@ func (proxy *ProxyHttpServer) getTargetSiteConnection(ctx *ProxyCtx, proxyClient
 					LocalAddr: tcpLocal,
 					Resolver:  proxy.getResolver(ctx, "udp", ""),
 				}
-				targetSiteCon, err = d.Dial("tcp", proxyClient.LocalAddr().String())
+				targetSiteCon, err = ctx.tracedDial(&d, "tcp", proxyClient.LocalAddr().String())
 				// targetSiteCon, err = net.DialTCP("tcp", tcpLocal, tcpRemote)
 			} else {
 				err = errTCP
@@ -398,7 +314,9 @@ func (proxy *ProxyHttpServer) getTargetSiteConnection(ctx *ProxyCtx, proxyClient
 		}
 
 	} else {
-		targetSiteCon, err = proxy.connectDial("tcp", host)
+		targetSiteCon, err = ctx.tracedDialFunc(func(network, addr string) (net.Conn, error) {
+			return proxy.connectDialContext(withProxyCtx(context.Background(), ctx), network, addr)
+		}, "tcp", host)
 		sendHTTPOK = true
 	}
 
@@ -407,9 +325,7 @@ func (proxy *ProxyHttpServer) getTargetSiteConnection(ctx *ProxyCtx, proxyClient
 
 func (proxy *ProxyHttpServer) handleHttpsConnectAccept(ctx *ProxyCtx, host string, proxyClient net.Conn) {
 
-	if !hasPort.MatchString(host) {
-		host += ":80"
-	}
+	host = withPort(host, proxy.defaultPort("https"))
 	var targetSiteCon net.Conn
 	var err error
 	var logHeaders http.Header
@@ -419,7 +335,11 @@ func (proxy *ProxyHttpServer) handleHttpsConnectAccept(ctx *ProxyCtx, host strin
 	ctx.Logf("client type: %+v", reflect.TypeOf(proxyClient))
 	ctx.Logf("client info: %s -> %s", proxyClient.LocalAddr().String(), proxyClient.RemoteAddr().String())
 
+	proxy.routeLocal(ctx, host)
+
 	// init target connection
+	ctx.traceUpstream(host, nil)
+	ctx.traceGetConn(host)
 	sendHTTPOK, setTargetKA, logHeaders, targetSiteCon, err = proxy.getTargetSiteConnection(ctx, proxyClient, host)
 
 	if err != nil || targetSiteCon == nil {
@@ -441,7 +361,7 @@ func (proxy *ProxyHttpServer) handleHttpsConnectAccept(ctx *ProxyCtx, host strin
 		if ctx.ForwardProxyErrorFallback != nil {
 			todo := OkConnect
 			for i, h := range proxy.httpsHandlers {
-				newtodo, newhost := h.HandleConnect(host, ctx)
+				newtodo, newhost := ctx.handleConnect(h, host)
 				// If found a result, break the loop immediately
 				if newtodo != nil {
 					todo, host = newtodo, newhost
@@ -457,22 +377,35 @@ func (proxy *ProxyHttpServer) handleHttpsConnectAccept(ctx *ProxyCtx, host strin
 			}
 		}
 
-		c4, c6, err := proxy.resolveDomain(ctx, "udp", strings.Split(host, ":")[0], ctx.DNSResolver)
+		// retry through the next forward proxy of the chain, if any
+		if ctx.nextFallback(err) {
+			proxy.handleHttpsConnectAccept(ctx, host, proxyClient)
+			return
+		}
+
+		if ctx.ForwardProxy == "" {
+			ctx.connFailed(host, nil)
+		}
+		c4, c6, _ := proxy.resolveDomain(ctx, ctx.primaryResolver("udp"), hostOnly(host))
 		if len(c4) > 0 || len(c6) > 0 {
 			ctx.Logf("error-metric: https to host: %s failed: %v - headers %+v", host, err, logHeaders)
 			ctx.SetErrorMetric()
 		}
-		httpError(proxyClient, ctx, err)
+		ctx.Errorf("CONNECT to %s failed: %v", host, err)
+		proxy.connectError(ctx, proxyClient, err)
 		return
 	}
 
-	// only send HTTP OK if this is not a transparent proxy request
-	if sendHTTPOK {
-		proxyClient.Write([]byte("HTTP/1.0 200 OK\r\n\r\n"))
+	// only answer the CONNECT if this is not a transparent proxy request, the SOCKS5 clients
+	// always wait for their reply
+	if _, socks := proxyClient.(*socks5Client); sendHTTPOK || socks {
+		proxy.writeConnectEstablished(ctx, proxyClient)
 	}
 
 	ctx.Logf("targetSiteCon type: %+v", reflect.TypeOf(targetSiteCon))
-	ctx.Logf("targetSiteCon info: %s -> %s", targetSiteCon.LocalAddr().String(), targetSiteCon.RemoteAddr().String())
+	ctx.Debugf(DebugDial, "dial trace: %v", ctx.DialTrace)
+	ctx.traceGotConn(targetSiteCon)
+	ctx.Debugf(DebugTunnel, "targetSiteCon info: %s -> %s", targetSiteCon.LocalAddr().String(), targetSiteCon.RemoteAddr().String())
 
 	//This is a hack for now to support tproxy metrics and local forward request metrics
 	if ctx.ForwardProxy == "" && (ctx.ForwardProxyTProxy || ctx.ForwardProxyLocalRequest) {
@@ -533,17 +466,43 @@ func (proxy *ProxyHttpServer) handleHttpsConnectAccept(ctx *ProxyCtx, host strin
 		}
 	}
 
-	var wg sync.WaitGroup
-	wg.Add(2)
-	cancelCtx, cancel := context.WithCancel(context.Background())
+	proxy.setSessionCloser(ctx, func() {
+		clientConn.Conn.Close()
+		targetConn.Conn.Close()
+	})
+
+	wc := ctx.writeCoalescing()
+	if wc != nil && wc.Nagle {
+		enableNagle(clientConn)
+		enableNagle(targetConn)
+	}
 
-	go copyAndClose(cancelCtx, cancel, ctx, targetConn, clientConn, "sent", &wg)
-	go copyAndClose(cancelCtx, cancel, ctx, clientConn, targetConn, "recv", &wg)
-	wg.Wait()
+	engine := ctx.tunnelEngine()
+	var relayed bool
+	var relayErr error
+	if engine == TunnelEngineEpoll && wc == nil {
+		ctx.BytesSent, ctx.BytesReceived, relayed, relayErr = relayEpoll(clientConn, targetConn)
+	}
+	if !relayed {
+		engine = TunnelEngineGoroutines
+		var wg sync.WaitGroup
+		wg.Add(2)
+		cancelCtx, cancel := context.WithCancel(context.Background())
+
+		go copyAndClose(cancelCtx, cancel, ctx, targetConn, clientConn, "sent", &wg)
+		go copyAndClose(cancelCtx, cancel, ctx, clientConn, targetConn, "recv", &wg)
+		wg.Wait()
+	}
+	if relayErr != nil {
+		ctx.Debugf(DebugTunnel, "tunnel to %s failed: %v", host, relayErr)
+	}
+	proxy.countTunnel(engine, ctx.BytesSent+ctx.BytesReceived, relayErr)
+	ctx.Debugf(DebugTunnel, "tunnel to %s closed, wrote %d bytes, read %d bytes", host, targetConn.BytesWrote, targetConn.BytesRead)
 	if ctx.ForwardMetricsCounters.ProxyBandwidth != nil {
 		metric := *ctx.ForwardMetricsCounters.ProxyBandwidth
 		metric.Add(float64(targetConn.BytesWrote + targetConn.BytesRead))
 	}
+	proxy.account(ctx)
 	targetConn.Conn.Close()
 	clientConn.Conn.Close()
 	if ctx.Tail != nil {
@@ -552,8 +511,23 @@ func (proxy *ProxyHttpServer) handleHttpsConnectAccept(ctx *ProxyCtx, host strin
 }
 
 func (proxy *ProxyHttpServer) HandleHttps(w http.ResponseWriter, r *http.Request, conn *net.Conn) {
+	if proxy.fastPath() {
+		var client net.Conn
+		if conn != nil {
+			client = *conn
+		}
+		proxy.relayTunnel(w, r, client)
+		return
+	}
 
-	ctx := &ProxyCtx{Req: r, Session: atomic.AddInt64(&proxy.sess, 1), Proxy: proxy, certStore: proxy.CertStore}
+	ctx := proxy.acquireCtx(r, proxy.config().pooled)
+	ctx.Target = proxy.target(r)
+	defer ctx.release()
+	defer ctx.freeMemory()
+	if id := proxy.startTrace(ctx, r); id != "" {
+		ctx.SetConnectHeader(TraceIDHeader, id)
+		defer ctx.finishTrace()
+	}
 
 	var proxyClient net.Conn
 
@@ -563,11 +537,11 @@ func (proxy *ProxyHttpServer) HandleHttps(w http.ResponseWriter, r *http.Request
 		if !ok {
 			panic("httpserver does not support hijacking")
 		}
-		var e error
-		proxyClient, _, e = hij.Hijack()
+		conn, brw, e := hij.Hijack()
 		if e != nil {
 			panic("Cannot hijack connection " + e.Error())
 		}
+		proxyClient = hijackedConn(conn, brw)
 	} else {
 		proxyClient = *conn
 		ctx.Logf("using provided proxyClient: %v, type %v", proxyClient, reflect.TypeOf(proxyClient))
@@ -577,8 +551,10 @@ func (proxy *ProxyHttpServer) HandleHttps(w http.ResponseWriter, r *http.Request
 	ctx.ProxyTargetAddress = proxyClient.LocalAddr().String()
 
 	todo, host := OkConnect, r.URL.Host
-	for _, h := range proxy.httpsHandlers {
-		newtodo, newhost := h.HandleConnect(host, ctx)
+	for i, h := range proxy.httpsHandlers {
+		start := time.Now()
+		newtodo, newhost := ctx.handleConnect(h, host)
+		ctx.traceConnectHandler(proxy.httpsHandlerInfos[i].Name, start, newtodo, newhost)
 		// If found a result, break the loop immediately
 		if newtodo != nil {
 			todo, host = newtodo, newhost
@@ -586,18 +562,29 @@ func (proxy *ProxyHttpServer) HandleHttps(w http.ResponseWriter, r *http.Request
 			break
 		}
 	}
+	if todo.Action != ConnectReject && todo.Action != ConnectProxyAuthHijack {
+		if resp := proxy.failClosed(ctx); resp != nil {
+			ctx.Resp = resp
+			todo = RejectConnect
+		} else if resp := proxy.drained(ctx, host); resp != nil {
+			ctx.Resp = resp
+			todo = RejectConnect
+		}
+	}
 	switch todo.Action {
 	case ConnectAccept:
 
+		defer proxy.trackSession(ctx, SessionTunnel, host)()
 		proxy.handleHttpsConnectAccept(ctx, host, proxyClient)
 
 	case ConnectHijack:
-		ctx.Logf("Hijacking CONNECT to %s", host)
-		proxyClient.Write([]byte("HTTP/1.0 200 OK\r\n\r\n"))
-		todo.Hijack(r, proxyClient, ctx)
+		ctx.keep()
+		ctx.Debugf(DebugTunnel, "Hijacking CONNECT to %s", host)
+		proxy.writeConnectEstablished(ctx, proxyClient)
+		ctx.hijack(todo, r, proxyClient)
 	case ConnectHTTPMitm:
-		proxyClient.Write([]byte("HTTP/1.0 200 OK\r\n\r\n"))
-		ctx.Logf("Assuming CONNECT is plain HTTP tunneling, mitm proxying it")
+		proxy.writeConnectEstablished(ctx, proxyClient)
+		ctx.Debugf(DebugMitm, "Assuming CONNECT is plain HTTP tunneling, mitm proxying it")
 		targetSiteCon, err := proxy.connectDial("tcp", host)
 		if err != nil {
 			ctx.Warnf("Error dialing to %s: %s", host, err.Error())
@@ -619,17 +606,38 @@ func (proxy *ProxyHttpServer) HandleHttps(w http.ResponseWriter, r *http.Request
 			if ctx.Cancel != nil {
 				defer ctx.Cancel()
 			}
+			if resp == nil && isUpgradeRequest(req) && !isWebSocketRequest(req) {
+				resp = proxy.refuseUpgrade(ctx, req)
+			}
 			if resp == nil {
+				if expectsContinue(req) {
+					req.Body = &continueSender{ReadCloser: req.Body, client: proxyClient}
+				}
 				if err := req.Write(targetSiteCon); err != nil {
 					httpError(proxyClient, ctx, err)
 					return
 				}
-				resp, err = http.ReadResponse(remote, req)
+				resp, err = readFinalResponse(remote, req, nil)
 				if err != nil {
 					httpError(proxyClient, ctx, err)
 					return
 				}
+				if resp.StatusCode == http.StatusSwitchingProtocols && isUpgradeRequest(req) {
+					if err := writeUpgradeResponse(proxyClient, resp); err != nil {
+						return
+					}
+					relay := proxy.relayUpgrade
+					if isWebSocketRequest(req) {
+						relay = proxy.relayWebSocket
+					}
+					relay(ctx, client, proxyClient, remote, targetSiteCon, func() {
+						proxyClient.Close()
+						targetSiteCon.Close()
+					})
+					return
+				}
 				defer resp.Body.Close()
+				resp = proxy.validateResponseHeaders(resp, ctx)
 			}
 			resp = proxy.filterResponse(resp, ctx)
 			if err := resp.Write(proxyClient); err != nil {
@@ -638,21 +646,33 @@ func (proxy *ProxyHttpServer) HandleHttps(w http.ResponseWriter, r *http.Request
 			}
 		}
 	case ConnectMitm:
-		proxyClient.Write([]byte("HTTP/1.0 200 OK\r\n\r\n"))
-		ctx.Logf("Assuming CONNECT is TLS, mitm proxying it")
+		ctx.keep()
+		proxy.writeConnectEstablished(ctx, proxyClient)
+		ctx.Debugf(DebugMitm, "Assuming CONNECT is TLS, mitm proxying it")
 		// this goes in a separate goroutine, so that the net/http server won't think we're
 		// still handling the request even after hijacking the connection. Those HTTP CONNECT
 		// request can take forever, and the server will be stuck when "closed".
 		// TODO: Allow Server.Close() mechanism to shut down this connection as nicely as possible
 		tlsConfig := defaultTLSConfig
-		if todo.TLSConfig != nil {
+		configTLS := todo.TLSConfig
+		if t := ctx.Tenant(); t != nil && t.CA != nil {
+			cfg := *ctx.config()
+			cfg.certStore = t.CertStore
+			ctx.cfg = &cfg
+			configTLS = TLSConfigFromCA(t.CA)
+		}
+		if configTLS != nil {
 			var err error
-			tlsConfig, err = todo.TLSConfig(host, ctx)
+			tlsConfig, err = configTLS(host, ctx)
 			if err != nil {
 				httpError(proxyClient, ctx, err)
 				return
 			}
 		}
+		if proxy.GRPC != nil {
+			tlsConfig = tlsConfig.Clone()
+			tlsConfig.NextProtos = []string{"h2", "http/1.1"}
+		}
 		go func() {
 			//TODO: cache connections to the remote website
 			rawClientTls := tls.Server(proxyClient, tlsConfig)
@@ -660,11 +680,25 @@ func (proxy *ProxyHttpServer) HandleHttps(w http.ResponseWriter, r *http.Request
 				ctx.Warnf("Cannot handshake client %v %v", r.Host, err)
 				return
 			}
+			state := rawClientTls.ConnectionState()
+			ctx.Debugf(DebugTLS, "handshake with client for %v: version %x, cipher suite %x", r.Host, state.Version, state.CipherSuite)
 			defer rawClientTls.Close()
+			if state.NegotiatedProtocol == "h2" {
+				proxy.serveMitmHTTP2(ctx, r, rawClientTls)
+				return
+			}
 			clientTlsReader := bufio.NewReader(rawClientTls)
+			// the memory of each request is freed once it is served, and that of the request
+			// being served when the connection is given up on
+			var serving *ProxyCtx
+			defer func() {
+				if serving != nil {
+					serving.freeMemory()
+				}
+			}()
 			for !isEof(clientTlsReader) {
 				req, err := http.ReadRequest(clientTlsReader)
-				var ctx = &ProxyCtx{Req: req, Session: atomic.AddInt64(&proxy.sess, 1), Proxy: proxy, UserData: ctx.UserData}
+				var ctx = &ProxyCtx{Req: req, Session: atomic.AddInt64(&proxy.sess, 1), Proxy: proxy, UserData: ctx.UserData, values: ctx.cloneValues(), tags: ctx.Tags(), received: time.Now()}
 				if err != nil && err != io.EOF {
 					return
 				}
@@ -672,8 +706,12 @@ func (proxy *ProxyHttpServer) HandleHttps(w http.ResponseWriter, r *http.Request
 					ctx.Warnf("Cannot read TLS request from mitm'd client %v %v", r.Host, err)
 					return
 				}
+				serving = ctx
 				req.RemoteAddr = r.RemoteAddr // since we're converting the request, need to carry over the original connecting IP as well
-				ctx.Logf("req %v", r.Host)
+				if expectsContinue(req) {
+					req.Body = &continueSender{ReadCloser: req.Body, client: rawClientTls}
+				}
+				ctx.Debugf(DebugMitm, "req %v", r.Host)
 
 				if !httpsRegexp.MatchString(req.URL.String()) {
 					req.URL, err = url.Parse("https://" + r.Host + req.URL.String())
@@ -682,6 +720,7 @@ func (proxy *ProxyHttpServer) HandleHttps(w http.ResponseWriter, r *http.Request
 				// Bug fix which goproxy fails to provide request
 				// information URL in the context when does HTTPS MITM
 				ctx.Req = req
+				ctx.Target = proxy.target(req)
 
 				req, resp := proxy.filterRequest(req, ctx)
 				// If a cancel function is set, ensure we call it when
@@ -689,20 +728,44 @@ func (proxy *ProxyHttpServer) HandleHttps(w http.ResponseWriter, r *http.Request
 				if ctx.Cancel != nil {
 					defer ctx.Cancel()
 				}
+				if resp == nil {
+					resp = proxy.failClosed(ctx)
+				}
 				if resp == nil {
 					if err != nil {
 						ctx.Warnf("Illegal URL %s", "https://"+r.Host+req.URL.Path)
 						return
 					}
+					if isWebSocketRequest(req) {
+						proxy.serveWebSocket(ctx, req, clientTlsReader, rawClientTls)
+						return
+					}
+					if isUpgradeRequest(req) {
+						proxy.serveUpgrade(ctx, req, clientTlsReader, rawClientTls)
+						return
+					}
 					removeProxyHeaders(ctx, req)
-					resp, err = ctx.RoundTrip(req)
+					ctx.setUpstreamAcceptEncoding(req)
+					resp, err = proxy.fetch(ctx, req, func(req *http.Request) (*http.Response, error) {
+						resp, err := ctx.RoundTrip(req)
+						if err == nil {
+							resp, err = ctx.followRedirects(req, resp)
+						}
+						return resp, err
+					})
 					if err != nil {
 						ctx.Warnf("Cannot read TLS response from mitm'd server %v", err)
+						ctx.finishIdempotent()
 						return
 					}
-					ctx.Logf("resp %v", resp.Status)
+					ctx.Debugf(DebugMitm, "resp %v", resp.Status)
+					resp = proxy.validateResponseHeaders(resp, ctx)
+					proxy.prefetch(ctx, resp)
 				}
+				ctx.streaming = proxy.Streaming.streams(resp)
 				resp = proxy.filterResponse(resp, ctx)
+				resp = ctx.recordIdempotent(resp)
+				resp = ctx.encodeForClient(resp)
 				defer resp.Body.Close()
 
 				text := resp.Status
@@ -711,6 +774,7 @@ func (proxy *ProxyHttpServer) HandleHttps(w http.ResponseWriter, r *http.Request
 					text = text[len(statusCode):]
 				}
 				// always use 1.1 to support chunked encoding
+				ctx.markFirstByte()
 				if _, err := io.WriteString(rawClientTls, "HTTP/1.1"+" "+statusCode+text+"\r\n"); err != nil {
 					ctx.Warnf("Cannot write TLS response HTTP status from mitm'd client: %v", err)
 					return
@@ -721,6 +785,8 @@ func (proxy *ProxyHttpServer) HandleHttps(w http.ResponseWriter, r *http.Request
 				resp.Header.Set("Transfer-Encoding", "chunked")
 				// Force connection close otherwise chrome will keep CONNECT tunnel open forever
 				resp.Header.Set("Connection", "close")
+				announceTrailers(resp.Header, resp)
+				ctx.annotateResponse(resp.Header)
 				if err := resp.Header.Write(rawClientTls); err != nil {
 					ctx.Warnf("Cannot write TLS response header from mitm'd client: %v", err)
 					return
@@ -730,7 +796,20 @@ func (proxy *ProxyHttpServer) HandleHttps(w http.ResponseWriter, r *http.Request
 					return
 				}
 				chunked := newChunkedWriter(rawClientTls)
-				if _, err := io.Copy(chunked, resp.Body); err != nil {
+				var n int64
+				if ctx.streaming {
+					n, err = copyStreaming(chunked, resp)
+				} else {
+					n, err = io.Copy(chunked, resp.Body)
+				}
+				ctx.markResponseDone()
+				proxy.SLO.observe(ctx, resp.StatusCode)
+				ctx.BytesReceived += n
+				if req.ContentLength > 0 {
+					ctx.BytesSent += req.ContentLength
+				}
+				proxy.account(ctx)
+				if err != nil {
 					ctx.Warnf("Cannot write TLS response body from mitm'd client: %v", err)
 					return
 				}
@@ -738,16 +817,22 @@ func (proxy *ProxyHttpServer) HandleHttps(w http.ResponseWriter, r *http.Request
 					ctx.Warnf("Cannot write TLS chunked EOF from mitm'd client: %v", err)
 					return
 				}
+				if err := resp.Trailer.Write(rawClientTls); err != nil {
+					ctx.Warnf("Cannot write TLS response trailers from mitm'd client: %v", err)
+					return
+				}
 				if _, err = io.WriteString(rawClientTls, "\r\n"); err != nil {
 					ctx.Warnf("Cannot write TLS response chunked trailer from mitm'd client: %v", err)
 					return
 				}
+				ctx.freeMemory()
 			}
-			ctx.Logf("Exiting on EOF")
+			ctx.Debugf(DebugMitm, "Exiting on EOF")
 		}()
 	case ConnectProxyAuthHijack:
+		ctx.keep()
 		proxyClient.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n"))
-		todo.Hijack(r, proxyClient, ctx)
+		ctx.hijack(todo, r, proxyClient)
 	case ConnectReject:
 		if ctx.Resp != nil {
 			if err := ctx.Resp.Write(proxyClient); err != nil {
@@ -778,15 +863,29 @@ func copyAndClose(ctx context.Context, cancel context.CancelFunc, proxyCtx *Prox
 	defer cancel()
 	defer wg.Done()
 
-	size := 32 * 1024
-	if proxyCtx.CopyBufferSize > 0 {
-		size = proxyCtx.CopyBufferSize * 1024
+	var buf []byte
+	var adaptive *adaptiveBuffer
+	if policy := proxyCtx.adaptiveBuffers(); policy != nil {
+		adaptive = newAdaptiveBuffer(policy)
+		defer adaptive.release()
+		buf = adaptive.bytes()
+	} else if proxyCtx.CopyBufferSize > 0 && proxyCtx.CopyBufferSize*1024 != copyBufferSize {
+		buf = make([]byte, proxyCtx.CopyBufferSize*1024)
+	} else {
+		pooled := copyBuffers.Get().(*[]byte)
+		defer copyBuffers.Put(pooled)
+		buf = *pooled
 	}
-
-	buf := make([]byte, size)
 	var written int64
 	var err error
 
+	var w io.Writer = dst
+	if wc := proxyCtx.writeCoalescing(); wc != nil {
+		cw := newCoalescingWriter(dst, wc)
+		defer cw.Flush()
+		w = cw
+	}
+
 	// Defer this logic to ensure we always set the bytes sent/received
 	// regardless of the return condition.
 	defer func() {
@@ -813,7 +912,7 @@ func copyAndClose(ctx context.Context, cancel context.CancelFunc, proxyCtx *Prox
 		default:
 		}
 		if nr > 0 {
-			nw, ew := dst.Write(buf[0:nr])
+			nw, ew := w.Write(buf[0:nr])
 			if nw > 0 {
 				written += int64(nw)
 			}
@@ -830,6 +929,9 @@ func copyAndClose(ctx context.Context, cancel context.CancelFunc, proxyCtx *Prox
 				break
 			}
 		}
+		if adaptive != nil {
+			buf = adaptive.adapt(nr)
+		}
 		if er != nil {
 			if (errors.Is(er, os.ErrDeadlineExceeded) || errors.Is(er, syscall.ETIMEDOUT)) && src.IgnoreDeadlineErrors {
 				continue
@@ -901,10 +1003,22 @@ func dialerFromEnv(proxy *ProxyHttpServer) func(network, addr string) (net.Conn,
 	return proxy.NewConnectDialToProxy(https_proxy)
 }
 
+// getResolver returns a resolver using the DNS settings of proxyCtx. When the lookup is made
+// with a context carrying another ProxyCtx (e.g. a pooled transport reused by a later request)
+// the settings of that request are used instead, so per-request overrides of DNSResolver and
+// DNSLocalAddr made by handlers are honored.
 func (proxy *ProxyHttpServer) getResolver(proxyCtx *ProxyCtx, proto, resolver string) *net.Resolver {
 	return &net.Resolver{
 		PreferGo: true,
 		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			proxyCtx := proxyCtx
+			if reqCtx := proxyCtxFromContext(ctx); reqCtx != nil {
+				proxyCtx = reqCtx
+			}
+			proto := proto
+			if proxyCtx.DNSForceTCP {
+				proto = "tcp"
+			}
 			d := net.Dialer{
 				Timeout:       proxyCtx.DNSTimeout,
 				FallbackDelay: time.Duration(-1),
@@ -928,9 +1042,7 @@ func (proxy *ProxyHttpServer) getResolver(proxyCtx *ProxyCtx, proto, resolver st
 					d.LocalAddr = tcpAddr
 				}
 			}
-			if !strings.Contains(address, ":") {
-				address = net.JoinHostPort(address, "53")
-			}
+			address = withPort(address, "53")
 			if proxyCtx.DNSResolver != "" {
 				address = proxyCtx.DNSResolver
 			}
@@ -953,9 +1065,7 @@ func (proxy *ProxyHttpServer) NewConnectDialWithKeepAlives(ctx *ProxyCtx, https_
 	}
 
 	if u.Scheme == "" || u.Scheme == "http" {
-		if strings.IndexRune(u.Host, ':') == -1 {
-			u.Host += ":80"
-		}
+		u.Host = withPort(u.Host, "80")
 		return func(network, addr string) (net.Conn, error) {
 			connectReq := &http.Request{
 				Method: "CONNECT",
@@ -979,27 +1089,32 @@ func (proxy *ProxyHttpServer) NewConnectDialWithKeepAlives(ctx *ProxyCtx, https_
 					Timeout:  time.Duration(dialTimeout) * time.Second,
 					Resolver: proxy.getResolver(ctx, "udp", ""),
 				}
-				localAddr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf("%s:0", ctx.ForwardProxySourceIP))
+				localAddr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(ctx.ForwardProxySourceIP, "0"))
 				if err == nil {
 					d.LocalAddr = localAddr
 				}
 
 				var dialHost string
-				domain := strings.Split(u.Host, ":")[0]
-				ips, _, err := proxy.resolveDomain(ctx, "udp", domain, ctx.DNSResolver)
-				if err != nil && ctx.BackupDNSResolver != "" {
-					ips, _, err = proxy.resolveDomain(ctx, "udp", domain, ctx.BackupDNSResolver)
+				domain := hostOnly(u.Host)
+				ctx.traceDNSStart(domain)
+				ips, ips6, err := proxy.resolveDomain(ctx, ctx.primaryResolver("udp"), domain)
+				if backup := ctx.backupResolver("udp"); err != nil && backup != nil {
+					ips, ips6, err = proxy.resolveDomain(ctx, backup, domain)
 				}
-				if err != nil || len(ips) == 0 {
+				ctx.traceDNSDone(append(append([]string{}, ips...), ips6...), err)
+				if err == nil && len(ips) == 0 && len(ips6) > 0 && ctx.ForwardProxySourceIPv6 != "" {
+					// IPv6 only forward proxy, tracedDial binds the v6 source address
+					dialHost = net.JoinHostPort(ips6[0], "80")
+				} else if err != nil || len(ips) == 0 {
 					dialHost = u.Host
 				} else {
 					dialHost = ips[0] + ":80"
 				}
 
-				c, err = d.Dial(network, dialHost)
+				c, err = ctx.tracedDial(&d, network, dialHost)
 			} else {
 				ctx.Logf("starting proxy.dial: %+v", u.Host)
-				c, err = proxy.dial(network, u.Host)
+				c, err = ctx.tracedDialFunc(proxy.dial, network, u.Host)
 			}
 
 			if err != nil || c == nil {
@@ -1029,13 +1144,13 @@ func (proxy *ProxyHttpServer) NewConnectDialWithKeepAlives(ctx *ProxyCtx, https_
 			if resp.StatusCode != 200 {
 				ctx.Logf("dialing target with url: %+v  and req: %+v", u, connectReq)
 				ctx.Logf("connect dial got error reponse: %+v", resp)
-				resp, err := ioutil.ReadAll(resp.Body)
+				refused, err := newUpstreamConnectError(resp)
 				if err != nil {
 					ctx.Logf("connect dial error read body: %v", err)
 					return nil, err
 				}
 				c.Close()
-				return nil, errors.New("proxy refused connection" + string(resp))
+				return nil, refused
 			}
 			return c, nil
 		}
@@ -1043,9 +1158,7 @@ func (proxy *ProxyHttpServer) NewConnectDialWithKeepAlives(ctx *ProxyCtx, https_
 
 	if u.Scheme == "https" {
 
-		if strings.IndexRune(u.Host, ':') == -1 {
-			u.Host += ":443"
-		}
+		u.Host = withPort(u.Host, "443")
 
 		//set tcp keep alives. TODO: make these defaults smaller for forward proxied requests
 		tcpKAPeriod := 5
@@ -1076,26 +1189,31 @@ func (proxy *ProxyHttpServer) NewConnectDialWithKeepAlives(ctx *ProxyCtx, https_
 					Timeout:  time.Duration(dialTimeout) * time.Second,
 					Resolver: proxy.getResolver(ctx, "udp", ""),
 				}
-				localAddr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf("%s:0", ctx.ForwardProxySourceIP))
+				localAddr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(ctx.ForwardProxySourceIP, "0"))
 				if err == nil {
 					d.LocalAddr = localAddr
 				}
 
 				var dialHost string
-				domain := strings.Split(u.Host, ":")[0]
-				ips, _, err := proxy.resolveDomain(ctx, "udp", domain, ctx.DNSResolver)
-				if err != nil && ctx.BackupDNSResolver != "" {
-					ips, _, err = proxy.resolveDomain(ctx, "tcp", domain, ctx.BackupDNSResolver)
+				domain := hostOnly(u.Host)
+				ctx.traceDNSStart(domain)
+				ips, ips6, err := proxy.resolveDomain(ctx, ctx.primaryResolver("udp"), domain)
+				if backup := ctx.backupResolver("tcp"); err != nil && backup != nil {
+					ips, ips6, err = proxy.resolveDomain(ctx, backup, domain)
 				}
-				if err != nil || len(ips) == 0 {
+				ctx.traceDNSDone(append(append([]string{}, ips...), ips6...), err)
+				if err == nil && len(ips) == 0 && len(ips6) > 0 && ctx.ForwardProxySourceIPv6 != "" {
+					// IPv6 only forward proxy, tracedDial binds the v6 source address
+					dialHost = net.JoinHostPort(ips6[0], "443")
+				} else if err != nil || len(ips) == 0 {
 					dialHost = u.Host
 				} else {
 					dialHost = ips[0] + ":443"
 				}
 
-				c, err = d.Dial(network, dialHost)
+				c, err = ctx.tracedDial(&d, network, dialHost)
 			} else {
-				c, err = proxy.dial(network, u.Host)
+				c, err = ctx.tracedDialFunc(proxy.dial, network, u.Host)
 			}
 
 			if err != nil {
@@ -1117,7 +1235,15 @@ func (proxy *ProxyHttpServer) NewConnectDialWithKeepAlives(ctx *ProxyCtx, https_
 				targetConn.WriteTimeout = time.Second * time.Duration(ctx.ProxyWriteDeadline)
 				targetConn.IgnoreDeadlineErrors = false
 			}
-			c = tls.Client(targetConn, proxy.Tr.TLSClientConfig)
+			tlsConn := tls.Client(targetConn, ctx.forwardProxyTLSConfig(u.Host))
+			ctx.traceTLSStart()
+			err = tlsConn.Handshake()
+			ctx.traceTLSDone(tlsConn.ConnectionState(), err)
+			if err != nil {
+				tlsConn.Close()
+				return nil, err
+			}
+			c = tlsConn
 			connectReq := &http.Request{
 				Method: "CONNECT",
 				URL:    &url.URL{Opaque: addr},
@@ -1145,18 +1271,22 @@ func (proxy *ProxyHttpServer) NewConnectDialWithKeepAlives(ctx *ProxyCtx, https_
 			if resp.StatusCode != 200 {
 				ctx.Logf("dialing target with url: %+v  and req: %+v", u, connectReq)
 				ctx.Logf("connect dial got error reponse: %+v", resp)
-				body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 500))
+				refused, err := newUpstreamConnectError(resp)
 				if err != nil {
 					ctx.Logf("connect dial error read body: %v", err)
 					return nil, err
 				}
 				c.Close()
-				return nil, errors.New("proxy refused connection" + string(body))
+				return nil, refused
 			}
 			return c, nil
 		}
 
 	}
+
+	if u.Scheme == "socks5" || u.Scheme == "socks5h" {
+		return proxy.newSOCKS5Dial(ctx, u)
+	}
 	return nil
 }
 
@@ -1166,9 +1296,7 @@ func (proxy *ProxyHttpServer) NewConnectDialToProxyWithHandler(https_proxy strin
 		return nil
 	}
 	if u.Scheme == "" || u.Scheme == "http" {
-		if strings.IndexRune(u.Host, ':') == -1 {
-			u.Host += ":80"
-		}
+		u.Host = withPort(u.Host, "80")
 		return func(network, addr string) (net.Conn, error) {
 			connectReq := &http.Request{
 				Method: "CONNECT",
@@ -1195,20 +1323,18 @@ func (proxy *ProxyHttpServer) NewConnectDialToProxyWithHandler(https_proxy strin
 			}
 			defer resp.Body.Close()
 			if resp.StatusCode != 200 {
-				resp, err := ioutil.ReadAll(resp.Body)
+				refused, err := newUpstreamConnectError(resp)
 				if err != nil {
 					return nil, err
 				}
 				c.Close()
-				return nil, errors.New("proxy refused connection" + string(resp))
+				return nil, refused
 			}
 			return c, nil
 		}
 	}
 	if u.Scheme == "https" {
-		if strings.IndexRune(u.Host, ':') == -1 {
-			u.Host += ":443"
-		}
+		u.Host = withPort(u.Host, "443")
 		return func(network, addr string) (net.Conn, error) {
 			c, err := proxy.dial(network, u.Host)
 			if err != nil {
@@ -1236,12 +1362,12 @@ func (proxy *ProxyHttpServer) NewConnectDialToProxyWithHandler(https_proxy strin
 			}
 			defer resp.Body.Close()
 			if resp.StatusCode != 200 {
-				body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 500))
+				refused, err := newUpstreamConnectError(resp)
 				if err != nil {
 					return nil, err
 				}
 				c.Close()
-				return nil, errors.New("proxy refused connection" + string(body))
+				return nil, refused
 			}
 			return c, nil
 		}
@@ -1256,13 +1382,13 @@ func TLSConfigFromCA(ca *tls.Certificate) func(host string, ctx *ProxyCtx) (*tls
 
 		hostname := stripPort(host)
 		config := *defaultTLSConfig
-		ctx.Logf("signing for %s", stripPort(host))
+		ctx.Debugf(DebugTLS, "signing for %s", stripPort(host))
 
 		genCert := func() (*tls.Certificate, error) {
 			return signHost(*ca, []string{hostname})
 		}
-		if ctx.certStore != nil {
-			cert, err = ctx.certStore.Fetch(hostname, genCert)
+		if store := ctx.config().certStore; store != nil {
+			cert, err = store.Fetch(hostname, genCert)
 		} else {
 			cert, err = genCert()
 		}
@@ -0,0 +1,213 @@
+package goproxy
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// IdempotentReplayHeader is set on the responses replayed to duplicate requests
+const IdempotentReplayHeader = "X-Proxy-Idempotent-Replay"
+
+// DuplicateAction is what an IdempotencyPolicy does with the duplicates of a request
+type DuplicateAction int
+
+const (
+	// DuplicateReplay answers the duplicates with the response to the first request, once it
+	// was relayed. When there is none to replay, e.g. the first request failed, the first of
+	// the duplicates waiting takes its place and is let through.
+	DuplicateReplay DuplicateAction = iota
+	// DuplicateReject answers the duplicates with 409 Conflict
+	DuplicateReject
+)
+
+// IdempotencyPolicy detects the requests retried by clients with the same idempotency key, e.g.
+// POSTs retried while the proxy is slow, so that they don't have their upstream effects twice.
+// Requests are the same when they come from the same client, with the same method, URL and
+// key. See DeduplicateRequests.
+type IdempotencyPolicy struct {
+	// Header carries the idempotency keys, "Idempotency-Key" if empty. Requests without it are
+	// never duplicates.
+	Header string
+	// TTL is how long the keys are remembered, a minute if zero
+	TTL time.Duration
+	// Action is what is done with the duplicates, DuplicateReplay by default
+	Action DuplicateAction
+	// MaxBodySize bounds the responses kept to be replayed, 1MB if zero. The duplicates of
+	// requests with larger responses are rejected.
+	MaxBodySize int64
+	// Size is the number of keys remembered, 1024 if zero
+	Size int
+
+	once sync.Once
+	mu   sync.Mutex
+	keys *lruCache
+}
+
+// idempotentRequest is the first request with an idempotency key
+type idempotentRequest struct {
+	policy *IdempotencyPolicy
+	key    string
+	once   sync.Once
+	done   chan struct{}
+	// resp is the response to replay, nil if it couldn't be kept
+	resp *CachedResponse
+}
+
+func (p *IdempotencyPolicy) ttl() time.Duration {
+	if p.TTL > 0 {
+		return p.TTL
+	}
+	return time.Minute
+}
+
+// DeduplicateRequests returns a ReqHandler detecting the duplicates of the requests it handles
+// with policy, and answering them as policy.Action says
+//
+//	proxy.OnRequest(goproxy.MethodIs("POST")).Do(goproxy.DeduplicateRequests(
+//		&goproxy.IdempotencyPolicy{TTL: 30 * time.Second}))
+func DeduplicateRequests(policy *IdempotencyPolicy) ReqHandler {
+	policy.once.Do(func() { policy.keys = newLRUCache(policy.Size) })
+	header := policy.Header
+	if header == "" {
+		header = "Idempotency-Key"
+	}
+	return FuncReqHandler(func(r *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response) {
+		value := r.Header.Get(header)
+		if value == "" {
+			return r, nil
+		}
+		client := ctx.ProxyUser
+		if client == "" {
+			client, _, _ = net.SplitHostPort(r.RemoteAddr)
+		}
+		key := client + "\n" + r.Method + " " + r.URL.String() + "\n" + value
+
+		var timer *time.Timer
+		defer func() {
+			if timer != nil {
+				timer.Stop()
+			}
+		}()
+		for {
+			policy.mu.Lock()
+			v, duplicate := policy.keys.get(key)
+			if !duplicate {
+				ctx.idempotent = &idempotentRequest{policy: policy, key: key, done: make(chan struct{})}
+				policy.keys.set(key, ctx.idempotent, policy.ttl())
+			}
+			policy.mu.Unlock()
+			if !duplicate {
+				return r, nil
+			}
+
+			first := v.(*idempotentRequest)
+			ctx.Logf("duplicate request with idempotency key %s", value)
+			if policy.Action != DuplicateReplay {
+				break
+			}
+			if timer == nil {
+				timer = time.NewTimer(policy.ttl())
+			}
+			select {
+			case <-first.done:
+			case <-timer.C:
+				first = nil
+			case <-r.Context().Done():
+				first = nil
+			}
+			if first == nil {
+				break
+			}
+			if first.resp != nil {
+				resp := first.resp.Response(r)
+				resp.Header.Set(IdempotentReplayHeader, "true")
+				return r, resp
+			}
+			// the first request has no response to replay and its key was forgotten, the
+			// duplicates waiting claim it again and the others wait for the one that did
+		}
+		return r, ctx.BlockedResponse(http.StatusConflict, PolicyDecision{Policy: "idempotency", Reason: "duplicate request"})
+	})
+}
+
+// recordIdempotent keeps resp, the response relayed to the first request with an idempotency
+// key, to replay it to the duplicates once its body was read entirely
+func (ctx *ProxyCtx) recordIdempotent(resp *http.Response) *http.Response {
+	first := ctx.idempotent
+	if first == nil || resp == nil || resp.Body == nil {
+		ctx.finishIdempotent()
+		return resp
+	}
+	max := first.policy.MaxBodySize
+	if max <= 0 {
+		max = 1 << 20
+	}
+	cached := &CachedResponse{StatusCode: resp.StatusCode, Header: cloneHeader(resp.Header), Stored: time.Now()}
+	cached.Header.Del("Content-Length")
+	cached.Header.Del("Transfer-Encoding")
+	resp.Body = &idempotentBody{ReadCloser: resp.Body, max: max, done: func(body []byte) {
+		if body != nil {
+			cached.Body = body
+			first.resp = cached
+		}
+		ctx.finishIdempotent()
+	}}
+	return resp
+}
+
+// finishIdempotent releases the duplicates waiting for the first request of ctx
+func (ctx *ProxyCtx) finishIdempotent() {
+	first := ctx.idempotent
+	if first == nil {
+		return
+	}
+	first.once.Do(func() {
+		if first.resp == nil {
+			// the duplicates can't be replayed a response, let the next one through, be it
+			// a new request or one of the duplicates waiting
+			first.policy.mu.Lock()
+			if v, ok := first.policy.keys.get(first.key); ok && v == first {
+				first.policy.keys.remove(first.key)
+			}
+			first.policy.mu.Unlock()
+		}
+		close(first.done)
+	})
+}
+
+// idempotentBody copies the body it reads to a buffer, and passes it to done when it is closed,
+// nil if it was not read entirely or was larger than max
+type idempotentBody struct {
+	io.ReadCloser
+	buf  bytes.Buffer
+	max  int64
+	eof  bool
+	done func(body []byte)
+}
+
+func (b *idempotentBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if int64(b.buf.Len()+n) <= b.max {
+		b.buf.Write(p[:n])
+	} else {
+		b.max = -1
+	}
+	if err == io.EOF {
+		b.eof = true
+	}
+	return n, err
+}
+
+func (b *idempotentBody) Close() error {
+	err := b.ReadCloser.Close()
+	if b.eof && b.max >= 0 {
+		b.done(b.buf.Bytes())
+	} else {
+		b.done(nil)
+	}
+	return err
+}
@@ -0,0 +1,124 @@
+package goproxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDeduplicateRequests(t *testing.T) {
+	var hits int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&hits, 1)
+		w.Write([]byte("order " + strconv.Itoa(int(n))))
+	}))
+	defer upstream.Close()
+
+	policy := &IdempotencyPolicy{}
+	proxy := NewProxyHttpServer()
+	proxy.OnRequest(MethodIs("POST")).Do(DeduplicateRequests(policy))
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+	proxyURL, _ := url.Parse(s.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	post := func(key string) (*http.Response, string) {
+		req, _ := http.NewRequest("POST", upstream.URL+"/orders", strings.NewReader("item=1"))
+		if key != "" {
+			req.Header.Set("Idempotency-Key", key)
+		}
+		resp, err := client.Do(req)
+		orFatal("POST", err, t)
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp, string(body)
+	}
+
+	if _, body := post("a"); body != "order 1" {
+		t.Fatalf("unexpected response %q", body)
+	}
+	resp, body := post("a")
+	if body != "order 1" || resp.Header.Get(IdempotentReplayHeader) != "true" {
+		t.Errorf("expected the duplicate to be answered with the first response, got %q", body)
+	}
+	if _, body := post("b"); body != "order 2" {
+		t.Errorf("expected another key to reach the upstream server, got %q", body)
+	}
+	if _, body := post(""); body != "order 3" {
+		t.Errorf("expected requests without key to reach the upstream server, got %q", body)
+	}
+
+	policy.Action = DuplicateReject
+	if resp, _ := post("b"); resp.StatusCode != http.StatusConflict {
+		t.Errorf("expected the duplicate to be rejected, got %s", resp.Status)
+	}
+	if n := atomic.LoadInt32(&hits); n != 3 {
+		t.Errorf("expected 3 upstream requests, got %d", n)
+	}
+}
+
+func TestDeduplicateRequestsAfterFailure(t *testing.T) {
+	var hits int32
+	started := make(chan bool)
+	release := make(chan bool)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&hits, 1)
+		if n == 1 {
+			// the first request fails without a response
+			started <- true
+			<-release
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		w.Write([]byte("order " + strconv.Itoa(int(n))))
+	}))
+	defer upstream.Close()
+
+	proxy := NewProxyHttpServer()
+	proxy.OnRequest(MethodIs("POST")).Do(DeduplicateRequests(&IdempotencyPolicy{}))
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+	proxyURL, _ := url.Parse(s.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	type result struct {
+		resp *http.Response
+		body string
+		err  error
+	}
+	post := func(results chan<- result) {
+		req, _ := http.NewRequest("POST", upstream.URL+"/orders", strings.NewReader("item=1"))
+		req.Header.Set("Idempotency-Key", "a")
+		resp, err := client.Do(req)
+		if err != nil {
+			results <- result{err: err}
+			return
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		results <- result{resp: resp, body: string(body)}
+	}
+
+	first := make(chan result, 1)
+	go post(first)
+	<-started
+	duplicate := make(chan result, 1)
+	go post(duplicate)
+	// the duplicate waits for the first request, which then fails
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	<-first
+
+	r := <-duplicate
+	orFatal("POST", r.err, t)
+	if r.resp.StatusCode != http.StatusOK || r.body != "order 2" || r.resp.Header.Get(IdempotentReplayHeader) != "" {
+		t.Errorf("expected the duplicate to be let through in place of the failed request, got %s %q", r.resp.Status, r.body)
+	}
+}
@@ -0,0 +1,278 @@
+package goproxy
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var errIntegrity = errors.New("response body doesn't match its digest")
+
+// IntegrityPolicy is a RespHandler verifying the bodies of the responses against their
+// Content-MD5, Digest (RFC 3230) and Content-Digest (RFC 9530) headers, and against the
+// subresource integrity metadata configured for their URL. Responses that don't match are
+// replaced with 502 Bad Gateway: the bodies of up to MaxBufferSize bytes are verified before
+// any of it is relayed, larger bodies are relayed as they are read and cut before their end,
+// keeping their Content-Length so that the clients detect the truncation.
+//
+//	proxy.OnResponse(goproxy.ReqHostIs("downloads.example.com:443")).Do(&goproxy.IntegrityPolicy{
+//		Integrity: map[string]string{"https://downloads.example.com/tool.tar.gz": "sha384-..."}})
+type IntegrityPolicy struct {
+	// Integrity maps URLs to their subresource integrity metadata, e.g. "sha256-<base64>".
+	// The responses to the URLs of Integrity must match one of its digests, and are rejected
+	// if they can't be verified.
+	Integrity map[string]string
+	// MaxBufferSize is the size of the largest body verified before it is relayed, 16MB if zero
+	MaxBufferSize int64
+	// FailureMetric, if set, counts the responses failing their integrity check
+	FailureMetric *prometheus.Counter
+}
+
+// digestCheck is a digest a body must match
+type digestCheck struct {
+	alg  string
+	want []byte
+}
+
+// newDigestHash returns the hash of the digest algorithm alg, nil if it is not supported
+func newDigestHash(alg string) hash.Hash {
+	switch strings.ToLower(alg) {
+	case "md5":
+		return md5.New()
+	case "sha", "sha1":
+		return sha1.New()
+	case "sha-256", "sha256":
+		return sha256.New()
+	case "sha384":
+		return sha512.New384()
+	case "sha-512", "sha512":
+		return sha512.New()
+	}
+	return nil
+}
+
+// headerDigests returns the digests of the body announced by the headers h
+func headerDigests(h http.Header) []digestCheck {
+	var checks []digestCheck
+	if v := h.Get("Content-MD5"); v != "" {
+		if want, err := base64.StdEncoding.DecodeString(strings.TrimSpace(v)); err == nil {
+			checks = append(checks, digestCheck{"md5", want})
+		}
+	}
+	for _, name := range []string{"Digest", "Content-Digest"} {
+		for _, v := range h[name] {
+			for _, d := range strings.Split(v, ",") {
+				i := strings.IndexByte(d, '=')
+				if i < 0 {
+					continue
+				}
+				alg := strings.TrimSpace(d[:i])
+				// Content-Digest values are byte sequences, between colons
+				value := strings.Trim(strings.TrimSpace(d[i+1:]), ":")
+				want, err := base64.StdEncoding.DecodeString(value)
+				if err != nil || newDigestHash(alg) == nil {
+					continue
+				}
+				checks = append(checks, digestCheck{strings.ToLower(alg), want})
+			}
+		}
+	}
+	return checks
+}
+
+// sriDigests returns the digests of subresource integrity metadata, any of which a body must
+// match
+func sriDigests(integrity string) []digestCheck {
+	var checks []digestCheck
+	for _, m := range strings.Fields(integrity) {
+		// options after ? are reserved
+		m = strings.SplitN(m, "?", 2)[0]
+		i := strings.IndexByte(m, '-')
+		if i < 0 || newDigestHash(m[:i]) == nil {
+			continue
+		}
+		if want, err := base64.StdEncoding.DecodeString(m[i+1:]); err == nil {
+			checks = append(checks, digestCheck{strings.ToLower(m[:i]), want})
+		}
+	}
+	return checks
+}
+
+// bodyVerifier hashes a body with the algorithms of its checks
+type bodyVerifier struct {
+	hashes map[string]hash.Hash
+	// all must match
+	all []digestCheck
+	// one of any must match, if not empty
+	any []digestCheck
+}
+
+func newBodyVerifier(all, any []digestCheck) *bodyVerifier {
+	v := &bodyVerifier{hashes: make(map[string]hash.Hash), all: all, any: any}
+	for _, checks := range [][]digestCheck{all, any} {
+		for _, c := range checks {
+			if _, ok := v.hashes[c.alg]; !ok {
+				v.hashes[c.alg] = newDigestHash(c.alg)
+			}
+		}
+	}
+	return v
+}
+
+func (v *bodyVerifier) Write(p []byte) (int, error) {
+	for _, h := range v.hashes {
+		h.Write(p)
+	}
+	return len(p), nil
+}
+
+func (v *bodyVerifier) match(c digestCheck) bool {
+	return bytes.Equal(v.hashes[c.alg].Sum(nil), c.want)
+}
+
+func (v *bodyVerifier) verified() bool {
+	for _, c := range v.all {
+		if !v.match(c) {
+			return false
+		}
+	}
+	if len(v.any) == 0 {
+		return true
+	}
+	for _, c := range v.any {
+		if v.match(c) {
+			return true
+		}
+	}
+	return false
+}
+
+// Handle implements RespHandler
+func (p *IntegrityPolicy) Handle(resp *http.Response, ctx *ProxyCtx) *http.Response {
+	if resp == nil || resp.Body == nil || resp.StatusCode != http.StatusOK || resp.Request == nil || resp.Request.Method == "HEAD" {
+		return resp
+	}
+	all := headerDigests(resp.Header)
+	var any []digestCheck
+	if integrity, ok := p.Integrity[resp.Request.URL.String()]; ok {
+		if any = sriDigests(integrity); len(any) == 0 {
+			resp.Body.Close()
+			return p.failed(resp, ctx, "no supported integrity metadata")
+		}
+	}
+	if len(all) == 0 && len(any) == 0 {
+		return resp
+	}
+	v := newBodyVerifier(all, any)
+
+	max := p.MaxBufferSize
+	if max <= 0 {
+		max = 16 << 20
+	}
+	if resp.ContentLength > max || ctx.Streaming() {
+		resp.Body = p.verifyingBody(resp, ctx, v, nil)
+		return resp
+	}
+	body, err := ctx.readAll(io.LimitReader(resp.Body, max+1))
+	if err != nil {
+		resp.Body.Close()
+		return p.failed(resp, ctx, err.Error())
+	}
+	v.Write(body)
+	if int64(len(body)) > max {
+		// of unknown length, relay what was read and verify the rest as it is relayed
+		resp.Body = p.verifyingBody(resp, ctx, v, body)
+		return resp
+	}
+	resp.Body.Close()
+	if !v.verified() {
+		return p.failed(resp, ctx, "body doesn't match its digest")
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	return resp
+}
+
+// failed records the integrity failure of resp, and returns the response replacing it
+func (p *IntegrityPolicy) failed(resp *http.Response, ctx *ProxyCtx, reason string) *http.Response {
+	ctx.Warnf("integrity check of %s failed: %s", resp.Request.URL, reason)
+	if p.FailureMetric != nil {
+		metric := *p.FailureMetric
+		metric.Inc()
+	}
+	return ctx.BlockedResponse(http.StatusBadGateway, PolicyDecision{Policy: "integrity", Reason: "integrity check failed"})
+}
+
+func (p *IntegrityPolicy) verifyingBody(resp *http.Response, ctx *ProxyCtx, v *bodyVerifier, read []byte) *verifyingBody {
+	return newVerifyingBody(resp.Body, v, read, func() error {
+		if !v.verified() {
+			p.failed(resp, ctx, "body doesn't match its digest")
+			return errIntegrity
+		}
+		return nil
+	})
+}
+
+// verifyingBody writes the body it reads to w, and returns the error of verify instead of
+// the last byte of the body if it is not nil. It fails as soon as w does. The pending bytes
+// were already written.
+type verifyingBody struct {
+	src     io.ReadCloser
+	w       io.Writer
+	chunk   []byte
+	pending bytes.Buffer
+	eof     bool
+	err     error
+	verify  func() error
+}
+
+func newVerifyingBody(src io.ReadCloser, w io.Writer, read []byte, verify func() error) *verifyingBody {
+	b := &verifyingBody{src: src, w: w, chunk: make([]byte, 32*1024), verify: verify}
+	b.pending.Write(read)
+	return b
+}
+
+func (b *verifyingBody) Read(p []byte) (int, error) {
+	// the last byte is only returned once the body is verified, so that a body failing its
+	// check never reaches the client entirely
+	for b.pending.Len() <= 1 && !b.eof && b.err == nil {
+		n, err := b.src.Read(b.chunk)
+		b.pending.Write(b.chunk[:n])
+		if _, werr := b.w.Write(b.chunk[:n]); werr != nil {
+			b.err = werr
+		} else if err == io.EOF {
+			b.eof = true
+			b.err = b.verify()
+		} else if err != nil {
+			b.err = err
+		}
+	}
+	if b.err != nil {
+		return 0, b.err
+	}
+	if b.eof {
+		if b.pending.Len() == 0 {
+			return 0, io.EOF
+		}
+		return b.pending.Read(p)
+	}
+	if n := b.pending.Len() - 1; len(p) > n {
+		p = p[:n]
+	}
+	return b.pending.Read(p)
+}
+
+func (b *verifyingBody) Close() error {
+	return b.src.Close()
+}
@@ -0,0 +1,77 @@
+package goproxy
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+func integrityResponse(url string, body []byte, header http.Header) *http.Response {
+	req, _ := http.NewRequest("GET", url, nil)
+	return &http.Response{StatusCode: http.StatusOK, Header: header, Request: req,
+		Body: ioutil.NopCloser(bytes.NewReader(body)), ContentLength: int64(len(body))}
+}
+
+func TestIntegrityPolicy(t *testing.T) {
+	body := []byte("release tarball")
+	sumMD5 := md5.Sum(body)
+	sum256 := sha256.Sum256(body)
+	sum384 := sha512.Sum384(body)
+	b64 := base64.StdEncoding.EncodeToString
+	policy := &IntegrityPolicy{Integrity: map[string]string{
+		"https://example.com/tool.tar.gz": "sha384-" + b64(sum384[:]) + " sha256-" + b64(make([]byte, 32)),
+		"https://example.com/bad.tar.gz":  "sha512-" + b64(make([]byte, 64)),
+	}}
+	for _, c := range []struct {
+		url    string
+		header http.Header
+		status int
+	}{
+		{"http://example.com/a", http.Header{"Content-Md5": {b64(sumMD5[:])}}, http.StatusOK},
+		{"http://example.com/a", http.Header{"Digest": {"SHA-256=" + b64(sum256[:]) + ",UNIXsum=1"}}, http.StatusOK},
+		{"http://example.com/a", http.Header{"Content-Digest": {"sha-256=:" + b64(sum256[:]) + ":"}}, http.StatusOK},
+		{"http://example.com/a", http.Header{"Digest": {"MD5=" + b64(sumMD5[:]) + ",SHA-256=" + b64(sumMD5[:])}}, http.StatusBadGateway},
+		{"http://example.com/a", http.Header{}, http.StatusOK},
+		{"https://example.com/tool.tar.gz", http.Header{}, http.StatusOK},
+		{"https://example.com/bad.tar.gz", http.Header{}, http.StatusBadGateway},
+	} {
+		resp := integrityResponse(c.url, body, c.header)
+		resp = policy.Handle(resp, &ProxyCtx{Req: resp.Request, Proxy: NewProxyHttpServer()})
+		if resp.StatusCode != c.status {
+			t.Errorf("%s %v: expected status %d, got %d", c.url, c.header, c.status, resp.StatusCode)
+			continue
+		}
+		if got, _ := ioutil.ReadAll(resp.Body); c.status == http.StatusOK && !bytes.Equal(got, body) {
+			t.Errorf("%s %v: unexpected body %q", c.url, c.header, got)
+		}
+	}
+}
+
+func TestIntegrityPolicyStreamed(t *testing.T) {
+	body := bytes.Repeat([]byte("0123456789"), 1000)
+	sum := sha256.Sum256(body)
+	policy := &IntegrityPolicy{MaxBufferSize: 100}
+	digest := "sha-256=" + base64.StdEncoding.EncodeToString(sum[:])
+
+	resp := integrityResponse("http://example.com/a", body, http.Header{"Digest": {digest}})
+	resp = policy.Handle(resp, &ProxyCtx{Req: resp.Request, Proxy: NewProxyHttpServer()})
+	got, err := ioutil.ReadAll(resp.Body)
+	orFatal("ReadAll", err, t)
+	if !bytes.Equal(got, body) {
+		t.Error("unexpected streamed body")
+	}
+
+	corrupted := append([]byte(nil), body...)
+	corrupted[5000] = 'x'
+	resp = integrityResponse("http://example.com/a", corrupted, http.Header{"Digest": {digest}})
+	resp = policy.Handle(resp, &ProxyCtx{Req: resp.Request, Proxy: NewProxyHttpServer()})
+	got, err = ioutil.ReadAll(resp.Body)
+	if err != errIntegrity || len(got) >= len(body) {
+		t.Errorf("expected the corrupted body to be cut, got %d bytes, %v", len(got), err)
+	}
+}
@@ -0,0 +1,211 @@
+package goproxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// DefaultInternalHost is the host name of the internal endpoints when InternalEndpoints.Host
+// is empty
+const DefaultInternalHost = "proxy.internal"
+
+// InternalEndpoints are served by the proxy itself to the plain HTTP requests it proxies for a
+// reserved host name, after the request handlers ran:
+//
+//	/ca.crt          the CA certificate signing the MITMed connections, in DER
+//	/ca.pem          the same in PEM, to install it as trusted by the clients
+//	/proxy.pac       the PAC file of the client, also served as /wpad.dat
+//	/assets/...      the assets of the block pages, if Assets is set
+//	/diagnostics     the identity of the client and the policies applied to its requests,
+//	                 in JSON if the client accepts it
+//	/config          the configuration of the client, long polled, if ConfigPush is set
+type InternalEndpoints struct {
+	// Host is the reserved host name, DefaultInternalHost if empty
+	Host string
+	// CA is the certificate offered for download, the CA of the tenant of the client or
+	// GoproxyCa if nil
+	CA *tls.Certificate
+	// PAC returns the PAC file of the client of ctx. The PAC file generated from the
+	// LocalDestinations of the proxy is served if nil.
+	PAC func(ctx *ProxyCtx) string
+	// ProxyAddr is the address the clients reach the proxy at in the generated PAC file, the
+	// address they connected to if empty
+	ProxyAddr string
+	// Assets serves the assets of the block pages, without the /assets prefix
+	Assets http.Handler
+	// ConfigPush distributes their configuration to the clients
+	ConfigPush *ConfigPush
+}
+
+func (e *InternalEndpoints) host() string {
+	if e.Host != "" {
+		return e.Host
+	}
+	return DefaultInternalHost
+}
+
+// Is reports whether hostport, a host with or without port, is the reserved host name
+func (e *InternalEndpoints) Is(hostport string) bool {
+	host := hostport
+	if h, _, err := net.SplitHostPort(hostport); err == nil {
+		host = h
+	}
+	return strings.EqualFold(strings.TrimSuffix(host, "."), e.host())
+}
+
+// internalResponse returns the response of the internal endpoints to r, or nil if r is not for
+// the reserved host name
+func (proxy *ProxyHttpServer) internalResponse(ctx *ProxyCtx, r *http.Request) *http.Response {
+	e := proxy.InternalEndpoints
+	if e == nil || !e.Is(r.URL.Host) {
+		return nil
+	}
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return NewResponse(r, ContentTypeText, http.StatusMethodNotAllowed, "method not allowed\n")
+	}
+	switch path := r.URL.Path; {
+	case path == "/ca.crt" || path == "/ca.pem":
+		ca := e.CA
+		if ca == nil {
+			if t := ctx.Tenant(); t != nil && t.CA != nil {
+				ca = t.CA
+			} else {
+				ca = &GoproxyCa
+			}
+		}
+		if len(ca.Certificate) == 0 {
+			return NewResponse(r, ContentTypeText, http.StatusNotFound, "no CA certificate\n")
+		}
+		if path == "/ca.pem" {
+			return NewResponse(r, "application/x-pem-file", http.StatusOK,
+				string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Certificate[0]})))
+		}
+		return NewResponse(r, "application/x-x509-ca-cert", http.StatusOK, string(ca.Certificate[0]))
+	case wpadPaths[path] && e.PAC != nil:
+		return NewResponse(r, "application/x-ns-proxy-autoconfig", http.StatusOK, e.PAC(ctx))
+	case wpadPaths[path]:
+		return serveHandler(proxy.PACHandler(e.ProxyAddr), r)
+	case strings.HasPrefix(path, "/assets/") && e.Assets != nil:
+		return serveHandler(http.StripPrefix("/assets", e.Assets), r)
+	case path == "/config" && e.ConfigPush != nil:
+		return e.ConfigPush.response(ctx, r)
+	case path == "/diagnostics":
+		d := ctx.diagnostics()
+		if strings.Contains(r.Header.Get("Accept"), ContentTypeJSON) {
+			body, _ := json.Marshal(d)
+			return NewResponse(r, ContentTypeJSON, http.StatusOK, string(body))
+		}
+		return NewResponse(r, ContentTypeText, http.StatusOK, d.String())
+	}
+	return NewResponse(r, ContentTypeText, http.StatusNotFound, "not found\n")
+}
+
+// responseRecorder records the response written by an http.Handler
+type responseRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *responseRecorder) Header() http.Header {
+	return w.header
+}
+
+func (w *responseRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *responseRecorder) Write(b []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(b)
+}
+
+// serveHandler returns the response of h to r
+func serveHandler(h http.Handler, r *http.Request) *http.Response {
+	w := &responseRecorder{header: make(http.Header)}
+	h.ServeHTTP(w, r)
+	w.WriteHeader(http.StatusOK)
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", w.status, http.StatusText(w.status)),
+		StatusCode:    w.status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        w.header,
+		Body:          ioutil.NopCloser(&w.body),
+		ContentLength: int64(w.body.Len()),
+		Request:       r,
+	}
+}
+
+// clientDiagnostics is the content of the /diagnostics internal endpoint
+type clientDiagnostics struct {
+	RemoteAddr string            `json:"remote_addr"`
+	User       string            `json:"user,omitempty"`
+	Tenant     string            `json:"tenant,omitempty"`
+	UserAgent  string            `json:"user_agent,omitempty"`
+	Policies   map[string]string `json:"policies,omitempty"`
+}
+
+func (d *clientDiagnostics) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "remote address: %s\n", d.RemoteAddr)
+	if d.User != "" {
+		fmt.Fprintf(&b, "user: %s\n", d.User)
+	}
+	if d.Tenant != "" {
+		fmt.Fprintf(&b, "tenant: %s\n", d.Tenant)
+	}
+	if d.UserAgent != "" {
+		fmt.Fprintf(&b, "user agent: %s\n", d.UserAgent)
+	}
+	names := make([]string, 0, len(d.Policies))
+	for name := range d.Policies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(&b, "policy %s: %s\n", name, d.Policies[name])
+	}
+	return b.String()
+}
+
+// diagnostics describes the client of ctx and the policies its request handlers applied
+func (ctx *ProxyCtx) diagnostics() *clientDiagnostics {
+	d := &clientDiagnostics{User: ctx.ProxyUser, UserAgent: ctx.OriginalUserAgent, Policies: make(map[string]string)}
+	if ctx.Req != nil {
+		d.RemoteAddr = ctx.Req.RemoteAddr
+	}
+	if t := ctx.Tenant(); t != nil {
+		d.Tenant = t.Name
+	}
+	if policy := ctx.userAgentPolicy(); policy != nil {
+		d.Policies["user-agent"] = policy.Mode.String()
+	}
+	if ctx.FingerprintPolicy != nil {
+		d.Policies["fingerprint"] = "reduced"
+	}
+	if ctx.CachePartition != "" {
+		d.Policies["cache-partition"] = ctx.CachePartition
+	}
+	if policy := ctx.encodingPolicy(); policy != nil && policy.AcceptEncoding != "" {
+		d.Policies["accept-encoding"] = policy.AcceptEncoding
+	}
+	if ctx.headerLimits() != nil {
+		d.Policies["header-limits"] = "enforced"
+	}
+	if ctx.PolicyDecision != nil {
+		d.Policies["decision"] = ctx.PolicyDecision.Policy
+	}
+	return d
+}
@@ -0,0 +1,68 @@
+package goproxy
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestInternalEndpoints(t *testing.T) {
+	proxy := NewProxyHttpServer()
+	proxy.OnRequest().DoFunc(func(r *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response) {
+		ctx.ProxyUser = "bobo"
+		ctx.CachePartition = "site-a"
+		return r, nil
+	})
+	proxy.InternalEndpoints = &InternalEndpoints{
+		PAC:    func(ctx *ProxyCtx) string { return `function FindProxyForURL(url, host) { return "DIRECT"; }` },
+		Assets: ConstantHanlder("logo"),
+	}
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+	proxyURL, _ := url.Parse(s.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	get := func(path, accept string) (*http.Response, []byte) {
+		req, _ := http.NewRequest("GET", "http://proxy.internal"+path, nil)
+		req.Header.Set("Accept", accept)
+		resp, err := client.Do(req)
+		orFatal("GET "+path, err, t)
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp, body
+	}
+
+	_, body := get("/ca.pem", "")
+	block, _ := pem.Decode(body)
+	if block == nil {
+		t.Fatalf("expected a PEM certificate, got %q", body)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	orFatal("ParseCertificate", err, t)
+	if !cert.IsCA {
+		t.Error("expected the CA certificate")
+	}
+
+	if resp, body := get("/proxy.pac", ""); resp.Header.Get("Content-Type") != "application/x-ns-proxy-autoconfig" || len(body) == 0 {
+		t.Errorf("unexpected PAC response %s %q", resp.Header.Get("Content-Type"), body)
+	}
+	if _, body := get("/assets/logo.png", ""); string(body) != "logo" {
+		t.Errorf("unexpected asset %q", body)
+	}
+
+	_, body = get("/diagnostics", "application/json")
+	var d clientDiagnostics
+	orFatal("Unmarshal", json.Unmarshal(body, &d), t)
+	if d.User != "bobo" || d.Policies["cache-partition"] != "site-a" || d.RemoteAddr == "" {
+		t.Errorf("unexpected diagnostics %s", body)
+	}
+
+	if resp, _ := get("/bobo", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown endpoint, got %s", resp.Status)
+	}
+}
@@ -0,0 +1,26 @@
+package goproxy
+
+import (
+	"time"
+)
+
+// markFirstByte records the time to the first byte of the response to the client of ctx, as
+// its headers are about to be written
+func (ctx *ProxyCtx) markFirstByte() {
+	ctx.FirstByte = time.Since(ctx.received)
+}
+
+// markResponseDone records the time to the end of the response to the client of ctx
+func (ctx *ProxyCtx) markResponseDone() {
+	ctx.ResponseDuration = time.Since(ctx.received)
+}
+
+// TransferRate returns the bytes per second at which the body of the response was relayed,
+// from its first byte to its end, 0 until the response is relayed
+func (ctx *ProxyCtx) TransferRate() float64 {
+	d := ctx.ResponseDuration - ctx.FirstByte
+	if ctx.ResponseDuration <= 0 || d <= 0 {
+		return 0
+	}
+	return float64(ctx.BytesReceived) / d.Seconds()
+}
@@ -0,0 +1,52 @@
+package goproxy
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestResponseLatency(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		io.WriteString(w, "first")
+		w.(http.Flusher).Flush()
+		time.Sleep(50 * time.Millisecond)
+		io.WriteString(w, "second")
+	}))
+	defer backend.Close()
+
+	done := make(chan *ProxyCtx, 1)
+	proxy := NewProxyHttpServer()
+	proxy.OnRequest().DoFunc(func(r *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response) {
+		ctx.Tail = func(ctx *ProxyCtx) error {
+			done <- ctx
+			return nil
+		}
+		return r, nil
+	})
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+	proxyURL, _ := url.Parse(s.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	resp, err := client.Get(backend.URL)
+	orFatal("Get", err, t)
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	ctx := <-done
+	if ctx.FirstByte < 50*time.Millisecond {
+		t.Errorf("expected the first byte after the headers of the backend, got %v", ctx.FirstByte)
+	}
+	if ctx.ResponseDuration < ctx.FirstByte+50*time.Millisecond {
+		t.Errorf("expected the response done after its body, got %v and %v", ctx.FirstByte, ctx.ResponseDuration)
+	}
+	if ctx.TransferRate() <= 0 {
+		t.Errorf("expected a transfer rate, got %v", ctx.TransferRate())
+	}
+}
@@ -0,0 +1,237 @@
+package goproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// Severity is the gravity of a Diagnostic
+type Severity int
+
+const (
+	// SeverityError is a configuration that doesn't work as intended
+	SeverityError Severity = iota
+	// SeverityWarning is a configuration that works, but likely not as intended
+	SeverityWarning
+)
+
+func (s Severity) String() string {
+	if s == SeverityError {
+		return "error"
+	}
+	return "warning"
+}
+
+// MarshalJSON encodes s as its name
+func (s Severity) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+// Diagnostic is a problem found in a configuration by Validate
+type Diagnostic struct {
+	Severity Severity `json:"severity"`
+	// Field is the path of the setting, e.g. "LocalDestinations.CIDRs[2]"
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (d Diagnostic) String() string {
+	return d.Severity.String() + ": " + d.Field + ": " + d.Message
+}
+
+// Diagnostics are the problems of a configuration
+type Diagnostics []Diagnostic
+
+// HasErrors reports whether one of the diagnostics is an error
+func (ds Diagnostics) HasErrors() bool {
+	for _, d := range ds {
+		if d.Severity == SeverityError {
+			return true
+		}
+	}
+	return false
+}
+
+// String formats the diagnostics one per line, e.g. for a command line tool
+func (ds Diagnostics) String() string {
+	lines := make([]string, len(ds))
+	for i, d := range ds {
+		lines[i] = d.String()
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (ds *Diagnostics) add(severity Severity, field, format string, args ...interface{}) {
+	*ds = append(*ds, Diagnostic{severity, field, fmt.Sprintf(format, args...)})
+}
+
+// ValidateRegexps checks that patterns compile, e.g. the patterns of a rule file before they
+// are compiled into ReqHostMatches conditions. field names the patterns in the diagnostics.
+func ValidateRegexps(field string, patterns ...string) Diagnostics {
+	var ds Diagnostics
+	for i, p := range patterns {
+		if _, err := regexp.Compile(p); err != nil {
+			ds.add(SeverityError, fmt.Sprintf("%s[%d]", field, i), "%v", err)
+		}
+	}
+	return ds
+}
+
+// ValidateCIDRs checks the syntax of networks, which are CIDRs or bare IP addresses, and
+// reports the networks covered by another one of the list, which can never match on their own
+func ValidateCIDRs(field string, networks ...string) Diagnostics {
+	var ds Diagnostics
+	parsed := make([]*net.IPNet, len(networks))
+	for i, s := range networks {
+		if ip := net.ParseIP(s); ip != nil {
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+			}
+			parsed[i] = &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)}
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			ds.add(SeverityError, fmt.Sprintf("%s[%d]", field, i), "invalid CIDR %q", s)
+			continue
+		}
+		parsed[i] = ipnet
+	}
+	for i, a := range parsed {
+		for j, b := range parsed {
+			if i == j || a == nil || b == nil {
+				continue
+			}
+			aOnes, aBits := a.Mask.Size()
+			bOnes, bBits := b.Mask.Size()
+			if aBits != bBits || !b.Contains(a.IP) || bOnes > aOnes || bOnes == aOnes && j > i {
+				continue
+			}
+			verb := "is covered by"
+			if bOnes == aOnes {
+				verb = "duplicates"
+			}
+			ds.add(SeverityWarning, fmt.Sprintf("%s[%d]", field, i), "%s %s %s", networks[i], verb, networks[j])
+			break
+		}
+	}
+	return ds
+}
+
+// validateHosts checks host name patterns with optional "*." or "." prefixes, and reports the
+// names covered by a wildcard of the list
+func validateHosts(field string, hosts []string) Diagnostics {
+	var ds Diagnostics
+	for i, h := range hosts {
+		name := strings.TrimPrefix(strings.TrimPrefix(strings.ToLower(h), "*"), ".")
+		if name == "" || strings.ContainsAny(name, " */:[]") {
+			ds.add(SeverityError, fmt.Sprintf("%s[%d]", field, i), "invalid host pattern %q", h)
+			continue
+		}
+		for j, w := range hosts {
+			suffix := strings.TrimPrefix(strings.ToLower(w), "*")
+			if i != j && strings.HasPrefix(suffix, ".") && strings.HasSuffix("."+name, suffix) && "."+name != suffix {
+				ds.add(SeverityWarning, fmt.Sprintf("%s[%d]", field, i), "%s is covered by %s", h, w)
+				break
+			}
+		}
+	}
+	return ds
+}
+
+// Validate checks the configuration of the proxy, and returns the problems found in it. Build
+// the proxy of a proposed configuration and validate it before serving it, e.g. from a command
+// line tool or a deployment check. The admin API serves the diagnostics of the running proxy
+// on /validate.
+func (proxy *ProxyHttpServer) Validate() Diagnostics {
+	var ds Diagnostics
+	if l := proxy.LocalDestinations; l != nil {
+		ds = append(ds, ValidateCIDRs("LocalDestinations.CIDRs", l.CIDRs...)...)
+		ds = append(ds, validateHosts("LocalDestinations.Hosts", l.Hosts)...)
+	}
+	if p := proxy.RedirectPolicy; p != nil {
+		if p.SameHostOnly && len(p.AllowedHosts) > 0 {
+			ds.add(SeverityWarning, "RedirectPolicy.AllowedHosts", "unreachable, SameHostOnly only follows redirects to the same host")
+		}
+		if p.MaxHops < 0 {
+			ds.add(SeverityError, "RedirectPolicy.MaxHops", "negative number of redirects")
+		}
+	}
+	if b := proxy.DialBudget; b != nil {
+		if b.Attempts < 0 {
+			ds.add(SeverityError, "DialBudget.Attempts", "negative number of attempts")
+		}
+		if b.Total < 0 {
+			ds.add(SeverityError, "DialBudget.Total", "negative duration")
+		}
+	}
+	if p := proxy.UserAgentPolicy; p != nil && p.Mode == UserAgentOverride && p.UserAgent == "" {
+		ds.add(SeverityError, "UserAgentPolicy.UserAgent", "missing User-Agent to override with")
+	}
+	if proxy.MaxCacheObjectSize < 0 {
+		ds.add(SeverityError, "MaxCacheObjectSize", "negative size")
+	}
+	if proxy.RangeFullFetchMaxSize > proxy.maxCacheObjectSize() && proxy.Cache != nil {
+		ds.add(SeverityWarning, "RangeFullFetchMaxSize", "objects larger than MaxCacheObjectSize are fetched entirely for every range request")
+	}
+	if proxy.StalePolicy != nil && proxy.Cache == nil {
+		ds.add(SeverityWarning, "StalePolicy", "unreachable without a Cache")
+	}
+	if proxy.Prefetcher != nil {
+		if proxy.Cache == nil {
+			ds.add(SeverityWarning, "Prefetcher", "only preconnects without a Cache")
+		}
+		for i, rule := range proxy.Prefetcher.Rules {
+			if rule.Match == nil {
+				ds.add(SeverityError, fmt.Sprintf("Prefetcher.Rules[%d].Match", i), "missing regular expression")
+			}
+		}
+	}
+	if e := proxy.InternalEndpoints; e != nil {
+		if strings.ContainsAny(e.host(), ":/ ") {
+			ds.add(SeverityError, "InternalEndpoints.Host", "invalid host name %q", e.host())
+		}
+		if e.CA != nil && len(e.CA.Certificate) == 0 {
+			ds.add(SeverityError, "InternalEndpoints.CA", "missing certificate")
+		}
+		if e.ConfigPush != nil && e.ConfigPush.Generate == nil && proxy.LocalDestinations == nil {
+			ds.add(SeverityWarning, "InternalEndpoints.ConfigPush", "pushes empty configurations without Generate or LocalDestinations")
+		}
+	}
+	if n, ok := proxy.Notifier.(*WebhookNotifier); ok {
+		if u, err := http.NewRequest("POST", n.URL, nil); err != nil || u.URL.Host == "" {
+			ds.add(SeverityError, "Notifier.URL", "invalid webhook URL %q", n.URL)
+		}
+	}
+	if proxy.Tracing != nil && proxy.Tracing.Token == "" {
+		ds.add(SeverityWarning, "Tracing.Token", "is empty, no request is traced")
+	}
+	if FIPSMode {
+		if err := proxy.VerifyFIPS(); err != nil {
+			ds.add(SeverityError, "FIPS", "%v", err)
+		}
+	}
+	if proxy.TunnelEngine == TunnelEngineEpoll && !proxy.Capabilities().EpollTunnels {
+		ds.add(SeverityWarning, "TunnelEngine", "epoll is not available on %s, the tunnels are relayed with goroutines", proxy.Capabilities().OS)
+	}
+	if proxy.SourcePorts != nil && len(proxy.SourcePorts.Ranges) == 0 && !proxy.Capabilities().BindNoPort {
+		ds.add(SeverityWarning, "SourcePorts", "without Ranges, the local ports are not shared across destinations on %s", proxy.Capabilities().OS)
+	}
+	if proxy.AdminProfiling != nil && proxy.AdminProfiling.Token == "" {
+		ds.add(SeverityWarning, "AdminProfiling.Token", "is empty, the profiling routes are not served")
+	}
+	return ds
+}
+
+func (proxy *ProxyHttpServer) serveValidate(w http.ResponseWriter, r *http.Request) {
+	ds := proxy.Validate()
+	if ds == nil {
+		ds = Diagnostics{}
+	}
+	w.Header().Set("Content-Type", ContentTypeJSON)
+	json.NewEncoder(w).Encode(ds)
+}
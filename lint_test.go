@@ -0,0 +1,54 @@
+package goproxy
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	proxy := NewProxyHttpServer()
+	if ds := proxy.Validate(); len(ds) != 0 {
+		t.Errorf("unexpected diagnostics of the default configuration:\n%s", ds)
+	}
+
+	proxy.LocalDestinations = &LocalDestinations{
+		CIDRs: []string{"10.0.0.0/8", "10.1.0.0/16", "300.0.0.0/8", "10.2.3.4", "fd00::/8", "10.0.0.0/8"},
+		Hosts: []string{"*.corp.example.com", "wiki.corp.example.com", "corp.example.com", "bad host"},
+	}
+	proxy.UserAgentPolicy = &UserAgentPolicy{Mode: UserAgentOverride}
+	proxy.RedirectPolicy = &RedirectPolicy{SameHostOnly: true, AllowedHosts: []string{"example.com"}}
+	proxy.Notifier = &WebhookNotifier{}
+	expected := map[string]Severity{
+		"LocalDestinations.CIDRs[1]":  SeverityWarning,
+		"LocalDestinations.CIDRs[2]":  SeverityError,
+		"LocalDestinations.CIDRs[3]":  SeverityWarning,
+		"LocalDestinations.CIDRs[5]":  SeverityWarning,
+		"LocalDestinations.Hosts[1]":  SeverityWarning,
+		"LocalDestinations.Hosts[3]":  SeverityError,
+		"UserAgentPolicy.UserAgent":   SeverityError,
+		"RedirectPolicy.AllowedHosts": SeverityWarning,
+		"Notifier.URL":                SeverityError,
+	}
+	ds := proxy.Validate()
+	if !ds.HasErrors() || len(ds) != len(expected) {
+		t.Errorf("unexpected diagnostics:\n%s", ds)
+	}
+	for _, d := range ds {
+		if severity, ok := expected[d.Field]; !ok || severity != d.Severity {
+			t.Errorf("unexpected diagnostic %s", d)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	proxy.AdminHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/validate", nil))
+	var served []map[string]string
+	orFatal("Decode", json.NewDecoder(rec.Body).Decode(&served), t)
+	if len(served) != len(expected) || served[0]["severity"] != "error" {
+		t.Errorf("unexpected served diagnostics %v", served)
+	}
+
+	if ds := ValidateRegexps("rules", `^ads\.`, `(unclosed`); len(ds) != 1 || ds[0].Field != "rules[1]" {
+		t.Errorf("unexpected regexp diagnostics %v", ds)
+	}
+}
@@ -0,0 +1,134 @@
+package goproxy
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// LocalDestinations detects the requests to the proxy host itself or to local networks, and
+// routes them directly instead of through the forward proxy the handlers chose, which would
+// send them back to the proxy or to a network it can't reach. Such requests get
+// ProxyCtx.ForwardProxyLocalRequest set.
+//
+// The loopback addresses, "localhost", the host name and the interface addresses of the proxy
+// host, and the address the client connected to are local. The host names are not resolved.
+type LocalDestinations struct {
+	// CIDRs are local networks in addition to the addresses of the proxy host, e.g.
+	// "10.0.0.0/8". Bare IP addresses are allowed.
+	CIDRs []string
+	// Hosts are local host names, e.g. "proxy.example.com". A leading "*." or "." matches the
+	// subdomains of the name, e.g. "*.corp.example.com".
+	Hosts []string
+	// Handler, if set, serves the plain HTTP requests to local destinations instead of the
+	// destinations themselves, e.g. the NonproxyHandler of the proxy. CONNECT requests are
+	// always tunneled directly.
+	Handler http.Handler
+
+	once     sync.Once
+	networks []*net.IPNet
+	hosts    map[string]bool
+	suffixes []string
+}
+
+func (l *LocalDestinations) init() {
+	l.networks = parseCIDRs(l.CIDRs)
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok {
+				l.networks = append(l.networks, &net.IPNet{IP: ipnet.IP, Mask: net.CIDRMask(len(ipnet.IP)*8, len(ipnet.IP)*8)})
+			}
+		}
+	}
+	l.hosts = map[string]bool{"localhost": true}
+	if hostname, err := os.Hostname(); err == nil {
+		l.hosts[strings.ToLower(hostname)] = true
+	}
+	for _, h := range l.Hosts {
+		h = strings.ToLower(h)
+		if suffix := strings.TrimPrefix(h, "*"); strings.HasPrefix(suffix, ".") {
+			l.suffixes = append(l.suffixes, suffix)
+		} else {
+			l.hosts[h] = true
+		}
+	}
+}
+
+// Contains reports whether hostport, a host with or without port, is local. self is the
+// address the client connected to, if known.
+func (l *LocalDestinations) Contains(hostport string, self net.Addr) bool {
+	l.once.Do(l.init)
+	if self != nil && hostport == self.String() {
+		return true
+	}
+	host := hostport
+	if h, _, err := net.SplitHostPort(hostport); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(strings.Trim(host, "[]"), "."))
+	if l.hosts[host] || strings.HasSuffix(host, ".localhost") {
+		return true
+	}
+	for _, suffix := range l.suffixes {
+		if strings.HasSuffix(host, suffix) {
+			return true
+		}
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	if ip.IsLoopback() || ip.IsUnspecified() {
+		return true
+	}
+	for _, n := range l.networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseCIDRs parses networks in CIDR notation or bare IP addresses, ignoring the invalid ones
+func parseCIDRs(cidrs []string) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		if _, n, err := net.ParseCIDR(cidr); err == nil {
+			networks = append(networks, n)
+		}
+	}
+	return networks
+}
+
+// routeLocal routes the request of ctx to host directly if it is local, and reports whether
+// it is
+func (proxy *ProxyHttpServer) routeLocal(ctx *ProxyCtx, host string) bool {
+	local := proxy.LocalDestinations
+	if local == nil {
+		return false
+	}
+	var self net.Addr
+	if ctx.Req != nil {
+		self, _ = ctx.Req.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	}
+	if !local.Contains(host, self) {
+		return false
+	}
+	if ctx.ForwardProxy != "" || ctx.ForwardProxyDirect || ctx.ForwardProxyTProxy {
+		ctx.Logf("%s is local, dialing it directly instead of through %q", host, ctx.ForwardProxy)
+	}
+	ctx.ForwardProxy = ""
+	ctx.ForwardProxyDirect = false
+	ctx.ForwardProxyTProxy = false
+	ctx.ForwardProxyLocalRequest = true
+	return true
+}
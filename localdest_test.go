@@ -0,0 +1,60 @@
+package goproxy
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestLocalDestinationsContains(t *testing.T) {
+	l := &LocalDestinations{CIDRs: []string{"10.1.0.0/16", "192.0.2.7"}, Hosts: []string{"Proxy.Example.com"}}
+	self := &net.TCPAddr{IP: net.ParseIP("203.0.113.1"), Port: 3128}
+	for _, host := range []string{"127.0.0.1:80", "[::1]:443", "localhost", "app.localhost:8080", "10.1.2.3",
+		"192.0.2.7:443", "proxy.example.com.", "203.0.113.1:3128", "0.0.0.0:80"} {
+		if !l.Contains(host, self) {
+			t.Errorf("expected %s to be local", host)
+		}
+	}
+	for _, host := range []string{"example.com:443", "10.2.0.1", "192.0.2.8:443", "203.0.113.1:80"} {
+		if l.Contains(host, self) {
+			t.Errorf("expected %s not to be local", host)
+		}
+	}
+}
+
+func TestLocalDestinationsBypassForwardProxy(t *testing.T) {
+	target := httptest.NewServer(ConstantHanlder("bobo"))
+	defer target.Close()
+
+	proxy := NewProxyHttpServer()
+	proxy.OnRequest().DoFunc(func(r *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response) {
+		// a forward proxy that doesn't exist
+		ctx.ForwardProxy = "192.0.2.1:3128"
+		return r, nil
+	})
+	proxy.LocalDestinations = &LocalDestinations{}
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	proxyURL, _ := url.Parse(s.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	resp, err := client.Get(target.URL)
+	orFatal("Get", err, t)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "bobo" {
+		t.Errorf("expected the local destination to be reached directly, got %s %q", resp.Status, body)
+	}
+
+	proxy.LocalDestinations = &LocalDestinations{Handler: ConstantHanlder("internal")}
+	resp, err = client.Get(target.URL)
+	orFatal("Get", err, t)
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "internal" {
+		t.Errorf("expected the local destination to be served by the handler, got %q", body)
+	}
+}
@@ -0,0 +1,264 @@
+package goproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// connectUDPPath is the default URI template of RFC 9298,
+// /.well-known/masque/udp/{target_host}/{target_port}/
+const connectUDPPath = "/.well-known/masque/udp/"
+
+// capsuleDatagram is the type of the DATAGRAM capsules of RFC 9297
+const capsuleDatagram = 0
+
+// ConnectUDP tunnels UDP flows, e.g. QUIC, through the proxy with CONNECT-UDP (RFC 9298), so
+// that the clients using HTTP/3 are not downgraded to TCP. The clients upgrade an HTTP/1.1
+// request to the default URI template to connect-udp, and exchange the datagrams with the
+// target in DATAGRAM capsules.
+//
+// The target host:port of a flow goes through the CONNECT handlers: a rejected CONNECT is
+// answered with its ctx.Resp, or 403. The flows can't go through a forward proxy, and the
+// bytes of their datagrams are accounted like the ones of the CONNECT tunnels.
+type ConnectUDP struct {
+	// IdleTimeout closes the flows without datagrams in either direction for that long, two
+	// minutes if zero
+	IdleTimeout time.Duration
+}
+
+func (c *ConnectUDP) idleTimeout() time.Duration {
+	if c.IdleTimeout <= 0 {
+		return 2 * time.Minute
+	}
+	return c.IdleTimeout
+}
+
+// isConnectUDPRequest reports whether r asks to upgrade its connection to connect-udp
+func isConnectUDPRequest(r *http.Request) bool {
+	return r.Method == "GET" && strings.EqualFold(r.Header.Get("Upgrade"), "connect-udp") &&
+		strings.HasPrefix(r.URL.Path, connectUDPPath)
+}
+
+// connectUDPTarget returns the host:port of the target of the CONNECT-UDP request r
+func connectUDPTarget(r *http.Request) (string, error) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.EscapedPath(), connectUDPPath), "/")
+	if len(parts) < 2 || parts[0] == "" || parts[1] == "" || len(parts) > 3 || len(parts) == 3 && parts[2] != "" {
+		return "", errors.New("malformed CONNECT-UDP target " + r.URL.Path)
+	}
+	host, err := url.PathUnescape(parts[0])
+	if err != nil {
+		return "", err
+	}
+	port, err := url.PathUnescape(parts[1])
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// serveConnectUDP serves the CONNECT-UDP request r
+func (proxy *ProxyHttpServer) serveConnectUDP(w http.ResponseWriter, r *http.Request) {
+	target, err := connectUDPTarget(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// the handlers and the accounting see the target as the host of the request
+	u := *r.URL
+	u.Host = target
+	r = r.WithContext(r.Context())
+	r.URL = &u
+
+	ctx := proxy.acquireCtx(r, proxy.config().pooled)
+	ctx.Target = target
+	defer ctx.release()
+	defer ctx.freeMemory()
+
+	todo := OkConnect
+	for _, h := range proxy.httpsHandlers {
+		if newtodo, _ := ctx.handleConnect(h, target); newtodo != nil {
+			todo = newtodo
+			break
+		}
+	}
+	var resp *http.Response
+	if todo.Action == ConnectReject {
+		if resp = ctx.Resp; resp == nil {
+			resp = NewResponse(r, ContentTypeText, http.StatusForbidden, "Forbidden")
+		}
+	} else if resp = proxy.failClosed(ctx); resp == nil {
+		resp = proxy.drained(ctx, target)
+	}
+	if resp == nil && ctx.ForwardProxy != "" {
+		ctx.Warnf("Cannot tunnel UDP to %s through the forward proxy %s", target, ctx.ForwardProxy)
+		resp = NewResponse(r, ContentTypeText, http.StatusBadGateway, "Bad Gateway")
+	}
+	var udp net.Conn
+	if resp == nil {
+		if udp, err = proxy.dialContext(withProxyCtx(context.Background(), ctx), "udp", target); err != nil {
+			ctx.Warnf("Cannot dial UDP %s: %v", target, err)
+			resp = NewResponse(r, ContentTypeText, http.StatusBadGateway, "Bad Gateway")
+		}
+	}
+	if resp != nil {
+		defer resp.Body.Close()
+		copyHeaders(w.Header(), resp.Header, false)
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+		return
+	}
+	defer udp.Close()
+
+	hij, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "cannot upgrade the connection", http.StatusInternalServerError)
+		return
+	}
+	conn, brw, err := hij.Hijack()
+	if err != nil {
+		ctx.Warnf("Cannot hijack the CONNECT-UDP connection: %v", err)
+		return
+	}
+	client := hijackedConn(conn, brw)
+	defer client.Close()
+	defer proxy.trackSession(ctx, SessionTunnel, target)()
+	if _, err := io.WriteString(client, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\n"+
+		"Upgrade: connect-udp\r\nCapsule-Protocol: ?1\r\n\r\n"); err != nil {
+		return
+	}
+	ctx.Debugf(DebugTunnel, "Relaying UDP to %s", target)
+	proxy.relayUDP(ctx, client, udp)
+}
+
+// relayUDP relays the datagrams of the DATAGRAM capsules read from client to udp, and the
+// datagrams read from udp back to client, until one of them is closed or idle
+func (proxy *ProxyHttpServer) relayUDP(ctx *ProxyCtx, client net.Conn, udp net.Conn) {
+	idle := proxy.ConnectUDP.idleTimeout()
+	var mu sync.Mutex
+	last := time.Now()
+	touch := func() {
+		mu.Lock()
+		last = time.Now()
+		mu.Unlock()
+	}
+	closeAll := func() {
+		client.Close()
+		udp.Close()
+	}
+	var sent, received int64
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer closeAll()
+		r := bufio.NewReader(client)
+		for {
+			typ, payload, err := readCapsule(r)
+			if err != nil {
+				return
+			}
+			if typ != capsuleDatagram {
+				continue
+			}
+			pr := bytes.NewReader(payload)
+			if id, err := readQUICVarint(pr); err != nil || id != 0 {
+				// no other context is registered
+				continue
+			}
+			data := payload[len(payload)-pr.Len():]
+			if _, err := udp.Write(data); err != nil {
+				return
+			}
+			sent += int64(len(data))
+			touch()
+		}
+	}()
+
+	buf := make([]byte, 65535)
+	for {
+		udp.SetReadDeadline(time.Now().Add(idle))
+		n, err := udp.Read(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				mu.Lock()
+				active := time.Since(last) < idle
+				mu.Unlock()
+				if active {
+					continue
+				}
+				ctx.Debugf(DebugTunnel, "UDP flow idle, closing it")
+			}
+			break
+		}
+		received += int64(n)
+		touch()
+		capsule := appendQUICVarint(nil, capsuleDatagram)
+		capsule = appendQUICVarint(capsule, uint64(n+1))
+		capsule = append(appendQUICVarint(capsule, 0), buf[:n]...)
+		if _, err := client.Write(capsule); err != nil {
+			break
+		}
+	}
+	closeAll()
+	wg.Wait()
+	ctx.BytesSent += sent
+	ctx.BytesReceived += received
+	proxy.account(ctx)
+}
+
+// readCapsule reads a capsule of RFC 9297 from r
+func readCapsule(r *bufio.Reader) (typ uint64, payload []byte, err error) {
+	if typ, err = readQUICVarint(r); err != nil {
+		return 0, nil, err
+	}
+	n, err := readQUICVarint(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	if n > 1<<16 {
+		return 0, nil, errors.New("capsule too large")
+	}
+	payload = make([]byte, n)
+	_, err = io.ReadFull(r, payload)
+	return typ, payload, err
+}
+
+// readQUICVarint reads a variable-length integer of RFC 9000
+func readQUICVarint(r io.ByteReader) (uint64, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	n := 1 << (b >> 6)
+	v := uint64(b & 0x3f)
+	for i := 1; i < n; i++ {
+		if b, err = r.ReadByte(); err != nil {
+			return 0, err
+		}
+		v = v<<8 | uint64(b)
+	}
+	return v, nil
+}
+
+// appendQUICVarint appends v to b as a variable-length integer of RFC 9000
+func appendQUICVarint(b []byte, v uint64) []byte {
+	switch {
+	case v < 1<<6:
+		return append(b, byte(v))
+	case v < 1<<14:
+		return append(b, byte(v>>8)|0x40, byte(v))
+	case v < 1<<30:
+		return append(b, byte(v>>24)|0x80, byte(v>>16), byte(v>>8), byte(v))
+	default:
+		return append(b, byte(v>>56)|0xc0, byte(v>>48), byte(v>>40), byte(v>>32), byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	}
+}
@@ -0,0 +1,74 @@
+package goproxy
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestConnectUDP(t *testing.T) {
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	orFatal("ListenPacket", err, t)
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], addr)
+		}
+	}()
+	_, port, _ := net.SplitHostPort(echo.LocalAddr().String())
+
+	records := make(chan *AccountingRecord, 1)
+	proxy := NewProxyHttpServer()
+	proxy.ConnectUDP = &ConnectUDP{}
+	proxy.OnAccounting = func(r *AccountingRecord) { records <- r }
+	proxy.OnRequest(DstHostIs("127.0.0.2:53")).HandleConnect(AlwaysReject)
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	c, err := net.Dial("tcp", s.Listener.Addr().String())
+	orFatal("Dial", err, t)
+	defer c.Close()
+	r := bufio.NewReader(c)
+	c.Write([]byte("GET /.well-known/masque/udp/127.0.0.1/" + port + "/ HTTP/1.1\r\nHost: proxy\r\n" +
+		"Connection: Upgrade\r\nUpgrade: connect-udp\r\nCapsule-Protocol: ?1\r\n\r\n"))
+	resp, err := http.ReadResponse(r, nil)
+	orFatal("ReadResponse", err, t)
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected the flow to be upgraded, got %s", resp.Status)
+	}
+	c.Write([]byte{capsuleDatagram, 6, 0, 'h', 'e', 'l', 'l', 'o'})
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	typ, payload, err := readCapsule(r)
+	orFatal("readCapsule", err, t)
+	if typ != capsuleDatagram || string(payload) != "\x00hello" {
+		t.Errorf("expected the datagram to be echoed, got %d %q", typ, payload)
+	}
+	c.Close()
+	select {
+	case rec := <-records:
+		if rec.BytesSent != 5 || rec.BytesReceived != 5 || rec.Destination != "127.0.0.1:"+port {
+			t.Errorf("expected the flow to be accounted, got %+v", rec)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("expected the flow to be accounted")
+	}
+
+	c2, err := net.Dial("tcp", s.Listener.Addr().String())
+	orFatal("Dial", err, t)
+	defer c2.Close()
+	c2.Write([]byte("GET /.well-known/masque/udp/127.0.0.2/53/ HTTP/1.1\r\nHost: proxy\r\n" +
+		"Connection: Upgrade\r\nUpgrade: connect-udp\r\n\r\n"))
+	resp, err = http.ReadResponse(bufio.NewReader(c2), nil)
+	orFatal("ReadResponse", err, t)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected the rejected target to be denied, got %s", resp.Status)
+	}
+}
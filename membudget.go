@@ -0,0 +1,106 @@
+package goproxy
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync/atomic"
+)
+
+// ErrMemoryBudget is the error of the requests buffering more than their MemoryBudget allows
+var ErrMemoryBudget = errors.New("memory budget exceeded")
+
+// MemoryBudget bounds the bytes the requests buffer in memory: the bodies read entirely by
+// the inspection features of the proxy, the responses being cached and what the handlers
+// account with ReserveMemory. The buffering of a request exceeding the budget fails with
+// ErrMemoryBudget, and the feature fails the request as it does for the other errors.
+type MemoryBudget struct {
+	// PerSession bounds the bytes buffered by a request, unbounded if zero
+	PerSession int64
+	// Total bounds the bytes buffered by all the requests, unbounded if zero
+	Total int64
+	// SpillDir is the directory of the files of the SpillBuffers, the default directory for
+	// temporary files if empty
+	SpillDir string
+
+	used int64
+}
+
+// Used returns the bytes buffered by all the requests
+func (b *MemoryBudget) Used() int64 {
+	return atomic.LoadInt64(&b.used)
+}
+
+// ReserveMemory accounts n more bytes buffered by the request of ctx, until it is done or
+// they are released with ReleaseMemory. It returns ErrMemoryBudget, and reserves nothing,
+// if they don't fit in the MemoryBudget of the proxy.
+func (ctx *ProxyCtx) ReserveMemory(n int64) error {
+	if ctx.Proxy == nil || ctx.Proxy.MemoryBudget == nil || n <= 0 {
+		return nil
+	}
+	b := ctx.Proxy.MemoryBudget
+	if used := atomic.AddInt64(&ctx.memory, n); b.PerSession > 0 && used > b.PerSession {
+		atomic.AddInt64(&ctx.memory, -n)
+		return ErrMemoryBudget
+	}
+	if used := atomic.AddInt64(&b.used, n); b.Total > 0 && used > b.Total {
+		atomic.AddInt64(&b.used, -n)
+		atomic.AddInt64(&ctx.memory, -n)
+		return ErrMemoryBudget
+	}
+	return nil
+}
+
+// ReleaseMemory releases n bytes reserved with ReserveMemory
+func (ctx *ProxyCtx) ReleaseMemory(n int64) {
+	if ctx.Proxy == nil || ctx.Proxy.MemoryBudget == nil || n <= 0 {
+		return
+	}
+	atomic.AddInt64(&ctx.memory, -n)
+	atomic.AddInt64(&ctx.Proxy.MemoryBudget.used, -n)
+}
+
+// MemoryUsed returns the bytes buffered by the request of ctx
+func (ctx *ProxyCtx) MemoryUsed() int64 {
+	return atomic.LoadInt64(&ctx.memory)
+}
+
+// freeMemory releases all the memory reserved and the SpillBuffers of the request of ctx, once
+// it is done
+func (ctx *ProxyCtx) freeMemory() {
+	for _, b := range ctx.spills {
+		b.Close()
+	}
+	ctx.spills = nil
+	if ctx.Proxy == nil || ctx.Proxy.MemoryBudget == nil {
+		return
+	}
+	if n := atomic.SwapInt64(&ctx.memory, 0); n != 0 {
+		atomic.AddInt64(&ctx.Proxy.MemoryBudget.used, -n)
+	}
+}
+
+// readAll reads r entirely like ioutil.ReadAll, reserving the bytes read
+func (ctx *ProxyCtx) readAll(r io.Reader) ([]byte, error) {
+	if ctx.Proxy == nil || ctx.Proxy.MemoryBudget == nil {
+		return ioutil.ReadAll(r)
+	}
+	return ioutil.ReadAll(&budgetReader{ctx: ctx, r: r})
+}
+
+// budgetReader reserves the bytes read from r
+type budgetReader struct {
+	ctx *ProxyCtx
+	r   io.Reader
+}
+
+func (b *budgetReader) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if n > 0 {
+		if err := b.ctx.ReserveMemory(int64(n)); err != nil {
+			b.ctx.Warnf("cannot buffer body, %d bytes buffered: %v", b.ctx.MemoryUsed(), err)
+			return 0, err
+		}
+	}
+	return n, err
+}
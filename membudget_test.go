@@ -0,0 +1,101 @@
+package goproxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMemoryBudget(t *testing.T) {
+	proxy := NewProxyHttpServer()
+	proxy.MemoryBudget = &MemoryBudget{PerSession: 100, Total: 150}
+	a := &ProxyCtx{Proxy: proxy}
+	b := &ProxyCtx{Proxy: proxy}
+	orFatal("ReserveMemory", a.ReserveMemory(60), t)
+	if err := a.ReserveMemory(60); err != ErrMemoryBudget {
+		t.Errorf("session budget not enforced: %v", err)
+	}
+	orFatal("ReserveMemory", b.ReserveMemory(90), t)
+	if err := a.ReserveMemory(10); err != ErrMemoryBudget {
+		t.Errorf("total budget not enforced: %v", err)
+	}
+	if a.MemoryUsed() != 60 || b.MemoryUsed() != 90 || proxy.MemoryBudget.Used() != 150 {
+		t.Errorf("unexpected usage %d %d %d", a.MemoryUsed(), b.MemoryUsed(), proxy.MemoryBudget.Used())
+	}
+	b.ReleaseMemory(40)
+	orFatal("ReserveMemory", a.ReserveMemory(30), t)
+	a.freeMemory()
+	b.freeMemory()
+	if a.MemoryUsed() != 0 || proxy.MemoryBudget.Used() != 0 {
+		t.Errorf("memory not freed: %d %d", a.MemoryUsed(), proxy.MemoryBudget.Used())
+	}
+
+	// the inspection features fail the requests whose bodies don't fit in the budget
+	body := bytes.Repeat([]byte("0123456789"), 1000)
+	sum := sha256.Sum256(body)
+	header := http.Header{"Digest": {"sha-256=" + base64.StdEncoding.EncodeToString(sum[:])}}
+	policy := &IntegrityPolicy{}
+	resp := integrityResponse("http://example.com/a", body, header)
+	ctx := &ProxyCtx{Req: resp.Request, Proxy: proxy}
+	if resp = policy.Handle(resp, ctx); resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("body over budget relayed: %d", resp.StatusCode)
+	}
+	proxy.MemoryBudget.PerSession = 0
+	proxy.MemoryBudget.Total = 0
+	resp = integrityResponse("http://example.com/a", body, header)
+	ctx = &ProxyCtx{Req: resp.Request, Proxy: proxy}
+	if resp = policy.Handle(resp, ctx); resp.StatusCode != http.StatusOK || ctx.MemoryUsed() != int64(len(body)) {
+		t.Errorf("unexpected status %d with %d bytes buffered", resp.StatusCode, ctx.MemoryUsed())
+	}
+}
+
+func TestMemoryFreedPerMitmRequest(t *testing.T) {
+	backend := httptest.NewServer(ConstantHanlder("hello"))
+	defer backend.Close()
+	proxy := NewProxyHttpServer()
+	proxy.MemoryBudget = &MemoryBudget{}
+	proxy.OnRequest().HandleConnect(AlwaysMitm)
+	proxy.OnResponse().DoFunc(func(resp *http.Response, ctx *ProxyCtx) *http.Response {
+		orFatal("ReserveMemory", ctx.ReserveMemory(100), t)
+		return resp
+	})
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", s.Listener.Addr().String())
+	orFatal("Dial", err, t)
+	defer conn.Close()
+	host := backend.Listener.Addr().String()
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", host, host)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	orFatal("CONNECT", err, t)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT failed: %v", resp.Status)
+	}
+	tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+	reader := bufio.NewReader(tlsConn)
+
+	// the memory of each request is freed once it is served, while the connection is still open
+	for i := 0; i < 2; i++ {
+		fmt.Fprintf(tlsConn, "GET / HTTP/1.1\r\nHost: %s\r\n\r\n", host)
+		resp, err := http.ReadResponse(reader, nil)
+		orFatal("ReadResponse", err, t)
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		for deadline := time.Now().Add(time.Second); proxy.MemoryBudget.Used() != 0 && time.Now().Before(deadline); {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if used := proxy.MemoryBudget.Used(); used != 0 {
+			t.Errorf("request %d: %d bytes still reserved", i, used)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package goproxy
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// TrackingParams are common query parameters that don't change the resource being requested
+var TrackingParams = []string{"utm_*", "fbclid", "gclid", "dclid", "msclkid", "mc_cid", "mc_eid", "_ga", "yclid"}
+
+// RequestNormalizer canonicalizes requests into keys that are equal for equivalent requests,
+// used to look up caches and detect duplicate requests
+type RequestNormalizer struct {
+	// StripParams are the query parameters left out of the keys. A trailing * matches
+	// every parameter with the prefix.
+	StripParams []string
+	// KeyHeaders are the request headers that are part of the keys, e.g. Accept-Encoding
+	// when the responses vary on it
+	KeyHeaders []string
+}
+
+// DefaultRequestNormalizer strips the TrackingParams
+var DefaultRequestNormalizer = &RequestNormalizer{StripParams: TrackingParams}
+
+func (n *RequestNormalizer) stripped(param string) bool {
+	return paramMatches(n.StripParams, param)
+}
+
+// paramMatches reports whether the query parameter param is one of params, where a trailing *
+// matches every parameter with the prefix
+func paramMatches(params []string, param string) bool {
+	for _, p := range params {
+		if strings.HasSuffix(p, "*") {
+			if strings.HasPrefix(param, p[:len(p)-1]) {
+				return true
+			}
+		} else if param == p {
+			return true
+		}
+	}
+	return false
+}
+
+// Key returns the canonical form of req: its method and URL with the host in lower case, the
+// default port removed, the query parameters sorted and the stripped parameters removed,
+// followed by the KeyHeaders
+func (n *RequestNormalizer) Key(req *http.Request) string {
+	u := req.URL
+	scheme := strings.ToLower(u.Scheme)
+	host := strings.ToLower(u.Host)
+	if host == "" {
+		host = strings.ToLower(req.Host)
+	}
+	if h, port, err := net.SplitHostPort(host); err == nil {
+		if (scheme == "http" && port == "80") || (scheme == "https" && port == "443") {
+			host = h
+			if strings.Contains(h, ":") {
+				host = "[" + h + "]"
+			}
+		}
+	}
+	host = strings.TrimSuffix(host, ".")
+
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+
+	query := u.Query()
+	params := make([]string, 0, len(query))
+	for p := range query {
+		if !n.stripped(p) {
+			params = append(params, p)
+		}
+	}
+	sort.Strings(params)
+	var q []string
+	for _, p := range params {
+		values := query[p]
+		sort.Strings(values)
+		for _, v := range values {
+			q = append(q, url.QueryEscape(p)+"="+url.QueryEscape(v))
+		}
+	}
+
+	key := req.Method + " " + scheme + "://" + host + path
+	if len(q) > 0 {
+		key += "?" + strings.Join(q, "&")
+	}
+	for _, h := range n.KeyHeaders {
+		key += "\n" + http.CanonicalHeaderKey(h) + ": " + strings.Join(req.Header[http.CanonicalHeaderKey(h)], ",")
+	}
+	return key
+}
+
+// RequestKey returns the canonical key of the request of ctx, computed with the Normalizer of
+// the proxy, or DefaultRequestNormalizer
+func (ctx *ProxyCtx) RequestKey() string {
+	if ctx.Req == nil {
+		return ""
+	}
+	if ctx.requestKeyReq == ctx.Req {
+		return ctx.requestKey
+	}
+	ctx.requestKey, ctx.requestKeyReq = ctx.Proxy.normalizer().Key(ctx.Req), ctx.Req
+	return ctx.requestKey
+}
+
+func (proxy *ProxyHttpServer) normalizer() *RequestNormalizer {
+	if proxy != nil && proxy.Normalizer != nil {
+		return proxy.Normalizer
+	}
+	return DefaultRequestNormalizer
+}
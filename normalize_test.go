@@ -0,0 +1,27 @@
+package goproxy
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestRequestKey(t *testing.T) {
+	key := func(u string) string {
+		req, err := http.NewRequest("GET", u, nil)
+		orFatal("NewRequest", err, t)
+		return (&ProxyCtx{Req: req}).RequestKey()
+	}
+	expected := "GET http://example.com/a?b=1&b=2&c=3"
+	for _, u := range []string{
+		"http://example.com/a?c=3&b=2&b=1",
+		"http://EXAMPLE.com:80/a?b=1&utm_source=x&c=3&b=2",
+		"http://example.com./a?fbclid=y&b=2&c=3&b=1",
+	} {
+		if k := key(u); k != expected {
+			t.Errorf("%s: expected key %q, got %q", u, expected, k)
+		}
+	}
+	if k := key("https://example.com:8443/"); k != "GET https://example.com:8443/" {
+		t.Errorf("unexpected key %q", k)
+	}
+}
@@ -0,0 +1,227 @@
+package goproxy
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// EventType is the kind of an operational Event
+type EventType string
+
+const (
+	// EventUpstreamDown is sent when a forward proxy fails and the next one of the fallback
+	// chain is tried, its subject is the forward proxy
+	EventUpstreamDown EventType = "upstream_down"
+	// EventCAExpiring is sent by CheckCAExpiry, its subject is the CA
+	EventCAExpiring EventType = "ca_expiring"
+	// EventQuotaExceeded is sent by EnforceQuota, its subject is the quota key
+	EventQuotaExceeded EventType = "quota_exceeded"
+	// EventReloadApplied and EventReloadFailed are sent by ArtifactDistributor when it loads a
+	// new version of its artifact, their subject is the artifact
+	EventReloadApplied EventType = "reload_applied"
+	EventReloadFailed  EventType = "reload_failed"
+	// EventReloadScheduled is sent by ArtifactDistributor when it fetches a version to load at
+	// its activation time
+	EventReloadScheduled EventType = "reload_scheduled"
+	// EventFailClosed is sent when a subsystem of StrictEgress becomes unhealthy, its subject
+	// is the subsystem
+	EventFailClosed EventType = "fail_closed"
+	// EventSLOBurnRate is sent by SLOTracker when a BurnRateAlert starts firing, its subject is
+	// the objective
+	EventSLOBurnRate EventType = "slo_burn_rate"
+)
+
+// Event is an operational event of the proxy
+type Event struct {
+	Type    EventType         `json:"type"`
+	Time    time.Time         `json:"time"`
+	Subject string            `json:"subject"`
+	Message string            `json:"message"`
+	Fields  map[string]string `json:"fields,omitempty"`
+}
+
+// Notifier delivers operational events, e.g. to a webhook. Notify must not block.
+type Notifier interface {
+	Notify(e Event)
+}
+
+// NewEvent returns an Event of the current time
+func NewEvent(t EventType, subject, message string) Event {
+	return Event{Type: t, Time: time.Now(), Subject: subject, Message: message}
+}
+
+// notify sends an event to the notifier of the proxy, if any
+func (proxy *ProxyHttpServer) notify(e Event) {
+	if proxy != nil && proxy.Notifier != nil {
+		proxy.Notifier.Notify(e)
+	}
+}
+
+// WebhookNotifier is a Notifier posting the events to an HTTP webhook, from a queue, with
+// retries. The payload is the event in JSON, or the output of Template, e.g. for a chat
+// webhook:
+//
+//	&goproxy.WebhookNotifier{URL: hookURL,
+//		Template: template.Must(template.New("").Parse(`{"text": "{{.Type}} {{.Subject}}: {{.Message}}"}`))}
+type WebhookNotifier struct {
+	URL string
+	// Template, if set, renders the payload from the Event
+	Template *template.Template
+	// ContentType of the payload, application/json if empty
+	ContentType string
+	Header      http.Header
+	// Client is the client posting the events, http.DefaultClient if nil
+	Client *http.Client
+	// Events are the types of events sent, all of them if empty
+	Events []EventType
+	// Throttle, if not zero, drops the events of the same type and subject as an event sent
+	// less than Throttle ago
+	Throttle time.Duration
+	// Retries is the number of retries of a failed delivery, 3 if zero, with a Backoff (a second
+	// if zero) doubled after every attempt
+	Retries int
+	Backoff time.Duration
+	// QueueSize bounds the events waiting to be delivered, the others are dropped. 100 if zero.
+	QueueSize int
+	// OnError, if set, is called with the events that couldn't be delivered or were dropped
+	OnError func(e Event, err error)
+
+	once  sync.Once
+	queue chan Event
+	mu    sync.Mutex
+	sent  map[string]time.Time
+}
+
+func (n *WebhookNotifier) init() {
+	size := n.QueueSize
+	if size <= 0 {
+		size = 100
+	}
+	n.queue = make(chan Event, size)
+	n.sent = make(map[string]time.Time)
+	go n.run()
+}
+
+// Notify implements Notifier
+func (n *WebhookNotifier) Notify(e Event) {
+	n.once.Do(n.init)
+	if len(n.Events) > 0 {
+		wanted := false
+		for _, t := range n.Events {
+			wanted = wanted || t == e.Type
+		}
+		if !wanted {
+			return
+		}
+	}
+	if n.Throttle > 0 {
+		key := string(e.Type) + "\n" + e.Subject
+		n.mu.Lock()
+		last, ok := n.sent[key]
+		if ok && e.Time.Sub(last) < n.Throttle {
+			n.mu.Unlock()
+			return
+		}
+		n.sent[key] = e.Time
+		n.mu.Unlock()
+	}
+	select {
+	case n.queue <- e:
+	default:
+		n.failed(e, fmt.Errorf("webhook queue full"))
+	}
+}
+
+func (n *WebhookNotifier) failed(e Event, err error) {
+	if n.OnError != nil {
+		n.OnError(e, err)
+	}
+}
+
+func (n *WebhookNotifier) run() {
+	for e := range n.queue {
+		payload, err := n.payload(e)
+		if err != nil {
+			n.failed(e, err)
+			continue
+		}
+		retries, backoff := n.Retries, n.Backoff
+		if retries <= 0 {
+			retries = 3
+		}
+		if backoff <= 0 {
+			backoff = time.Second
+		}
+		for attempt := 0; ; attempt++ {
+			if err = n.post(payload); err == nil || attempt >= retries {
+				break
+			}
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		if err != nil {
+			n.failed(e, err)
+		}
+	}
+}
+
+func (n *WebhookNotifier) payload(e Event) ([]byte, error) {
+	if n.Template == nil {
+		return json.Marshal(e)
+	}
+	var buf bytes.Buffer
+	if err := n.Template.Execute(&buf, e); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (n *WebhookNotifier) post(payload []byte) error {
+	req, err := http.NewRequest("POST", n.URL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	for k, vs := range n.Header {
+		req.Header[k] = vs
+	}
+	contentType := n.ContentType
+	if contentType == "" {
+		contentType = ContentTypeJSON
+	}
+	req.Header.Set("Content-Type", contentType)
+	client := n.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+// CheckCAExpiry sends an EventCAExpiring to the notifier of the proxy if ca expires within
+// the given duration, and reports whether it does. Call it periodically, e.g. daily.
+func (proxy *ProxyHttpServer) CheckCAExpiry(ca *x509.Certificate, within time.Duration) bool {
+	left := time.Until(ca.NotAfter)
+	if left > within {
+		return false
+	}
+	e := NewEvent(EventCAExpiring, ca.Subject.CommonName, fmt.Sprintf("CA expires on %s", ca.NotAfter.Format(time.RFC3339)))
+	e.Fields = map[string]string{"not_after": ca.NotAfter.Format(time.RFC3339), "serial": ca.SerialNumber.String()}
+	proxy.notify(e)
+	return true
+}
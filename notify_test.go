@@ -0,0 +1,92 @@
+package goproxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"text/template"
+	"time"
+)
+
+type notifierFunc func(e Event)
+
+func (f notifierFunc) Notify(e Event) { f(e) }
+
+func TestWebhookNotifier(t *testing.T) {
+	var calls int32
+	payloads := make(chan string, 10)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		payloads <- r.Header.Get("Content-Type") + " " + string(body)
+	}))
+	defer hook.Close()
+
+	n := &WebhookNotifier{URL: hook.URL, Backoff: time.Millisecond, Throttle: time.Hour,
+		Events:   []EventType{EventQuotaExceeded, EventCAExpiring},
+		Template: template.Must(template.New("").Parse(`{"text": "{{.Type}} {{.Subject}}"}`))}
+	n.Notify(NewEvent(EventReloadApplied, "ads", "loaded"))
+	n.Notify(NewEvent(EventQuotaExceeded, "alice", "quota exceeded"))
+	n.Notify(NewEvent(EventQuotaExceeded, "alice", "quota exceeded"))
+	proxy := NewProxyHttpServer()
+	proxy.Notifier = n
+	if !proxy.CheckCAExpiry(GoproxyCa.Leaf, 100*365*24*time.Hour) || proxy.CheckCAExpiry(GoproxyCa.Leaf, 0) {
+		t.Error("unexpected CA expiry check")
+	}
+
+	for _, expected := range []string{
+		`application/json {"text": "quota_exceeded alice"}`,
+		`application/json {"text": "ca_expiring ` + GoproxyCa.Leaf.Subject.CommonName + `"}`,
+	} {
+		select {
+		case p := <-payloads:
+			if p != expected {
+				t.Errorf("expected payload %s, got %s", expected, p)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("webhook not called")
+		}
+	}
+	select {
+	case p := <-payloads:
+		t.Errorf("unexpected payload %s", p)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestArtifactDistributorNotifies(t *testing.T) {
+	var events []EventType
+	d := &ArtifactDistributor{Name: "ads", Coordinator: &memoryCoordinator{leader: true},
+		Build:    func() ([]byte, error) { return []byte("v1"), nil },
+		Load:     func(data []byte) error { return nil },
+		Notifier: notifierFunc(func(e Event) { events = append(events, e.Type) })}
+	orFatal("Sync", d.Sync(), t)
+	if len(events) != 1 || events[0] != EventReloadApplied {
+		t.Errorf("unexpected events %v", events)
+	}
+}
+
+type memoryCoordinator struct {
+	leader    bool
+	artifacts map[string]Artifact
+}
+
+func (c *memoryCoordinator) IsLeader() (bool, error) { return c.leader, nil }
+
+func (c *memoryCoordinator) Publish(a Artifact) error {
+	if c.artifacts == nil {
+		c.artifacts = make(map[string]Artifact)
+	}
+	c.artifacts[a.Name] = a
+	return nil
+}
+
+func (c *memoryCoordinator) Fetch(name string) (Artifact, bool, error) {
+	a, ok := c.artifacts[name]
+	return a, ok, nil
+}
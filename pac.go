@@ -0,0 +1,59 @@
+package goproxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// PAC returns a proxy auto-config file sending the requests of the browsers to the proxy at
+// proxyAddr, except the ones to the local destinations which go direct, as the proxy itself
+// routes them. The IPv6 networks of CIDRs are left out, PAC files can't match them.
+func (l *LocalDestinations) PAC(proxyAddr string) string {
+	var b strings.Builder
+	b.WriteString("function FindProxyForURL(url, host) {\n")
+	b.WriteString("\thost = host.toLowerCase();\n")
+	b.WriteString("\tif (host == \"localhost\" || dnsDomainIs(host, \".localhost\") || shExpMatch(host, \"127.*\") || host == \"[::1]\")\n\t\treturn \"DIRECT\";\n")
+	for _, h := range l.Hosts {
+		h = strings.ToLower(h)
+		if suffix := strings.TrimPrefix(h, "*"); strings.HasPrefix(suffix, ".") {
+			fmt.Fprintf(&b, "\tif (dnsDomainIs(host, %q))\n\t\treturn \"DIRECT\";\n", suffix)
+		} else {
+			fmt.Fprintf(&b, "\tif (host == %q)\n\t\treturn \"DIRECT\";\n", h)
+		}
+	}
+	for _, n := range parseCIDRs(l.CIDRs) {
+		if ip4 := n.IP.To4(); ip4 != nil && len(n.Mask) == net.IPv4len {
+			fmt.Fprintf(&b, "\tif (isInNet(host, %q, %q))\n\t\treturn \"DIRECT\";\n", ip4.String(), net.IP(n.Mask).String())
+		}
+	}
+	fmt.Fprintf(&b, "\treturn %q;\n}\n", "PROXY "+proxyAddr)
+	return b.String()
+}
+
+// pacProxyAddr returns the address the client of r reaches the proxy at: addr if not empty,
+// the address it connected to otherwise
+func pacProxyAddr(addr string, r *http.Request) string {
+	if addr != "" {
+		return addr
+	}
+	if self, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		return self.String()
+	}
+	return r.Host
+}
+
+// PACHandler returns a handler serving the PAC file generated from the LocalDestinations of the
+// proxy, to be served e.g. by the NonproxyHandler. proxyAddr is the address the clients reach
+// the proxy at, the address they connected to if empty.
+func (proxy *ProxyHttpServer) PACHandler(proxyAddr string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		local := proxy.LocalDestinations
+		if local == nil {
+			local = &LocalDestinations{}
+		}
+		w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+		w.Write([]byte(local.PAC(pacProxyAddr(proxyAddr, r))))
+	})
+}
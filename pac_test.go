@@ -0,0 +1,70 @@
+package goproxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPAC(t *testing.T) {
+	l := &LocalDestinations{Hosts: []string{"*.corp.example.com", "intranet"}, CIDRs: []string{"10.0.0.0/8", "192.0.2.7", "fd00::/8"}}
+	pac := l.PAC("proxy.example.com:3128")
+	for _, expected := range []string{
+		`dnsDomainIs(host, ".corp.example.com")`,
+		`host == "intranet"`,
+		`isInNet(host, "10.0.0.0", "255.0.0.0")`,
+		`isInNet(host, "192.0.2.7", "255.255.255.255")`,
+		`return "PROXY proxy.example.com:3128";`,
+	} {
+		if !strings.Contains(pac, expected) {
+			t.Errorf("expected %s in PAC file:\n%s", expected, pac)
+		}
+	}
+	if strings.Contains(pac, "fd00") {
+		t.Errorf("expected the IPv6 networks to be left out:\n%s", pac)
+	}
+	if !l.Contains("www.corp.example.com:443", nil) || l.Contains("corp.example.com.evil.com", nil) {
+		t.Error("expected the direct destinations of the PAC file to be routed directly by the proxy")
+	}
+}
+
+func TestPACHandler(t *testing.T) {
+	proxy := NewProxyHttpServer()
+	proxy.LocalDestinations = &LocalDestinations{Hosts: []string{"intranet"}}
+	s := httptest.NewServer(proxy.PACHandler(""))
+	defer s.Close()
+	resp, err := http.Get(s.URL + "/proxy.pac")
+	orFatal("GET", err, t)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), `"PROXY `+s.Listener.Addr().String()+`"`) {
+		t.Errorf("expected the clients to be sent to the address they connected to, got\n%s", body)
+	}
+}
+
+func TestWPADHandler(t *testing.T) {
+	proxy := NewProxyHttpServer()
+	s := httptest.NewServer(proxy.WPADHandler("proxy.example.com:3128", ConstantHanlder("nonproxy")))
+	defer s.Close()
+	for _, path := range []string{"/wpad.dat", "/wpad.da", "/bobo"} {
+		resp, err := http.Get(s.URL + path)
+		orFatal("GET", err, t)
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		isPAC := strings.Contains(string(body), "PROXY proxy.example.com:3128")
+		if isPAC != (path != "/bobo") {
+			t.Errorf("unexpected response to %s: %q", path, body)
+		}
+	}
+
+	option, err := WPADDHCPOption("http://wpad/wpad.dat")
+	orFatal("WPADDHCPOption", err, t)
+	if option[0] != 252 || int(option[1]) != len("http://wpad/wpad.dat") || string(option[2:]) != "http://wpad/wpad.dat" {
+		t.Errorf("unexpected DHCP option %q", option)
+	}
+	if _, err := WPADDHCPOption(strings.Repeat("a", 256)); err == nil {
+		t.Error("expected an error for a PAC URL too long for a DHCP option")
+	}
+}
@@ -0,0 +1,97 @@
+package goproxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"runtime/debug"
+)
+
+// recovered reports the panic p of the user callback named callback, recovered while handling
+// the request of ctx
+func (ctx *ProxyCtx) recovered(callback string, p interface{}) {
+	ctx.Error = fmt.Errorf("panic in %s: %v", callback, p)
+	ctx.Warnf("panic in %s, session %d: %v\n%s", callback, ctx.Session, p, debug.Stack())
+	ctx.SetErrorMetric()
+	if ctx.Proxy != nil && ctx.Proxy.PanicsMetric != nil {
+		metric := *ctx.Proxy.PanicsMetric
+		metric.Inc()
+	}
+}
+
+// panicResponse returns the 502 response sent to the client of ctx when a callback panicked
+func (ctx *ProxyCtx) panicResponse(r *http.Request) *http.Response {
+	return NewResponse(r, ContentTypeText, http.StatusBadGateway, "Bad Gateway")
+}
+
+// handleReq runs the request handler h, and answers 502 if it panics
+func (ctx *ProxyCtx) handleReq(h ReqHandler, r *http.Request) (req *http.Request, resp *http.Response) {
+	defer func() {
+		if p := recover(); p != nil {
+			ctx.recovered("request handler", p)
+			req, resp = r, ctx.panicResponse(r)
+		}
+	}()
+	return h.Handle(r, ctx)
+}
+
+// handleResp runs the response handler h, and answers 502 if it panics, closing the body of
+// the upstream response
+func (ctx *ProxyCtx) handleResp(h RespHandler, resp *http.Response) (newResp *http.Response) {
+	defer func() {
+		if p := recover(); p != nil {
+			ctx.recovered("response handler", p)
+			if resp != nil && resp.Body != nil {
+				resp.Body.Close()
+			}
+			newResp = ctx.panicResponse(ctx.Req)
+		}
+	}()
+	return h.Handle(resp, ctx)
+}
+
+// handleResponseHeaders runs the response headers handler h, and rejects the response if it
+// panics
+func (ctx *ProxyCtx) handleResponseHeaders(h ResponseHeadersHandler, resp *http.Response) (d *PolicyDecision) {
+	defer func() {
+		if p := recover(); p != nil {
+			ctx.recovered("response headers handler", p)
+			d = &PolicyDecision{Policy: "panic", Reason: "response headers handler failed"}
+		}
+	}()
+	return h.HandleResponseHeaders(resp, ctx)
+}
+
+// handleWebSocketMessage runs the WebSocket handler h, and drops the message if it panics
+func (ctx *ProxyCtx) handleWebSocketMessage(h WebSocketHandler, msg *WebSocketMessage) (newMsg *WebSocketMessage) {
+	defer func() {
+		if p := recover(); p != nil {
+			ctx.recovered("WebSocket handler", p)
+			newMsg = nil
+		}
+	}()
+	return h.HandleWebSocketMessage(msg, ctx)
+}
+
+// handleConnect runs the CONNECT handler h, and rejects the CONNECT with a 502 if it panics
+func (ctx *ProxyCtx) handleConnect(h HttpsHandler, host string) (todo *ConnectAction, newHost string) {
+	defer func() {
+		if p := recover(); p != nil {
+			ctx.recovered("CONNECT handler", p)
+			ctx.Resp = ctx.panicResponse(ctx.Req)
+			todo, newHost = RejectConnect, host
+		}
+	}()
+	return h.HandleConnect(host, ctx)
+}
+
+// hijack runs the hijack function of todo, and closes the client connection if it panics
+func (ctx *ProxyCtx) hijack(todo *ConnectAction, r *http.Request, client net.Conn) {
+	defer func() {
+		if p := recover(); p != nil {
+			ctx.recovered("CONNECT hijack", p)
+			client.Close()
+		}
+	}()
+	todo.Hijack(r, client, ctx)
+}
@@ -0,0 +1,41 @@
+package goproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestHandlerPanics(t *testing.T) {
+	origin := httptest.NewServer(ConstantHanlder("bobo"))
+	defer origin.Close()
+	proxy := NewProxyHttpServer()
+	proxy.OnRequest(UrlIs("/request")).DoFunc(func(r *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response) {
+		panic("bobo")
+	})
+	proxy.OnResponse(UrlIs("/response")).DoFunc(func(resp *http.Response, ctx *ProxyCtx) *http.Response {
+		var m map[string]string
+		m["bobo"] = "bobo"
+		return resp
+	})
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+	proxyURL, _ := url.Parse(s.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	for _, path := range []string{"/request", "/response"} {
+		resp, err := client.Get(origin.URL + path)
+		orFatal("Get "+path, err, t)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadGateway {
+			t.Errorf("%s: expected 502, got %s", path, resp.Status)
+		}
+	}
+	resp, err := client.Get(origin.URL + "/ok")
+	orFatal("Get /ok", err, t)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected the proxy to keep serving, got %s", resp.Status)
+	}
+}
@@ -0,0 +1,204 @@
+package goproxy
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PrefetchRule adds URLs to prefetch when a response to an URL matching Match is received.
+// The URLs of Prefetch may refer to the submatches of Match, as in regexp.Expand.
+//
+//	goproxy.PrefetchRule{Match: regexp.MustCompile(`^(https://cdn\.example\.com/v/\d+)/index\.html$`),
+//		Prefetch: []string{"$1/app.js", "$1/app.css"}}
+type PrefetchRule struct {
+	Match    *regexp.Regexp
+	Prefetch []string
+}
+
+// Prefetcher warms the cache of the proxy with the resources that responses announce with
+// Link: rel=preload headers, or that match a PrefetchRule. Link: rel=preconnect hints resolve
+// the host, which warms the DNS cache when the request uses a CachingResolver.
+type Prefetcher struct {
+	Rules []PrefetchRule
+	// MaxConcurrent bounds the prefetches in flight, 4 if zero
+	MaxConcurrent int
+	// ByteBudget bounds the bytes prefetched every BudgetPeriod (a minute if zero),
+	// there is no bound if it is zero
+	ByteBudget   int64
+	BudgetPeriod time.Duration
+
+	once     sync.Once
+	sem      chan struct{}
+	mu       sync.Mutex
+	inflight map[string]bool
+	spent    int64
+	period   time.Time
+}
+
+func (p *Prefetcher) init() {
+	n := p.MaxConcurrent
+	if n <= 0 {
+		n = 4
+	}
+	p.sem = make(chan struct{}, n)
+	p.inflight = make(map[string]bool)
+}
+
+// hasBudget reports whether the byte budget of the current period is not spent
+func (p *Prefetcher) hasBudget() bool {
+	if p.ByteBudget <= 0 {
+		return true
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	period := p.BudgetPeriod
+	if period <= 0 {
+		period = time.Minute
+	}
+	if time.Since(p.period) > period {
+		p.period = time.Now()
+		p.spent = 0
+	}
+	return p.spent < p.ByteBudget
+}
+
+func (p *Prefetcher) spend(n int64) {
+	p.mu.Lock()
+	p.spent += n
+	p.mu.Unlock()
+}
+
+// linkHints returns the URLs of the Link headers of h with the given relation type
+func linkHints(h http.Header, rel string) []string {
+	var urls []string
+	for _, v := range h["Link"] {
+		for _, link := range strings.Split(v, ",") {
+			parts := strings.Split(link, ";")
+			target := strings.TrimSpace(parts[0])
+			if !strings.HasPrefix(target, "<") || !strings.HasSuffix(target, ">") {
+				continue
+			}
+			for _, param := range parts[1:] {
+				param = strings.TrimSpace(param)
+				if !strings.HasPrefix(strings.ToLower(param), "rel=") {
+					continue
+				}
+				for _, r := range strings.Fields(strings.Trim(param[len("rel="):], `"`)) {
+					if strings.EqualFold(r, rel) {
+						urls = append(urls, target[1:len(target)-1])
+					}
+				}
+			}
+		}
+	}
+	return urls
+}
+
+// targets returns the absolute URLs to prefetch and to preconnect to for resp
+func (p *Prefetcher) targets(resp *http.Response) (prefetch []string, preconnect []string) {
+	base := resp.Request.URL
+	resolve := func(ref string) string {
+		u, err := base.Parse(ref)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return ""
+		}
+		return u.String()
+	}
+	for _, ref := range linkHints(resp.Header, "preload") {
+		if u := resolve(ref); u != "" {
+			prefetch = append(prefetch, u)
+		}
+	}
+	for _, ref := range linkHints(resp.Header, "preconnect") {
+		if u := resolve(ref); u != "" {
+			preconnect = append(preconnect, u)
+		}
+	}
+	for _, rule := range p.Rules {
+		s := base.String()
+		m := rule.Match.FindStringSubmatchIndex(s)
+		if m == nil {
+			continue
+		}
+		for _, template := range rule.Prefetch {
+			if u := resolve(string(rule.Match.ExpandString(nil, template, s, m))); u != "" {
+				prefetch = append(prefetch, u)
+			}
+		}
+	}
+	return prefetch, preconnect
+}
+
+// prefetch starts the prefetches announced by resp, the response to the request of ctx
+func (proxy *ProxyHttpServer) prefetch(ctx *ProxyCtx, resp *http.Response) {
+	p := proxy.Prefetcher
+	if p == nil || resp == nil || resp.Request == nil || resp.Request.URL == nil {
+		return
+	}
+	p.once.Do(p.init)
+	prefetch, preconnect := p.targets(resp)
+
+	for _, target := range preconnect {
+		u, _ := url.Parse(target)
+		host := u.Hostname()
+		bg := ctx.background(ctx.Req)
+		go func() {
+			bg.primaryResolver("udp").LookupIP(withProxyCtx(context.Background(), bg), host, bg.lookupHints("ip"))
+		}()
+	}
+
+	if proxy.Cache == nil {
+		return
+	}
+	for _, target := range prefetch {
+		req, err := http.NewRequest("GET", target, nil)
+		if err != nil {
+			continue
+		}
+		if ua := ctx.Req.Header.Get("User-Agent"); ua != "" {
+			req.Header.Set("User-Agent", ua)
+		}
+		if cached, ok := proxy.Cache.Get(proxy.cacheKey(ctx, req)); ok && cached.Fresh(time.Now()) {
+			continue
+		}
+		p.mu.Lock()
+		if p.inflight[target] {
+			p.mu.Unlock()
+			continue
+		}
+		p.inflight[target] = true
+		p.mu.Unlock()
+
+		bg := ctx.background(req)
+		go func(req *http.Request) {
+			defer bg.freeMemory()
+			defer func() {
+				p.mu.Lock()
+				delete(p.inflight, req.URL.String())
+				p.mu.Unlock()
+			}()
+			p.sem <- struct{}{}
+			defer func() { <-p.sem }()
+			if !p.hasBudget() {
+				return
+			}
+			resp, err := proxy.fetch(bg, req, bg.RoundTrip)
+			if err != nil {
+				bg.Logf("prefetch of %s failed: %v", req.URL, err)
+				return
+			}
+			// reading the body entirely stores it in the cache
+			n, _ := io.Copy(ioutil.Discard, io.LimitReader(resp.Body, proxy.maxCacheObjectSize()+1))
+			resp.Body.Close()
+			p.spend(n)
+			bg.Logf("prefetched %s: %d bytes", req.URL, n)
+		}(req)
+	}
+}
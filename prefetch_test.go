@@ -0,0 +1,29 @@
+package goproxy
+
+import (
+	"net/http"
+	"net/url"
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+func TestPrefetchTargets(t *testing.T) {
+	p := &Prefetcher{Rules: []PrefetchRule{{
+		Match:    regexp.MustCompile(`^(http://example\.com/v/\d+)/index\.html$`),
+		Prefetch: []string{"$1/app.js"},
+	}}}
+	u, _ := url.Parse("http://example.com/v/2/index.html")
+	resp := &http.Response{Request: &http.Request{URL: u}, Header: http.Header{}}
+	resp.Header.Add("Link", `</style.css>; rel=preload; as=style, <https://cdn.example.com>; rel="preconnect"`)
+	resp.Header.Add("Link", `<ftp://example.com/x>; rel=preload`)
+
+	prefetch, preconnect := p.targets(resp)
+	expected := []string{"http://example.com/style.css", "http://example.com/v/2/app.js"}
+	if !reflect.DeepEqual(prefetch, expected) {
+		t.Errorf("expected prefetch of %v, got %v", expected, prefetch)
+	}
+	if !reflect.DeepEqual(preconnect, []string{"https://cdn.example.com"}) {
+		t.Errorf("unexpected preconnect %v", preconnect)
+	}
+}
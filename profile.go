@@ -0,0 +1,114 @@
+package goproxy
+
+import (
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Stages of the requests profiled by a ProfilingPolicy
+const (
+	StageRequestHandlers  = "request_handlers"
+	StageUpstream         = "upstream"
+	StageResponseHandlers = "response_handlers"
+	StageResponseCopy     = "response_copy"
+)
+
+// ProfilingPolicy profiles a sample of the plain HTTP requests, to find where the latency of
+// the proxy is spent: the wall time of each stage of the pipeline and the bytes relayed are
+// recorded. The sampled requests are traced too when Tracing is set, so that the time spent
+// in each handler is in their trace, see TracePolicy.
+type ProfilingPolicy struct {
+	// SampleRate is the fraction of the requests profiled, from 0 to 1
+	SampleRate float64
+	// StageMetric, if set, observes the seconds spent in each stage, labeled with the stage
+	StageMetric *prometheus.HistogramVec
+	// BytesMetric, if set, observes the bytes relayed by the requests, labeled with "sent" or
+	// "received"
+	BytesMetric *prometheus.HistogramVec
+	// OnProfile, if set, is called with the profile of each profiled request once it is done
+	OnProfile func(*RequestProfile)
+}
+
+// RequestProfile is the profile of a request sampled by a ProfilingPolicy
+type RequestProfile struct {
+	Session  int64         `json:"session"`
+	Method   string        `json:"method"`
+	URL      string        `json:"url"`
+	Started  time.Time     `json:"started"`
+	Duration time.Duration `json:"duration"`
+	// Stages is the wall time spent in each stage of the request
+	Stages        map[string]time.Duration `json:"stages"`
+	BytesSent     int64                    `json:"bytes_sent"`
+	BytesReceived int64                    `json:"bytes_received"`
+	// TraceID is the ID of the trace of the request, if it was traced
+	TraceID string `json:"trace_id,omitempty"`
+
+	// whether the profile started the trace of the request
+	traced bool
+}
+
+// startProfile starts the profile of the request r of ctx if it is sampled, and reports
+// whether it did
+func (proxy *ProxyHttpServer) startProfile(ctx *ProxyCtx, r *http.Request) bool {
+	policy := proxy.Profiling
+	if policy == nil || policy.SampleRate <= 0 || rand.Float64() >= policy.SampleRate {
+		return false
+	}
+	p := &RequestProfile{Session: ctx.Session, Method: r.Method, URL: r.URL.String(), Started: time.Now(),
+		Stages: make(map[string]time.Duration)}
+	if ctx.trace != nil {
+		p.TraceID = ctx.trace.ID
+	} else if proxy.Tracing != nil {
+		p.TraceID, p.traced = proxy.Tracing.start(ctx, r), true
+	}
+	ctx.profile = p
+	return true
+}
+
+// profileStart returns the start of a stage of the request of ctx, the zero time if it is
+// not profiled
+func (ctx *ProxyCtx) profileStart() time.Time {
+	if ctx.profile == nil {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+// profileStage records the stage of the request of ctx started at start
+func (ctx *ProxyCtx) profileStage(stage string, start time.Time) {
+	if ctx.profile == nil {
+		return
+	}
+	d := time.Since(start)
+	ctx.profile.Stages[stage] += d
+	ctx.trace.event("stage", "%s in %v", stage, d)
+}
+
+// finishProfile records the profile of the request of ctx once it is done
+func (ctx *ProxyCtx) finishProfile() {
+	p := ctx.profile
+	if p == nil {
+		return
+	}
+	if p.traced {
+		ctx.finishTrace()
+	}
+	p.Duration = time.Since(p.Started)
+	p.BytesSent, p.BytesReceived = ctx.BytesSent, ctx.BytesReceived
+	policy := ctx.Proxy.Profiling
+	if policy.StageMetric != nil {
+		for stage, d := range p.Stages {
+			policy.StageMetric.WithLabelValues(stage).Observe(d.Seconds())
+		}
+	}
+	if policy.BytesMetric != nil {
+		policy.BytesMetric.WithLabelValues("sent").Observe(float64(p.BytesSent))
+		policy.BytesMetric.WithLabelValues("received").Observe(float64(p.BytesReceived))
+	}
+	if policy.OnProfile != nil {
+		policy.OnProfile(p)
+	}
+}
@@ -0,0 +1,80 @@
+package goproxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestProfiling(t *testing.T) {
+	background := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "profiled")
+	}))
+	defer background.Close()
+	profiles := make(chan *RequestProfile, 1)
+	proxy := NewProxyHttpServer()
+	proxy.Tracing = &TracePolicy{}
+	proxy.Profiling = &ProfilingPolicy{
+		SampleRate:  1,
+		StageMetric: prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "stages"}, []string{"stage"}),
+		OnProfile:   func(p *RequestProfile) { profiles <- p },
+	}
+	proxy.OnRequest().DoFunc(func(r *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response) {
+		time.Sleep(10 * time.Millisecond)
+		return r, nil
+	})
+	srv := httptest.NewServer(proxy)
+	defer srv.Close()
+	proxyURL, _ := url.Parse(srv.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	resp, err := client.Get(background.URL)
+	orFatal("Get", err, t)
+	resp.Body.Close()
+	if resp.Header.Get(TraceIDHeader) != "" {
+		t.Errorf("the trace of a sampled request is sent to the client")
+	}
+	p := <-profiles
+	for _, stage := range []string{StageRequestHandlers, StageUpstream, StageResponseHandlers, StageResponseCopy} {
+		if _, ok := p.Stages[stage]; !ok {
+			t.Errorf("stage %s not profiled: %v", stage, p.Stages)
+		}
+	}
+	if p.Stages[StageRequestHandlers] < 10*time.Millisecond || p.Duration < p.Stages[StageRequestHandlers] ||
+		p.BytesReceived != int64(len("profiled")) {
+		t.Errorf("unexpected profile %+v", p)
+	}
+	observed := make(chan prometheus.Metric, 10)
+	proxy.Profiling.StageMetric.Collect(observed)
+	if len(observed) != 4 {
+		t.Errorf("%d stages observed", len(observed))
+	}
+	trace, ok := proxy.Tracing.Trace(p.TraceID)
+	if !ok {
+		t.Fatalf("sampled request not traced")
+	}
+	stages := 0
+	for _, e := range trace.Events {
+		if e.Stage == "stage" {
+			stages++
+		}
+	}
+	if stages != 4 || trace.Duration == 0 {
+		t.Errorf("unexpected trace %+v", trace)
+	}
+
+	proxy.Profiling.SampleRate = 0
+	resp, err = client.Get(background.URL)
+	orFatal("Get", err, t)
+	resp.Body.Close()
+	select {
+	case p := <-profiles:
+		t.Errorf("request profiled: %+v", p)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
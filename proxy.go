@@ -8,9 +8,11 @@ import (
 	"net"
 	"net/http"
 	"os"
-	"regexp"
 	"sync"
 	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 // The basic proxy type. Implements http.Handler.
@@ -35,10 +37,197 @@ type ProxyHttpServer struct {
 	// ConnectDial will be used to create TCP connections for CONNECT requests
 	// if nil Tr.Dial will be used
 	ConnectDial func(network string, addr string) (net.Conn, error)
-	CertStore   CertStorage
-}
+	// CertStore, if set, caches the certificates signed for the MITM'd connections. Call
+	// Reconfigure after changing it while serving.
+	CertStore CertStorage
+
+	// DNSQueryLogger, if set, is called for every query made through the Resolver of a
+	// ProxyCtx (or its DNSResolver servers). LogDNSQuery writes them to the request log.
+	DNSQueryLogger func(ctx *ProxyCtx, q DNSQuery)
+	// DNSQueryLogSampleRate is the fraction of lookups reported to DNSQueryLogger,
+	// every lookup is reported if it is zero
+	DNSQueryLogSampleRate float64
+
+	// SourcePorts, if set, picks the local ports of connections bound to a source address
+	// (ForwardProxySourceIP and ForwardProxySourceIPv6)
+	SourcePorts *SourcePortAllocator
+
+	// TenantIdentity maps a request to the name of its tenant, ProxyUser is used if nil
+	TenantIdentity func(ctx *ProxyCtx) string
+	tenants        map[string]*Tenant
+	tenantsMu      sync.RWMutex
+
+	respHeadersHandlers []ResponseHeadersHandler
+	webSocketHandlers   []WebSocketHandler
+
+	// RedirectPolicy, if set, makes the proxy follow the redirects of the upstream servers
+	// for clients, see ProxyCtx.RedirectChain
+	RedirectPolicy *RedirectPolicy
+
+	// Normalizer computes ProxyCtx.RequestKey, DefaultRequestNormalizer is used if nil
+	Normalizer *RequestNormalizer
+
+	// Cache, if set, stores the cacheable responses and serves them while they are fresh
+	Cache ResponseCache
+	// MaxCacheObjectSize is the size of the largest body cached or shared between coalesced
+	// requests, 1MB if zero
+	MaxCacheObjectSize int64
+	// CoalesceRequests makes identical cacheable requests in flight share a single upstream
+	// request, see CoalesceHits
+	CoalesceRequests   bool
+	CoalesceHitsMetric *prometheus.Counter
+	coalescer          *coalescer
+	coalesceOnce       sync.Once
+
+	// RangeFullFetchMaxSize, if not zero, makes the proxy fetch the objects of up to this size
+	// entirely when a byte range of them is requested, and answer the range from the full object
+	RangeFullFetchMaxSize int64
+	// StalePolicy allows the cache to serve stale responses, see ProxyCtx.StalePolicy
+	StalePolicy    *StalePolicy
+	revalidating   map[string]bool
+	revalidatingMu sync.Mutex
+	// Prefetcher, if set, warms the cache with the resources announced by the responses
+	Prefetcher *Prefetcher
+	// EncodingPolicy controls the content encodings, see ProxyCtx.EncodingPolicy
+	EncodingPolicy *EncodingPolicy
+	// UserAgentPolicy controls the User-Agent sent upstream, see ProxyCtx.UserAgentPolicy
+	UserAgentPolicy *UserAgentPolicy
+	// HeaderLimits bounds the header of the requests sent upstream, see ProxyCtx.HeaderLimits
+	HeaderLimits *HeaderLimits
+	// PanicsMetric, if set, counts the panics recovered in the handlers
+	PanicsMetric *prometheus.Counter
+	// HandlerMetrics, if set, instruments the handlers
+	HandlerMetrics *HandlerMetrics
+	// ConnectResponse, if set, can rewrite the responses to the accepted CONNECT requests
+	ConnectResponse func(ctx *ProxyCtx, resp *ConnectResponse)
+	// UpstreamConnectErrorResponse, if set, maps the refusals of the forward proxies to the
+	// responses sent to the clients of the CONNECT requests, a nil response answers 502. The
+	// refusals are relayed as they are if it is not set.
+	UpstreamConnectErrorResponse func(ctx *ProxyCtx, err *UpstreamConnectError) *http.Response
+	// FallbackMetric, if set, counts the fallbacks to the upstreams of ProxyCtx.FallbackChain,
+	// labeled with the attempt number
+	FallbackMetric *prometheus.CounterVec
+	// DialBudget bounds the connect attempts to the addresses of the destinations, 3 addresses
+	// within the dial timeout if nil
+	DialBudget *DialBudget
+	// LocalDestinations, if set, routes the requests to the proxy host or to local networks
+	// directly, whatever forward proxy the handlers chose
+	LocalDestinations *LocalDestinations
+	// InternalEndpoints, if set, are answered by the proxy itself for their reserved host name
+	InternalEndpoints *InternalEndpoints
+	// BandwidthReport, if set, aggregates the traffic of the proxy per destination domain
+	BandwidthReport *BandwidthReport
+	// OnAccounting, if set, is called with the traffic of every request and tunnel once it is
+	// done, with its cost attribution tags
+	OnAccounting func(rec *AccountingRecord)
+	// OnUpgrade, if set, is called with the protocol of the requests upgrading their
+	// connection to another protocol than WebSocket, e.g. "h2c", before they are sent
+	// upstream. The upgrades it returns false for are answered 403.
+	OnUpgrade func(protocol string, ctx *ProxyCtx) bool
+	// TagMetrics, if set, counts the traffic by cost attribution tags
+	TagMetrics *TagMetrics
+	// Notifier, if set, is sent the operational events of the proxy
+	Notifier Notifier
+	// ShadowMetric, if set, counts what the shadow handlers would have done, labeled with the
+	// handler name and the outcome, see ReqProxyConds.Shadow
+	ShadowMetric *prometheus.CounterVec
+	// ErrorLog, if set, keeps the recent warnings and errors of the requests
+	ErrorLog *ErrorLog
+	// Tracing, if set, records diagnostic traces of the requests carrying its token
+	Tracing *TracePolicy
+	// Profiling, if set, profiles a sample of the requests
+	Profiling *ProfilingPolicy
+	// Streaming, if set, relays the large and the streamed response bodies without buffering
+	// them
+	Streaming *StreamingPolicy
+	// SLO, if set, tracks the service level objectives of the requests
+	SLO *SLOTracker
+	// FastPath relays the requests and the tunnels with as little work and as few allocations
+	// as possible while no handler is registered and no feature of the proxy needs to see
+	// them: the bodies are relayed as they are, through Tr, and only the tunnels are listed
+	// in Sessions. The traffic is accounted only if BandwidthReport, OnAccounting or
+	// TagMetrics is set.
+	FastPath bool
+	// PoolContexts reuses the ProxyCtx of the plain HTTP requests and of the accepted or
+	// rejected CONNECT requests once they are done, instead of allocating one per request.
+	// Handlers and Tail must then neither use their ctx nor keep it after the request is done.
+	// Call Reconfigure after changing it while serving.
+	PoolContexts bool
+	// ReresolveOnFailure flushes the cached addresses of a destination, in the CachingResolver
+	// of the request, and the idle connections of the transport when a connection to it fails,
+	// so that the next attempt resolves it again after its addresses moved
+	ReresolveOnFailure bool
+	// TunnelEngine relays the accepted CONNECT tunnels, TunnelEngineGoroutines if empty
+	TunnelEngine string
+	// TunnelMetric, if set, counts the tunnels relayed, their bytes and their errors, labeled
+	// with the engine relaying them and "tunnels", "bytes" or "errors"
+	TunnelMetric *prometheus.CounterVec
+	// WriteCoalescing, if set, batches the small writes relayed through the CONNECT tunnels
+	WriteCoalescing *WriteCoalescing
+	// AdaptiveBuffers, if set, sizes the buffers of the CONNECT tunnels from their
+	// throughput instead of CopyBufferSize
+	AdaptiveBuffers *AdaptiveBuffers
+	// MemoryBudget, if set, bounds the bytes the requests buffer in memory
+	MemoryBudget *MemoryBudget
+	// HTTP3, if set, is the transport of the requests with UpstreamHTTP3. goproxy does not
+	// implement QUIC itself, HTTP3 is typically the http3.RoundTripper of quic-go. The
+	// requests it fails are sent again over TCP, and their origins are then reached over TCP
+	// for a few minutes.
+	HTTP3 http.RoundTripper
+	// AdminProfiling, if set, serves the profiles and the runtime statistics of the process
+	// on the admin API
+	AdminProfiling *AdminProfiling
+	// SupportBundle sets what the support bundles of the admin API gather, see
+	// WriteSupportBundle
+	SupportBundle *SupportBundle
+	// StateComponents are the components whose warm state SaveState saves and LoadState
+	// restores across restarts, by name
+	StateComponents map[string]StatefulComponent
+	// StrictEgress, if set, denies the requests while the policy subsystems it checks are
+	// unhealthy
+	StrictEgress *StrictEgress
+	// GRPC, if set, relays the gRPC calls of the intercepted connections end to end over
+	// HTTP/2
+	GRPC *GRPCPassthrough
+	// ResponseAnnotations, if set, adds headers describing how the proxy handled the requests
+	// to their responses, see ProxyCtx.ResponseAnnotations
+	ResponseAnnotations *ResponseAnnotations
+	// DrainFlags, if set, keeps the new requests off the forward proxies and destinations
+	// marked as draining
+	DrainFlags *DrainFlags
+	// ConnectUDP, if set, tunnels the UDP flows of the CONNECT-UDP requests
+	ConnectUDP *ConnectUDP
+	// DefaultPorts are the ports of the destinations without one by URL scheme, in addition
+	// to the well-known ones (80 for http, 443 for https, ...). The unknown schemes default
+	// to 80. Call Reconfigure after changing them while serving.
+	DefaultPorts map[string]string
+	// ConnRecycling, if set, closes the pooled connections to the destinations once they
+	// reach a maximum lifetime
+	ConnRecycling *ConnRecycling
+
+	// requests and tunnels in progress, see Sessions
+	sessions sessionRegistry
+
+	// the transports of the requests with UpstreamHTTP2, by source addresses
+	http2Mu         sync.Mutex
+	http2Transports map[string]*http.Transport
+
+	// the origins reached over TCP after their HTTP/3 requests failed, until when
+	http3Mu     sync.Mutex
+	http3Broken map[string]time.Time
 
-var hasPort = regexp.MustCompile(`:\d+$`)
+	// cfg holds the *ctxConfig the new requests refer to, see Reconfigure
+	cfg   atomic.Value
+	cfgMu sync.Mutex
+
+	// names and priorities of the handlers, see Handlers
+	reqHandlerInfos   []HandlerInfo
+	respHandlerInfos  []HandlerInfo
+	httpsHandlerInfos []HandlerInfo
+
+	// components being debugged, see SetDebug
+	debugFlags uint32
+}
 
 var trPool = sync.Pool{
 	New: func() interface{} { return new(http.Transport) },
@@ -67,8 +256,14 @@ func isEof(r *bufio.Reader) bool {
 
 func (proxy *ProxyHttpServer) filterRequest(r *http.Request, ctx *ProxyCtx) (req *http.Request, resp *http.Response) {
 	req = r
-	for _, h := range proxy.reqHandlers {
-		req, resp = h.Handle(r, ctx)
+	if r != nil {
+		ctx.OriginalUserAgent = r.Header.Get("User-Agent")
+	}
+	for i, h := range proxy.reqHandlers {
+		ctx.Debugf(DebugHandlers, "running request handler %d %s", i, proxy.reqHandlerInfos[i].Name)
+		before := ctx.traceRequest(r)
+		req, resp = ctx.handleReq(h, r)
+		ctx.traceReqHandler(proxy.reqHandlerInfos[i].Name, before, req, resp)
 		// non-nil resp means the handler decided to skip sending the request
 		// and return canned response instead.
 		if resp != nil {
@@ -79,9 +274,14 @@ func (proxy *ProxyHttpServer) filterRequest(r *http.Request, ctx *ProxyCtx) (req
 }
 func (proxy *ProxyHttpServer) filterResponse(respOrig *http.Response, ctx *ProxyCtx) (resp *http.Response) {
 	resp = respOrig
-	for _, h := range proxy.respHandlers {
+	ctx.reduceResponseFingerprint(resp)
+	for i, h := range proxy.respHandlers {
+		ctx.Debugf(DebugHandlers, "running response handler %d %s", i, proxy.respHandlerInfos[i].Name)
 		ctx.Resp = resp
-		resp = h.Handle(resp, ctx)
+		start := time.Now()
+		newResp := ctx.handleResp(h, resp)
+		ctx.traceRespHandler(proxy.respHandlerInfos[i].Name, start, resp, newResp)
+		resp = newResp
 	}
 	return
 }
@@ -91,6 +291,9 @@ func removeProxyHeaders(ctx *ProxyCtx, r *http.Request) {
 	ctx.Logf("Sending request %v %v", r.Method, r.URL.String())
 	// If no Accept-Encoding header exists, Transport will add the headers it can accept
 	// and would wrap the response body with the relevant reader.
+	if !ctx.clientAcceptEncodingSet {
+		ctx.clientAcceptEncoding, ctx.clientAcceptEncodingSet = r.Header.Get("Accept-Encoding"), true
+	}
 	r.Header.Del("Accept-Encoding")
 	// curl can add that, see
 	// https://jdebp.eu./FGA/web-proxy-connection-header.html
@@ -113,71 +316,148 @@ func removeProxyHeaders(ctx *ProxyCtx, r *http.Request) {
 // Standard net/http function. Shouldn't be used directly, http.Serve will use it.
 func (proxy *ProxyHttpServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	//r.Header["X-Forwarded-For"] = w.RemoteAddr()
-	if r.Method == "CONNECT" {
+	if r.Method == "CONNECT" && r.ProtoMajor == 2 {
+		proxy.serveHTTP2Connect(w, r)
+	} else if r.Method == "CONNECT" {
 		proxy.HandleHttps(w, r, nil)
 	} else {
 
-		ctx := &ProxyCtx{Req: r, Session: atomic.AddInt64(&proxy.sess, 1), Proxy: proxy}
-
 		if r == nil || r.URL == nil {
 			return
 		}
 
 		var err error
 
+		if r.ProtoMajor == 2 {
+			absoluteHTTP2URL(r)
+		}
+
+		if proxy.ConnectUDP != nil && isConnectUDPRequest(r) {
+			proxy.serveConnectUDP(w, r)
+			return
+		}
 		if !r.URL.IsAbs() {
 			proxy.NonproxyHandler.ServeHTTP(w, r)
 			return
 		}
+		if proxy.fastPath() && !isUpgradeRequest(r) {
+			proxy.serveFastPath(w, r)
+			return
+		}
 
+		ctx := proxy.acquireCtx(r, proxy.config().pooled)
+		ctx.Target = proxy.target(r)
+		defer ctx.release()
+		defer ctx.freeMemory()
+
+		if id := proxy.startTrace(ctx, r); id != "" {
+			w.Header().Set(TraceIDHeader, id)
+			defer ctx.finishTrace()
+		}
+		if proxy.startProfile(ctx, r) {
+			defer ctx.finishProfile()
+		}
+		start := ctx.profileStart()
 		r, resp := proxy.filterRequest(r, ctx)
+		ctx.profileStage(StageRequestHandlers, start)
 		// If a cancel function is set, ensure we call it when
 		// we've finished handling the request
 		if ctx.Cancel != nil {
 			defer ctx.Cancel()
 		}
+		defer ctx.finishIdempotent()
 
 		if r == nil || r.URL == nil {
 			return
 		}
+		defer proxy.trackSession(ctx, SessionHTTP, r.URL.Host)()
 
 		ctx.Logf("Got request %v %v %v %v", r.URL.Path, r.Host, r.Method, r.URL.String())
 
+		if resp == nil {
+			resp = proxy.internalResponse(ctx, r)
+		}
+		if resp == nil {
+			resp = proxy.failClosed(ctx)
+		}
+		if resp == nil {
+			resp = proxy.drained(ctx, r.URL.Host)
+		}
+
+		if resp == nil && proxy.routeLocal(ctx, r.URL.Host) && proxy.LocalDestinations.Handler != nil {
+			proxy.LocalDestinations.Handler.ServeHTTP(w, r)
+			return
+		}
+
+		if resp == nil && isWebSocketRequest(r) {
+			proxy.hijackWebSocket(w, r, ctx)
+			return
+		}
+		if resp == nil && isUpgradeRequest(r) {
+			proxy.hijackUpgrade(w, r, ctx)
+			return
+		}
+
 		if resp == nil {
 			removeProxyHeaders(ctx, r)
-			resp, err = ctx.RoundTrip(r)
+			ctx.setUpstreamAcceptEncoding(r)
+			start := ctx.profileStart()
+			resp, err = proxy.fetch(ctx, r, func(r *http.Request) (*http.Response, error) {
+				ctx.traceUpstream(r.URL.Host, r.Header)
+				resp, err := ctx.RoundTrip(r)
 
-			if err != nil {
-				ctx.Logf("http roundtrip error %+v", err)
-				if ctx.BackupDNSResolver != "" {
-					ctx.DNSResolver = ctx.BackupDNSResolver
-					ctx.Logf("http retrying with backup resolver %s", ctx.DNSResolver)
-					resp, err = ctx.RoundTrip(r)
+				if err != nil {
+					ctx.Logf("http roundtrip error %+v", err)
+					if ctx.BackupResolver != nil {
+						ctx.Resolver = ctx.BackupResolver
+						ctx.Logf("http retrying with backup resolver %v", ctx.Resolver)
+						resp, err = ctx.RoundTrip(r)
+					} else if ctx.BackupDNSResolver != "" {
+						ctx.DNSResolver = ctx.BackupDNSResolver
+						ctx.Logf("http retrying with backup resolver %s", ctx.DNSResolver)
+						resp, err = ctx.RoundTrip(r)
+					}
 				}
-			}
+				if err == nil {
+					resp, err = ctx.followRedirects(r, resp)
+				}
+				return resp, err
+			})
+			ctx.profileStage(StageUpstream, start)
 
 			if err != nil {
 				if ctx.CloseOnError {
 					ctx.Logf("http roundtrip error, closing: %+v", err)
 					r.Close = true
+					proxy.SLO.observe(ctx, http.StatusBadGateway)
 					return
 				}
 				ctx.Logf("http roundtrip error %+v", err)
 				ctx.Error = err
+				start := ctx.profileStart()
 				resp = proxy.filterResponse(nil, ctx)
+				ctx.profileStage(StageResponseHandlers, start)
 
 			}
 			if resp != nil {
 				ctx.Logf("Received response %v", resp.Status)
+				resp = proxy.validateResponseHeaders(resp, ctx)
+				proxy.prefetch(ctx, resp)
 			}
 		}
+		ctx.streaming = proxy.Streaming.streams(resp)
+		start = ctx.profileStart()
 		resp = proxy.filterResponse(resp, ctx)
+		ctx.profileStage(StageResponseHandlers, start)
+		resp = ctx.recordIdempotent(resp)
 
 		if resp == nil {
+			ctx.annotateResponse(w.Header())
 			var errorString string
 			if ctx.Error != nil {
 				errorString = "error read response " + r.URL.Host + " : " + ctx.Error.Error()
-				ctx.Logf(errorString)
+				ctx.Errorf("%s", errorString)
+				ctx.traceResponse(w.Header(), 500)
 				if proxy.ErrorPages.Enabled() {
 					proxy.ErrorPages.WriteErrorPage(ctx.Error, r.URL.Host, w)
 				} else {
@@ -186,14 +466,17 @@ func (proxy *ProxyHttpServer) ServeHTTP(w http.ResponseWriter, r *http.Request)
 			} else {
 				errorString = "error read response " + r.URL.Host
 				ctx.Logf(errorString)
+				ctx.traceResponse(w.Header(), 500)
 				if proxy.ErrorPages.Enabled() {
 					proxy.ErrorPages.WriteErrorPage(errors.New(errorString), r.URL.Host, w)
 				} else {
 					http.Error(w, errorString, 500)
 				}
 			}
+			proxy.SLO.observe(ctx, http.StatusInternalServerError)
 			return
 		}
+		resp = ctx.encodeForClient(resp)
 		origBody := resp.Body
 		defer origBody.Close()
 		ctx.Logf("Copying response to client %v [%d]", resp.Status, resp.StatusCode)
@@ -207,14 +490,30 @@ func (proxy *ProxyHttpServer) ServeHTTP(w http.ResponseWriter, r *http.Request)
 			resp.Header.Del("Content-Length")
 		}
 		copyHeaders(w.Header(), resp.Header, proxy.KeepDestinationHeaders)
+		announceTrailers(w.Header(), resp)
+		ctx.annotateResponse(w.Header())
+		ctx.traceResponse(w.Header(), resp.StatusCode)
+		ctx.markFirstByte()
 		w.WriteHeader(resp.StatusCode)
-		nr, err := io.Copy(w, resp.Body)
+		start = ctx.profileStart()
+		var nr int64
+		if ctx.streaming {
+			nr, err = copyStreaming(w, resp)
+		} else {
+			nr, err = io.Copy(w, resp.Body)
+		}
+		ctx.profileStage(StageResponseCopy, start)
+		copyTrailers(w.Header(), resp)
+		ctx.markResponseDone()
+		proxy.SLO.observe(ctx, resp.StatusCode)
 		if err := resp.Body.Close(); err != nil {
 			ctx.Warnf("Can't close response body %v", err)
 		}
 		ctx.BytesReceived += nr
 		ctx.Logf("Copied %v bytes to client error=%v", nr, err)
 		ctx.Logf("Copied %v bytes from client error=%v", ctx.BytesSent, err)
+		ctx.Logf("First byte after %v, response done after %v at %.0f B/s", ctx.FirstByte, ctx.ResponseDuration, ctx.TransferRate())
+		proxy.account(ctx)
 		if ctx.Tail != nil {
 			ctx.Tail(ctx)
 		}
@@ -233,7 +532,8 @@ func NewProxyHttpServer() *ProxyHttpServer {
 		NonproxyHandler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 			http.Error(w, "This is a proxy server. Does not respond to non-proxy requests.", 500)
 		}),
-		Tr: &http.Transport{TLSClientConfig: tlsClientSkipVerify, Proxy: http.ProxyFromEnvironment},
+		Tr:       &http.Transport{TLSClientConfig: tlsClientSkipVerify, Proxy: http.ProxyFromEnvironment},
+		ErrorLog: &ErrorLog{},
 	}
 	proxy.ConnectDial = dialerFromEnv(&proxy)
 
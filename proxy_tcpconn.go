@@ -1,21 +1,22 @@
 package goproxy
 
 import (
+	"crypto/tls"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"reflect"
-	"syscall"
+	"sync/atomic"
 	"time"
 
-	tproxy "github.com/Windscribe/go-tproxy"
 	"github.com/Windscribe/go-vhost"
-	"golang.org/x/sys/unix"
 )
 
 type ProxyTCPConn struct {
 	net.Conn
+	// BytesWrote and BytesRead are updated atomically, they are read with Counters while the
+	// conn is in use
 	BytesWrote           int64
 	BytesRead            int64
 	ReadTimeout          time.Duration
@@ -30,6 +31,11 @@ func newProxyTCPConn(conn net.Conn) *ProxyTCPConn {
 	return &ProxyTCPConn{Conn: conn}
 }
 
+// Counters returns the bytes written to and read from the conn so far
+func (conn *ProxyTCPConn) Counters() (wrote, read int64) {
+	return atomic.LoadInt64(&conn.BytesWrote), atomic.LoadInt64(&conn.BytesRead)
+}
+
 func (conn *ProxyTCPConn) Close() error {
 	if conn == nil || conn.Conn == nil {
 		return nil
@@ -48,7 +54,7 @@ func (conn *ProxyTCPConn) Write(b []byte) (n int, err error) {
 	if err != nil {
 		return
 	}
-	conn.BytesWrote += int64(n)
+	atomic.AddInt64(&conn.BytesWrote, int64(n))
 	conn.Conn.SetWriteDeadline(time.Time{})
 	return
 }
@@ -64,7 +70,7 @@ func (conn *ProxyTCPConn) Read(b []byte) (n int, err error) {
 	if err != nil {
 		return
 	}
-	conn.BytesRead += int64(n)
+	atomic.AddInt64(&conn.BytesRead, int64(n))
 	conn.Conn.SetReadDeadline(time.Time{})
 	return
 }
@@ -79,10 +85,14 @@ func (conn *ProxyTCPConn) SetKeepaliveParameters(sharedConn bool, count, interva
 			if ok {
 				converted = true
 			}
-		} else if nConn, ok := conn.Conn.(*tproxy.Conn); ok {
-			tcpConn = nConn.TCPConn
-			converted = true
-		} else {
+		} else if nConn, ok := conn.Conn.(*socks5Client); ok {
+			tcpConn, converted = nConn.Conn.(*net.TCPConn)
+		} else if nConn, ok := conn.Conn.(*proxyProtocolConn); ok {
+			tcpConn, converted = nConn.Conn.(*net.TCPConn)
+		} else if nConn, ok := conn.Conn.(*tls.Conn); ok {
+			// the clients of ServeTLS
+			tcpConn, converted = nConn.NetConn().(*net.TCPConn)
+		} else if tcpConn, converted = transparentTCPConn(conn.Conn); !converted {
 			return fmt.Errorf("unable to set keep alives, conn is unkown type: %v", reflect.TypeOf(conn.Conn))
 		}
 
@@ -111,28 +121,13 @@ func (conn *ProxyTCPConn) SetKeepaliveParameters(sharedConn bool, count, interva
 		return err
 	}
 
-	tcpUserTimeout := ((period + interval*count) - 1) * 1000
+	tcpUserTimeout := time.Duration((period+interval*count)-1) * time.Second
 
-	err = rawConn.Control(
-		func(fdPtr uintptr) {
-			// got socket file descriptor. Setting parameters.
-			fd := int(fdPtr)
-			//Number of probes.
-			err := syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_KEEPCNT, count)
-			if err != nil {
-				conn.Logger.Warningf("on setting keepalive probe count: %s", err.Error())
-			}
-			//Wait time after an unsuccessful probe.
-			err = syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL, interval)
-			if err != nil {
-				conn.Logger.Warningf("on setting keepalive retry interval: %s", err.Error())
-			}
-			//Set the user timeout to make sure connections close
-			err = syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, unix.TCP_USER_TIMEOUT, int(tcpUserTimeout))
-			if err != nil {
-				conn.Logger.Warningf("on setting user timeout to %v: %s", tcpUserTimeout, err.Error())
-			}
+	err = rawConn.Control(func(fd uintptr) {
+		setKeepaliveProbes(fd, count, interval, tcpUserTimeout, func(format string, a ...interface{}) {
+			conn.Logger.Warningf(format, a...)
 		})
+	})
 	if err != nil {
 		return err
 	}
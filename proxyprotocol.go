@@ -0,0 +1,402 @@
+package goproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyProtocolSignature starts the PROXY protocol v2 headers
+var proxyProtocolSignature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ErrProxyProtocol is the error of the connections whose PROXY protocol header is invalid, or
+// missing while it is required
+var ErrProxyProtocol = errors.New("invalid PROXY protocol header")
+
+// ProxyProtocolHeader is the PROXY protocol header a load balancer sent at the start of a
+// connection, with the addresses of the client connection it relays
+type ProxyProtocolHeader struct {
+	// Version is 1 or 2
+	Version int
+	// Source and Destination are the addresses of the client and of the load balancer on the
+	// client connection, nil if the load balancer did not send them (e.g. its health checks)
+	Source      net.Addr
+	Destination net.Addr
+	// Peer is the address of the load balancer, which sent the header
+	Peer net.Addr
+	// TLVs are the type-length-value fields of a version 2 header, by type
+	TLVs map[byte][]byte
+}
+
+// ProxyProtocolListener reads the PROXY protocol header (versions 1 and 2) the L4 load
+// balancers in front of the proxy send at the start of the connections, so that the
+// connections it accepts have the address of the client as RemoteAddr, and so does the
+// Req.RemoteAddr of their requests. The header is read on the first Read or RemoteAddr, not
+// in Accept. To make the header available with ProxyCtx.ProxyProtocol, set the ConnContext
+// of the http.Server to ProxyProtocolConnContext:
+//
+//	l = &goproxy.ProxyProtocolListener{Listener: l, TrustedCIDRs: []string{"10.0.0.0/8"}}
+//	srv := &http.Server{Handler: proxy, ConnContext: goproxy.ProxyProtocolConnContext}
+//	srv.Serve(l)
+type ProxyProtocolListener struct {
+	net.Listener
+	// TrustedCIDRs are the networks of the load balancers, whose headers are read. The
+	// connections from other addresses are accepted as they are. No address is trusted if it
+	// is empty.
+	TrustedCIDRs []string
+	// Required refuses the connections from the trusted addresses without a header
+	Required bool
+	// HeaderTimeout bounds the time to read the header, 5s if zero
+	HeaderTimeout time.Duration
+
+	once    sync.Once
+	trusted []*net.IPNet
+}
+
+// Accept accepts the next connection, whose header is read when it is first used
+func (l *ProxyProtocolListener) Accept() (net.Conn, error) {
+	l.once.Do(func() { l.trusted = parseCIDRs(l.TrustedCIDRs) })
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !l.trusts(c.RemoteAddr()) {
+		return c, nil
+	}
+	return &proxyProtocolConn{Conn: c, r: bufio.NewReader(c), l: l}, nil
+}
+
+func (l *ProxyProtocolListener) trusts(addr net.Addr) bool {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, n := range l.trusted {
+		if n.Contains(tcp.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyProtocolConn is a connection accepted by a ProxyProtocolListener from a load balancer
+type proxyProtocolConn struct {
+	net.Conn
+	r *bufio.Reader
+	l *ProxyProtocolListener
+
+	once   sync.Once
+	header *ProxyProtocolHeader
+	err    error
+}
+
+func (c *proxyProtocolConn) init() {
+	timeout := c.l.HeaderTimeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	c.Conn.SetReadDeadline(time.Now().Add(timeout))
+	c.header, c.err = readProxyProtocolHeader(c.r, c.l.Required)
+	c.Conn.SetReadDeadline(time.Time{})
+	if c.header != nil {
+		c.header.Peer = c.Conn.RemoteAddr()
+	}
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	if c.once.Do(c.init); c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	if c.once.Do(c.init); c.header != nil && c.header.Source != nil {
+		return c.header.Source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyProtocolConn) LocalAddr() net.Addr {
+	if c.once.Do(c.init); c.header != nil && c.header.Destination != nil {
+		return c.header.Destination
+	}
+	return c.Conn.LocalAddr()
+}
+
+// ProxyProtocol returns the PROXY protocol header read at the start of c, nil if there was
+// none or c was not accepted by a ProxyProtocolListener
+func ProxyProtocol(c net.Conn) *ProxyProtocolHeader {
+	if pc, ok := c.(*proxyProtocolConn); ok {
+		pc.once.Do(pc.init)
+		return pc.header
+	}
+	return nil
+}
+
+type proxyProtocolConnKey struct{}
+
+// ProxyProtocolConnContext is the ConnContext of the http.Servers accepting connections from a
+// ProxyProtocolListener, which makes their header available with ProxyCtx.ProxyProtocol
+func ProxyProtocolConnContext(parent context.Context, c net.Conn) context.Context {
+	return context.WithValue(parent, proxyProtocolConnKey{}, c)
+}
+
+// ProxyProtocol returns the PROXY protocol header of the connection of the client, nil if
+// there was none. The address of the client is then the Source of the header, which is also
+// the RemoteAddr of Req.
+func (ctx *ProxyCtx) ProxyProtocol() *ProxyProtocolHeader {
+	if ctx.Req == nil {
+		return nil
+	}
+	c, _ := ctx.Req.Context().Value(proxyProtocolConnKey{}).(net.Conn)
+	return ProxyProtocol(c)
+}
+
+// readProxyProtocolHeader reads the header at the start of r, if any
+func readProxyProtocolHeader(r *bufio.Reader, required bool) (*ProxyProtocolHeader, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		if err == io.EOF && !required {
+			return nil, nil
+		}
+		return nil, err
+	}
+	switch first[0] {
+	case 'P':
+		if start, err := r.Peek(6); err == nil && string(start) == "PROXY " {
+			return readProxyProtocolV1(r)
+		}
+	case '\r':
+		if start, err := r.Peek(len(proxyProtocolSignature)); err == nil && bytes.Equal(start, proxyProtocolSignature) {
+			return readProxyProtocolV2(r)
+		}
+	}
+	if required {
+		return nil, ErrProxyProtocol
+	}
+	return nil, nil
+}
+
+// readProxyProtocolV1 reads a header like "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"
+func readProxyProtocolV1(r *bufio.Reader) (*ProxyProtocolHeader, error) {
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, ErrProxyProtocol
+	}
+	fields := strings.Fields(string(line))
+	h := &ProxyProtocolHeader{Version: 1}
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return h, nil
+	}
+	if len(fields) != 6 || fields[1] != "TCP4" && fields[1] != "TCP6" {
+		return nil, ErrProxyProtocol
+	}
+	src, err := proxyProtocolAddr(fields[2], fields[4])
+	if err != nil {
+		return nil, err
+	}
+	dst, err := proxyProtocolAddr(fields[3], fields[5])
+	if err != nil {
+		return nil, err
+	}
+	h.Source, h.Destination = src, dst
+	return h, nil
+}
+
+func proxyProtocolAddr(ip, port string) (*net.TCPAddr, error) {
+	addr := &net.TCPAddr{IP: net.ParseIP(ip)}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if addr.IP == nil || err != nil {
+		return nil, ErrProxyProtocol
+	}
+	addr.Port = int(p)
+	return addr, nil
+}
+
+// readProxyProtocolV2 reads a binary header
+func readProxyProtocolV2(r *bufio.Reader) (*ProxyProtocolHeader, error) {
+	head := make([]byte, 16)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+	if head[12]>>4 != 2 {
+		return nil, ErrProxyProtocol
+	}
+	body := make([]byte, binary.BigEndian.Uint16(head[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	h := &ProxyProtocolHeader{Version: 2}
+	// LOCAL connections, e.g. the health checks of the load balancer, keep their addresses
+	if head[12]&0xf == 0 {
+		return h, nil
+	}
+	var n int
+	switch family := head[13] >> 4; family {
+	case 1, 2:
+		ipLen := net.IPv4len
+		if family == 2 {
+			ipLen = net.IPv6len
+		}
+		if n = 2*ipLen + 4; len(body) < n {
+			return nil, ErrProxyProtocol
+		}
+		h.Source = &net.TCPAddr{IP: net.IP(body[:ipLen]), Port: int(binary.BigEndian.Uint16(body[2*ipLen:]))}
+		h.Destination = &net.TCPAddr{IP: net.IP(body[ipLen : 2*ipLen]), Port: int(binary.BigEndian.Uint16(body[2*ipLen+2:]))}
+	case 3:
+		// unix sockets, whose addresses are skipped
+		n = 216
+	default:
+		return h, nil
+	}
+	if len(body) < n {
+		return nil, ErrProxyProtocol
+	}
+	tlvs := body[n:]
+	for len(tlvs) > 0 {
+		if len(tlvs) < 3 {
+			return nil, ErrProxyProtocol
+		}
+		l := int(binary.BigEndian.Uint16(tlvs[1:]))
+		if len(tlvs) < 3+l {
+			return nil, ErrProxyProtocol
+		}
+		if h.TLVs == nil {
+			h.TLVs = make(map[byte][]byte)
+		}
+		h.TLVs[tlvs[0]] = tlvs[3 : 3+l]
+		tlvs = tlvs[3+l:]
+	}
+	return h, nil
+}
+
+// The TLV types of the PROXY protocol headers sent upstream, see
+// ProxyCtx.ProxyProtocolUpstream
+const (
+	// ProxyProtocolTLVAccounting carries the Accounting of the request
+	ProxyProtocolTLVAccounting byte = 0xe0
+	// ProxyProtocolTLVTags carries the cost attribution tags of the request, as
+	// "key=value" pairs separated by commas
+	ProxyProtocolTLVTags byte = 0xe1
+)
+
+// MarshalBinary encodes h as a version 2 header. Its Source and Destination must be
+// *net.TCPAddr of the same family, a header without them is sent as a LOCAL connection.
+func (h *ProxyProtocolHeader) MarshalBinary() ([]byte, error) {
+	b := append([]byte{}, proxyProtocolSignature...)
+	src, _ := h.Source.(*net.TCPAddr)
+	dst, _ := h.Destination.(*net.TCPAddr)
+	var addrs []byte
+	switch {
+	case src == nil || dst == nil:
+		// LOCAL, AF_UNSPEC
+		b = append(b, 0x20, 0x00)
+	case src.IP.To4() != nil && dst.IP.To4() != nil:
+		b = append(b, 0x21, 0x11)
+		addrs = append(append(addrs, src.IP.To4()...), dst.IP.To4()...)
+	case src.IP.To4() == nil && dst.IP.To4() == nil:
+		b = append(b, 0x21, 0x21)
+		addrs = append(append(addrs, src.IP.To16()...), dst.IP.To16()...)
+	default:
+		return nil, errors.New("PROXY protocol addresses of different families")
+	}
+	if addrs != nil {
+		addrs = append(addrs, byte(src.Port>>8), byte(src.Port), byte(dst.Port>>8), byte(dst.Port))
+	}
+	types := make([]int, 0, len(h.TLVs))
+	for t := range h.TLVs {
+		types = append(types, int(t))
+	}
+	sort.Ints(types)
+	for _, t := range types {
+		v := h.TLVs[byte(t)]
+		if len(v) > 0xffff {
+			return nil, errors.New("PROXY protocol TLV too long")
+		}
+		addrs = append(addrs, byte(t), byte(len(v)>>8), byte(len(v)))
+		addrs = append(addrs, v...)
+	}
+	if len(addrs) > 0xffff {
+		return nil, errors.New("PROXY protocol header too long")
+	}
+	b = append(b, byte(len(addrs)>>8), byte(len(addrs)))
+	return append(b, addrs...), nil
+}
+
+// upstreamProxyProtocol returns the header sent upstream for the request of ctx, whose
+// connection to the upstream is conn
+func (ctx *ProxyCtx) upstreamProxyProtocol(conn net.Conn) *ProxyProtocolHeader {
+	h := &ProxyProtocolHeader{Version: 2, TLVs: map[byte][]byte{}}
+	for t, v := range ctx.ProxyProtocolTLVs {
+		h.TLVs[t] = v
+	}
+	if ctx.Accounting != "" {
+		h.TLVs[ProxyProtocolTLVAccounting] = []byte(ctx.Accounting)
+	}
+	if len(ctx.tags) > 0 {
+		h.TLVs[ProxyProtocolTLVTags] = []byte(ctx.tagString())
+	}
+	if ctx.Req == nil {
+		return h
+	}
+	src, err := net.ResolveTCPAddr("tcp", ctx.Req.RemoteAddr)
+	if err != nil || src.IP == nil {
+		return h
+	}
+	// the address the client connected to, or the one of the proxy on conn
+	var dst *net.TCPAddr
+	if self, ok := ctx.Req.Context().Value(http.LocalAddrContextKey).(*net.TCPAddr); ok {
+		dst = self
+	} else if local, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		dst = local
+	}
+	if dst == nil || (src.IP.To4() == nil) != (dst.IP.To4() == nil) {
+		// the families differ, send the unspecified address of the family of the client
+		dst = &net.TCPAddr{IP: net.IPv4zero, Port: 0}
+		if src.IP.To4() == nil {
+			dst.IP = net.IPv6zero
+		}
+	}
+	h.Source, h.Destination = src, dst
+	return h
+}
+
+// writeUpstreamProxyProtocol sends the PROXY protocol header of the request of ctx on conn,
+// the new connection to its upstream, if ProxyProtocolUpstream is set. It closes conn if it
+// fails.
+func (ctx *ProxyCtx) writeUpstreamProxyProtocol(conn net.Conn) (net.Conn, error) {
+	if !ctx.ProxyProtocolUpstream {
+		return conn, nil
+	}
+	b, err := ctx.upstreamProxyProtocol(conn).MarshalBinary()
+	if err == nil {
+		_, err = conn.Write(b)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	ctx.Debugf(DebugDial, "sent PROXY protocol header to %s", conn.RemoteAddr())
+	return conn, nil
+}
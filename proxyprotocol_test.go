@@ -0,0 +1,140 @@
+package goproxy
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestReadProxyProtocolHeader(t *testing.T) {
+	v2 := append([]byte{}, proxyProtocolSignature...)
+	v2 = append(v2, 0x21, 0x11, 0, 12+5, 192, 0, 2, 1, 198, 51, 100, 1, 0xdc, 0x04, 0x01, 0xbb, 0xea, 0, 2, 'h', 'i')
+	for _, test := range []struct {
+		in      string
+		version int
+		source  string
+	}{
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\nGET", 1, "192.0.2.1:56324"},
+		{"PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\nGET", 1, "[2001:db8::1]:56324"},
+		{"PROXY UNKNOWN\r\nGET", 1, ""},
+		{string(v2) + "GET", 2, "192.0.2.1:56324"},
+		{"GET", 0, ""},
+	} {
+		r := bufio.NewReader(strings.NewReader(test.in))
+		h, err := readProxyProtocolHeader(r, false)
+		orFatal("readProxyProtocolHeader", err, t)
+		if rest, _ := ioutil.ReadAll(r); string(rest) != "GET" {
+			t.Errorf("expected the header of %q to be consumed, got %q left", test.in, rest)
+		}
+		if h == nil {
+			if test.version != 0 {
+				t.Errorf("expected a header in %q", test.in)
+			}
+			continue
+		}
+		if h.Version != test.version || test.source != "" && (h.Source == nil || h.Source.String() != test.source) {
+			t.Errorf("unexpected header of %q: %+v", test.in, h)
+		}
+	}
+
+	r := bufio.NewReader(bytes.NewReader(append(v2, "GET"...)))
+	h, _ := readProxyProtocolHeader(r, false)
+	if h == nil || string(h.TLVs[0xea]) != "hi" || h.Destination.String() != "198.51.100.1:443" {
+		t.Errorf("expected the TLVs and the destination of the v2 header, got %+v", h)
+	}
+	if _, err := readProxyProtocolHeader(bufio.NewReader(strings.NewReader("GET / HTTP/1.1\r\n")), true); err != ErrProxyProtocol {
+		t.Errorf("expected a missing required header to fail, got %v", err)
+	}
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	orFatal("Listen", err, t)
+	var client string
+	var header *ProxyProtocolHeader
+	proxy := NewProxyHttpServer()
+	proxy.NonproxyHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client = r.RemoteAddr
+		header = (&ProxyCtx{Req: r}).ProxyProtocol()
+	})
+	srv := &http.Server{Handler: proxy, ConnContext: ProxyProtocolConnContext}
+	go srv.Serve(&ProxyProtocolListener{Listener: l, TrustedCIDRs: []string{"127.0.0.0/8"}})
+	defer srv.Close()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	orFatal("Dial", err, t)
+	defer c.Close()
+	c.Write([]byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\nGET / HTTP/1.1\r\nHost: proxy\r\n\r\n"))
+	resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	orFatal("ReadResponse", err, t)
+	resp.Body.Close()
+	if client != "192.0.2.1:56324" || header == nil || header.Peer.String() != c.LocalAddr().String() {
+		t.Errorf("expected the client address of the header, got %s %+v", client, header)
+	}
+}
+
+func TestProxyProtocolUntrustedPeer(t *testing.T) {
+	for _, cidrs := range [][]string{nil, {"10.0.0.0/8"}} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		orFatal("Listen", err, t)
+		var client string
+		proxy := NewProxyHttpServer()
+		proxy.NonproxyHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { client = r.RemoteAddr })
+		srv := &http.Server{Handler: proxy, ConnContext: ProxyProtocolConnContext}
+		go srv.Serve(&ProxyProtocolListener{Listener: l, TrustedCIDRs: cidrs})
+
+		c, err := net.Dial("tcp", l.Addr().String())
+		orFatal("Dial", err, t)
+		c.Write([]byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\nGET / HTTP/1.1\r\nHost: proxy\r\n\r\n"))
+		resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+		orFatal("ReadResponse", err, t)
+		resp.Body.Close()
+		c.Close()
+		srv.Close()
+		if resp.StatusCode != http.StatusBadRequest || client != "" {
+			t.Errorf("trusted %v: expected the header of an untrusted peer to be ignored, got %v from %q", cidrs, resp.Status, client)
+		}
+	}
+}
+
+func TestProxyProtocolUpstream(t *testing.T) {
+	var client string
+	var header *ProxyProtocolHeader
+	target := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client = r.RemoteAddr
+		header = (&ProxyCtx{Req: r}).ProxyProtocol()
+	}))
+	target.Listener = &ProxyProtocolListener{Listener: target.Listener, TrustedCIDRs: []string{"127.0.0.0/8"}, Required: true}
+	target.Config.ConnContext = ProxyProtocolConnContext
+	target.Start()
+	defer target.Close()
+
+	proxy := NewProxyHttpServer()
+	proxy.OnRequest().DoFunc(func(r *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response) {
+		ctx.ProxyProtocolUpstream = true
+		ctx.Accounting = "acme"
+		ctx.SetTag("team", "web")
+		return r, nil
+	})
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	proxyURL, _ := url.Parse(s.URL)
+	tr := &http.Transport{Proxy: http.ProxyURL(proxyURL)}
+	resp, err := (&http.Client{Transport: tr}).Get(target.URL)
+	orFatal("Get", err, t)
+	resp.Body.Close()
+	if header == nil || header.Version != 2 || string(header.TLVs[ProxyProtocolTLVAccounting]) != "acme" ||
+		string(header.TLVs[ProxyProtocolTLVTags]) != "team=web" {
+		t.Fatalf("expected a PROXY protocol v2 header with the accounting TLVs, got %+v", header)
+	}
+	if header.Destination.String() != s.Listener.Addr().String() || !strings.HasPrefix(client, "127.0.0.1:") || client == header.Peer.String() {
+		t.Errorf("expected the addresses of the client connection, got %s %+v", client, header)
+	}
+}
@@ -0,0 +1,141 @@
+package goproxy
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// byteRange is a single range of a Range header, first or last is -1 for suffix and open
+// ranges ("bytes=-500", "bytes=500-")
+type byteRange struct {
+	first, last int64
+}
+
+// parseRange parses a Range header containing a single byte range
+func parseRange(header string) (byteRange, bool) {
+	if !strings.HasPrefix(header, "bytes=") {
+		return byteRange{}, false
+	}
+	spec := strings.TrimSpace(header[len("bytes="):])
+	if strings.Contains(spec, ",") {
+		return byteRange{}, false
+	}
+	i := strings.IndexByte(spec, '-')
+	if i < 0 {
+		return byteRange{}, false
+	}
+	r := byteRange{-1, -1}
+	var err error
+	if first := strings.TrimSpace(spec[:i]); first != "" {
+		if r.first, err = strconv.ParseInt(first, 10, 64); err != nil || r.first < 0 {
+			return byteRange{}, false
+		}
+	}
+	if last := strings.TrimSpace(spec[i+1:]); last != "" {
+		if r.last, err = strconv.ParseInt(last, 10, 64); err != nil || r.last < 0 {
+			return byteRange{}, false
+		}
+	}
+	if r.first == -1 && r.last == -1 || r.first != -1 && r.last != -1 && r.last < r.first {
+		return byteRange{}, false
+	}
+	return r, true
+}
+
+// resolve returns the offsets of the first and last bytes of r in an object of size bytes,
+// and false if r can't be satisfied
+func (r byteRange) resolve(size int64) (int64, int64, bool) {
+	first, last := r.first, r.last
+	if first == -1 {
+		// suffix range, the last bytes of the object
+		first = size - last
+		if first < 0 {
+			first = 0
+		}
+		last = size - 1
+	} else if last == -1 || last >= size {
+		last = size - 1
+	}
+	if first >= size || size == 0 {
+		return 0, 0, false
+	}
+	return first, last, true
+}
+
+// ifRangeMatches reports whether the If-Range header of req, if any, matches the validators
+// of the full response header h
+func ifRangeMatches(req *http.Request, h http.Header) bool {
+	ifRange := req.Header.Get("If-Range")
+	if ifRange == "" {
+		return true
+	}
+	if strings.HasPrefix(ifRange, `"`) {
+		return ifRange == h.Get("ETag")
+	}
+	return ifRange == h.Get("Last-Modified")
+}
+
+// partialResponse turns full, a complete 200 response to req whose body is body, into the
+// 206 Partial Content (or 416 Range Not Satisfiable) response to the Range of req
+func partialResponse(req *http.Request, full *http.Response, body []byte) *http.Response {
+	r, ok := parseRange(req.Header.Get("Range"))
+	if !ok || !ifRangeMatches(req, full.Header) {
+		full.Body = ioutil.NopCloser(bytes.NewReader(body))
+		full.ContentLength = int64(len(body))
+		return full
+	}
+	size := int64(len(body))
+	resp := *full
+	resp.Header = cloneHeader(full.Header)
+	resp.Header.Del("Content-Length")
+	first, last, ok := r.resolve(size)
+	if !ok {
+		resp.StatusCode = http.StatusRequestedRangeNotSatisfiable
+		resp.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		body = nil
+	} else {
+		resp.StatusCode = http.StatusPartialContent
+		resp.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", first, last, size))
+		body = body[first : last+1]
+	}
+	resp.Status = strconv.Itoa(resp.StatusCode) + " " + http.StatusText(resp.StatusCode)
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	return &resp
+}
+
+// fetchRange gets the response to r, a request for a single byte range. Small objects, up to
+// RangeFullFetchMaxSize, are fetched entirely so that all the ranges requested for them share
+// the cache and a single coalesced upstream request. Other ranges are forwarded as is.
+func (proxy *ProxyHttpServer) fetchRange(ctx *ProxyCtx, key string, r *http.Request, roundTrip func(*http.Request) (*http.Response, error)) (*http.Response, error) {
+	if proxy.RangeFullFetchMaxSize > 0 {
+		full := r.WithContext(r.Context())
+		full.Header = cloneHeader(r.Header)
+		full.Header.Del("Range")
+		full.Header.Del("If-Range")
+		resp, err := proxy.fetch(ctx, full, roundTrip)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusOK && resp.ContentLength >= 0 && resp.ContentLength <= proxy.RangeFullFetchMaxSize {
+			body, err := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				return nil, err
+			}
+			resp.Request = r
+			return partialResponse(r, resp, body), nil
+		}
+		// too large, or of unknown size, get the range only
+		resp.Body.Close()
+		ctx.CacheStatus = CacheMiss
+	}
+	if proxy.CoalesceRequests {
+		return proxy.coalescedFetch(ctx, key+"\nRange: "+r.Header.Get("Range"), r, roundTrip)
+	}
+	return roundTrip(r)
+}
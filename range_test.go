@@ -0,0 +1,70 @@
+package goproxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestParseRange(t *testing.T) {
+	for header, expected := range map[string][3]int64{
+		"bytes=0-3":   {0, 3, 1},
+		"bytes=2-":    {2, 9, 1},
+		"bytes=-4":    {6, 9, 1},
+		"bytes=5-100": {5, 9, 1},
+		"bytes=10-12": {0, 0, 0},
+	} {
+		r, ok := parseRange(header)
+		if !ok {
+			t.Errorf("%s: not parsed", header)
+			continue
+		}
+		first, last, ok := r.resolve(10)
+		if ok != (expected[2] == 1) || ok && (first != expected[0] || last != expected[1]) {
+			t.Errorf("%s: got %d-%d %v, expected %v", header, first, last, ok, expected)
+		}
+	}
+	for _, header := range []string{"bytes=0-1,3-4", "items=0-1", "bytes=4-2", "bytes=-"} {
+		if _, ok := parseRange(header); ok {
+			t.Errorf("%s: expected parse failure", header)
+		}
+	}
+}
+
+func TestRangeFromFullFetch(t *testing.T) {
+	var upstream int64
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&upstream, 1)
+		if r.Header.Get("Range") != "" {
+			t.Errorf("expected a full fetch, got Range %s", r.Header.Get("Range"))
+		}
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("0123456789"))
+	}))
+	defer s.Close()
+
+	proxy := NewProxyHttpServer()
+	proxy.Cache = &MemoryResponseCache{}
+	proxy.RangeFullFetchMaxSize = 100
+	roundTrip := func(ctx *ProxyCtx) func(*http.Request) (*http.Response, error) {
+		return func(r *http.Request) (*http.Response, error) { return ctx.RoundTrip(r) }
+	}
+
+	for header, expected := range map[string]string{"bytes=2-4": "234", "bytes=-3": "789"} {
+		req, _ := http.NewRequest("GET", s.URL+"/", nil)
+		req.Header.Set("Range", header)
+		ctx := &ProxyCtx{Req: req, Proxy: proxy}
+		resp, err := proxy.fetch(ctx, req, roundTrip(ctx))
+		orFatal("fetch", err, t)
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusPartialContent || string(body) != expected {
+			t.Errorf("%s: got %v %q, expected %q", header, resp.Status, body, expected)
+		}
+	}
+	if n := atomic.LoadInt64(&upstream); n != 1 {
+		t.Errorf("expected the second range to be served from the cache, got %d upstream requests", n)
+	}
+}
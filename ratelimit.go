@@ -0,0 +1,198 @@
+package goproxy
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RateLimiter decides whether the client identified by key may send a request now
+type RateLimiter interface {
+	Allow(key string) (bool, error)
+}
+
+// QuotaManager accounts the usage of clients over a period, in units chosen by the caller
+// (requests, bytes...)
+type QuotaManager interface {
+	// Remaining returns what is left of the quota of key for the current period
+	Remaining(key string) (int64, error)
+	// Consume records n units used by key
+	Consume(key string, n int64) error
+}
+
+// TokenBucketLimiter is an in memory RateLimiter allowing Rate requests per second per key,
+// with bursts of up to Burst requests
+type TokenBucketLimiter struct {
+	Rate  float64
+	Burst int
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take refills the bucket for the time elapsed since the last call, and takes n tokens from
+// it if there are enough. It returns how long to wait for the missing tokens otherwise.
+func (b *tokenBucket) take(now time.Time, rate float64, burst int, n float64) (bool, time.Duration) {
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	if b.tokens > float64(burst) {
+		b.tokens = float64(burst)
+	}
+	b.last = now
+	if b.tokens >= n {
+		b.tokens -= n
+		return true, 0
+	}
+	if rate <= 0 {
+		return false, time.Duration(1<<63 - 1)
+	}
+	return false, time.Duration((n - b.tokens) / rate * float64(time.Second))
+}
+
+// Allow implements RateLimiter
+func (l *TokenBucketLimiter) Allow(key string) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.buckets == nil {
+		l.buckets = make(map[string]*tokenBucket)
+	}
+	now := time.Now()
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(l.Burst), last: now}
+		l.buckets[key] = b
+	}
+	allowed, _ := b.take(now, l.Rate, l.Burst, 1)
+	return allowed, nil
+}
+
+// MemoryQuota is an in memory QuotaManager granting Limit units per key for every Period
+type MemoryQuota struct {
+	Limit  int64
+	Period time.Duration
+	// Changes are the scheduled changes of Limit, the last one whose time has come applies
+	Changes []QuotaChange
+
+	mu    sync.Mutex
+	usage map[string]*quotaUsage
+}
+
+type quotaUsage struct {
+	window int64
+	used   int64
+}
+
+// quotaWindow returns the index of the period containing now
+func quotaWindow(now time.Time, period time.Duration) int64 {
+	if period <= 0 {
+		return 0
+	}
+	return now.UnixNano() / int64(period)
+}
+
+func (q *MemoryQuota) current(key string) *quotaUsage {
+	if q.usage == nil {
+		q.usage = make(map[string]*quotaUsage)
+	}
+	window := quotaWindow(time.Now(), q.Period)
+	u, ok := q.usage[key]
+	if !ok || u.window != window {
+		u = &quotaUsage{window: window}
+		q.usage[key] = u
+	}
+	return u
+}
+
+// Remaining implements QuotaManager
+func (q *MemoryQuota) Remaining(key string) (int64, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.limit(time.Now()) - q.current(key).used, nil
+}
+
+// QuotaChange is a change of the limit of a MemoryQuota, scheduled at At
+type QuotaChange struct {
+	At    time.Time
+	Limit int64
+}
+
+// limit returns the limit of q at now
+func (q *MemoryQuota) limit(now time.Time) int64 {
+	limit, at := q.Limit, time.Time{}
+	for _, c := range q.Changes {
+		if !c.At.After(now) && !c.At.Before(at) {
+			limit, at = c.Limit, c.At
+		}
+	}
+	return limit
+}
+
+// Consume implements QuotaManager
+func (q *MemoryQuota) Consume(key string, n int64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.current(key).used += n
+	return nil
+}
+
+// LimitRate returns a ReqHandler answering 429 Too Many Requests to the clients that l doesn't
+// allow. key identifies the client of a request, requests with an empty key are not limited.
+// Requests are let through when l fails.
+//
+//	proxy.OnRequest().Do(goproxy.LimitRate(&goproxy.TokenBucketLimiter{Rate: 10, Burst: 20},
+//		func(ctx *goproxy.ProxyCtx) string { return ctx.ProxyUser }))
+func LimitRate(l RateLimiter, key func(ctx *ProxyCtx) string) ReqHandler {
+	return FuncReqHandler(func(r *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response) {
+		k := key(ctx)
+		if k == "" {
+			return r, nil
+		}
+		allowed, err := l.Allow(k)
+		if err != nil {
+			ctx.Warnf("rate limiter error for %s: %v", k, err)
+			return r, nil
+		}
+		if !allowed {
+			return r, ctx.BlockedResponse(http.StatusTooManyRequests, PolicyDecision{Policy: "ratelimit", Reason: "too many requests"})
+		}
+		return r, nil
+	})
+}
+
+// EnforceQuota returns a ReqHandler answering 429 Too Many Requests to the clients that used
+// their quota in q, and charging the bytes sent and received by the other requests to
+// their quota once they are done. It wraps ctx.Tail, so handlers registered after it must
+// not replace Tail.
+func EnforceQuota(q QuotaManager, key func(ctx *ProxyCtx) string) ReqHandler {
+	return FuncReqHandler(func(r *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response) {
+		k := key(ctx)
+		if k == "" {
+			return r, nil
+		}
+		remaining, err := q.Remaining(k)
+		if err != nil {
+			ctx.Warnf("quota error for %s: %v", k, err)
+		} else if remaining <= 0 {
+			ctx.Proxy.notify(NewEvent(EventQuotaExceeded, k, "quota exceeded"))
+			resp := ctx.BlockedResponse(http.StatusTooManyRequests, PolicyDecision{Policy: "quota", Reason: "quota exceeded"})
+			resp.Header.Set("X-Proxy-Quota-Remaining", strconv.FormatInt(remaining, 10))
+			return r, resp
+		}
+		tail := ctx.Tail
+		ctx.Tail = func(ctx *ProxyCtx) error {
+			if err := q.Consume(k, ctx.BytesSent+ctx.BytesReceived); err != nil {
+				ctx.Warnf("quota error for %s: %v", k, err)
+			}
+			if tail != nil {
+				return tail(ctx)
+			}
+			return nil
+		}
+		return r, nil
+	})
+}
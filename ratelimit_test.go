@@ -0,0 +1,104 @@
+package goproxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLimitRate(t *testing.T) {
+	h := LimitRate(&TokenBucketLimiter{Rate: 0.001, Burst: 2}, func(ctx *ProxyCtx) string { return ctx.ProxyUser })
+	for i, blocked := range []bool{false, false, true} {
+		req, _ := http.NewRequest("GET", "http://example.com/", nil)
+		ctx := &ProxyCtx{Req: req, ProxyUser: "bob"}
+		if _, resp := h.Handle(req, ctx); (resp != nil) != blocked {
+			t.Errorf("request %d: expected blocked=%v, got %v", i, blocked, resp)
+		} else if blocked && (resp.StatusCode != http.StatusTooManyRequests || ctx.PolicyDecision.Policy != "ratelimit") {
+			t.Errorf("unexpected denial %v %+v", resp.Status, ctx.PolicyDecision)
+		}
+	}
+}
+
+func TestLimitRateThroughProxy(t *testing.T) {
+	s := httptest.NewServer(ConstantHanlder("ok"))
+	defer s.Close()
+	proxy := NewProxyHttpServer()
+	proxy.OnRequest().Do(LimitRate(&TokenBucketLimiter{Rate: 0.001, Burst: 1}, func(ctx *ProxyCtx) string { return "all" }))
+	p := httptest.NewServer(proxy)
+	defer p.Close()
+	proxyURL, _ := url.Parse(p.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	for i, status := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		resp, err := client.Get(s.URL)
+		orFatal("Get", err, t)
+		resp.Body.Close()
+		if resp.StatusCode != status {
+			t.Errorf("request %d: expected %d, got %v", i, status, resp.Status)
+		}
+	}
+}
+
+// fakeQuotaRedis implements the quota script over an in memory map
+type fakeQuotaRedis struct {
+	mu       sync.Mutex
+	counters map[string]int64
+	calls    int
+}
+
+func (r *fakeQuotaRedis) Eval(c context.Context, script string, keys []string, args ...interface{}) (interface{}, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls++
+	r.counters[keys[0]] += args[0].(int64)
+	return r.counters[keys[0]], nil
+}
+
+func TestRedisQuotaSharedBetweenInstances(t *testing.T) {
+	redis := &fakeQuotaRedis{counters: map[string]int64{}}
+	a := &RedisQuota{Client: redis, Limit: 100, Period: time.Hour, SyncInterval: time.Nanosecond}
+	b := &RedisQuota{Client: redis, Limit: 100, Period: time.Hour, SyncInterval: time.Nanosecond}
+
+	if err := a.Consume("bob", 60); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Consume("bob", 30); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond)
+	a.Remaining("bob")
+	b.Remaining("bob")
+	if remaining, err := a.Remaining("bob"); err != nil || remaining != 10 {
+		t.Errorf("expected 10 remaining, got %d %v", remaining, err)
+	}
+
+	h := EnforceQuota(b, func(ctx *ProxyCtx) string { return "bob" })
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	ctx := &ProxyCtx{Req: req}
+	if _, resp := h.Handle(req, ctx); resp != nil {
+		t.Fatalf("unexpected denial %v", resp.Status)
+	}
+	ctx.BytesReceived = 20
+	ctx.Tail(ctx)
+	time.Sleep(time.Millisecond)
+	if _, resp := h.Handle(req, &ProxyCtx{Req: req}); resp == nil || resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("expected the quota to be exceeded, got %v", resp)
+	}
+}
+
+func TestMemoryQuotaChanges(t *testing.T) {
+	now := time.Now()
+	q := &MemoryQuota{Limit: 100, Period: time.Hour, Changes: []QuotaChange{
+		{At: now.Add(-time.Hour), Limit: 50},
+		{At: now.Add(-time.Minute), Limit: 20},
+		{At: now.Add(time.Hour), Limit: 1000},
+	}}
+	q.Consume("bob", 5)
+	if remaining, _ := q.Remaining("bob"); remaining != 15 {
+		t.Errorf("expected the last change whose time has come to apply, got %d remaining", remaining)
+	}
+}
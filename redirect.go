@@ -0,0 +1,263 @@
+package goproxy
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+)
+
+// ErrRedirectLoop is returned when a followed redirect points to an URL already in the chain
+var ErrRedirectLoop = errors.New("redirect loop")
+
+// ErrTooManyRedirects is returned when the redirect chain is longer than MaxHops
+var ErrTooManyRedirects = errors.New("too many redirects")
+
+// ErrPrivateTarget is returned when the host of a followed redirect resolves to a private or
+// local address
+var ErrPrivateTarget = errors.New("redirect target resolves to a private address")
+
+// RedirectPolicy makes the proxy follow the redirects of upstream servers itself, so that
+// clients that can't follow redirects get the final response. Redirects that the policy
+// doesn't allow are relayed to the client as is.
+//
+// Every hop goes through the request handlers, StrictEgress and DrainFlags like the requests
+// of the clients, and the redirects from another host to a private or local address, e.g.
+// 127.0.0.1 or a LocalDestination, are not followed unless AllowPrivateTargets is set. The
+// addresses are checked as the hops are dialed, so that a host name resolving to one, e.g.
+// by DNS rebinding, fails the request with ErrPrivateTarget.
+type RedirectPolicy struct {
+	// MaxHops is the number of redirects followed for a request, 10 if zero
+	MaxHops int
+	// SameHostOnly restricts the redirects followed to the host of the original request
+	SameHostOnly bool
+	// AllowedHosts, if not empty, restricts the redirects followed to these hosts
+	AllowedHosts []string
+	// AllowPrivateTargets follows the redirects from another host to private and local
+	// addresses
+	AllowPrivateTargets bool
+}
+
+// privateNetworks are the networks of the private, loopback and link-local addresses
+var privateNetworks = parseCIDRs([]string{"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8",
+	"169.254.0.0/16", "172.16.0.0/12", "192.168.0.0/16", "::1/128", "fc00::/7", "fe80::/10"})
+
+// privateHost reports whether host is localhost or a private or loopback address
+func privateHost(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return true
+	}
+	ip := ipLiteral(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range privateNetworks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *RedirectPolicy) maxHops() int {
+	if p.MaxHops > 0 {
+		return p.MaxHops
+	}
+	return 10
+}
+
+// allows reports whether the redirect of a request to origin may be followed to target
+func (p *RedirectPolicy) allows(origin, target *url.URL) bool {
+	if target.Scheme != "http" && target.Scheme != "https" {
+		return false
+	}
+	if p.SameHostOnly && !strings.EqualFold(origin.Host, target.Host) {
+		return false
+	}
+	if len(p.AllowedHosts) > 0 {
+		for _, h := range p.AllowedHosts {
+			if strings.EqualFold(h, target.Hostname()) || strings.EqualFold(h, target.Host) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// redirectPolicy returns the policy of the request, falling back to the one of the proxy
+func (ctx *ProxyCtx) redirectPolicy() *RedirectPolicy {
+	if ctx.RedirectPolicy != nil {
+		return ctx.RedirectPolicy
+	}
+	if ctx.Proxy != nil {
+		return ctx.Proxy.RedirectPolicy
+	}
+	return nil
+}
+
+// followRedirects follows the redirects of resp, the response to req, as allowed by the
+// redirect policy, recording the URLs of the chain in ctx.RedirectChain
+func (ctx *ProxyCtx) followRedirects(req *http.Request, resp *http.Response) (*http.Response, error) {
+	policy := ctx.redirectPolicy()
+	if policy == nil {
+		return resp, nil
+	}
+	origin := req.URL
+	seen := map[string]bool{req.URL.String(): true}
+	for hops := 0; ; hops++ {
+		switch resp.StatusCode {
+		case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+			http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		default:
+			return resp, nil
+		}
+		location := resp.Header.Get("Location")
+		if location == "" {
+			return resp, nil
+		}
+		target, err := req.URL.Parse(location)
+		if err != nil || !policy.allows(origin, target) {
+			return resp, nil
+		}
+		if !strings.EqualFold(origin.Host, target.Host) && !policy.AllowPrivateTargets {
+			if ctx.localTarget(target.Host) {
+				ctx.Warnf("Not following the redirect of %s to the local address %s", origin.Host, target.Host)
+				return resp, nil
+			}
+			ctx.refusePrivate = true
+		}
+
+		method := req.Method
+		var body bool
+		switch resp.StatusCode {
+		case http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+			// the method and body must be kept, which we can only do if the body can be replayed
+			if req.Body != nil && req.Body != http.NoBody {
+				if req.GetBody == nil {
+					return resp, nil
+				}
+				body = true
+			}
+		default:
+			if method != "GET" && method != "HEAD" {
+				method = "GET"
+			}
+		}
+
+		if hops >= policy.maxHops() {
+			resp.Body.Close()
+			return nil, ErrTooManyRedirects
+		}
+		if seen[target.String()] {
+			resp.Body.Close()
+			return nil, ErrRedirectLoop
+		}
+		seen[target.String()] = true
+
+		next, err := http.NewRequest(method, target.String(), nil)
+		if err != nil {
+			return resp, nil
+		}
+		next = next.WithContext(req.Context())
+		copyHeaders(next.Header, req.Header, false)
+		if body {
+			if next.Body, err = req.GetBody(); err != nil {
+				return resp, nil
+			}
+			next.GetBody = req.GetBody
+			next.ContentLength = req.ContentLength
+		} else {
+			next.Header.Del("Content-Length")
+			next.Header.Del("Content-Type")
+		}
+		if !strings.EqualFold(target.Host, req.URL.Host) {
+			// don't leak the credentials of the original host
+			next.Header.Del("Authorization")
+			next.Header.Del("Cookie")
+		}
+
+		filtered, blocked := ctx.filterRedirect(next)
+		if filtered == nil && blocked == nil {
+			return resp, nil
+		}
+		ctx.Logf("following redirect %d to %s", resp.StatusCode, target)
+		resp.Body.Close()
+		ctx.RedirectChain = append(ctx.RedirectChain, target)
+		if blocked != nil {
+			return blocked, nil
+		}
+		req = filtered
+		resp, err = ctx.RoundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// localTarget reports whether hostport, a host with or without port, is a private address or
+// a LocalDestination
+func (ctx *ProxyCtx) localTarget(hostport string) bool {
+	host := strings.Trim(hostport, "[]")
+	if h, _, err := net.SplitHostPort(hostport); err == nil {
+		host = h
+	}
+	if privateHost(host) {
+		return true
+	}
+	if ctx.Proxy == nil || ctx.Proxy.LocalDestinations == nil {
+		return false
+	}
+	var self net.Addr
+	if ctx.Req != nil {
+		self, _ = ctx.Req.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	}
+	return ctx.Proxy.LocalDestinations.Contains(hostport, self)
+}
+
+// refusePrivateDial returns d refusing to connect to the private and local addresses, once
+// ctx followed a redirect to another host, so that every address the host of the redirect
+// resolves to is checked
+func (ctx *ProxyCtx) refusePrivateDial(d *net.Dialer) *net.Dialer {
+	if !ctx.refusePrivate {
+		return d
+	}
+	guarded := *d
+	guarded.Control = chainControl(func(network, address string, c syscall.RawConn) error {
+		if ctx.localTarget(address) {
+			ctx.Warnf("Not connecting to the local address %s of a followed redirect", address)
+			return ErrPrivateTarget
+		}
+		return nil
+	}, d.Control)
+	return &guarded
+}
+
+// filterRedirect runs the request handlers, StrictEgress and DrainFlags on req, the next hop
+// of a followed redirect, like on the requests of the clients. It returns the request to
+// send, or the response answering it instead, and neither if the redirect must not be
+// followed.
+func (ctx *ProxyCtx) filterRedirect(req *http.Request) (*http.Request, *http.Response) {
+	proxy := ctx.Proxy
+	if proxy == nil {
+		return req, nil
+	}
+	ctx.Req = req
+	req, resp := proxy.filterRequest(req, ctx)
+	if resp != nil {
+		return nil, resp
+	}
+	if req == nil || req.URL == nil {
+		return nil, nil
+	}
+	if resp = proxy.failClosed(ctx); resp == nil {
+		resp = proxy.drained(ctx, req.URL.Host)
+	}
+	if resp != nil {
+		return nil, resp
+	}
+	return req, nil
+}
@@ -0,0 +1,144 @@
+package goproxy
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFollowRedirects(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/a", func(w http.ResponseWriter, r *http.Request) { http.Redirect(w, r, "/b", http.StatusFound) })
+	mux.HandleFunc("/b", func(w http.ResponseWriter, r *http.Request) { http.Redirect(w, r, "/c", http.StatusMovedPermanently) })
+	mux.HandleFunc("/c", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("final")) })
+	mux.HandleFunc("/loop", func(w http.ResponseWriter, r *http.Request) { http.Redirect(w, r, "/loop2", http.StatusFound) })
+	mux.HandleFunc("/loop2", func(w http.ResponseWriter, r *http.Request) { http.Redirect(w, r, "/loop", http.StatusFound) })
+	mux.HandleFunc("/away", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://other.example.com/", http.StatusFound)
+	})
+	s := httptest.NewServer(mux)
+	defer s.Close()
+
+	proxy := NewProxyHttpServer()
+	proxy.RedirectPolicy = &RedirectPolicy{SameHostOnly: true}
+	get := func(path string) (*ProxyCtx, *http.Response, error) {
+		req, err := http.NewRequest("GET", s.URL+path, nil)
+		orFatal("NewRequest", err, t)
+		ctx := &ProxyCtx{Req: req, Proxy: proxy}
+		resp, err := ctx.RoundTrip(req)
+		orFatal("RoundTrip", err, t)
+		resp, err = ctx.followRedirects(req, resp)
+		return ctx, resp, err
+	}
+
+	ctx, resp, err := get("/a")
+	orFatal("followRedirects", err, t)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "final" || len(ctx.RedirectChain) != 2 || ctx.RedirectChain[1].Path != "/c" {
+		t.Errorf("unexpected final response %q, chain %v", body, ctx.RedirectChain)
+	}
+
+	if _, _, err := get("/loop"); err != ErrRedirectLoop {
+		t.Errorf("expected a redirect loop, got %v", err)
+	}
+
+	_, resp, err = get("/away")
+	orFatal("followRedirects", err, t)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Errorf("expected the redirect to another host to be relayed, got %v", resp.Status)
+	}
+}
+
+func TestFollowRedirectsFiltersHops(t *testing.T) {
+	reached := false
+	mux := http.NewServeMux()
+	mux.HandleFunc("/a", func(w http.ResponseWriter, r *http.Request) { http.Redirect(w, r, "/admin", http.StatusFound) })
+	mux.HandleFunc("/admin", func(w http.ResponseWriter, r *http.Request) { reached = true })
+	s := httptest.NewServer(mux)
+	defer s.Close()
+
+	proxy := NewProxyHttpServer()
+	proxy.RedirectPolicy = &RedirectPolicy{}
+	proxy.OnRequest(ReqConditionFunc(func(req *http.Request, ctx *ProxyCtx) bool {
+		return req.URL.Path == "/admin"
+	})).DoFunc(func(r *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response) {
+		return r, ctx.BlockedResponse(http.StatusForbidden, PolicyDecision{Policy: "test", Reason: "admin"})
+	})
+	req, err := http.NewRequest("GET", s.URL+"/a", nil)
+	orFatal("NewRequest", err, t)
+	ctx := &ProxyCtx{Req: req, Proxy: proxy}
+	resp, err := ctx.RoundTrip(req)
+	orFatal("RoundTrip", err, t)
+	resp, err = ctx.followRedirects(req, resp)
+	orFatal("followRedirects", err, t)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden || reached {
+		t.Errorf("expected the redirect to /admin to be blocked, got %v, reached %v", resp.Status, reached)
+	}
+}
+
+func TestFollowRedirectsRefusesPrivateTargets(t *testing.T) {
+	s := httptest.NewServer(ConstantHanlder("internal"))
+	defer s.Close()
+	_, port, _ := net.SplitHostPort(s.Listener.Addr().String())
+	// another host redirecting to the private address of s
+	front := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://localhost:"+port+"/", http.StatusFound)
+	}))
+	defer front.Close()
+
+	for _, allow := range []bool{false, true} {
+		proxy := NewProxyHttpServer()
+		proxy.RedirectPolicy = &RedirectPolicy{AllowPrivateTargets: allow}
+		req, err := http.NewRequest("GET", front.URL, nil)
+		orFatal("NewRequest", err, t)
+		ctx := &ProxyCtx{Req: req, Proxy: proxy}
+		resp, err := ctx.RoundTrip(req)
+		orFatal("RoundTrip", err, t)
+		resp, err = ctx.followRedirects(req, resp)
+		orFatal("followRedirects", err, t)
+		resp.Body.Close()
+		if followed := resp.StatusCode == http.StatusOK; followed != allow {
+			t.Errorf("AllowPrivateTargets %v: unexpected response %v", allow, resp.Status)
+		}
+	}
+}
+
+func TestFollowRedirectsRefusesResolvedPrivateTargets(t *testing.T) {
+	s := httptest.NewServer(ConstantHanlder("internal"))
+	defer s.Close()
+	_, port, _ := net.SplitHostPort(s.Listener.Addr().String())
+	// another host redirecting to a name resolving to the private address of s
+	front := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://internal.example.com:"+port+"/", http.StatusFound)
+	}))
+	defer front.Close()
+
+	for _, allow := range []bool{false, true} {
+		proxy := NewProxyHttpServer()
+		proxy.RedirectPolicy = &RedirectPolicy{AllowPrivateTargets: allow}
+		req, err := http.NewRequest("GET", front.URL, nil)
+		orFatal("NewRequest", err, t)
+		ctx := &ProxyCtx{Req: req, Proxy: proxy,
+			Resolver: StaticResolver{"internal.example.com": {net.ParseIP("127.0.0.1")}}}
+		resp, err := ctx.RoundTrip(req)
+		orFatal("RoundTrip", err, t)
+		resp, err = ctx.followRedirects(req, resp)
+		if !allow {
+			if !errors.Is(err, ErrPrivateTarget) {
+				t.Errorf("expected the redirect to the private address to be refused, got %v", err)
+			}
+			continue
+		}
+		orFatal("followRedirects", err, t)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("AllowPrivateTargets: unexpected response %v", resp.Status)
+		}
+	}
+}
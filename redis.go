@@ -0,0 +1,253 @@
+package goproxy
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RedisClient is the part of a Redis client the proxy needs, so that any client library can be
+// plugged in. With github.com/go-redis/redis for example:
+//
+//	goproxy.RedisEvalFunc(func(ctx context.Context, script string, keys []string, args ...interface{}) (interface{}, error) {
+//		return client.Eval(ctx, script, keys, args...).Result()
+//	})
+type RedisClient interface {
+	Eval(ctx context.Context, script string, keys []string, args ...interface{}) (interface{}, error)
+}
+
+// RedisEvalFunc converts a function to a RedisClient
+type RedisEvalFunc func(ctx context.Context, script string, keys []string, args ...interface{}) (interface{}, error)
+
+// Eval calls f(ctx, script, keys, args...)
+func (f RedisEvalFunc) Eval(ctx context.Context, script string, keys []string, args ...interface{}) (interface{}, error) {
+	return f(ctx, script, keys, args...)
+}
+
+// redisTimeout bounds the calls made to Redis on the request path
+const redisTimeout = 500 * time.Millisecond
+
+// tokenBucketScript takes ARGV[4] tokens from the bucket in KEYS[1], refilled at ARGV[1]
+// tokens per second up to ARGV[2] tokens. ARGV[3] is the current time in milliseconds.
+// It returns {1, 0} when the tokens were taken, {0, ms to wait} otherwise.
+const tokenBucketScript = `
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local n = tonumber(ARGV[4])
+local b = redis.call("HMGET", KEYS[1], "tokens", "ts")
+local tokens = tonumber(b[1]) or burst
+local ts = tonumber(b[2]) or now
+if now > ts then
+	tokens = math.min(burst, tokens + (now - ts) * rate / 1000)
+else
+	now = ts
+end
+local wait = 0
+if tokens >= n then
+	tokens = tokens - n
+else
+	wait = math.ceil((n - tokens) * 1000 / rate)
+end
+redis.call("HSET", KEYS[1], "tokens", tostring(tokens), "ts", tostring(now))
+redis.call("PEXPIRE", KEYS[1], math.ceil(burst * 1000 / rate) + 1000)
+if wait > 0 then
+	return {0, wait}
+end
+return {1, 0}
+`
+
+// RedisRateLimiter is a RateLimiter sharing its token buckets between the instances of a fleet
+// through Redis, so that the rate is enforced fleet-wide. Denied keys are cached locally until
+// their next token is due, to spare Redis the requests of clients hammering the proxy.
+// When Redis fails, the limiter falls back to local buckets and reports the error.
+type RedisRateLimiter struct {
+	Client RedisClient
+	// Prefix is prepended to the keys of the buckets in Redis
+	Prefix string
+	Rate   float64
+	Burst  int
+
+	mu          sync.Mutex
+	deniedUntil map[string]time.Time
+	fallback    TokenBucketLimiter
+}
+
+// Allow implements RateLimiter
+func (l *RedisRateLimiter) Allow(key string) (bool, error) {
+	now := time.Now()
+	l.mu.Lock()
+	if until, ok := l.deniedUntil[key]; ok {
+		if now.Before(until) {
+			l.mu.Unlock()
+			return false, nil
+		}
+		delete(l.deniedUntil, key)
+	}
+	l.mu.Unlock()
+
+	c, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	res, err := l.Client.Eval(c, tokenBucketScript, []string{l.Prefix + key},
+		l.Rate, l.Burst, now.UnixNano()/int64(time.Millisecond), 1)
+	var allowed, wait int64
+	if err == nil {
+		allowed, wait, err = redisIntPair(res)
+	}
+	if err != nil {
+		l.mu.Lock()
+		l.fallback.Rate, l.fallback.Burst = l.Rate, l.Burst
+		l.mu.Unlock()
+		local, _ := l.fallback.Allow(key)
+		return local, err
+	}
+	if allowed == 1 {
+		return true, nil
+	}
+	l.mu.Lock()
+	if l.deniedUntil == nil {
+		l.deniedUntil = make(map[string]time.Time)
+	}
+	l.deniedUntil[key] = now.Add(time.Duration(wait) * time.Millisecond)
+	l.mu.Unlock()
+	return false, nil
+}
+
+// redisIntPair converts the reply of tokenBucketScript
+func redisIntPair(res interface{}) (int64, int64, error) {
+	values, ok := res.([]interface{})
+	if !ok || len(values) != 2 {
+		return 0, 0, fmt.Errorf("unexpected redis reply %v", res)
+	}
+	a, err := redisInt(values[0])
+	if err != nil {
+		return 0, 0, err
+	}
+	b, err := redisInt(values[1])
+	return a, b, err
+}
+
+func redisInt(v interface{}) (int64, error) {
+	switch n := v.(type) {
+	case int64:
+		return n, nil
+	case int:
+		return int64(n), nil
+	case string:
+		return strconv.ParseInt(n, 10, 64)
+	case []byte:
+		return strconv.ParseInt(string(n), 10, 64)
+	}
+	return 0, fmt.Errorf("unexpected redis reply %v", v)
+}
+
+// quotaScript adds ARGV[1] to the counter in KEYS[1], expiring it after ARGV[2] milliseconds,
+// and returns its new value
+const quotaScript = `
+local used = redis.call("INCRBY", KEYS[1], ARGV[1])
+if tonumber(used) == tonumber(ARGV[1]) then
+	redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return used
+`
+
+// RedisQuota is a QuotaManager sharing its counters between the instances of a fleet through
+// Redis. Each instance accumulates the usage of its clients locally, and adds it to the shared
+// counter at most every SyncInterval, jittered so that the instances don't sync all at once.
+// The quota can thus be exceeded by the usage of up to one SyncInterval of each instance.
+type RedisQuota struct {
+	Client RedisClient
+	// Prefix is prepended to the keys of the counters in Redis
+	Prefix string
+	Limit  int64
+	Period time.Duration
+	// SyncInterval defaults to a second
+	SyncInterval time.Duration
+
+	mu    sync.Mutex
+	usage map[string]*redisQuotaUsage
+}
+
+type redisQuotaUsage struct {
+	window   int64
+	used     int64 // usage of the fleet at the last sync
+	pending  int64 // local usage not yet added to Redis
+	syncing  int64 // local usage being added to Redis
+	nextSync time.Time
+}
+
+func (q *RedisQuota) syncInterval() time.Duration {
+	if q.SyncInterval > 0 {
+		return q.SyncInterval
+	}
+	return time.Second
+}
+
+// current returns the usage of key for the current period, syncing it with Redis if due.
+// q.mu must not be held, it is released during the sync.
+func (q *RedisQuota) current(key string) (*redisQuotaUsage, error) {
+	now := time.Now()
+	window := quotaWindow(now, q.Period)
+	q.mu.Lock()
+	if q.usage == nil {
+		q.usage = make(map[string]*redisQuotaUsage)
+	}
+	u, ok := q.usage[key]
+	if !ok || u.window != window {
+		u = &redisQuotaUsage{window: window}
+		q.usage[key] = u
+	}
+	if now.Before(u.nextSync) {
+		q.mu.Unlock()
+		return u, nil
+	}
+	// jitter the next sync between half and one and a half interval, even on errors
+	interval := q.syncInterval()
+	u.nextSync = now.Add(interval/2 + time.Duration(rand.Int63n(int64(interval))))
+	u.syncing, u.pending = u.pending, 0
+	pending := u.syncing
+	q.mu.Unlock()
+
+	c, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	expire := q.Period
+	if expire <= 0 {
+		expire = 24 * time.Hour
+	}
+	redisKey := q.Prefix + key + ":" + strconv.FormatInt(window, 10)
+	res, err := q.Client.Eval(c, quotaScript, []string{redisKey}, pending, int64(expire/time.Millisecond))
+	var used int64
+	if err == nil {
+		used, err = redisInt(res)
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	u.syncing = 0
+	if err != nil {
+		u.pending += pending
+		return u, err
+	}
+	u.used = used
+	return u, nil
+}
+
+// Remaining implements QuotaManager. On Redis errors, it returns the remaining quota as
+// last known along with the error.
+func (q *RedisQuota) Remaining(key string) (int64, error) {
+	u, err := q.current(key)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.Limit - u.used - u.pending - u.syncing, err
+}
+
+// Consume implements QuotaManager
+func (q *RedisQuota) Consume(key string, n int64) error {
+	u, err := q.current(key)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	u.pending += n
+	return err
+}
@@ -0,0 +1,41 @@
+package goproxy
+
+import (
+	"net/http"
+)
+
+// A connection failing after the origin moved to other addresses keeps failing as long as the
+// proxy uses the addresses it cached, in the CachingResolver of the request or in the idle
+// connections of its pooled transports. With ProxyHttpServer.ReresolveOnFailure, a failed
+// connection to a destination flushes both, so that the next attempt resolves it again.
+
+// forgettingResolver is a Resolver whose cached answers for a host can be flushed, like
+// CachingResolver
+type forgettingResolver interface {
+	Forget(host string)
+}
+
+// connFailed flushes the cached addresses of the destination hostport of ctx, and the idle
+// connections of rt if it pools them, once a connection to it failed
+func (ctx *ProxyCtx) connFailed(hostport string, rt http.RoundTripper) {
+	proxy := ctx.Proxy
+	if proxy == nil || !proxy.ReresolveOnFailure {
+		return
+	}
+	host := hostOnly(hostport)
+	flushed := false
+	for _, r := range []Resolver{ctx.Resolver, ctx.BackupResolver} {
+		if f, ok := r.(forgettingResolver); ok {
+			f.Forget(host)
+			flushed = true
+		}
+	}
+	// the transports can't close the connections of a single destination
+	if tr, ok := rt.(interface{ CloseIdleConnections() }); ok {
+		tr.CloseIdleConnections()
+		flushed = true
+	}
+	if flushed {
+		ctx.Debugf(DebugDial, "connection to %s failed, flushed its cached addresses and idle connections", host)
+	}
+}
@@ -0,0 +1,78 @@
+package goproxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+)
+
+type idleCloser struct {
+	http.RoundTripper
+	closed int
+}
+
+func (c *idleCloser) CloseIdleConnections() { c.closed++ }
+
+func TestCachingResolverForget(t *testing.T) {
+	lookups := 0
+	upstream := ResolverFunc(func(ctx context.Context, host string, hints LookupHints) ([]net.IP, error) {
+		lookups++
+		return []net.IP{net.ParseIP("10.0.0.1")}, nil
+	})
+	shared := &mapCache{values: map[string][]byte{}}
+	a := &CachingResolver{Resolver: upstream, Shared: shared}
+	b := &CachingResolver{Resolver: upstream, Shared: shared}
+	lookup := func(r *CachingResolver, host string) {
+		if _, err := r.LookupIP(context.Background(), host, LookupHints{Network: "ip"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lookup(a, "example.com")
+	lookup(a, "other.com")
+	a.Forget("EXAMPLE.com")
+	lookup(a, "other.com")
+	if lookups != 2 {
+		t.Errorf("expected the other host to stay cached, got %d lookups", lookups)
+	}
+	lookup(a, "example.com")
+	if lookups != 3 {
+		t.Errorf("expected the forgotten host to be looked up again, got %d lookups", lookups)
+	}
+	a.Forget("example.com")
+	lookup(b, "example.com")
+	if lookups != 4 {
+		t.Errorf("expected the shared answer to be forgotten, got %d lookups", lookups)
+	}
+}
+
+func TestConnFailed(t *testing.T) {
+	lookups := 0
+	resolver := &CachingResolver{Resolver: ResolverFunc(func(ctx context.Context, host string, hints LookupHints) ([]net.IP, error) {
+		lookups++
+		return []net.IP{net.ParseIP("10.0.0.1")}, nil
+	})}
+	proxy := NewProxyHttpServer()
+	ctx := &ProxyCtx{Proxy: proxy, Resolver: resolver}
+	tr := &idleCloser{}
+	lookup := func() {
+		if _, err := resolver.LookupIP(context.Background(), "example.com", LookupHints{Network: "ip"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lookup()
+	ctx.connFailed("example.com:443", tr)
+	lookup()
+	if lookups != 1 || tr.closed != 0 {
+		t.Errorf("expected nothing flushed while disabled, got %d lookups and %d closes", lookups, tr.closed)
+	}
+
+	proxy.ReresolveOnFailure = true
+	ctx.connFailed("example.com:443", tr)
+	lookup()
+	if lookups != 2 || tr.closed != 1 {
+		t.Errorf("expected the host and the idle connections flushed, got %d lookups and %d closes", lookups, tr.closed)
+	}
+}
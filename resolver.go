@@ -0,0 +1,376 @@
+package goproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// LookupHints carries the per-request settings a Resolver should take into account
+type LookupHints struct {
+	// Network is "ip4", "ip6" or "ip" (both families)
+	Network string
+	// EDNSClientSubnetV4 and EDNSClientSubnetV6 are CIDRs sent as EDNS client subnet
+	// by the resolvers talking the DNS protocol
+	EDNSClientSubnetV4 string
+	EDNSClientSubnetV6 string
+	// LocalAddr is the local IP used to reach the DNS server, if any
+	LocalAddr string
+	// Timeout bounds each query, zero means no timeout
+	Timeout time.Duration
+	// ForceTCP asks resolvers speaking DNS over udp to use tcp instead
+	ForceTCP bool
+	// LogQuery, if not nil, should be called by the resolver for every query it makes
+	LogQuery func(DNSQuery)
+}
+
+// Resolver resolves host names for the proxy. It replaces the string typed DNSResolver and
+// BackupDNSResolver fields of ProxyCtx when set.
+type Resolver interface {
+	LookupIP(ctx context.Context, host string, hints LookupHints) ([]net.IP, error)
+}
+
+// ResolverFunc converts a function to a Resolver
+type ResolverFunc func(ctx context.Context, host string, hints LookupHints) ([]net.IP, error)
+
+// LookupIP calls f(ctx, host, hints)
+func (f ResolverFunc) LookupIP(ctx context.Context, host string, hints LookupHints) ([]net.IP, error) {
+	return f(ctx, host, hints)
+}
+
+// SystemResolver resolves through the resolver of the operating system
+type SystemResolver struct{}
+
+// LookupIP implements Resolver
+func (SystemResolver) LookupIP(ctx context.Context, host string, hints LookupHints) ([]net.IP, error) {
+	if hints.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, hints.Timeout)
+		defer cancel()
+	}
+	start := time.Now()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	var ips []net.IP
+	for _, addr := range addrs {
+		if matchesNetwork(addr.IP, hints.Network) {
+			ips = append(ips, addr.IP)
+		}
+	}
+	if hints.LogQuery != nil {
+		hints.LogQuery(DNSQuery{Name: host, Type: "IP", Resolver: "system", Latency: time.Since(start), Answers: ipStrings(ips), Err: err})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ips, nil
+}
+
+// DNSServerResolver queries a DNS server directly. Net is "udp" (the default), "tcp",
+// or "tcp-tls" for DNS over TLS, in which case TLSConfig is used for the handshake.
+// Truncated udp responses are retried over tcp against the same server.
+type DNSServerResolver struct {
+	// Addr is the host:port of the server, 127.0.0.1:53 if empty
+	Addr      string
+	Net       string
+	TLSConfig *tls.Config
+}
+
+func (r *DNSServerResolver) String() string {
+	if r.Net == "" {
+		return "udp://" + r.Addr
+	}
+	return r.Net + "://" + r.Addr
+}
+
+// LookupIP implements Resolver
+func (r *DNSServerResolver) LookupIP(ctx context.Context, host string, hints LookupHints) ([]net.IP, error) {
+	addr := r.Addr
+	if addr == "" {
+		addr = "127.0.0.1:53"
+	}
+	proto := r.Net
+	if proto == "" {
+		proto = "udp"
+	}
+
+	if proto == "udp" && hints.ForceTCP {
+		proto = "tcp"
+	}
+
+	c, err := r.client(proto, hints)
+	if err != nil {
+		return nil, err
+	}
+
+	exchange := func(m *dns.Msg) (*dns.Msg, error) {
+		reply, _, err := c.ExchangeContext(ctx, m, addr)
+		if err == nil && reply.Truncated && c.Net == "udp" {
+			// the answer did not fit in a datagram, ask again over tcp to get all the records
+			tc, err := r.client("tcp", hints)
+			if err != nil {
+				return reply, nil
+			}
+			if tcpReply, _, err := tc.ExchangeContext(ctx, m, addr); err == nil {
+				return tcpReply, nil
+			}
+		}
+		return reply, err
+	}
+	return lookupDNS(exchange, r.String(), host, hints)
+}
+
+// client returns a dns.Client querying the server over proto
+func (r *DNSServerResolver) client(proto string, hints LookupHints) (*dns.Client, error) {
+	c := new(dns.Client)
+
+	c.Net = proto
+	c.TLSConfig = r.TLSConfig
+	c.DialTimeout = hints.Timeout
+	c.ReadTimeout = hints.Timeout
+	c.WriteTimeout = hints.Timeout
+
+	if hints.LocalAddr != "" {
+		localAddr := net.JoinHostPort(hints.LocalAddr, "0")
+		c.Dialer = &net.Dialer{Timeout: c.DialTimeout}
+		if proto == "udp" {
+			udpAddr, err := net.ResolveUDPAddr("udp", localAddr)
+			if err != nil {
+				return nil, err
+			}
+			c.Dialer.LocalAddr = udpAddr
+		} else {
+			tcpAddr, err := net.ResolveTCPAddr("tcp", localAddr)
+			if err != nil {
+				return nil, err
+			}
+			c.Dialer.LocalAddr = tcpAddr
+		}
+	}
+	return c, nil
+}
+
+// DoHResolver resolves over DNS over HTTPS (RFC 8484) by POSTing wire format queries to URL
+type DoHResolver struct {
+	URL string
+	// Client is used to send the queries, http.DefaultClient if nil
+	Client *http.Client
+}
+
+func (r *DoHResolver) String() string {
+	return r.URL
+}
+
+// LookupIP implements Resolver
+func (r *DoHResolver) LookupIP(ctx context.Context, host string, hints LookupHints) ([]net.IP, error) {
+	client := r.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	exchange := func(m *dns.Msg) (*dns.Msg, error) {
+		m.Id = 0
+		packed, err := m.Pack()
+		if err != nil {
+			return nil, err
+		}
+		reqCtx := ctx
+		if hints.Timeout > 0 {
+			var cancel context.CancelFunc
+			reqCtx, cancel = context.WithTimeout(ctx, hints.Timeout)
+			defer cancel()
+		}
+		req, err := http.NewRequest("POST", r.URL, bytes.NewReader(packed))
+		if err != nil {
+			return nil, err
+		}
+		req = req.WithContext(reqCtx)
+		req.Header.Set("Content-Type", "application/dns-message")
+		req.Header.Set("Accept", "application/dns-message")
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("doh server replied %s", resp.Status)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		reply := new(dns.Msg)
+		if err := reply.Unpack(body); err != nil {
+			return nil, err
+		}
+		return reply, nil
+	}
+	return lookupDNS(exchange, r.URL, host, hints)
+}
+
+// StaticResolver answers from a fixed map of host names to addresses
+type StaticResolver map[string][]net.IP
+
+// LookupIP implements Resolver
+func (r StaticResolver) LookupIP(ctx context.Context, host string, hints LookupHints) ([]net.IP, error) {
+	var ips []net.IP
+	for _, ip := range r[strings.TrimSuffix(strings.ToLower(host), ".")] {
+		if matchesNetwork(ip, hints.Network) {
+			ips = append(ips, ip)
+		}
+	}
+	var err error
+	if len(ips) == 0 {
+		err = &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	if hints.LogQuery != nil {
+		hints.LogQuery(DNSQuery{Name: host, Type: "IP", Resolver: "static", Answers: ipStrings(ips), Err: err})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ips, nil
+}
+
+var errNoResolver = errors.New("no resolver configured")
+
+func ipStrings(ips []net.IP) []string {
+	s := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		s = append(s, ip.String())
+	}
+	return s
+}
+
+func matchesNetwork(ip net.IP, network string) bool {
+	switch network {
+	case "ip4":
+		return ip.To4() != nil
+	case "ip6":
+		return ip.To4() == nil
+	}
+	return true
+}
+
+// lookupDNS sends the A and AAAA queries for host through exchange, adding the EDNS client
+// subnet options of hints. resolver describes the server for the query log.
+func lookupDNS(exchange func(m *dns.Msg) (*dns.Msg, error), resolver, host string, hints LookupHints) ([]net.IP, error) {
+	var ips []net.IP
+	var err4, err6 error
+
+	query := func(qtype uint16, clientSubnet string, family uint16) ([]net.IP, error) {
+		m := new(dns.Msg)
+		m.SetQuestion(dns.Fqdn(host), qtype)
+		setClientSubnet(m, clientSubnet, family)
+
+		start := time.Now()
+		r, err := exchange(m)
+		var answers []net.IP
+		if err == nil && r.Rcode == dns.RcodeSuccess {
+			for _, a := range r.Answer {
+				switch ar := a.(type) {
+				case *dns.A:
+					answers = append(answers, ar.A)
+				case *dns.AAAA:
+					answers = append(answers, ar.AAAA)
+				}
+			}
+		}
+
+		if hints.LogQuery != nil {
+			q := DNSQuery{
+				Name:     host,
+				Type:     dns.TypeToString[qtype],
+				Resolver: resolver,
+				Latency:  time.Since(start),
+				Answers:  ipStrings(answers),
+				Err:      err,
+			}
+			if r != nil {
+				q.Rcode = dns.RcodeToString[r.Rcode]
+			}
+			if _, _, err := net.ParseCIDR(clientSubnet); err == nil {
+				q.ClientSubnet = clientSubnet
+			}
+			hints.LogQuery(q)
+		}
+		return answers, err
+	}
+
+	// TODO: make these requests in parallel
+
+	if hints.Network != "ip6" {
+		var answers []net.IP
+		answers, err4 = query(dns.TypeA, hints.EDNSClientSubnetV4, 1)
+		ips = append(ips, answers...)
+	}
+
+	if hints.Network != "ip4" {
+		var answers []net.IP
+		answers, err6 = query(dns.TypeAAAA, hints.EDNSClientSubnetV6, 2)
+		ips = append(ips, answers...)
+	}
+
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("v4: %+v - v6: %+v", err4, err6)
+	}
+	return ips, nil
+}
+
+// setClientSubnet adds an EDNS client subnet option for cidr to m, if cidr is valid
+func setClientSubnet(m *dns.Msg, cidr string, family uint16) {
+	ip, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return
+	}
+	eDNS0Subnet := new(dns.EDNS0_SUBNET)
+	eDNS0Subnet.Code = dns.EDNS0SUBNET
+	eDNS0Subnet.SourceScope = 0
+	eDNS0Subnet.Address = ip
+	eDNS0Subnet.Family = family
+	ones, _ := ipNet.Mask.Size()
+	eDNS0Subnet.SourceNetmask = uint8(ones)
+	m.SetEdns0(dns.DefaultMsgSize, false)
+	opt := m.IsEdns0()
+	opt.Option = append(opt.Option, eDNS0Subnet)
+}
+
+// lookupHints returns the hints for a lookup made on behalf of ctx
+func (ctx *ProxyCtx) lookupHints(network string) LookupHints {
+	return LookupHints{
+		Network:            network,
+		EDNSClientSubnetV4: ctx.EDNSClientSubnetV4,
+		EDNSClientSubnetV6: ctx.EDNSClientSubnetV6,
+		LocalAddr:          ctx.DNSLocalAddr,
+		Timeout:            ctx.DNSTimeout,
+		ForceTCP:           ctx.DNSForceTCP,
+		LogQuery:           ctx.queryLogger(),
+	}
+}
+
+// primaryResolver returns ctx.Resolver, or a resolver querying ctx.DNSResolver over proto
+func (ctx *ProxyCtx) primaryResolver(proto string) Resolver {
+	if ctx.Resolver != nil {
+		return ctx.Resolver
+	}
+	return &DNSServerResolver{Addr: ctx.DNSResolver, Net: proto}
+}
+
+// backupResolver returns ctx.BackupResolver, or a resolver querying ctx.BackupDNSResolver
+// over proto. It returns nil when no backup is configured.
+func (ctx *ProxyCtx) backupResolver(proto string) Resolver {
+	if ctx.BackupResolver != nil {
+		return ctx.BackupResolver
+	}
+	if ctx.BackupDNSResolver != "" {
+		return &DNSServerResolver{Addr: ctx.BackupDNSResolver, Net: proto}
+	}
+	return nil
+}
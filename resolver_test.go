@@ -0,0 +1,87 @@
+package goproxy
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestStaticResolver(t *testing.T) {
+	r := StaticResolver{"example.com": {net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")}}
+
+	ips, err := r.LookupIP(context.Background(), "Example.com.", LookupHints{Network: "ip4"})
+	orFatal("LookupIP", err, t)
+	if len(ips) != 1 || !ips[0].Equal(net.ParseIP("192.0.2.1")) {
+		t.Errorf("expected only the v4 address, got %v", ips)
+	}
+	if _, err := r.LookupIP(context.Background(), "example.com", LookupHints{Network: "ip6"}); err != nil {
+		t.Errorf("expected the v6 address, got %v", err)
+	}
+	if _, err := r.LookupIP(context.Background(), "example.org", LookupHints{Network: "ip"}); err == nil {
+		t.Error("expected an error for an unknown host")
+	}
+}
+
+func TestRoundTripUsesCtxResolver(t *testing.T) {
+	s := httptest.NewServer(ConstantHanlder("bobo"))
+	defer s.Close()
+	u, _ := url.Parse(s.URL)
+	_, port, _ := net.SplitHostPort(u.Host)
+
+	req, err := http.NewRequest("GET", "http://bobo.invalid:"+port+"/", nil)
+	orFatal("NewRequest", err, t)
+	ctx := &ProxyCtx{
+		Req:      req,
+		Proxy:    NewProxyHttpServer(),
+		Resolver: StaticResolver{"bobo.invalid": {net.ParseIP("127.0.0.1")}},
+	}
+	resp, err := ctx.RoundTrip(req)
+	orFatal("RoundTrip", err, t)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	orFatal("ReadAll", err, t)
+	if string(body) != "bobo" {
+		t.Errorf("unexpected body %q", body)
+	}
+	if len(ctx.DialTrace.Addrs) != 1 || ctx.DialTrace.Addrs[0] != "127.0.0.1" {
+		t.Errorf("resolution not traced: %+v", ctx.DialTrace)
+	}
+}
+
+func TestDNSServerResolverRetriesTruncatedOverTCP(t *testing.T) {
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, m *dns.Msg) {
+		r := new(dns.Msg)
+		r.SetReply(m)
+		if _, udp := w.RemoteAddr().(*net.UDPAddr); udp {
+			r.Truncated = true
+		} else if m.Question[0].Qtype == dns.TypeA {
+			rr, _ := dns.NewRR(m.Question[0].Name + " 60 IN A 192.0.2.1")
+			r.Answer = append(r.Answer, rr)
+		}
+		w.WriteMsg(r)
+	})
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	orFatal("ListenPacket", err, t)
+	l, err := net.Listen("tcp", pc.LocalAddr().String())
+	orFatal("Listen", err, t)
+	udpServer := &dns.Server{PacketConn: pc, Handler: handler}
+	tcpServer := &dns.Server{Listener: l, Handler: handler}
+	go udpServer.ActivateAndServe()
+	go tcpServer.ActivateAndServe()
+	defer udpServer.Shutdown()
+	defer tcpServer.Shutdown()
+
+	r := &DNSServerResolver{Addr: pc.LocalAddr().String()}
+	ips, err := r.LookupIP(context.Background(), "example.com", LookupHints{Network: "ip4"})
+	orFatal("LookupIP", err, t)
+	if len(ips) != 1 || !ips[0].Equal(net.ParseIP("192.0.2.1")) {
+		t.Errorf("expected the tcp answer, got %v", ips)
+	}
+}
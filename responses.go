@@ -2,8 +2,10 @@ package goproxy
 
 import (
 	"bytes"
+	"encoding/json"
 	"io/ioutil"
 	"net/http"
+	"strings"
 )
 
 // Will generate a valid http response to the given request the response will have
@@ -31,9 +33,64 @@ func NewResponse(r *http.Request, contentType string, status int, body string) *
 const (
 	ContentTypeText = "text/plain"
 	ContentTypeHtml = "text/html"
+	ContentTypeJSON = "application/json"
 )
 
 // Alias for NewResponse(r,ContentTypeText,http.StatusAccepted,text)
 func TextResponse(r *http.Request, text string) *http.Response {
 	return NewResponse(r, ContentTypeText, http.StatusAccepted, text)
 }
+
+// PolicyDecision describes the policy that denied a request, so that clients and downstream
+// automation can react to blocks programmatically
+type PolicyDecision struct {
+	// Policy is the name of the policy (e.g. "blocklist", "quota", "auth")
+	Policy   string `json:"policy"`
+	RuleID   string `json:"rule_id,omitempty"`
+	Category string `json:"category,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// Headers carrying the PolicyDecision of blocked responses
+const (
+	PolicyHeader         = "X-Proxy-Policy"
+	PolicyRuleIDHeader   = "X-Proxy-Policy-Rule"
+	PolicyCategoryHeader = "X-Proxy-Policy-Category"
+)
+
+// NewBlockedResponse generates a response denying r with the given status, carrying d
+// as X-Proxy-Policy headers. The body is d encoded as JSON when the client accepts
+// application/json, and a plain text explanation otherwise.
+//
+//	proxy.OnRequest(goproxy.ReqHostIs("ads.example.com")).DoFunc(func(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+//		return r, goproxy.NewBlockedResponse(r, http.StatusForbidden,
+//			goproxy.PolicyDecision{Policy: "blocklist", RuleID: "ads-1", Category: "advertising"})
+//	})
+func NewBlockedResponse(r *http.Request, status int, d PolicyDecision) *http.Response {
+	var resp *http.Response
+	if strings.Contains(r.Header.Get("Accept"), ContentTypeJSON) {
+		body, _ := json.Marshal(d)
+		resp = NewResponse(r, ContentTypeJSON, status, string(body))
+	} else {
+		text := "Blocked by policy " + d.Policy
+		if d.Reason != "" {
+			text += ": " + d.Reason
+		}
+		resp = NewResponse(r, ContentTypeText, status, text+"\n")
+	}
+	resp.Header.Set(PolicyHeader, d.Policy)
+	if d.RuleID != "" {
+		resp.Header.Set(PolicyRuleIDHeader, d.RuleID)
+	}
+	if d.Category != "" {
+		resp.Header.Set(PolicyCategoryHeader, d.Category)
+	}
+	return resp
+}
+
+// BlockedResponse is NewBlockedResponse for the request of ctx, it also records the decision
+// in ctx.PolicyDecision for logging and accounting
+func (ctx *ProxyCtx) BlockedResponse(status int, d PolicyDecision) *http.Response {
+	ctx.PolicyDecision = &d
+	return NewBlockedResponse(ctx.Req, status, d)
+}
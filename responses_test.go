@@ -0,0 +1,33 @@
+package goproxy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+func TestNewBlockedResponse(t *testing.T) {
+	d := PolicyDecision{Policy: "blocklist", RuleID: "ads-1", Category: "advertising"}
+
+	req, _ := http.NewRequest("GET", "http://ads.example.com/", nil)
+	resp := NewBlockedResponse(req, http.StatusForbidden, d)
+	if resp.StatusCode != http.StatusForbidden || resp.Header.Get(PolicyHeader) != "blocklist" ||
+		resp.Header.Get(PolicyRuleIDHeader) != "ads-1" || resp.Header.Get(PolicyCategoryHeader) != "advertising" {
+		t.Errorf("unexpected response %d %v", resp.StatusCode, resp.Header)
+	}
+	if resp.Header.Get("Content-Type") != ContentTypeText {
+		t.Errorf("expected a text body, got %s", resp.Header.Get("Content-Type"))
+	}
+
+	req.Header.Set("Accept", "application/json, text/plain")
+	resp = NewBlockedResponse(req, http.StatusForbidden, d)
+	body, _ := ioutil.ReadAll(resp.Body)
+	var got PolicyDecision
+	if err := json.Unmarshal(body, &got); err != nil {
+		t.Fatalf("invalid json body %q: %v", body, err)
+	}
+	if got != d {
+		t.Errorf("expected %+v, got %+v", d, got)
+	}
+}
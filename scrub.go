@@ -0,0 +1,124 @@
+package goproxy
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// RefererMode is what a ScrubPolicy does with the Referer of cross-origin requests
+type RefererMode int
+
+const (
+	// RefererKeep forwards the Referer as is
+	RefererKeep RefererMode = iota
+	// RefererOriginOnly downgrades the Referer of cross-origin requests to the origin of the
+	// referring page
+	RefererOriginOnly
+	// RefererStrip removes the Referer of cross-origin requests
+	RefererStrip
+)
+
+// ScrubPolicy removes the tracking information from the requests it is applied to by Scrub.
+// The Referer of requests from https to http pages is always removed when a RefererMode
+// other than RefererKeep is set.
+//
+//	proxy.OnRequest().Do(goproxy.Scrub(&goproxy.ScrubPolicy{
+//		CrossOriginReferer: goproxy.RefererOriginOnly, StripParams: goproxy.TrackingParams}))
+type ScrubPolicy struct {
+	// counters of scrubbed items, aligned for atomic operations
+	referers int64
+	params   int64
+
+	CrossOriginReferer RefererMode
+	// StripParams are the query parameters removed from the URLs, a trailing * matches every
+	// parameter with the prefix
+	StripParams []string
+	// RefererMetric and ParamMetric, if set, count the referers and parameters scrubbed
+	RefererMetric *prometheus.Counter
+	ParamMetric   *prometheus.Counter
+}
+
+// Scrubbed returns the numbers of referers and query parameters scrubbed by policy
+func (policy *ScrubPolicy) Scrubbed() (referers int64, params int64) {
+	return atomic.LoadInt64(&policy.referers), atomic.LoadInt64(&policy.params)
+}
+
+// Scrub returns a ReqHandler scrubbing the requests it handles according to policy
+func Scrub(policy *ScrubPolicy) ReqHandler {
+	return FuncReqHandler(func(r *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response) {
+		if policy.scrubReferer(r) {
+			ctx.Logf("Scrubbed Referer of %s", r.URL.Host)
+			atomic.AddInt64(&policy.referers, 1)
+			if policy.RefererMetric != nil {
+				metric := *policy.RefererMetric
+				metric.Inc()
+			}
+		}
+		if n := policy.scrubParams(r.URL); n > 0 {
+			ctx.Logf("Scrubbed %d query parameters of %s", n, r.URL.Host)
+			atomic.AddInt64(&policy.params, int64(n))
+			if policy.ParamMetric != nil {
+				metric := *policy.ParamMetric
+				metric.Add(float64(n))
+			}
+		}
+		return r, nil
+	})
+}
+
+// scrubReferer downgrades or removes the Referer of r, and reports whether it was changed
+func (policy *ScrubPolicy) scrubReferer(r *http.Request) bool {
+	referer := r.Header.Get("Referer")
+	if policy.CrossOriginReferer == RefererKeep || referer == "" {
+		return false
+	}
+	ref, err := url.Parse(referer)
+	if err != nil || ref.Scheme == "https" && r.URL.Scheme == "http" {
+		r.Header.Del("Referer")
+		return true
+	}
+	if strings.EqualFold(ref.Scheme, r.URL.Scheme) && strings.EqualFold(ref.Host, r.URL.Host) {
+		return false
+	}
+	if policy.CrossOriginReferer == RefererStrip {
+		r.Header.Del("Referer")
+		return true
+	}
+	origin := ref.Scheme + "://" + ref.Host + "/"
+	if origin == referer {
+		return false
+	}
+	r.Header.Set("Referer", origin)
+	return true
+}
+
+// scrubParams removes the StripParams from the query of u, and returns how many were removed
+func (policy *ScrubPolicy) scrubParams(u *url.URL) int {
+	if len(policy.StripParams) == 0 || u.RawQuery == "" {
+		return 0
+	}
+	var kept []string
+	n := 0
+	for _, pair := range strings.Split(u.RawQuery, "&") {
+		name := pair
+		if i := strings.IndexByte(pair, '='); i >= 0 {
+			name = pair[:i]
+		}
+		if unescaped, err := url.QueryUnescape(name); err == nil {
+			name = unescaped
+		}
+		if pair != "" && paramMatches(policy.StripParams, name) {
+			n++
+			continue
+		}
+		kept = append(kept, pair)
+	}
+	if n > 0 {
+		u.RawQuery = strings.Join(kept, "&")
+	}
+	return n
+}
@@ -0,0 +1,32 @@
+package goproxy
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestScrub(t *testing.T) {
+	policy := &ScrubPolicy{CrossOriginReferer: RefererOriginOnly, StripParams: TrackingParams}
+	scrub := Scrub(policy)
+	for _, c := range []struct {
+		url, referer        string
+		expectedURL, expRef string
+	}{
+		{"http://example.com/a?b=1&utm_source=x&fbclid=y", "http://example.com/page?q=1",
+			"http://example.com/a?b=1", "http://example.com/page?q=1"},
+		{"https://cdn.example.com/lib.js", "https://example.com/secret/page",
+			"https://cdn.example.com/lib.js", "https://example.com/"},
+		{"http://example.org/?utm_medium=mail", "https://example.com/page",
+			"http://example.org/", ""},
+	} {
+		req, _ := http.NewRequest("GET", c.url, nil)
+		req.Header.Set("Referer", c.referer)
+		req, _ = scrub.Handle(req, &ProxyCtx{Req: req, Proxy: NewProxyHttpServer()})
+		if req.URL.String() != c.expectedURL || req.Header.Get("Referer") != c.expRef {
+			t.Errorf("%s: unexpected scrubbed request %s, Referer %q", c.url, req.URL, req.Header.Get("Referer"))
+		}
+	}
+	if referers, params := policy.Scrubbed(); referers != 2 || params != 3 {
+		t.Errorf("unexpected counters %d referers, %d params", referers, params)
+	}
+}
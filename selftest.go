@@ -0,0 +1,293 @@
+package goproxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+)
+
+// SelfTestStep is the outcome of a step of a self-test
+type SelfTestStep struct {
+	Name     string        `json:"name"`
+	OK       bool          `json:"ok"`
+	Detail   string        `json:"detail"`
+	Duration time.Duration `json:"duration"`
+}
+
+// SelfTestReport is the outcome of ProxyHttpServer.SelfTest, step by step
+type SelfTestReport struct {
+	URL   string         `json:"url"`
+	OK    bool           `json:"ok"`
+	Steps []SelfTestStep `json:"steps"`
+}
+
+func (r *SelfTestReport) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "self-test of %s\n", r.URL)
+	w := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	for _, step := range r.Steps {
+		outcome := "ok"
+		if !step.OK {
+			outcome = "FAILED"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%v\t%s\n", step.Name, outcome, step.Duration.Round(time.Microsecond), step.Detail)
+	}
+	w.Flush()
+	return b.String()
+}
+
+// step runs the step name, and reports whether it succeeded
+func (r *SelfTestReport) step(name string, run func() (string, error)) bool {
+	start := time.Now()
+	detail, err := run()
+	step := SelfTestStep{Name: name, OK: err == nil, Detail: detail, Duration: time.Since(start)}
+	if err != nil {
+		step.Detail = err.Error()
+		r.OK = false
+	}
+	r.Steps = append(r.Steps, step)
+	return step.OK
+}
+
+// SelfTest runs the pipeline of the proxy for a GET of target, without serving a client, and
+// reports the outcome and the duration of every step: the evaluation of the handlers, the
+// upstream selection, the DNS resolution, the dial and, for https URLs, the TLS handshake
+// with the destination. The request is then sent, and its response status reported.
+//
+// The handlers run as they would for a real request, so their side effects (counters, rate
+// limits) apply. tlsConfig sets the handshake with https destinations, the certificates are
+// verified against the system roots if it is nil. The steps are bounded by the deadline of
+// c, if any.
+func (proxy *ProxyHttpServer) SelfTest(c context.Context, target string, tlsConfig *tls.Config) *SelfTestReport {
+	report := &SelfTestReport{URL: target, OK: true}
+	var r *http.Request
+	ok := report.step("request", func() (string, error) {
+		u, err := url.Parse(target)
+		if err != nil {
+			return "", err
+		}
+		if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+			return "", fmt.Errorf("%q is not an absolute http or https URL", target)
+		}
+		r, err = http.NewRequest("GET", target, nil)
+		if err != nil {
+			return "", err
+		}
+		r = r.WithContext(c)
+		r.RemoteAddr = "127.0.0.1:0"
+		return "GET " + u.String(), nil
+	})
+	if !ok {
+		return report
+	}
+	ctx := &ProxyCtx{Req: r, Session: atomic.AddInt64(&proxy.sess, 1), Proxy: proxy, cfg: proxy.config()}
+	if r.URL.Scheme == "https" {
+		proxy.selfTestTunnel(ctx, report, r, tlsConfig)
+	} else {
+		proxy.selfTestHTTP(ctx, report, r)
+	}
+	return report
+}
+
+// selfTestRoute reports the upstream selected for host and resolves it
+func (proxy *ProxyHttpServer) selfTestRoute(ctx *ProxyCtx, report *SelfTestReport, host string) bool {
+	report.step("upstream", func() (string, error) {
+		if proxy.routeLocal(ctx, host) {
+			return "local destination, dialed directly", nil
+		}
+		var route string
+		switch {
+		case ctx.ForwardProxy != "":
+			proto := ctx.ForwardProxyProto
+			if proto == "" {
+				proto = "http"
+			}
+			route = "forward proxy " + proto + "://" + ctx.ForwardProxy
+		case ctx.ForwardProxyTProxy:
+			route = "transparent proxy from " + ctx.ForwardProxySourceIP
+		case ctx.ForwardProxyDirect && ctx.ForwardProxySourceIP != "":
+			route = "direct from " + ctx.ForwardProxySourceIP
+		default:
+			route = "direct"
+		}
+		if len(ctx.FallbackChain) > 0 {
+			route += fmt.Sprintf(", %d fallback upstreams", len(ctx.FallbackChain))
+		}
+		return route, nil
+	})
+	return report.step("dns", func() (string, error) {
+		hostname := host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			hostname = h
+		}
+		if net.ParseIP(hostname) != nil {
+			return "IP literal, not resolved", nil
+		}
+		ips, ips6, err := proxy.resolveDomain(ctx, ctx.primaryResolver("udp"), hostname)
+		if backup := ctx.backupResolver("udp"); err != nil && backup != nil {
+			ctx.Logf("self-test: primary resolver failed: %v, trying the backup", err)
+			ips, ips6, err = proxy.resolveDomain(ctx, backup, hostname)
+		}
+		if err != nil {
+			return "", err
+		}
+		return strings.Join(append(ips, ips6...), ", "), nil
+	})
+}
+
+// selfTestHTTP tests the plain HTTP request r
+func (proxy *ProxyHttpServer) selfTestHTTP(ctx *ProxyCtx, report *SelfTestReport, r *http.Request) {
+	var resp *http.Response
+	ok := report.step("handlers", func() (string, error) {
+		r, resp = proxy.filterRequest(r, ctx)
+		if resp != nil {
+			return "", fmt.Errorf("answered by the handlers: %d %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+		}
+		if r == nil {
+			return "", fmt.Errorf("dropped by the handlers")
+		}
+		return "forwarded to " + r.URL.String(), nil
+	})
+	if ctx.Cancel != nil {
+		defer ctx.Cancel()
+	}
+	if !ok || !proxy.selfTestRoute(ctx, report, r.URL.Host) {
+		return
+	}
+	report.step("response", func() (string, error) {
+		removeProxyHeaders(ctx, r)
+		resp, err := ctx.RoundTrip(r)
+		if err != nil {
+			return "", err
+		}
+		resp.Body.Close()
+		detail := resp.Status
+		if ctx.DialTrace != nil {
+			detail += ", dial " + ctx.DialTrace.String()
+		}
+		if resp.StatusCode >= 500 {
+			return "", fmt.Errorf("%s", detail)
+		}
+		return detail, nil
+	})
+}
+
+// selfTestTunnel tests the CONNECT tunnel to the https URL of r, and the request r through it
+func (proxy *ProxyHttpServer) selfTestTunnel(ctx *ProxyCtx, report *SelfTestReport, r *http.Request, tlsConfig *tls.Config) {
+	host := withPort(r.URL.Host, "443")
+	ok := report.step("handlers", func() (string, error) {
+		todo := OkConnect
+		for _, h := range proxy.httpsHandlers {
+			newtodo, newhost := ctx.handleConnect(h, host)
+			if newtodo != nil {
+				todo, host = newtodo, newhost
+				break
+			}
+		}
+		switch todo.Action {
+		case ConnectAccept:
+			return "CONNECT accepted to " + host, nil
+		case ConnectReject:
+			return "", fmt.Errorf("CONNECT rejected by the handlers")
+		case ConnectMitm, ConnectHTTPMitm:
+			return "", fmt.Errorf("CONNECT intercepted (MITM) by the handlers, not tested")
+		default:
+			return "", fmt.Errorf("CONNECT hijacked by the handlers, not tested")
+		}
+	})
+	if !ok || !proxy.selfTestRoute(ctx, report, host) {
+		return
+	}
+	var conn net.Conn
+	ok = report.step("dial", func() (string, error) {
+		if ctx.ForwardProxyTProxy {
+			return "", fmt.Errorf("transparent proxying needs a client connection, not tested")
+		}
+		var err error
+		_, _, _, conn, err = proxy.getTargetSiteConnection(ctx, nil, host)
+		if err != nil {
+			return "", err
+		}
+		return conn.RemoteAddr().String() + ", " + ctx.DialTrace.String(), nil
+	})
+	if !ok {
+		return
+	}
+	defer conn.Close()
+	if deadline, ok := r.Context().Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	var tlsConn *tls.Conn
+	ok = report.step("tls", func() (string, error) {
+		config := &tls.Config{}
+		if tlsConfig != nil {
+			config = tlsConfig.Clone()
+		}
+		if config.ServerName == "" {
+			config.ServerName = r.URL.Hostname()
+		}
+		tlsConn = tls.Client(conn, config)
+		if err := tlsConn.Handshake(); err != nil {
+			return "", err
+		}
+		state := tlsConn.ConnectionState()
+		detail := tlsVersionName(state.Version)
+		if len(state.PeerCertificates) > 0 {
+			cert := state.PeerCertificates[0]
+			detail += fmt.Sprintf(", certificate %s expires %s", cert.Subject.CommonName, cert.NotAfter.Format(time.RFC3339))
+		}
+		return detail, nil
+	})
+	if !ok {
+		return
+	}
+	report.step("response", func() (string, error) {
+		if err := r.Write(tlsConn); err != nil {
+			return "", err
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(tlsConn), r)
+		if err != nil {
+			return "", err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 500 {
+			return "", fmt.Errorf("%s", resp.Status)
+		}
+		return resp.Status, nil
+	})
+}
+
+func tlsVersionName(v uint16) string {
+	switch v {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	}
+	return fmt.Sprintf("TLS %#04x", v)
+}
+
+func (proxy *ProxyHttpServer) serveSelfTest(w http.ResponseWriter, r *http.Request) {
+	target := r.URL.Query().Get("url")
+	if target == "" {
+		http.Error(w, "missing url parameter", http.StatusBadRequest)
+		return
+	}
+	c, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+	w.Header().Set("Content-Type", ContentTypeJSON)
+	json.NewEncoder(w).Encode(proxy.SelfTest(c, target, nil))
+}
@@ -0,0 +1,91 @@
+package goproxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// selfTestSteps returns the names of the steps of r that succeeded, and of the first one that
+// failed with a ! prefix
+func selfTestSteps(r *SelfTestReport) string {
+	var names []string
+	for _, step := range r.Steps {
+		if step.OK {
+			names = append(names, step.Name)
+		} else {
+			names = append(names, "!"+step.Name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+func TestSelfTestHTTP(t *testing.T) {
+	background := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer background.Close()
+	proxy := NewProxyHttpServer()
+	proxy.OnRequest(UrlHasPrefix("127.0.0.1")).DoFunc(func(r *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response) {
+		if r.URL.Path == "/blocked" {
+			return r, NewResponse(r, ContentTypeText, http.StatusForbidden, "blocked")
+		}
+		return r, nil
+	})
+	proxy.OnRequest().DoFunc(func(r *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response) {
+		ctx.Resolver = StaticResolver{"selftest.invalid": {net.ParseIP("127.0.0.1")}}
+		return r, nil
+	})
+
+	report := proxy.SelfTest(context.Background(), background.URL+"/ok", nil)
+	if !report.OK || selfTestSteps(report) != "request,handlers,upstream,dns,response" ||
+		!strings.HasPrefix(report.Steps[4].Detail, "200 OK") {
+		t.Errorf("unexpected report\n%s", report)
+	}
+
+	report = proxy.SelfTest(context.Background(), background.URL+"/blocked", nil)
+	if report.OK || selfTestSteps(report) != "request,!handlers" || !strings.Contains(report.Steps[1].Detail, "403") {
+		t.Errorf("unexpected report\n%s", report)
+	}
+
+	report = proxy.SelfTest(context.Background(), "http://selftest.invalid/", nil)
+	if report.Steps[3].Name != "dns" || report.Steps[3].Detail != "127.0.0.1" {
+		t.Errorf("unexpected report\n%s", report)
+	}
+
+	report = proxy.SelfTest(context.Background(), "ftp://example.com/", nil)
+	if report.OK || selfTestSteps(report) != "!request" {
+		t.Errorf("unexpected report\n%s", report)
+	}
+}
+
+func TestSelfTestHTTPS(t *testing.T) {
+	background := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer background.Close()
+	proxy := NewProxyHttpServer()
+	tlsConfig := background.Client().Transport.(*http.Transport).TLSClientConfig
+
+	report := proxy.SelfTest(context.Background(), background.URL+"/", tlsConfig)
+	if !report.OK || selfTestSteps(report) != "request,handlers,upstream,dns,dial,tls,response" ||
+		report.Steps[6].Detail != "200 OK" {
+		t.Errorf("unexpected report\n%s", report)
+	}
+
+	// the certificate of the test server is not trusted by default
+	report = proxy.SelfTest(context.Background(), background.URL+"/", nil)
+	if report.OK || selfTestSteps(report) != "request,handlers,upstream,dns,dial,!tls" {
+		t.Errorf("unexpected report\n%s", report)
+	}
+
+	proxy.OnRequest().HandleConnect(AlwaysReject)
+	report = proxy.SelfTest(context.Background(), background.URL+"/", tlsConfig)
+	if report.OK || selfTestSteps(report) != "request,!handlers" {
+		t.Errorf("unexpected report\n%s", report)
+	}
+}
@@ -0,0 +1,146 @@
+package goproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Kinds of the sessions of a SessionInfo
+const (
+	SessionHTTP   = "http"
+	SessionTunnel = "tunnel"
+)
+
+// SessionInfo describes a request or a CONNECT tunnel being served by the proxy
+type SessionInfo struct {
+	ID          int64     `json:"id"`
+	Kind        string    `json:"kind"`
+	Client      string    `json:"client"`
+	Destination string    `json:"destination"`
+	User        string    `json:"user,omitempty"`
+	Started     time.Time `json:"started"`
+
+	// close closes the connections of a tunnel, see CloseTunnels
+	close func()
+}
+
+// sessionShards is the number of shards of a sessionRegistry
+const sessionShards = 64
+
+// sessionRegistry holds the sessions in progress, by ID, in shards so that concurrent
+// sessions seldom contend on the same lock
+type sessionRegistry struct {
+	once   sync.Once
+	shards *[sessionShards]sessionShard
+}
+
+// sessionShard holds the sessions whose ID modulo sessionShards is its index. The counters
+// come first to be 64-bit aligned, and the shard is padded to a cache line.
+type sessionShard struct {
+	requests int64
+	tunnels  int64
+	mu       sync.Mutex
+	sessions map[int64]*SessionInfo
+	_        [32]byte
+}
+
+func (r *sessionRegistry) shard(id int64) *sessionShard {
+	r.once.Do(func() { r.shards = new([sessionShards]sessionShard) })
+	if id < 0 {
+		id = -id
+	}
+	return &r.shards[id%sessionShards]
+}
+
+func (s *sessionShard) counter(kind string) *int64 {
+	if kind == SessionTunnel {
+		return &s.tunnels
+	}
+	return &s.requests
+}
+
+// trackSession registers the session of ctx until the returned function is called
+func (proxy *ProxyHttpServer) trackSession(ctx *ProxyCtx, kind, destination string) func() {
+	info := &SessionInfo{ID: ctx.Session, Kind: kind, Destination: destination, User: ctx.ProxyUser, Started: time.Now()}
+	if ctx.Req != nil {
+		info.Client = ctx.Req.RemoteAddr
+	}
+	s := proxy.sessions.shard(info.ID)
+	atomic.AddInt64(s.counter(kind), 1)
+	s.mu.Lock()
+	if s.sessions == nil {
+		s.sessions = make(map[int64]*SessionInfo)
+	}
+	s.sessions[info.ID] = info
+	s.mu.Unlock()
+	return func() {
+		s.mu.Lock()
+		delete(s.sessions, info.ID)
+		s.mu.Unlock()
+		atomic.AddInt64(s.counter(kind), -1)
+	}
+}
+
+// setSessionCloser sets the function closing the connections of the tunnel of ctx
+func (proxy *ProxyHttpServer) setSessionCloser(ctx *ProxyCtx, close func()) {
+	s := proxy.sessions.shard(ctx.Session)
+	s.mu.Lock()
+	if info, ok := s.sessions[ctx.Session]; ok {
+		info.close = close
+	}
+	s.mu.Unlock()
+}
+
+// CloseTunnels closes the connections of the tunnels in progress, e.g. once they were given
+// some time to end after the proxy stopped accepting new ones, and returns how many it closed
+func (proxy *ProxyHttpServer) CloseTunnels() int {
+	var closers []func()
+	for i := 0; i < sessionShards; i++ {
+		s := proxy.sessions.shard(int64(i))
+		s.mu.Lock()
+		for _, info := range s.sessions {
+			if info.close != nil {
+				closers = append(closers, info.close)
+			}
+		}
+		s.mu.Unlock()
+	}
+	for _, close := range closers {
+		close()
+	}
+	return len(closers)
+}
+
+// ActiveSessions returns the numbers of requests and of tunnels in progress, without locking
+func (proxy *ProxyHttpServer) ActiveSessions() (requests, tunnels int64) {
+	for i := 0; i < sessionShards; i++ {
+		s := proxy.sessions.shard(int64(i))
+		requests += atomic.LoadInt64(&s.requests)
+		tunnels += atomic.LoadInt64(&s.tunnels)
+	}
+	return requests, tunnels
+}
+
+// Sessions returns the requests and tunnels in progress, oldest first
+func (proxy *ProxyHttpServer) Sessions() []SessionInfo {
+	sessions := []SessionInfo{}
+	for i := 0; i < sessionShards; i++ {
+		s := proxy.sessions.shard(int64(i))
+		s.mu.Lock()
+		for _, info := range s.sessions {
+			sessions = append(sessions, *info)
+		}
+		s.mu.Unlock()
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].ID < sessions[j].ID })
+	return sessions
+}
+
+func (proxy *ProxyHttpServer) serveSessions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", ContentTypeJSON)
+	json.NewEncoder(w).Encode(proxy.Sessions())
+}
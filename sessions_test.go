@@ -0,0 +1,48 @@
+package goproxy
+
+import (
+	"sync"
+	"testing"
+	"unsafe"
+)
+
+func TestSessionRegistry(t *testing.T) {
+	if size := unsafe.Sizeof(sessionShard{}); size != 64 {
+		t.Errorf("session shards are %d bytes", size)
+	}
+	proxy := NewProxyHttpServer()
+	var wg sync.WaitGroup
+	done := make(chan func(), 200)
+	for i := 0; i < 200; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			kind := SessionHTTP
+			if i%4 == 0 {
+				kind = SessionTunnel
+			}
+			ctx := &ProxyCtx{Session: int64(i + 1), Proxy: proxy}
+			done <- proxy.trackSession(ctx, kind, "example.com:443")
+		}(i)
+	}
+	wg.Wait()
+	close(done)
+	if requests, tunnels := proxy.ActiveSessions(); requests != 150 || tunnels != 50 {
+		t.Errorf("unexpected counts %d %d", requests, tunnels)
+	}
+	sessions := proxy.Sessions()
+	if len(sessions) != 200 {
+		t.Fatalf("unexpected sessions %d", len(sessions))
+	}
+	for i, s := range sessions {
+		if s.ID != int64(i+1) {
+			t.Fatalf("sessions not sorted: %d at %d", s.ID, i)
+		}
+	}
+	for untrack := range done {
+		untrack()
+	}
+	if requests, tunnels := proxy.ActiveSessions(); requests != 0 || tunnels != 0 || len(proxy.Sessions()) != 0 {
+		t.Errorf("sessions left %d %d %v", requests, tunnels, proxy.Sessions())
+	}
+}
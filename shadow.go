@@ -0,0 +1,128 @@
+package goproxy
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// Shadow registers the handler of pcond in shadow mode: it is evaluated on a copy of the
+// request and of its context, and what it would have done (answer the request, route it
+// elsewhere or rewrite it) is logged and counted in ProxyHttpServer.ShadowMetric, but not
+// enforced. It validates new blocklists, quotas or routing rules against live traffic:
+//
+//	proxy.OnRequest(goproxy.ReqHostMatches(newBlocklist)).Named("blocklist-v2").Shadow().DoFunc(block)
+//
+// Shadow handlers don't see the bodies of the requests, and the side effects of the
+// handlers outside of the request and the context, such as quota consumption by EnforceQuota,
+// are not undone.
+func (pcond *ReqProxyConds) Shadow() *ReqProxyConds {
+	pcond.placement.shadow = true
+	return pcond
+}
+
+// shadowName returns the name of a shadow handler in the logs and metrics
+func shadowName(name string) string {
+	if name == "" {
+		return "unnamed"
+	}
+	return name
+}
+
+// shadowCopy returns copies of r and ctx for the evaluation of a shadow handler
+func shadowCopy(r *http.Request, ctx *ProxyCtx) (*http.Request, *ProxyCtx) {
+	shadow := *ctx
+	shadow.values = ctx.cloneValues()
+	shadow.tags = ctx.Tags()
+	shadow.PolicyDecision = nil
+	shadow.Tail = nil
+	if r == nil {
+		return nil, &shadow
+	}
+	req := r.WithContext(r.Context())
+	req.Header = cloneHeader(r.Header)
+	u := *r.URL
+	req.URL = &u
+	req.Body = http.NoBody
+	shadow.Req = req
+	return req, &shadow
+}
+
+// shadowRoute describes the routing of the request of ctx
+func shadowRoute(ctx *ProxyCtx) string {
+	return ctx.ForwardProxy + "|" + strconv.FormatBool(ctx.ForwardProxyDirect) + "|" + ctx.ForwardProxyProto + "|" + ctx.DNSResolver
+}
+
+// shadowMatched logs and counts what the shadow handler name would have done
+func (proxy *ProxyHttpServer) shadowMatched(ctx, shadow *ProxyCtx, name, outcome string) {
+	if shadow.PolicyDecision != nil {
+		ctx.Warnf("shadow handler %s would have %s %s: policy %s rule %s %s", name, outcome, ctx.Req.URL,
+			shadow.PolicyDecision.Policy, shadow.PolicyDecision.RuleID, shadow.PolicyDecision.Reason)
+	} else {
+		ctx.Warnf("shadow handler %s would have %s %s", name, outcome, ctx.Req.URL)
+	}
+	if proxy.ShadowMetric != nil {
+		proxy.ShadowMetric.WithLabelValues(name, outcome).Inc()
+	}
+}
+
+// shadowReqHandler evaluates h in shadow mode, see ReqProxyConds.Shadow
+func (proxy *ProxyHttpServer) shadowReqHandler(name string, h ReqHandler) ReqHandler {
+	name = shadowName(name)
+	return FuncReqHandler(func(r *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response) {
+		req, shadow := shadowCopy(r, ctx)
+		route := shadowRoute(shadow)
+		url, header := req.URL.String(), cloneHeader(req.Header)
+		req, resp := h.Handle(req, shadow)
+		switch {
+		case resp != nil:
+			if resp.Body != nil {
+				resp.Body.Close()
+			}
+			proxy.shadowMatched(ctx, shadow, name, "answered "+strconv.Itoa(resp.StatusCode))
+		case req == nil:
+			proxy.shadowMatched(ctx, shadow, name, "dropped")
+		case shadowRoute(shadow) != route:
+			proxy.shadowMatched(ctx, shadow, name, "rerouted")
+		case req.URL.String() != url || !headersEqual(req.Header, header):
+			proxy.shadowMatched(ctx, shadow, name, "rewritten")
+		}
+		return r, nil
+	})
+}
+
+// shadowHttpsHandler evaluates h in shadow mode, see ReqProxyConds.Shadow
+func (proxy *ProxyHttpServer) shadowHttpsHandler(name string, h HttpsHandler) HttpsHandler {
+	name = shadowName(name)
+	return FuncHttpsHandler(func(host string, ctx *ProxyCtx) (*ConnectAction, string) {
+		_, shadow := shadowCopy(ctx.Req, ctx)
+		route := shadowRoute(shadow)
+		todo, newHost := h.HandleConnect(host, shadow)
+		switch {
+		case todo != nil && todo.Action == ConnectReject:
+			proxy.shadowMatched(ctx, shadow, name, "rejected")
+		case todo != nil && todo.Action != ConnectAccept:
+			proxy.shadowMatched(ctx, shadow, name, "intercepted")
+		case shadowRoute(shadow) != route || todo != nil && newHost != host:
+			proxy.shadowMatched(ctx, shadow, name, "rerouted")
+		}
+		return nil, ""
+	})
+}
+
+func headersEqual(a, b http.Header) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, va := range a {
+		vb := b[k]
+		if len(va) != len(vb) {
+			return false
+		}
+		for i := range va {
+			if va[i] != vb[i] {
+				return false
+			}
+		}
+	}
+	return true
+}
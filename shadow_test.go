@@ -0,0 +1,58 @@
+package goproxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestShadowHandlers(t *testing.T) {
+	upstream := httptest.NewServer(ConstantHanlder("hello"))
+	defer upstream.Close()
+
+	proxy := NewProxyHttpServer()
+	proxy.ShadowMetric = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "shadow"}, []string{"handler", "outcome"})
+	proxy.OnRequest().Named("blocklist").Shadow().DoFunc(func(r *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response) {
+		return r, ctx.BlockedResponse(http.StatusForbidden, PolicyDecision{Policy: "blocklist", RuleID: "new-1"})
+	})
+	proxy.OnRequest().Named("routing").Shadow().DoFunc(func(r *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response) {
+		ctx.ForwardProxy = "upstream.example.com:3128"
+		r.Header.Set("X-Rewritten", "1")
+		return r, nil
+	})
+	proxy.OnRequest().Named("headers").Shadow().DoFunc(func(r *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response) {
+		r.Header.Set("X-Rewritten", "1")
+		return r, nil
+	})
+	var forwardProxy, rewritten string
+	proxy.OnRequest().DoFunc(func(r *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response) {
+		forwardProxy, rewritten = ctx.ForwardProxy, r.Header.Get("X-Rewritten")
+		return r, nil
+	})
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+	proxyURL, _ := url.Parse(s.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	resp, err := client.Get(upstream.URL)
+	orFatal("GET", err, t)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if string(body) != "hello" || forwardProxy != "" || rewritten != "" {
+		t.Errorf("shadow handlers were enforced: %q, forward proxy %q, header %q", body, forwardProxy, rewritten)
+	}
+	for _, c := range []struct{ handler, outcome string }{
+		{"blocklist", "answered 403"},
+		{"routing", "rerouted"},
+		{"headers", "rewritten"},
+	} {
+		if n := testutil.ToFloat64(proxy.ShadowMetric.WithLabelValues(c.handler, c.outcome)); n != 1 {
+			t.Errorf("expected %s to have %s once, got %v", c.handler, c.outcome, n)
+		}
+	}
+}
@@ -0,0 +1,277 @@
+package goproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// SLOObjective is a service level objective of the plain and mitm'd HTTP requests of a route
+// or of a tenant. A request is bad when it failed, was answered with a 5xx status, or took
+// longer than Latency to the first byte of its response; it is good otherwise.
+type SLOObjective struct {
+	// Name identifies the objective in the metrics and the alerts
+	Name string
+	// Tenant, if set, restricts the objective to the requests of the tenant of that name
+	Tenant string
+	// Conditions, if set, restrict the objective to the requests matching all of them, e.g.
+	// ReqHostIs or UrlHasPrefix
+	Conditions []ReqCondition
+	// Target is the ratio of good requests aimed at, e.g. 0.999
+	Target float64
+	// Latency, if set, makes the requests slower than Latency to their first byte bad
+	Latency time.Duration
+}
+
+// BurnRateAlert fires when the error budget of an objective, the ratio of bad requests its
+// Target allows, burns at least BurnRate times faster than the rate that would exhaust it
+// exactly, over both the Long and the Short window. The Short window stops the alert soon
+// after the burn stops.
+type BurnRateAlert struct {
+	Long     time.Duration
+	Short    time.Duration
+	BurnRate float64
+}
+
+// defaultBurnRateAlerts page on 2% of a 30 days budget burnt in an hour, and on 5% in 6 hours
+var defaultBurnRateAlerts = []BurnRateAlert{
+	{Long: time.Hour, Short: 5 * time.Minute, BurnRate: 14.4},
+	{Long: 6 * time.Hour, Short: 30 * time.Minute, BurnRate: 6},
+}
+
+// SLOTracker computes the rolling ratios of good requests and the burn rates of its
+// objectives inside the proxy. Each firing BurnRateAlert sends an EventSLOBurnRate, e.g. to a
+// WebhookNotifier, once until it stops firing. The ratios and burn rates are evaluated once
+// per Resolution at most.
+type SLOTracker struct {
+	Objectives []*SLOObjective
+	// Alerts are the burn rate alerts of every objective, a fast and a slow one if empty
+	Alerts []BurnRateAlert
+	// Resolution is the granularity of the windows, a minute if zero
+	Resolution time.Duration
+	// Metric, if set, is set to the ratio of good requests over the longest window and to the
+	// burn rate over each window, labeled with the objective and "ratio" or "burn_rate_<window>"
+	Metric *prometheus.GaugeVec
+
+	mu     sync.Mutex
+	series map[string]*sloSeries
+}
+
+// SLOStatus is the state of an SLOObjective
+type SLOStatus struct {
+	Name   string  `json:"name"`
+	Target float64 `json:"target"`
+	// Ratio is the ratio of good requests over the longest window, 1 without requests
+	Ratio float64 `json:"ratio"`
+	// BurnRates are the burn rates over each window of the alerts
+	BurnRates map[string]float64 `json:"burn_rates"`
+	// Firing are the long windows of the alerts firing
+	Firing []string `json:"firing,omitempty"`
+}
+
+// sloBucket counts the requests of an objective during a slot of Resolution
+type sloBucket struct {
+	slot        int64
+	good, total int64
+}
+
+// sloSeries is the ring of the buckets of an objective, covering its longest window
+type sloSeries struct {
+	buckets   []sloBucket
+	evaluated int64
+	firing    map[time.Duration]bool
+}
+
+func (t *SLOTracker) resolution() time.Duration {
+	if t.Resolution <= 0 {
+		return time.Minute
+	}
+	return t.Resolution
+}
+
+func (t *SLOTracker) alerts() []BurnRateAlert {
+	if len(t.Alerts) == 0 {
+		return defaultBurnRateAlerts
+	}
+	return t.Alerts
+}
+
+// longest returns the longest window of the alerts
+func (t *SLOTracker) longest() time.Duration {
+	var max time.Duration
+	for _, a := range t.alerts() {
+		if a.Long > max {
+			max = a.Long
+		}
+		if a.Short > max {
+			max = a.Short
+		}
+	}
+	return max
+}
+
+// matches reports whether the request of ctx counts for o
+func (o *SLOObjective) matches(ctx *ProxyCtx) bool {
+	if o.Tenant != "" {
+		if tenant := ctx.Tenant(); tenant == nil || tenant.Name != o.Tenant {
+			return false
+		}
+	}
+	for _, cond := range o.Conditions {
+		if !cond.HandleReq(ctx.Req, ctx) {
+			return false
+		}
+	}
+	return true
+}
+
+// observe counts the request of ctx, answered with status, for the objectives it matches
+func (t *SLOTracker) observe(ctx *ProxyCtx, status int) {
+	if t == nil || ctx.Req == nil {
+		return
+	}
+	now := time.Now()
+	for _, o := range t.Objectives {
+		if !o.matches(ctx) {
+			continue
+		}
+		good := status < 500 && (o.Latency <= 0 || ctx.FirstByte <= o.Latency)
+		t.record(ctx.Proxy, o, now, good)
+	}
+}
+
+// record counts a request of o at now, and evaluates o once per Resolution
+func (t *SLOTracker) record(proxy *ProxyHttpServer, o *SLOObjective, now time.Time, good bool) {
+	res := t.resolution()
+	slot := now.UnixNano() / int64(res)
+	t.mu.Lock()
+	if t.series == nil {
+		t.series = make(map[string]*sloSeries)
+	}
+	s := t.series[o.Name]
+	if s == nil {
+		s = &sloSeries{buckets: make([]sloBucket, int(t.longest()/res)+1), firing: make(map[time.Duration]bool)}
+		t.series[o.Name] = s
+	}
+	b := &s.buckets[slot%int64(len(s.buckets))]
+	if b.slot != slot {
+		*b = sloBucket{slot: slot}
+	}
+	b.total++
+	if good {
+		b.good++
+	}
+	var status *SLOStatus
+	var fired []BurnRateAlert
+	if s.evaluated != slot {
+		s.evaluated = slot
+		status, fired = t.evaluate(o, s, slot)
+	}
+	t.mu.Unlock()
+
+	if status == nil {
+		return
+	}
+	if t.Metric != nil {
+		t.Metric.WithLabelValues(o.Name, "ratio").Set(status.Ratio)
+		for window, rate := range status.BurnRates {
+			t.Metric.WithLabelValues(o.Name, "burn_rate_"+window).Set(rate)
+		}
+	}
+	for _, a := range fired {
+		e := NewEvent(EventSLOBurnRate, o.Name, fmt.Sprintf("error budget burning %.1f times too fast over %v",
+			status.BurnRates[a.Long.String()], a.Long))
+		e.Fields = map[string]string{
+			"target":    strconv.FormatFloat(o.Target, 'f', -1, 64),
+			"ratio":     strconv.FormatFloat(status.Ratio, 'f', 6, 64),
+			"long":      strconv.FormatFloat(status.BurnRates[a.Long.String()], 'f', 2, 64),
+			"short":     strconv.FormatFloat(status.BurnRates[a.Short.String()], 'f', 2, 64),
+			"threshold": strconv.FormatFloat(a.BurnRate, 'f', -1, 64),
+		}
+		proxy.notify(e)
+	}
+}
+
+// evaluate returns the status of o at slot, and the alerts that started firing. t.mu is held.
+func (t *SLOTracker) evaluate(o *SLOObjective, s *sloSeries, slot int64) (*SLOStatus, []BurnRateAlert) {
+	res := t.resolution()
+	burnRate := func(window time.Duration) float64 {
+		good, total := s.count(slot, window, res)
+		if total == 0 || o.Target >= 1 {
+			return 0
+		}
+		return (1 - float64(good)/float64(total)) / (1 - o.Target)
+	}
+	status := &SLOStatus{Name: o.Name, Target: o.Target, Ratio: 1, BurnRates: make(map[string]float64)}
+	if good, total := s.count(slot, t.longest(), res); total > 0 {
+		status.Ratio = float64(good) / float64(total)
+	}
+	var fired []BurnRateAlert
+	for _, a := range t.alerts() {
+		long, short := burnRate(a.Long), burnRate(a.Short)
+		status.BurnRates[a.Long.String()] = long
+		status.BurnRates[a.Short.String()] = short
+		firing := long >= a.BurnRate && short >= a.BurnRate
+		if firing {
+			status.Firing = append(status.Firing, a.Long.String())
+			if !s.firing[a.Long] {
+				fired = append(fired, a)
+			}
+		}
+		s.firing[a.Long] = firing
+	}
+	return status, fired
+}
+
+// count returns the good and total requests of the window ending at slot
+func (s *sloSeries) count(slot int64, window, res time.Duration) (good, total int64) {
+	n := int64(window / res)
+	if n < 1 {
+		n = 1
+	}
+	for _, b := range s.buckets {
+		if b.slot > slot-n && b.slot <= slot {
+			good += b.good
+			total += b.total
+		}
+	}
+	return good, total
+}
+
+// Status returns the current state of the objectives, sorted by name
+func (t *SLOTracker) Status() []SLOStatus {
+	slot := time.Now().UnixNano() / int64(t.resolution())
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	statuses := []SLOStatus{}
+	for _, o := range t.Objectives {
+		s := t.series[o.Name]
+		if s == nil {
+			s = &sloSeries{firing: make(map[time.Duration]bool)}
+		}
+		// the firing state is only updated by the requests
+		firing := s.firing
+		s.firing = make(map[time.Duration]bool)
+		status, _ := t.evaluate(o, s, slot)
+		s.firing = firing
+		statuses = append(statuses, *status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
+
+// serveSLO serves the status of the objectives on the admin API
+func (proxy *ProxyHttpServer) serveSLO(w http.ResponseWriter, r *http.Request) {
+	if proxy.SLO == nil {
+		http.Error(w, "SLO tracking is not enabled", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", ContentTypeJSON)
+	json.NewEncoder(w).Encode(proxy.SLO.Status())
+}
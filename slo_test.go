@@ -0,0 +1,79 @@
+package goproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSLOBurnRate(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer backend.Close()
+
+	var mu sync.Mutex
+	var events []Event
+	metric := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "slo"}, []string{"objective", "value"})
+	proxy := NewProxyHttpServer()
+	proxy.Notifier = notifierFunc(func(e Event) {
+		mu.Lock()
+		events = append(events, e)
+		mu.Unlock()
+	})
+	proxy.SLO = &SLOTracker{
+		Objectives: []*SLOObjective{{Name: "api", Target: 0.9}},
+		Alerts:     []BurnRateAlert{{Long: time.Hour, Short: time.Hour, BurnRate: 2}},
+		Resolution: time.Hour,
+		Metric:     metric,
+	}
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+	proxyURL, _ := url.Parse(s.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	for _, path := range []string{"/fail", "/ok", "/fail"} {
+		resp, err := client.Get(backend.URL + path)
+		orFatal("Get", err, t)
+		resp.Body.Close()
+	}
+
+	// Status counts all the requests of the slot
+	status := proxy.SLO.Status()
+	if len(status) != 1 || status[0].Ratio < 0.33 || status[0].Ratio > 0.34 {
+		t.Fatalf("unexpected status %+v", status)
+	}
+	if rate := status[0].BurnRates["1h0m0s"]; rate < 6.6 || rate > 6.7 {
+		t.Errorf("expected a burn rate of 6.67, got %v", rate)
+	}
+	if len(status[0].Firing) != 1 {
+		t.Errorf("expected the alert firing, got %v", status[0].Firing)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(events) != 1 || events[0].Type != EventSLOBurnRate || events[0].Subject != "api" {
+		t.Errorf("expected a single burn rate alert, got %+v", events)
+	}
+	// the metric was set when the first request of the slot was evaluated
+	if rate := testutil.ToFloat64(metric.WithLabelValues("api", "burn_rate_1h0m0s")); rate < 9.9 || rate > 10.1 {
+		t.Errorf("expected the burn rate of the first request in the metric, got %v", rate)
+	}
+}
+
+func TestSLOObjectiveMatches(t *testing.T) {
+	o := &SLOObjective{Name: "api", Conditions: []ReqCondition{UrlHasPrefix("api.example.com/v1")}}
+	for u, expected := range map[string]bool{"http://api.example.com/v1/users": true, "http://api.example.com/v2": false} {
+		req, _ := http.NewRequest("GET", u, nil)
+		if o.matches(&ProxyCtx{Req: req}) != expected {
+			t.Errorf("%s: expected match %v", u, expected)
+		}
+	}
+}
@@ -0,0 +1,294 @@
+package goproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ConfigSnapshot is the effective configuration of a proxy, as generic values that encode to
+// JSON or YAML, see ProxyHttpServer.ConfigSnapshot
+type ConfigSnapshot map[string]interface{}
+
+// redacted replaces the values of secrets in a ConfigSnapshot
+const redacted = "[REDACTED]"
+
+// secretField matches the names of the fields holding secrets
+var secretField = regexp.MustCompile(`(?i)(password|secret|token|credential|auth$|privatekey)`)
+
+// secretHeaders are the headers whose values are redacted
+var secretHeaders = map[string]bool{"Authorization": true, "Proxy-Authorization": true, "Cookie": true, "X-Api-Key": true}
+
+var (
+	durationType  = reflect.TypeOf(time.Duration(0))
+	timeType      = reflect.TypeOf(time.Time{})
+	regexpType    = reflect.TypeOf(&regexp.Regexp{})
+	headerType    = reflect.TypeOf(http.Header{})
+	transportType = reflect.TypeOf(&http.Transport{})
+	packagePath   = reflect.TypeOf(ProxyHttpServer{}).PkgPath()
+)
+
+// ConfigSnapshot returns the effective configuration of the proxy: its exported settings with
+// the defaults of the unset ones resolved, its handler chains and its debug flags. Secrets
+// (passwords, tokens, auth fields, credentials in URLs and authorization headers) are
+// redacted. Functions are omitted, and the values of types from other packages are
+// reported by type. Comparing snapshots detects drift between instances, or after reloads.
+func (proxy *ProxyHttpServer) ConfigSnapshot() ConfigSnapshot {
+	s := snapshotValue(reflect.ValueOf(proxy).Elem(), 0).(map[string]interface{})
+	s["MaxCacheObjectSize"] = proxy.maxCacheObjectSize()
+	if s["DialBudget"] == nil {
+		s["DialBudget"] = snapshotValue(reflect.ValueOf(defaultDialBudget), 1)
+	}
+	if budget := s["DialBudget"].(map[string]interface{}); budget["Attempts"] == 0 {
+		budget["Attempts"] = 3
+	}
+	s["Normalizer"] = snapshotValue(reflect.ValueOf(proxy.normalizer()), 1)
+	if proxy.InternalEndpoints != nil {
+		s["InternalEndpoints"].(map[string]interface{})["Host"] = proxy.InternalEndpoints.host()
+	}
+	s["Handlers"] = snapshotValue(reflect.ValueOf(proxy.Handlers()), 1)
+	s["Debug"] = proxy.Debug().String()
+	return ConfigSnapshot(s)
+}
+
+// snapshotValue returns v as generic values, nil for the values that are omitted
+func snapshotValue(v reflect.Value, depth int) interface{} {
+	if depth > 8 {
+		return v.Type().String()
+	}
+	switch v.Type() {
+	case durationType:
+		return time.Duration(v.Int()).String()
+	case timeType:
+		return v.Interface().(time.Time).Format(time.RFC3339)
+	case regexpType:
+		if v.IsNil() {
+			return nil
+		}
+		return v.Interface().(*regexp.Regexp).String()
+	case headerType:
+		h := make(map[string]interface{}, v.Len())
+		for k, vs := range v.Interface().(http.Header) {
+			if secretHeaders[http.CanonicalHeaderKey(k)] {
+				h[k] = redacted
+			} else {
+				h[k] = vs
+			}
+		}
+		return h
+	case transportType:
+		if v.IsNil() {
+			return nil
+		}
+		tr := v.Interface().(*http.Transport)
+		return map[string]interface{}{
+			"DisableKeepAlives":     tr.DisableKeepAlives,
+			"MaxIdleConns":          tr.MaxIdleConns,
+			"MaxIdleConnsPerHost":   tr.MaxIdleConnsPerHost,
+			"MaxConnsPerHost":       tr.MaxConnsPerHost,
+			"IdleConnTimeout":       tr.IdleConnTimeout.String(),
+			"TLSHandshakeTimeout":   tr.TLSHandshakeTimeout.String(),
+			"ResponseHeaderTimeout": tr.ResponseHeaderTimeout.String(),
+			"ExpectContinueTimeout": tr.ExpectContinueTimeout.String(),
+			"Proxy":                 tr.Proxy != nil,
+		}
+	}
+	switch v.Kind() {
+	case reflect.Func, reflect.Chan, reflect.UnsafePointer:
+		return nil
+	case reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return snapshotValue(v.Elem(), depth+1)
+	case reflect.Ptr:
+		if v.IsNil() {
+			return nil
+		}
+		if v.Elem().Kind() != reflect.Struct || v.Elem().Type().PkgPath() == packagePath {
+			return snapshotValue(v.Elem(), depth+1)
+		}
+		return v.Type().String()
+	case reflect.Struct:
+		if v.Type().PkgPath() != packagePath {
+			return v.Type().String()
+		}
+		m := make(map[string]interface{})
+		for i := 0; i < v.NumField(); i++ {
+			f := v.Type().Field(i)
+			if f.PkgPath != "" {
+				continue
+			}
+			value := snapshotValue(v.Field(i), depth+1)
+			if value == nil && (f.Type.Kind() == reflect.Func || f.Type.Kind() == reflect.Chan) {
+				continue
+			}
+			if secretField.MatchString(f.Name) && !reflect.DeepEqual(v.Field(i).Interface(), reflect.Zero(f.Type).Interface()) {
+				value = redacted
+			}
+			m[f.Name] = value
+		}
+		return m
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return fmt.Sprintf("%d bytes", v.Len())
+		}
+		values := make([]interface{}, v.Len())
+		for i := range values {
+			values[i] = snapshotValue(v.Index(i), depth+1)
+		}
+		return values
+	case reflect.Map:
+		if v.IsNil() {
+			return nil
+		}
+		m := make(map[string]interface{}, v.Len())
+		for _, k := range v.MapKeys() {
+			m[fmt.Sprint(k.Interface())] = snapshotValue(v.MapIndex(k), depth+1)
+		}
+		return m
+	case reflect.String:
+		return redactURL(v.String())
+	}
+	return v.Interface()
+}
+
+// redactURL redacts the password of s if it is a URL with credentials
+func redactURL(s string) string {
+	if !strings.Contains(s, "@") {
+		return s
+	}
+	u, err := url.Parse(s)
+	if err != nil || u.User == nil {
+		return s
+	}
+	if _, ok := u.User.Password(); ok {
+		// brackets would be escaped in the user info
+		u.User = url.UserPassword(u.User.Username(), "REDACTED")
+		return strings.Replace(u.String(), ":REDACTED@", ":"+redacted+"@", 1)
+	}
+	return s
+}
+
+// JSON encodes the snapshot in indented JSON
+func (s ConfigSnapshot) JSON() ([]byte, error) {
+	return json.MarshalIndent(s, "", "  ")
+}
+
+// YAML encodes the snapshot in YAML, with sorted keys
+func (s ConfigSnapshot) YAML() []byte {
+	var buf bytes.Buffer
+	writeYAML(&buf, map[string]interface{}(s), 0)
+	return buf.Bytes()
+}
+
+func writeYAML(buf *bytes.Buffer, v interface{}, indent int) {
+	pad := strings.Repeat("  ", indent)
+	switch v := v.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			buf.WriteString(pad + yamlKey(k) + ":")
+			writeYAMLValue(buf, v[k], indent)
+		}
+	case []interface{}:
+		for _, e := range v {
+			if m, ok := e.(map[string]interface{}); ok && len(m) > 0 {
+				// the first key of a map goes on the line of its dash
+				var item bytes.Buffer
+				writeYAML(&item, m, indent+1)
+				buf.WriteString(pad + "- " + strings.TrimPrefix(item.String(), pad+"  "))
+				continue
+			}
+			buf.WriteString(pad + "-")
+			writeYAMLValue(buf, e, indent)
+		}
+	}
+}
+
+// writeYAMLValue writes v after a key or a list dash
+func writeYAMLValue(buf *bytes.Buffer, v interface{}, indent int) {
+	switch e := v.(type) {
+	case map[string]interface{}:
+		if len(e) == 0 {
+			buf.WriteString(" {}\n")
+			return
+		}
+		buf.WriteString("\n")
+		writeYAML(buf, e, indent+1)
+	case []interface{}:
+		if len(e) == 0 {
+			buf.WriteString(" []\n")
+			return
+		}
+		buf.WriteString("\n")
+		writeYAML(buf, e, indent+1)
+	case []string:
+		values := make([]interface{}, len(e))
+		for i, s := range e {
+			values[i] = s
+		}
+		writeYAMLValue(buf, values, indent)
+	default:
+		buf.WriteString(" " + yamlScalar(v) + "\n")
+	}
+}
+
+// plainKey matches the keys written without quotes
+var plainKey = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.-]*$`)
+
+func yamlKey(k string) string {
+	if plainKey.MatchString(k) && k != "null" && k != "true" && k != "false" {
+		return k
+	}
+	return yamlScalar(k)
+}
+
+func yamlScalar(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case string:
+		// JSON strings are valid YAML double quoted scalars
+		b, _ := json.Marshal(v)
+		return string(b)
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return strconv.Quote(fmt.Sprint(v))
+	}
+	return string(b)
+}
+
+func (proxy *ProxyHttpServer) serveConfig(w http.ResponseWriter, r *http.Request) {
+	s := proxy.ConfigSnapshot()
+	if r.URL.Query().Get("format") == "yaml" || strings.Contains(r.Header.Get("Accept"), "yaml") {
+		w.Header().Set("Content-Type", "application/yaml")
+		w.Write(s.YAML())
+		return
+	}
+	b, err := s.JSON()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", ContentTypeJSON)
+	w.Write(b)
+}
@@ -0,0 +1,53 @@
+package goproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"sync"
+)
+
+// Capabilities reports the socket options and features of the proxy available on the platform
+// it runs on. The settings relying on a missing one are ignored, or fail for the listeners.
+type Capabilities struct {
+	// OS is the operating system the proxy runs on
+	OS string `json:"os"`
+	// KeepAliveProbes is whether the count and interval of the keep-alive probes are set, see
+	// ProxyTCPConn.SetKeepaliveParameters, otherwise only the keep-alive period is
+	KeepAliveProbes bool `json:"keepalive_probes"`
+	// UserTimeout is whether the connections whose data stays unacknowledged are closed once
+	// the keep-alive probes would have failed
+	UserTimeout bool `json:"user_timeout"`
+	// BindNoPort is whether the connections dialed from a source IP without a port range, see
+	// SourcePortAllocator, share their local ports across destinations
+	BindNoPort bool `json:"bind_no_port"`
+	// ReusePort is whether ListenReusePort is available
+	ReusePort bool `json:"reuse_port"`
+	// Transparent is whether the process may set IP_TRANSPARENT, to accept the connections
+	// redirected by TPROXY rules
+	Transparent bool `json:"transparent"`
+	// EpollTunnels is whether the tunnels can be relayed with TunnelEngineEpoll
+	EpollTunnels bool `json:"epoll_tunnels"`
+	// Handover is whether the listeners can be handed over with ServeHandover
+	Handover bool `json:"handover"`
+}
+
+var (
+	capabilitiesOnce sync.Once
+	capabilities     Capabilities
+)
+
+// Capabilities returns the socket options and features available to the proxy, probed on a
+// socket the first time it is called
+func (proxy *ProxyHttpServer) Capabilities() Capabilities {
+	capabilitiesOnce.Do(func() {
+		capabilities = probeCapabilities()
+		capabilities.OS = runtime.GOOS
+	})
+	return capabilities
+}
+
+func (proxy *ProxyHttpServer) serveCapabilities(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", ContentTypeJSON)
+	json.NewEncoder(w).Encode(proxy.Capabilities())
+}
@@ -0,0 +1,77 @@
+package goproxy
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// setKeepaliveProbes sets the count and interval of the keep-alive probes of the socket fd,
+// and the retransmission timeout closing it when its data stays unacknowledged, in seconds
+func setKeepaliveProbes(fd uintptr, count, interval int, userTimeout time.Duration, warnf func(string, ...interface{})) {
+	if err := unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_KEEPCNT, count); err != nil {
+		warnf("on setting keepalive probe count: %s", err.Error())
+	}
+	if err := unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_KEEPINTVL, interval); err != nil {
+		warnf("on setting keepalive retry interval: %s", err.Error())
+	}
+	s := int((userTimeout + time.Second - 1) / time.Second)
+	if err := unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_RXT_CONNDROPTIME, s); err != nil {
+		warnf("on setting retransmission timeout to %v: %s", s, err.Error())
+	}
+}
+
+// transparentTCPConn returns nil, there are no transparent listeners on this platform
+func transparentTCPConn(conn net.Conn) (*net.TCPConn, bool) {
+	return nil, false
+}
+
+func setReuseAddr(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// setBindNoPort only sets SO_REUSEADDR, the local port is picked at bind time
+func setBindNoPort(network, address string, c syscall.RawConn) error {
+	return setReuseAddr(network, address, c)
+}
+
+func setReusePort(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// isPortTaken reports whether err is the failure to use a local port already in use: bound
+// by another socket, or, as SO_REUSEADDR lets the bind succeed, connected to the same
+// destination, which fails at connect with EADDRNOTAVAIL
+func isPortTaken(err error) bool {
+	return errors.Is(err, syscall.EADDRINUSE) || errors.Is(err, syscall.EADDRNOTAVAIL)
+}
+
+func probeCapabilities() Capabilities {
+	caps := Capabilities{Handover: true}
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM, 0)
+	if err != nil {
+		return caps
+	}
+	defer unix.Close(fd)
+	caps.KeepAliveProbes = unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_KEEPCNT, 8) == nil
+	caps.UserTimeout = unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_RXT_CONNDROPTIME, 0) == nil
+	caps.ReusePort = unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_REUSEPORT, 1) == nil
+	return caps
+}
@@ -0,0 +1,93 @@
+package goproxy
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"time"
+
+	tproxy "github.com/Windscribe/go-tproxy"
+	"golang.org/x/sys/unix"
+)
+
+// setKeepaliveProbes sets the count and interval of the keep-alive probes of the socket fd,
+// and the user timeout closing it when its data stays unacknowledged
+func setKeepaliveProbes(fd uintptr, count, interval int, userTimeout time.Duration, warnf func(string, ...interface{})) {
+	if err := unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_KEEPCNT, count); err != nil {
+		warnf("on setting keepalive probe count: %s", err.Error())
+	}
+	if err := unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_KEEPINTVL, interval); err != nil {
+		warnf("on setting keepalive retry interval: %s", err.Error())
+	}
+	ms := int(userTimeout / time.Millisecond)
+	if err := unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_USER_TIMEOUT, ms); err != nil {
+		warnf("on setting user timeout to %v: %s", ms, err.Error())
+	}
+}
+
+// transparentTCPConn returns the TCP connection of conn if it was accepted by a transparent
+// listener
+func transparentTCPConn(conn net.Conn) (*net.TCPConn, bool) {
+	if c, ok := conn.(*tproxy.Conn); ok {
+		return c.TCPConn, true
+	}
+	return nil, false
+}
+
+func setReuseAddr(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+func setBindNoPort(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1)
+		// best effort, older kernels pick the port at bind time
+		unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_BIND_ADDRESS_NO_PORT, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+func setReusePort(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// isPortTaken reports whether err is the failure to use a local port already in use: bound
+// by another socket, or, as SO_REUSEADDR lets the bind succeed, connected to the same
+// destination, which fails at connect with EADDRNOTAVAIL
+func isPortTaken(err error) bool {
+	return errors.Is(err, syscall.EADDRINUSE) || errors.Is(err, syscall.EADDRNOTAVAIL)
+}
+
+func probeCapabilities() Capabilities {
+	caps := Capabilities{EpollTunnels: true, Handover: true}
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM, 0)
+	if err != nil {
+		return caps
+	}
+	defer unix.Close(fd)
+	caps.KeepAliveProbes = unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_KEEPCNT, 9) == nil
+	caps.UserTimeout = unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_USER_TIMEOUT, 0) == nil
+	caps.BindNoPort = unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_BIND_ADDRESS_NO_PORT, 1) == nil
+	caps.ReusePort = unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_REUSEPORT, 1) == nil
+	// requires CAP_NET_ADMIN
+	caps.Transparent = unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_TRANSPARENT, 1) == nil
+	return caps
+}
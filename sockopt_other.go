@@ -0,0 +1,51 @@
+//go:build !linux && !darwin && !windows
+// +build !linux,!darwin,!windows
+
+package goproxy
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"time"
+)
+
+// setKeepaliveProbes does nothing, only the keep-alive period is set on this platform
+func setKeepaliveProbes(fd uintptr, count, interval int, userTimeout time.Duration, warnf func(string, ...interface{})) {
+}
+
+// transparentTCPConn returns nil, there are no transparent listeners on this platform
+func transparentTCPConn(conn net.Conn) (*net.TCPConn, bool) {
+	return nil, false
+}
+
+func setReuseAddr(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// setBindNoPort only sets SO_REUSEADDR, the local port is picked at bind time
+func setBindNoPort(network, address string, c syscall.RawConn) error {
+	return setReuseAddr(network, address, c)
+}
+
+func setReusePort(network, address string, c syscall.RawConn) error {
+	return errors.New("SO_REUSEPORT is not supported on this platform")
+}
+
+// isPortTaken reports whether err is the failure to use a local port already in use: bound
+// by another socket, or, as SO_REUSEADDR lets the bind succeed, connected to the same
+// destination, which fails at connect with EADDRNOTAVAIL
+func isPortTaken(err error) bool {
+	return errors.Is(err, syscall.EADDRINUSE) || errors.Is(err, syscall.EADDRNOTAVAIL)
+}
+
+func probeCapabilities() Capabilities {
+	return Capabilities{Handover: true}
+}
@@ -0,0 +1,36 @@
+package goproxy
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+)
+
+func TestCapabilities(t *testing.T) {
+	proxy := NewProxyHttpServer()
+	caps := proxy.Capabilities()
+	if caps.OS != runtime.GOOS {
+		t.Errorf("unexpected OS %q", caps.OS)
+	}
+	if runtime.GOOS == "linux" && (!caps.EpollTunnels || !caps.KeepAliveProbes || !caps.ReusePort) {
+		t.Errorf("expected the Linux socket options, got %+v", caps)
+	}
+
+	rec := httptest.NewRecorder()
+	proxy.AdminHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/capabilities", nil))
+	var served Capabilities
+	orFatal("Unmarshal", json.Unmarshal(rec.Body.Bytes(), &served), t)
+	if served != caps {
+		t.Errorf("unexpected capabilities %+v", served)
+	}
+
+	if caps.ReusePort {
+		l, err := ListenReusePort("tcp", "127.0.0.1:0")
+		orFatal("ListenReusePort", err, t)
+		defer l.Close()
+		l2, err := ListenReusePort("tcp", l.Addr().String())
+		orFatal("ListenReusePort", err, t)
+		l2.Close()
+	}
+}
@@ -0,0 +1,79 @@
+package goproxy
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/windows"
+)
+
+// The socket options of Windows 10 1709 and later, missing from x/sys/windows
+const (
+	tcpMaxRT           = 5
+	tcpKeepCnt         = 16
+	tcpKeepIntvl       = 17
+	soReuseUnicastPort = 0x3007
+)
+
+// setKeepaliveProbes sets the count and interval of the keep-alive probes of the socket fd,
+// and the retransmission timeout closing it when its data stays unacknowledged, in seconds.
+// The interval must be set after the keep-alive period, which overrides it.
+func setKeepaliveProbes(fd uintptr, count, interval int, userTimeout time.Duration, warnf func(string, ...interface{})) {
+	h := windows.Handle(fd)
+	if err := windows.SetsockoptInt(h, windows.IPPROTO_TCP, tcpKeepCnt, count); err != nil {
+		warnf("on setting keepalive probe count: %s", err.Error())
+	}
+	if err := windows.SetsockoptInt(h, windows.IPPROTO_TCP, tcpKeepIntvl, interval); err != nil {
+		warnf("on setting keepalive retry interval: %s", err.Error())
+	}
+	s := int((userTimeout + time.Second - 1) / time.Second)
+	if err := windows.SetsockoptInt(h, windows.IPPROTO_TCP, tcpMaxRT, s); err != nil {
+		warnf("on setting retransmission timeout to %v: %s", s, err.Error())
+	}
+}
+
+// transparentTCPConn returns nil, there are no transparent listeners on this platform
+func transparentTCPConn(conn net.Conn) (*net.TCPConn, bool) {
+	return nil, false
+}
+
+// setReuseAddr does nothing, SO_REUSEADDR lets another socket steal the port on Windows, and
+// the ports in TIME_WAIT can be bound again anyway
+func setReuseAddr(network, address string, c syscall.RawConn) error {
+	return nil
+}
+
+// setBindNoPort sets SO_REUSE_UNICASTPORT, the equivalent of IP_BIND_ADDRESS_NO_PORT
+func setBindNoPort(network, address string, c syscall.RawConn) error {
+	return c.Control(func(fd uintptr) {
+		// best effort, older versions pick the port at bind time
+		windows.SetsockoptInt(windows.Handle(fd), windows.SOL_SOCKET, soReuseUnicastPort, 1)
+	})
+}
+
+func setReusePort(network, address string, c syscall.RawConn) error {
+	return errors.New("SO_REUSEPORT is not available on windows")
+}
+
+// isPortTaken reports whether err is the failure to use a local port already in use: bound
+// by another socket, or, as SO_REUSEADDR lets the bind succeed, connected to the same
+// destination, which fails at connect with EADDRNOTAVAIL
+func isPortTaken(err error) bool {
+	return errors.Is(err, windows.WSAEADDRINUSE) || errors.Is(err, syscall.EADDRINUSE) ||
+		errors.Is(err, windows.WSAEADDRNOTAVAIL) || errors.Is(err, syscall.EADDRNOTAVAIL)
+}
+
+func probeCapabilities() Capabilities {
+	var caps Capabilities
+	h, err := windows.Socket(windows.AF_INET, windows.SOCK_STREAM, windows.IPPROTO_TCP)
+	if err != nil {
+		return caps
+	}
+	defer windows.Closesocket(h)
+	caps.KeepAliveProbes = windows.SetsockoptInt(h, windows.IPPROTO_TCP, tcpKeepCnt, 10) == nil
+	caps.UserTimeout = windows.SetsockoptInt(h, windows.IPPROTO_TCP, tcpMaxRT, 0) == nil
+	caps.BindNoPort = windows.SetsockoptInt(h, windows.SOL_SOCKET, soReuseUnicastPort, 1) == nil
+	return caps
+}
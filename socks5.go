@@ -0,0 +1,243 @@
+package goproxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The SOCKS5 reply codes, see RFC 1928
+var socks5Replies = map[byte]string{
+	0x01: "general SOCKS server failure",
+	0x02: "connection not allowed by ruleset",
+	0x03: "network unreachable",
+	0x04: "host unreachable",
+	0x05: "connection refused",
+	0x06: "TTL expired",
+	0x07: "command not supported",
+	0x08: "address type not supported",
+}
+
+// forwardProxySOCKS reports whether the forward proxy of ctx is a SOCKS5 proxy
+func (ctx *ProxyCtx) forwardProxySOCKS() bool {
+	return ctx.ForwardProxy != "" && (ctx.ForwardProxyProto == "socks5" || ctx.ForwardProxyProto == "socks5h")
+}
+
+// socks5Refusal returns the UpstreamConnectError reporting the refusal of a SOCKS5 proxy, with
+// the status of the equivalent refusal of an HTTP proxy
+func socks5Refusal(status int, reason string) *UpstreamConnectError {
+	return &UpstreamConnectError{
+		StatusCode: status,
+		Status:     strconv.Itoa(status) + " " + http.StatusText(status),
+		Header:     http.Header{"Content-Type": {ContentTypeText}},
+		Body:       []byte(reason),
+	}
+}
+
+// newSOCKS5Dial returns the dialer of the connections to addr through the SOCKS5 proxy u. With
+// the "socks5" scheme the destinations are resolved by the resolvers of ctx, with "socks5h"
+// by the SOCKS5 proxy. ForwardProxyAuth, the base64 encoded user:password, is sent with the
+// username/password method if set.
+func (proxy *ProxyHttpServer) newSOCKS5Dial(ctx *ProxyCtx, u *url.URL) func(network, addr string) (net.Conn, error) {
+	if strings.IndexRune(u.Host, ':') == -1 {
+		u.Host += ":1080"
+	}
+	return func(network, addr string) (net.Conn, error) {
+		dialTimeout := ctx.ForwardProxyDialTimeout
+		if dialTimeout == 0 {
+			dialTimeout = 20
+		}
+		var c net.Conn
+		var err error
+		if ctx.ForwardProxySourceIP != "" {
+			d := net.Dialer{
+				Timeout:  time.Duration(dialTimeout) * time.Second,
+				Resolver: proxy.getResolver(ctx, "udp", ""),
+			}
+			if localAddr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(ctx.ForwardProxySourceIP, "0")); err == nil {
+				d.LocalAddr = localAddr
+			}
+			c, err = ctx.tracedDial(&d, network, u.Host)
+		} else {
+			c, err = ctx.tracedDialFunc(proxy.dial, network, u.Host)
+		}
+		if err != nil {
+			return nil, err
+		}
+		c.SetDeadline(time.Now().Add(time.Duration(dialTimeout) * time.Second))
+		if err := proxy.socks5Connect(ctx, c, u.Scheme == "socks5h", addr); err != nil {
+			ctx.Logf("SOCKS5 connect to %s through %s failed: %v", addr, u.Host, err)
+			c.Close()
+			return nil, err
+		}
+		c.SetDeadline(time.Time{})
+		return c, nil
+	}
+}
+
+// socks5Connect authenticates to the SOCKS5 proxy on c and asks it to connect to addr, by name
+// if remoteDNS is set
+func (proxy *ProxyHttpServer) socks5Connect(ctx *ProxyCtx, c net.Conn, remoteDNS bool, addr string) error {
+	host, portString, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil || port <= 0 || port > 0xffff {
+		return fmt.Errorf("invalid port %q", portString)
+	}
+
+	var user, password string
+	if ctx.ForwardProxyAuth != "" {
+		decoded, err := base64.StdEncoding.DecodeString(ctx.ForwardProxyAuth)
+		if err != nil {
+			return fmt.Errorf("invalid forward proxy auth: %v", err)
+		}
+		i := bytes.IndexByte(decoded, ':')
+		if i < 0 {
+			return errors.New("invalid forward proxy auth: no password")
+		}
+		user, password = string(decoded[:i]), string(decoded[i+1:])
+		if len(user) > 255 || len(password) > 255 {
+			return errors.New("invalid forward proxy auth: too long")
+		}
+	}
+
+	method := byte(0x00)
+	if user != "" {
+		method = 0x02
+	}
+	if _, err := c.Write([]byte{0x05, 0x01, method}); err != nil {
+		return err
+	}
+	var reply [2]byte
+	if _, err := io.ReadFull(c, reply[:]); err != nil {
+		return err
+	}
+	if reply[0] != 0x05 {
+		return fmt.Errorf("unexpected SOCKS version %d", reply[0])
+	}
+	if reply[1] != method {
+		return socks5Refusal(http.StatusProxyAuthRequired, "no acceptable SOCKS5 authentication method")
+	}
+	if method == 0x02 {
+		auth := append([]byte{0x01, byte(len(user))}, user...)
+		auth = append(append(auth, byte(len(password))), password...)
+		if _, err := c.Write(auth); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(c, reply[:]); err != nil {
+			return err
+		}
+		if reply[1] != 0x00 {
+			return socks5Refusal(http.StatusProxyAuthRequired, "SOCKS5 authentication failed")
+		}
+	}
+
+	req := []byte{0x05, 0x01, 0x00}
+	ip := net.ParseIP(host)
+	if ip == nil && !remoteDNS {
+		ctx.traceDNSStart(host)
+		ips, ips6, err := proxy.resolveDomain(ctx, ctx.primaryResolver("udp"), host)
+		if backup := ctx.backupResolver("udp"); err != nil && backup != nil {
+			ips, ips6, err = proxy.resolveDomain(ctx, backup, host)
+		}
+		ctx.traceDNSDone(append(append([]string{}, ips...), ips6...), err)
+		if err != nil {
+			return err
+		}
+		if len(ips) > 0 {
+			ip = net.ParseIP(ips[0])
+		} else if len(ips6) > 0 {
+			ip = net.ParseIP(ips6[0])
+		}
+		if ip == nil {
+			return fmt.Errorf("no address for %s", host)
+		}
+	}
+	switch {
+	case ip == nil:
+		if len(host) > 255 {
+			return fmt.Errorf("host name too long: %s", host)
+		}
+		req = append(append(req, 0x03, byte(len(host))), host...)
+	case ip.To4() != nil:
+		req = append(append(req, 0x01), ip.To4()...)
+	default:
+		req = append(append(req, 0x04), ip.To16()...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+	if _, err := c.Write(req); err != nil {
+		return err
+	}
+
+	var header [4]byte
+	if _, err := io.ReadFull(c, header[:]); err != nil {
+		return err
+	}
+	if header[1] != 0x00 {
+		reason, ok := socks5Replies[header[1]]
+		if !ok {
+			reason = fmt.Sprintf("SOCKS5 reply %d", header[1])
+		}
+		status := http.StatusBadGateway
+		switch header[1] {
+		case 0x02:
+			status = http.StatusForbidden
+		case 0x06:
+			status = http.StatusGatewayTimeout
+		}
+		return socks5Refusal(status, reason)
+	}
+	// skip the bound address
+	var skip int
+	switch header[3] {
+	case 0x01:
+		skip = net.IPv4len
+	case 0x04:
+		skip = net.IPv6len
+	case 0x03:
+		var n [1]byte
+		if _, err := io.ReadFull(c, n[:]); err != nil {
+			return err
+		}
+		skip = int(n[0])
+	default:
+		return fmt.Errorf("unexpected SOCKS5 address type %d", header[3])
+	}
+	bound := make([]byte, skip+2)
+	if _, err := io.ReadFull(c, bound); err != nil {
+		return err
+	}
+	ctx.Debugf(DebugDial, "SOCKS5 tunnel to %s bound to port %d", addr, binary.BigEndian.Uint16(bound[skip:]))
+	return nil
+}
+
+// socks5TLS starts the TLS of the https request of ctx to serverName over the SOCKS5 tunnel c,
+// which reaches the destination itself rather than an HTTP proxy
+func (ctx *ProxyCtx) socks5TLS(c net.Conn, serverName string) (net.Conn, error) {
+	config := &tls.Config{}
+	if ctx.Proxy.Tr != nil && ctx.Proxy.Tr.TLSClientConfig != nil {
+		config = ctx.Proxy.Tr.TLSClientConfig.Clone()
+	}
+	config.ServerName = serverName
+	tlsConn := tls.Client(c, config)
+	ctx.traceTLSStart()
+	err := tlsConn.Handshake()
+	ctx.traceTLSDone(tlsConn.ConnectionState(), err)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
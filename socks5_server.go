@@ -0,0 +1,289 @@
+package goproxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// The proxy can accept SOCKS5 clients too, see ServeSOCKS5. Their CONNECT commands are handled
+// as HTTP CONNECT requests for the same host and port: they go through the CONNECT handlers,
+// the forward proxies, the sessions, the metrics and the accounting like the HTTP clients. The
+// username and password of the clients, if any, are sent in the Proxy-Authorization header of
+// the CONNECT request, and the handlers answering it with an error make the proxy reply with
+// the equivalent SOCKS5 failure.
+
+// ListenAndServeSOCKS5 listens on the TCP address addr and serves the SOCKS5 clients
+// connecting to it, see ServeSOCKS5
+func (proxy *ProxyHttpServer) ListenAndServeSOCKS5(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return proxy.ServeSOCKS5(l)
+}
+
+// ServeSOCKS5 accepts the SOCKS5 clients connecting to l, and serves each of them in its own
+// goroutine. It returns when l fails to accept, and closes it.
+func (proxy *ProxyHttpServer) ServeSOCKS5(l net.Listener) error {
+	defer l.Close()
+	var delay time.Duration
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay *= 2; delay > time.Second {
+					delay = time.Second
+				}
+				proxy.Logger.Printf("WARN: SOCKS5 accept error: %v, retrying in %v", err, delay)
+				time.Sleep(delay)
+				continue
+			}
+			return err
+		}
+		delay = 0
+		go proxy.serveSOCKS5Conn(c)
+	}
+}
+
+// serveSOCKS5Conn negotiates with the SOCKS5 client on c and hands its CONNECT command over
+// to HandleHttps
+func (proxy *ProxyHttpServer) serveSOCKS5Conn(c net.Conn) {
+	c.SetDeadline(time.Now().Add(30 * time.Second))
+	r := bufio.NewReader(c)
+	req, err := readSOCKS5Connect(r, c)
+	if err != nil {
+		proxy.Logger.Printf("WARN: SOCKS5 client %s: %v", c.RemoteAddr(), err)
+		c.Close()
+		return
+	}
+	c.SetDeadline(time.Time{})
+	req.RemoteAddr = c.RemoteAddr().String()
+	req = req.WithContext(ProxyProtocolConnContext(req.Context(), c))
+	var client net.Conn = &socks5Client{Conn: c, r: r}
+	proxy.HandleHttps(nil, req, &client)
+}
+
+// socks5Error is a failure of a SOCKS5 negotiation already answered with reply
+type socks5Error struct {
+	reply byte
+	err   error
+}
+
+func (e *socks5Error) Error() string {
+	return e.err.Error()
+}
+
+// readSOCKS5Connect negotiates the authentication method with the SOCKS5 client on r and w,
+// and returns its CONNECT command as an HTTP CONNECT request
+func readSOCKS5Connect(r *bufio.Reader, w io.Writer) (*http.Request, error) {
+	var b [4]byte
+	if _, err := io.ReadFull(r, b[:2]); err != nil {
+		return nil, err
+	}
+	if b[0] != 0x05 {
+		return nil, fmt.Errorf("unexpected SOCKS version %d", b[0])
+	}
+	methods := make([]byte, b[1])
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return nil, err
+	}
+	// the username/password method is preferred, the CONNECT handlers check the credentials
+	method := byte(0xff)
+	if bytes.IndexByte(methods, 0x02) >= 0 {
+		method = 0x02
+	} else if bytes.IndexByte(methods, 0x00) >= 0 {
+		method = 0x00
+	}
+	if _, err := w.Write([]byte{0x05, method}); err != nil {
+		return nil, err
+	}
+	if method == 0xff {
+		return nil, errors.New("no acceptable authentication method")
+	}
+
+	var user, password string
+	if method == 0x02 {
+		if _, err := io.ReadFull(r, b[:2]); err != nil {
+			return nil, err
+		}
+		u := make([]byte, b[1])
+		if _, err := io.ReadFull(r, u); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(r, b[:1]); err != nil {
+			return nil, err
+		}
+		p := make([]byte, b[0])
+		if _, err := io.ReadFull(r, p); err != nil {
+			return nil, err
+		}
+		user, password = string(u), string(p)
+		if _, err := w.Write([]byte{0x01, 0x00}); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := io.ReadFull(r, b[:4]); err != nil {
+		return nil, err
+	}
+	var host string
+	switch b[3] {
+	case 0x01:
+		ip := make([]byte, net.IPv4len)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return nil, err
+		}
+		host = net.IP(ip).String()
+	case 0x04:
+		ip := make([]byte, net.IPv6len)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return nil, err
+		}
+		host = net.IP(ip).String()
+	case 0x03:
+		var n [1]byte
+		if _, err := io.ReadFull(r, n[:]); err != nil {
+			return nil, err
+		}
+		name := make([]byte, n[0])
+		if _, err := io.ReadFull(r, name); err != nil {
+			return nil, err
+		}
+		host = string(name)
+	default:
+		writeSOCKS5Reply(w, 0x08, nil)
+		return nil, fmt.Errorf("unexpected address type %d", b[3])
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return nil, err
+	}
+	if b[1] != 0x01 {
+		writeSOCKS5Reply(w, 0x07, nil)
+		return nil, fmt.Errorf("unsupported command %d", b[1])
+	}
+
+	addr := net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1])))
+	req := &http.Request{
+		Method:     "CONNECT",
+		URL:        &url.URL{Host: addr},
+		Host:       addr,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+	}
+	if method == 0x02 {
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(user+":"+password)))
+	}
+	return req, nil
+}
+
+// writeSOCKS5Reply writes the SOCKS5 reply code reply, with the bound address addr if set
+func writeSOCKS5Reply(w io.Writer, reply byte, addr net.Addr) error {
+	b := []byte{0x05, reply, 0x00}
+	ip, port := net.IPv4zero.To4(), 0
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		ip, port = tcp.IP, tcp.Port
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		b = append(append(b, 0x01), ip4...)
+	} else {
+		b = append(append(b, 0x04), ip.To16()...)
+	}
+	_, err := w.Write(append(b, byte(port>>8), byte(port)))
+	return err
+}
+
+// socks5ReplyCode returns the SOCKS5 reply equivalent to the HTTP answer to a CONNECT request
+func socks5ReplyCode(status int) byte {
+	switch status {
+	case http.StatusOK:
+		return 0x00
+	case http.StatusForbidden, http.StatusProxyAuthRequired, http.StatusUnauthorized:
+		return 0x02
+	case http.StatusGatewayTimeout:
+		return 0x04
+	}
+	return 0x01
+}
+
+// maxSOCKS5Answer bounds the HTTP answer to a CONNECT request translated to a SOCKS5 reply
+const maxSOCKS5Answer = 64 * 1024
+
+// socks5Client is the connection of a SOCKS5 client, translating the HTTP answer written to
+// its CONNECT request into a SOCKS5 reply. The body of the error answers is dropped.
+type socks5Client struct {
+	net.Conn
+	r       *bufio.Reader
+	answer  []byte
+	replied bool
+	failed  bool
+}
+
+func (c *socks5Client) Read(b []byte) (int, error) {
+	if c.r.Buffered() > 0 {
+		return c.r.Read(b)
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *socks5Client) Write(b []byte) (int, error) {
+	if c.failed {
+		return len(b), nil
+	}
+	if c.replied {
+		return c.Conn.Write(b)
+	}
+	c.answer = append(c.answer, b...)
+	end := bytes.Index(c.answer, []byte("\r\n\r\n"))
+	if end < 0 {
+		if len(c.answer) > maxSOCKS5Answer {
+			return 0, errors.New("HTTP answer to a SOCKS5 client too long")
+		}
+		return len(b), nil
+	}
+	c.replied = true
+	status := http.StatusBadGateway
+	if line := bytes.Fields(c.answer[:end]); len(line) >= 2 {
+		if code, err := strconv.Atoi(string(line[1])); err == nil {
+			status = code
+		}
+	}
+	reply := socks5ReplyCode(status)
+	if reply != 0x00 {
+		c.failed = true
+		return len(b), writeSOCKS5Reply(c.Conn, reply, nil)
+	}
+	if err := writeSOCKS5Reply(c.Conn, reply, c.Conn.LocalAddr()); err != nil {
+		return 0, err
+	}
+	if rest := c.answer[end+4:]; len(rest) > 0 {
+		if _, err := c.Conn.Write(rest); err != nil {
+			return 0, err
+		}
+	}
+	c.answer = nil
+	return len(b), nil
+}
+
+// Close replies with a failure if the CONNECT request was closed without an answer, e.g. when
+// a handler rejected it
+func (c *socks5Client) Close() error {
+	if !c.replied {
+		c.replied = true
+		writeSOCKS5Reply(c.Conn, 0x02, nil)
+	}
+	return c.Conn.Close()
+}
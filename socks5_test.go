@@ -0,0 +1,225 @@
+package goproxy
+
+import (
+	"bufio"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// socks5Server is a SOCKS5 proxy requiring the user alice, recording the addresses it is asked
+// to connect to
+type socks5Server struct {
+	net.Listener
+	mu    sync.Mutex
+	addrs []string
+}
+
+func newSOCKS5Server(t *testing.T) *socks5Server {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	orFatal("Listen", err, t)
+	s := &socks5Server{Listener: l}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(c)
+		}
+	}()
+	return s
+}
+
+func (s *socks5Server) serve(c net.Conn) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	b := make([]byte, 262)
+	// greeting, then the username/password auth
+	if _, err := io.ReadFull(r, b[:2]); err != nil {
+		return
+	}
+	io.ReadFull(r, b[:b[1]])
+	c.Write([]byte{0x05, 0x02})
+	io.ReadFull(r, b[:2])
+	user := make([]byte, b[1])
+	io.ReadFull(r, user)
+	io.ReadFull(r, b[:1])
+	password := make([]byte, b[0])
+	io.ReadFull(r, password)
+	if string(user) != "alice" || string(password) != "secret" {
+		c.Write([]byte{0x01, 0x01})
+		return
+	}
+	c.Write([]byte{0x01, 0x00})
+
+	if _, err := io.ReadFull(r, b[:4]); err != nil {
+		return
+	}
+	var host string
+	switch b[3] {
+	case 0x01:
+		io.ReadFull(r, b[:4])
+		host = net.IP(b[:4]).String()
+	case 0x03:
+		io.ReadFull(r, b[:1])
+		name := make([]byte, b[0])
+		io.ReadFull(r, name)
+		host = string(name)
+	}
+	io.ReadFull(r, b[:2])
+	addr := net.JoinHostPort(host, strconv.Itoa(int(b[0])<<8|int(b[1])))
+	s.mu.Lock()
+	s.addrs = append(s.addrs, addr)
+	s.mu.Unlock()
+	if host == "localhost" {
+		addr = strings.Replace(addr, "localhost", "127.0.0.1", 1)
+	}
+	target, err := net.Dial("tcp", addr)
+	if err != nil {
+		c.Write([]byte{0x05, 0x05, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer target.Close()
+	c.Write([]byte{0x05, 0x00, 0x00, 0x01, 127, 0, 0, 1, 0, 0})
+	go io.Copy(target, r)
+	io.Copy(c, target)
+}
+
+func (s *socks5Server) requested() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.addrs...)
+}
+
+func TestSOCKS5ForwardProxy(t *testing.T) {
+	upstream := httptest.NewServer(ConstantHanlder("bobo"))
+	defer upstream.Close()
+	_, port, _ := net.SplitHostPort(upstream.Listener.Addr().String())
+	socks := newSOCKS5Server(t)
+	defer socks.Close()
+
+	proxy := NewProxyHttpServer()
+	auth := base64.StdEncoding.EncodeToString([]byte("alice:secret"))
+	proxy.OnRequest().DoFunc(func(r *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response) {
+		ctx.ForwardProxy, ctx.ForwardProxyProto, ctx.ForwardProxyAuth = socks.Addr().String(), "socks5h", auth
+		return r, nil
+	})
+	proxy.OnRequest().HandleConnectFunc(func(host string, ctx *ProxyCtx) (*ConnectAction, string) {
+		ctx.ForwardProxy, ctx.ForwardProxyProto, ctx.ForwardProxyAuth = socks.Addr().String(), "socks5", auth
+		ctx.ForwardProxyDirectSendOK = true
+		ctx.Resolver = StaticResolver{"localhost": {net.ParseIP("127.0.0.1")}}
+		return OkConnect, host
+	})
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	// a plain HTTP request, resolved by the SOCKS5 proxy
+	conn, err := net.Dial("tcp", s.Listener.Addr().String())
+	orFatal("Dial", err, t)
+	defer conn.Close()
+	host := "localhost:" + port
+	io.WriteString(conn, "GET http://"+host+"/ HTTP/1.1\r\nHost: "+host+"\r\n\r\n")
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	orFatal("ReadResponse", err, t)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), "bobo") {
+		t.Errorf("unexpected response %s %q", resp.Status, body)
+	}
+
+	// a tunnel, resolved by the proxy
+	conn, err = net.Dial("tcp", s.Listener.Addr().String())
+	orFatal("Dial", err, t)
+	defer conn.Close()
+	io.WriteString(conn, "CONNECT "+host+" HTTP/1.1\r\nHost: "+host+"\r\n\r\n")
+	r = bufio.NewReader(conn)
+	resp, err = http.ReadResponse(r, &http.Request{Method: "CONNECT"})
+	orFatal("ReadResponse(CONNECT)", err, t)
+	if resp.StatusCode != 200 {
+		t.Fatalf("unexpected CONNECT response %s", resp.Status)
+	}
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: "+host+"\r\nConnection: close\r\n\r\n")
+	resp, err = http.ReadResponse(r, nil)
+	orFatal("ReadResponse(GET)", err, t)
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), "bobo") {
+		t.Errorf("unexpected tunneled response %s %q", resp.Status, body)
+	}
+
+	if addrs := socks.requested(); len(addrs) != 2 || addrs[0] != host || addrs[1] != "127.0.0.1:"+port {
+		t.Errorf("unexpected SOCKS5 requests %v", addrs)
+	}
+}
+
+func TestSOCKS5Refusal(t *testing.T) {
+	socks := newSOCKS5Server(t)
+	defer socks.Close()
+	proxy := NewProxyHttpServer()
+	ctx := &ProxyCtx{Proxy: proxy, ForwardProxy: socks.Addr().String(), ForwardProxyProto: "socks5",
+		ForwardProxyAuth: base64.StdEncoding.EncodeToString([]byte("alice:wrong"))}
+	dial := proxy.NewConnectDialWithKeepAlives(ctx, "socks5://"+ctx.ForwardProxy, nil)
+	_, err := dial("tcp", "127.0.0.1:1")
+	if refused, ok := err.(*UpstreamConnectError); !ok || refused.StatusCode != http.StatusProxyAuthRequired {
+		t.Fatalf("expected a 407 refusal, got %v", err)
+	}
+
+	ctx.ForwardProxyAuth = base64.StdEncoding.EncodeToString([]byte("alice:secret"))
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	orFatal("Listen", err, t)
+	addr := l.Addr().String()
+	l.Close()
+	_, err = dial("tcp", addr)
+	if refused, ok := err.(*UpstreamConnectError); !ok || refused.StatusCode != http.StatusBadGateway {
+		t.Fatalf("expected a 502 refusal, got %v", err)
+	}
+}
+
+func TestServeSOCKS5(t *testing.T) {
+	upstream := httptest.NewServer(ConstantHanlder("bobo"))
+	defer upstream.Close()
+	_, port, _ := net.SplitHostPort(upstream.Listener.Addr().String())
+
+	auth := base64.StdEncoding.EncodeToString([]byte("alice:secret"))
+	proxy := NewProxyHttpServer()
+	proxy.OnRequest().HandleConnectFunc(func(host string, ctx *ProxyCtx) (*ConnectAction, string) {
+		if ctx.Req.Header.Get("Proxy-Authorization") != "Basic "+auth {
+			return RejectConnect, host
+		}
+		return OkConnect, strings.Replace(host, "localhost", "127.0.0.1", 1)
+	})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	orFatal("Listen", err, t)
+	go proxy.ServeSOCKS5(l)
+	defer l.Close()
+
+	client := NewProxyHttpServer()
+	ctx := &ProxyCtx{Proxy: client, ForwardProxy: l.Addr().String(), ForwardProxyProto: "socks5h", ForwardProxyAuth: auth}
+	dial := client.NewConnectDialWithKeepAlives(ctx, "socks5h://"+ctx.ForwardProxy, nil)
+	conn, err := dial("tcp", "localhost:"+port)
+	orFatal("dial", err, t)
+	defer conn.Close()
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	orFatal("ReadResponse", err, t)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), "bobo") {
+		t.Errorf("unexpected tunneled response %s %q", resp.Status, body)
+	}
+
+	ctx.ForwardProxyAuth = base64.StdEncoding.EncodeToString([]byte("alice:wrong"))
+	_, err = dial("tcp", "localhost:"+port)
+	if refused, ok := err.(*UpstreamConnectError); !ok || refused.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected a 403 refusal, got %v", err)
+	}
+}
@@ -0,0 +1,63 @@
+package goproxy
+
+import (
+	"fmt"
+	"net"
+)
+
+// sourceAddr returns the local address to bind when dialing ip: ForwardProxySourceIPv6 for
+// IPv6 destinations and ForwardProxySourceIP for IPv4 ones. It returns nil when no source
+// address is configured for the family of ip.
+func (ctx *ProxyCtx) sourceAddr(ip net.IP) *net.TCPAddr {
+	source := ctx.ForwardProxySourceIP
+	if ip.To4() == nil {
+		source = ctx.ForwardProxySourceIPv6
+	}
+	if source == "" {
+		return nil
+	}
+	sourceIP := net.ParseIP(source)
+	if sourceIP == nil || (sourceIP.To4() == nil) != (ip.To4() == nil) {
+		ctx.Logf("ignoring source address %s for destination %s", source, ip)
+		return nil
+	}
+	return &net.TCPAddr{IP: sourceIP}
+}
+
+// hasSourceAddr is true when the outgoing connections must be bound to a source address
+func (ctx *ProxyCtx) hasSourceAddr() bool {
+	return ctx.ForwardProxySourceIP != "" || ctx.ForwardProxySourceIPv6 != ""
+}
+
+// ValidateSourceIPs checks the addresses meant for ProxyCtx.ForwardProxySourceIP and
+// ForwardProxySourceIPv6: they must be IP literals of the right family assigned to a local
+// interface. Empty addresses are skipped. It is meant to be called at startup, since a bad
+// address would otherwise only surface as dial errors.
+func ValidateSourceIPs(v4, v6 string) error {
+	localAddrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return err
+	}
+	check := func(addr string, wantV4 bool) error {
+		if addr == "" {
+			return nil
+		}
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return fmt.Errorf("source address %q is not an IP address", addr)
+		}
+		if (ip.To4() != nil) != wantV4 {
+			return fmt.Errorf("source address %s has the wrong address family", addr)
+		}
+		for _, local := range localAddrs {
+			if ipNet, ok := local.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+				return nil
+			}
+		}
+		return fmt.Errorf("source address %s is not assigned to a local interface", addr)
+	}
+	if err := check(v4, true); err != nil {
+		return err
+	}
+	return check(v6, false)
+}
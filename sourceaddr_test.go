@@ -0,0 +1,42 @@
+package goproxy
+
+import (
+	"net"
+	"testing"
+)
+
+func TestValidateSourceIPs(t *testing.T) {
+	hasV6 := false
+	addrs, err := net.InterfaceAddrs()
+	orFatal("InterfaceAddrs", err, t)
+	for _, a := range addrs {
+		if ipNet, ok := a.(*net.IPNet); ok && ipNet.IP.Equal(net.IPv6loopback) {
+			hasV6 = true
+		}
+	}
+
+	for _, c := range []struct {
+		name   string
+		v4, v6 string
+		valid  bool
+		needV6 bool
+	}{
+		{"none", "", "", true, false},
+		{"v4", "127.0.0.1", "", true, false},
+		{"v6", "", "::1", true, true},
+		{"both", "127.0.0.1", "::1", true, true},
+		{"v4 not an ip", "localhost", "", false, false},
+		{"v6 not an ip", "", "::zz", false, false},
+		{"v6 as v4", "::1", "", false, false},
+		{"v4 as v6", "", "127.0.0.1", false, false},
+		{"v4 not local", "192.0.2.1", "", false, false},
+		{"v6 not local", "", "2001:db8::1", false, false},
+	} {
+		if c.needV6 && !hasV6 {
+			continue
+		}
+		if err := ValidateSourceIPs(c.v4, c.v6); (err == nil) != c.valid {
+			t.Errorf("%s: expected valid=%v, got %v", c.name, c.valid, err)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package goproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ErrSourcePortsExhausted is returned when every port of the range configured for a source
+// address is in use
+var ErrSourcePortsExhausted = errors.New("source ports exhausted")
+
+// PortRange is an inclusive range of local ports
+type PortRange struct {
+	First int
+	Last  int
+}
+
+// SourcePortAllocator hands out local ports to connections bound to a source address, to avoid
+// ephemeral port exhaustion when a single source IP makes many connections.
+//
+// Source addresses with a range in Ranges get their ports picked round-robin in that range,
+// skipping ports still in use. Other source addresses let the kernel pick the port at connect
+// time (IP_BIND_ADDRESS_NO_PORT), which allows reusing a port towards different destinations.
+// In both cases SO_REUSEADDR is set so ports in TIME_WAIT can be bound again.
+type SourcePortAllocator struct {
+	// Ranges maps a source IP to the ports it may use
+	Ranges map[string]PortRange
+	// ExhaustedMetric, if set, is incremented every time a range is exhausted
+	ExhaustedMetric *prometheus.Counter
+
+	mu        sync.Mutex
+	next      map[string]int
+	exhausted int64
+}
+
+// Exhausted returns how many dials failed because the port range of their source was exhausted
+func (a *SourcePortAllocator) Exhausted() int64 {
+	return atomic.LoadInt64(&a.exhausted)
+}
+
+// nextPort returns the next port to try in r for ip
+func (a *SourcePortAllocator) nextPort(ip string, r PortRange) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.next == nil {
+		a.next = make(map[string]int)
+	}
+	port := a.next[ip]
+	if port < r.First || port > r.Last {
+		port = r.First
+	}
+	if port == r.Last {
+		a.next[ip] = r.First
+	} else {
+		a.next[ip] = port + 1
+	}
+	return port
+}
+
+// dial dials addr from the source address of d, picking the local port as configured
+func (a *SourcePortAllocator) dial(c context.Context, d *net.Dialer, network, addr string) (net.Conn, error) {
+	src, ok := d.LocalAddr.(*net.TCPAddr)
+	if !ok || src.IP == nil || src.Port != 0 {
+		return d.DialContext(c, network, addr)
+	}
+
+	r, ok := a.Ranges[src.IP.String()]
+	if !ok || r.First <= 0 || r.Last < r.First {
+		bound := *d
+		bound.Control = chainControl(d.Control, setBindNoPort)
+		return bound.DialContext(c, network, addr)
+	}
+
+	for i := 0; i <= r.Last-r.First; i++ {
+		if err := c.Err(); err != nil {
+			return nil, err
+		}
+		bound := *d
+		bound.LocalAddr = &net.TCPAddr{IP: src.IP, Port: a.nextPort(src.IP.String(), r), Zone: src.Zone}
+		bound.Control = chainControl(d.Control, setReuseAddr)
+		conn, err := bound.DialContext(c, network, addr)
+		if err == nil || !isPortTaken(err) {
+			return conn, err
+		}
+	}
+
+	atomic.AddInt64(&a.exhausted, 1)
+	if a.ExhaustedMetric != nil {
+		metric := *a.ExhaustedMetric
+		metric.Inc()
+	}
+	return nil, ErrSourcePortsExhausted
+}
+
+// chainControl returns a dialer Control function calling first and then second
+func chainControl(first, second func(network, address string, c syscall.RawConn) error) func(network, address string, c syscall.RawConn) error {
+	if first == nil {
+		return second
+	}
+	if second == nil {
+		return first
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		if err := first(network, address, c); err != nil {
+			return err
+		}
+		return second(network, address, c)
+	}
+}
+
+// dialBound dials addr with d, going through the source port allocator of the proxy when
+// the dialer binds a source address. The hops of followed redirects are checked by
+// refusePrivateDial.
+func (ctx *ProxyCtx) dialBound(c context.Context, d *net.Dialer, network, addr string) (net.Conn, error) {
+	d = ctx.refusePrivateDial(d)
+	if d.LocalAddr == nil || ctx.Proxy == nil || ctx.Proxy.SourcePorts == nil {
+		return d.DialContext(c, network, addr)
+	}
+	conn, err := ctx.Proxy.SourcePorts.dial(c, d, network, addr)
+	if err == ErrSourcePortsExhausted {
+		ctx.Warnf("source ports exhausted for %v dialing %s", d.LocalAddr, addr)
+	}
+	return conn, err
+}
@@ -0,0 +1,98 @@
+package goproxy
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+func TestSourcePortAllocator(t *testing.T) {
+	// the server closes the connections first, so that their source port is free again
+	// once the client closed them too
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	orFatal("Listen", err, t)
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+
+	// a listener holds the only port of the range
+	blocker, err := net.Listen("tcp", "127.0.0.1:0")
+	orFatal("Listen", err, t)
+	port := blocker.Addr().(*net.TCPAddr).Port
+	a := &SourcePortAllocator{Ranges: map[string]PortRange{"127.0.0.1": {First: port, Last: port}}}
+	d := &net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP("127.0.0.1")}}
+	if _, err := a.dial(context.Background(), d, "tcp", l.Addr().String()); err != ErrSourcePortsExhausted {
+		t.Fatalf("expected the range to be exhausted, got %v", err)
+	}
+	if a.Exhausted() != 1 {
+		t.Errorf("expected 1 exhausted dial, got %d", a.Exhausted())
+	}
+
+	// released, the port is used again, connection after connection
+	blocker.Close()
+	for i := 0; i < 2; i++ {
+		conn, err := a.dial(context.Background(), d, "tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("dial %d: %v", i, err)
+		}
+		if local := conn.LocalAddr().(*net.TCPAddr).Port; local != port {
+			t.Errorf("dial %d: expected the source port %d, got %d", i, port, local)
+		}
+		ioutil.ReadAll(conn)
+		conn.Close()
+	}
+	if a.Exhausted() != 1 {
+		t.Errorf("expected no other exhausted dial, got %d", a.Exhausted())
+	}
+}
+
+func TestSourcePortAllocatorSkipsConnectedPorts(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	orFatal("Listen", err, t)
+	defer l.Close()
+	// the server keeps the connections open
+	go func() {
+		var held []net.Conn
+		defer func() {
+			for _, c := range held {
+				c.Close()
+			}
+		}()
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			held = append(held, c)
+		}
+	}()
+
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	orFatal("Listen", err, t)
+	port := free.Addr().(*net.TCPAddr).Port
+	free.Close()
+	a := &SourcePortAllocator{Ranges: map[string]PortRange{"127.0.0.1": {First: port, Last: port}}}
+	d := &net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP("127.0.0.1")}}
+	conn, err := a.dial(context.Background(), d, "tcp", l.Addr().String())
+	orFatal("dial", err, t)
+	defer conn.Close()
+
+	// the port binds again with SO_REUSEADDR, but is already connected to this destination
+	if _, err := a.dial(context.Background(), d, "tcp", l.Addr().String()); err != ErrSourcePortsExhausted {
+		t.Errorf("expected the connected port to be skipped, got %v", err)
+	}
+
+	c, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := a.dial(c, d, "tcp", l.Addr().String()); err != context.Canceled {
+		t.Errorf("expected the dial to stop with its context, got %v", err)
+	}
+}
@@ -0,0 +1,173 @@
+package goproxy
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// SpillBuffer buffers a body in memory as long as the MemoryBudget of its request allows it,
+// entirely if the request has no budget, and in a temporary file beyond that, so that the
+// handlers needing entire bodies don't hold large ones in memory. The file is encrypted with
+// a key only held by the buffer. It is removed from its directory as soon as it is created
+// where the system allows it, and by Close otherwise. The buffers of a request are closed
+// once it is done.
+type SpillBuffer struct {
+	ctx  *ProxyCtx
+	dir  string
+	mem  []byte
+	file *os.File
+	// the name of file if it couldn't be removed yet
+	name  string
+	block cipher.Block
+	iv    []byte
+	size  int64
+}
+
+// errSpillBufferClosed is the error of the SpillBuffers used after Close
+var errSpillBufferClosed = errors.New("spill buffer closed")
+
+// NewSpillBuffer returns an empty SpillBuffer, spilling to the SpillDir of the MemoryBudget
+// of the proxy, or to the default directory for temporary files
+func (ctx *ProxyCtx) NewSpillBuffer() *SpillBuffer {
+	b := &SpillBuffer{ctx: ctx}
+	if ctx.Proxy != nil && ctx.Proxy.MemoryBudget != nil {
+		b.dir = ctx.Proxy.MemoryBudget.SpillDir
+	}
+	ctx.spills = append(ctx.spills, b)
+	return b
+}
+
+// Write appends p to the buffer, in memory if its reservation fits in the memory budget of
+// the request
+func (b *SpillBuffer) Write(p []byte) (int, error) {
+	if b.ctx == nil {
+		return 0, errSpillBufferClosed
+	}
+	if b.file == nil && b.ctx.ReserveMemory(int64(len(p))) == nil {
+		b.mem = append(b.mem, p...)
+		b.size += int64(len(p))
+		return len(p), nil
+	}
+	if b.file == nil {
+		if err := b.spill(); err != nil {
+			return 0, err
+		}
+	}
+	enc := make([]byte, len(p))
+	b.stream(b.size-int64(len(b.mem))).XORKeyStream(enc, p)
+	n, err := b.file.WriteAt(enc, b.size-int64(len(b.mem)))
+	b.size += int64(n)
+	return n, err
+}
+
+// spill creates the file of the buffer
+func (b *SpillBuffer) spill() error {
+	key := make([]byte, 32)
+	b.iv = make([]byte, aes.BlockSize)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	if _, err := rand.Read(b.iv); err != nil {
+		return err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(b.dir, "goproxy-spill-")
+	if err != nil {
+		return err
+	}
+	if os.Remove(f.Name()) != nil {
+		b.name = f.Name()
+	}
+	b.block, b.file = block, f
+	b.ctx.Logf("spilling body to disk after %d bytes", b.size)
+	return nil
+}
+
+// stream returns the key stream of the file from off
+func (b *SpillBuffer) stream(off int64) cipher.Stream {
+	iv := make([]byte, aes.BlockSize)
+	copy(iv, b.iv)
+	// adds the index of the block of off to the big endian counter of iv
+	carry := uint64(off / aes.BlockSize)
+	for i := aes.BlockSize - 1; i >= 0 && carry > 0; i-- {
+		sum := uint64(iv[i]) + carry&0xff
+		iv[i] = byte(sum)
+		carry = carry>>8 + sum>>8
+	}
+	s := cipher.NewCTR(b.block, iv)
+	if skip := off % aes.BlockSize; skip > 0 {
+		discard := make([]byte, skip)
+		s.XORKeyStream(discard, discard)
+	}
+	return s
+}
+
+// Len returns the number of bytes buffered
+func (b *SpillBuffer) Len() int64 {
+	return b.size
+}
+
+// Spilled reports whether the buffer spilled to disk
+func (b *SpillBuffer) Spilled() bool {
+	return b.file != nil
+}
+
+// ReadAt reads the buffer from off, it implements io.ReaderAt
+func (b *SpillBuffer) ReadAt(p []byte, off int64) (int, error) {
+	if b.ctx == nil {
+		return 0, errSpillBufferClosed
+	}
+	if off >= b.size {
+		return 0, io.EOF
+	}
+	n := 0
+	if off < int64(len(b.mem)) {
+		n = copy(p, b.mem[off:])
+		off += int64(n)
+	}
+	if n < len(p) && b.file != nil && off < b.size {
+		m, err := b.file.ReadAt(p[n:], off-int64(len(b.mem)))
+		b.stream(off-int64(len(b.mem))).XORKeyStream(p[n:n+m], p[n:n+m])
+		n += m
+		if err != nil && err != io.EOF {
+			return n, err
+		}
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Reader returns a reader of the buffer from its start, closing the buffer when it is closed
+func (b *SpillBuffer) Reader() io.ReadCloser {
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.NewSectionReader(b, 0, b.size), b}
+}
+
+// Close releases the memory of the buffer and removes its file
+func (b *SpillBuffer) Close() error {
+	if b.ctx == nil {
+		return nil
+	}
+	b.ctx.ReleaseMemory(int64(len(b.mem)))
+	b.ctx, b.mem = nil, nil
+	if b.file == nil {
+		return nil
+	}
+	err := b.file.Close()
+	if b.name != "" {
+		os.Remove(b.name)
+	}
+	return err
+}
@@ -0,0 +1,110 @@
+package goproxy
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestSpillBuffer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spill")
+	orFatal("TempDir", err, t)
+	defer os.RemoveAll(dir)
+	proxy := NewProxyHttpServer()
+	proxy.MemoryBudget = &MemoryBudget{PerSession: 100, SpillDir: dir}
+	ctx := &ProxyCtx{Proxy: proxy}
+
+	data := make([]byte, 10000)
+	rand.Read(data)
+	b := ctx.NewSpillBuffer()
+	for i := 0; i < len(data); i += 60 {
+		end := i + 60
+		if end > len(data) {
+			end = len(data)
+		}
+		_, err := b.Write(data[i:end])
+		orFatal("Write", err, t)
+	}
+	if !b.Spilled() || b.Len() != int64(len(data)) || ctx.MemoryUsed() != 60 {
+		t.Errorf("unexpected buffer: spilled %v, %d bytes, %d in memory", b.Spilled(), b.Len(), ctx.MemoryUsed())
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("spill file left in its directory: %v", files[0].Name())
+	}
+	got, err := ioutil.ReadAll(b.Reader())
+	orFatal("ReadAll", err, t)
+	if !bytes.Equal(got, data) {
+		t.Errorf("unexpected content")
+	}
+	for _, off := range []int{0, 59, 60, 61, 4095, 4096, 9999} {
+		p := make([]byte, 33)
+		n, _ := b.ReadAt(p, int64(off))
+		if !bytes.Equal(p[:n], data[off:off+n]) {
+			t.Errorf("unexpected content at %d", off)
+		}
+	}
+	// the buffers are closed once the request is done
+	ctx.freeMemory()
+	if ctx.MemoryUsed() != 0 || proxy.MemoryBudget.Used() != 0 {
+		t.Errorf("memory not released")
+	}
+	if _, err := b.ReadAt(make([]byte, 1), 0); err != errSpillBufferClosed {
+		t.Errorf("buffer not closed: %v", err)
+	}
+}
+
+func TestInspectUploadsSpilled(t *testing.T) {
+	received := make(chan int, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received <- len(body)
+	}))
+	defer upstream.Close()
+	proxy := NewProxyHttpServer()
+	proxy.MemoryBudget = &MemoryBudget{PerSession: 1024}
+	proxy.OnRequest().Do(InspectUploads(&DLPPolicy{MaxBufferSize: 64, SpillToDisk: true, Classifiers: []DLPClassifier{
+		&RegexClassifier{Rules: []DLPRule{{Name: "card", Pattern: regexp.MustCompile(`\b4[0-9]{15}\b`), Action: DLPBlock}}}}}))
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+	proxyURL, _ := url.Parse(s.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	large := strings.Repeat("quarterly notes ", 1000)
+	for _, c := range []struct {
+		body   string
+		status int
+	}{
+		{large, http.StatusOK},
+		// the upload is blocked before anything is sent upstream
+		{large + " 4111111111111111", http.StatusForbidden},
+	} {
+		req, _ := http.NewRequest("POST", upstream.URL, strings.NewReader(c.body))
+		req.ContentLength = -1
+		resp, err := client.Do(req)
+		orFatal("Do", err, t)
+		resp.Body.Close()
+		if resp.StatusCode != c.status {
+			t.Errorf("unexpected status %d", resp.StatusCode)
+		}
+		if c.status == http.StatusOK {
+			if n := <-received; n != len(c.body) {
+				t.Errorf("%d bytes of %d sent upstream", n, len(c.body))
+			}
+		}
+	}
+	select {
+	case n := <-received:
+		t.Errorf("blocked upload sent upstream: %d bytes", n)
+	default:
+	}
+	if used := proxy.MemoryBudget.Used(); used != 0 {
+		t.Errorf("%d bytes still reserved", used)
+	}
+}
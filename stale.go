@@ -0,0 +1,124 @@
+package goproxy
+
+import (
+	"io"
+	"net/http"
+	"time"
+)
+
+// StalePolicy allows the cache of the proxy to serve stale responses (RFC 5861). It can be
+// set for the whole proxy, and overridden per route by setting ProxyCtx.StalePolicy in a
+// request handler.
+type StalePolicy struct {
+	// WhileRevalidate serves stale responses immediately while they are refreshed in the
+	// background, within their stale-while-revalidate window
+	WhileRevalidate bool
+	// IfError serves stale responses when the upstream server fails or answers with a 5xx
+	// status, within their stale-if-error window
+	IfError bool
+	// DefaultWindow is used for the responses that don't specify the windows themselves
+	DefaultWindow time.Duration
+}
+
+// stalePolicy returns the policy of the request, falling back to the one of the proxy
+func (ctx *ProxyCtx) stalePolicy() *StalePolicy {
+	if ctx.StalePolicy != nil {
+		return ctx.StalePolicy
+	}
+	if ctx.Proxy != nil {
+		return ctx.Proxy.StalePolicy
+	}
+	return nil
+}
+
+// staleUntil returns the end of the window during which c may be served stale
+func (c *CachedResponse) staleUntil(window time.Duration, policy *StalePolicy) time.Time {
+	if window == 0 {
+		window = policy.DefaultWindow
+	}
+	return c.Stored.Add(c.FreshFor + window)
+}
+
+// revalidate refreshes the cached response to r in the background, unless it is already
+// being refreshed. The upstream request is conditional when cached has validators.
+func (proxy *ProxyHttpServer) revalidate(ctx *ProxyCtx, key string, r *http.Request, cached *CachedResponse) {
+	proxy.revalidatingMu.Lock()
+	if proxy.revalidating == nil {
+		proxy.revalidating = make(map[string]bool)
+	}
+	if proxy.revalidating[key] {
+		proxy.revalidatingMu.Unlock()
+		return
+	}
+	proxy.revalidating[key] = true
+	proxy.revalidatingMu.Unlock()
+
+	req, err := http.NewRequest("GET", r.URL.String(), nil)
+	if err != nil {
+		return
+	}
+	copyHeaders(req.Header, r.Header, false)
+	req.Header.Del("Range")
+	req.Header.Del("If-Range")
+	if etag := cached.Header.Get("ETag"); etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if lastModified := cached.Header.Get("Last-Modified"); lastModified != "" {
+		req.Header.Set("If-Modified-Since", lastModified)
+	}
+	bg := ctx.background(req)
+
+	go func() {
+		defer bg.freeMemory()
+		defer func() {
+			proxy.revalidatingMu.Lock()
+			delete(proxy.revalidating, key)
+			proxy.revalidatingMu.Unlock()
+		}()
+		resp, err := bg.RoundTrip(req)
+		if err != nil {
+			bg.Logf("revalidation of %s failed: %v", key, err)
+			return
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusNotModified {
+			refreshed := *cached
+			refreshed.Header = cloneHeader(cached.Header)
+			for _, h := range []string{"Cache-Control", "Expires", "Date", "ETag"} {
+				if v := resp.Header.Get(h); v != "" {
+					refreshed.Header.Set(h, v)
+				}
+			}
+			if lifetime, ok := freshness(&http.Response{StatusCode: http.StatusOK, Header: refreshed.Header}); ok {
+				refreshed.FreshFor = lifetime
+			}
+			refreshed.Stored = time.Now()
+			proxy.Cache.Set(key, &refreshed)
+			return
+		}
+		body, err := bg.readAll(io.LimitReader(resp.Body, proxy.maxCacheObjectSize()+1))
+		if err != nil || int64(len(body)) > proxy.maxCacheObjectSize() {
+			return
+		}
+		if fresh := newCachedResponse(resp, body); fresh != nil {
+			proxy.Cache.Set(key, fresh)
+		}
+	}()
+}
+
+// background returns a copy of ctx for req, for the requests the proxy makes on its own
+// behalf while the request of ctx goes on
+func (ctx *ProxyCtx) background(req *http.Request) *ProxyCtx {
+	bg := *ctx
+	bg.Req = req
+	bg.Resp = nil
+	bg.DialTrace = nil
+	bg.httpTrace = nil
+	bg.Tail = nil
+	bg.RedirectChain = nil
+	bg.memory = 0
+	bg.spills = nil
+	bg.values = ctx.cloneValues()
+	bg.tags = ctx.Tags()
+	return &bg
+}
@@ -0,0 +1,37 @@
+package goproxy
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestStaleIfError(t *testing.T) {
+	proxy := NewProxyHttpServer()
+	proxy.Cache = &MemoryResponseCache{}
+	proxy.StalePolicy = &StalePolicy{IfError: true, DefaultWindow: time.Hour}
+
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	key := proxy.normalizer().Key(req)
+	proxy.Cache.Set(key, &CachedResponse{StatusCode: 200, Header: http.Header{}, Body: []byte("stale"),
+		Stored: time.Now().Add(-time.Minute), FreshFor: time.Second})
+
+	ctx := &ProxyCtx{Req: req, Proxy: proxy}
+	resp, err := proxy.fetch(ctx, req, func(*http.Request) (*http.Response, error) {
+		return nil, errors.New("origin down")
+	})
+	orFatal("fetch", err, t)
+	body, _ := ioutil.ReadAll(resp.Body)
+	if string(body) != "stale" || ctx.CacheStatus != CacheStale {
+		t.Errorf("expected the stale response, got %q %s", body, ctx.CacheStatus)
+	}
+
+	ctx = &ProxyCtx{Req: req, Proxy: proxy, StalePolicy: &StalePolicy{}}
+	if _, err := proxy.fetch(ctx, req, func(*http.Request) (*http.Response, error) {
+		return nil, errors.New("origin down")
+	}); err == nil {
+		t.Error("expected the per request policy to disable stale responses")
+	}
+}
@@ -0,0 +1,349 @@
+package goproxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// StatefulComponent is a component whose warm state (caches, counters) is saved when the
+// process of the proxy stops and restored by the next one, so that it doesn't start cold and
+// stampede the resolvers and the upstreams, see ProxyHttpServer.SaveState.
+// CachingResolver, SharedCertStorage, MemoryQuota and TokenBucketLimiter implement it.
+type StatefulComponent interface {
+	// ExportState returns the state of the component, encoded in JSON
+	ExportState() (json.RawMessage, error)
+	// ImportState restores a state returned by ExportState, possibly by a previous process
+	ImportState(state json.RawMessage) error
+}
+
+// stateVersion is the version of the format of the saved states
+const stateVersion = 1
+
+// http3State is the name of the state of the proxy itself in the saved states
+const http3State = "proxy.http3"
+
+// savedState is what SaveState writes
+type savedState struct {
+	Version    int                        `json:"version"`
+	Saved      time.Time                  `json:"saved"`
+	Components map[string]json.RawMessage `json:"components"`
+}
+
+// SaveState writes the state of the components of StateComponents, and the origins the proxy
+// reaches over TCP after their HTTP/3 requests failed, to w. The state holds the private
+// keys of the cached certificates and must be stored privately.
+func (proxy *ProxyHttpServer) SaveState(w io.Writer) error {
+	s := savedState{Version: stateVersion, Saved: time.Now(), Components: make(map[string]json.RawMessage)}
+	for name, c := range proxy.StateComponents {
+		state, err := c.ExportState()
+		if err != nil {
+			return fmt.Errorf("cannot export the state of %s: %v", name, err)
+		}
+		s.Components[name] = state
+	}
+	state, err := proxy.exportHTTP3State()
+	if err != nil {
+		return err
+	}
+	s.Components[http3State] = state
+	return json.NewEncoder(w).Encode(&s)
+}
+
+// LoadState restores the state written by SaveState into the components of StateComponents
+// with the same names, the components missing from the state are left as they are. The
+// entries of caches expired since the state was saved are dropped.
+func (proxy *ProxyHttpServer) LoadState(r io.Reader) error {
+	var s savedState
+	if err := json.NewDecoder(r).Decode(&s); err != nil {
+		return err
+	}
+	if s.Version != stateVersion {
+		return fmt.Errorf("unsupported state version %d", s.Version)
+	}
+	var firstErr error
+	for name, state := range s.Components {
+		var err error
+		if name == http3State {
+			err = proxy.importHTTP3State(state)
+		} else if c, ok := proxy.StateComponents[name]; ok {
+			err = c.ImportState(state)
+		} else {
+			continue
+		}
+		if err != nil {
+			proxy.Logger.Printf("WARN: cannot import the state of %s: %v", name, err)
+			if firstErr == nil {
+				firstErr = fmt.Errorf("cannot import the state of %s: %v", name, err)
+			}
+		}
+	}
+	return firstErr
+}
+
+// SaveStateFile saves the state of the proxy to the file path, readable by its owner only,
+// see SaveState. The file is replaced atomically.
+func (proxy *ProxyHttpServer) SaveStateFile(path string) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := proxy.SaveState(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	// TempFile creates the file with mode 0600 already
+	return os.Rename(f.Name(), path)
+}
+
+// LoadStateFile restores the state saved by SaveStateFile to path, see LoadState. A missing
+// file is not an error, the proxy then starts cold.
+func (proxy *ProxyHttpServer) LoadStateFile(path string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return proxy.LoadState(f)
+}
+
+func (proxy *ProxyHttpServer) exportHTTP3State() (json.RawMessage, error) {
+	proxy.http3Mu.Lock()
+	defer proxy.http3Mu.Unlock()
+	return json.Marshal(proxy.http3Broken)
+}
+
+func (proxy *ProxyHttpServer) importHTTP3State(state json.RawMessage) error {
+	var broken map[string]time.Time
+	if err := json.Unmarshal(state, &broken); err != nil {
+		return err
+	}
+	now := time.Now()
+	proxy.http3Mu.Lock()
+	defer proxy.http3Mu.Unlock()
+	for host, until := range broken {
+		if until.After(now) {
+			if proxy.http3Broken == nil {
+				proxy.http3Broken = make(map[string]time.Time)
+			}
+			proxy.http3Broken[host] = until
+		}
+	}
+	return nil
+}
+
+// lruState is an entry of an exported lruCache
+type lruState struct {
+	Key     string          `json:"key"`
+	Value   json.RawMessage `json:"value"`
+	Expires time.Time       `json:"expires,omitempty"`
+}
+
+// export encodes the entries of c that have not expired, from the least to the most recently
+// used
+func (c *lruCache) export(encode func(value interface{}) (interface{}, error)) ([]lruState, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	var entries []lruState
+	for e := c.order.Back(); e != nil; e = e.Prev() {
+		entry := e.Value.(*lruEntry)
+		if !entry.expires.IsZero() && now.After(entry.expires) {
+			continue
+		}
+		v, err := encode(entry.value)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, lruState{Key: entry.key, Value: value, Expires: entry.expires})
+	}
+	return entries, nil
+}
+
+// restore adds the entries exported by export that have not expired to c, skipping those
+// that decode fails on
+func (c *lruCache) restore(entries []lruState, decode func(value json.RawMessage) (interface{}, bool)) {
+	now := time.Now()
+	for _, entry := range entries {
+		if !entry.Expires.IsZero() && now.After(entry.Expires) {
+			continue
+		}
+		if value, ok := decode(entry.Value); ok {
+			c.setUntil(entry.Key, value, entry.Expires)
+		}
+	}
+}
+
+// ExportState implements StatefulComponent, the cached answers are exported
+func (r *CachingResolver) ExportState() (json.RawMessage, error) {
+	r.once.Do(func() { r.local = newLRUCache(r.Size) })
+	entries, err := r.local.export(func(value interface{}) (interface{}, error) {
+		return ipStrings(value.([]net.IP)), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(entries)
+}
+
+// ImportState implements StatefulComponent
+func (r *CachingResolver) ImportState(state json.RawMessage) error {
+	r.once.Do(func() { r.local = newLRUCache(r.Size) })
+	var entries []lruState
+	if err := json.Unmarshal(state, &entries); err != nil {
+		return err
+	}
+	r.local.restore(entries, func(value json.RawMessage) (interface{}, bool) {
+		var addrs []string
+		if json.Unmarshal(value, &addrs) != nil {
+			return nil, false
+		}
+		var ips []net.IP
+		for _, s := range addrs {
+			if ip := net.ParseIP(s); ip != nil {
+				ips = append(ips, ip)
+			}
+		}
+		return ips, len(ips) > 0
+	})
+	return nil
+}
+
+// ExportState implements StatefulComponent, the cached certificates are exported with their
+// private keys
+func (s *SharedCertStorage) ExportState() (json.RawMessage, error) {
+	s.once.Do(s.init)
+	entries, err := s.local.export(func(value interface{}) (interface{}, error) {
+		encoded, err := encodeCertificate(value.(*tls.Certificate))
+		return string(encoded), err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(entries)
+}
+
+// ImportState implements StatefulComponent, the certificates no longer valid are dropped
+func (s *SharedCertStorage) ImportState(state json.RawMessage) error {
+	s.once.Do(s.init)
+	var entries []lruState
+	if err := json.Unmarshal(state, &entries); err != nil {
+		return err
+	}
+	now := time.Now()
+	s.local.restore(entries, func(value json.RawMessage) (interface{}, bool) {
+		var encoded string
+		if json.Unmarshal(value, &encoded) != nil {
+			return nil, false
+		}
+		cert, err := tls.X509KeyPair([]byte(encoded), []byte(encoded))
+		if err != nil {
+			return nil, false
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil || now.After(leaf.NotAfter) {
+			return nil, false
+		}
+		return &cert, true
+	})
+	return nil
+}
+
+// quotaState is the exported state of a MemoryQuota
+type quotaState struct {
+	Period time.Duration    `json:"period"`
+	Window int64            `json:"window"`
+	Used   map[string]int64 `json:"used"`
+}
+
+// ExportState implements StatefulComponent, the usage of the current period is exported
+func (q *MemoryQuota) ExportState() (json.RawMessage, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	s := quotaState{Period: q.Period, Window: quotaWindow(time.Now(), q.Period), Used: make(map[string]int64)}
+	for key, u := range q.usage {
+		if u.window == s.Window {
+			s.Used[key] = u.used
+		}
+	}
+	return json.Marshal(&s)
+}
+
+// ImportState implements StatefulComponent. The usage is restored if it was exported during
+// the current period, with the same Period.
+func (q *MemoryQuota) ImportState(state json.RawMessage) error {
+	var s quotaState
+	if err := json.Unmarshal(state, &s); err != nil {
+		return err
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if s.Period != q.Period || s.Window != quotaWindow(time.Now(), q.Period) {
+		return nil
+	}
+	for key, used := range s.Used {
+		q.current(key).used += used
+	}
+	return nil
+}
+
+// bucketState is an exported bucket of a TokenBucketLimiter
+type bucketState struct {
+	Key    string    `json:"key"`
+	Tokens float64   `json:"tokens"`
+	Last   time.Time `json:"last"`
+}
+
+// ExportState implements StatefulComponent, the buckets not full yet are exported
+func (l *TokenBucketLimiter) ExportState() (json.RawMessage, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	buckets := []bucketState{}
+	for key, b := range l.buckets {
+		// the buckets refilled since are as good as new ones
+		if b.tokens+now.Sub(b.last).Seconds()*l.Rate >= float64(l.Burst) {
+			continue
+		}
+		buckets = append(buckets, bucketState{Key: key, Tokens: b.tokens, Last: b.last})
+	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].Key < buckets[j].Key })
+	return json.Marshal(buckets)
+}
+
+// ImportState implements StatefulComponent, the buckets refill for the time elapsed since
+// they were exported
+func (l *TokenBucketLimiter) ImportState(state json.RawMessage) error {
+	var buckets []bucketState
+	if err := json.Unmarshal(state, &buckets); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.buckets == nil {
+		l.buckets = make(map[string]*tokenBucket)
+	}
+	for _, b := range buckets {
+		l.buckets[b.Key] = &tokenBucket{tokens: b.Tokens, last: b.Last}
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package goproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSaveLoadState(t *testing.T) {
+	lookups := 0
+	upstream := ResolverFunc(func(ctx context.Context, host string, hints LookupHints) ([]net.IP, error) {
+		lookups++
+		return []net.IP{net.ParseIP("10.0.0.1")}, nil
+	})
+	newProxy := func() (*ProxyHttpServer, *CachingResolver, *SharedCertStorage, *MemoryQuota, *TokenBucketLimiter) {
+		proxy := NewProxyHttpServer()
+		r := &CachingResolver{Resolver: upstream}
+		certs := &SharedCertStorage{}
+		quota := &MemoryQuota{Limit: 100, Period: time.Hour}
+		limiter := &TokenBucketLimiter{Rate: 0.001, Burst: 2}
+		proxy.StateComponents = map[string]StatefulComponent{"dns": r, "certs": certs, "quota": quota, "rate": limiter}
+		return proxy, r, certs, quota, limiter
+	}
+
+	old, r, certs, quota, limiter := newProxy()
+	_, err := r.LookupIP(context.Background(), "example.com", LookupHints{Network: "ip"})
+	orFatal("LookupIP", err, t)
+	_, err = certs.Fetch("example.com", func() (*tls.Certificate, error) {
+		return signHost(GoproxyCa, []string{"example.com"})
+	})
+	orFatal("Fetch", err, t)
+	quota.Consume("alice", 40)
+	limiter.Allow("alice")
+	limiter.Allow("alice")
+	old.http3Broken = map[string]time.Time{"example.com:443": time.Now().Add(time.Hour)}
+	var buf bytes.Buffer
+	orFatal("SaveState", old.SaveState(&buf), t)
+
+	proxy, r, certs, quota, limiter := newProxy()
+	orFatal("LoadState", proxy.LoadState(&buf), t)
+	_, err = r.LookupIP(context.Background(), "example.com", LookupHints{Network: "ip"})
+	orFatal("LookupIP", err, t)
+	if lookups != 1 {
+		t.Errorf("expected the answer to be restored, got %d lookups", lookups)
+	}
+	_, err = certs.Fetch("example.com", func() (*tls.Certificate, error) {
+		return nil, errors.New("the certificate was not restored")
+	})
+	orFatal("Fetch", err, t)
+	if remaining, _ := quota.Remaining("alice"); remaining != 60 {
+		t.Errorf("expected 60 remaining, got %d", remaining)
+	}
+	if allowed, _ := limiter.Allow("alice"); allowed {
+		t.Error("expected the bucket of alice to be restored empty")
+	}
+	if _, ok := proxy.http3Broken["example.com:443"]; !ok {
+		t.Error("expected the broken HTTP/3 origin to be restored")
+	}
+}
+
+func TestLoadStateFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goproxy-state")
+	orFatal("TempDir", err, t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+
+	quota := &MemoryQuota{Limit: 10, Period: time.Hour}
+	proxy := NewProxyHttpServer()
+	proxy.StateComponents = map[string]StatefulComponent{"quota": quota}
+	orFatal("LoadStateFile", proxy.LoadStateFile(path), t)
+	quota.Consume("bob", 3)
+	orFatal("SaveStateFile", proxy.SaveStateFile(path), t)
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0600 {
+		t.Fatalf("unexpected state file %v %v", fi, err)
+	}
+
+	// the quotas of another period are not restored
+	quota = &MemoryQuota{Limit: 10, Period: time.Minute}
+	proxy.StateComponents["quota"] = quota
+	orFatal("LoadStateFile", proxy.LoadStateFile(path), t)
+	if remaining, _ := quota.Remaining("bob"); remaining != 10 {
+		t.Errorf("expected 10 remaining, got %d", remaining)
+	}
+}
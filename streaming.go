@@ -0,0 +1,70 @@
+package goproxy
+
+import (
+	"io"
+	"net/http"
+)
+
+// StreamingPolicy relays the large and the streamed response bodies as they come, without
+// ever buffering them entirely: they are neither cached nor shared by coalesced requests,
+// HandleBytes and the handlers of the proxy needing entire bodies pass them through or check
+// them as they are relayed, and they are copied to the client with pooled buffers. The event
+// streams are flushed to the client after each write, so that their events are not delayed.
+//
+// The response handlers of the users can check ProxyCtx.Streaming before reading a body.
+type StreamingPolicy struct {
+	// MinSize streams the bodies of a Content-Length of at least MinSize bytes
+	MinSize int64
+	// ContentTypes streams the bodies of these media types whatever their length, in which a
+	// trailing * matches every subtype. text/event-stream is always streamed.
+	ContentTypes []string
+}
+
+// eventStreamTypes are the media types of the bodies flushed after each write
+var eventStreamTypes = []string{"text/event-stream"}
+
+// streams reports whether the body of resp is streamed
+func (p *StreamingPolicy) streams(resp *http.Response) bool {
+	if p == nil || resp == nil || resp.Body == nil {
+		return false
+	}
+	if p.MinSize > 0 && resp.ContentLength >= p.MinSize {
+		return true
+	}
+	contentType := resp.Header.Get("Content-Type")
+	return mediaTypeIn(contentType, eventStreamTypes) || mediaTypeIn(contentType, p.ContentTypes)
+}
+
+// Streaming reports whether the body of the response of ctx is streamed, see StreamingPolicy
+func (ctx *ProxyCtx) Streaming() bool {
+	return ctx.streaming
+}
+
+// copyStreaming copies the streamed body of resp to w with a pooled buffer, flushing w after
+// each write if resp is an event stream
+func copyStreaming(w io.Writer, resp *http.Response) (int64, error) {
+	buf := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(buf)
+	flusher, ok := w.(http.Flusher)
+	if !ok || !mediaTypeIn(resp.Header.Get("Content-Type"), eventStreamTypes) {
+		return io.CopyBuffer(w, resp.Body, *buf)
+	}
+	var written int64
+	for {
+		n, err := resp.Body.Read(*buf)
+		if n > 0 {
+			m, werr := w.Write((*buf)[:n])
+			written += int64(m)
+			if werr != nil {
+				return written, werr
+			}
+			flusher.Flush()
+		}
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package goproxy
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStreamingSkipsBuffering(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := strconv.Atoi(r.URL.Query().Get("size"))
+		io.WriteString(w, strings.Repeat("x", n))
+	}))
+	defer backend.Close()
+
+	proxy := NewProxyHttpServer()
+	proxy.Streaming = &StreamingPolicy{MinSize: 500}
+	proxy.OnResponse().Do(HandleBytes(func(b []byte, ctx *ProxyCtx) []byte { return []byte("buffered") }))
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+	proxyURL, _ := url.Parse(s.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	for size, expected := range map[string]string{"100": "buffered", "1000": strings.Repeat("x", 1000)} {
+		resp, err := client.Get(backend.URL + "/?size=" + size)
+		orFatal("Get", err, t)
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != expected {
+			t.Errorf("%s bytes: expected %d bytes, got %d", size, len(expected), len(body))
+		}
+	}
+}
+
+func TestStreamingFlushesEventStreams(t *testing.T) {
+	next := make(chan bool)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, "data: first\n\n")
+		w.(http.Flusher).Flush()
+		select {
+		case <-next:
+		case <-time.After(5 * time.Second):
+		}
+		io.WriteString(w, "data: second\n\n")
+	}))
+	defer backend.Close()
+
+	proxy := NewProxyHttpServer()
+	proxy.Streaming = &StreamingPolicy{}
+	proxy.OnResponse().Do(HandleBytes(func(b []byte, ctx *ProxyCtx) []byte { return b }))
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+	proxyURL, _ := url.Parse(s.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	resp, err := client.Get(backend.URL)
+	orFatal("Get", err, t)
+	defer resp.Body.Close()
+	r := bufio.NewReader(resp.Body)
+	read := make(chan string, 1)
+	go func() {
+		line, _ := r.ReadString('\n')
+		read <- line
+	}()
+	select {
+	case line := <-read:
+		if line != "data: first\n" {
+			t.Errorf("unexpected event %q", line)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the first event was not flushed to the client")
+	}
+	close(next)
+	rest, _ := ioutil.ReadAll(r)
+	if string(rest) != "\ndata: second\n\n" {
+		t.Errorf("unexpected rest of the stream %q", rest)
+	}
+}
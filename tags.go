@@ -0,0 +1,125 @@
+package goproxy
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// SetTag attaches the cost attribution tag key=value to the request or tunnel of ctx, e.g.
+// "team", "project" or "cost-center". The tags are part of its AccountingRecord, of its
+// accounting log line and of the labels of ProxyHttpServer.TagMetrics. Setting an empty
+// value removes the tag. The tags set by CONNECT handlers are inherited by the requests
+// intercepted in the tunnel.
+func (ctx *ProxyCtx) SetTag(key, value string) {
+	if value == "" {
+		delete(ctx.tags, key)
+		return
+	}
+	if ctx.tags == nil {
+		ctx.tags = make(map[string]string)
+	}
+	ctx.tags[key] = value
+}
+
+// Tag returns the value of the tag key of ctx, or ""
+func (ctx *ProxyCtx) Tag(key string) string {
+	return ctx.tags[key]
+}
+
+// Tags returns a copy of the tags of ctx
+func (ctx *ProxyCtx) Tags() map[string]string {
+	if ctx.tags == nil {
+		return nil
+	}
+	tags := make(map[string]string, len(ctx.tags))
+	for k, v := range ctx.tags {
+		tags[k] = v
+	}
+	return tags
+}
+
+// tagString formats the tags of ctx as sorted key=value pairs
+func (ctx *ProxyCtx) tagString() string {
+	pairs := make([]string, 0, len(ctx.tags))
+	for k, v := range ctx.tags {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// AccountingRecord is the traffic of a request or tunnel of the proxy, once it is done
+type AccountingRecord struct {
+	Session int64
+	// Client is the address of the client, from the PROXY protocol header of its connection if
+	// any
+	Client        string
+	User          string
+	Accounting    string
+	Destination   string
+	BytesSent     int64
+	BytesReceived int64
+	Tags          map[string]string
+}
+
+// TagMetrics counts the traffic of the proxy labelled with the values of the tags Keys
+// (empty for the requests without the tag), and with "sent" or "received" as direction
+type TagMetrics struct {
+	Keys  []string
+	Bytes *prometheus.CounterVec
+}
+
+// NewTagMetrics returns TagMetrics labelled with keys, with a metric named after namespace
+// which the caller registers, e.g. with prometheus.MustRegister(m.Bytes). Tag keys must be
+// valid label names, e.g. "cost_center" rather than "cost-center".
+func NewTagMetrics(namespace string, keys ...string) *TagMetrics {
+	return &TagMetrics{
+		Keys: keys,
+		Bytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "tagged_bytes_total",
+			Help:      "Bytes sent and received by the proxy, by cost attribution tags",
+		}, append(append([]string(nil), keys...), "direction")),
+	}
+}
+
+func (m *TagMetrics) add(ctx *ProxyCtx) {
+	values := make([]string, len(m.Keys), len(m.Keys)+1)
+	for i, k := range m.Keys {
+		values[i] = ctx.tags[k]
+	}
+	m.Bytes.WithLabelValues(append(values, "sent")...).Add(float64(ctx.BytesSent))
+	m.Bytes.WithLabelValues(append(values, "received")...).Add(float64(ctx.BytesReceived))
+}
+
+// account records the traffic of the request or tunnel of ctx, once it is done
+func (proxy *ProxyHttpServer) account(ctx *ProxyCtx) {
+	proxy.accountBandwidth(ctx)
+	// the labels of the tenant are the tags the handlers didn't set
+	if tenant := ctx.Tenant(); tenant != nil {
+		for k, v := range tenant.Labels {
+			if _, ok := ctx.tags[k]; !ok {
+				ctx.SetTag(k, v)
+			}
+		}
+	}
+	var destination, client string
+	if ctx.Req != nil {
+		client = ctx.Req.RemoteAddr
+		if destination = ctx.Req.URL.Host; destination == "" {
+			destination = ctx.Req.Host
+		}
+	}
+	if len(ctx.tags) > 0 {
+		ctx.Logf("accounting %s: sent %d bytes, received %d bytes, tags %s", destination, ctx.BytesSent, ctx.BytesReceived, ctx.tagString())
+	}
+	if proxy.TagMetrics != nil {
+		proxy.TagMetrics.add(ctx)
+	}
+	if proxy.OnAccounting != nil {
+		proxy.OnAccounting(&AccountingRecord{Session: ctx.Session, Client: client, User: ctx.ProxyUser, Accounting: ctx.Accounting,
+			Destination: destination, BytesSent: ctx.BytesSent, BytesReceived: ctx.BytesReceived, Tags: ctx.Tags()})
+	}
+}
@@ -0,0 +1,75 @@
+package goproxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCostTags(t *testing.T) {
+	upstream := httptest.NewServer(ConstantHanlder("hello"))
+	defer upstream.Close()
+
+	records := make(chan *AccountingRecord, 1)
+	proxy := NewProxyHttpServer()
+	proxy.TagMetrics = NewTagMetrics("test", "team", "project")
+	proxy.OnAccounting = func(rec *AccountingRecord) { records <- rec }
+	proxy.OnRequest().DoFunc(func(r *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response) {
+		ctx.SetTag("team", "search")
+		ctx.SetTag("project", "crawler")
+		ctx.SetTag("project", "")
+		return r, nil
+	})
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+	proxyURL, _ := url.Parse(s.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	resp, err := client.Get(upstream.URL)
+	orFatal("GET", err, t)
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	rec := <-records
+	if len(rec.Tags) != 1 || rec.Tags["team"] != "search" || rec.BytesReceived != 5 {
+		t.Errorf("unexpected accounting record %+v", rec)
+	}
+	if n := testutil.ToFloat64(proxy.TagMetrics.Bytes.WithLabelValues("search", "", "received")); n != 5 {
+		t.Errorf("expected 5 bytes received by search, got %v", n)
+	}
+}
+
+func TestTenantLabels(t *testing.T) {
+	upstream := httptest.NewServer(ConstantHanlder("hello"))
+	defer upstream.Close()
+
+	records := make(chan *AccountingRecord, 1)
+	proxy := NewProxyHttpServer()
+	proxy.TagMetrics = NewTagMetrics("test", "team", "project")
+	proxy.OnAccounting = func(rec *AccountingRecord) { records <- rec }
+	proxy.TenantIdentity = func(ctx *ProxyCtx) string { return "acme" }
+	proxy.NewTenant("acme").Labels = map[string]string{"team": "web", "project": "shop"}
+	proxy.OnRequest().DoFunc(func(r *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response) {
+		ctx.SetTag("project", "crawler")
+		return r, nil
+	})
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+	proxyURL, _ := url.Parse(s.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	resp, err := client.Get(upstream.URL)
+	orFatal("GET", err, t)
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	rec := <-records
+	if len(rec.Tags) != 2 || rec.Tags["team"] != "web" || rec.Tags["project"] != "crawler" {
+		t.Errorf("expected the labels of the tenant under the tags of the request, got %+v", rec)
+	}
+	if n := testutil.ToFloat64(proxy.TagMetrics.Bytes.WithLabelValues("web", "crawler", "received")); n != 5 {
+		t.Errorf("expected 5 bytes received by web, got %v", n)
+	}
+}
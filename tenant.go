@@ -0,0 +1,113 @@
+package goproxy
+
+import (
+	"crypto/tls"
+	"net/http"
+)
+
+// Tenant scopes part of the proxy configuration to a group of clients sharing the proxy.
+// Clients are mapped to a tenant from their auth identity (see ProxyHttpServer.TenantIdentity),
+// and the handlers registered through the OnRequest and OnResponse methods of a Tenant
+// only see the requests of that tenant, so that routing rules and blocklists don't have to
+// be multiplexed inside shared handlers.
+type Tenant struct {
+	Name string
+	// CA, if set, signs the certificates of the connections of the tenant that are MITMed,
+	// instead of the CA of the ConnectAction
+	CA *tls.Certificate
+	// CertStore caches the certificates signed by CA. As certificates are cached by host name,
+	// it must not be shared with other tenants or the proxy.
+	CertStore CertStorage
+	// Metrics, if set, replaces ForwardMetricsCounters for the requests of the tenant
+	Metrics *MetricsCounters
+	// Labels describe the tenant in accounting, they are the cost attribution tags of its
+	// requests and tunnels that the handlers didn't set, see ProxyCtx.SetTag
+	Labels map[string]string
+	// ResponseAnnotations, if set, replaces the ResponseAnnotations of the proxy for the
+	// requests of the tenant
+	ResponseAnnotations *ResponseAnnotations
+
+	proxy *ProxyHttpServer
+}
+
+// NewTenant registers a tenant named name on the proxy, replacing any tenant with the same name
+func (proxy *ProxyHttpServer) NewTenant(name string) *Tenant {
+	t := &Tenant{Name: name, proxy: proxy}
+	proxy.tenantsMu.Lock()
+	defer proxy.tenantsMu.Unlock()
+	if proxy.tenants == nil {
+		proxy.tenants = make(map[string]*Tenant)
+	}
+	proxy.tenants[name] = t
+	return t
+}
+
+// Tenant returns the tenant registered as name, or nil
+func (proxy *ProxyHttpServer) Tenant(name string) *Tenant {
+	proxy.tenantsMu.RLock()
+	defer proxy.tenantsMu.RUnlock()
+	return proxy.tenants[name]
+}
+
+// RemoveTenant unregisters the tenant named name. Its handlers stay registered but won't
+// match any request anymore.
+func (proxy *ProxyHttpServer) RemoveTenant(name string) {
+	proxy.tenantsMu.Lock()
+	defer proxy.tenantsMu.Unlock()
+	delete(proxy.tenants, name)
+}
+
+// OnRequest is like ProxyHttpServer.OnRequest, for the requests of the tenant only
+func (t *Tenant) OnRequest(conds ...ReqCondition) *ReqProxyConds {
+	return t.proxy.OnRequest(append([]ReqCondition{TenantIs(t.Name)}, conds...)...)
+}
+
+// OnResponse is like ProxyHttpServer.OnResponse, for the responses of the tenant only
+func (t *Tenant) OnResponse(conds ...RespCondition) *ProxyConds {
+	pcond := t.proxy.OnResponse(conds...)
+	pcond.reqConds = append(pcond.reqConds, TenantIs(t.Name))
+	return pcond
+}
+
+// TenantIs returns a ReqCondition testing whether the request belongs to one of the given tenants
+func TenantIs(names ...string) ReqConditionFunc {
+	return func(req *http.Request, ctx *ProxyCtx) bool {
+		t := ctx.Tenant()
+		if t == nil {
+			return false
+		}
+		for _, name := range names {
+			if t.Name == name {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Tenant returns the tenant of the client that sent the request, or nil if it doesn't belong to one.
+// The tenant is looked up the first time the identity of the client is known, so handlers
+// authenticating the client must run before the first handler scoped to a tenant.
+func (ctx *ProxyCtx) Tenant() *Tenant {
+	if ctx.tenant != nil || ctx.Proxy == nil {
+		return ctx.tenant
+	}
+	var identity string
+	if ctx.Proxy.TenantIdentity != nil {
+		identity = ctx.Proxy.TenantIdentity(ctx)
+	} else {
+		identity = ctx.ProxyUser
+	}
+	if identity == "" {
+		return nil
+	}
+	t := ctx.Proxy.Tenant(identity)
+	if t == nil {
+		return nil
+	}
+	ctx.tenant = t
+	if t.Metrics != nil {
+		ctx.ForwardMetricsCounters = *t.Metrics
+	}
+	return t
+}
@@ -0,0 +1,39 @@
+package goproxy
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestTenantScopedHandlers(t *testing.T) {
+	proxy := NewProxyHttpServer()
+	acme := proxy.NewTenant("acme")
+	proxy.NewTenant("globex")
+
+	proxy.OnRequest().DoFunc(func(r *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response) {
+		ctx.ProxyUser = r.Header.Get("X-User")
+		return r, nil
+	})
+	acme.OnRequest().DoFunc(func(r *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response) {
+		return nil, ctx.BlockedResponse(http.StatusForbidden, PolicyDecision{Policy: "blocklist"})
+	})
+
+	for user, blocked := range map[string]bool{"acme": true, "globex": false, "": false} {
+		req, _ := http.NewRequest("GET", "http://example.com/", nil)
+		req.Header.Set("X-User", user)
+		ctx := &ProxyCtx{Req: req, Proxy: proxy}
+		_, resp := proxy.filterRequest(req, ctx)
+		if (resp != nil) != blocked {
+			t.Errorf("user %q: expected blocked=%v, got response %v", user, blocked, resp)
+		}
+		if user != "" && (ctx.Tenant() == nil || ctx.Tenant().Name != user) {
+			t.Errorf("user %q: unexpected tenant %v", user, ctx.Tenant())
+		}
+	}
+
+	proxy.TenantIdentity = func(ctx *ProxyCtx) string { return "acme" }
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	if _, resp := proxy.filterRequest(req, &ProxyCtx{Req: req, Proxy: proxy}); resp == nil {
+		t.Error("expected TenantIdentity to map the request to acme")
+	}
+}
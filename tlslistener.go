@@ -0,0 +1,52 @@
+package goproxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+)
+
+// errNoTLSCertificates is the error of ServeTLS for a config without certificates
+var errNoTLSCertificates = errors.New("the TLS config of the proxy has no certificates")
+
+// ListenAndServeTLS listens on the TCP address addr and serves the clients connecting to it
+// over TLS, see ServeTLS
+func (proxy *ProxyHttpServer) ListenAndServeTLS(addr string, config *tls.Config) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return proxy.ServeTLS(l, config)
+}
+
+// ServeTLS serves the clients connecting to l over TLS, with the certificates of config, so
+// that they can be configured with a proxy URL like "https://proxy:3129" and their requests
+// to the proxy, credentials included, are encrypted. The CONNECT requests and the plain
+// requests in absolute form are read from the TLS stream as they are read from TCP
+// connections. HTTP/2 is negotiated with ALPN, as with ConfigureHTTP2, unless the NextProtos
+// of config are set without "h2". It returns when l fails to accept, and closes it. It fails
+// at once if config has no certificates.
+func (proxy *ProxyHttpServer) ServeTLS(l net.Listener, config *tls.Config) error {
+	if config == nil || (len(config.Certificates) == 0 && config.GetCertificate == nil && config.GetConfigForClient == nil) {
+		l.Close()
+		return errNoTLSCertificates
+	}
+	srv := &http.Server{Handler: proxy, TLSConfig: config.Clone()}
+	if protos := config.NextProtos; len(protos) > 0 && !hasProto(protos, "h2") {
+		// a non-nil map keeps net/http from configuring HTTP/2
+		srv.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+	} else if err := proxy.ConfigureHTTP2(srv); err != nil {
+		return err
+	}
+	return srv.ServeTLS(l, "", "")
+}
+
+func hasProto(protos []string, proto string) bool {
+	for _, p := range protos {
+		if p == proto {
+			return true
+		}
+	}
+	return false
+}
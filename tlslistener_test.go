@@ -0,0 +1,58 @@
+package goproxy
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestServeTLS(t *testing.T) {
+	target := httptest.NewServer(ConstantHanlder("bobo"))
+	defer target.Close()
+	tlsTarget := httptest.NewTLSServer(ConstantHanlder("tls bobo"))
+	defer tlsTarget.Close()
+
+	cert, err := signHost(GoproxyCa, []string{"127.0.0.1"})
+	orFatal("signHost", err, t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	orFatal("Listen", err, t)
+	go NewProxyHttpServer().ServeTLS(l, &tls.Config{Certificates: []tls.Certificate{*cert}})
+	defer l.Close()
+
+	proxyURL, _ := url.Parse("https://" + l.Addr().String())
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL),
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	for u, expected := range map[string]string{target.URL: "bobo", tlsTarget.URL: "tls bobo"} {
+		resp, err := client.Get(u)
+		orFatal("Get", err, t)
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != expected {
+			t.Errorf("expected %q through the TLS proxy for %s, got %s %q", expected, u, resp.Status, body)
+		}
+	}
+
+	conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"h2", "http/1.1"}})
+	orFatal("Dial", err, t)
+	conn.Close()
+	if p := conn.ConnectionState().NegotiatedProtocol; p != "h2" {
+		t.Errorf("expected HTTP/2 to be negotiated, got %q", p)
+	}
+}
+
+func TestServeTLSWithoutCertificates(t *testing.T) {
+	for _, config := range []*tls.Config{nil, {}} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		orFatal("Listen", err, t)
+		if err := NewProxyHttpServer().ServeTLS(l, config); err != errNoTLSCertificates {
+			t.Errorf("expected an error for %v, got %v", config, err)
+		}
+		if _, err := l.Accept(); err == nil {
+			t.Error("expected the listener to be closed")
+		}
+	}
+}
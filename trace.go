@@ -0,0 +1,342 @@
+package goproxy
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultTraceHeader is the request header enabling the trace of a request when
+// TracePolicy.Header is empty
+const DefaultTraceHeader = "X-Proxy-Trace"
+
+// TraceIDHeader is the response header holding the ID of the trace of a request, to get it
+// from the /traces/ID route of the admin API
+const TraceIDHeader = "X-Proxy-Trace-Id"
+
+// TracePolicy enables detailed diagnostic traces for the requests carrying a secret header,
+// e.g. "X-Proxy-Trace: <token>": the outcome of every handler, the upstream chosen, the
+// header as sent upstream and the timing breakdown of the request are recorded. The header
+// is removed from the requests forwarded.
+type TracePolicy struct {
+	// Header is the request header holding the token, DefaultTraceHeader if empty
+	Header string
+	// Token is the value of Header enabling the trace of a request, nothing is traced if it
+	// is empty
+	Token string
+	// Size is the number of traces kept, 64 if zero
+	Size int
+
+	once   sync.Once
+	traces *lruCache
+}
+
+// TraceEvent is a step of a RequestTrace, At is its time since the start of the request
+type TraceEvent struct {
+	At     time.Duration `json:"at"`
+	Stage  string        `json:"stage"`
+	Detail string        `json:"detail"`
+}
+
+// RequestTrace is the diagnostic trace of a request, see TracePolicy
+type RequestTrace struct {
+	ID       string        `json:"id"`
+	Session  int64         `json:"session"`
+	Method   string        `json:"method"`
+	URL      string        `json:"url"`
+	Started  time.Time     `json:"started"`
+	Duration time.Duration `json:"duration"`
+	Events   []TraceEvent  `json:"events"`
+	// Upstream is the forward proxy the request was sent through, "direct" without one
+	Upstream string `json:"upstream,omitempty"`
+	// RequestHeader is the header as sent upstream, secrets redacted
+	RequestHeader http.Header `json:"request_header,omitempty"`
+	StatusCode    int         `json:"status_code,omitempty"`
+	// Timings breaks down the duration of the request: dns, connect and tls
+	Timings map[string]time.Duration `json:"timings,omitempty"`
+
+	mu sync.Mutex
+}
+
+func (policy *TracePolicy) header() string {
+	if policy.Header != "" {
+		return policy.Header
+	}
+	return DefaultTraceHeader
+}
+
+func (policy *TracePolicy) store() *lruCache {
+	policy.once.Do(func() {
+		size := policy.Size
+		if size <= 0 {
+			size = 64
+		}
+		policy.traces = newLRUCache(size)
+	})
+	return policy.traces
+}
+
+// Trace returns a copy of the trace id, if it is still kept
+func (policy *TracePolicy) Trace(id string) (*RequestTrace, bool) {
+	v, ok := policy.store().get(id)
+	if !ok {
+		return nil, false
+	}
+	return v.(*RequestTrace).copy(), true
+}
+
+// Traces returns copies of the traces kept, most recent first
+func (policy *TracePolicy) Traces() []*RequestTrace {
+	c := policy.store()
+	c.mu.Lock()
+	traces := make([]*RequestTrace, 0, c.order.Len())
+	for e := c.order.Front(); e != nil; e = e.Next() {
+		traces = append(traces, e.Value.(*lruEntry).value.(*RequestTrace))
+	}
+	c.mu.Unlock()
+	for i, t := range traces {
+		traces[i] = t.copy()
+	}
+	return traces
+}
+
+func (t *RequestTrace) copy() *RequestTrace {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	c := &RequestTrace{ID: t.ID, Session: t.Session, Method: t.Method, URL: t.URL, Started: t.Started,
+		Duration: t.Duration, Upstream: t.Upstream, StatusCode: t.StatusCode}
+	c.Events = append([]TraceEvent(nil), t.Events...)
+	if t.RequestHeader != nil {
+		c.RequestHeader = cloneHeader(t.RequestHeader)
+	}
+	if t.Timings != nil {
+		c.Timings = make(map[string]time.Duration, len(t.Timings))
+		for k, v := range t.Timings {
+			c.Timings[k] = v
+		}
+	}
+	return c
+}
+
+// event records a step of the trace, it does nothing if t is nil
+func (t *RequestTrace) event(stage, format string, argv ...interface{}) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.Events = append(t.Events, TraceEvent{At: time.Since(t.Started), Stage: stage, Detail: fmt.Sprintf(format, argv...)})
+	t.mu.Unlock()
+}
+
+// startTrace starts the trace of the request r of ctx if it carries the trace token, and
+// removes the trace header from r. It returns the ID of the trace, "" if r is not traced.
+func (proxy *ProxyHttpServer) startTrace(ctx *ProxyCtx, r *http.Request) string {
+	policy := proxy.Tracing
+	if policy == nil || r == nil {
+		return ""
+	}
+	token := r.Header.Get(policy.header())
+	if token == "" {
+		return ""
+	}
+	r.Header.Del(policy.header())
+	if policy.Token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(policy.Token)) != 1 {
+		ctx.Warnf("ignoring %s header with an invalid token", policy.header())
+		return ""
+	}
+	return policy.start(ctx, r)
+}
+
+// start starts the trace of the request r of ctx, and returns its ID
+func (policy *TracePolicy) start(ctx *ProxyCtx, r *http.Request) string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	t := &RequestTrace{ID: hex.EncodeToString(id), Session: ctx.Session, Method: r.Method, Started: time.Now()}
+	if r.URL != nil {
+		t.URL = r.URL.String()
+	}
+	if r.Method == "CONNECT" {
+		t.URL = r.Host
+	}
+	ctx.trace = t
+	policy.store().set(t.ID, t, 0)
+	ctx.Logf("tracing request as %s", t.ID)
+	return t.ID
+}
+
+// traceRequest returns the state of the request r before a handler, nil if ctx is not traced
+func (ctx *ProxyCtx) traceRequest(r *http.Request) *tracedRequest {
+	if ctx.trace == nil || r == nil {
+		return nil
+	}
+	return &tracedRequest{start: time.Now(), route: shadowRoute(ctx), url: r.URL.String(), header: cloneHeader(r.Header)}
+}
+
+// tracedRequest is the state of a traced request before a handler
+type tracedRequest struct {
+	start  time.Time
+	route  string
+	url    string
+	header http.Header
+}
+
+// traceReqHandler records what the request handler name did to the request, given its state
+// before the handler
+func (ctx *ProxyCtx) traceReqHandler(name string, before *tracedRequest, req *http.Request, resp *http.Response) {
+	if before == nil {
+		return
+	}
+	var outcome string
+	switch {
+	case resp != nil:
+		outcome = "answered " + strconv.Itoa(resp.StatusCode)
+	case req == nil:
+		outcome = "dropped"
+	case shadowRoute(ctx) != before.route:
+		outcome = "rerouted"
+	case req.URL.String() != before.url || !headersEqual(req.Header, before.header):
+		outcome = "rewritten"
+	default:
+		outcome = "no change"
+	}
+	ctx.trace.event("request handler", "%s: %s in %v", handlerName(name), outcome, time.Since(before.start))
+}
+
+// traceConnectHandler records what the CONNECT handler name decided for host
+func (ctx *ProxyCtx) traceConnectHandler(name string, start time.Time, todo *ConnectAction, host string) {
+	if ctx.trace == nil {
+		return
+	}
+	outcome := "no decision"
+	if todo != nil {
+		outcome = connectActionName(todo.Action) + " " + host
+	}
+	ctx.trace.event("connect handler", "%s: %s in %v", handlerName(name), outcome, time.Since(start))
+}
+
+// traceRespHandler records whether the response handler name replaced the response
+func (ctx *ProxyCtx) traceRespHandler(name string, start time.Time, before, after *http.Response) {
+	if ctx.trace == nil {
+		return
+	}
+	outcome := "no change"
+	switch {
+	case after != before && after != nil:
+		outcome = "replaced with " + strconv.Itoa(after.StatusCode)
+	case after != before:
+		outcome = "dropped"
+	}
+	ctx.trace.event("response handler", "%s: %s in %v", handlerName(name), outcome, time.Since(start))
+}
+
+// traceUpstream records the upstream the request of ctx to host is sent to, and the header
+// sent, if any
+func (ctx *ProxyCtx) traceUpstream(host string, header http.Header) {
+	t := ctx.trace
+	if t == nil {
+		return
+	}
+	upstream := "direct"
+	if ctx.ForwardProxy != "" {
+		upstream = ctx.ForwardProxy
+	}
+	t.event("upstream", "sending to %s via %s", host, upstream)
+	t.mu.Lock()
+	t.Upstream = upstream
+	if header != nil {
+		t.RequestHeader = cloneHeader(header)
+		for k := range t.RequestHeader {
+			if secretHeaders[k] {
+				t.RequestHeader[k] = []string{redacted}
+			}
+		}
+	}
+	t.mu.Unlock()
+}
+
+// traceResponse records the status of the response to the traced request of ctx, and sets
+// the trace ID in its header h unless the request was traced because it was sampled
+func (ctx *ProxyCtx) traceResponse(h http.Header, statusCode int) {
+	t := ctx.trace
+	if t == nil {
+		return
+	}
+	if ctx.profile == nil || !ctx.profile.traced {
+		h.Set(TraceIDHeader, t.ID)
+	}
+	t.event("response", "status %d", statusCode)
+	t.mu.Lock()
+	t.StatusCode = statusCode
+	t.mu.Unlock()
+}
+
+// finishTrace records the duration and the timing breakdown of the traced request of ctx
+func (ctx *ProxyCtx) finishTrace() {
+	t := ctx.trace
+	if t == nil {
+		return
+	}
+	t.event("done", "")
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.Duration = time.Since(t.Started)
+	if ctx.DialTrace != nil {
+		t.Timings = map[string]time.Duration{
+			"dns":     ctx.DialTrace.DNSDuration(),
+			"connect": ctx.DialTrace.ConnectDuration(),
+			"tls":     ctx.DialTrace.TLSDuration(),
+		}
+	}
+}
+
+func handlerName(name string) string {
+	if name == "" {
+		return "(unnamed)"
+	}
+	return name
+}
+
+func connectActionName(action ConnectActionLiteral) string {
+	switch action {
+	case ConnectAccept:
+		return "accept"
+	case ConnectReject:
+		return "reject"
+	case ConnectMitm:
+		return "mitm"
+	case ConnectHijack:
+		return "hijack"
+	case ConnectHTTPMitm:
+		return "http mitm"
+	case ConnectProxyAuthHijack:
+		return "proxy auth hijack"
+	}
+	return "action " + strconv.Itoa(int(action))
+}
+
+// serveTraces serves the list of the traces on /traces, and a trace on /traces/ID
+func (proxy *ProxyHttpServer) serveTraces(w http.ResponseWriter, r *http.Request) {
+	if proxy.Tracing == nil {
+		http.Error(w, "tracing is not enabled", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", ContentTypeJSON)
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/traces"), "/")
+	if id == "" {
+		json.NewEncoder(w).Encode(proxy.Tracing.Traces())
+		return
+	}
+	t, ok := proxy.Tracing.Trace(id)
+	if !ok {
+		http.Error(w, "no trace "+id, http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(t)
+}
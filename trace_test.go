@@ -0,0 +1,84 @@
+package goproxy
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTraceRequest(t *testing.T) {
+	background := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(DefaultTraceHeader) != "" {
+			t.Errorf("trace header forwarded: %v", r.Header)
+		}
+		io.WriteString(w, "ok")
+	}))
+	defer background.Close()
+	proxy := NewProxyHttpServer()
+	proxy.Tracing = &TracePolicy{Token: "s3cret"}
+	proxy.OnRequest().Named("team").DoFunc(func(r *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response) {
+		r.Header.Set("X-Team", "net")
+		return r, nil
+	})
+	proxy.OnRequest().Named("noop").DoFunc(func(r *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response) {
+		return r, nil
+	})
+	srv := httptest.NewServer(proxy)
+	defer srv.Close()
+	proxyURL, _ := url.Parse(srv.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	get := func(token string) *http.Response {
+		req, _ := http.NewRequest("GET", background.URL+"/traced", nil)
+		req.Header.Set(DefaultTraceHeader, token)
+		req.Header.Set("Authorization", "Bearer xyz")
+		resp, err := client.Do(req)
+		orFatal("Do", err, t)
+		resp.Body.Close()
+		return resp
+	}
+	if resp := get("wrong"); resp.Header.Get(TraceIDHeader) != "" {
+		t.Errorf("request traced with a wrong token")
+	}
+	resp := get("s3cret")
+	id := resp.Header.Get(TraceIDHeader)
+	if id == "" {
+		t.Fatalf("no trace ID in %v", resp.Header)
+	}
+
+	// the trace is finished once the response is sent
+	var rec *httptest.ResponseRecorder
+	var trace RequestTrace
+	for i := 0; i < 100 && trace.Duration == 0; i++ {
+		time.Sleep(time.Millisecond)
+		rec = httptest.NewRecorder()
+		proxy.AdminHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/traces/"+id, nil))
+		orFatal("Unmarshal", json.Unmarshal(rec.Body.Bytes(), &trace), t)
+	}
+	if trace.StatusCode != 200 || trace.Upstream != "direct" || trace.RequestHeader.Get("X-Team") != "net" ||
+		trace.RequestHeader.Get("Authorization") != redacted || trace.Duration <= 0 {
+		t.Errorf("unexpected trace %s", rec.Body)
+	}
+	var stages []string
+	for _, e := range trace.Events {
+		stages = append(stages, e.Stage+" "+strings.Split(e.Detail, " in ")[0])
+	}
+	expected := "request handler team: rewritten,request handler noop: no change,upstream sending to " +
+		background.Listener.Addr().String() + " via direct,response status 200,done "
+	if strings.Join(stages, ",") != expected {
+		t.Errorf("unexpected events %q", stages)
+	}
+
+	rec = httptest.NewRecorder()
+	proxy.AdminHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/traces", nil))
+	var traces []RequestTrace
+	orFatal("Unmarshal", json.Unmarshal(rec.Body.Bytes(), &traces), t)
+	if len(traces) != 1 || traces[0].ID != id {
+		t.Errorf("unexpected traces %s", rec.Body)
+	}
+}
@@ -0,0 +1,34 @@
+package goproxy
+
+import (
+	"net/http"
+)
+
+// The trailers of the requests and of the responses, e.g. the status of the gRPC-web calls or
+// the checksums of the chunked uploads, are relayed as they are. They are only known once the
+// bodies are read, so they are announced in the Trailer header and written after the bodies.
+
+// sendTrailers makes req carry its trailers, which need a chunked body
+func sendTrailers(req *http.Request) {
+	if len(req.Trailer) == 0 || req.Body == nil || req.Body == http.NoBody {
+		return
+	}
+	req.ContentLength = -1
+	req.TransferEncoding = []string{"chunked"}
+}
+
+// announceTrailers declares the trailers of resp in the header h of the response to the
+// client, before it is written
+func announceTrailers(h http.Header, resp *http.Response) {
+	for k := range resp.Trailer {
+		h.Add("Trailer", k)
+	}
+}
+
+// copyTrailers sets the trailers of resp in the header h of the response to the client, once
+// its body is read
+func copyTrailers(h http.Header, resp *http.Response) {
+	for k, vs := range resp.Trailer {
+		h[http.TrailerPrefix+k] = vs
+	}
+}
@@ -0,0 +1,61 @@
+package goproxy
+
+import (
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestTrailers(t *testing.T) {
+	echo := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Echo")
+		ioutil.ReadAll(r.Body)
+		io.WriteString(w, "body")
+		w.Header().Set("X-Echo", r.Trailer.Get("X-Checksum"))
+	})
+	for _, tc := range []struct {
+		name   string
+		scheme string
+		setup  func(proxy *ProxyHttpServer)
+	}{
+		{"plain", "http", func(proxy *ProxyHttpServer) {
+			proxy.OnRequest().DoFunc(func(r *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response) { return r, nil })
+		}},
+		{"fast path", "http", func(proxy *ProxyHttpServer) { proxy.FastPath = true }},
+		{"mitm", "https", func(proxy *ProxyHttpServer) { proxy.OnRequest().HandleConnect(AlwaysMitm) }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// the mitm'd requests reach the backend as they are
+			backend := httptest.NewServer(echo)
+			defer backend.Close()
+			proxy := NewProxyHttpServer()
+			tc.setup(proxy)
+			s := httptest.NewServer(proxy)
+			defer s.Close()
+			proxyURL, _ := url.Parse(s.URL)
+			client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL),
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+
+			req, err := http.NewRequest("POST", tc.scheme+"://"+backend.Listener.Addr().String(), ioutil.NopCloser(strings.NewReader("upload")))
+			orFatal("NewRequest", err, t)
+			req.ContentLength = -1
+			req.Trailer = http.Header{"X-Checksum": {"42"}}
+			resp, err := client.Do(req)
+			orFatal("Do", err, t)
+			body, err := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			orFatal("ReadAll", err, t)
+			if string(body) != "body" {
+				t.Errorf("unexpected body %q", body)
+			}
+			if got := resp.Trailer.Get("X-Echo"); got != "42" {
+				t.Errorf("expected the trailers relayed both ways, got %q", got)
+			}
+		})
+	}
+}
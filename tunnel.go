@@ -0,0 +1,55 @@
+package goproxy
+
+import (
+	"net"
+	"syscall"
+)
+
+// Engines relaying the CONNECT tunnels, see ProxyCtx.TunnelEngine
+const (
+	// TunnelEngineGoroutines relays each tunnel with two goroutines copying its directions
+	TunnelEngineGoroutines = "goroutines"
+	// TunnelEngineEpoll relays the tunnels from a single event loop polling their sockets with
+	// epoll, without a goroutine per direction. It is only available on Linux, for tunnels
+	// between two plain TCP connections; the other tunnels are relayed with goroutines. The
+	// read and write deadlines of the proxy are not enforced on these tunnels, only the TCP
+	// keep-alives are.
+	TunnelEngineEpoll = "epoll"
+)
+
+// tunnelEngine returns the engine relaying the tunnel of ctx
+func (ctx *ProxyCtx) tunnelEngine() string {
+	if ctx.TunnelEngine != "" {
+		return ctx.TunnelEngine
+	}
+	if ctx.Proxy != nil && ctx.Proxy.TunnelEngine != "" {
+		return ctx.Proxy.TunnelEngine
+	}
+	return TunnelEngineGoroutines
+}
+
+// countTunnel counts a tunnel relayed by engine in TunnelMetric
+func (proxy *ProxyHttpServer) countTunnel(engine string, bytes int64, err error) {
+	if proxy.TunnelMetric == nil {
+		return
+	}
+	proxy.TunnelMetric.WithLabelValues(engine, "tunnels").Inc()
+	proxy.TunnelMetric.WithLabelValues(engine, "bytes").Add(float64(bytes))
+	if err != nil {
+		proxy.TunnelMetric.WithLabelValues(engine, "errors").Inc()
+	}
+}
+
+// rawTCPConn returns the TCP connection of conn if reading and writing its socket directly
+// is equivalent to reading and writing conn
+func rawTCPConn(conn net.Conn) (syscall.RawConn, bool) {
+	if c, ok := conn.(*ProxyTCPConn); ok {
+		conn = c.Conn
+	}
+	tcp, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil, false
+	}
+	raw, err := tcp.SyscallConn()
+	return raw, err == nil
+}
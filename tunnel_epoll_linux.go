@@ -0,0 +1,236 @@
+package goproxy
+
+import (
+	"sync"
+	"syscall"
+)
+
+// epollEvents are the events always reported by epoll, whatever the interest of a socket
+const epollEvents = syscall.EPOLLERR | syscall.EPOLLHUP
+
+// epollEngine relays the tunnels of TunnelEngineEpoll from a single goroutine. The sockets
+// are level-triggered: a side is polled for reading while its peer has nothing pending, and
+// for writing while it has something pending.
+type epollEngine struct {
+	fd  int
+	buf []byte
+
+	mu    sync.Mutex
+	sides map[int32]*epollSide
+}
+
+// epollSide is a socket of a tunnel of the epoll engine
+type epollSide struct {
+	fd     int
+	peer   *epollSide
+	tunnel *epollTunnel
+	// the bytes read from the peer not written yet
+	pending []byte
+	// the bytes read from this side
+	read int64
+	// whether this side was read entirely, and its peer shut down for writing
+	eof      bool
+	shutdown bool
+	interest uint32
+}
+
+type epollTunnel struct {
+	done chan struct{}
+	err  error
+}
+
+var (
+	epollOnce sync.Once
+	epoll     *epollEngine
+	epollErr  error
+)
+
+// relayEpoll relays the tunnel between client and target with the epoll engine, and returns
+// the bytes sent to target and received from it once the tunnel is done. ok is false if the
+// tunnel can't be relayed with epoll, it wasn't touched then.
+func relayEpoll(client, target *ProxyTCPConn) (sent, received int64, ok bool, err error) {
+	epollOnce.Do(func() {
+		fd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+		if err != nil {
+			epollErr = err
+			return
+		}
+		epoll = &epollEngine{fd: fd, buf: make([]byte, copyBufferSize), sides: make(map[int32]*epollSide)}
+		go epoll.loop()
+	})
+	if epollErr != nil {
+		return 0, 0, false, nil
+	}
+	rawClient, ok := rawTCPConn(client)
+	if !ok {
+		return 0, 0, false, nil
+	}
+	rawTarget, ok := rawTCPConn(target)
+	if !ok {
+		return 0, 0, false, nil
+	}
+	// the sockets stay open until the tunnel is done, their descriptors can't be reused
+	// before then
+	var clientFd, targetFd int
+	rawClient.Control(func(fd uintptr) { clientFd = int(fd) })
+	rawTarget.Control(func(fd uintptr) { targetFd = int(fd) })
+
+	t := &epollTunnel{done: make(chan struct{})}
+	c := &epollSide{fd: clientFd, tunnel: t}
+	s := &epollSide{fd: targetFd, tunnel: t, peer: c}
+	c.peer = s
+	if err := epoll.add(c, s); err != nil {
+		return 0, 0, false, nil
+	}
+	<-t.done
+	client.BytesRead, target.BytesWrote = c.read, c.read
+	target.BytesRead, client.BytesWrote = s.read, s.read
+	return c.read, s.read, true, t.err
+}
+
+func (e *epollEngine) add(sides ...*epollSide) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for i, s := range sides {
+		s.interest = syscall.EPOLLIN
+		ev := syscall.EpollEvent{Events: s.interest, Fd: int32(s.fd)}
+		if err := syscall.EpollCtl(e.fd, syscall.EPOLL_CTL_ADD, s.fd, &ev); err != nil {
+			for _, added := range sides[:i] {
+				syscall.EpollCtl(e.fd, syscall.EPOLL_CTL_DEL, added.fd, nil)
+				delete(e.sides, int32(added.fd))
+			}
+			return err
+		}
+		e.sides[int32(s.fd)] = s
+	}
+	return nil
+}
+
+func (e *epollEngine) loop() {
+	events := make([]syscall.EpollEvent, 128)
+	for {
+		n, err := syscall.EpollWait(e.fd, events, -1)
+		if err != nil {
+			continue
+		}
+		for _, ev := range events[:n] {
+			e.mu.Lock()
+			s := e.sides[ev.Fd]
+			e.mu.Unlock()
+			if s != nil {
+				e.handle(s, ev.Events)
+			}
+		}
+	}
+}
+
+// handle relays what the events of s allow
+func (e *epollEngine) handle(s *epollSide, events uint32) {
+	if events&syscall.EPOLLERR != 0 {
+		errno, err := syscall.GetsockoptInt(s.fd, syscall.SOL_SOCKET, syscall.SO_ERROR)
+		if err == nil && errno != 0 {
+			err = syscall.Errno(errno)
+		}
+		e.finish(s, err)
+		return
+	}
+	if events&syscall.EPOLLOUT != 0 && len(s.pending) > 0 {
+		if !e.flush(s) {
+			return
+		}
+	}
+	if events&(syscall.EPOLLIN|syscall.EPOLLHUP) != 0 && !s.eof && len(s.peer.pending) == 0 {
+		n, err := syscall.Read(s.fd, e.buf)
+		switch {
+		case err == syscall.EAGAIN || err == syscall.EINTR:
+		case err != nil:
+			e.finish(s, err)
+			return
+		case n == 0:
+			s.eof = true
+		default:
+			s.read += int64(n)
+			s.peer.pending = e.buf[:n]
+			if !e.flush(s.peer) {
+				return
+			}
+			if len(s.peer.pending) > 0 {
+				// the buffer is shared by the tunnels
+				s.peer.pending = append([]byte(nil), s.peer.pending...)
+			}
+		}
+	} else if events&syscall.EPOLLHUP != 0 && s.eof {
+		// both directions of s are closed, nothing can be written to it anymore
+		e.finish(s, nil)
+		return
+	}
+	if s.eof && len(s.peer.pending) == 0 && !s.peer.shutdown {
+		s.peer.shutdown = true
+		syscall.Shutdown(s.peer.fd, syscall.SHUT_WR)
+	}
+	if s.eof && s.peer.eof && len(s.pending) == 0 && len(s.peer.pending) == 0 {
+		e.finish(s, nil)
+		return
+	}
+	e.update(s)
+	e.update(s.peer)
+}
+
+// flush writes the bytes pending for s, it returns false if the tunnel is done
+func (e *epollEngine) flush(s *epollSide) bool {
+	for len(s.pending) > 0 {
+		n, err := syscall.Write(s.fd, s.pending)
+		if err == syscall.EAGAIN {
+			break
+		}
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			e.finish(s, err)
+			return false
+		}
+		s.pending = s.pending[n:]
+	}
+	if len(s.pending) == 0 {
+		s.pending = nil
+	}
+	return true
+}
+
+// update polls s for the events it is waiting for
+func (e *epollEngine) update(s *epollSide) {
+	var interest uint32
+	if !s.eof && len(s.peer.pending) == 0 {
+		interest |= syscall.EPOLLIN
+	}
+	if len(s.pending) > 0 {
+		interest |= syscall.EPOLLOUT
+	}
+	if interest == s.interest {
+		return
+	}
+	s.interest = interest
+	ev := syscall.EpollEvent{Events: interest, Fd: int32(s.fd)}
+	if err := syscall.EpollCtl(e.fd, syscall.EPOLL_CTL_MOD, s.fd, &ev); err != nil {
+		e.finish(s, err)
+	}
+}
+
+// finish stops polling the tunnel of s and wakes up relayEpoll
+func (e *epollEngine) finish(s *epollSide, err error) {
+	e.mu.Lock()
+	for _, side := range []*epollSide{s, s.peer} {
+		if e.sides[int32(side.fd)] == side {
+			syscall.EpollCtl(e.fd, syscall.EPOLL_CTL_DEL, side.fd, nil)
+			delete(e.sides, int32(side.fd))
+		}
+	}
+	e.mu.Unlock()
+	select {
+	case <-s.tunnel.done:
+	default:
+		s.tunnel.err = err
+		close(s.tunnel.done)
+	}
+}
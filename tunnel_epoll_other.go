@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package goproxy
+
+// relayEpoll is not available on this platform, the tunnels are relayed with goroutines
+func relayEpoll(client, target *ProxyTCPConn) (sent, received int64, ok bool, err error) {
+	return 0, 0, false, nil
+}
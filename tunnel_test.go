@@ -0,0 +1,95 @@
+package goproxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// echoServer echoes the first n bytes the connections send, then closes them
+func echoServer(t *testing.T, n int64) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	orFatal("Listen", err, t)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.CopyN(conn, conn, n)
+				conn.Close()
+			}()
+		}
+	}()
+	return l
+}
+
+func TestTunnelEngines(t *testing.T) {
+	payload := make([]byte, 4<<20)
+	rand.Read(payload)
+	echo := echoServer(t, int64(len(payload)))
+	defer echo.Close()
+	proxy := NewProxyHttpServer()
+	proxy.TunnelEngine = TunnelEngineEpoll
+	proxy.AdaptiveBuffers = &AdaptiveBuffers{Min: 1024, Max: 64 * 1024}
+	proxy.TunnelMetric = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "tunnels"}, []string{"engine", "counter"})
+	proxy.OnRequest().HandleConnectFunc(func(host string, ctx *ProxyCtx) (*ConnectAction, string) {
+		switch engine := ctx.Req.Header.Get("X-Engine"); engine {
+		case "coalesced":
+			ctx.WriteCoalescing = &WriteCoalescing{Nagle: true}
+		case "":
+		default:
+			ctx.TunnelEngine = engine
+		}
+		return OkConnect, host
+	})
+	srv := httptest.NewServer(proxy)
+	defer srv.Close()
+
+	for _, engine := range []string{"", TunnelEngineGoroutines, "coalesced"} {
+		conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+		orFatal("Dial", err, t)
+		host := echo.Addr().String()
+		io.WriteString(conn, "CONNECT "+host+" HTTP/1.1\r\nHost: "+host+"\r\nX-Engine: "+engine+"\r\n\r\n")
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, nil)
+		orFatal("ReadResponse", err, t)
+		if resp.StatusCode != 200 {
+			t.Fatalf("unexpected CONNECT response %s", resp.Status)
+		}
+		// the echo is read while the payload is sent, so that the tunnel is filled both ways
+		go conn.Write(payload)
+		echoed := make([]byte, len(payload))
+		_, err = io.ReadFull(br, echoed)
+		orFatal("ReadFull", err, t)
+		conn.Close()
+		if !bytes.Equal(echoed, payload) {
+			t.Errorf("%q engine echoed %d bytes out of %d", engine, len(echoed), len(payload))
+		}
+	}
+
+	// the coalesced tunnels are relayed with goroutines
+	expected := map[string]int{TunnelEngineEpoll: 1, TunnelEngineGoroutines: 2}
+	for engine, tunnels := range expected {
+		// the tunnels are accounted once the proxy closed them
+		for i := 0; i < 100 && int(testutil.ToFloat64(proxy.TunnelMetric.WithLabelValues(engine, "tunnels"))) < tunnels; i++ {
+			time.Sleep(time.Millisecond)
+		}
+		if n := testutil.ToFloat64(proxy.TunnelMetric.WithLabelValues(engine, "tunnels")); int(n) != tunnels {
+			t.Errorf("%d tunnels relayed by %s", int(n), engine)
+		}
+		if n := testutil.ToFloat64(proxy.TunnelMetric.WithLabelValues(engine, "bytes")); n != float64(2*tunnels*len(payload)) {
+			t.Errorf("%d bytes relayed by %s", int(n), engine)
+		}
+	}
+}
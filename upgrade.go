@@ -0,0 +1,134 @@
+package goproxy
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// PolicyUpgrade is the policy of the upgrades refused by ProxyHttpServer.OnUpgrade
+const PolicyUpgrade = "upgrade"
+
+// The requests upgrading their connection to another protocol than WebSocket, e.g. h2c or a
+// custom protocol, are sent upstream on a connection of their own. Once the server answers 101
+// Switching Protocols, the proxy relays the bytes of both sides as they are, like a CONNECT
+// tunnel, and accounts them.
+
+// upgradeProtocol returns the protocol the request r upgrades its connection to, if any
+func upgradeProtocol(r *http.Request) string {
+	upgrade := r.Header.Get("Upgrade")
+	if upgrade == "" {
+		return ""
+	}
+	for _, v := range r.Header["Connection"] {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return upgrade
+			}
+		}
+	}
+	return ""
+}
+
+// isUpgradeRequest reports whether r asks to upgrade its connection to another protocol
+func isUpgradeRequest(r *http.Request) bool {
+	return upgradeProtocol(r) != ""
+}
+
+// refuseUpgrade returns the response refusing the upgrade request req of ctx if OnUpgrade
+// refuses it, nil otherwise
+func (proxy *ProxyHttpServer) refuseUpgrade(ctx *ProxyCtx, req *http.Request) *http.Response {
+	if proxy.OnUpgrade == nil {
+		return nil
+	}
+	protocol := upgradeProtocol(req)
+	if proxy.OnUpgrade(protocol, ctx) {
+		return nil
+	}
+	ctx.Warnf("Refusing the upgrade of %s to %s", req.URL.Host, protocol)
+	return ctx.BlockedResponse(http.StatusForbidden, PolicyDecision{Policy: PolicyUpgrade, RuleID: protocol,
+		Reason: "upgrade to " + protocol + " is not allowed"})
+}
+
+// hijackUpgrade serves the upgrade request r of a plain HTTP client
+func (proxy *ProxyHttpServer) hijackUpgrade(w http.ResponseWriter, r *http.Request, ctx *ProxyCtx) {
+	hij, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "cannot upgrade the connection", http.StatusInternalServerError)
+		return
+	}
+	conn, brw, err := hij.Hijack()
+	if err != nil {
+		ctx.Warnf("Cannot hijack the upgraded connection: %v", err)
+		return
+	}
+	client := hijackedConn(conn, brw)
+	defer client.Close()
+	proxy.serveUpgrade(ctx, r, client, client)
+}
+
+// serveUpgrade sends the upgrade request req upstream, answers the client with the response of
+// the server, and relays the upgraded connections once both sides switched protocols. The
+// client is read from r, which may buffer conn.
+func (proxy *ProxyHttpServer) serveUpgrade(ctx *ProxyCtx, req *http.Request, r io.Reader, conn net.Conn) {
+	// the Connection header may list other headers of the upgrade, e.g. HTTP2-Settings
+	connection := req.Header["Connection"]
+	removeProxyHeaders(ctx, req)
+	req.Header["Connection"] = connection
+	resp := proxy.refuseUpgrade(ctx, req)
+	var err error
+	if resp == nil {
+		if resp, err = ctx.roundTripWebSocket(req); err != nil {
+			ctx.Warnf("Cannot upgrade the connection to %s: %v", req.URL.Host, err)
+			resp = NewResponse(req, ContentTypeText, http.StatusBadGateway, "Bad Gateway")
+		}
+	}
+	upstream, ok := resp.Body.(io.ReadWriteCloser)
+	if resp.StatusCode != http.StatusSwitchingProtocols || !ok {
+		resp = proxy.filterResponse(proxy.validateResponseHeaders(resp, ctx), ctx)
+		if resp == nil {
+			return
+		}
+		defer resp.Body.Close()
+		resp.Close = true
+		if err := resp.Write(conn); err != nil {
+			ctx.Warnf("Cannot write the upgrade response: %v", err)
+		}
+		return
+	}
+	defer upstream.Close()
+	if err := writeUpgradeResponse(conn, resp); err != nil {
+		ctx.Warnf("Cannot write the upgrade response: %v", err)
+		return
+	}
+	ctx.Debugf(DebugTunnel, "Connection to %s upgraded to %s", req.URL.Host, resp.Header.Get("Upgrade"))
+	defer proxy.trackSession(ctx, SessionTunnel, req.URL.Host)()
+	proxy.relayUpgrade(ctx, r, conn, upstream, upstream, func() {
+		conn.Close()
+		upstream.Close()
+	})
+}
+
+// relayUpgrade relays an upgraded connection between the client and the server as it is.
+// closeAll closes both connections.
+func (proxy *ProxyHttpServer) relayUpgrade(ctx *ProxyCtx, clientR io.Reader, clientW io.Writer, serverR io.Reader, serverW io.Writer, closeAll func()) {
+	var sent, received int64
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		sent, _ = io.Copy(serverW, clientR)
+		closeAll()
+	}()
+	go func() {
+		defer wg.Done()
+		received, _ = io.Copy(clientW, serverR)
+		closeAll()
+	}()
+	wg.Wait()
+	ctx.BytesSent += sent
+	ctx.BytesReceived += received
+	proxy.account(ctx)
+}
@@ -0,0 +1,82 @@
+package goproxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestUpgradeTunnel(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if upgradeProtocol(r) != "echo/1" || r.Header.Get("Echo-Settings") != "loud" {
+			http.Error(w, "unexpected upgrade request", http.StatusBadRequest)
+			return
+		}
+		conn, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: echo/1\r\nConnection: Upgrade\r\n\r\n")
+		io.Copy(conn, brw)
+	}))
+	defer server.Close()
+
+	var protocols []string
+	records := make(chan *AccountingRecord, 1)
+	proxy := NewProxyHttpServer()
+	proxy.OnUpgrade = func(protocol string, ctx *ProxyCtx) bool {
+		protocols = append(protocols, protocol)
+		return protocol != "refused/1"
+	}
+	proxy.OnAccounting = func(rec *AccountingRecord) { records <- rec }
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	upgrade := func(protocol string) (net.Conn, *bufio.Reader, *http.Response) {
+		conn, err := net.Dial("tcp", s.Listener.Addr().String())
+		orFatal("Dial", err, t)
+		req, _ := http.NewRequest("GET", server.URL+"/", nil)
+		req.Header.Set("Upgrade", protocol)
+		req.Header.Set("Connection", "Upgrade, Echo-Settings")
+		req.Header.Set("Echo-Settings", "loud")
+		orFatal("WriteProxy", req.WriteProxy(conn), t)
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, req)
+		orFatal("ReadResponse", err, t)
+		return conn, br, resp
+	}
+
+	conn, br, resp := upgrade("echo/1")
+	defer conn.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected the connection to be upgraded, got %s", resp.Status)
+	}
+	io.WriteString(conn, "ping")
+	buf := make([]byte, 4)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err := io.ReadFull(br, buf)
+	orFatal("ReadFull", err, t)
+	if string(buf) != "ping" {
+		t.Errorf("expected the bytes to be relayed as they are, got %q", buf)
+	}
+	conn.Close()
+	select {
+	case rec := <-records:
+		if rec.BytesSent != 4 || rec.BytesReceived != 4 {
+			t.Errorf("expected the upgraded connection to be accounted, got %+v", rec)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("expected the upgraded connection to be accounted")
+	}
+
+	conn2, _, resp := upgrade("refused/1")
+	defer conn2.Close()
+	if resp.StatusCode != http.StatusForbidden || len(protocols) != 2 {
+		t.Errorf("expected OnUpgrade to refuse the upgrade, got %s %v", resp.Status, protocols)
+	}
+}
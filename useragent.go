@@ -0,0 +1,77 @@
+package goproxy
+
+import "net/http"
+
+// UserAgentMode is what a UserAgentPolicy does with the User-Agent of the clients
+type UserAgentMode int
+
+const (
+	// UserAgentPreserve forwards the User-Agent of the client, and none if the client sent none
+	UserAgentPreserve UserAgentMode = iota
+	// UserAgentStrip forwards the requests without User-Agent
+	UserAgentStrip
+	// UserAgentOverride replaces the User-Agent of the client with UserAgentPolicy.UserAgent
+	UserAgentOverride
+)
+
+func (m UserAgentMode) String() string {
+	switch m {
+	case UserAgentPreserve:
+		return "preserve"
+	case UserAgentStrip:
+		return "strip"
+	case UserAgentOverride:
+		return "override"
+	}
+	return "unknown"
+}
+
+// UserAgentPolicy controls the User-Agent sent to the upstream servers. It can be set for the
+// whole proxy, and overridden per request by setting ProxyCtx.UserAgentPolicy in a request
+// handler, see SetUserAgentPolicy. The User-Agent is preserved if there is no policy.
+type UserAgentPolicy struct {
+	Mode UserAgentMode
+	// UserAgent is sent instead of the one of the client with UserAgentOverride
+	UserAgent string
+}
+
+// SetUserAgentPolicy returns a ReqHandler applying policy to the requests it handles
+//
+//	proxy.OnRequest(goproxy.ReqHostIs("example.com")).Do(goproxy.SetUserAgentPolicy(
+//		&goproxy.UserAgentPolicy{Mode: goproxy.UserAgentOverride, UserAgent: "Mozilla/5.0"}))
+func SetUserAgentPolicy(policy *UserAgentPolicy) ReqHandler {
+	return FuncReqHandler(func(r *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response) {
+		ctx.UserAgentPolicy = policy
+		return r, nil
+	})
+}
+
+// userAgentPolicy returns the policy of the request, falling back to the one of the proxy
+func (ctx *ProxyCtx) userAgentPolicy() *UserAgentPolicy {
+	if ctx.UserAgentPolicy != nil {
+		return ctx.UserAgentPolicy
+	}
+	if ctx.Proxy != nil {
+		return ctx.Proxy.UserAgentPolicy
+	}
+	return nil
+}
+
+// setUpstreamUserAgent sets the User-Agent of the request sent upstream. An empty User-Agent
+// header keeps the transports from sending their own.
+func (ctx *ProxyCtx) setUpstreamUserAgent(req *http.Request) {
+	mode, userAgent := UserAgentPreserve, ""
+	if policy := ctx.userAgentPolicy(); policy != nil {
+		mode, userAgent = policy.Mode, policy.UserAgent
+	}
+	switch mode {
+	case UserAgentStrip:
+		req.Header.Set("User-Agent", "")
+	case UserAgentOverride:
+		req.Header.Set("User-Agent", userAgent)
+	default:
+		if req.Header.Get("User-Agent") == "" {
+			req.Header.Set("User-Agent", "")
+		}
+	}
+}
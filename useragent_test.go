@@ -0,0 +1,35 @@
+package goproxy
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestUserAgentPolicy(t *testing.T) {
+	proxy := NewProxyHttpServer()
+	proxy.UserAgentPolicy = &UserAgentPolicy{Mode: UserAgentStrip}
+	proxy.OnRequest(ReqHostIs("example.com")).Do(SetUserAgentPolicy(&UserAgentPolicy{Mode: UserAgentOverride, UserAgent: "bobo/1.0"}))
+
+	for _, c := range []struct {
+		url, ua, expected string
+	}{
+		{"http://example.com/", "curl/7.0", "bobo/1.0"},
+		{"http://example.org/", "curl/7.0", ""},
+	} {
+		req, _ := http.NewRequest("GET", c.url, nil)
+		req.Header.Set("User-Agent", c.ua)
+		ctx := &ProxyCtx{Req: req, Proxy: proxy}
+		req, _ = proxy.filterRequest(req, ctx)
+		ctx.setUpstreamUserAgent(req)
+		if ua, ok := req.Header["User-Agent"]; !ok || ua[0] != c.expected || ctx.OriginalUserAgent != c.ua {
+			t.Errorf("%s: unexpected User-Agent %q, original %q", c.url, ua, ctx.OriginalUserAgent)
+		}
+	}
+
+	// without User-Agent, none is sent rather than the default of the transport
+	req, _ := http.NewRequest("GET", "http://example.net/", nil)
+	(&ProxyCtx{Req: req}).setUpstreamUserAgent(req)
+	if ua, ok := req.Header["User-Agent"]; !ok || ua[0] != "" {
+		t.Errorf("unexpected User-Agent %q", ua)
+	}
+}
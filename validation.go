@@ -0,0 +1,111 @@
+package goproxy
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ResponseHeadersHandler validates the headers of a response from the upstream server before
+// its body is relayed to the client. It returns a non nil PolicyDecision to reject the response.
+type ResponseHeadersHandler interface {
+	HandleResponseHeaders(resp *http.Response, ctx *ProxyCtx) *PolicyDecision
+}
+
+// FuncResponseHeadersHandler.HandleResponseHeaders(resp,ctx) <=> FuncResponseHeadersHandler(resp,ctx)
+type FuncResponseHeadersHandler func(resp *http.Response, ctx *ProxyCtx) *PolicyDecision
+
+func (f FuncResponseHeadersHandler) HandleResponseHeaders(resp *http.Response, ctx *ProxyCtx) *PolicyDecision {
+	return f(resp, ctx)
+}
+
+// ResponseHeadersConds aggregates RespConditions for the response headers handlers of a
+// ProxyHttpServer
+type ResponseHeadersConds struct {
+	proxy    *ProxyHttpServer
+	respCond []RespCondition
+}
+
+// OnResponseHeaders is used to validate the responses of upstream servers before their body
+// is read. Rejected responses are replaced by a 502 Bad Gateway BlockedResponse carrying the
+// PolicyDecision, and their body is never relayed. For example, to reject large downloads:
+//
+//	proxy.OnResponseHeaders().DoFunc(func(resp *http.Response, ctx *goproxy.ProxyCtx) *goproxy.PolicyDecision {
+//		if resp.ContentLength > 100<<20 {
+//			return &goproxy.PolicyDecision{Policy: "size", Reason: "response too large"}
+//		}
+//		return nil
+//	})
+func (proxy *ProxyHttpServer) OnResponseHeaders(conds ...RespCondition) *ResponseHeadersConds {
+	return &ResponseHeadersConds{proxy, conds}
+}
+
+// Do registers h, it is called for the responses matching all the conditions
+func (pcond *ResponseHeadersConds) Do(h ResponseHeadersHandler) {
+	pcond.proxy.respHeadersHandlers = append(pcond.proxy.respHeadersHandlers,
+		FuncResponseHeadersHandler(func(resp *http.Response, ctx *ProxyCtx) *PolicyDecision {
+			for _, cond := range pcond.respCond {
+				if !cond.HandleResp(resp, ctx) {
+					return nil
+				}
+			}
+			return h.HandleResponseHeaders(resp, ctx)
+		}))
+}
+
+// DoFunc is equivalent to proxy.OnResponseHeaders().Do(FuncResponseHeadersHandler(f))
+func (pcond *ResponseHeadersConds) DoFunc(f func(resp *http.Response, ctx *ProxyCtx) *PolicyDecision) {
+	pcond.Do(FuncResponseHeadersHandler(f))
+}
+
+// Reject rejects the responses matching all the conditions with the decision d
+//
+//	proxy.OnResponseHeaders(goproxy.RedirectHostIs("blocked.example.com")).
+//		Reject(goproxy.PolicyDecision{Policy: "blocklist", Reason: "redirect to a blocked host"})
+func (pcond *ResponseHeadersConds) Reject(d PolicyDecision) {
+	pcond.DoFunc(func(resp *http.Response, ctx *ProxyCtx) *PolicyDecision {
+		return &d
+	})
+}
+
+// RedirectHostIs returns a RespCondition testing whether the response redirects to one of
+// the given hosts
+func RedirectHostIs(hosts ...string) RespCondition {
+	hostSet := make(map[string]bool)
+	for _, h := range hosts {
+		hostSet[strings.ToLower(h)] = true
+	}
+	return RespConditionFunc(func(resp *http.Response, ctx *ProxyCtx) bool {
+		if resp == nil || resp.StatusCode < 300 || resp.StatusCode >= 400 {
+			return false
+		}
+		location := resp.Header.Get("Location")
+		if location == "" {
+			return false
+		}
+		u, err := url.Parse(location)
+		if err != nil {
+			return false
+		}
+		if resp.Request != nil && resp.Request.URL != nil {
+			u = resp.Request.URL.ResolveReference(u)
+		}
+		return hostSet[strings.ToLower(u.Hostname())] || hostSet[strings.ToLower(u.Host)]
+	})
+}
+
+// validateResponseHeaders runs the response headers handlers on the upstream response resp,
+// and replaces it with a policy error response if one of them rejects it
+func (proxy *ProxyHttpServer) validateResponseHeaders(resp *http.Response, ctx *ProxyCtx) *http.Response {
+	if resp == nil {
+		return nil
+	}
+	for _, h := range proxy.respHeadersHandlers {
+		if d := ctx.handleResponseHeaders(h, resp); d != nil {
+			ctx.Logf("rejecting response %v: policy %s %s", resp.Status, d.Policy, d.Reason)
+			resp.Body.Close()
+			return ctx.BlockedResponse(http.StatusBadGateway, *d)
+		}
+	}
+	return resp
+}
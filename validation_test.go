@@ -0,0 +1,45 @@
+package goproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestOnResponseHeadersRejectsRedirect(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, "http://blocked.example.com/x", http.StatusFound)
+			return
+		}
+		w.Write([]byte("bobo"))
+	}))
+	defer s.Close()
+
+	proxy := NewProxyHttpServer()
+	proxy.OnResponseHeaders(RedirectHostIs("blocked.example.com")).
+		Reject(PolicyDecision{Policy: "blocklist", RuleID: "r1"})
+	p := httptest.NewServer(proxy)
+	defer p.Close()
+
+	proxyURL, _ := url.Parse(p.URL)
+	client := &http.Client{
+		Transport:     &http.Transport{Proxy: http.ProxyURL(proxyURL)},
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+
+	resp, err := client.Get(s.URL + "/redirect")
+	orFatal("Get", err, t)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway || resp.Header.Get(PolicyRuleIDHeader) != "r1" {
+		t.Errorf("expected the redirect to be rejected, got %v %v", resp.Status, resp.Header)
+	}
+
+	resp, err = client.Get(s.URL + "/")
+	orFatal("Get", err, t)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected other responses to go through, got %v", resp.Status)
+	}
+}
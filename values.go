@@ -0,0 +1,48 @@
+package goproxy
+
+// SetValue stores value under key in ctx, for the later handlers of the request. As with
+// context.Context, key should be of an unexported type of the package setting it, so that the
+// values of independent handlers never collide, and the package should export typed accessors
+// rather than the key:
+//
+//	type sessionKey struct{}
+//
+//	func SetSession(ctx *goproxy.ProxyCtx, s *Session) { ctx.SetValue(sessionKey{}, s) }
+//
+//	func GetSession(ctx *goproxy.ProxyCtx) (*Session, bool) {
+//		s, ok := ctx.Value(sessionKey{}).(*Session)
+//		return s, ok
+//	}
+//
+// Setting a nil value removes the key. As the other fields of ProxyCtx, the values must not
+// be set concurrently.
+func (ctx *ProxyCtx) SetValue(key, value interface{}) {
+	if key == nil {
+		panic("goproxy: nil value key")
+	}
+	if value == nil {
+		delete(ctx.values, key)
+		return
+	}
+	if ctx.values == nil {
+		ctx.values = make(map[interface{}]interface{})
+	}
+	ctx.values[key] = value
+}
+
+// Value returns the value stored under key in ctx, or nil
+func (ctx *ProxyCtx) Value(key interface{}) interface{} {
+	return ctx.values[key]
+}
+
+// cloneValues returns a copy of the values of ctx
+func (ctx *ProxyCtx) cloneValues() map[interface{}]interface{} {
+	if ctx.values == nil {
+		return nil
+	}
+	values := make(map[interface{}]interface{}, len(ctx.values))
+	for k, v := range ctx.values {
+		values[k] = v
+	}
+	return values
+}
@@ -0,0 +1,28 @@
+package goproxy
+
+import "testing"
+
+type testKey struct{}
+
+type otherKey struct{}
+
+func TestValues(t *testing.T) {
+	ctx := &ProxyCtx{}
+	if ctx.Value(testKey{}) != nil {
+		t.Error("expected no value")
+	}
+	ctx.SetValue(testKey{}, "bobo")
+	ctx.SetValue(otherKey{}, 42)
+	if v, ok := ctx.Value(testKey{}).(string); !ok || v != "bobo" {
+		t.Errorf("unexpected value %v", ctx.Value(testKey{}))
+	}
+	if v, ok := ctx.Value(otherKey{}).(int); !ok || v != 42 {
+		t.Errorf("unexpected value %v", ctx.Value(otherKey{}))
+	}
+
+	bg := ctx.background(nil)
+	bg.SetValue(testKey{}, nil)
+	if bg.Value(testKey{}) != nil || ctx.Value(testKey{}) != "bobo" {
+		t.Error("expected the values of the background context to be a copy")
+	}
+}
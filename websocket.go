@@ -0,0 +1,369 @@
+package goproxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The opcodes of the WebSocket frames, see RFC 6455
+const (
+	WebSocketContinuation = 0x0
+	WebSocketText         = 0x1
+	WebSocketBinary       = 0x2
+	WebSocketClose        = 0x8
+	WebSocketPing         = 0x9
+	WebSocketPong         = 0xa
+)
+
+// maxWebSocketMessage bounds the size of the messages of intercepted WebSockets
+const maxWebSocketMessage = 16 << 20
+
+// WebSocketMessage is a data message relayed through a WebSocket intercepted by the proxy,
+// reassembled from its fragments
+type WebSocketMessage struct {
+	// FromClient is true for the messages of the client, false for those of the server
+	FromClient bool
+	// Opcode is WebSocketText or WebSocketBinary
+	Opcode  int
+	Payload []byte
+}
+
+// WebSocketHandler inspects the messages of the WebSockets upgraded through the proxy. It
+// returns the message to relay, possibly modified, or nil to drop it.
+type WebSocketHandler interface {
+	HandleWebSocketMessage(msg *WebSocketMessage, ctx *ProxyCtx) *WebSocketMessage
+}
+
+// FuncWebSocketHandler.HandleWebSocketMessage(msg,ctx) <=> FuncWebSocketHandler(msg,ctx)
+type FuncWebSocketHandler func(msg *WebSocketMessage, ctx *ProxyCtx) *WebSocketMessage
+
+func (f FuncWebSocketHandler) HandleWebSocketMessage(msg *WebSocketMessage, ctx *ProxyCtx) *WebSocketMessage {
+	return f(msg, ctx)
+}
+
+// WebSocketConds aggregates ReqConditions for the WebSocket handlers of a ProxyHttpServer
+type WebSocketConds struct {
+	proxy    *ProxyHttpServer
+	reqConds []ReqCondition
+}
+
+// OnWebSocketMessage is used to inspect, modify or drop the messages of the WebSockets
+// upgraded through the proxy, over plain HTTP or MITM'd CONNECT requests. The conditions are
+// tested against the upgrade request, ctx.Req. The control frames (ping, pong, close) are
+// relayed as they are, and the compression extensions are not negotiated so that the
+// handlers see the payloads in clear. For example, to drop the messages of the server
+// containing "secret":
+//
+//	proxy.OnWebSocketMessage().DoFunc(func(msg *goproxy.WebSocketMessage, ctx *goproxy.ProxyCtx) *goproxy.WebSocketMessage {
+//		if !msg.FromClient && bytes.Contains(msg.Payload, []byte("secret")) {
+//			return nil
+//		}
+//		return msg
+//	})
+func (proxy *ProxyHttpServer) OnWebSocketMessage(conds ...ReqCondition) *WebSocketConds {
+	return &WebSocketConds{proxy, conds}
+}
+
+// Do registers h, it is called for the messages of the WebSockets whose upgrade request
+// matches all the conditions
+func (pcond *WebSocketConds) Do(h WebSocketHandler) {
+	pcond.proxy.webSocketHandlers = append(pcond.proxy.webSocketHandlers,
+		FuncWebSocketHandler(func(msg *WebSocketMessage, ctx *ProxyCtx) *WebSocketMessage {
+			for _, cond := range pcond.reqConds {
+				if !cond.HandleReq(ctx.Req, ctx) {
+					return msg
+				}
+			}
+			return h.HandleWebSocketMessage(msg, ctx)
+		}))
+}
+
+// DoFunc is equivalent to proxy.OnWebSocketMessage().Do(FuncWebSocketHandler(f))
+func (pcond *WebSocketConds) DoFunc(f func(msg *WebSocketMessage, ctx *ProxyCtx) *WebSocketMessage) {
+	pcond.Do(FuncWebSocketHandler(f))
+}
+
+// isWebSocketRequest reports whether r asks to upgrade its connection to a WebSocket
+func isWebSocketRequest(r *http.Request) bool {
+	return strings.EqualFold(upgradeProtocol(r), "websocket")
+}
+
+// hijackWebSocket serves the WebSocket upgrade request r of a plain HTTP client
+func (proxy *ProxyHttpServer) hijackWebSocket(w http.ResponseWriter, r *http.Request, ctx *ProxyCtx) {
+	hij, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "cannot upgrade the connection", http.StatusInternalServerError)
+		return
+	}
+	conn, brw, err := hij.Hijack()
+	if err != nil {
+		ctx.Warnf("Cannot hijack the WebSocket connection: %v", err)
+		return
+	}
+	client := hijackedConn(conn, brw)
+	defer client.Close()
+	proxy.serveWebSocket(ctx, r, client, client)
+}
+
+// serveWebSocket sends the WebSocket upgrade request req upstream, answers the client with
+// the response of the server, and relays the WebSocket once both sides switched protocols.
+// The client is read from r, which may buffer conn.
+func (proxy *ProxyHttpServer) serveWebSocket(ctx *ProxyCtx, req *http.Request, r io.Reader, conn net.Conn) {
+	removeProxyHeaders(ctx, req)
+	req.Header.Set("Connection", "Upgrade")
+	if len(proxy.webSocketHandlers) > 0 {
+		req.Header.Del("Sec-WebSocket-Extensions")
+	}
+	resp, err := ctx.roundTripWebSocket(req)
+	if err != nil {
+		ctx.Warnf("Cannot upgrade the WebSocket to %s: %v", req.URL.Host, err)
+		resp = NewResponse(req, ContentTypeText, http.StatusBadGateway, "Bad Gateway")
+	}
+	upstream, ok := resp.Body.(io.ReadWriteCloser)
+	if resp.StatusCode != http.StatusSwitchingProtocols || !ok {
+		resp = proxy.filterResponse(proxy.validateResponseHeaders(resp, ctx), ctx)
+		if resp == nil {
+			return
+		}
+		defer resp.Body.Close()
+		resp.Close = true
+		if err := resp.Write(conn); err != nil {
+			ctx.Warnf("Cannot write the WebSocket upgrade response: %v", err)
+		}
+		return
+	}
+	defer upstream.Close()
+	if err := writeUpgradeResponse(conn, resp); err != nil {
+		ctx.Warnf("Cannot write the WebSocket upgrade response: %v", err)
+		return
+	}
+	ctx.Debugf(DebugMitm, "WebSocket upgraded to %s", req.URL.Host)
+	proxy.relayWebSocket(ctx, r, conn, upstream, upstream, func() {
+		conn.Close()
+		upstream.Close()
+	})
+}
+
+// roundTripWebSocket sends the upgrade request req through a transport of its own, dialing
+// through the forward proxy of ctx if any, so that its 101 response carries the upgraded
+// connection as its body
+func (ctx *ProxyCtx) roundTripWebSocket(req *http.Request) (*http.Response, error) {
+	tlsConfig := &tls.Config{}
+	if ctx.Proxy.Tr != nil && ctx.Proxy.Tr.TLSClientConfig != nil {
+		tlsConfig = ctx.Proxy.Tr.TLSClientConfig.Clone()
+	}
+	tr := &http.Transport{
+		DialContext:         dialHTTP2,
+		TLSClientConfig:     tlsConfig,
+		TLSHandshakeTimeout: 15 * time.Second,
+		DisableKeepAlives:   true,
+	}
+	if ctx.ForwardProxy != "" {
+		if ctx.ForwardProxyProto == "" {
+			ctx.ForwardProxyProto = "http"
+		}
+		dial := ctx.Proxy.NewConnectDialWithKeepAlives(ctx, ctx.ForwardProxyProto+"://"+ctx.ForwardProxy, func(req *http.Request) {
+			if ctx.ForwardProxyAuth != "" {
+				req.Header.Set("Proxy-Authorization", "Basic "+ctx.ForwardProxyAuth)
+			}
+		})
+		tr.DialContext = func(c context.Context, network, addr string) (net.Conn, error) {
+			return dial(network, addr)
+		}
+	}
+	ctx.setUpstreamUserAgent(req)
+	out := req.WithContext(withProxyCtx(req.Context(), ctx))
+	out.RequestURI = ""
+	return tr.RoundTrip(out)
+}
+
+// writeUpgradeResponse writes the header of the 101 Switching Protocols response resp to w,
+// which Response.Write would turn into a closing response
+func writeUpgradeResponse(w io.Writer, resp *http.Response) error {
+	if _, err := fmt.Fprintf(w, "HTTP/1.1 %s\r\n", resp.Status); err != nil {
+		return err
+	}
+	if err := resp.Header.Write(w); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\r\n")
+	return err
+}
+
+// relayWebSocket relays an upgraded WebSocket between the client and the server, through the
+// WebSocket handlers if any. closeAll closes both connections.
+func (proxy *ProxyHttpServer) relayWebSocket(ctx *ProxyCtx, clientR io.Reader, clientW io.Writer, serverR io.Reader, serverW io.Writer, closeAll func()) {
+	var sent, received int64
+	var wg sync.WaitGroup
+	wg.Add(2)
+	relay := func(dst io.Writer, src io.Reader, fromClient bool, n *int64) {
+		defer wg.Done()
+		var err error
+		if len(proxy.webSocketHandlers) == 0 {
+			*n, err = io.Copy(dst, src)
+		} else {
+			*n, err = proxy.relayWebSocketMessages(ctx, dst, src, fromClient)
+		}
+		// a side done without a close frame ends the WebSocket, otherwise the other side
+		// answers the close frame and ends it
+		if err != nil || len(proxy.webSocketHandlers) == 0 {
+			closeAll()
+		}
+	}
+	go relay(serverW, clientR, true, &sent)
+	go relay(clientW, serverR, false, &received)
+	wg.Wait()
+	closeAll()
+	ctx.BytesSent += sent
+	ctx.BytesReceived += received
+	proxy.account(ctx)
+}
+
+// relayWebSocketMessages relays the frames read from src to dst, reassembling the data
+// messages for the WebSocket handlers. It returns the size of the payloads relayed, and a nil
+// error once it relayed a close frame.
+func (proxy *ProxyHttpServer) relayWebSocketMessages(ctx *ProxyCtx, dst io.Writer, src io.Reader, fromClient bool) (int64, error) {
+	br := bufio.NewReader(src)
+	var n int64
+	var msg *WebSocketMessage
+	for {
+		fin, opcode, payload, err := readWebSocketFrame(br)
+		if err != nil {
+			return n, err
+		}
+		if opcode >= WebSocketClose {
+			if err := writeWebSocketFrame(dst, opcode, payload, fromClient); err != nil {
+				return n, err
+			}
+			n += int64(len(payload))
+			if opcode == WebSocketClose {
+				return n, nil
+			}
+			continue
+		}
+		if opcode == WebSocketContinuation {
+			if msg == nil {
+				return n, errors.New("unexpected WebSocket continuation frame")
+			}
+			if len(msg.Payload)+len(payload) > maxWebSocketMessage {
+				return n, errors.New("WebSocket message too large")
+			}
+			msg.Payload = append(msg.Payload, payload...)
+		} else {
+			if msg != nil {
+				return n, errors.New("unexpected WebSocket data frame within a fragmented message")
+			}
+			msg = &WebSocketMessage{FromClient: fromClient, Opcode: opcode, Payload: payload}
+		}
+		if !fin {
+			continue
+		}
+		for _, h := range proxy.webSocketHandlers {
+			if msg = ctx.handleWebSocketMessage(h, msg); msg == nil {
+				break
+			}
+		}
+		if msg != nil {
+			if err := writeWebSocketFrame(dst, msg.Opcode, msg.Payload, fromClient); err != nil {
+				return n, err
+			}
+			n += int64(len(msg.Payload))
+		}
+		msg = nil
+	}
+}
+
+// readWebSocketFrame reads a frame from r and returns its payload unmasked
+func readWebSocketFrame(r *bufio.Reader) (fin bool, opcode int, payload []byte, err error) {
+	var header [2]byte
+	if _, err = io.ReadFull(r, header[:]); err != nil {
+		return
+	}
+	fin, opcode = header[0]&0x80 != 0, int(header[0]&0x0f)
+	if header[0]&0x70 != 0 {
+		err = errors.New("unsupported WebSocket extension")
+		return
+	}
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(r, ext[:]); err != nil {
+			return
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(r, ext[:]); err != nil {
+			return
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if length > maxWebSocketMessage {
+		err = errors.New("WebSocket frame too large")
+		return
+	}
+	var key [4]byte
+	if masked {
+		if _, err = io.ReadFull(r, key[:]); err != nil {
+			return
+		}
+	}
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(r, payload); err != nil {
+		return
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= key[i%4]
+		}
+	}
+	return
+}
+
+// writeWebSocketFrame writes payload as a single frame to w, masked for the frames sent to
+// the server
+func writeWebSocketFrame(w io.Writer, opcode int, payload []byte, mask bool) error {
+	frame := make([]byte, 0, 14+len(payload))
+	frame = append(frame, 0x80|byte(opcode))
+	var maskBit byte
+	if mask {
+		maskBit = 0x80
+	}
+	switch length := len(payload); {
+	case length < 126:
+		frame = append(frame, maskBit|byte(length))
+	case length <= 0xffff:
+		frame = append(frame, maskBit|126, byte(length>>8), byte(length))
+	default:
+		var ext [8]byte
+		binary.BigEndian.PutUint64(ext[:], uint64(length))
+		frame = append(append(frame, maskBit|127), ext[:]...)
+	}
+	if !mask {
+		_, err := w.Write(append(frame, payload...))
+		return err
+	}
+	var key [4]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return err
+	}
+	frame = append(frame, key[:]...)
+	for i, b := range payload {
+		frame = append(frame, b^key[i%4])
+	}
+	_, err := w.Write(frame)
+	return err
+}
@@ -0,0 +1,129 @@
+package goproxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// webSocketEcho upgrades the requests to WebSockets echoing the messages of the client
+var webSocketEcho = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	if !isWebSocketRequest(r) || r.Header.Get("Sec-WebSocket-Extensions") != "" {
+		http.Error(w, "unexpected upgrade request", http.StatusBadRequest)
+		return
+	}
+	conn, brw, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+	for {
+		_, opcode, payload, err := readWebSocketFrame(brw.Reader)
+		if err != nil {
+			return
+		}
+		if err := writeWebSocketFrame(conn, opcode, payload, false); err != nil || opcode == WebSocketClose {
+			return
+		}
+	}
+})
+
+// dialWebSocket sends a WebSocket upgrade request for u on conn
+func dialWebSocket(t *testing.T, conn net.Conn, u string) *bufio.Reader {
+	req, _ := http.NewRequest("GET", u, nil)
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	req.Header.Set("Sec-WebSocket-Extensions", "permessage-deflate")
+	if strings.HasPrefix(u, "http:") {
+		orFatal("WriteProxy", req.WriteProxy(conn), t)
+	} else {
+		orFatal("Write", req.Write(conn), t)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	orFatal("ReadResponse", err, t)
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("unexpected upgrade response %s", resp.Status)
+	}
+	return br
+}
+
+func testWebSocketMessages(t *testing.T, conn net.Conn, br *bufio.Reader) {
+	for _, s := range []string{"drop", "hello", strings.Repeat("x", 70000)} {
+		orFatal("writeWebSocketFrame", writeWebSocketFrame(conn, WebSocketText, []byte(s), true), t)
+	}
+	// a message fragmented in two frames
+	io.WriteString(conn, "\x01\x03abc")
+	io.WriteString(conn, "\x80\x03def")
+	for _, expected := range []string{"HELLO", strings.Repeat("X", 70000), "ABCDEF"} {
+		_, opcode, payload, err := readWebSocketFrame(br)
+		orFatal("readWebSocketFrame", err, t)
+		if opcode != WebSocketText || string(payload) != expected {
+			t.Fatalf("unexpected message %d %.20q", opcode, payload)
+		}
+	}
+	orFatal("writeWebSocketFrame", writeWebSocketFrame(conn, WebSocketClose, []byte{3, 232}, true), t)
+	if _, opcode, _, err := readWebSocketFrame(br); err != nil || opcode != WebSocketClose {
+		t.Fatalf("unexpected close answer %d %v", opcode, err)
+	}
+}
+
+func newWebSocketProxy() *ProxyHttpServer {
+	proxy := NewProxyHttpServer()
+	proxy.OnWebSocketMessage().DoFunc(func(msg *WebSocketMessage, ctx *ProxyCtx) *WebSocketMessage {
+		if msg.FromClient && string(msg.Payload) == "drop" {
+			return nil
+		}
+		return msg
+	})
+	proxy.OnWebSocketMessage().DoFunc(func(msg *WebSocketMessage, ctx *ProxyCtx) *WebSocketMessage {
+		if !msg.FromClient {
+			msg.Payload = bytes.ToUpper(msg.Payload)
+		}
+		return msg
+	})
+	return proxy
+}
+
+func TestWebSocketHTTP(t *testing.T) {
+	server := httptest.NewServer(webSocketEcho)
+	defer server.Close()
+	s := httptest.NewServer(newWebSocketProxy())
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", s.Listener.Addr().String())
+	orFatal("Dial", err, t)
+	defer conn.Close()
+	testWebSocketMessages(t, conn, dialWebSocket(t, conn, server.URL+"/ws"))
+}
+
+func TestWebSocketMitm(t *testing.T) {
+	server := httptest.NewTLSServer(webSocketEcho)
+	defer server.Close()
+	proxy := newWebSocketProxy()
+	proxy.OnRequest().HandleConnect(AlwaysMitm)
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", s.Listener.Addr().String())
+	orFatal("Dial", err, t)
+	defer conn.Close()
+	host := server.Listener.Addr().String()
+	io.WriteString(conn, "CONNECT "+host+" HTTP/1.1\r\nHost: "+host+"\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	orFatal("ReadResponse", err, t)
+	if resp.StatusCode != 200 {
+		t.Fatalf("unexpected CONNECT response %s", resp.Status)
+	}
+	tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+	testWebSocketMessages(t, tlsConn, dialWebSocket(t, tlsConn, "https://"+host+"/ws"))
+}
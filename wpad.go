@@ -0,0 +1,43 @@
+package goproxy
+
+import (
+	"errors"
+	"net/http"
+)
+
+// wpadPaths are the paths the WPAD clients fetch the PAC file at: wpad.dat, wpad.da for the
+// old Internet Explorers truncating the name, and proxy.pac
+var wpadPaths = map[string]bool{"/wpad.dat": true, "/wpad.da": true, "/proxy.pac": true}
+
+// WPADHandler returns a handler serving the PAC file generated from the LocalDestinations of
+// the proxy at the WPAD paths, so that the clients discovering their proxy through the wpad
+// DNS name or DHCP are configured without manual settings. Serve it as the NonproxyHandler of
+// the proxy on the address the wpad name resolves to, e.g.
+//
+//	proxy.NonproxyHandler = proxy.WPADHandler("proxy.example.com:3128", proxy.NonproxyHandler)
+//
+// The other requests are served by next. proxyAddr is the address the clients reach the proxy
+// at, the address they connected to if empty.
+func (proxy *ProxyHttpServer) WPADHandler(proxyAddr string, next http.Handler) http.Handler {
+	pac := proxy.PACHandler(proxyAddr)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if (r.Method == "GET" || r.Method == "HEAD") && wpadPaths[r.URL.Path] {
+			pac.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// dhcpOptionWPAD is the private DHCP option used by WPAD clients
+const dhcpOptionWPAD = 252
+
+// WPADDHCPOption returns DHCP option 252 announcing the PAC file at pacURL, e.g.
+// "http://wpad.example.com/wpad.dat", encoded as code, length and value, for DHCP servers
+// taking raw options
+func WPADDHCPOption(pacURL string) ([]byte, error) {
+	if pacURL == "" || len(pacURL) > 255 {
+		return nil, errors.New("the PAC URL must be between 1 and 255 bytes long")
+	}
+	return append([]byte{dhcpOptionWPAD, byte(len(pacURL))}, pacURL...), nil
+}
@@ -0,0 +1,139 @@
+package goproxy
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// WriteCoalescing batches the small writes relayed through the CONNECT tunnels of chatty
+// protocols, to send fewer packets on expensive links: the writes are held until Size
+// bytes are buffered or Delay elapsed since the first of them. The tunnels with a
+// WriteCoalescing are relayed with goroutines, whatever their TunnelEngine.
+type WriteCoalescing struct {
+	// Delay is how long a write is held at most, 2ms if zero
+	Delay time.Duration
+	// Size is the number of bytes sent at once, 16KB if zero. Larger writes are not held.
+	Size int
+	// Nagle enables Nagle's algorithm on both connections of the tunnels, Go disables it by
+	// default
+	Nagle bool
+}
+
+// writeCoalescing returns the WriteCoalescing of the tunnel of ctx, nil if its writes are
+// relayed as they are
+func (ctx *ProxyCtx) writeCoalescing() *WriteCoalescing {
+	if ctx.WriteCoalescing != nil {
+		return ctx.WriteCoalescing
+	}
+	if ctx.Proxy != nil {
+		return ctx.Proxy.WriteCoalescing
+	}
+	return nil
+}
+
+func (wc *WriteCoalescing) delay() time.Duration {
+	if wc.Delay > 0 {
+		return wc.Delay
+	}
+	return 2 * time.Millisecond
+}
+
+func (wc *WriteCoalescing) size() int {
+	if wc.Size > 0 {
+		return wc.Size
+	}
+	return 16 * 1024
+}
+
+// enableNagle enables Nagle's algorithm on conn if it is a TCP connection
+func enableNagle(conn net.Conn) {
+	if c, ok := conn.(*ProxyTCPConn); ok {
+		conn = c.Conn
+	}
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		tcp.SetNoDelay(false)
+	}
+}
+
+// coalescingWriter holds the small writes to w as set by a WriteCoalescing. The error of a
+// delayed write is returned by the next Write.
+type coalescingWriter struct {
+	w     io.Writer
+	delay time.Duration
+	size  int
+
+	mu    sync.Mutex
+	buf   []byte
+	timer *time.Timer
+	armed bool
+	err   error
+}
+
+func newCoalescingWriter(w io.Writer, wc *WriteCoalescing) *coalescingWriter {
+	c := &coalescingWriter{w: w, delay: wc.delay(), size: wc.size()}
+	c.buf = make([]byte, 0, c.size)
+	return c
+}
+
+func (c *coalescingWriter) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.err; err != nil {
+		c.err = nil
+		return 0, err
+	}
+	if len(c.buf)+len(p) > c.size {
+		if err := c.flushLocked(); err != nil {
+			return 0, err
+		}
+		if len(p) >= c.size {
+			return c.w.Write(p)
+		}
+	}
+	c.buf = append(c.buf, p...)
+	if len(c.buf) >= c.size {
+		if err := c.flushLocked(); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	if !c.armed {
+		c.armed = true
+		if c.timer == nil {
+			c.timer = time.AfterFunc(c.delay, c.delayedFlush)
+		} else {
+			c.timer.Reset(c.delay)
+		}
+	}
+	return len(p), nil
+}
+
+func (c *coalescingWriter) delayedFlush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.armed {
+		c.err = c.flushLocked()
+	}
+}
+
+func (c *coalescingWriter) flushLocked() error {
+	if c.armed {
+		c.armed = false
+		c.timer.Stop()
+	}
+	if len(c.buf) == 0 {
+		return nil
+	}
+	_, err := c.w.Write(c.buf)
+	c.buf = c.buf[:0]
+	return err
+}
+
+// Flush writes the bytes held
+func (c *coalescingWriter) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.flushLocked()
+}
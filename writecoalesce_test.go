@@ -0,0 +1,55 @@
+package goproxy
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingWriter records the writes it is given
+type recordingWriter struct {
+	mu     sync.Mutex
+	writes []string
+}
+
+func (w *recordingWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	w.writes = append(w.writes, string(p))
+	w.mu.Unlock()
+	return len(p), nil
+}
+
+func (w *recordingWriter) recorded() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]string(nil), w.writes...)
+}
+
+func TestCoalescingWriter(t *testing.T) {
+	rec := &recordingWriter{}
+	cw := newCoalescingWriter(rec, &WriteCoalescing{Delay: 20 * time.Millisecond, Size: 64})
+	for i := 0; i < 5; i++ {
+		cw.Write([]byte("ping "))
+	}
+	if writes := rec.recorded(); len(writes) != 0 {
+		t.Errorf("writes not held: %q", writes)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if writes := rec.recorded(); len(writes) != 1 || writes[0] != strings.Repeat("ping ", 5) {
+		t.Errorf("writes not coalesced: %q", writes)
+	}
+
+	// reaching Size flushes the writes held, larger writes are not held
+	cw.Write(bytes.Repeat([]byte("a"), 40))
+	cw.Write(bytes.Repeat([]byte("b"), 40))
+	cw.Write(bytes.Repeat([]byte("c"), 100))
+	cw.Write([]byte("end"))
+	cw.Flush()
+	writes := rec.recorded()[1:]
+	if len(writes) != 4 || writes[0] != strings.Repeat("a", 40) || writes[1] != strings.Repeat("b", 40) ||
+		len(writes[2]) != 100 || writes[3] != "end" {
+		t.Errorf("unexpected writes %q", writes)
+	}
+}